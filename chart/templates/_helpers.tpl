@@ -76,3 +76,27 @@ Create the name of the service account to use
 {{- default "default" .Values.serviceAccount.name }}
 {{- end }}
 {{- end }}
+
+{{/*
+Create the name of the TLS Secret of the endpoints requiring authentication
+*/}}
+{{- define "harvester-vm-dhcp-controller.apiTLSSecretName" -}}
+{{- default (printf "%s-api-tls" (include "harvester-vm-dhcp-controller.fullname" .)) .Values.apiTLS.secretName }}
+{{- end }}
+
+{{/*
+Multus network selection elements attaching the controller to the networks of
+its embedded agents.
+*/}}
+{{- define "harvester-vm-dhcp-controller.embeddedAgentNetworks" -}}
+{{- $networks := list }}
+{{- range . }}
+{{- $parts := splitList "/" .network }}
+{{- $network := dict "namespace" (first $parts) "name" (last $parts) "interface" .interface }}
+{{- with .ip }}
+{{- $_ := set $network "ips" (list .) }}
+{{- end }}
+{{- $networks = append $networks $network }}
+{{- end }}
+{{- toJson $networks }}
+{{- end }}
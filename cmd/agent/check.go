@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rancher/wrangler/v3/pkg/signals"
+	"github.com/spf13/cobra"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/agent"
+	"github.com/harvester/vm-dhcp-controller/pkg/agent/dhcpcheck"
+)
+
+var (
+	checkOptions    dhcpcheck.Options
+	checkResultPath string
+)
+
+// checkCmd runs a single DHCP exchange against the agent of an IPPool with
+// the test MAC address and records the result. It's run by the checker Pods
+// the controller launches for the DHCP checks.
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the DHCP service of an IPPool end to end",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := signals.SetupSignalContext()
+
+		result := dhcpcheck.Run(ctx, checkOptions)
+		if err := dhcpcheck.WriteResult(checkResultPath, result); err != nil {
+			return fmt.Errorf("cannot record dhcp check result: %w", err)
+		}
+
+		if !result.Succeeded {
+			fmt.Fprintf(os.Stderr, "dhcp check failed: %s\n", result.Message)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	checkCmd.Flags().StringVar(&checkOptions.Nic, "nic", agent.DefaultNetworkInterface, "The network interface attached to the network of the IPPool")
+	checkCmd.Flags().StringVar(&checkOptions.MACAddress, "mac", "", "The test MAC address to run the exchange with")
+	checkCmd.Flags().StringVar(&checkOptions.ServerIP, "server-ip", "", "The address of the agent expected to answer")
+	checkCmd.Flags().DurationVar(&checkOptions.Timeout, "timeout", dhcpcheck.DefaultTimeout, "How long the whole exchange may take")
+	checkCmd.Flags().StringVar(&checkResultPath, "result-path", dhcpcheck.TerminationMessagePath, "The file to record the result in")
+	_ = checkCmd.MarkFlagRequired("mac")
+
+	rootCmd.AddCommand(checkCmd)
+}
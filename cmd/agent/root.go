@@ -19,12 +19,16 @@ var (
 	logTrace bool
 
 	name               string
+	namespace          string
 	dryRun             bool
 	nic                string
 	enableCacheDumpAPI bool
 	kubeConfigPath     string
 	kubeContext        string
 	ippoolRef          string
+	verifyCIDR         string
+	verifyRouter       string
+	verifyMTU          int
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -45,6 +49,8 @@ var rootCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		ipPoolNamespace, ipPoolName := kv.RSplit(ippoolRef, "/")
 		options := &config.AgentOptions{
+			Name:           name,
+			Namespace:      namespace,
 			DryRun:         dryRun,
 			Nic:            nic,
 			KubeConfigPath: kubeConfigPath,
@@ -53,6 +59,9 @@ var rootCmd = &cobra.Command{
 				Namespace: ipPoolNamespace,
 				Name:      ipPoolName,
 			},
+			VerifyCIDR:   verifyCIDR,
+			VerifyRouter: verifyRouter,
+			VerifyMTU:    verifyMTU,
 		}
 
 		if err := run(options); err != nil {
@@ -70,12 +79,16 @@ func init() {
 	rootCmd.PersistentFlags().BoolVar(&logTrace, "trace", trace, "set logging level to trace")
 
 	rootCmd.Flags().StringVar(&name, "name", os.Getenv("VM_DHCP_AGENT_NAME"), "The name of the vm-dhcp-agent instance")
+	rootCmd.Flags().StringVar(&namespace, "namespace", os.Getenv("POD_NAMESPACE"), "The namespace of the vm-dhcp-agent instance")
 	rootCmd.Flags().StringVar(&kubeConfigPath, "kubeconfig", os.Getenv("KUBECONFIG"), "Path to the kubeconfig file")
 	rootCmd.Flags().StringVar(&kubeContext, "kubecontext", os.Getenv("KUBECONTEXT"), "Context name")
 	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Run vm-dhcp-agent without starting the DHCP server")
 	rootCmd.Flags().BoolVar(&enableCacheDumpAPI, "enable-cache-dump-api", false, "Enable cache dump APIs")
 	rootCmd.Flags().StringVar(&ippoolRef, "ippool-ref", os.Getenv("IPPOOL_REF"), "The IPPool object the agent should sync with")
 	rootCmd.Flags().StringVar(&nic, "nic", agent.DefaultNetworkInterface, "The network interface the embedded DHCP server listens on")
+	rootCmd.Flags().StringVar(&verifyCIDR, "verify-cidr", "", "Verify the network interface is attached to the given subnet and report mismatches")
+	rootCmd.Flags().StringVar(&verifyRouter, "verify-router", "", "Verify the given router answers ICMP echo requests")
+	rootCmd.Flags().IntVar(&verifyMTU, "verify-mtu", 0, "Verify the network interface has the given MTU")
 }
 
 // execute adds all child commands to the root command and sets flags appropriately.
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/validation"
+)
+
+var lintFiles []string
+
+// lintCmd checks the IPPools of manifests offline, with the same spec checks
+// as the webhook, e.g., before committing them to a GitOps repository.
+var lintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "Check the IPPools of manifests without a cluster",
+	Long: `Check the IPPools of YAML or JSON manifests with the same spec checks as the webhook.
+The checks needing the cluster, e.g., overlaps with other IPPools, are left out.
+Other kinds of objects in the manifests are skipped.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		invalid := 0
+		for _, file := range lintFiles {
+			n, err := lintFile(cmd.OutOrStdout(), file)
+			if err != nil {
+				return err
+			}
+			invalid += n
+		}
+
+		if invalid > 0 {
+			return fmt.Errorf("%d invalid ippool(s) found", invalid)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	lintCmd.Flags().StringArrayVarP(&lintFiles, "filename", "f", nil, "The manifest to check (- for stdin), can be given multiple times")
+	_ = lintCmd.MarkFlagRequired("filename")
+
+	rootCmd.AddCommand(lintCmd)
+}
+
+func lintFile(out io.Writer, file string) (int, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	return lintIPPools(out, file, r)
+}
+
+// lintIPPools prints the spec errors of each IPPool of the manifest read from
+// r, and returns the amount of IPPools having any.
+func lintIPPools(out io.Writer, file string, r io.Reader) (int, error) {
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+
+	invalid := 0
+	for {
+		var ipPool networkv1.IPPool
+		if err := decoder.Decode(&ipPool); err != nil {
+			if errors.Is(err, io.EOF) {
+				return invalid, nil
+			}
+			return invalid, fmt.Errorf("cannot decode %s: %w", file, err)
+		}
+
+		if ipPool.Kind != "IPPool" || ipPool.APIVersion != networkv1.SchemeGroupVersion.String() {
+			continue
+		}
+
+		errs := validation.ValidateIPPoolSpec(&ipPool)
+		if len(errs) == 0 {
+			continue
+		}
+
+		invalid++
+		name := ipPool.Name
+		if ipPool.Namespace != "" {
+			name = ipPool.Namespace + "/" + ipPool.Name
+		}
+		for _, err := range errs {
+			fmt.Fprintf(out, "%s: ippool %s: %s\n", file, name, err.Error())
+		}
+	}
+}
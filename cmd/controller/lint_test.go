@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLintIPPools(t *testing.T) {
+	manifest := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: not-an-ippool
+---
+apiVersion: network.harvesterhci.io/v1alpha1
+kind: IPPool
+metadata:
+  namespace: default
+  name: net-48
+spec:
+  ipv4Config:
+    serverIP: 192.168.48.77
+    cidr: 192.168.48.0/24
+    pool:
+      start: 192.168.48.81
+      end: 192.168.48.90
+  networkName: default/net-48
+---
+apiVersion: network.harvesterhci.io/v1alpha1
+kind: IPPool
+metadata:
+  namespace: default
+  name: net-49
+spec:
+  ipv4Config:
+    serverIP: 192.168.49.255
+    cidr: 192.168.49.0/24
+    pool:
+      start: 192.168.50.81
+  networkName: default/net-49
+`
+
+	var out bytes.Buffer
+	invalid, err := lintIPPools(&out, "ippools.yaml", strings.NewReader(manifest))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, invalid)
+	assert.Equal(t, `ippools.yaml: ippool default/net-49: spec.ipv4Config.pool.start: Invalid value: "192.168.50.81": must be within subnet 192.168.49.0/24
+ippools.yaml: ippool default/net-49: spec.ipv4Config.serverIP: Invalid value: "192.168.49.255": must not be the broadcast ip
+`, out.String())
+
+	_, err = lintIPPools(&out, "broken.yaml", strings.NewReader("kind: [IPPool"))
+	assert.NotNil(t, err)
+}
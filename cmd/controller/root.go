@@ -2,13 +2,16 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
 	"github.com/harvester/vm-dhcp-controller/pkg/util"
 )
 
@@ -16,14 +19,34 @@ var (
 	logDebug bool
 	logTrace bool
 
-	name                    string
-	noLeaderElection        bool
-	noAgent                 bool
-	enableCacheDumpAPI      bool
-	agentNamespace          string
-	agentImage              string
-	agentServiceAccountName string
-	noDHCP                  bool
+	name                        string
+	noLeaderElection            bool
+	noAgent                     bool
+	enableCacheDumpAPI          bool
+	httpPort                    int
+	apiPort                     int
+	apiTLSSecret                string
+	agentNamespace              string
+	agentImage                  string
+	agentServiceAccountName     string
+	noDHCP                      bool
+	pendingMACPolicy            string
+	allocationTiming            string
+	typedAllocationEntries      bool
+	eventDedupWindow            time.Duration
+	maxPoolSize                 int
+	vmNetCfgCreateQPS           float64
+	vmNetCfgCreateBurst         int
+	reconcileTimeout            time.Duration
+	ipConflictQuarantine        time.Duration
+	resyncInterval              time.Duration
+	resyncBurst                 int
+	allocationConfigMaps        bool
+	allocationExemplars         int
+	pinnedAllocationsAnnotation string
+	embeddedAgentNetworks       map[string]string
+	externalIPAMAllowedURLs     []string
+	featureGates                map[string]string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -53,12 +76,57 @@ var rootCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		switch pendingMACPolicy {
+		case config.PendingMACPolicySkip, config.PendingMACPolicyReport, config.PendingMACPolicyGenerate:
+		default:
+			fmt.Fprintf(os.Stderr, "Error: invalid pending MAC policy %q\n", pendingMACPolicy)
+			os.Exit(1)
+		}
+
+		switch allocationTiming {
+		case config.AllocationTimingImmediate, config.AllocationTimingOnFirstStart:
+		default:
+			fmt.Fprintf(os.Stderr, "Error: invalid allocation timing %q\n", allocationTiming)
+			os.Exit(1)
+		}
+
+		for _, allowedURL := range externalIPAMAllowedURLs {
+			if u, err := url.Parse(allowedURL); err != nil || u.Scheme != "https" || u.Host == "" {
+				fmt.Fprintf(os.Stderr, "Error: invalid external IPAM allowed URL %q, must be an absolute https one\n", allowedURL)
+				os.Exit(1)
+			}
+		}
+
+		gates, err := featuregate.New(featureGates)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid feature gates: %v\n", err)
+			os.Exit(1)
+		}
+
 		options := &config.ControllerOptions{
-			NoAgent:                 noAgent,
-			AgentNamespace:          agentNamespace,
-			AgentImage:              image,
-			AgentServiceAccountName: agentServiceAccountName,
-			NoDHCP:                  noDHCP,
+			NoAgent:                     noAgent,
+			AgentNamespace:              agentNamespace,
+			AgentImage:                  image,
+			AgentServiceAccountName:     agentServiceAccountName,
+			NoDHCP:                      noDHCP,
+			EnableCacheDumpAPI:          enableCacheDumpAPI,
+			PendingMACPolicy:            pendingMACPolicy,
+			AllocationTiming:            allocationTiming,
+			TypedAllocationEntries:      typedAllocationEntries,
+			EventDedupWindow:            eventDedupWindow,
+			MaxPoolSize:                 maxPoolSize,
+			VmNetCfgCreateQPS:           vmNetCfgCreateQPS,
+			VmNetCfgCreateBurst:         vmNetCfgCreateBurst,
+			ReconcileTimeout:            reconcileTimeout,
+			IPConflictQuarantine:        ipConflictQuarantine,
+			ResyncInterval:              resyncInterval,
+			ResyncBurst:                 resyncBurst,
+			AllocationConfigMaps:        allocationConfigMaps,
+			AllocationExemplars:         allocationExemplars,
+			PinnedAllocationsAnnotation: pinnedAllocationsAnnotation,
+			EmbeddedAgentNetworks:       embeddedAgentNetworks,
+			ExternalIPAMAllowedURLs:     externalIPAMAllowedURLs,
+			FeatureGates:                gates,
 		}
 
 		if err := run(options); err != nil {
@@ -79,7 +147,27 @@ func init() {
 	rootCmd.Flags().BoolVar(&noLeaderElection, "no-leader-election", false, "Run vm-dhcp-controller with leader-election disabled")
 	rootCmd.Flags().BoolVar(&noAgent, "no-agent", false, "Run vm-dhcp-controller without spawning agents")
 	rootCmd.Flags().BoolVar(&enableCacheDumpAPI, "enable-cache-dump-api", false, "Enable cache dump APIs")
+	rootCmd.Flags().IntVar(&httpPort, "http-port", 8080, "The port the metrics, probes, and other HTTP APIs of the controller are served on")
+	rootCmd.Flags().IntVar(&apiPort, "api-port", 8443, "The port the HTTP APIs of the controller requiring authentication are served on over TLS")
+	rootCmd.Flags().StringVar(&apiTLSSecret, "api-tls-secret", "", "The TLS Secret of the namespace the HTTP APIs requiring authentication are served with, reloaded on change (empty to not serve them)")
 	rootCmd.Flags().BoolVar(&noDHCP, "no-dhcp", false, "Disable DHCP server on the spawned agents")
+	rootCmd.Flags().BoolVar(&typedAllocationEntries, "typed-allocation-entries", false, "Migrate IPPool allocation records to typed entries")
+	rootCmd.Flags().DurationVar(&eventDedupWindow, "event-dedup-window", 10*time.Minute, "How long identical events about an object are held back after one is emitted (0 to disable)")
+	rootCmd.Flags().IntVar(&maxPoolSize, "max-pool-size", util.DefaultMaxPoolSize, "The maximum amount of allocatable addresses of an IPPool after exclusions (0 for no limit)")
+	rootCmd.Flags().Float64Var(&vmNetCfgCreateQPS, "vmnetcfg-create-qps", 20, "The rate at which vmnetcfgs are created for new VMs per second (0 for no limit)")
+	rootCmd.Flags().IntVar(&vmNetCfgCreateBurst, "vmnetcfg-create-burst", 50, "The amount of vmnetcfgs created at once before the rate applies")
+	rootCmd.Flags().DurationVar(&reconcileTimeout, "reconcile-timeout", 2*time.Minute, "How long the handlers of a controller run on a single object before it's requeued with backoff (0 for no limit)")
+	rootCmd.Flags().DurationVar(&ipConflictQuarantine, "ip-conflict-quarantine", time.Hour, "How long IP addresses declined by guests as already in use are kept from being allocated (0 to ignore declines)")
+	rootCmd.Flags().DurationVar(&resyncInterval, "resync-interval", 10*time.Second, "How often, per controller, a resync asked for with the resync annotation may run (0 for no limit)")
+	rootCmd.Flags().IntVar(&resyncBurst, "resync-burst", 5, "The amount of resyncs run at once before the interval applies")
+	rootCmd.Flags().BoolVar(&allocationConfigMaps, "allocation-configmaps", false, "Mirror the allocations of the VMs of each namespace into the "+util.AllocationsConfigMapName+" ConfigMap")
+	rootCmd.Flags().IntVar(&allocationExemplars, "allocation-exemplars", 0, "Count the allocations of each IPPool, with the VM of the latest one as an exemplar for up to this amount of IPPools at a time (0 to disable)")
+	rootCmd.Flags().StringVar(&pinnedAllocationsAnnotation, "pinned-allocations-annotation", "", "Pin the IP addresses allocated to each VM in this annotation of the VM, and restore them from it into IPPools lacking them, e.g., "+util.PinnedAllocationsAnnotationKey+" (empty to disable)")
+	rootCmd.Flags().StringToStringVar(&embeddedAgentNetworks, "embedded-agent-network", nil, "Serve the IPPools of a network from the controller itself on the given nic it's attached to the network with, e.g., default/vlan100=net1, rather than from agent Pods (repeatable)")
+	rootCmd.Flags().StringSliceVar(&externalIPAMAllowedURLs, "external-ipam-allowed-url", nil, "Let the external IPAMs of IPPools be asked at https URLs starting with this one, e.g., https://ipam.example.com/vm-dhcp (repeatable; none disables external IPAMs)")
+	rootCmd.Flags().StringToStringVar(&featureGates, "feature-gates", nil, "Turn optional features on or off, e.g., CNIIPAM=true, overriding the "+featuregate.ConfigMapName+" ConfigMap of the namespace")
+	rootCmd.Flags().StringVar(&pendingMACPolicy, "pending-mac-policy", config.PendingMACPolicySkip, "How to handle VM interfaces without a MAC address on IPPool-backed networks (skip, report, or generate)")
+	rootCmd.Flags().StringVar(&allocationTiming, "allocation-timing", config.AllocationTimingImmediate, "When the IP addresses of VMs are allocated (immediate, or onFirstStart to defer them for VMs created stopped)")
 	rootCmd.Flags().StringVar(&agentNamespace, "namespace", os.Getenv("AGENT_NAMESPACE"), "The namespace for the spawned agents")
 	rootCmd.Flags().StringVar(&agentImage, "image", os.Getenv("AGENT_IMAGE"), "The container image for the spawned agents")
 	rootCmd.Flags().StringVar(&agentServiceAccountName, "service-account-name", os.Getenv("AGENT_SERVICE_ACCOUNT_NAME"), "The service account for the spawned agents")
@@ -6,8 +6,10 @@ import (
 	"log"
 	"net/http"
 
+	wranglercore "github.com/rancher/wrangler/v3/pkg/generated/controllers/core"
 	"github.com/rancher/wrangler/v3/pkg/leader"
 	"github.com/rancher/wrangler/v3/pkg/signals"
+	"github.com/rancher/wrangler/v3/pkg/start"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 	"k8s.io/client-go/kubernetes"
@@ -15,7 +17,9 @@ import (
 
 	"github.com/harvester/vm-dhcp-controller/pkg/config"
 	"github.com/harvester/vm-dhcp-controller/pkg/controller"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
 	"github.com/harvester/vm-dhcp-controller/pkg/server"
+	"github.com/harvester/vm-dhcp-controller/pkg/webhook/certificate"
 )
 
 var (
@@ -46,7 +50,18 @@ func run(options *config.ControllerOptions) error {
 		logrus.Fatalf("Error building controllers: %s", err.Error())
 	}
 
+	// Every replica follows the ConfigMap, so the ones on standby serve the
+	// same state at /features
+	configMaps := client.CoreV1().ConfigMaps(agentNamespace)
+	if err := options.FeatureGates.Sync(ctx, configMaps); err != nil {
+		logrus.Warnf("Error reading feature gates: %s", err.Error())
+	}
+	go options.FeatureGates.Run(ctx, configMaps, featuregate.DefaultSyncInterval)
+
 	callback := func(ctx context.Context) {
+		management.Leadership.Acquire()
+		defer management.Leadership.Release()
+
 		if err := management.Register(ctx, cfg, controller.RegisterFuncList); err != nil {
 			panic(err)
 		}
@@ -59,11 +74,44 @@ func run(options *config.ControllerOptions) error {
 	}
 
 	httpServerOptions := config.HTTPServerOptions{
+		Port:             httpPort,
+		APIPort:          apiPort,
+		KubeClient:       client,
 		DebugMode:        enableCacheDumpAPI,
 		IPAllocator:      management.IPAllocator,
 		CacheAllocator:   management.CacheAllocator,
 		MetricsAllocator: management.MetricsAllocator,
+		DenialLog:        management.DenialLog,
+		ChangeLog:        management.ChangeLog,
+		IPPoolClient:     management.HarvesterNetworkFactory.Network().V1alpha1().IPPool(),
+		VmNetCfgClient:   management.HarvesterNetworkFactory.Network().V1alpha1().VirtualMachineNetworkConfig(),
+		VmNetCfgCache:    management.HarvesterNetworkFactory.Network().V1alpha1().VirtualMachineNetworkConfig().Cache(),
+		PodClient:        management.CoreFactory.Core().V1().Pod(),
+		AppVersion:       AppVersion,
+		GitCommit:        GitCommit,
+		ReadyCheck:       management.Warmup.Check,
+		Identity:         management.Identity.String(),
+		IsLeader:         management.Leadership.IsLeader,
+		FeatureGates:     options.FeatureGates,
 	}
+	// Every replica serves the endpoints requiring authentication with the
+	// certificate of the Secret, swapped in for new connections on every
+	// change, e.g., once renewed
+	if apiTLSSecret != "" {
+		reloader := certificate.NewReloader(agentNamespace, apiTLSSecret)
+		secretFactory, err := wranglercore.NewFactoryFromConfigWithOptions(cfg, &wranglercore.FactoryOptions{
+			Namespace: agentNamespace,
+		})
+		if err != nil {
+			return err
+		}
+		secretFactory.Core().V1().Secret().OnChange(ctx, "api-certificate", reloader.OnChange)
+		if err := start.All(ctx, 1, secretFactory); err != nil {
+			return err
+		}
+		httpServerOptions.GetAPICertificate = reloader.GetCertificate
+	}
+
 	s := server.NewHTTPServer(&httpServerOptions)
 	s.RegisterControllerHandlers()
 
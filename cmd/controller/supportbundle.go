@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const supportBundleFetchTimeout = time.Minute
+
+var (
+	supportBundleURL    string
+	supportBundleOutput string
+)
+
+// supportBundleCmd fetches the support bundle from a running controller, e.g.,
+// through kubectl port-forward, and saves it.
+var supportBundleCmd = &cobra.Command{
+	Use:   "support-bundle",
+	Short: "Fetch the support bundle of the DHCP subsystem from a running controller",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output := supportBundleOutput
+		if output == "" {
+			output = fmt.Sprintf("vm-dhcp-supportbundle-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+		}
+
+		if err := fetchSupportBundle(supportBundleURL, output); err != nil {
+			return err
+		}
+
+		if output != "-" {
+			fmt.Fprintf(os.Stderr, "Support bundle saved to %s\n", output)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	supportBundleCmd.Flags().StringVar(&supportBundleURL, "url", "http://localhost:8080/supportbundle", "The support bundle endpoint of the controller")
+	supportBundleCmd.Flags().StringVarP(&supportBundleOutput, "output", "o", "", "The file to save the support bundle to (- for stdout, defaults to a timestamped file in the working directory)")
+
+	rootCmd.AddCommand(supportBundleCmd)
+}
+
+func fetchSupportBundle(url, output string) error {
+	client := &http.Client{Timeout: supportBundleFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("cannot fetch support bundle: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("cannot fetch support bundle: %s: %s", resp.Status, body)
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("cannot save support bundle: %w", err)
+	}
+
+	return nil
+}
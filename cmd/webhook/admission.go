@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/harvester/webhook/pkg/config"
+	"github.com/harvester/webhook/pkg/server/admission"
+	"github.com/rancher/wrangler/v3/pkg/webhook"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	validationPath = "/v1/webhook/validation"
+	mutationPath   = "/v1/webhook/mutation"
+)
+
+// The cipher suites allowed by the webhook framework
+var allowedCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// newAdmissionHandler routes the admission reviews to the validators and the
+// mutators at the paths the webhook framework registers with the API servers.
+func newAdmissionHandler(options *config.Options, validators []admission.Validator, mutators []admission.Mutator) http.Handler {
+	router := mux.NewRouter()
+
+	validatingRouter := webhook.NewRouter()
+	for _, v := range validators {
+		admission.NewHandler(admission.Validator2Admitter(v), admission.AdmissionTypeValidation, options).AddToWebhookRouter(validatingRouter)
+	}
+	router.Handle(validationPath, validatingRouter)
+
+	mutatingRouter := webhook.NewRouter()
+	for _, m := range mutators {
+		admission.NewHandler(m, admission.AdmissionTypeMutation, options).AddToWebhookRouter(mutatingRouter)
+	}
+	router.Handle(mutationPath, mutatingRouter)
+
+	return router
+}
+
+// serveAdmissions serves the admission reviews on port with the certificate
+// handed out by getCertificate, until ctx is done.
+func serveAdmissions(ctx context.Context, port int, handler http.Handler, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			CipherSuites:   allowedCipherSuites,
+			GetCertificate: getCertificate,
+		},
+		BaseContext: func(_ net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			logrus.Errorf("(serveAdmissions) failed to shut down: %s", err.Error())
+		}
+	}()
+
+	logrus.Infof("Serving admissions on port %d", port)
+	if err := srv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
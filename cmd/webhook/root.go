@@ -9,6 +9,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
 	"github.com/harvester/vm-dhcp-controller/pkg/util"
 	"github.com/harvester/webhook/pkg/config"
 )
@@ -19,9 +20,12 @@ var (
 	logDebug bool
 	logTrace bool
 
-	name        string
-	serviceCIDR string
-	options     config.Options
+	name           string
+	serviceCIDR    string
+	maxPoolSize    int
+	certIssuerPort int
+	featureGates   map[string]string
+	options        config.Options
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -62,11 +66,14 @@ func init() {
 
 	rootCmd.Flags().StringVar(&name, "name", os.Getenv("VM_DHCP_AGENT_NAME"), "The name of the vm-dhcp-webhook instance")
 	rootCmd.Flags().StringVar(&serviceCIDR, "service-cidr", defaultServiceCIDR, "The service CIDR that the cluster is currently using")
+	rootCmd.Flags().IntVar(&maxPoolSize, "max-pool-size", util.DefaultMaxPoolSize, "The maximum amount of allocatable addresses of an IPPool after exclusions (0 for no limit)")
+	rootCmd.Flags().StringToStringVar(&featureGates, "feature-gates", nil, "Turn optional features on or off, e.g., CNIIPAM=true, overriding the "+featuregate.ConfigMapName+" ConfigMap of the namespace")
 
 	rootCmd.Flags().StringVar(&options.ControllerUsername, "controller-user", "harvester-vm-dhcp-controller", "The harvester controller username")
 	rootCmd.Flags().StringVar(&options.GarbageCollectionUsername, "gc-user", "system:serviceaccount:kube-system:generic-garbage-collector", "The system username that performs garbage collection")
 	rootCmd.Flags().StringVar(&options.Namespace, "namespace", os.Getenv("NAMESPACE"), "The harvester namespace")
 	rootCmd.Flags().IntVar(&options.HTTPSListenPort, "https-port", 8443, "HTTPS listen port")
+	rootCmd.Flags().IntVar(&certIssuerPort, "cert-issuer-port", 8444, "The port of the webhook framework listener issuing the serving certificate, which serves no admissions")
 	rootCmd.Flags().IntVar(&options.Threadiness, "threadiness", 5, "Specify controller threads")
 }
 
@@ -2,13 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
 
 	"github.com/harvester/webhook/pkg/config"
 	"github.com/harvester/webhook/pkg/server"
+	"github.com/harvester/webhook/pkg/server/admission"
+	"github.com/prometheus/client_golang/prometheus"
+	wranglercore "github.com/rancher/wrangler/v3/pkg/generated/controllers/core"
 	"github.com/rancher/wrangler/v3/pkg/start"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
+	dhcpconfig "github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
 	ctlcore "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/core"
 	ctlcni "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/k8s.cni.cncf.io"
 	ctlcniv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/k8s.cni.cncf.io/v1"
@@ -17,7 +27,11 @@ import (
 	ctlnetwork "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io"
 	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
 	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
+	dhcpserver "github.com/harvester/vm-dhcp-controller/pkg/server"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+	"github.com/harvester/vm-dhcp-controller/pkg/webhook/certificate"
 	"github.com/harvester/vm-dhcp-controller/pkg/webhook/ippool"
+	"github.com/harvester/vm-dhcp-controller/pkg/webhook/vm"
 	"github.com/harvester/vm-dhcp-controller/pkg/webhook/vmnetcfg"
 )
 
@@ -54,7 +68,12 @@ func newCaches(ctx context.Context, cfg *rest.Config, threadiness int) (*caches,
 
 	// Indexer must be added before starting the informer, otherwise panic `cannot add indexers to running index` happens
 	c.vmnetcfgCache.AddIndexer(indexer.VmNetCfgByNetworkIndex, indexer.VmNetCfgByNetwork)
+	c.vmnetcfgCache.AddIndexer(indexer.VmNetCfgByMACIndex, util.VmNetCfgByMAC)
+	c.vmnetcfgCache.AddIndexer(indexer.VmNetCfgByNetworkMACIndex, util.VmNetCfgByNetworkMAC)
+	c.vmnetcfgCache.AddIndexer(indexer.VmNetCfgByQualifiedNetworkIndex, util.VmNetCfgByQualifiedNetwork)
 
+	// Waits for the caches to sync, so nothing is admitted against empty
+	// caches
 	if err := start.All(ctx, threadiness, starters...); err != nil {
 		return nil, err
 	}
@@ -65,33 +84,92 @@ func newCaches(ctx context.Context, cfg *rest.Config, threadiness int) (*caches,
 func run(ctx context.Context, cfg *rest.Config, options *config.Options) error {
 	logrus.Infof("Starting VM DHCP Webhook: %s", name)
 
-	c, err := newCaches(ctx, cfg, options.Threadiness)
+	gates, err := featuregate.New(featureGates)
+	if err != nil {
+		return fmt.Errorf("invalid feature gates: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
 		return err
 	}
+	// Read before admitting anything, so the webhook agrees with the
+	// controller from the start
+	configMaps := client.CoreV1().ConfigMaps(options.Namespace)
+	if err := gates.Sync(ctx, configMaps); err != nil {
+		logrus.Warnf("Error reading feature gates: %s", err.Error())
+	}
+	go gates.Run(ctx, configMaps, featuregate.DefaultSyncInterval)
 
-	webhookServer := server.NewWebhookServer(ctx, cfg, name, options)
-
-	if err := webhookServer.RegisterValidators(
-		ippool.NewValidator(serviceCIDR, c.nadCache, c.vmnetcfgCache),
-		vmnetcfg.NewValidator(c.nadCache, c.ippoolCache),
-	); err != nil {
+	c, err := newCaches(ctx, cfg, options.Threadiness)
+	if err != nil {
 		return err
 	}
 
-	if err := webhookServer.RegisterMutators(
+	validators := []admission.Validator{
+		ippool.NewValidator(serviceCIDR, maxPoolSize, c.nadCache, c.ippoolCache, c.vmnetcfgCache),
+		vmnetcfg.NewValidator(c.nadCache, c.ippoolCache, c.vmnetcfgCache, gates),
+	}
+	mutators := []admission.Mutator{
 		ippool.NewMutator(),
-	); err != nil {
-		return err
+		vm.NewMutator(c.vmnetcfgCache),
 	}
 
+	// The webhook framework issues and renews the serving certificate, and
+	// registers the webhook with the API servers. Its own listener is moved
+	// out of the way and serves nothing the API servers reach.
+	frameworkOptions := *options
+	frameworkOptions.HTTPSListenPort = certIssuerPort
+	webhookServer := server.NewWebhookServer(ctx, cfg, name, &frameworkOptions)
+	if err := webhookServer.RegisterValidators(validators...); err != nil {
+		return err
+	}
+	if err := webhookServer.RegisterMutators(mutators...); err != nil {
+		return err
+	}
 	if err := webhookServer.Start(); err != nil {
 		return err
 	}
 
-	<-ctx.Done()
+	// Admissions are served with the certificate loaded from the Secret the
+	// framework keeps it in, swapped in for new connections on every change
+	reloader := certificate.NewReloader(options.Namespace, name+"-tls")
+	secretFactory, err := wranglercore.NewFactoryFromConfigWithOptions(cfg, &wranglercore.FactoryOptions{
+		Namespace: options.Namespace,
+	})
+	if err != nil {
+		return err
+	}
+	secretFactory.Core().V1().Secret().OnChange(ctx, "webhook-certificate", reloader.OnChange)
+	if err := start.All(ctx, 1, secretFactory); err != nil {
+		return err
+	}
+
+	httpServerOptions := dhcpconfig.HTTPServerOptions{
+		ReadyCheck:   reloader.Ready,
+		Collectors:   []prometheus.Collector{reloader, gates},
+		FeatureGates: gates,
+	}
+	s := dhcpserver.NewHTTPServer(&httpServerOptions)
+	s.RegisterWebhookHandlers()
+
+	eg, egctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		return s.Run()
+	})
+
+	eg.Go(func() error {
+		return serveAdmissions(egctx, options.HTTPSListenPort, newAdmissionHandler(options, validators, mutators), reloader.GetCertificate)
+	})
+
+	errCh := dhcpserver.Cleanup(egctx, s)
+
+	if err := eg.Wait(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
 
 	logrus.Info("Stopping webhook server")
 
-	return nil
+	// Return cleanup error message if any
+	return <-errCh
 }
@@ -6,32 +6,59 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 
+	"github.com/harvester/vm-dhcp-controller/pkg/agent/decline"
 	"github.com/harvester/vm-dhcp-controller/pkg/agent/ippool"
+	"github.com/harvester/vm-dhcp-controller/pkg/agent/netcheck"
 	"github.com/harvester/vm-dhcp-controller/pkg/config"
 	"github.com/harvester/vm-dhcp-controller/pkg/dhcp"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
 )
 
 const DefaultNetworkInterface = "eth1"
 
 type Agent struct {
-	dryRun  bool
-	nic     string
-	poolRef types.NamespacedName
+	dryRun      bool
+	nic         string
+	poolRef     types.NamespacedName
+	podRef      types.NamespacedName
+	kubeConfig  string
+	kubeContext string
+
+	verifier *netcheck.Verifier
 
 	ippoolEventHandler *ippool.EventHandler
 	DHCPAllocator      *dhcp.DHCPAllocator
-	poolCache          map[string]string
+	poolCache          map[string]map[string]string
 }
 
 func NewAgent(options *config.AgentOptions) *Agent {
-	dhcpAllocator := dhcp.NewDHCPAllocator()
-	poolCache := make(map[string]string, 10)
+	dhcpAllocator := dhcp.New()
+	poolCache := make(map[string]map[string]string)
+
+	var verifier *netcheck.Verifier
+	if options.VerifyCIDR != "" {
+		verifier = netcheck.NewVerifier(netcheck.Options{
+			Nic:    options.Nic,
+			CIDR:   options.VerifyCIDR,
+			Router: options.VerifyRouter,
+			MTU:    options.VerifyMTU,
+		})
+	}
 
 	return &Agent{
 		dryRun:  options.DryRun,
 		nic:     options.Nic,
 		poolRef: options.IPPoolRef,
+		podRef: types.NamespacedName{
+			Namespace: options.Namespace,
+			Name:      options.Name,
+		},
+		kubeConfig:  options.KubeConfigPath,
+		kubeContext: options.KubeContext,
+
+		verifier: verifier,
 
 		DHCPAllocator: dhcpAllocator,
 		ippoolEventHandler: ippool.NewEventHandler(
@@ -51,12 +78,10 @@ func (a *Agent) Run(ctx context.Context) error {
 
 	eg, egctx := errgroup.WithContext(ctx)
 
-	eg.Go(func() error {
-		if a.dryRun {
-			return a.DHCPAllocator.DryRun(egctx, a.nic)
-		}
-		return a.DHCPAllocator.Run(egctx, a.nic)
-	})
+	errCh, err := serve(egctx, a.DHCPAllocator, a.nic, a.dryRun)
+	if err != nil {
+		return err
+	}
 
 	eg.Go(func() error {
 		if err := a.ippoolEventHandler.Init(); err != nil {
@@ -66,7 +91,17 @@ func (a *Agent) Run(ctx context.Context) error {
 		return nil
 	})
 
-	errCh := dhcp.Cleanup(egctx, a.DHCPAllocator, a.nic)
+	if a.verifier != nil {
+		eg.Go(func() error {
+			a.verifyNetwork(egctx)
+			return nil
+		})
+	}
+
+	eg.Go(func() error {
+		a.reportDeclines(egctx)
+		return nil
+	})
 
 	if err := eg.Wait(); err != nil {
 		return err
@@ -79,3 +114,89 @@ func (a *Agent) Run(ctx context.Context) error {
 
 	return nil
 }
+
+// serve starts serving the leases of dhcpAllocator on nic until ctx is done.
+// The returned channel reports the error stopping the service, if any.
+func serve(ctx context.Context, dhcpAllocator *dhcp.DHCPAllocator, nic string, dryRun bool) (<-chan error, error) {
+	if dryRun {
+		if err := dhcpAllocator.DryRun(ctx, nic); err != nil {
+			return nil, err
+		}
+		return dhcp.Cleanup(ctx, dhcpAllocator, nic), nil
+	}
+
+	if err := dhcpAllocator.Run(ctx, nic); err != nil {
+		return nil, err
+	}
+
+	// DHCPv6 is served on a best effort basis, so the IPv4 leases keep being
+	// served on nics without IPv6
+	if err := dhcpAllocator.Run6(ctx, nic); err != nil {
+		logrus.Warnf("DHCPv6 service is unavailable on nic %s: %s", nic, err.Error())
+	}
+
+	return dhcp.Cleanup(ctx, dhcpAllocator, nic), nil
+}
+
+// verifyNetwork checks the attachment against the pool's expectations and
+// reports the result on the agent Pod. Failures are only logged since the
+// DHCP service itself is still functional.
+func (a *Agent) verifyNetwork(ctx context.Context) {
+	logrus.Infof("verify network attachment of %s", a.nic)
+
+	result := a.verifier.Verify(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+
+	for _, mismatch := range result.Mismatches {
+		logrus.Warnf("network mismatch: %s", mismatch)
+	}
+
+	client, err := a.newClient()
+	if err != nil {
+		logrus.Errorf("failed to report network verification result: %s", err.Error())
+		return
+	}
+
+	if err := netcheck.Report(ctx, client, a.podRef, result); err != nil {
+		logrus.Errorf("failed to report network verification result: %s", err.Error())
+	}
+}
+
+// reportDeclines reports the DHCPDECLINEs received on the agent Pod as they
+// come in, so the controller quarantines the IP addresses found in use. The
+// whole list is reported every time, which keeps the annotation right even if
+// a report was lost.
+func (a *Agent) reportDeclines(ctx context.Context) {
+	var client kubernetes.Interface
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.DHCPAllocator.Declined():
+		}
+
+		if client == nil {
+			var err error
+			if client, err = a.newClient(); err != nil {
+				logrus.Errorf("failed to report declined ip addresses: %s", err.Error())
+				continue
+			}
+		}
+
+		if err := decline.Report(ctx, client, a.podRef, a.DHCPAllocator.ListDeclines()); err != nil {
+			logrus.Errorf("failed to report declined ip addresses: %s", err.Error())
+		}
+	}
+}
+
+func (a *Agent) newClient() (kubernetes.Interface, error) {
+	restConfig, err := util.GetRESTConfig(a.kubeConfig, a.kubeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(restConfig)
+}
@@ -0,0 +1,55 @@
+package decline
+
+import (
+	"context"
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/dhcp"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// Report records the DHCPDECLINEs received by the agent on its Pod so the
+// controller can quarantine the declined IP addresses.
+func Report(ctx context.Context, client kubernetes.Interface, podRef types.NamespacedName, declines []dhcp.Decline) error {
+	declinesStr, err := json.Marshal(declines)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				util.DeclinedIPsAnnotationKey: string(declinesStr),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return retry.OnError(retry.DefaultBackoff, func(error) bool { return true }, func() error {
+		_, err := client.CoreV1().Pods(podRef.Namespace).Patch(ctx, podRef.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+}
+
+// ParseDeclines reads the DHCPDECLINEs reported on the agent Pod annotations.
+// It returns nil if the agent hasn't received any.
+func ParseDeclines(annotations map[string]string) ([]dhcp.Decline, error) {
+	declinesStr, ok := annotations[util.DeclinedIPsAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+
+	var declines []dhcp.Decline
+	if err := json.Unmarshal([]byte(declinesStr), &declines); err != nil {
+		return nil, err
+	}
+
+	return declines, nil
+}
@@ -0,0 +1,111 @@
+package dhcpcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultTimeout = 30 * time.Second
+
+	// exchangeTimeout is how long each message of the exchange waits for
+	// its answer before being sent again.
+	exchangeTimeout = 5 * time.Second
+)
+
+type Options struct {
+	// Nic is the network interface attached to the pool's network.
+	Nic string
+	// MACAddress is the reserved test MAC address the exchange runs with.
+	MACAddress string
+	// ServerIP is the address of the agent expected to answer. An empty
+	// value takes the answer of any server.
+	ServerIP string
+	// Timeout bounds the whole exchange.
+	Timeout time.Duration
+}
+
+// Result is what the checker reports back to the controller. It's written as
+// the termination message of the checker Pod.
+type Result struct {
+	Succeeded           bool     `json:"succeeded"`
+	IPAddress           string   `json:"ipAddress,omitempty"`
+	LatencyMilliseconds int64    `json:"latencyMilliseconds,omitempty"`
+	Options             []string `json:"options,omitempty"`
+	Message             string   `json:"message,omitempty"`
+}
+
+// Run goes through a full DISCOVER, OFFER, REQUEST, ACK, and RELEASE cycle
+// with the test MAC address and reports how it went.
+func Run(ctx context.Context, options Options) (result Result) {
+	hwAddr, err := net.ParseMAC(options.MACAddress)
+	if err != nil {
+		result.Message = err.Error()
+		return
+	}
+
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, err := nclient4.New(options.Nic,
+		nclient4.WithHWAddr(hwAddr),
+		nclient4.WithTimeout(exchangeTimeout),
+	)
+	if err != nil {
+		result.Message = fmt.Sprintf("cannot open dhcp client on %s: %s", options.Nic, err.Error())
+		return
+	}
+	defer client.Close()
+
+	// The test MAC address isn't the one of the interface, so the answers
+	// are asked to be broadcast
+	start := time.Now()
+	lease, err := client.Request(ctx, dhcpv4.WithBroadcast(true))
+	if err != nil {
+		result.Message = fmt.Sprintf("no lease acknowledged for %s: %s", options.MACAddress, err.Error())
+		return
+	}
+	result.LatencyMilliseconds = time.Since(start).Milliseconds()
+
+	ack := lease.ACK
+	result.IPAddress = ack.YourIPAddr.String()
+	result.Options = summarize(ack.Options)
+	logrus.Infof("(dhcpcheck.Run) %s acknowledged for %s in %dms", result.IPAddress, options.MACAddress, result.LatencyMilliseconds)
+
+	if err := client.Release(lease, dhcpv4.WithBroadcast(true)); err != nil {
+		result.Message = fmt.Sprintf("cannot release lease %s: %s", result.IPAddress, err.Error())
+		return
+	}
+
+	if options.ServerIP != "" {
+		if serverID := ack.ServerIdentifier(); !serverID.Equal(net.ParseIP(options.ServerIP)) {
+			result.Message = fmt.Sprintf("lease acknowledged by %s rather than the agent at %s", serverID, options.ServerIP)
+			return
+		}
+	}
+
+	result.Succeeded = true
+	return
+}
+
+// summarize returns the options in a human-readable form, one per item.
+func summarize(options dhcpv4.Options) []string {
+	var summary []string
+	for _, line := range strings.Split(options.Summary(nil), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			summary = append(summary, line)
+		}
+	}
+	return summary
+}
@@ -0,0 +1,32 @@
+package dhcpcheck
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// TerminationMessagePath is where the checker writes its result, so the
+// controller reads it from the termination message in the checker Pod's
+// status.
+const TerminationMessagePath = "/dev/termination-log"
+
+// WriteResult records the result at path.
+func WriteResult(path string, result Result) error {
+	resultStr, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, resultStr, 0644)
+}
+
+// ParseResult reads the result from the termination message of the checker
+// Pod.
+func ParseResult(message string) (*Result, error) {
+	var result Result
+	if err := json.Unmarshal([]byte(message), &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/agent/ippool"
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+	"github.com/harvester/vm-dhcp-controller/pkg/dhcp"
+)
+
+// Embedded hosts the agents of IPPools in the controller process itself,
+// for single-node clusters where running an agent Pod per IPPool isn't worth
+// it. The controller has to be attached to the networks of these IPPools, as
+// nics of its own. The leases are served by the same code as the agent Pods',
+// off the IPPools cached by the controller. A nil Embedded hosts no agent.
+type Embedded struct {
+	ctx      context.Context
+	informer cache.SharedIndexInformer
+	dryRun   bool
+	clock    clock.Clock
+	// nics are the nics of the controller attached to each network,
+	// keyed by the namespaced name of the NetworkAttachmentDefinition
+	nics map[string]string
+
+	agents map[string]*embeddedAgent
+	mutex  sync.Mutex
+}
+
+type embeddedAgent struct {
+	nic    string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewEmbedded returns the manager of the embedded agents serving the IPPools
+// of the networks in nics, off the IPPools of informer. They're all stopped
+// as ctx is done.
+func NewEmbedded(ctx context.Context, nics map[string]string, informer cache.SharedIndexInformer, dryRun bool, clock clock.Clock) *Embedded {
+	return &Embedded{
+		ctx:      ctx,
+		informer: informer,
+		dryRun:   dryRun,
+		clock:    clock,
+		nics:     nics,
+		agents:   make(map[string]*embeddedAgent),
+	}
+}
+
+// NIC returns the nic the leases of ipPool are served on by an embedded
+// agent, if any.
+func (e *Embedded) NIC(ipPool *networkv1.IPPool) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+
+	nic, ok := e.nics[ipPool.Spec.NetworkName]
+	return nic, ok
+}
+
+// Start starts the embedded agent of ipPool on nic, unless it's already
+// running there. An agent running on another nic is restarted.
+func (e *Embedded) Start(ipPool *networkv1.IPPool, nic string) error {
+	key := ipPool.Namespace + "/" + ipPool.Name
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if agent, ok := e.agents[key]; ok {
+		if agent.nic == nic {
+			return nil
+		}
+		e.stop(key, agent)
+	}
+
+	ctx, cancel := context.WithCancel(e.ctx)
+	dhcpAllocator := dhcp.NewDHCPAllocator(e.clock)
+
+	errCh, err := serve(ctx, dhcpAllocator, nic, e.dryRun)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("cannot start embedded agent for ippool %s on nic %s: %w", key, nic, err)
+	}
+
+	agent := &embeddedAgent{
+		nic:    nic,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	e.agents[key] = agent
+
+	poolRef := types.NamespacedName{Namespace: ipPool.Namespace, Name: ipPool.Name}
+	go func() {
+		defer close(agent.done)
+
+		if err := ippool.RunInProcess(ctx, e.informer, poolRef, dhcpAllocator); err != nil {
+			logrus.Errorf("(agent.Embedded) embedded agent for ippool %s failed: %s", key, err.Error())
+		}
+		if err := <-errCh; err != nil {
+			logrus.Errorf("(agent.Embedded) cannot stop DHCP service of embedded agent for ippool %s: %s", key, err.Error())
+		}
+	}()
+
+	logrus.Infof("(agent.Embedded) embedded agent for ippool %s started on nic %s", key, nic)
+
+	return nil
+}
+
+// Stop stops the embedded agent of the IPPool of key, if any, and waits for
+// its DHCP service to be stopped.
+func (e *Embedded) Stop(key string) {
+	if e == nil {
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if agent, ok := e.agents[key]; ok {
+		e.stop(key, agent)
+	}
+}
+
+// IsRunning reports whether the embedded agent of the IPPool of key is
+// running.
+func (e *Embedded) IsRunning(key string) bool {
+	if e == nil {
+		return false
+	}
+
+	e.mutex.Lock()
+	agent, ok := e.agents[key]
+	e.mutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-agent.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (e *Embedded) stop(key string, agent *embeddedAgent) {
+	agent.cancel()
+	<-agent.done
+	delete(e.agents, key)
+
+	logrus.Infof("(agent.Embedded) embedded agent for ippool %s stopped", key)
+}
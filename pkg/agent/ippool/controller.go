@@ -1,6 +1,7 @@
 package ippool
 
 import (
+	"errors"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -12,6 +13,7 @@ import (
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
 	"github.com/harvester/vm-dhcp-controller/pkg/dhcp"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
 )
 
 type Controller struct {
@@ -22,7 +24,17 @@ type Controller struct {
 
 	poolRef       types.NamespacedName
 	dhcpAllocator *dhcp.DHCPAllocator
-	poolCache     map[string]string
+	poolCache     map[string]map[string]string
+	// ipv6PoolCache is the poolCache counterpart of the IPv6 leases
+	ipv6PoolCache map[string]map[string]string
+	// resyncs keeps the request ID of the last resync seen of each IPPool
+	resyncs map[string]string
+	// applied keeps what identifies the IPPool each sync was last applied
+	// from, so replays are told apart
+	applied map[string]*syncMark
+	// settings keeps the settings the leases of each IPPool were last added
+	// with, so they're added again once the settings change
+	settings map[string]leaseSettings
 }
 
 func NewController(
@@ -31,7 +43,7 @@ func NewController(
 	informer cache.Controller,
 	poolRef types.NamespacedName,
 	dhcpAllocator *dhcp.DHCPAllocator,
-	poolCache map[string]string,
+	poolCache map[string]map[string]string,
 ) *Controller {
 	return &Controller{
 		stopCh:        make(chan struct{}),
@@ -41,6 +53,9 @@ func NewController(
 		poolRef:       poolRef,
 		dhcpAllocator: dhcpAllocator,
 		poolCache:     poolCache,
+		ipv6PoolCache: make(map[string]map[string]string),
+		resyncs:       make(map[string]string),
+		applied:       make(map[string]*syncMark),
 	}
 }
 
@@ -70,26 +85,91 @@ func (c *Controller) sync(event Event) (err error) {
 		return
 	}
 
-	if event.poolName != c.poolRef.Name {
-		logrus.Debugf("(controller.sync) IPPool %s is not our target", event.key)
-		return
-	}
-
 	switch event.action {
 	case UPDATE:
 		ipPool, ok := obj.(*networkv1.IPPool)
 		if !ok {
 			logrus.Error("(controller.sync) failed to assert obj during UPDATE")
+			return
+		}
+		if !c.isServed(ipPool) {
+			logrus.Debugf("(controller.sync) IPPool %s is not our target", event.key)
+			return
 		}
 		logrus.Infof("(controller.sync) UPDATE %s/%s", ipPool.Namespace, ipPool.Name)
-		if err := c.Update(ipPool); err != nil {
+		if err := c.Update(ipPool); errors.Is(err, ErrStaleSync) {
+			logrus.Debugf("(controller.sync) IPPool %s was already applied, skip", event.key)
+		} else if err != nil {
 			logrus.Errorf("(controller.sync) failed to update DHCP lease store: %s", err.Error())
 		}
+		// Any IPPool along an overflow chain can cut off the ones after it
+		c.pruneDelegatedPools()
+	case DELETE:
+		if _, ok := c.poolCache[event.key]; !ok {
+			return
+		}
+		logrus.Infof("(controller.sync) DELETE %s", event.key)
+		if err := c.removePool(event.key); err != nil {
+			logrus.Errorf("(controller.sync) failed to remove leases from DHCP lease store: %s", err.Error())
+		}
 	}
 
 	return
 }
 
+// isServed reports whether the leases of the IPPool are served by the agent,
+// i.e., it's either the IPPool of the agent, one delegated by it, or one of
+// its overflow chain.
+func (c *Controller) isServed(ipPool *networkv1.IPPool) bool {
+	for depth := 0; depth <= util.MaxOverflowDepth; depth++ {
+		if ipPool.Namespace == c.poolRef.Namespace && ipPool.Name == c.poolRef.Name {
+			return true
+		}
+
+		parentKey, ok := util.DelegatingPool(ipPool)
+		if !ok {
+			return false
+		}
+		obj, exists, err := c.indexer.GetByKey(parentKey)
+		if err != nil || !exists {
+			return false
+		}
+		parent, ok := obj.(*networkv1.IPPool)
+		if !ok || !util.IsDelegated(parent, ipPool) {
+			return false
+		}
+
+		ipPool = parent
+	}
+
+	return false
+}
+
+// pruneDelegatedPools removes the leases of the IPPools no longer delegated
+// by the IPPool of the agent.
+func (c *Controller) pruneDelegatedPools() {
+	for key := range c.poolCache {
+		if key == c.poolRef.String() {
+			continue
+		}
+
+		obj, exists, err := c.indexer.GetByKey(key)
+		if err != nil {
+			continue
+		}
+		if exists {
+			if ipPool, ok := obj.(*networkv1.IPPool); ok && c.isServed(ipPool) {
+				continue
+			}
+		}
+
+		logrus.Infof("(controller.pruneDelegatedPools) IPPool %s is no longer delegated", key)
+		if err := c.removePool(key); err != nil {
+			logrus.Errorf("(controller.pruneDelegatedPools) failed to remove leases from DHCP lease store: %s", err.Error())
+		}
+	}
+}
+
 func (c *Controller) handleErr(err error, key interface{}) {
 	if err == nil {
 		c.queue.Forget(key.(Event))
@@ -116,11 +196,15 @@ func (c *Controller) Run(workers int) {
 	defer c.queue.ShutDown()
 	logrus.Info("(controller.Run) starting IPPool controller")
 
-	go c.informer.Run(c.stopCh)
-	if !cache.WaitForCacheSync(c.stopCh, c.informer.HasSynced) {
-		logrus.Errorf("(controller.Run) timed out waiting for caches to sync")
+	// The informer of an in-process controller is shared with the
+	// controller process, which runs it
+	if c.informer != nil {
+		go c.informer.Run(c.stopCh)
+		if !cache.WaitForCacheSync(c.stopCh, c.informer.HasSynced) {
+			logrus.Errorf("(controller.Run) timed out waiting for caches to sync")
 
-		return
+			return
+		}
 	}
 
 	for i := 0; i < workers; i++ {
@@ -4,12 +4,11 @@ import (
 	"context"
 
 	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/tools/clientcmd"
-	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/client-go/util/workqueue"
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
@@ -32,7 +31,7 @@ type EventHandler struct {
 
 	poolRef       types.NamespacedName
 	dhcpAllocator *dhcp.DHCPAllocator
-	poolCache     map[string]string
+	poolCache     map[string]map[string]string
 }
 
 type Event struct {
@@ -48,7 +47,7 @@ func NewEventHandler(
 	kubeRestConfig *rest.Config,
 	poolRef types.NamespacedName,
 	dhcpAllocator *dhcp.DHCPAllocator,
-	poolCache map[string]string,
+	poolCache map[string]map[string]string,
 ) *EventHandler {
 	return &EventHandler{
 		kubeConfig:     kubeConfig,
@@ -75,55 +74,105 @@ func (e *EventHandler) Init() (err error) {
 }
 
 func (e *EventHandler) getKubeConfig() (config *rest.Config, err error) {
-	if !util.FileExists(e.kubeConfig) {
-		return rest.InClusterConfig()
-	}
-
-	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
-		&clientcmd.ClientConfigLoadingRules{
-			ExplicitPath: e.kubeConfig,
-		},
-		&clientcmd.ConfigOverrides{
-			ClusterInfo:    clientcmdapi.Cluster{},
-			CurrentContext: e.kubeContext,
-		},
-	).ClientConfig()
+	return util.GetRESTConfig(e.kubeConfig, e.kubeContext)
 }
 
 func (e *EventHandler) EventListener(ctx context.Context) {
 	logrus.Info("(eventhandler.EventListener) starting IPPool event listener")
 
-	// TODO: could be more specific on what namespaces we want to watch and what fields we need
-	watcher := cache.NewListWatchFromClient(e.k8sClientset.NetworkV1alpha1().RESTClient(), "ippools", e.poolRef.Namespace, fields.Everything())
+	// IPPools of every namespace are watched as the ones delegated by our
+	// target may live anywhere
+	// TODO: could be more specific on what fields we need
+	watcher := cache.NewListWatchFromClient(e.k8sClientset.NetworkV1alpha1().RESTClient(), "ippools", metav1.NamespaceAll, fields.Everything())
+
+	listen(ctx, watcher, e.poolRef, e.dhcpAllocator, e.poolCache)
+
+	logrus.Info("(eventhandler.Run) IPPool event listener terminated")
+}
 
+// listen serves the IPPool of poolRef with dhcpAllocator off the IPPools of
+// watcher until ctx is done.
+func listen(ctx context.Context, watcher cache.ListerWatcher, poolRef types.NamespacedName, dhcpAllocator *dhcp.DHCPAllocator, poolCache map[string]map[string]string) {
 	queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[Event]())
 
 	indexer, informer := cache.NewInformerWithOptions(cache.InformerOptions{
 		ListerWatcher: watcher,
 		ObjectType:    &networkv1.IPPool{},
 		ResyncPeriod:  0,
-		Handler: cache.ResourceEventHandlerFuncs{
-			UpdateFunc: func(old interface{}, new interface{}) {
-				key, err := cache.MetaNamespaceKeyFunc(new)
-				if err == nil {
-					queue.Add(Event{
-						key:             key,
-						action:          UPDATE,
-						poolName:        new.(*networkv1.IPPool).Name,
-						poolNetworkName: new.(*networkv1.IPPool).Spec.NetworkName,
-					})
-				}
-			},
-		},
-		Indexers: cache.Indexers{},
+		Handler:       newResourceEventHandler(queue),
+		Indexers:      cache.Indexers{},
 	})
 
-	controller := NewController(queue, indexer.(cache.Indexer), informer, e.poolRef, e.dhcpAllocator, e.poolCache)
+	controller := NewController(queue, indexer.(cache.Indexer), informer, poolRef, dhcpAllocator, poolCache)
 
 	go controller.Run(1)
 
 	<-ctx.Done()
 	controller.Stop()
+}
 
-	logrus.Info("(eventhandler.Run) IPPool event listener terminated")
+// RunInProcess serves the IPPool of poolRef with dhcpAllocator until ctx is
+// done, for agents hosted by the controller process itself. It's the
+// in-process counterpart of EventListener: the IPPools come from informer, the
+// shared informer of the controller, rather than from a watch of their own,
+// and go through the same controller.
+func RunInProcess(ctx context.Context, informer cache.SharedIndexInformer, poolRef types.NamespacedName, dhcpAllocator *dhcp.DHCPAllocator) error {
+	logrus.Infof("(eventhandler.RunInProcess) starting in-process IPPool event listener for %s", poolRef.String())
+
+	queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[Event]())
+
+	registration, err := informer.AddEventHandler(newResourceEventHandler(queue))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := informer.RemoveEventHandler(registration); err != nil {
+			logrus.Warnf("(eventhandler.RunInProcess) cannot remove IPPool event handler: %s", err.Error())
+		}
+	}()
+
+	// The IPPools already cached are only notified as added, which the
+	// controller doesn't act on, so the IPPool is applied right away
+	queue.Add(Event{
+		key:    poolRef.String(),
+		action: UPDATE,
+	})
+
+	controller := NewController(queue, informer.GetIndexer(), nil, poolRef, dhcpAllocator, make(map[string]map[string]string))
+
+	go controller.Run(1)
+
+	<-ctx.Done()
+	controller.Stop()
+
+	logrus.Infof("(eventhandler.RunInProcess) in-process IPPool event listener for %s terminated", poolRef.String())
+
+	return nil
+}
+
+// newResourceEventHandler returns the handler turning the IPPool
+// notifications into the events of queue.
+func newResourceEventHandler(queue workqueue.TypedRateLimitingInterface[Event]) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old interface{}, new interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(new)
+			if err == nil {
+				queue.Add(Event{
+					key:             key,
+					action:          UPDATE,
+					poolName:        new.(*networkv1.IPPool).Name,
+					poolNetworkName: new.(*networkv1.IPPool).Spec.NetworkName,
+				})
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err == nil {
+				queue.Add(Event{
+					key:    key,
+					action: DELETE,
+				})
+			}
+		},
+	}
 }
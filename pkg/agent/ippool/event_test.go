@@ -0,0 +1,128 @@
+package ippool
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/dhcp"
+)
+
+// newTestListerWatcher returns a ListerWatcher of no IPPools, whose watch
+// delivers the events played to the returned watcher.
+func newTestListerWatcher() (cache.ListerWatcher, *watch.FakeWatcher) {
+	watcher := watch.NewFakeWithChanSize(16, false)
+	return &cache.ListWatch{
+		ListFunc: func(_ metav1.ListOptions) (runtime.Object, error) {
+			return &networkv1.IPPoolList{}, nil
+		},
+		WatchFunc: func(_ metav1.ListOptions) (watch.Interface, error) {
+			return watcher, nil
+		},
+	}, watcher
+}
+
+// TestRunInProcess_Conformance plays the same IPPool events to the listener of
+// the agent Pods and to the in-process one of the embedded agents. Both serve
+// the same leases all along.
+func TestRunInProcess_Conformance(t *testing.T) {
+	poolRef := types.NamespacedName{Namespace: testIPPoolNamespace, Name: testIPPoolName}
+
+	newRevision := func(revision int64, leases map[string]string) *networkv1.IPPool {
+		ipPool := newTestIPPool(networkv1.IPPoolStatusSchemaVersion, leases)
+		ipPool.UID = "c3a9e1d4-5b6f-4a7e-8d9c-0b1a2c3d4e5f"
+		ipPool.Generation = 1
+		ipPool.ResourceVersion = fmt.Sprintf("%d", 100+revision)
+		ipPool.Status.AllocationRevision = revision
+		return ipPool
+	}
+
+	// An IPPool of another network, whose leases aren't served
+	const testMACAddress3 = "33:44:55:66:77:88"
+	other := newTestIPPool(networkv1.IPPoolStatusSchemaVersion, map[string]string{testIPAddress3: testMACAddress3})
+	other.Name = "net-2"
+
+	// The first MAC address is released at the third revision
+	steps := []struct {
+		name           string
+		play           func(w *watch.FakeWatcher)
+		expectedLeases map[string]string
+	}{
+		{
+			name: "ippool allocating",
+			play: func(w *watch.FakeWatcher) {
+				w.Add(newRevision(1, map[string]string{testIPAddress1: testMACAddress1}))
+				w.Modify(newRevision(2, map[string]string{testIPAddress1: testMACAddress1, testIPAddress2: testMACAddress2}))
+			},
+			expectedLeases: map[string]string{testMACAddress1: testIPAddress1, testMACAddress2: testIPAddress2},
+		},
+		{
+			name: "ippool releasing",
+			play: func(w *watch.FakeWatcher) {
+				w.Modify(newRevision(3, map[string]string{testIPAddress2: testMACAddress2}))
+			},
+			expectedLeases: map[string]string{testMACAddress2: testIPAddress2},
+		},
+		{
+			name: "other ippool allocating",
+			play: func(w *watch.FakeWatcher) {
+				w.Add(other)
+				w.Modify(other.DeepCopy())
+			},
+			expectedLeases: map[string]string{testMACAddress2: testIPAddress2},
+		},
+		{
+			name: "ippool removed",
+			play: func(w *watch.FakeWatcher) {
+				w.Delete(newRevision(3, map[string]string{testIPAddress2: testMACAddress2}))
+			},
+			expectedLeases: map[string]string{},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	standaloneWatcher, standaloneEvents := newTestListerWatcher()
+	standalone := dhcp.New()
+	go listen(ctx, standaloneWatcher, poolRef, standalone, make(map[string]map[string]string))
+
+	inProcessWatcher, inProcessEvents := newTestListerWatcher()
+	informer := cache.NewSharedIndexInformer(inProcessWatcher, &networkv1.IPPool{}, 0, cache.Indexers{})
+	go informer.Run(ctx.Done())
+	assert.True(t, cache.WaitForCacheSync(ctx.Done(), informer.HasSynced))
+	inProcess := dhcp.New()
+	go func() {
+		assert.Nil(t, RunInProcess(ctx, informer, poolRef, inProcess))
+	}()
+
+	leasesOf := func(a *dhcp.DHCPAllocator) map[string]string {
+		leases := make(map[string]string)
+		for _, mac := range []string{testMACAddress1, testMACAddress2, testMACAddress3} {
+			if ip := a.GetLease(mac).ClientIP; ip != nil {
+				leases[mac] = ip.String()
+			}
+		}
+		return leases
+	}
+
+	for _, step := range steps {
+		step.play(standaloneEvents)
+		step.play(inProcessEvents)
+
+		for name, a := range map[string]*dhcp.DHCPAllocator{"standalone": standalone, "in-process": inProcess} {
+			assert.Eventually(t, func() bool {
+				return assert.ObjectsAreEqual(step.expectedLeases, leasesOf(a))
+			}, 5*time.Second, 10*time.Millisecond, "%s: %s agent should serve %v, serves %v", step.name, name, step.expectedLeases, leasesOf(a))
+		}
+	}
+}
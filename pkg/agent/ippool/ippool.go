@@ -1,12 +1,86 @@
 package ippool
 
 import (
+	"errors"
+	"reflect"
+
 	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/types"
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
 	"github.com/harvester/vm-dhcp-controller/pkg/util"
 )
 
+// ErrStaleSync is returned for an IPPool older than or the same as the one
+// last applied, e.g., one replayed by the informer after a network blip. It
+// means there's nothing to do.
+var ErrStaleSync = errors.New("stale sync")
+
+// syncMark identifies the IPPools syncs were applied from. The generation and
+// the allocation revision of the IPPool never go backward. The resource
+// versions applied at the same ones tell a replay from a status update
+// leaving the leases alone, e.g., of a condition.
+type syncMark struct {
+	uid              types.UID
+	generation       int64
+	revision         int64
+	resourceVersions map[string]struct{}
+}
+
+// isStale reports whether ipPool is older than or the same as an IPPool
+// already applied. An IPPool recreated under the same name starts over.
+func (mark *syncMark) isStale(ipPool *networkv1.IPPool) bool {
+	if ipPool.UID != mark.uid {
+		return false
+	}
+	if ipPool.Generation != mark.generation {
+		return ipPool.Generation < mark.generation
+	}
+	if ipPool.Status.AllocationRevision != mark.revision {
+		return ipPool.Status.AllocationRevision < mark.revision
+	}
+	// IPPools lacking a resource version, i.e., not from the API server,
+	// can't be told apart
+	if ipPool.ResourceVersion == "" {
+		return false
+	}
+	_, ok := mark.resourceVersions[ipPool.ResourceVersion]
+	return ok
+}
+
+// advance records ipPool as applied, and returns the mark of the IPPools
+// applied since.
+func (mark *syncMark) advance(ipPool *networkv1.IPPool) *syncMark {
+	if mark == nil || ipPool.UID != mark.uid || ipPool.Generation != mark.generation || ipPool.Status.AllocationRevision != mark.revision {
+		mark = &syncMark{
+			uid:              ipPool.UID,
+			generation:       ipPool.Generation,
+			revision:         ipPool.Status.AllocationRevision,
+			resourceVersions: make(map[string]struct{}),
+		}
+	}
+	mark.resourceVersions[ipPool.ResourceVersion] = struct{}{}
+	return mark
+}
+
+// leaseSettings are the settings of an IPPool the leases are added with, apart
+// from their addresses and default routes.
+type leaseSettings struct {
+	ipv4Config   networkv1.IPv4Config
+	staticRoutes []networkv1.Route
+}
+
+// Update syncs the leases of the IPPool into the DHCP lease store. The leases
+// carry the options of the IPPool they come from, so the clients of delegated
+// IPPools get the options of the IPPool whose range holds their address. The
+// settings shared by the whole pool only come from the IPPool of the agent.
+// Leases missing from a status predating the current schema aren't taken as
+// released, as the status may just lack the records holding them. A resync of
+// the IPPool by the controller has its leases rebuilt from scratch, and
+// supersedes whatever was applied before it. An IPPool older than or the same
+// as the one last applied is rejected with ErrStaleSync, so a replay can't
+// bring back a lease released in between. Once the options of the IPPool
+// change, its leases are added again so the next replies carry the new ones.
 func (c *Controller) Update(ipPool *networkv1.IPPool) error {
 	if !networkv1.CacheReady.IsTrue(ipPool) {
 		logrus.Warningf("ippool %s/%s is not ready", ipPool.Namespace, ipPool.Name)
@@ -16,56 +90,190 @@ func (c *Controller) Update(ipPool *networkv1.IPPool) error {
 		logrus.Warningf("ippool %s/%s status has no records", ipPool.Namespace, ipPool.Name)
 		return nil
 	}
-	allocated := ipPool.Status.IPv4.Allocated
-	filterExcludedAndReserved(allocated)
-	return c.updatePoolCacheAndLeaseStore(allocated, ipPool.Spec.IPv4Config)
+	key := ipPool.Namespace + "/" + ipPool.Name
+	applied := c.applied[key]
+	if applied != nil && applied.isStale(ipPool) {
+		return ErrStaleSync
+	}
+	if key == c.poolRef.String() {
+		authoritative := ipPool.Spec.Authoritative != nil && *ipPool.Spec.Authoritative
+		allowBOOTP := ipPool.Spec.AllowBOOTP != nil && *ipPool.Spec.AllowBOOTP
+		if err := c.dhcpAllocator.SetPoolConfig(ipPool.Spec.IPv4Config.ServerIP, ipPool.Spec.IPv4Config.CIDR, authoritative, allowBOOTP, ipPool.Spec.RelayGateways); err != nil {
+			return err
+		}
+	}
+	// The reserveOnly leases are left out, so they're dropped from the lease
+	// store like released ones
+	allocated := normalizeLeases(util.ServedLeases(ipPool.Status.IPv4))
+	defaultRoutes := util.DefaultRoutes(ipPool)
+	if ip, mac, ok := util.DHCPCheckLease(ipPool); ok {
+		allocated[ip] = util.NormalizeMAC(mac)
+		defaultRoutes[ip] = util.DefaultRouteEnabled(ipPool, nil)
+	}
+	staticRoutes := util.MergeStaticRoutes(ipPool.Spec.IPv4Config.StaticRoutes, ipPool.Status.ServiceRoutes)
+	prune := util.IsStatusCurrent(ipPool)
+	if !prune {
+		logrus.Warningf("ippool %s/%s status predates schema version %d, keep leases missing from it", ipPool.Namespace, ipPool.Name, networkv1.IPPoolStatusSchemaVersion)
+	}
+	var resyncID string
+	if ipPool.Status.LastResync != nil {
+		resyncID = ipPool.Status.LastResync.RequestID
+	}
+	if resyncID != "" && resyncID != c.resyncs[key] {
+		logrus.Infof("ippool %s/%s was resynced by %s, rebuild its leases", ipPool.Namespace, ipPool.Name, resyncID)
+		if err := c.resyncPool(key, allocated); err != nil {
+			return err
+		}
+		if err := c.removeIPv6Leases(key); err != nil {
+			return err
+		}
+	}
+	settings := leaseSettings{
+		ipv4Config:   *ipPool.Spec.IPv4Config.DeepCopy(),
+		staticRoutes: staticRoutes,
+	}
+	previous, ok := c.settings[key]
+	refresh := ok && !reflect.DeepEqual(previous, settings)
+	if refresh {
+		logrus.Infof("ippool %s/%s settings changed, refresh its leases", ipPool.Namespace, ipPool.Name)
+	}
+	if err := c.updatePoolCacheAndLeaseStore(key, allocated, defaultRoutes, ipPool.Spec.IPv4Config, staticRoutes, prune, refresh); err != nil {
+		return err
+	}
+	if c.settings == nil {
+		c.settings = make(map[string]leaseSettings)
+	}
+	c.settings[key] = settings
+	if err := c.updateIPv6Leases(key, ipPool, prune); err != nil {
+		return err
+	}
+	if resyncID != "" {
+		if c.resyncs == nil {
+			c.resyncs = make(map[string]string)
+		}
+		c.resyncs[key] = resyncID
+	}
+	if c.applied == nil {
+		c.applied = make(map[string]*syncMark)
+	}
+	c.applied[key] = applied.advance(ipPool)
+	return nil
+}
+
+// normalizeLeases normalizes the MAC addresses of leases in place, so the pool
+// cache holds them the way the lease store keys them, whatever form the status
+// of the IPPool records them in.
+func normalizeLeases(leases map[string]string) map[string]string {
+	for ip, mac := range leases {
+		leases[ip] = util.NormalizeMAC(mac)
+	}
+	return leases
 }
 
-func (c *Controller) updatePoolCacheAndLeaseStore(latest map[string]string, ipv4Config networkv1.IPv4Config) error {
-	for ip, mac := range c.poolCache {
+// updatePoolCacheAndLeaseStore brings the leases of the IPPool in the DHCP
+// lease store in line with latest. Refreshed leases are added again even if
+// they're unchanged, for the settings of the IPPool to apply to them.
+func (c *Controller) updatePoolCacheAndLeaseStore(key string, latest map[string]string, defaultRoutes map[string]bool, ipv4Config networkv1.IPv4Config, staticRoutes []networkv1.Route, prune, refresh bool) error {
+	poolCache, ok := c.poolCache[key]
+	if !ok {
+		poolCache = make(map[string]string, len(latest))
+		c.poolCache[key] = poolCache
+	}
+
+	for ip, mac := range poolCache {
 		if newMAC, exists := latest[ip]; exists {
 			if mac != newMAC {
 				logrus.Infof("set %s with new value %s", ip, newMAC)
 				// TODO: update lease
-				c.poolCache[ip] = newMAC
+				poolCache[ip] = newMAC
+			} else if refresh || c.dhcpAllocator.GetLease(mac).NoDefaultRoute == defaultRoutes[ip] {
+				// The lease is added back with the new settings below
+				logrus.Infof("set %s with default route %t", ip, defaultRoutes[ip])
+				if err := c.dhcpAllocator.DeleteLease(mac); err != nil {
+					return err
+				}
+				delete(poolCache, ip)
 			}
-		} else {
+		} else if prune {
 			logrus.Infof("remove %s", ip)
-			if err := c.dhcpAllocator.DeleteLease(c.poolCache[ip]); err != nil {
+			if err := c.dhcpAllocator.DeleteLease(poolCache[ip]); err != nil {
 				return err
 			}
-			delete(c.poolCache, ip)
+			delete(poolCache, ip)
 		}
 	}
 
 	for newIP, newMAC := range latest {
-		if _, exists := c.poolCache[newIP]; !exists {
+		if _, exists := poolCache[newIP]; !exists {
 			logrus.Infof("add %s with value %s", newIP, newMAC)
 			if err := c.dhcpAllocator.AddLease(
 				newMAC,
 				ipv4Config.ServerIP,
 				newIP,
 				ipv4Config.CIDR,
+				ipv4Config.SubnetMaskOverride,
 				ipv4Config.Router,
 				ipv4Config.DNS,
 				ipv4Config.DomainName,
 				ipv4Config.DomainSearch,
 				ipv4Config.NTP,
 				ipv4Config.LeaseTime,
+				staticRoutes,
+				ipv4Config.AlwaysSendOptions,
+				ipv4Config.Options,
+				defaultRoutes[newIP],
 			); err != nil {
 				return err
 			}
-			c.poolCache[newIP] = newMAC
+			poolCache[newIP] = newMAC
 		}
 	}
 
 	return nil
 }
 
-func filterExcludedAndReserved(allocated map[string]string) {
-	for ip, mac := range allocated {
-		if mac == util.ExcludedMark || mac == util.ReservedMark {
-			delete(allocated, ip)
+// removePool deletes the leases of the IPPool from the DHCP lease store.
+func (c *Controller) removePool(key string) error {
+	for ip, mac := range c.poolCache[key] {
+		logrus.Infof("remove %s", ip)
+		if err := c.dhcpAllocator.DeleteLease(mac); err != nil {
+			return err
 		}
+		delete(c.poolCache[key], ip)
 	}
+	delete(c.poolCache, key)
+	if err := c.removeIPv6Leases(key); err != nil {
+		return err
+	}
+	delete(c.resyncs, key)
+	delete(c.applied, key)
+	delete(c.settings, key)
+
+	return nil
+}
+
+// resyncPool drops whatever the DHCP lease store holds for the IPPool, i.e.,
+// the leases cached for it and any other lease of the MAC addresses of latest,
+// so they're all added afresh. Leases the store lost on its own are skipped.
+func (c *Controller) resyncPool(key string, latest map[string]string) error {
+	macs := make(map[string]struct{}, len(latest))
+	for _, mac := range c.poolCache[key] {
+		macs[mac] = struct{}{}
+	}
+	for _, mac := range latest {
+		macs[mac] = struct{}{}
+	}
+
+	for mac := range macs {
+		if c.dhcpAllocator.GetLease(mac).ClientIP == nil {
+			continue
+		}
+		logrus.Infof("remove lease of %s", mac)
+		if err := c.dhcpAllocator.DeleteLease(mac); err != nil {
+			return err
+		}
+	}
+	delete(c.poolCache, key)
+
+	return nil
 }
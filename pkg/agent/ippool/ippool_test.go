@@ -0,0 +1,483 @@
+package ippool
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/dhcp"
+)
+
+const (
+	testIPPoolNamespace = "default"
+	testIPPoolName      = "net-1"
+	testServerIP        = "192.168.0.2"
+	testCIDR            = "192.168.0.0/24"
+	testIPAddress1      = "192.168.0.101"
+	testIPAddress2      = "192.168.0.102"
+	testIPAddress3      = "192.168.0.103"
+	testMACAddress1     = "11:22:33:44:55:66"
+	testMACAddress2     = "22:33:44:55:66:77"
+)
+
+func newTestIPPool(schemaVersion int64, leases map[string]string) *networkv1.IPPool {
+	ipPool := &networkv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: testIPPoolNamespace,
+			Name:      testIPPoolName,
+		},
+		Spec: networkv1.IPPoolSpec{
+			IPv4Config: networkv1.IPv4Config{
+				ServerIP: testServerIP,
+				CIDR:     testCIDR,
+			},
+		},
+		Status: networkv1.IPPoolStatus{
+			SchemaVersion: schemaVersion,
+			IPv4: &networkv1.IPv4Status{
+				Entries: make(map[string]networkv1.AllocationEntry),
+			},
+		},
+	}
+	for ip, mac := range leases {
+		ipPool.Status.IPv4.Entries[ip] = networkv1.AllocationEntry{
+			Type:  networkv1.AllocationTypeLease,
+			Owner: mac,
+		}
+	}
+	networkv1.CacheReady.True(ipPool)
+	return ipPool
+}
+
+// TestController_Update_StatusSchemaUpgrade feeds an IPPool whose status
+// predates the current schema, as delivered by the informer while the CRDs
+// are upgraded, to the agent. The leases missing from such a status are kept
+// until the status is written at the current schema version.
+func TestController_Update_StatusSchemaUpgrade(t *testing.T) {
+	c := &Controller{
+		poolRef:       types.NamespacedName{Namespace: testIPPoolNamespace, Name: testIPPoolName},
+		dhcpAllocator: dhcp.New(),
+		poolCache:     make(map[string]map[string]string),
+	}
+
+	err := c.Update(newTestIPPool(networkv1.IPPoolStatusSchemaVersion, map[string]string{
+		testIPAddress1: testMACAddress1,
+		testIPAddress2: testMACAddress2,
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, testIPAddress2, c.dhcpAllocator.GetLease(testMACAddress2).ClientIP.String())
+
+	err = c.Update(newTestIPPool(0, map[string]string{
+		testIPAddress1: testMACAddress1,
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, testIPAddress2, c.dhcpAllocator.GetLease(testMACAddress2).ClientIP.String(), "lease should be kept while the status predates the current schema")
+
+	err = c.Update(newTestIPPool(networkv1.IPPoolStatusSchemaVersion, map[string]string{
+		testIPAddress1: testMACAddress1,
+	}))
+	assert.Nil(t, err)
+	assert.Nil(t, c.dhcpAllocator.GetLease(testMACAddress2).ClientIP, "lease should be removed once released in a current status")
+	assert.Equal(t, testIPAddress1, c.dhcpAllocator.GetLease(testMACAddress1).ClientIP.String())
+}
+
+// TestController_Update_ReserveOnly switches a lease between the dhcp and
+// reserveOnly modes. The agent only serves it in the dhcp mode.
+func TestController_Update_ReserveOnly(t *testing.T) {
+	c := &Controller{
+		poolRef:       types.NamespacedName{Namespace: testIPPoolNamespace, Name: testIPPoolName},
+		dhcpAllocator: dhcp.New(),
+		poolCache:     make(map[string]map[string]string),
+	}
+	leases := map[string]string{
+		testIPAddress1: testMACAddress1,
+		testIPAddress2: testMACAddress2,
+	}
+	withMode := func(mode networkv1.NetworkConfigMode) *networkv1.IPPool {
+		ipPool := newTestIPPool(networkv1.IPPoolStatusSchemaVersion, leases)
+		entry := ipPool.Status.IPv4.Entries[testIPAddress2]
+		entry.Mode = mode
+		ipPool.Status.IPv4.Entries[testIPAddress2] = entry
+		return ipPool
+	}
+
+	err := c.Update(withMode(networkv1.NetworkConfigModeReserveOnly))
+	assert.Nil(t, err)
+	assert.Equal(t, testIPAddress1, c.dhcpAllocator.GetLease(testMACAddress1).ClientIP.String())
+	assert.Nil(t, c.dhcpAllocator.GetLease(testMACAddress2).ClientIP, "reserveOnly lease shouldn't be served")
+
+	err = c.Update(withMode(networkv1.NetworkConfigModeDHCP))
+	assert.Nil(t, err)
+	assert.Equal(t, testIPAddress2, c.dhcpAllocator.GetLease(testMACAddress2).ClientIP.String())
+
+	err = c.Update(withMode(networkv1.NetworkConfigModeReserveOnly))
+	assert.Nil(t, err)
+	assert.Nil(t, c.dhcpAllocator.GetLease(testMACAddress2).ClientIP, "lease switched to reserveOnly should be dropped")
+	assert.Equal(t, testIPAddress1, c.dhcpAllocator.GetLease(testMACAddress1).ClientIP.String())
+}
+
+// TestController_Update_MACAddressForms feeds leases whose MAC addresses are
+// recorded in other forms than the canonical one. They're cached and served
+// under the canonical form, so the same address in another form is the same
+// lease rather than a new one.
+func TestController_Update_MACAddressForms(t *testing.T) {
+	c := &Controller{
+		poolRef:       types.NamespacedName{Namespace: testIPPoolNamespace, Name: testIPPoolName},
+		dhcpAllocator: dhcp.New(),
+		poolCache:     make(map[string]map[string]string),
+	}
+	key := testIPPoolNamespace + "/" + testIPPoolName
+
+	for _, form := range []string{"11-22-33-44-55-66", "1122.3344.5566", testMACAddress1} {
+		err := c.Update(newTestIPPool(networkv1.IPPoolStatusSchemaVersion, map[string]string{
+			testIPAddress1: form,
+			testIPAddress2: testMACAddress2,
+		}))
+		assert.Nil(t, err, form)
+		assert.Equal(t, testIPAddress1, c.dhcpAllocator.GetLease(testMACAddress1).ClientIP.String(), form)
+		assert.Equal(t, map[string]string{testIPAddress1: testMACAddress1, testIPAddress2: testMACAddress2}, c.poolCache[key], form)
+	}
+
+	err := c.Update(newTestIPPool(networkv1.IPPoolStatusSchemaVersion, map[string]string{
+		testIPAddress2: testMACAddress2,
+	}))
+	assert.Nil(t, err)
+	assert.Nil(t, c.dhcpAllocator.GetLease(testMACAddress1).ClientIP, "lease recorded in another form should be removed once released")
+}
+
+// TestController_Update_Options changes the options of an IPPool serving a
+// lease. The lease is added again with the new options, with no restart.
+func TestController_Update_Options(t *testing.T) {
+	c := &Controller{
+		poolRef:       types.NamespacedName{Namespace: testIPPoolNamespace, Name: testIPPoolName},
+		dhcpAllocator: dhcp.New(),
+		poolCache:     make(map[string]map[string]string),
+	}
+	leases := map[string]string{testIPAddress1: testMACAddress1}
+
+	err := c.Update(newTestIPPool(networkv1.IPPoolStatusSchemaVersion, leases))
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0), c.dhcpAllocator.GetLease(testMACAddress1).MTU)
+
+	mtu := 1450
+	ipPool := newTestIPPool(networkv1.IPPoolStatusSchemaVersion, leases)
+	ipPool.Spec.IPv4Config.Options = &networkv1.DHCPOptions{MTU: &mtu}
+	ipPool.Spec.IPv4Config.NTP = []string{"192.168.0.253"}
+	err = c.Update(ipPool)
+	assert.Nil(t, err)
+	lease := c.dhcpAllocator.GetLease(testMACAddress1)
+	assert.Equal(t, testIPAddress1, lease.ClientIP.String())
+	assert.Equal(t, uint16(1450), lease.MTU, "lease should carry the new mtu")
+	assert.Equal(t, "192.168.0.253", lease.NTP[0].String(), "lease should carry the new ntp servers")
+}
+
+func TestController_Update_IPv6(t *testing.T) {
+	c := &Controller{
+		poolRef:       types.NamespacedName{Namespace: testIPPoolNamespace, Name: testIPPoolName},
+		dhcpAllocator: dhcp.New(),
+		poolCache:     make(map[string]map[string]string),
+	}
+	leases := map[string]string{
+		testIPAddress1: testMACAddress1,
+		testIPAddress2: testMACAddress2,
+	}
+	withIPv6 := func(ipv6Leases map[string]string) *networkv1.IPPool {
+		ipPool := newTestIPPool(networkv1.IPPoolStatusSchemaVersion, leases)
+		if ipv6Leases == nil {
+			return ipPool
+		}
+		ipPool.Spec.IPv6Config = &networkv1.IPv6Config{
+			CIDR: "2001:db8::/64",
+			Pool: networkv1.IPv6Pool{Start: "2001:db8::100"},
+			DNS:  []string{"2001:db8::53"},
+		}
+		ipPool.Status.IPv6 = &networkv1.IPv6Status{Entries: make(map[string]networkv1.AllocationEntry)}
+		for ip, mac := range ipv6Leases {
+			ipPool.Status.IPv6.Entries[ip] = networkv1.AllocationEntry{
+				Type:  networkv1.AllocationTypeLease,
+				Owner: mac,
+			}
+		}
+		return ipPool
+	}
+
+	err := c.Update(withIPv6(map[string]string{
+		"2001:db8::101": testMACAddress1,
+		"2001:db8::102": testMACAddress2,
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, testIPAddress1, c.dhcpAllocator.GetLease(testMACAddress1).ClientIP.String())
+	assert.Equal(t, "2001:db8::101", c.dhcpAllocator.GetLease6(testMACAddress1).ClientIP.String())
+	assert.Equal(t, "2001:db8::102", c.dhcpAllocator.GetLease6(testMACAddress2).ClientIP.String())
+	assert.Equal(t, "2001:db8::53", c.dhcpAllocator.GetLease6(testMACAddress2).DNS[0].String())
+
+	err = c.Update(withIPv6(map[string]string{
+		"2001:db8::101": testMACAddress1,
+	}))
+	assert.Nil(t, err)
+	assert.Nil(t, c.dhcpAllocator.GetLease6(testMACAddress2).ClientIP, "released ipv6 lease should be dropped")
+	assert.Equal(t, testIPAddress2, c.dhcpAllocator.GetLease(testMACAddress2).ClientIP.String(), "ipv4 lease should be kept")
+
+	err = c.Update(withIPv6(nil))
+	assert.Nil(t, err)
+	assert.Nil(t, c.dhcpAllocator.GetLease6(testMACAddress1).ClientIP, "ipv6 leases should go with the ipv6 config")
+	assert.Equal(t, testIPAddress1, c.dhcpAllocator.GetLease(testMACAddress1).ClientIP.String())
+}
+
+// TestController_Update_Resync has the lease store drift from the IPPool, and
+// the controller resync the IPPool. The leases are rebuilt from its status
+// once per resync.
+func TestController_Update_Resync(t *testing.T) {
+	c := NewController(nil, nil, nil,
+		types.NamespacedName{Namespace: testIPPoolNamespace, Name: testIPPoolName},
+		dhcp.New(),
+		make(map[string]map[string]string),
+	)
+	leases := map[string]string{
+		testIPAddress1: testMACAddress1,
+		testIPAddress2: testMACAddress2,
+	}
+
+	err := c.Update(newTestIPPool(networkv1.IPPoolStatusSchemaVersion, map[string]string{
+		testIPAddress1: testMACAddress1,
+	}))
+	assert.Nil(t, err)
+
+	// The lease store lost the lease of the first MAC address, and holds one
+	// of the second it was never told about
+	err = c.dhcpAllocator.DeleteLease(testMACAddress1)
+	assert.Nil(t, err)
+	err = c.dhcpAllocator.AddLease(testMACAddress2, testServerIP, testIPAddress3, testCIDR, "", "", nil, nil, nil, nil, nil, nil, nil, nil, true)
+	assert.Nil(t, err)
+
+	err = c.Update(newTestIPPool(networkv1.IPPoolStatusSchemaVersion, leases))
+	assert.NotNil(t, err, "drifted lease store should fail to take the leases")
+
+	resynced := newTestIPPool(networkv1.IPPoolStatusSchemaVersion, leases)
+	resynced.Status.LastResync = &networkv1.ResyncResult{RequestID: "r1"}
+	err = c.Update(resynced)
+	assert.Nil(t, err)
+	assert.Equal(t, testIPAddress1, c.dhcpAllocator.GetLease(testMACAddress1).ClientIP.String())
+	assert.Equal(t, testIPAddress2, c.dhcpAllocator.GetLease(testMACAddress2).ClientIP.String())
+	assert.Equal(t, leases, c.poolCache[testIPPoolNamespace+"/"+testIPPoolName])
+
+	// The same resync isn't run again
+	err = c.dhcpAllocator.DeleteLease(testMACAddress1)
+	assert.Nil(t, err)
+	err = c.Update(resynced)
+	assert.Nil(t, err)
+	assert.Nil(t, c.dhcpAllocator.GetLease(testMACAddress1).ClientIP, "lease store should be left alone until the next resync")
+}
+
+// TestController_Update_Replay feeds the agent the IPPools of an allocation
+// history out of order and more than once, as the informer may deliver them
+// after a network blip. Whatever the order, the lease store ends up holding
+// the leases of the latest IPPool, and the older ones are rejected as stale.
+func TestController_Update_Replay(t *testing.T) {
+	newRevision := func(revision int64, resourceVersion string, leases map[string]string) *networkv1.IPPool {
+		ipPool := newTestIPPool(networkv1.IPPoolStatusSchemaVersion, leases)
+		ipPool.UID = "c3a9e1d4-5b6f-4a7e-8d9c-0b1a2c3d4e5f"
+		ipPool.Generation = 1
+		ipPool.ResourceVersion = resourceVersion
+		ipPool.Status.AllocationRevision = revision
+		return ipPool
+	}
+
+	// The first MAC address is released at the third revision
+	history := []*networkv1.IPPool{
+		newRevision(1, "101", map[string]string{testIPAddress1: testMACAddress1}),
+		newRevision(2, "102", map[string]string{testIPAddress1: testMACAddress1, testIPAddress2: testMACAddress2}),
+		newRevision(3, "103", map[string]string{testIPAddress2: testMACAddress2}),
+	}
+
+	// A condition changing leaves the allocation revision as is
+	conditionUpdate := newRevision(3, "104", map[string]string{testIPAddress2: testMACAddress2})
+	networkv1.AgentReady.True(conditionUpdate)
+
+	// A resync has the leases rebuilt, and the first MAC address is given
+	// its IP address back afterwards
+	resynced := newRevision(4, "105", map[string]string{testIPAddress2: testMACAddress2})
+	resynced.Status.LastResync = &networkv1.ResyncResult{RequestID: "r1"}
+	reallocated := newRevision(5, "106", map[string]string{testIPAddress1: testMACAddress1, testIPAddress2: testMACAddress2})
+	reallocated.Status.LastResync = resynced.Status.LastResync
+
+	type step struct {
+		ipPool        *networkv1.IPPool
+		expectedStale bool
+	}
+
+	testCases := []struct {
+		name           string
+		steps          []step
+		expectedLeases map[string]string
+	}{
+		{
+			name: "duplicated syncs",
+			steps: []step{
+				{ipPool: history[0]},
+				{ipPool: history[0], expectedStale: true},
+				{ipPool: history[1]},
+				{ipPool: history[1], expectedStale: true},
+				{ipPool: history[2]},
+				{ipPool: history[2], expectedStale: true},
+			},
+			expectedLeases: map[string]string{testIPAddress2: testMACAddress2},
+		},
+		{
+			name: "release replayed",
+			steps: []step{
+				{ipPool: history[0]},
+				{ipPool: history[1]},
+				{ipPool: history[2]},
+				{ipPool: history[1], expectedStale: true},
+				{ipPool: history[0], expectedStale: true},
+			},
+			expectedLeases: map[string]string{testIPAddress2: testMACAddress2},
+		},
+		{
+			name: "out of order",
+			steps: []step{
+				{ipPool: history[2]},
+				{ipPool: history[0], expectedStale: true},
+				{ipPool: history[1], expectedStale: true},
+			},
+			expectedLeases: map[string]string{testIPAddress2: testMACAddress2},
+		},
+		{
+			name: "status update at the same revision",
+			steps: []step{
+				{ipPool: history[2]},
+				{ipPool: conditionUpdate},
+				{ipPool: history[2], expectedStale: true},
+				{ipPool: conditionUpdate, expectedStale: true},
+			},
+			expectedLeases: map[string]string{testIPAddress2: testMACAddress2},
+		},
+		{
+			name: "resync supersedes older syncs",
+			steps: []step{
+				{ipPool: history[1]},
+				{ipPool: resynced},
+				{ipPool: history[1], expectedStale: true},
+				{ipPool: history[2], expectedStale: true},
+				{ipPool: resynced, expectedStale: true},
+			},
+			expectedLeases: map[string]string{testIPAddress2: testMACAddress2},
+		},
+		{
+			name: "resync replayed after newer syncs",
+			steps: []step{
+				{ipPool: resynced},
+				{ipPool: reallocated},
+				{ipPool: resynced, expectedStale: true},
+			},
+			expectedLeases: map[string]string{testIPAddress1: testMACAddress1, testIPAddress2: testMACAddress2},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewController(nil, nil, nil,
+				types.NamespacedName{Namespace: testIPPoolNamespace, Name: testIPPoolName},
+				dhcp.New(),
+				make(map[string]map[string]string),
+			)
+
+			for i, step := range tc.steps {
+				err := c.Update(step.ipPool.DeepCopy())
+				if step.expectedStale {
+					assert.ErrorIs(t, err, ErrStaleSync, "step %d should be rejected", i)
+				} else {
+					assert.Nil(t, err, "step %d should be applied", i)
+				}
+			}
+
+			assert.Equal(t, tc.expectedLeases, c.poolCache[testIPPoolNamespace+"/"+testIPPoolName])
+			for _, mac := range []string{testMACAddress1, testMACAddress2} {
+				var leasedIP string
+				for ip, leasedMAC := range tc.expectedLeases {
+					if leasedMAC == mac {
+						leasedIP = ip
+					}
+				}
+				if leasedIP == "" {
+					assert.Nil(t, c.dhcpAllocator.GetLease(mac).ClientIP, "%s should hold no lease", mac)
+					continue
+				}
+				assert.Equal(t, leasedIP, c.dhcpAllocator.GetLease(mac).ClientIP.String())
+			}
+		})
+	}
+
+	t.Run("recreated ippool starts over", func(t *testing.T) {
+		c := NewController(nil, nil, nil,
+			types.NamespacedName{Namespace: testIPPoolNamespace, Name: testIPPoolName},
+			dhcp.New(),
+			make(map[string]map[string]string),
+		)
+
+		err := c.Update(history[2].DeepCopy())
+		assert.Nil(t, err)
+
+		recreated := newRevision(1, "201", map[string]string{testIPAddress1: testMACAddress1})
+		recreated.UID = "0f1e2d3c-4b5a-4968-8776-a5b4c3d2e1f0"
+		err = c.Update(recreated)
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{testIPAddress1: testMACAddress1}, c.poolCache[testIPPoolNamespace+"/"+testIPPoolName])
+	})
+}
+
+// BenchmarkController_Update applies an IPPool with 50k leases to an empty
+// lease store, and once more unchanged.
+func BenchmarkController_Update(b *testing.B) {
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	leases := make(map[string]string, 50000)
+	for i := 0; i < 50000; i++ {
+		n := i + 2
+		leases[fmt.Sprintf("10.%d.%d.%d", n>>16&0xff, n>>8&0xff, n&0xff)] =
+			fmt.Sprintf("02:00:00:%02x:%02x:%02x", n>>16&0xff, n>>8&0xff, n&0xff)
+	}
+	ipPool := newTestIPPool(networkv1.IPPoolStatusSchemaVersion, leases)
+	ipPool.Spec.IPv4Config.ServerIP = "10.0.0.1"
+	ipPool.Spec.IPv4Config.CIDR = "10.0.0.0/8"
+
+	newController := func() *Controller {
+		return &Controller{
+			poolRef:       types.NamespacedName{Namespace: testIPPoolNamespace, Name: testIPPoolName},
+			dhcpAllocator: dhcp.New(),
+			poolCache:     make(map[string]map[string]string),
+		}
+	}
+
+	b.Run("initial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := newController().Update(ipPool); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("unchanged", func(b *testing.B) {
+		c := newController()
+		ipPool.ResourceVersion = "0"
+		if err := c.Update(ipPool); err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < b.N; i++ {
+			// Each delivery comes with a resource version of its own
+			ipPool.ResourceVersion = strconv.Itoa(i + 1)
+			if err := c.Update(ipPool); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
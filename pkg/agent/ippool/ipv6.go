@@ -0,0 +1,76 @@
+package ippool
+
+import (
+	"github.com/sirupsen/logrus"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// updateIPv6Leases syncs the IPv6 leases of the IPPool into the DHCP lease
+// store, the way updatePoolCacheAndLeaseStore does the IPv4 ones. They go
+// away along with the IPv6 config of the IPPool.
+func (c *Controller) updateIPv6Leases(key string, ipPool *networkv1.IPPool, prune bool) error {
+	latest := normalizeLeases(util.ServedIPv6Leases(ipPool.Status.IPv6))
+	var dnsServers []string
+	if ipPool.Spec.IPv6Config != nil {
+		dnsServers = ipPool.Spec.IPv6Config.DNS
+	} else {
+		latest = make(map[string]string)
+	}
+
+	if c.ipv6PoolCache == nil {
+		c.ipv6PoolCache = make(map[string]map[string]string)
+	}
+	poolCache, ok := c.ipv6PoolCache[key]
+	if !ok {
+		poolCache = make(map[string]string, len(latest))
+		c.ipv6PoolCache[key] = poolCache
+	}
+
+	for ip, mac := range poolCache {
+		newMAC, exists := latest[ip]
+		if newMAC == mac || (!exists && !prune) {
+			continue
+		}
+		logrus.Infof("remove ipv6 %s", ip)
+		if err := c.dhcpAllocator.DeleteLease6(mac); err != nil {
+			return err
+		}
+		delete(poolCache, ip)
+	}
+
+	for newIP, newMAC := range latest {
+		if _, exists := poolCache[newIP]; exists {
+			continue
+		}
+		logrus.Infof("add ipv6 %s with value %s", newIP, newMAC)
+		if err := c.dhcpAllocator.AddLease6(newMAC, newIP, dnsServers, ipPool.Spec.IPv4Config.LeaseTime); err != nil {
+			return err
+		}
+		poolCache[newIP] = newMAC
+	}
+
+	if len(poolCache) == 0 {
+		delete(c.ipv6PoolCache, key)
+	}
+
+	return nil
+}
+
+// removeIPv6Leases deletes the IPv6 leases of the IPPool from the DHCP lease
+// store. Leases the store lost on its own are skipped.
+func (c *Controller) removeIPv6Leases(key string) error {
+	for ip, mac := range c.ipv6PoolCache[key] {
+		if c.dhcpAllocator.GetLease6(mac).ClientIP == nil {
+			continue
+		}
+		logrus.Infof("remove ipv6 %s", ip)
+		if err := c.dhcpAllocator.DeleteLease6(mac); err != nil {
+			return err
+		}
+	}
+	delete(c.ipv6PoolCache, key)
+
+	return nil
+}
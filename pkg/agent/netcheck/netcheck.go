@@ -0,0 +1,221 @@
+package netcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	protocolICMP = 1
+	pingTimeout  = 2 * time.Second
+)
+
+// The gateway may come up after the agent, so the router check is retried
+// for about a minute before it's reported as a mismatch.
+var routerBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2.0,
+	Jitter:   0.1,
+	Steps:    6,
+}
+
+type Options struct {
+	// Nic is the network interface attached to the pool's network.
+	Nic string
+	// CIDR is the subnet the interface is expected to be attached to.
+	CIDR string
+	// Router is the gateway expected to answer ICMP echo requests. An empty
+	// value skips the router check.
+	Router string
+	// MTU is the expected MTU of the interface. Zero skips the MTU check.
+	MTU int
+}
+
+// Result is what the agent reports back to the controller. It's serialized
+// into the agent Pod's annotation.
+type Result struct {
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+type Verifier struct {
+	options Options
+}
+
+func NewVerifier(options Options) *Verifier {
+	return &Verifier{
+		options: options,
+	}
+}
+
+// Verify checks the attached interface against the pool's expectations and
+// returns every mismatch found.
+func (v *Verifier) Verify(ctx context.Context) (result Result) {
+	iface, err := net.InterfaceByName(v.options.Nic)
+	if err != nil {
+		result.Mismatches = append(result.Mismatches, err.Error())
+		return
+	}
+
+	if err := v.checkMTU(iface); err != nil {
+		result.Mismatches = append(result.Mismatches, err.Error())
+	}
+
+	srcAddr, err := v.checkAddress(iface)
+	if err != nil {
+		result.Mismatches = append(result.Mismatches, err.Error())
+		return
+	}
+
+	if err := v.checkRouter(ctx, srcAddr); err != nil {
+		result.Mismatches = append(result.Mismatches, err.Error())
+	}
+
+	return
+}
+
+func (v *Verifier) checkMTU(iface *net.Interface) error {
+	if v.options.MTU == 0 {
+		return nil
+	}
+
+	if iface.MTU != v.options.MTU {
+		return fmt.Errorf("interface %s has mtu %d, expected %d", iface.Name, iface.MTU, v.options.MTU)
+	}
+
+	return nil
+}
+
+// checkAddress returns the address of the interface that is within the
+// expected subnet.
+func (v *Verifier) checkAddress(iface *net.Interface) (netip.Addr, error) {
+	prefix, err := netip.ParsePrefix(v.options.CIDR)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ipAddr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		if prefix.Contains(ipAddr.Unmap()) {
+			return ipAddr.Unmap(), nil
+		}
+	}
+
+	return netip.Addr{}, fmt.Errorf("interface %s has no address within %s", iface.Name, v.options.CIDR)
+}
+
+func (v *Verifier) checkRouter(ctx context.Context, srcAddr netip.Addr) error {
+	if v.options.Router == "" {
+		return nil
+	}
+
+	routerAddr, err := netip.ParseAddr(v.options.Router)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	seq := 0
+	err = wait.ExponentialBackoffWithContext(ctx, routerBackoff, func(ctx context.Context) (bool, error) {
+		seq++
+		peerAddr, err := ping(srcAddr, routerAddr, seq)
+		if err != nil {
+			logrus.Debugf("(netcheck.checkRouter) router %s not answering yet: %s", routerAddr, err.Error())
+			lastErr = err
+			return false, nil
+		}
+		if peerAddr != routerAddr {
+			lastErr = fmt.Errorf("answered from %s", peerAddr)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		if lastErr != nil {
+			err = lastErr
+		}
+		return fmt.Errorf("router %s unreachable from %s: %w", routerAddr, srcAddr, err)
+	}
+
+	return nil
+}
+
+// ping sends a single ICMP echo request from srcAddr to dstAddr and returns
+// the address the matching reply came from.
+func ping(srcAddr, dstAddr netip.Addr, seq int) (netip.Addr, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", srcAddr.String())
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Code: 0,
+		Body: &icmp.Echo{
+			ID:   id,
+			Seq:  seq,
+			Data: []byte("vm-dhcp-agent"),
+		},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	if _, err := conn.WriteTo(b, &net.IPAddr{IP: dstAddr.AsSlice()}); err != nil {
+		return netip.Addr{}, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(pingTimeout)); err != nil {
+		return netip.Addr{}, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+
+		reply, err := icmp.ParseMessage(protocolICMP, buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.ID != id || echo.Seq != seq {
+			continue
+		}
+
+		peerIPAddr, ok := peer.(*net.IPAddr)
+		if !ok {
+			return netip.Addr{}, fmt.Errorf("unexpected peer address %s", peer)
+		}
+		peerAddr, ok := netip.AddrFromSlice(peerIPAddr.IP)
+		if !ok {
+			return netip.Addr{}, fmt.Errorf("cannot convert ip address %s", peerIPAddr.IP)
+		}
+		return peerAddr.Unmap(), nil
+	}
+}
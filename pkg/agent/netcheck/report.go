@@ -0,0 +1,54 @@
+package netcheck
+
+import (
+	"context"
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// Report records the result on the agent Pod so the controller can surface it
+// on the IPPool.
+func Report(ctx context.Context, client kubernetes.Interface, podRef types.NamespacedName, result Result) error {
+	resultStr, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				util.NetworkVerificationAnnotationKey: string(resultStr),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return retry.OnError(retry.DefaultBackoff, func(error) bool { return true }, func() error {
+		_, err := client.CoreV1().Pods(podRef.Namespace).Patch(ctx, podRef.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+}
+
+// ParseResult reads the result reported on the agent Pod annotations. It
+// returns nil if the agent hasn't reported yet.
+func ParseResult(annotations map[string]string) (*Result, error) {
+	resultStr, ok := annotations[util.NetworkVerificationAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+
+	var result Result
+	if err := json.Unmarshal([]byte(resultStr), &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
@@ -3,6 +3,7 @@ package v1alpha1
 import (
 	"github.com/rancher/wrangler/v3/pkg/condition"
 	"github.com/rancher/wrangler/v3/pkg/genericcondition"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -12,6 +13,10 @@ var (
 	CacheReady condition.Cond = "CacheReady"
 	AgentReady condition.Cond = "AgentReady"
 	Stopped    condition.Cond = "Stopped"
+
+	ServiceRoutesReady condition.Cond = "ServiceRoutesReady"
+	NetworkMismatch    condition.Cond = "NetworkMismatch"
+	Degraded           condition.Cond = "Degraded"
 )
 
 // +genclient
@@ -19,6 +24,7 @@ var (
 // +kubebuilder:resource:shortName=ippl;ippls,scope=Namespaced
 // +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="NETWORK",type=string,JSONPath=`.spec.networkName`
+// +kubebuilder:printcolumn:name="AUTHORITATIVE",type=boolean,JSONPath=`.spec.authoritative`
 // +kubebuilder:printcolumn:name="AVAILABLE",type=integer,JSONPath=`.status.ipv4.available`
 // +kubebuilder:printcolumn:name="USED",type=integer,JSONPath=`.status.ipv4.used`
 // +kubebuilder:printcolumn:name="REGISTERED",type=string,JSONPath=`.status.conditions[?(@.type=='Registered')].status`
@@ -37,6 +43,12 @@ type IPPool struct {
 type IPPoolSpec struct {
 	IPv4Config IPv4Config `json:"ipv4Config,omitempty"`
 
+	// IPv6Config is the IPv6 addressing of the subnet. The VMs get an IPv6
+	// address along their IPv4 one, which the agent serves over DHCPv6.
+	// +optional
+	// +kubebuilder:validation:Optional
+	IPv6Config *IPv6Config `json:"ipv6Config,omitempty"`
+
 	// +kubebuilder:validation:Required
 	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="NetworkName is immutable"
 	// +kubebuilder:validation:MaxLength=64
@@ -45,6 +57,162 @@ type IPPoolSpec struct {
 	// +optional
 	// +kubebuilder:validation:Optional
 	Paused *bool `json:"paused,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	AdvertiseServiceRoutes *bool `json:"advertiseServiceRoutes,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Format=ipv4
+	ServiceGateway string `json:"serviceGateway,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	SkipNetworkVerification *bool `json:"skipNetworkVerification,omitempty"`
+
+	// Authoritative makes the agent NAK the requests of the clients it has
+	// leased another address to, and the requests for addresses out of the
+	// subnet. It should be left off on network segments shared with other
+	// DHCP servers.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=false
+	Authoritative *bool `json:"authoritative,omitempty"`
+
+	// AllowBOOTP makes the agent answer BOOTP requests as well. BOOTP
+	// clients never renew, so the leases served to them are made permanent.
+	// +optional
+	// +kubebuilder:validation:Optional
+	AllowBOOTP *bool `json:"allowBOOTP,omitempty"`
+
+	// RelayGateways lists the relay agent addresses (giaddr) whose relayed
+	// requests are served from the IPPool. Relayed requests from other relay
+	// agents are left to the IPPools listing them. Requests which aren't
+	// relayed are served regardless.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:items:Format=ipv4
+	RelayGateways []string `json:"relayGateways,omitempty"`
+
+	// AllocationStrategy tells how the IP address of a VM without a
+	// designated one is picked. It defaults to Any.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Any;MACHashed
+	AllocationStrategy AllocationStrategy `json:"allocationStrategy,omitempty"`
+
+	// RequiredVMAnnotations are the annotations, along with their values, a
+	// VM must carry to be allocated an IP address from the IPPool. Addresses
+	// already allocated are kept regardless.
+	// +optional
+	// +kubebuilder:validation:Optional
+	RequiredVMAnnotations map[string]string `json:"requiredVMAnnotations,omitempty"`
+
+	// KnownExternalHosts documents the hosts living within the subnet but
+	// managed elsewhere, e.g., printers and routers. Their IP addresses are
+	// never allocated to VMs.
+	// +optional
+	// +kubebuilder:validation:Optional
+	KnownExternalHosts []KnownExternalHost `json:"knownExternalHosts,omitempty"`
+
+	// OverflowPool is the IPPool, as <namespace>/<name>, VMs get their IP
+	// addresses from once this one is exhausted. It must be on the same
+	// network and name this IPPool in its delegated-from annotation, as it's
+	// served by the same agent.
+	// +optional
+	// +kubebuilder:validation:Optional
+	OverflowPool string `json:"overflowPool,omitempty"`
+
+	// OverflowWeight spreads the new IP addresses of an overflow chain over
+	// its IPPools in proportion to their weights, rather than filling them in
+	// order. It applies once any IPPool of the chain has a weight, those
+	// without one weighing 1, and a weight of 0 keeps the IPPool for
+	// overflowing only. The IPPools still overflow along the chain when full.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	OverflowWeight *int `json:"overflowWeight,omitempty"`
+
+	// ExternalIPAM hands the pick of the IP addresses allocated from the
+	// IPPool over to an external IPAM, which is asked over a webhook and told
+	// about the releases as well.
+	// +optional
+	// +kubebuilder:validation:Optional
+	ExternalIPAM *ExternalIPAM `json:"externalIPAM,omitempty"`
+}
+
+// ExternalIPAM is the webhook of an external IPAM, e.g., NetBox or Infoblox.
+type ExternalIPAM struct {
+	// URL is the https endpoint the allocations and releases are posted
+	// to. It's only asked if the controller allows it.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^https://`
+	URL string `json:"url"`
+
+	// AuthSecretRef is the key of a Secret, in the namespace of the IPPool,
+	// holding the bearer token sent along the requests. The Secret has to be
+	// labeled network.harvesterhci.io/external-ipam-auth=true.
+	// +optional
+	// +kubebuilder:validation:Optional
+	AuthSecretRef *corev1.SecretKeySelector `json:"authSecretRef,omitempty"`
+
+	// TimeoutSeconds is how long a request waits for the answer. It
+	// defaults to 5, and is capped at 10 by the controller.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=60
+	TimeoutSeconds *int32 `json:"timeoutSeconds,omitempty"`
+
+	// FailurePolicy tells what happens when the external IPAM can't be
+	// asked or gives an unusable answer. Fail, the default, leaves the VM
+	// without an IP address until it can, while AllocateLocally picks one
+	// like with no external IPAM.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Fail;AllocateLocally
+	FailurePolicy ExternalIPAMFailurePolicy `json:"failurePolicy,omitempty"`
+}
+
+type ExternalIPAMFailurePolicy string
+
+const (
+	// ExternalIPAMFailurePolicyFail fails the allocation.
+	ExternalIPAMFailurePolicyFail ExternalIPAMFailurePolicy = "Fail"
+	// ExternalIPAMFailurePolicyAllocateLocally allocates an IP address as if
+	// there were no external IPAM.
+	ExternalIPAMFailurePolicyAllocateLocally ExternalIPAMFailurePolicy = "AllocateLocally"
+)
+
+type AllocationStrategy string
+
+const (
+	// AllocationStrategyAny picks any free IP address.
+	AllocationStrategyAny AllocationStrategy = "Any"
+	// AllocationStrategyMACHashed picks the free IP address indexed by a
+	// hash of the MAC address, or the next free one on collision, so the
+	// same MAC address gets the same IP address as long as it's free.
+	AllocationStrategyMACHashed AllocationStrategy = "MACHashed"
+)
+
+type KnownExternalHost struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Format=ipv4
+	IP string `json:"ip"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	MAC string `json:"mac,omitempty"`
+
+	// Description is a single line of free text about the host, exported
+	// as a comment of its zone file record.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:MaxLength=256
+	// +kubebuilder:validation:Pattern=`^[^\x00-\x1F\x7F]*$`
+	Description string `json:"description,omitempty"`
 }
 
 // +kubebuilder:validation:XValidation:rule="!has(oldSelf.router) || has(self.router)", message="Router is required once set"
@@ -67,16 +235,26 @@ type IPv4Config struct {
 	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Router is immutable"
 	Router string `json:"router,omitempty"`
 
+	// DefaultRoute tells whether the router is served as the default route,
+	// i.e., with option 3 and along the routes of option 121, to the
+	// interfaces not saying otherwise. It defaults to true.
+	// +optional
+	// +kubebuilder:validation:Optional
+	DefaultRoute *bool `json:"defaultRoute,omitempty"`
+
 	// +optional
 	// +kubebuilder:validation:Optional
 	// +kubebuilder:validation:Format=ipv4
 	// +kubebuilder:validation:MaxItems=3
 	DNS []string `json:"dns,omitempty"`
 
+	// DomainName is the domain name of the clients, served with option 15.
 	// +optional
 	// +kubebuilder:validation:Optional
 	DomainName *string `json:"domainName,omitempty"`
 
+	// DomainSearch is the list of domains the clients resolve short
+	// hostnames in, served with option 119.
 	// +optional
 	// +kubebuilder:validation:Optional
 	DomainSearch []string `json:"domainSearch,omitempty"`
@@ -89,6 +267,174 @@ type IPv4Config struct {
 	// +optional
 	// +kubebuilder:validation:Optional
 	LeaseTime *int `json:"leaseTime,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	StaticRoutes []Route `json:"staticRoutes,omitempty"`
+
+	// AlwaysSendOptions lists the DHCP option codes sent to clients even if
+	// they're left out of the parameter request list (option 55).
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:items:Minimum=1
+	// +kubebuilder:validation:items:Maximum=254
+	AlwaysSendOptions []int `json:"alwaysSendOptions,omitempty"`
+
+	// SubnetMaskOverride is the subnet mask sent with option 1 instead of the
+	// one of the CIDR, e.g., a wider one on a segment shared with other
+	// subnets.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Format=ipv4
+	SubnetMaskOverride string `json:"subnetMaskOverride,omitempty"`
+
+	// Options are the DHCP options served besides the ones of the fields
+	// above, which the NTP servers and the domain search list are set with.
+	// +optional
+	// +kubebuilder:validation:Optional
+	Options *DHCPOptions `json:"options,omitempty"`
+
+	// Reservations pin IP addresses to MAC addresses. The IP address of a
+	// reservation is only ever allocated to its MAC address, which gets it
+	// unless the interface asks for a static IP address of its own.
+	// +optional
+	// +kubebuilder:validation:Optional
+	Reservations []Reservation `json:"reservations,omitempty"`
+}
+
+type Reservation struct {
+	// +kubebuilder:validation:Required
+	MACAddress string `json:"macAddress"`
+
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Format=ipv4
+	IPAddress string `json:"ipAddress"`
+}
+
+type DHCPOptions struct {
+	// MTU is the interface MTU served with option 26, e.g., 1450 on an
+	// overlay network.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=68
+	// +kubebuilder:validation:Maximum=9000
+	MTU *int `json:"mtu,omitempty"`
+
+	// ExtraOptions are served as they are, e.g., the TFTP server name (66)
+	// and the boot file name (67) of network boots, or any option the spec
+	// has no field for. The options the agent derives from the spec can't be
+	// overridden with them.
+	// +optional
+	// +kubebuilder:validation:Optional
+	ExtraOptions []ExtraOption `json:"extraOptions,omitempty"`
+}
+
+type ExtraOption struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=254
+	Code int `json:"code"`
+
+	// Value is the payload of the option, given as its Type says.
+	// +kubebuilder:validation:Required
+	Value string `json:"value"`
+
+	// Type tells how the value is given. It defaults to Text.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Text;Hex
+	Type ExtraOptionType `json:"type,omitempty"`
+}
+
+type ExtraOptionType string
+
+const (
+	// ExtraOptionTypeText sends the value as it is.
+	ExtraOptionTypeText ExtraOptionType = "Text"
+	// ExtraOptionTypeHex sends the bytes the value encodes in hexadecimal,
+	// e.g., "c0a80001" for 192.168.0.1, for binary payloads.
+	ExtraOptionTypeHex ExtraOptionType = "Hex"
+)
+
+// IPv6Config is the IPv6 addressing of the subnet. IPv6 has no broadcast, so
+// the last address of the prefix is allocatable like any other. Link-local
+// prefixes are rejected, as their addresses are configured by the hosts
+// themselves.
+type IPv6Config struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="CIDR is immutable"
+	CIDR string `json:"cidr"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Format=ipv6
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="ServerIP is immutable"
+	ServerIP string `json:"serverIP,omitempty"`
+
+	// +kubebuilder:validation:Required
+	Pool IPv6Pool `json:"pool"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Format=ipv6
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Router is immutable"
+	Router string `json:"router,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Format=ipv6
+	// +kubebuilder:validation:MaxItems=3
+	DNS []string `json:"dns,omitempty"`
+}
+
+// HoldBack is the range of addresses from Start to End, both included.
+type HoldBack struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Format=ipv4
+	Start string `json:"start"`
+
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Format=ipv4
+	End string `json:"end"`
+}
+
+type IPv6Pool struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Format=ipv6
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Start is immutable"
+	Start string `json:"start"`
+
+	// End is the last address of the pool range. It's derived from Count if
+	// that is set instead, and defaults to the last address of the CIDR
+	// otherwise.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Format=ipv6
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="End is immutable"
+	End string `json:"end,omitempty"`
+
+	// Count is the amount of addresses of the pool range from Start on, as an
+	// alternative to End. Setting both is rejected as ambiguous.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Count is immutable"
+	Count int `json:"count,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Format=ipv6
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Exclude is immutable"
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+type Route struct {
+	// +kubebuilder:validation:Required
+	Destination string `json:"destination"`
+
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Format=ipv4
+	Gateway string `json:"gateway"`
 }
 
 // +kubebuilder:validation:XValidation:rule="!has(oldSelf.exclude) || has(self.exclude)", message="End is required once set"
@@ -98,38 +444,370 @@ type Pool struct {
 	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Start is immutable"
 	Start string `json:"start"`
 
-	// +kubebuilder:validation:Required
+	// End is the last address of the pool range. It's derived from Count if
+	// that is set instead, and defaults to the last usable address of the CIDR
+	// otherwise.
+	// +optional
+	// +kubebuilder:validation:Optional
 	// +kubebuilder:validation:Format=ipv4
 	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="End is immutable"
-	End string `json:"end"`
+	End string `json:"end,omitempty"`
+
+	// Count is the amount of addresses of the pool range from Start on, as an
+	// alternative to End. Setting both is rejected as ambiguous.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Count is immutable"
+	Count int `json:"count,omitempty"`
 
 	// +optional
 	// +kubebuilder:validation:Optional
 	// +kubebuilder:validation:Format=ipv4
 	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Exclude is immutable"
 	Exclude []string `json:"exclude,omitempty"`
+
+	// HoldBack is a part of the pool range kept for planned static
+	// assignments. Unlike the excluded addresses, its addresses are still
+	// handed out to VMs without a designated address, but only once the rest
+	// of the range is exhausted.
+	// +optional
+	// +kubebuilder:validation:Optional
+	HoldBack *HoldBack `json:"holdBack,omitempty"`
+
+	// AllowNetworkBroadcast makes the network and broadcast addresses of
+	// the CIDR allocatable as well, for overlay networks where they're just
+	// normal addresses. It's up to the operator to make sure they are.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="AllowNetworkBroadcast is immutable"
+	AllowNetworkBroadcast bool `json:"allowNetworkBroadcast,omitempty"`
 }
 
 type IPPoolStatus struct {
 	LastUpdate metav1.Time `json:"lastUpdate,omitempty"`
 
+	// AllocationRevision is bumped once per status update changing the
+	// leases of the IPPool. It's kept in the status so it never goes
+	// backward, controller restarts included.
+	// +optional
+	// +kubebuilder:validation:Optional
+	AllocationRevision int64 `json:"allocationRevision,omitempty"`
+
+	// AllocatorHash is the digest of the parts of the spec the IPAM was
+	// last built from. The IPAM is rebuilt once the spec no longer
+	// matches it.
+	// +optional
+	// +kubebuilder:validation:Optional
+	AllocatorHash string `json:"allocatorHash,omitempty"`
+
+	// LastChange is when the leases of the IPPool were last changed.
+	// +optional
+	// +kubebuilder:validation:Optional
+	LastChange metav1.Time `json:"lastChange,omitempty"`
+
+	// LastWriter is the identity of the controller instance which last
+	// committed allocations to the IPPool, i.e., its Pod name and startup
+	// nonce.
+	// +optional
+	// +kubebuilder:validation:Optional
+	LastWriter string `json:"lastWriter,omitempty"`
+
 	// +optional
 	// +kubebuilder:validation:Optional
 	IPv4 *IPv4Status `json:"ipv4,omitempty"`
 
+	// IPv6 holds the allocations of the IPv6 addressing of the IPPool, if
+	// any.
+	// +optional
+	// +kubebuilder:validation:Optional
+	IPv6 *IPv6Status `json:"ipv6,omitempty"`
+
 	// +optional
 	// +kubebuilder:validation:Optional
 	AgentPodRef *PodReference `json:"agentPodRef,omitempty"`
 
+	// +optional
+	// +kubebuilder:validation:Optional
+	ServiceRoutes []Route `json:"serviceRoutes,omitempty"`
+
+	// SchemaVersion is the version of the status schema the controller last
+	// wrote the status at. A status predating the current version may lack
+	// fields the controller relies on, so it isn't trusted to release leases
+	// or purge agents.
+	// +optional
+	// +kubebuilder:validation:Optional
+	SchemaVersion int64 `json:"schemaVersion,omitempty"`
+
+	// PendingAllocations summarizes the VirtualMachineNetworkConfigs waiting
+	// for an IP address from the IPPool.
+	// +optional
+	// +kubebuilder:validation:Optional
+	PendingAllocations *PendingAllocations `json:"pendingAllocations,omitempty"`
+
+	// LastCheck is the result of the last DHCP check run on the IPPool, or
+	// the one running.
+	// +optional
+	// +kubebuilder:validation:Optional
+	LastCheck *DHCPCheck `json:"lastCheck,omitempty"`
+
+	// LastResync is the outcome of the last resync asked for with the
+	// resync annotation.
+	// +optional
+	// +kubebuilder:validation:Optional
+	LastResync *ResyncResult `json:"lastResync,omitempty"`
+
+	// Forecast is the estimate of when the IPPool runs out of addresses at
+	// the current allocation rate. It's refreshed coarsely, about once an
+	// hour.
+	// +optional
+	// +kubebuilder:validation:Optional
+	Forecast *AllocationForecast `json:"forecast,omitempty"`
+
 	// +optional
 	// +kubebuilder:validation:Optional
 	Conditions []genericcondition.GenericCondition `json:"conditions,omitempty"`
 }
 
+// IPPoolStatusSchemaVersion is the current version of the IPPool status
+// schema. It's bumped along with the status fields the controllers rely on to
+// tell what is allocated.
+const IPPoolStatusSchemaVersion int64 = 1
+
 type IPv4Status struct {
+	// Allocated is the legacy format of the allocation records, which maps IP
+	// addresses to either MAC addresses or the EXCLUDED/RESERVED marks. It's
+	// superseded by Entries and only kept for reading unmigrated IPPools.
+	// +optional
+	// +kubebuilder:validation:Optional
 	Allocated map[string]string `json:"allocated,omitempty"`
-	Used      int               `json:"used"`
-	Available int               `json:"available"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	Entries map[string]AllocationEntry `json:"entries,omitempty"`
+
+	// Conflicts are the IP addresses guests declined as already in use on
+	// the network. They're kept from being allocated until they expire.
+	// +optional
+	// +kubebuilder:validation:Optional
+	Conflicts map[string]IPConflict `json:"conflicts,omitempty"`
+
+	Used      int `json:"used"`
+	Available int `json:"available"`
+}
+
+// IPv6Status is the IPv4Status counterpart of the IPv6 addressing. Its
+// records are typed entries only, as there's no legacy format to read.
+type IPv6Status struct {
+	// +optional
+	// +kubebuilder:validation:Optional
+	Entries map[string]AllocationEntry `json:"entries,omitempty"`
+
+	Used      int `json:"used"`
+	Available int `json:"available"`
+}
+
+// PendingReason tells why a VirtualMachineNetworkConfig is waiting for an IP
+// address from an IPPool.
+type PendingReason string
+
+const (
+	PendingReasonPoolExhausted PendingReason = "PoolExhausted"
+	PendingReasonPoolPaused    PendingReason = "PoolPaused"
+	// PendingReasonAnnotationMismatch is for VMs lacking the annotations
+	// required by the IPPool.
+	PendingReasonAnnotationMismatch PendingReason = "AnnotationMismatch"
+	// PendingReasonStaticIPInUse is for static IP addresses leased to
+	// another MAC address.
+	PendingReasonStaticIPInUse PendingReason = "StaticIPInUse"
+)
+
+type PendingAllocations struct {
+	Count int `json:"count"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	Reasons map[PendingReason]int `json:"reasons,omitempty"`
+
+	// OldestSince is when the longest-waiting VirtualMachineNetworkConfig
+	// started waiting.
+	// +optional
+	// +kubebuilder:validation:Optional
+	OldestSince *metav1.Time `json:"oldestSince,omitempty"`
+}
+
+type DHCPCheckState string
+
+const (
+	DHCPCheckRunning   DHCPCheckState = "Running"
+	DHCPCheckSucceeded DHCPCheckState = "Succeeded"
+	DHCPCheckFailed    DHCPCheckState = "Failed"
+)
+
+type DHCPCheck struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Enum=Running;Succeeded;Failed
+	State DHCPCheckState `json:"state"`
+
+	// PodName is the name of the checker Pod in the agent namespace.
+	// +optional
+	// +kubebuilder:validation:Optional
+	PodName string `json:"podName,omitempty"`
+
+	// MACAddress is the reserved test MAC address the check runs with.
+	// +optional
+	// +kubebuilder:validation:Optional
+	MACAddress string `json:"macAddress,omitempty"`
+
+	// IPAddress is the IP address set aside for the test MAC address. The
+	// agent only hands it out while the check is running.
+	// +optional
+	// +kubebuilder:validation:Optional
+	IPAddress string `json:"ipAddress,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// LatencyMilliseconds is how long the exchange from the DISCOVER to
+	// the ACK took.
+	// +optional
+	// +kubebuilder:validation:Optional
+	LatencyMilliseconds int64 `json:"latencyMilliseconds,omitempty"`
+
+	// Options are the DHCP options received in the ACK.
+	// +optional
+	// +kubebuilder:validation:Optional
+	Options []string `json:"options,omitempty"`
+
+	// Message tells why the check failed.
+	// +optional
+	// +kubebuilder:validation:Optional
+	Message string `json:"message,omitempty"`
+}
+
+// AllocationForecast is the estimate of when an IPPool runs out of addresses
+// at the rate they're allocated at.
+type AllocationForecast struct {
+	// NetAllocationRate is the exponentially smoothed amount of addresses
+	// allocated per hour, net of the ones released, e.g., "1.25". It's
+	// negative when releases outpace allocations.
+	// +kubebuilder:validation:Required
+	NetAllocationRate string `json:"netAllocationRate"`
+
+	// ExhaustionTime is when the IPPool runs out of addresses at the net
+	// allocation rate. It's unset, i.e., unknown, when the rate is zero or
+	// negative.
+	// +optional
+	// +kubebuilder:validation:Optional
+	ExhaustionTime *metav1.Time `json:"exhaustionTime,omitempty"`
+
+	// +kubebuilder:validation:Required
+	LastUpdate metav1.Time `json:"lastUpdate"`
+}
+
+// ResyncResult is the outcome of a resync asked for with the resync
+// annotation of an IPPool or a VirtualMachineNetworkConfig.
+type ResyncResult struct {
+	// RequestID is the value of the resync annotation the resync ran for.
+	// +kubebuilder:validation:Required
+	RequestID string `json:"requestID"`
+
+	// +kubebuilder:validation:Required
+	CompletionTime metav1.Time `json:"completionTime"`
+
+	// Repairs counts the drift the resync found and repaired.
+	// +optional
+	// +kubebuilder:validation:Optional
+	Repairs ResyncRepairs `json:"repairs"`
+
+	// Message tells what the resync couldn't repair, if anything.
+	// +optional
+	// +kubebuilder:validation:Optional
+	Message string `json:"message,omitempty"`
+}
+
+// ResyncRepairs counts the drift a resync repaired, by kind.
+type ResyncRepairs struct {
+	// StaleLeases are the leases of the IPPool status no VM owns anymore,
+	// which were released.
+	StaleLeases int `json:"staleLeases"`
+
+	// MissingLeases are the IP addresses allocated to VMs but missing from
+	// the IPPool status, which were recorded again.
+	MissingLeases int `json:"missingLeases"`
+
+	// IPAMEntries are the IP addresses the in-memory IPAM held as allocated
+	// or free against the IPPool status.
+	IPAMEntries int `json:"ipamEntries"`
+
+	// MACEntries are the MAC addresses the in-memory MAC cache mapped to
+	// other IP addresses than the IPPool status, or held without a lease.
+	MACEntries int `json:"macEntries"`
+}
+
+type AllocationType string
+
+const (
+	AllocationTypeLease    AllocationType = "lease"
+	AllocationTypeExcluded AllocationType = "excluded"
+	AllocationTypeReserved AllocationType = "reserved"
+)
+
+type AllocationEntry struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Enum=lease;excluded;reserved
+	Type AllocationType `json:"type"`
+
+	// Owner is the MAC address holding the lease. It's empty for excluded and
+	// reserved entries.
+	// +optional
+	// +kubebuilder:validation:Optional
+	Owner string `json:"owner,omitempty"`
+
+	// Namespace is the namespace of the VM holding the lease. It's empty for
+	// excluded and reserved entries, and for leases recorded before it was
+	// introduced.
+	// +optional
+	// +kubebuilder:validation:Optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Optional
+	Since *metav1.Time `json:"since,omitempty"`
+
+	// DefaultRoute is the setting of the interface holding the lease. It's
+	// empty if the interface goes with the setting of the IPPool.
+	// +optional
+	// +kubebuilder:validation:Optional
+	DefaultRoute *bool `json:"defaultRoute,omitempty"`
+
+	// Mode is the mode of the interface holding the lease. The agent doesn't
+	// serve reserveOnly leases.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=dhcp;reserveOnly
+	Mode NetworkConfigMode `json:"mode,omitempty"`
+}
+
+// IPConflict is an IP address a guest declined with a DHCPDECLINE, e.g.,
+// because its ARP probe found another host using it.
+type IPConflict struct {
+	// MACAddress is the address of the interface which declined the IP
+	// address.
+	// +kubebuilder:validation:Required
+	MACAddress string `json:"macAddress"`
+
+	// +kubebuilder:validation:Required
+	DeclinedAt metav1.Time `json:"declinedAt"`
+
+	// Until is when the IP address can be allocated again.
+	// +kubebuilder:validation:Required
+	Until metav1.Time `json:"until"`
 }
 
 type PodReference struct {
@@ -12,14 +12,30 @@ const (
 	StaleState     NetworkConfigState = "Stale"
 )
 
+const (
+	// NetworkConfigModeDHCP has the agent serve the IP address of the
+	// interface over DHCP.
+	NetworkConfigModeDHCP NetworkConfigMode = "dhcp"
+	// NetworkConfigModeReserveOnly keeps the IP address of the interface
+	// allocated and recorded without the agent serving it, for guests
+	// configured statically, e.g., with cloud-init.
+	NetworkConfigModeReserveOnly NetworkConfigMode = "reserveOnly"
+)
+
 var (
 	Allocated condition.Cond = "Allocated"
 	Disabled  condition.Cond = "Disabled"
 	InSynced  condition.Cond = "InSynced"
+	Repaired  condition.Cond = "Repaired"
+	// DeferredAllocation is true while the allocation of the IP addresses
+	// waits for the VM to be first started.
+	DeferredAllocation condition.Cond = "DeferredAllocation"
 )
 
 type NetworkConfigState string
 
+type NetworkConfigMode string
+
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +kubebuilder:resource:shortName=vmnetcfg;vmnetcfgs,scope=Namespaced
@@ -67,11 +83,31 @@ type NetworkConfig struct {
 	// +kubebuilder:validation:Optional
 	// +kubebuilder:validation:Format=ipv4
 	IPAddress *string `json:"ipAddress,omitempty"`
+
+	// DefaultRoute tells whether the interface gets the router of the IPPool
+	// as its default route. VMs with several interfaces should have it set on
+	// only one of them. It falls back to the setting of the IPPool.
+	// +optional
+	// +kubebuilder:validation:Optional
+	DefaultRoute *bool `json:"defaultRoute,omitempty"`
+
+	// Mode tells whether the IP address is served over DHCP or only
+	// reserved for a guest configured statically. It defaults to dhcp.
+	// +optional
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=dhcp;reserveOnly
+	Mode NetworkConfigMode `json:"mode,omitempty"`
 }
 
 type VirtualMachineNetworkConfigStatus struct {
 	NetworkConfigs []NetworkConfigStatus `json:"networkConfigs,omitempty"`
 
+	// LastResync is the outcome of the last re-verification asked for with
+	// the resync annotation.
+	// +optional
+	// +kubebuilder:validation:Optional
+	LastResync *ResyncResult `json:"lastResync,omitempty"`
+
 	// +optional
 	// +kubebuilder:validation:Optional
 	Conditions []genericcondition.GenericCondition `json:"conditions,omitempty"`
@@ -82,4 +118,24 @@ type NetworkConfigStatus struct {
 	MACAddress         string             `json:"macAddress,omitempty"`
 	NetworkName        string             `json:"networkName,omitempty"`
 	State              NetworkConfigState `json:"state,omitempty"`
+
+	// AllocatedIPv6Address is the IPv6 address allocated along the IPv4 one
+	// if the IPPool has an IPv6 addressing.
+	// +optional
+	AllocatedIPv6Address string `json:"allocatedIPv6Address,omitempty"`
+
+	// IPPoolRef is the IPPool, as a namespace/name pair, the IP address was
+	// allocated from.
+	// +optional
+	IPPoolRef string `json:"ipPoolRef,omitempty"`
+
+	// Reason tells why the network config is left pending, e.g.,
+	// AmbiguousNetwork for a network matching NetworkAttachmentDefinitions of
+	// different IPPools.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// Message is the human-readable detail of Reason.
+	// +optional
+	Message string `json:"message,omitempty"`
 }
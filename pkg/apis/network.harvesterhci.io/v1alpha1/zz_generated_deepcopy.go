@@ -23,9 +23,187 @@ package v1alpha1
 
 import (
 	genericcondition "github.com/rancher/wrangler/v3/pkg/genericcondition"
+	v1 "k8s.io/api/core/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AllocationEntry) DeepCopyInto(out *AllocationEntry) {
+	*out = *in
+	if in.Since != nil {
+		in, out := &in.Since, &out.Since
+		*out = (*in).DeepCopy()
+	}
+	if in.DefaultRoute != nil {
+		in, out := &in.DefaultRoute, &out.DefaultRoute
+		*out = new(bool)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AllocationEntry.
+func (in *AllocationEntry) DeepCopy() *AllocationEntry {
+	if in == nil {
+		return nil
+	}
+	out := new(AllocationEntry)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AllocationForecast) DeepCopyInto(out *AllocationForecast) {
+	*out = *in
+	if in.ExhaustionTime != nil {
+		in, out := &in.ExhaustionTime, &out.ExhaustionTime
+		*out = (*in).DeepCopy()
+	}
+	in.LastUpdate.DeepCopyInto(&out.LastUpdate)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AllocationForecast.
+func (in *AllocationForecast) DeepCopy() *AllocationForecast {
+	if in == nil {
+		return nil
+	}
+	out := new(AllocationForecast)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DHCPCheck) DeepCopyInto(out *DHCPCheck) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Options != nil {
+		in, out := &in.Options, &out.Options
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DHCPCheck.
+func (in *DHCPCheck) DeepCopy() *DHCPCheck {
+	if in == nil {
+		return nil
+	}
+	out := new(DHCPCheck)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DHCPOptions) DeepCopyInto(out *DHCPOptions) {
+	*out = *in
+	if in.MTU != nil {
+		in, out := &in.MTU, &out.MTU
+		*out = new(int)
+		**out = **in
+	}
+	if in.ExtraOptions != nil {
+		in, out := &in.ExtraOptions, &out.ExtraOptions
+		*out = make([]ExtraOption, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DHCPOptions.
+func (in *DHCPOptions) DeepCopy() *DHCPOptions {
+	if in == nil {
+		return nil
+	}
+	out := new(DHCPOptions)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalIPAM) DeepCopyInto(out *ExternalIPAM) {
+	*out = *in
+	if in.AuthSecretRef != nil {
+		in, out := &in.AuthSecretRef, &out.AuthSecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TimeoutSeconds != nil {
+		in, out := &in.TimeoutSeconds, &out.TimeoutSeconds
+		*out = new(int32)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalIPAM.
+func (in *ExternalIPAM) DeepCopy() *ExternalIPAM {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalIPAM)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExtraOption) DeepCopyInto(out *ExtraOption) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExtraOption.
+func (in *ExtraOption) DeepCopy() *ExtraOption {
+	if in == nil {
+		return nil
+	}
+	out := new(ExtraOption)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HoldBack) DeepCopyInto(out *HoldBack) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HoldBack.
+func (in *HoldBack) DeepCopy() *HoldBack {
+	if in == nil {
+		return nil
+	}
+	out := new(HoldBack)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IPConflict) DeepCopyInto(out *IPConflict) {
+	*out = *in
+	in.DeclinedAt.DeepCopyInto(&out.DeclinedAt)
+	in.Until.DeepCopyInto(&out.Until)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPConflict.
+func (in *IPConflict) DeepCopy() *IPConflict {
+	if in == nil {
+		return nil
+	}
+	out := new(IPConflict)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IPPool) DeepCopyInto(out *IPPool) {
 	*out = *in
@@ -91,11 +269,63 @@ func (in *IPPoolList) DeepCopyObject() runtime.Object {
 func (in *IPPoolSpec) DeepCopyInto(out *IPPoolSpec) {
 	*out = *in
 	in.IPv4Config.DeepCopyInto(&out.IPv4Config)
+	if in.IPv6Config != nil {
+		in, out := &in.IPv6Config, &out.IPv6Config
+		*out = new(IPv6Config)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Paused != nil {
 		in, out := &in.Paused, &out.Paused
 		*out = new(bool)
 		**out = **in
 	}
+	if in.AdvertiseServiceRoutes != nil {
+		in, out := &in.AdvertiseServiceRoutes, &out.AdvertiseServiceRoutes
+		*out = new(bool)
+		**out = **in
+	}
+	if in.SkipNetworkVerification != nil {
+		in, out := &in.SkipNetworkVerification, &out.SkipNetworkVerification
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Authoritative != nil {
+		in, out := &in.Authoritative, &out.Authoritative
+		*out = new(bool)
+		**out = **in
+	}
+	if in.AllowBOOTP != nil {
+		in, out := &in.AllowBOOTP, &out.AllowBOOTP
+		*out = new(bool)
+		**out = **in
+	}
+	if in.RelayGateways != nil {
+		in, out := &in.RelayGateways, &out.RelayGateways
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RequiredVMAnnotations != nil {
+		in, out := &in.RequiredVMAnnotations, &out.RequiredVMAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.KnownExternalHosts != nil {
+		in, out := &in.KnownExternalHosts, &out.KnownExternalHosts
+		*out = make([]KnownExternalHost, len(*in))
+		copy(*out, *in)
+	}
+	if in.OverflowWeight != nil {
+		in, out := &in.OverflowWeight, &out.OverflowWeight
+		*out = new(int)
+		**out = **in
+	}
+	if in.ExternalIPAM != nil {
+		in, out := &in.ExternalIPAM, &out.ExternalIPAM
+		*out = new(ExternalIPAM)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -113,16 +343,47 @@ func (in *IPPoolSpec) DeepCopy() *IPPoolSpec {
 func (in *IPPoolStatus) DeepCopyInto(out *IPPoolStatus) {
 	*out = *in
 	in.LastUpdate.DeepCopyInto(&out.LastUpdate)
+	in.LastChange.DeepCopyInto(&out.LastChange)
 	if in.IPv4 != nil {
 		in, out := &in.IPv4, &out.IPv4
 		*out = new(IPv4Status)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.IPv6 != nil {
+		in, out := &in.IPv6, &out.IPv6
+		*out = new(IPv6Status)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.AgentPodRef != nil {
 		in, out := &in.AgentPodRef, &out.AgentPodRef
 		*out = new(PodReference)
 		**out = **in
 	}
+	if in.ServiceRoutes != nil {
+		in, out := &in.ServiceRoutes, &out.ServiceRoutes
+		*out = make([]Route, len(*in))
+		copy(*out, *in)
+	}
+	if in.PendingAllocations != nil {
+		in, out := &in.PendingAllocations, &out.PendingAllocations
+		*out = new(PendingAllocations)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastCheck != nil {
+		in, out := &in.LastCheck, &out.LastCheck
+		*out = new(DHCPCheck)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastResync != nil {
+		in, out := &in.LastResync, &out.LastResync
+		*out = new(ResyncResult)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Forecast != nil {
+		in, out := &in.Forecast, &out.Forecast
+		*out = new(AllocationForecast)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
 		*out = make([]genericcondition.GenericCondition, len(*in))
@@ -145,6 +406,11 @@ func (in *IPPoolStatus) DeepCopy() *IPPoolStatus {
 func (in *IPv4Config) DeepCopyInto(out *IPv4Config) {
 	*out = *in
 	in.Pool.DeepCopyInto(&out.Pool)
+	if in.DefaultRoute != nil {
+		in, out := &in.DefaultRoute, &out.DefaultRoute
+		*out = new(bool)
+		**out = **in
+	}
 	if in.DNS != nil {
 		in, out := &in.DNS, &out.DNS
 		*out = make([]string, len(*in))
@@ -170,6 +436,26 @@ func (in *IPv4Config) DeepCopyInto(out *IPv4Config) {
 		*out = new(int)
 		**out = **in
 	}
+	if in.StaticRoutes != nil {
+		in, out := &in.StaticRoutes, &out.StaticRoutes
+		*out = make([]Route, len(*in))
+		copy(*out, *in)
+	}
+	if in.AlwaysSendOptions != nil {
+		in, out := &in.AlwaysSendOptions, &out.AlwaysSendOptions
+		*out = make([]int, len(*in))
+		copy(*out, *in)
+	}
+	if in.Options != nil {
+		in, out := &in.Options, &out.Options
+		*out = new(DHCPOptions)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Reservations != nil {
+		in, out := &in.Reservations, &out.Reservations
+		*out = make([]Reservation, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -193,6 +479,20 @@ func (in *IPv4Status) DeepCopyInto(out *IPv4Status) {
 			(*out)[key] = val
 		}
 	}
+	if in.Entries != nil {
+		in, out := &in.Entries, &out.Entries
+		*out = make(map[string]AllocationEntry, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.Conflicts != nil {
+		in, out := &in.Conflicts, &out.Conflicts
+		*out = make(map[string]IPConflict, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
 	return
 }
 
@@ -206,6 +506,88 @@ func (in *IPv4Status) DeepCopy() *IPv4Status {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IPv6Config) DeepCopyInto(out *IPv6Config) {
+	*out = *in
+	in.Pool.DeepCopyInto(&out.Pool)
+	if in.DNS != nil {
+		in, out := &in.DNS, &out.DNS
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPv6Config.
+func (in *IPv6Config) DeepCopy() *IPv6Config {
+	if in == nil {
+		return nil
+	}
+	out := new(IPv6Config)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IPv6Pool) DeepCopyInto(out *IPv6Pool) {
+	*out = *in
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPv6Pool.
+func (in *IPv6Pool) DeepCopy() *IPv6Pool {
+	if in == nil {
+		return nil
+	}
+	out := new(IPv6Pool)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IPv6Status) DeepCopyInto(out *IPv6Status) {
+	*out = *in
+	if in.Entries != nil {
+		in, out := &in.Entries, &out.Entries
+		*out = make(map[string]AllocationEntry, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPv6Status.
+func (in *IPv6Status) DeepCopy() *IPv6Status {
+	if in == nil {
+		return nil
+	}
+	out := new(IPv6Status)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KnownExternalHost) DeepCopyInto(out *KnownExternalHost) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KnownExternalHost.
+func (in *KnownExternalHost) DeepCopy() *KnownExternalHost {
+	if in == nil {
+		return nil
+	}
+	out := new(KnownExternalHost)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NetworkConfig) DeepCopyInto(out *NetworkConfig) {
 	*out = *in
@@ -214,6 +596,11 @@ func (in *NetworkConfig) DeepCopyInto(out *NetworkConfig) {
 		*out = new(string)
 		**out = **in
 	}
+	if in.DefaultRoute != nil {
+		in, out := &in.DefaultRoute, &out.DefaultRoute
+		*out = new(bool)
+		**out = **in
+	}
 	return
 }
 
@@ -243,6 +630,33 @@ func (in *NetworkConfigStatus) DeepCopy() *NetworkConfigStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PendingAllocations) DeepCopyInto(out *PendingAllocations) {
+	*out = *in
+	if in.Reasons != nil {
+		in, out := &in.Reasons, &out.Reasons
+		*out = make(map[PendingReason]int, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.OldestSince != nil {
+		in, out := &in.OldestSince, &out.OldestSince
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PendingAllocations.
+func (in *PendingAllocations) DeepCopy() *PendingAllocations {
+	if in == nil {
+		return nil
+	}
+	out := new(PendingAllocations)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PodReference) DeepCopyInto(out *PodReference) {
 	*out = *in
@@ -267,6 +681,11 @@ func (in *Pool) DeepCopyInto(out *Pool) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.HoldBack != nil {
+		in, out := &in.HoldBack, &out.HoldBack
+		*out = new(HoldBack)
+		**out = **in
+	}
 	return
 }
 
@@ -280,6 +699,72 @@ func (in *Pool) DeepCopy() *Pool {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Reservation) DeepCopyInto(out *Reservation) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Reservation.
+func (in *Reservation) DeepCopy() *Reservation {
+	if in == nil {
+		return nil
+	}
+	out := new(Reservation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ResyncRepairs) DeepCopyInto(out *ResyncRepairs) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ResyncRepairs.
+func (in *ResyncRepairs) DeepCopy() *ResyncRepairs {
+	if in == nil {
+		return nil
+	}
+	out := new(ResyncRepairs)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ResyncResult) DeepCopyInto(out *ResyncResult) {
+	*out = *in
+	in.CompletionTime.DeepCopyInto(&out.CompletionTime)
+	out.Repairs = in.Repairs
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ResyncResult.
+func (in *ResyncResult) DeepCopy() *ResyncResult {
+	if in == nil {
+		return nil
+	}
+	out := new(ResyncResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Route) DeepCopyInto(out *Route) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Route.
+func (in *Route) DeepCopy() *Route {
+	if in == nil {
+		return nil
+	}
+	out := new(Route)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachineNetworkConfig) DeepCopyInto(out *VirtualMachineNetworkConfig) {
 	*out = *in
@@ -377,6 +862,11 @@ func (in *VirtualMachineNetworkConfigStatus) DeepCopyInto(out *VirtualMachineNet
 		*out = make([]NetworkConfigStatus, len(*in))
 		copy(*out, *in)
 	}
+	if in.LastResync != nil {
+		in, out := &in.LastResync, &out.LastResync
+		*out = new(ResyncResult)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
 		*out = make([]genericcondition.GenericCondition, len(*in))
@@ -0,0 +1,140 @@
+package audit
+
+import (
+	"sync"
+)
+
+// DefaultChangeLogSize is the amount of allocation revisions kept per IPPool.
+const DefaultChangeLogSize = 1000
+
+type ChangeType string
+
+const (
+	ChangeTypeAllocated ChangeType = "Allocated"
+	ChangeTypeReleased  ChangeType = "Released"
+)
+
+// Change is a lease given out or taken back by a revision of an IPPool.
+type Change struct {
+	Revision   int64      `json:"revision"`
+	Type       ChangeType `json:"type"`
+	IPAddress  string     `json:"ipAddress"`
+	MACAddress string     `json:"macAddress"`
+	// Writer is the identity of the controller instance which committed the
+	// revision.
+	Writer string `json:"writer,omitempty"`
+}
+
+type revision struct {
+	revision int64
+	changes  []Change
+}
+
+// ChangeLog keeps the lease changes of the most recent allocation revisions of
+// each IPPool, so consumers can catch up without reading the whole status
+// again. It lives in memory only and starts over with the controller.
+type ChangeLog struct {
+	size      int
+	revisions map[string][]revision
+	waiters   map[string]chan struct{}
+	mutex     sync.RWMutex
+}
+
+func NewChangeLog(size int) *ChangeLog {
+	return &ChangeLog{
+		size:      size,
+		revisions: make(map[string][]revision),
+		waiters:   make(map[string]chan struct{}),
+	}
+}
+
+// Record appends the changes of the revision to the log of the IPPool,
+// dropping the oldest revision if the log is full. Revisions are expected to
+// follow each other; on a gap, e.g., as another controller instance made the
+// revisions in between, the log of the IPPool starts over so it never claims
+// to cover revisions it hasn't seen.
+func (l *ChangeLog) Record(ipPoolKey string, rev int64, changes []Change) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	revisions := l.revisions[ipPoolKey]
+	if len(revisions) > 0 && revisions[len(revisions)-1].revision+1 != rev {
+		revisions = nil
+	}
+
+	recorded := make([]Change, len(changes))
+	for i, change := range changes {
+		change.Revision = rev
+		recorded[i] = change
+	}
+
+	revisions = append(revisions, revision{revision: rev, changes: recorded})
+	if len(revisions) > l.size {
+		revisions = revisions[len(revisions)-l.size:]
+	}
+	l.revisions[ipPoolKey] = revisions
+
+	if waiter, ok := l.waiters[ipPoolKey]; ok {
+		close(waiter)
+		delete(l.waiters, ipPoolKey)
+	}
+}
+
+// Since returns the changes made to the IPPool after the given revision up to
+// the latest one, oldest first. It reports false if the log doesn't cover all
+// of them, i.e., the revision right after the given one was evicted or never
+// seen, or the log falls short of the given latest revision. The caller has
+// to resync from the IPPool status then.
+func (l *ChangeLog) Since(ipPoolKey string, since, latest int64) ([]Change, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if since == latest {
+		return []Change{}, true
+	}
+
+	revisions := l.revisions[ipPoolKey]
+	if since > latest || len(revisions) == 0 ||
+		revisions[0].revision > since+1 || revisions[len(revisions)-1].revision < latest {
+		return nil, false
+	}
+
+	changes := []Change{}
+	for _, r := range revisions {
+		if r.revision <= since || r.revision > latest {
+			continue
+		}
+		changes = append(changes, r.changes...)
+	}
+
+	return changes, true
+}
+
+// List returns the changes of every revision of the IPPool still kept, oldest
+// first.
+func (l *ChangeLog) List(ipPoolKey string) []Change {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	changes := []Change{}
+	for _, r := range l.revisions[ipPoolKey] {
+		changes = append(changes, r.changes...)
+	}
+
+	return changes
+}
+
+// Wait returns a channel closed once the next revision of the IPPool is
+// recorded.
+func (l *ChangeLog) Wait(ipPoolKey string) <-chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	waiter, ok := l.waiters[ipPoolKey]
+	if !ok {
+		waiter = make(chan struct{})
+		l.waiters[ipPoolKey] = waiter
+	}
+
+	return waiter
+}
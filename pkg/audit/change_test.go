@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeLog(t *testing.T) {
+	log := NewChangeLog(2)
+
+	log.Record("default/net-1", 1, []Change{{Type: ChangeTypeAllocated, IPAddress: "192.168.0.10", MACAddress: "11:22:33:44:55:66"}})
+	log.Record("default/net-1", 2, []Change{{Type: ChangeTypeAllocated, IPAddress: "192.168.0.11", MACAddress: "22:33:44:55:66:77"}})
+	log.Record("default/net-1", 3, []Change{{Type: ChangeTypeReleased, IPAddress: "192.168.0.10", MACAddress: "11:22:33:44:55:66"}})
+
+	changes, ok := log.Since("default/net-1", 1, 3)
+	assert.True(t, ok)
+	assert.Equal(t, []Change{
+		{Revision: 2, Type: ChangeTypeAllocated, IPAddress: "192.168.0.11", MACAddress: "22:33:44:55:66:77"},
+		{Revision: 3, Type: ChangeTypeReleased, IPAddress: "192.168.0.10", MACAddress: "11:22:33:44:55:66"},
+	}, changes)
+
+	assert.Equal(t, changes, log.List("default/net-1"), "evicted revisions should be left out")
+
+	changes, ok = log.Since("default/net-1", 3, 3)
+	assert.True(t, ok)
+	assert.Empty(t, changes, "nothing should be changed since the latest revision")
+
+	_, ok = log.Since("default/net-1", 0, 3)
+	assert.False(t, ok, "evicted revision should call for a resync")
+	_, ok = log.Since("default/net-1", 2, 4)
+	assert.False(t, ok, "revision never seen should call for a resync")
+	_, ok = log.Since("default/net-1", 4, 3)
+	assert.False(t, ok, "revision from the future should call for a resync")
+	_, ok = log.Since("default/net-2", 0, 1)
+	assert.False(t, ok)
+
+	// Revisions made elsewhere in between aren't covered
+	log.Record("default/net-1", 7, nil)
+	_, ok = log.Since("default/net-1", 3, 7)
+	assert.False(t, ok, "gap in revisions should call for a resync")
+	changes, ok = log.Since("default/net-1", 6, 7)
+	assert.True(t, ok)
+	assert.Empty(t, changes)
+}
+
+func TestChangeLog_Wait(t *testing.T) {
+	log := NewChangeLog(DefaultChangeLogSize)
+
+	waiter := log.Wait("default/net-1")
+	select {
+	case <-waiter:
+		t.Fatal("waiter should block until the next revision")
+	default:
+	}
+
+	log.Record("default/net-2", 1, nil)
+	select {
+	case <-waiter:
+		t.Fatal("waiter should ignore the revisions of other ippools")
+	default:
+	}
+
+	log.Record("default/net-1", 1, nil)
+	select {
+	case <-waiter:
+	default:
+		t.Fatal("waiter should be released by the next revision")
+	}
+}
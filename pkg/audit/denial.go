@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+// DefaultDenialLogSize is the amount of denials kept per IPPool.
+const DefaultDenialLogSize = 100
+
+type DenialReason string
+
+const (
+	DenialReasonPoolPaused     DenialReason = "PoolPaused"
+	DenialReasonPoolExhausted  DenialReason = "PoolExhausted"
+	DenialReasonStaticConflict DenialReason = "StaticConflict"
+	// DenialReasonAnnotationMismatch is for VMs lacking the annotations
+	// required by the IPPool.
+	DenialReasonAnnotationMismatch DenialReason = "AnnotationMismatch"
+)
+
+// Denial is an allocation attempt that was turned down. The attempts of the
+// same network config turned down for the same reason are folded into one,
+// first seen at Timestamp and last seen at LastSeen.
+type Denial struct {
+	Timestamp  time.Time    `json:"timestamp"`
+	LastSeen   time.Time    `json:"lastSeen"`
+	Count      int          `json:"count"`
+	MACAddress string       `json:"macAddress"`
+	Reason     DenialReason `json:"reason"`
+	VmNetCfg   string       `json:"vmNetCfg"`
+	VMName     string       `json:"vmName"`
+	Message    string       `json:"message,omitempty"`
+}
+
+// DenialLog keeps the most recent denials of each IPPool. It lives in memory
+// only, so the records are lost along with the controller.
+type DenialLog struct {
+	clock   clock.Clock
+	size    int
+	denials map[string][]Denial
+	mutex   sync.RWMutex
+}
+
+func NewDenialLog(clock clock.Clock, size int) *DenialLog {
+	return &DenialLog{
+		clock:   clock,
+		size:    size,
+		denials: make(map[string][]Denial),
+	}
+}
+
+// Record appends the denial to the log of the IPPool, dropping the oldest one
+// if the log is full. The denial is stamped with the current time if it has
+// no timestamp. A denial of the same vmnetcfg, MAC address and reason as one
+// already in the log is folded into it instead: its count goes up, its last
+// seen time and message are updated, and it's moved to the end of the log.
+func (l *DenialLog) Record(ipPoolKey string, denial Denial) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if denial.Timestamp.IsZero() {
+		denial.Timestamp = l.clock.Now()
+	}
+	denial.LastSeen = denial.Timestamp
+	denial.Count = 1
+
+	denials := l.denials[ipPoolKey]
+	for i, recorded := range denials {
+		if recorded.VmNetCfg != denial.VmNetCfg || recorded.MACAddress != denial.MACAddress || recorded.Reason != denial.Reason {
+			continue
+		}
+		denial.Timestamp = recorded.Timestamp
+		denial.Count = recorded.Count + 1
+		denials = append(denials[:i:i], denials[i+1:]...)
+		break
+	}
+
+	denials = append(denials, denial)
+	if len(denials) > l.size {
+		denials = denials[len(denials)-l.size:]
+	}
+	l.denials[ipPoolKey] = denials
+}
+
+// Forget drops the denials of the IPPool, e.g., once it's removed.
+func (l *DenialLog) Forget(ipPoolKey string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.denials, ipPoolKey)
+}
+
+// List returns a copy of the denials of the IPPool, oldest first.
+func (l *DenialLog) List(ipPoolKey string) []Denial {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	denials := make([]Denial, len(l.denials[ipPoolKey]))
+	copy(denials, l.denials[ipPoolKey])
+
+	return denials
+}
@@ -0,0 +1,65 @@
+package audit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+func TestDenialLog(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(start)
+	log := NewDenialLog(fakeClock, 2)
+
+	log.Record("default/net-1", Denial{MACAddress: "11:22:33:44:55:66", Reason: DenialReasonPoolPaused})
+	fakeClock.Step(time.Second)
+	log.Record("default/net-1", Denial{MACAddress: "22:33:44:55:66:77", Reason: DenialReasonPoolExhausted})
+	fakeClock.Step(time.Second)
+	log.Record("default/net-1", Denial{MACAddress: "33:44:55:66:77:88", Reason: DenialReasonStaticConflict})
+	log.Record("default/net-2", Denial{MACAddress: "11:22:33:44:55:66", Reason: DenialReasonPoolExhausted})
+
+	assert.Equal(t, []Denial{
+		{Timestamp: start.Add(time.Second), LastSeen: start.Add(time.Second), Count: 1, MACAddress: "22:33:44:55:66:77", Reason: DenialReasonPoolExhausted},
+		{Timestamp: start.Add(2 * time.Second), LastSeen: start.Add(2 * time.Second), Count: 1, MACAddress: "33:44:55:66:77:88", Reason: DenialReasonStaticConflict},
+	}, log.List("default/net-1"), "oldest denial should be dropped")
+	assert.Len(t, log.List("default/net-2"), 1)
+	assert.Empty(t, log.List("default/net-3"))
+}
+
+func TestDenialLog_Dedupe(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(start)
+	log := NewDenialLog(fakeClock, 2)
+
+	exhausted := Denial{VmNetCfg: "default/vm-1", MACAddress: "11:22:33:44:55:66", Reason: DenialReasonPoolExhausted}
+	log.Record("default/net-1", exhausted)
+	fakeClock.Step(time.Second)
+	log.Record("default/net-1", Denial{VmNetCfg: "default/vm-2", MACAddress: "22:33:44:55:66:77", Reason: DenialReasonPoolPaused})
+
+	// The same denial retried over and over keeps a single entry
+	for i := 0; i < 10; i++ {
+		fakeClock.Step(time.Second)
+		retried := exhausted
+		retried.Message = "still exhausted"
+		log.Record("default/net-1", retried)
+	}
+
+	assert.Equal(t, []Denial{
+		{Timestamp: start.Add(time.Second), LastSeen: start.Add(time.Second), Count: 1, VmNetCfg: "default/vm-2", MACAddress: "22:33:44:55:66:77", Reason: DenialReasonPoolPaused},
+		{Timestamp: start, LastSeen: start.Add(11 * time.Second), Count: 11, VmNetCfg: "default/vm-1", MACAddress: "11:22:33:44:55:66", Reason: DenialReasonPoolExhausted, Message: "still exhausted"},
+	}, log.List("default/net-1"), "repeated denial should be folded and moved last")
+
+	// Another reason for the same network config is another entry
+	fakeClock.Step(time.Second)
+	log.Record("default/net-1", Denial{VmNetCfg: "default/vm-1", MACAddress: "11:22:33:44:55:66", Reason: DenialReasonPoolPaused})
+	denials := log.List("default/net-1")
+	assert.Len(t, denials, 2)
+	assert.Equal(t, DenialReasonPoolExhausted, denials[0].Reason, "least recently seen denial should be dropped")
+	assert.Equal(t, DenialReasonPoolPaused, denials[1].Reason)
+
+	log.Forget("default/net-1")
+	assert.Empty(t, log.List("default/net-1"), "denials of a removed ippool should be dropped")
+}
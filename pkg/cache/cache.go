@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"net"
 	"sync"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
 )
 
+// MACSet maps the MAC addresses of a network to their IP addresses. The MAC
+// addresses are normalized, so they match whatever form they're given in.
 type MACSet struct {
 	macs map[string]net.IP
 }
@@ -45,7 +49,7 @@ func (a *CacheAllocator) AddMAC(name, macAddress, ipAddress string) error {
 		return fmt.Errorf("network %s does not exist", name)
 	}
 
-	a.cache[name].macs[macAddress] = net.ParseIP(ipAddress)
+	a.cache[name].macs[util.NormalizeMAC(macAddress)] = net.ParseIP(ipAddress)
 
 	return nil
 }
@@ -59,7 +63,7 @@ func (a *CacheAllocator) DeleteMAC(name, macAddress string) error {
 		return fmt.Errorf("network %s does not exist", name)
 	}
 
-	delete(a.cache[name].macs, macAddress)
+	delete(a.cache[name].macs, util.NormalizeMAC(macAddress))
 
 	return nil
 }
@@ -73,7 +77,7 @@ func (a *CacheAllocator) HasMAC(name, macAddress string) (bool, error) {
 		return false, fmt.Errorf("network %s does not exist", name)
 	}
 
-	_, exists := a.cache[name].macs[macAddress]
+	_, exists := a.cache[name].macs[util.NormalizeMAC(macAddress)]
 
 	return exists, nil
 }
@@ -87,7 +91,7 @@ func (a *CacheAllocator) GetIPByMAC(name, macAddress string) (string, error) {
 		return "", fmt.Errorf("network %s does not exist", name)
 	}
 
-	ipAddress, exists := a.cache[name].macs[macAddress]
+	ipAddress, exists := a.cache[name].macs[util.NormalizeMAC(macAddress)]
 	if !exists {
 		return "", fmt.Errorf("mac %s not found in network %s", macAddress, name)
 	}
@@ -0,0 +1,63 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time. Everything depending on the passage of time
+// should go through it, so tests can control the time with FakeClock.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+}
+
+// RealClock is backed by the system clock.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+// FakeClock only moves when told to.
+type FakeClock struct {
+	now   time.Time
+	mutex sync.RWMutex
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now: now,
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.now
+}
+
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Step moves the clock forward by d.
+func (c *FakeClock) Step(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// SetTime moves the clock to t.
+func (c *FakeClock) SetTime(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = t
+}
@@ -0,0 +1,57 @@
+package clusterinfo
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	ctlcorev1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/core/v1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// Resolver resolves the network settings of the Kubernetes cluster the
+// controller is running on.
+type Resolver interface {
+	// CIDRs returns the service CIDR and the cluster (Pod) CIDR.
+	CIDRs() (serviceCIDR string, clusterCIDR string, err error)
+}
+
+// NodeResolver reads the cluster network settings from the node arguments
+// recorded on the management nodes.
+type NodeResolver struct {
+	nodeCache ctlcorev1.NodeCache
+}
+
+func NewNodeResolver(nodeCache ctlcorev1.NodeCache) *NodeResolver {
+	return &NodeResolver{
+		nodeCache: nodeCache,
+	}
+}
+
+func (r *NodeResolver) CIDRs() (serviceCIDR string, clusterCIDR string, err error) {
+	sets := labels.Set{
+		util.ManagementNodeLabelKey: "true",
+	}
+	nodes, err := r.nodeCache.List(sets.AsSelector())
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(nodes) == 0 {
+		return "", "", fmt.Errorf("no management node found")
+	}
+
+	for _, node := range nodes {
+		serviceCIDR, err = util.GetServiceCIDRFromNode(node)
+		if err != nil {
+			continue
+		}
+		clusterCIDR, err = util.GetClusterCIDRFromNode(node)
+		if err != nil {
+			continue
+		}
+		return serviceCIDR, clusterCIDR, nil
+	}
+
+	return "", "", err
+}
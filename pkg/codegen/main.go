@@ -44,6 +44,8 @@ func main() {
 			},
 			corev1.GroupName: {
 				Types: []interface{}{
+					corev1.ConfigMap{},
+					corev1.Namespace{},
 					corev1.Node{},
 					corev1.Pod{},
 				},
@@ -2,9 +2,12 @@ package config
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"time"
 
 	harvesterv1 "github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rancher/lasso/pkg/controller"
 	"github.com/rancher/wrangler/v3/pkg/generic"
 	"github.com/rancher/wrangler/v3/pkg/schemes"
@@ -14,6 +17,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
@@ -21,15 +25,23 @@ import (
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
 	"github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/audit"
 	"github.com/harvester/vm-dhcp-controller/pkg/cache"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
 	"github.com/harvester/vm-dhcp-controller/pkg/crd"
 	"github.com/harvester/vm-dhcp-controller/pkg/dhcp"
+	"github.com/harvester/vm-dhcp-controller/pkg/externalipam"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
+	"github.com/harvester/vm-dhcp-controller/pkg/forecast"
 	ctlcore "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/core"
+	ctlcorev1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/core/v1"
 	ctlcni "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/k8s.cni.cncf.io"
 	ctlkubevirt "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/kubevirt.io"
 	ctlnetwork "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io"
+	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
 	"github.com/harvester/vm-dhcp-controller/pkg/ipam"
 	"github.com/harvester/vm-dhcp-controller/pkg/metrics"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
 )
 
 var (
@@ -65,28 +77,138 @@ func (i *Image) String() string {
 	return fmt.Sprintf("%s:%s", i.Repository, i.Tag)
 }
 
+const (
+	// PendingMACPolicySkip silently skips VM interfaces without a MAC address.
+	PendingMACPolicySkip = "skip"
+	// PendingMACPolicyReport reports VM interfaces without a MAC address that
+	// are attached to a network backed by an IPPool.
+	PendingMACPolicyReport = "report"
+	// PendingMACPolicyGenerate assigns a MAC address derived from the VM UID
+	// and the interface name to VM interfaces without one that are attached
+	// to a network backed by an IPPool. VMs running already are left alone
+	// until they're stopped.
+	PendingMACPolicyGenerate = "generate"
+)
+
+const (
+	// AllocationTimingImmediate allocates the IP addresses of a VM as soon
+	// as its vmnetcfg is created, so they're known before it first boots.
+	AllocationTimingImmediate = "immediate"
+	// AllocationTimingOnFirstStart defers the allocation of the IP addresses
+	// of a VM created stopped until it's first started.
+	AllocationTimingOnFirstStart = "onFirstStart"
+)
+
 type ControllerOptions struct {
 	NoAgent                 bool
 	AgentNamespace          string
 	AgentImage              *Image
 	AgentServiceAccountName string
 	NoDHCP                  bool
+	// EnableCacheDumpAPI is passed on to the agents, so they serve their
+	// lease table for the support bundle
+	EnableCacheDumpAPI     bool
+	PendingMACPolicy       string
+	TypedAllocationEntries bool
+	// AllocationTiming is when the IP addresses of VMs are allocated, unless
+	// a VM tells otherwise with its allocation-timing annotation.
+	AllocationTiming string
+	// EventDedupWindow is how long identical events about an object are
+	// held back after one is emitted. Zero disables the deduplication.
+	EventDedupWindow time.Duration
+	// MaxPoolSize is the maximum amount of allocatable addresses of an
+	// IPPool. Zero or less means no limit.
+	MaxPoolSize int
+	// VmNetCfgCreateQPS is the rate at which vmnetcfgs are created for new
+	// VMs, with bursts of up to VmNetCfgCreateBurst of them. Zero or less
+	// means no limit.
+	VmNetCfgCreateQPS   float64
+	VmNetCfgCreateBurst int
+	// ReconcileTimeout is how long the handlers of a controller run on a
+	// single object before it's requeued. Zero or less means no limit.
+	ReconcileTimeout time.Duration
+	// IPConflictQuarantine is how long the IP addresses guests declined as
+	// already in use are kept from being allocated. Zero or less ignores the
+	// declines.
+	IPConflictQuarantine time.Duration
+	// ResyncInterval is how often, per controller, a resync asked for with
+	// the resync annotation may run, with bursts of up to ResyncBurst of
+	// them. Zero or less means no limit.
+	ResyncInterval time.Duration
+	ResyncBurst    int
+	// AllocationConfigMaps mirrors the allocations of the VMs of each
+	// namespace into ConfigMaps, for tooling unable to read CRDs.
+	AllocationConfigMaps bool
+	// AllocationExemplars is the amount of IPPools whose latest allocation
+	// is attached as an exemplar to their allocation counter at a time. Zero
+	// or less leaves the allocations uncounted.
+	AllocationExemplars int
+	// PinnedAllocationsAnnotation is the annotation the IP addresses
+	// allocated to each VM are pinned in on the VM itself, so they survive
+	// the IPPools being recreated, e.g., by a reinstall. Empty disables it.
+	PinnedAllocationsAnnotation string
+	// EmbeddedAgentNetworks are the nics the controller is attached to each
+	// network with, keyed by the namespaced name of its
+	// NetworkAttachmentDefinition. The IPPools of these networks are served
+	// by the controller itself rather than by agent Pods.
+	EmbeddedAgentNetworks map[string]string
+	// ExternalIPAMAllowedURLs are the https URLs the webhooks of the
+	// external IPAMs of the IPPools have to start with. None means external
+	// IPAMs are never asked.
+	ExternalIPAMAllowedURLs []string
+	// FeatureGates tells which optional behaviors are turned on
+	FeatureGates *featuregate.Gates
 }
 
 type AgentOptions struct {
+	Name           string
+	Namespace      string
 	DryRun         bool
 	Nic            string
 	KubeConfigPath string
 	KubeContext    string
 	IPPoolRef      types.NamespacedName
+	VerifyCIDR     string
+	VerifyRouter   string
+	VerifyMTU      int
 }
 
 type HTTPServerOptions struct {
+	// Port is the port the server listens on, 8080 if unset
+	Port int
+	// APIPort is the port the endpoints requiring authentication are served
+	// on over TLS, 8443 if unset
+	APIPort int
+	// KubeClient reviews the tokens and the access of the requests to the
+	// endpoints requiring authentication
+	KubeClient       kubernetes.Interface
 	DebugMode        bool
 	CacheAllocator   *cache.CacheAllocator
 	IPAllocator      *ipam.IPAllocator
 	DHCPAllocator    *dhcp.DHCPAllocator
 	MetricsAllocator *metrics.MetricsAllocator
+	DenialLog        *audit.DenialLog
+	ChangeLog        *audit.ChangeLog
+	IPPoolClient     ctlnetworkv1.IPPoolClient
+	VmNetCfgClient   ctlnetworkv1.VirtualMachineNetworkConfigClient
+	VmNetCfgCache    ctlnetworkv1.VirtualMachineNetworkConfigCache
+	PodClient        ctlcorev1.PodClient
+	AppVersion       string
+	GitCommit        string
+	// ReadyCheck tells whether the component is ready to serve. It's
+	// always ready if unset.
+	ReadyCheck func() error
+	// Identity and IsLeader are reported by the verbose ready check of the
+	// controller
+	Identity string
+	IsLeader func() bool
+	// Collectors are the metrics of components without a MetricsAllocator
+	Collectors []prometheus.Collector
+	// FeatureGates are served at /features
+	FeatureGates *featuregate.Gates
+	// GetAPICertificate hands out the certificate the endpoints requiring
+	// authentication are served with. They aren't served if unset.
+	GetAPICertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
 }
 
 type Management struct {
@@ -101,10 +223,30 @@ type Management struct {
 	KubeVirtFactory *ctlkubevirt.Factory
 
 	ClientSet *kubernetes.Clientset
+	// DynamicClient reads the resources of optional CRDs, which may not be
+	// installed
+	DynamicClient dynamic.Interface
 
 	CacheAllocator   *cache.CacheAllocator
 	IPAllocator      *ipam.IPAllocator
 	MetricsAllocator *metrics.MetricsAllocator
+	DenialLog        *audit.DenialLog
+	ChangeLog        *audit.ChangeLog
+	Warmup           *Warmup
+	Upgrade          *Upgrade
+	// AllocationTracker follows the pace of the allocations of each IPPool
+	// for the exhaustion forecasts
+	AllocationTracker *forecast.Tracker
+	// ExternalIPAM asks the webhooks of the IPPools with an external IPAM
+	// for their allocations, and tracks which ones are given up on
+	ExternalIPAM *externalipam.Client
+
+	// Identity tells the instance apart from the other ones in the audit
+	// trails, and Leadership tracks whether it holds the leader lease
+	Identity   Identity
+	Leadership *Leadership
+
+	Clock clock.Clock
 
 	Options *ControllerOptions
 
@@ -133,7 +275,16 @@ func (s *Management) NewRecorder(componentName, namespace, nodeName string) reco
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(logrus.Infof)
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: s.ClientSet.CoreV1().Events(namespace)})
-	return eventBroadcaster.NewRecorder(Scheme, corev1.EventSource{Component: componentName, Host: nodeName})
+	// The events are reported by the instance unless a node is given
+	host := nodeName
+	if host == "" {
+		host = s.Identity.String()
+	}
+	recorder := eventBroadcaster.NewRecorder(Scheme, corev1.EventSource{Component: componentName, Host: host})
+	if s.Options == nil || s.Options.EventDedupWindow <= 0 {
+		return recorder
+	}
+	return util.NewDedupRecorder(recorder, s.Clock, s.Options.EventDedupWindow)
 }
 
 func SetupManagement(ctx context.Context, restConfig *rest.Config, options *ControllerOptions) (*Management, error) {
@@ -153,7 +304,26 @@ func SetupManagement(ctx context.Context, restConfig *rest.Config, options *Cont
 
 	management.CacheAllocator = cache.NewCacheAllocator()
 	management.IPAllocator = ipam.NewIPAllocator()
-	management.MetricsAllocator = metrics.NewMetricsAllocator()
+	management.Clock = clock.RealClock{}
+	management.MetricsAllocator = metrics.NewMetricsAllocator(management.Clock)
+	if options.FeatureGates != nil {
+		management.MetricsAllocator.RegisterCollector(options.FeatureGates)
+	}
+	if options.AllocationExemplars > 0 {
+		management.MetricsAllocator.EnableAllocationExemplars(options.AllocationExemplars)
+	}
+	management.DenialLog = audit.NewDenialLog(management.Clock, audit.DefaultDenialLogSize)
+	management.ChangeLog = audit.NewChangeLog(audit.DefaultChangeLogSize)
+	management.AllocationTracker = forecast.NewTracker(management.Clock, forecast.DefaultWindow, forecast.DefaultSmoothingPeriod)
+	management.ExternalIPAM = externalipam.NewClient(management.Clock, externalipam.DefaultFailureThreshold, externalipam.DefaultCooldown)
+	management.Warmup = NewWarmup()
+	management.Upgrade = NewUpgrade()
+	management.Identity = NewIdentity()
+	management.Leadership = NewLeadership(func(leader bool) {
+		management.MetricsAllocator.UpdateLeader(management.Identity.String(), leader)
+	})
+	management.MetricsAllocator.UpdateLeader(management.Identity.String(), false)
+	logrus.Infof("controller instance identity is %s", management.Identity)
 
 	harvesterNetwork, err := ctlnetwork.NewFactoryFromConfigWithOptions(restConfig, opts)
 	if err != nil {
@@ -188,5 +358,10 @@ func SetupManagement(ctx context.Context, restConfig *rest.Config, options *Cont
 		return nil, err
 	}
 
+	management.DynamicClient, err = dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	return management, nil
 }
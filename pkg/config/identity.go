@@ -0,0 +1,76 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sync/atomic"
+)
+
+// Identity tells the controller instances apart in the audit trails, e.g.,
+// two of them running at once during a botched upgrade. The nonce is drawn at
+// startup, so a restarted Pod is told apart from its former self as well.
+type Identity struct {
+	PodName string
+	Nonce   string
+}
+
+// NewIdentity returns the identity of the running instance. The Pod name is
+// taken from the hostname, which Kubernetes sets to it.
+func NewIdentity() Identity {
+	podName, err := os.Hostname()
+	if err != nil || podName == "" {
+		podName = "unknown"
+	}
+
+	nonce := make([]byte, 4)
+	_, _ = rand.Read(nonce)
+
+	return Identity{
+		PodName: podName,
+		Nonce:   hex.EncodeToString(nonce),
+	}
+}
+
+// String returns the identity as stamped on the IPPools, the allocation
+// history, and the events, e.g., vm-dhcp-controller-5d8f9c7b6-x2x4z/9f86d081.
+// The zero Identity is the empty string.
+func (i Identity) String() string {
+	if i.PodName == "" {
+		return ""
+	}
+	return i.PodName + "/" + i.Nonce
+}
+
+// Leadership tracks whether the instance holds the leader lease. A nil
+// Leadership always does, as there's no election to lose.
+type Leadership struct {
+	leader atomic.Bool
+	// onChange is called with the new state whenever it changes
+	onChange func(bool)
+}
+
+func NewLeadership(onChange func(bool)) *Leadership {
+	return &Leadership{
+		onChange: onChange,
+	}
+}
+
+// Acquire marks the lease as held.
+func (l *Leadership) Acquire() {
+	if !l.leader.Swap(true) && l.onChange != nil {
+		l.onChange(true)
+	}
+}
+
+// Release marks the lease as lost or given up.
+func (l *Leadership) Release() {
+	if l.leader.Swap(false) && l.onChange != nil {
+		l.onChange(false)
+	}
+}
+
+// IsLeader reports whether the instance holds the leader lease.
+func (l *Leadership) IsLeader() bool {
+	return l == nil || l.leader.Load()
+}
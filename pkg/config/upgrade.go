@@ -0,0 +1,34 @@
+package config
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrUpgrading tells the objects left behind by former releases are still
+// being brought in line with the current invariants. The handlers returning
+// it are retried with backoff.
+var ErrUpgrading = errors.New("objects of former releases are being upgraded")
+
+// Upgrade tracks the one-shot upgrade of the objects left behind by former
+// releases, e.g., VirtualMachineNetworkConfigs lacking their labels or owner
+// references. The destructive actions deriving from what such objects lack,
+// like garbage collection and drift repairs, are held off until it's done. A
+// nil Upgrade is always done.
+type Upgrade struct {
+	done atomic.Bool
+}
+
+func NewUpgrade() *Upgrade {
+	return &Upgrade{}
+}
+
+// Done marks the upgrade as done.
+func (u *Upgrade) Done() {
+	u.done.Store(true)
+}
+
+// IsDone reports whether the upgrade is done.
+func (u *Upgrade) IsDone() bool {
+	return u == nil || u.done.Load()
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"sync/atomic"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+)
+
+// ErrWarmingUp tells the IPAM and MAC caches are still being warmed up. It
+// isn't retried with backoff, as the handlers returning it requeue the object
+// themselves.
+var ErrWarmingUp error = warmingUpError{}
+
+type warmingUpError struct{}
+
+func (warmingUpError) Error() string {
+	return "ipam and mac caches are warming up"
+}
+
+// Is keeps the error from being retried by the controller.
+func (warmingUpError) Is(target error) bool {
+	return target == generic.ErrSkip
+}
+
+// Warmup tracks the warm-up of the IPAM and MAC caches from the IPPools
+// existing at startup. The caches start out empty after a restart, and would
+// hand out the IP addresses leased before then again, so nothing is allocated
+// from them or released to them until the warm-up is done. A nil Warmup is
+// always done.
+type Warmup struct {
+	started atomic.Bool
+	done    atomic.Bool
+}
+
+func NewWarmup() *Warmup {
+	return &Warmup{}
+}
+
+// Start marks the warm-up as in progress.
+func (w *Warmup) Start() {
+	w.started.Store(true)
+}
+
+// Done marks the warm-up as done.
+func (w *Warmup) Done() {
+	w.done.Store(true)
+}
+
+// IsDone reports whether the warm-up is done.
+func (w *Warmup) IsDone() bool {
+	return w == nil || w.done.Load()
+}
+
+// Check is the ready check of the controller. A controller on standby, which
+// hasn't started warming up, is ready.
+func (w *Warmup) Check() error {
+	if w.started.Load() && !w.IsDone() {
+		return ErrWarmingUp
+	}
+	return nil
+}
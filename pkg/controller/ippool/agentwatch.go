@@ -0,0 +1,149 @@
+package ippool
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// agentMonitorFallbackPeriod is how long an IPPool waiting for its agent goes
+// before being checked again without any change of the agent pod showing up.
+const agentMonitorFallbackPeriod = time.Minute
+
+// reasonAgentNotReady is the reason of the events about the IPPools whose
+// agent stopped being ready.
+const reasonAgentNotReady = "AgentNotReady"
+
+// agentPendingError tells the agent of an IPPool isn't ready yet. It sets the
+// AgentReady condition to false like any other error, but isn't retried with
+// backoff, as the agent pod watcher enqueues the IPPool as soon as the pod
+// changes.
+type agentPendingError struct {
+	err error
+}
+
+func (e agentPendingError) Error() string {
+	return e.err.Error()
+}
+
+// Is keeps the error from being retried by the controller. The condition is
+// still set, as only generic.ErrSkip itself is taken as a success.
+func (e agentPendingError) Is(target error) bool {
+	return target == generic.ErrSkip
+}
+
+// waitForAgent schedules the fallback check of the IPPool and returns err as
+// an agentPendingError. An IPPool whose agent was ready gets an event, while
+// the ones still waiting for their agent to come up don't.
+func (h *Handler) waitForAgent(ipPool *networkv1.IPPool, err error) error {
+	if h.recorder != nil && networkv1.AgentReady.IsTrue(ipPool) {
+		h.recorder.Eventf(ipPool, corev1.EventTypeWarning, reasonAgentNotReady,
+			"Agent serving network %s is not ready: %s", ipPool.Spec.NetworkName, err)
+	}
+
+	// The controller isn't set up in tests not caring about it
+	if h.ippoolController != nil {
+		h.ippoolController.EnqueueAfter(ipPool.Namespace, ipPool.Name, agentMonitorFallbackPeriod)
+	}
+	return agentPendingError{err: err}
+}
+
+// agentPodState is what MonitorAgent looks at in an agent pod, along with the
+// IPPool the pod belongs to.
+type agentPodState struct {
+	ipPoolNamespace     string
+	ipPoolName          string
+	uid                 string
+	image               string
+	deleting            bool
+	ready               bool
+	networkVerification string
+	declinedIPs         string
+}
+
+func newAgentPodState(pod *corev1.Pod) agentPodState {
+	state := agentPodState{
+		ipPoolNamespace:     pod.Labels[util.IPPoolNamespaceLabelKey],
+		ipPoolName:          pod.Labels[util.IPPoolNameLabelKey],
+		uid:                 string(pod.UID),
+		deleting:            pod.DeletionTimestamp != nil,
+		ready:               isPodReady(pod),
+		networkVerification: pod.Annotations[util.NetworkVerificationAnnotationKey],
+		declinedIPs:         pod.Annotations[util.DeclinedIPsAnnotationKey],
+	}
+	if len(pod.Spec.Containers) > 0 {
+		state.image = pod.Spec.Containers[0].Image
+	}
+	return state
+}
+
+// agentPodTracker keeps the last state seen of each agent pod, so the IPPools
+// are only enqueued on the transitions of their agents.
+type agentPodTracker struct {
+	states map[string]agentPodState
+	mutex  sync.Mutex
+}
+
+func newAgentPodTracker() *agentPodTracker {
+	return &agentPodTracker{
+		states: make(map[string]agentPodState),
+	}
+}
+
+// observe records the state of the agent pod and reports whether it differs
+// from the one last seen.
+func (t *agentPodTracker) observe(key string, state agentPodState) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if previous, ok := t.states[key]; ok && previous == state {
+		return false
+	}
+	t.states[key] = state
+	return true
+}
+
+// forget drops the agent pod and returns its last state seen.
+func (t *agentPodTracker) forget(key string) (agentPodState, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	state, ok := t.states[key]
+	delete(t.states, key)
+	return state, ok
+}
+
+// OnAgentPodChange enqueues the IPPool of an agent pod as soon as the pod
+// changes in a way MonitorAgent cares about, e.g., becomes ready or is gone,
+// so the AgentReady condition follows the agent without waiting for a retry.
+func (h *Handler) OnAgentPodChange(key string, pod *corev1.Pod) (*corev1.Pod, error) {
+	if pod == nil {
+		if state, ok := h.agentPods.forget(key); ok {
+			logrus.Debugf("(ippool.OnAgentPodChange) agent pod %s is gone, enqueue ippool %s/%s", key, state.ipPoolNamespace, state.ipPoolName)
+			h.ippoolController.Enqueue(state.ipPoolNamespace, state.ipPoolName)
+		}
+		return nil, nil
+	}
+
+	if pod.Labels[vmDHCPControllerLabelKey] != "agent" {
+		return pod, nil
+	}
+
+	state := newAgentPodState(pod)
+	if state.ipPoolNamespace == "" || state.ipPoolName == "" {
+		return pod, nil
+	}
+
+	if h.agentPods.observe(key, state) {
+		logrus.Debugf("(ippool.OnAgentPodChange) agent pod %s changed (ready: %t), enqueue ippool %s/%s", key, state.ready, state.ipPoolNamespace, state.ipPoolName)
+		h.ippoolController.Enqueue(state.ipPoolNamespace, state.ipPoolName)
+	}
+
+	return pod, nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
@@ -22,8 +23,10 @@ import (
 func prepareAgentPod(
 	ipPool *networkv1.IPPool,
 	noDHCP bool,
+	enableCacheDumpAPI bool,
 	agentNamespace string,
 	clusterNetwork string,
+	mtu int,
 	agentServiceAccountName string,
 	agentImage *config.Image,
 ) (*corev1.Pod, error) {
@@ -55,6 +58,18 @@ func prepareAgentPod(
 	if noDHCP {
 		args = append(args, "--dry-run")
 	}
+	if enableCacheDumpAPI {
+		args = append(args, "--enable-cache-dump-api")
+	}
+	if ipPool.Spec.SkipNetworkVerification == nil || !*ipPool.Spec.SkipNetworkVerification {
+		args = append(args, "--verify-cidr", ipPool.Spec.IPv4Config.CIDR)
+		if ipPool.Spec.IPv4Config.Router != "" {
+			args = append(args, "--verify-router", ipPool.Spec.IPv4Config.Router)
+		}
+		if mtu > 0 {
+			args = append(args, "--verify-mtu", strconv.Itoa(mtu))
+		}
+	}
 
 	return &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -65,30 +80,13 @@ func prepareAgentPod(
 				vmDHCPControllerLabelKey:     "agent",
 				util.IPPoolNamespaceLabelKey: ipPool.Namespace,
 				util.IPPoolNameLabelKey:      ipPool.Name,
+				util.IPPoolUIDLabelKey:       string(ipPool.UID),
 			},
 			Name:      name,
 			Namespace: agentNamespace,
 		},
 		Spec: corev1.PodSpec{
-			Affinity: &corev1.Affinity{
-				NodeAffinity: &corev1.NodeAffinity{
-					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
-						NodeSelectorTerms: []corev1.NodeSelectorTerm{
-							{
-								MatchExpressions: []corev1.NodeSelectorRequirement{
-									{
-										Key:      network.GroupName + "/" + clusterNetwork,
-										Operator: corev1.NodeSelectorOpIn,
-										Values: []string{
-											"true",
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
+			Affinity:           clusterNetworkAffinity(clusterNetwork),
 			ServiceAccountName: agentServiceAccountName,
 			InitContainers: []corev1.Container{
 				{
@@ -121,6 +119,14 @@ func prepareAgentPod(
 							Name:  "VM_DHCP_AGENT_NAME",
 							Value: name,
 						},
+						{
+							Name: "POD_NAMESPACE",
+							ValueFrom: &corev1.EnvVarSource{
+								FieldRef: &corev1.ObjectFieldSelector{
+									FieldPath: "metadata.namespace",
+								},
+							},
+						},
 					},
 					SecurityContext: &corev1.SecurityContext{
 						RunAsUser:  &runAsUserID,
@@ -128,6 +134,7 @@ func prepareAgentPod(
 						Capabilities: &corev1.Capabilities{
 							Add: []corev1.Capability{
 								"NET_ADMIN",
+								"NET_RAW",
 							},
 						},
 					},
@@ -153,6 +160,30 @@ func prepareAgentPod(
 	}, nil
 }
 
+// clusterNetworkAffinity keeps the Pod on the nodes attached to the cluster
+// network.
+func clusterNetworkAffinity(clusterNetwork string) *corev1.Affinity {
+	return &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{
+						MatchExpressions: []corev1.NodeSelectorRequirement{
+							{
+								Key:      network.GroupName + "/" + clusterNetwork,
+								Operator: corev1.NodeSelectorOpIn,
+								Values: []string{
+									"true",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
 func setRegisteredCondition(ipPool *networkv1.IPPool, status corev1.ConditionStatus, reason, message string) {
 	networkv1.Registered.SetStatus(ipPool, string(status))
 	networkv1.Registered.Reason(ipPool, reason)
@@ -177,6 +208,24 @@ func setStoppedCondition(ipPool *networkv1.IPPool, status corev1.ConditionStatus
 	networkv1.Stopped.Message(ipPool, message)
 }
 
+func setServiceRoutesReadyCondition(ipPool *networkv1.IPPool, status corev1.ConditionStatus, reason, message string) {
+	networkv1.ServiceRoutesReady.SetStatus(ipPool, string(status))
+	networkv1.ServiceRoutesReady.Reason(ipPool, reason)
+	networkv1.ServiceRoutesReady.Message(ipPool, message)
+}
+
+func setNetworkMismatchCondition(ipPool *networkv1.IPPool, status corev1.ConditionStatus, reason, message string) {
+	networkv1.NetworkMismatch.SetStatus(ipPool, string(status))
+	networkv1.NetworkMismatch.Reason(ipPool, reason)
+	networkv1.NetworkMismatch.Message(ipPool, message)
+}
+
+func setDegradedCondition(ipPool *networkv1.IPPool, status corev1.ConditionStatus, reason, message string) {
+	networkv1.Degraded.SetStatus(ipPool, string(status))
+	networkv1.Degraded.Reason(ipPool, reason)
+	networkv1.Degraded.Message(ipPool, message)
+}
+
 type IPPoolBuilder struct {
 	ipPool *networkv1.IPPool
 }
@@ -200,6 +249,11 @@ func (b *IPPoolBuilder) Annotation(key, value string) *IPPoolBuilder {
 	return b
 }
 
+func (b *IPPoolBuilder) UID(uid string) *IPPoolBuilder {
+	b.ipPool.UID = types.UID(uid)
+	return b
+}
+
 func (b *IPPoolBuilder) NetworkName(networkName string) *IPPoolBuilder {
 	b.ipPool.Spec.NetworkName = networkName
 	return b
@@ -217,11 +271,85 @@ func (b *IPPoolBuilder) UnPaused() *IPPoolBuilder {
 	return b
 }
 
+func (b *IPPoolBuilder) SkipNetworkVerification() *IPPoolBuilder {
+	skip := true
+	b.ipPool.Spec.SkipNetworkVerification = &skip
+	return b
+}
+
+func (b *IPPoolBuilder) AllowBOOTP() *IPPoolBuilder {
+	allow := true
+	b.ipPool.Spec.AllowBOOTP = &allow
+	return b
+}
+
+func (b *IPPoolBuilder) RelayGateway(relayGateways ...string) *IPPoolBuilder {
+	b.ipPool.Spec.RelayGateways = append(b.ipPool.Spec.RelayGateways, relayGateways...)
+	return b
+}
+
+func (b *IPPoolBuilder) AllocationStrategy(strategy networkv1.AllocationStrategy) *IPPoolBuilder {
+	b.ipPool.Spec.AllocationStrategy = strategy
+	return b
+}
+
+func (b *IPPoolBuilder) OverflowPool(overflowPool string) *IPPoolBuilder {
+	b.ipPool.Spec.OverflowPool = overflowPool
+	return b
+}
+
+func (b *IPPoolBuilder) OverflowWeight(weight int) *IPPoolBuilder {
+	b.ipPool.Spec.OverflowWeight = &weight
+	return b
+}
+
+func (b *IPPoolBuilder) ExternalIPAM(url string, failurePolicy networkv1.ExternalIPAMFailurePolicy) *IPPoolBuilder {
+	b.ipPool.Spec.ExternalIPAM = &networkv1.ExternalIPAM{
+		URL:           url,
+		FailurePolicy: failurePolicy,
+	}
+	return b
+}
+
+func (b *IPPoolBuilder) ExternalIPAMAuthSecret(name, key string) *IPPoolBuilder {
+	if b.ipPool.Spec.ExternalIPAM == nil {
+		b.ipPool.Spec.ExternalIPAM = &networkv1.ExternalIPAM{}
+	}
+	b.ipPool.Spec.ExternalIPAM.AuthSecretRef = &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: name},
+		Key:                  key,
+	}
+	return b
+}
+
+func (b *IPPoolBuilder) RequiredVMAnnotation(key, value string) *IPPoolBuilder {
+	if b.ipPool.Spec.RequiredVMAnnotations == nil {
+		b.ipPool.Spec.RequiredVMAnnotations = make(map[string]string)
+	}
+	b.ipPool.Spec.RequiredVMAnnotations[key] = value
+	return b
+}
+
 func (b *IPPoolBuilder) ServerIP(serverIP string) *IPPoolBuilder {
 	b.ipPool.Spec.IPv4Config.ServerIP = serverIP
 	return b
 }
 
+func (b *IPPoolBuilder) DomainName(domainName string) *IPPoolBuilder {
+	b.ipPool.Spec.IPv4Config.DomainName = &domainName
+	return b
+}
+
+func (b *IPPoolBuilder) DomainSearch(domains ...string) *IPPoolBuilder {
+	b.ipPool.Spec.IPv4Config.DomainSearch = append(b.ipPool.Spec.IPv4Config.DomainSearch, domains...)
+	return b
+}
+
+func (b *IPPoolBuilder) LeaseTime(leaseTime int) *IPPoolBuilder {
+	b.ipPool.Spec.IPv4Config.LeaseTime = &leaseTime
+	return b
+}
+
 func (b *IPPoolBuilder) CIDR(cidr string) *IPPoolBuilder {
 	b.ipPool.Spec.IPv4Config.CIDR = cidr
 	return b
@@ -232,17 +360,130 @@ func (b *IPPoolBuilder) Router(router string) *IPPoolBuilder {
 	return b
 }
 
+func (b *IPPoolBuilder) SubnetMaskOverride(subnetMask string) *IPPoolBuilder {
+	b.ipPool.Spec.IPv4Config.SubnetMaskOverride = subnetMask
+	return b
+}
+
+func (b *IPPoolBuilder) MTU(mtu int) *IPPoolBuilder {
+	if b.ipPool.Spec.IPv4Config.Options == nil {
+		b.ipPool.Spec.IPv4Config.Options = new(networkv1.DHCPOptions)
+	}
+	b.ipPool.Spec.IPv4Config.Options.MTU = &mtu
+	return b
+}
+
+func (b *IPPoolBuilder) ExtraOption(code int, value string) *IPPoolBuilder {
+	return b.TypedExtraOption(code, value, "")
+}
+
+func (b *IPPoolBuilder) TypedExtraOption(code int, value string, optionType networkv1.ExtraOptionType) *IPPoolBuilder {
+	if b.ipPool.Spec.IPv4Config.Options == nil {
+		b.ipPool.Spec.IPv4Config.Options = new(networkv1.DHCPOptions)
+	}
+	b.ipPool.Spec.IPv4Config.Options.ExtraOptions = append(b.ipPool.Spec.IPv4Config.Options.ExtraOptions, networkv1.ExtraOption{
+		Code:  code,
+		Value: value,
+		Type:  optionType,
+	})
+	return b
+}
+
 func (b *IPPoolBuilder) PoolRange(start, end string) *IPPoolBuilder {
 	b.ipPool.Spec.IPv4Config.Pool.Start = start
 	b.ipPool.Spec.IPv4Config.Pool.End = end
 	return b
 }
 
+func (b *IPPoolBuilder) AllowNetworkBroadcast() *IPPoolBuilder {
+	b.ipPool.Spec.IPv4Config.Pool.AllowNetworkBroadcast = true
+	return b
+}
+
+func (b *IPPoolBuilder) PoolCount(start string, count int) *IPPoolBuilder {
+	b.ipPool.Spec.IPv4Config.Pool.Start = start
+	b.ipPool.Spec.IPv4Config.Pool.Count = count
+	return b
+}
+
+func (b *IPPoolBuilder) IPv6PoolRange(cidr, serverIP, start, end string) *IPPoolBuilder {
+	b.ipPool.Spec.IPv6Config = &networkv1.IPv6Config{
+		CIDR:     cidr,
+		ServerIP: serverIP,
+		Pool: networkv1.IPv6Pool{
+			Start: start,
+			End:   end,
+		},
+	}
+	return b
+}
+
+func (b *IPPoolBuilder) DNS(dnsServers ...string) *IPPoolBuilder {
+	b.ipPool.Spec.IPv4Config.DNS = append(b.ipPool.Spec.IPv4Config.DNS, dnsServers...)
+	return b
+}
+
+func (b *IPPoolBuilder) IPv6DNS(dnsServers ...string) *IPPoolBuilder {
+	if b.ipPool.Spec.IPv6Config == nil {
+		b.ipPool.Spec.IPv6Config = new(networkv1.IPv6Config)
+	}
+	b.ipPool.Spec.IPv6Config.DNS = append(b.ipPool.Spec.IPv6Config.DNS, dnsServers...)
+	return b
+}
+
 func (b *IPPoolBuilder) Exclude(ipAddressList ...string) *IPPoolBuilder {
 	b.ipPool.Spec.IPv4Config.Pool.Exclude = append(b.ipPool.Spec.IPv4Config.Pool.Exclude, ipAddressList...)
 	return b
 }
 
+func (b *IPPoolBuilder) HoldBack(start, end string) *IPPoolBuilder {
+	b.ipPool.Spec.IPv4Config.Pool.HoldBack = &networkv1.HoldBack{
+		Start: start,
+		End:   end,
+	}
+	return b
+}
+
+func (b *IPPoolBuilder) KnownExternalHost(ipAddress, macAddress, description string) *IPPoolBuilder {
+	b.ipPool.Spec.KnownExternalHosts = append(b.ipPool.Spec.KnownExternalHosts, networkv1.KnownExternalHost{
+		IP:          ipAddress,
+		MAC:         macAddress,
+		Description: description,
+	})
+	return b
+}
+
+func (b *IPPoolBuilder) Reservation(macAddress, ipAddress string) *IPPoolBuilder {
+	b.ipPool.Spec.IPv4Config.Reservations = append(b.ipPool.Spec.IPv4Config.Reservations, networkv1.Reservation{
+		MACAddress: macAddress,
+		IPAddress:  ipAddress,
+	})
+	return b
+}
+
+func (b *IPPoolBuilder) StaticRoute(destination, gateway string) *IPPoolBuilder {
+	b.ipPool.Spec.IPv4Config.StaticRoutes = append(b.ipPool.Spec.IPv4Config.StaticRoutes, networkv1.Route{
+		Destination: destination,
+		Gateway:     gateway,
+	})
+	return b
+}
+
+func (b *IPPoolBuilder) AdvertiseServiceRoutes(serviceGateway string) *IPPoolBuilder {
+	advertise := true
+	b.ipPool.Spec.AdvertiseServiceRoutes = &advertise
+	b.ipPool.Spec.ServiceGateway = serviceGateway
+	return b
+}
+
+func (b *IPPoolBuilder) ServiceRoute(destination, gateway string) *IPPoolBuilder {
+	b.ipPool.Status.ServiceRoutes = append(b.ipPool.Status.ServiceRoutes, networkv1.Route{
+		Destination: destination,
+		Gateway:     gateway,
+	})
+	return b
+}
+
 func (b *IPPoolBuilder) AgentPodRef(namespace, name, image, uid string) *IPPoolBuilder {
 	if b.ipPool.Status.AgentPodRef == nil {
 		b.ipPool.Status.AgentPodRef = new(networkv1.PodReference)
@@ -265,6 +506,45 @@ func (b *IPPoolBuilder) Allocated(ipAddress, macAddress string) *IPPoolBuilder {
 	return b
 }
 
+func (b *IPPoolBuilder) AllocationEntry(ipAddress string, allocationType networkv1.AllocationType, owner string) *IPPoolBuilder {
+	if b.ipPool.Status.IPv4 == nil {
+		b.ipPool.Status.IPv4 = new(networkv1.IPv4Status)
+	}
+	if b.ipPool.Status.IPv4.Entries == nil {
+		b.ipPool.Status.IPv4.Entries = make(map[string]networkv1.AllocationEntry, 2)
+	}
+	b.ipPool.Status.IPv4.Entries[ipAddress] = networkv1.AllocationEntry{
+		Type:  allocationType,
+		Owner: owner,
+	}
+	return b
+}
+
+func (b *IPPoolBuilder) AllocationRevision(revision int64) *IPPoolBuilder {
+	b.ipPool.Status.AllocationRevision = revision
+	return b
+}
+
+func (b *IPPoolBuilder) AllocatorHash(hash string) *IPPoolBuilder {
+	b.ipPool.Status.AllocatorHash = hash
+	return b
+}
+
+func (b *IPPoolBuilder) DHCPCheck(state networkv1.DHCPCheckState, podName, macAddress, ipAddress string) *IPPoolBuilder {
+	b.ipPool.Status.LastCheck = &networkv1.DHCPCheck{
+		State:      state,
+		PodName:    podName,
+		MACAddress: macAddress,
+		IPAddress:  ipAddress,
+	}
+	return b
+}
+
+func (b *IPPoolBuilder) SchemaVersion(version int64) *IPPoolBuilder {
+	b.ipPool.Status.SchemaVersion = version
+	return b
+}
+
 func (b *IPPoolBuilder) Available(count int) *IPPoolBuilder {
 	if b.ipPool.Status.IPv4 == nil {
 		b.ipPool.Status.IPv4 = new(networkv1.IPv4Status)
@@ -301,6 +581,21 @@ func (b *IPPoolBuilder) StoppedCondition(status corev1.ConditionStatus, reason,
 	return b
 }
 
+func (b *IPPoolBuilder) ServiceRoutesReadyCondition(status corev1.ConditionStatus, reason, message string) *IPPoolBuilder {
+	setServiceRoutesReadyCondition(b.ipPool, status, reason, message)
+	return b
+}
+
+func (b *IPPoolBuilder) NetworkMismatchCondition(status corev1.ConditionStatus, reason, message string) *IPPoolBuilder {
+	setNetworkMismatchCondition(b.ipPool, status, reason, message)
+	return b
+}
+
+func (b *IPPoolBuilder) DegradedCondition(status corev1.ConditionStatus, reason, message string) *IPPoolBuilder {
+	setDegradedCondition(b.ipPool, status, reason, message)
+	return b
+}
+
 func (b *IPPoolBuilder) Build() *networkv1.IPPool {
 	return b.ipPool
 }
@@ -402,10 +697,61 @@ func (b *podBuilder) PodReady(ready corev1.ConditionStatus) *podBuilder {
 	return b
 }
 
+func (b *podBuilder) Annotation(key, value string) *podBuilder {
+	if b.pod.Annotations == nil {
+		b.pod.Annotations = make(map[string]string)
+	}
+	b.pod.Annotations[key] = value
+	return b
+}
+
+func (b *podBuilder) Label(key, value string) *podBuilder {
+	if b.pod.Labels == nil {
+		b.pod.Labels = make(map[string]string)
+	}
+	b.pod.Labels[key] = value
+	return b
+}
+
 func (b *podBuilder) Build() *corev1.Pod {
 	return b.pod
 }
 
+type nodeBuilder struct {
+	node *corev1.Node
+}
+
+func newNodeBuilder(name string) *nodeBuilder {
+	return &nodeBuilder{
+		node: &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+			},
+		},
+	}
+}
+
+func (b *nodeBuilder) Label(key, value string) *nodeBuilder {
+	if b.node.Labels == nil {
+		b.node.Labels = make(map[string]string)
+	}
+	b.node.Labels[key] = value
+	return b
+}
+
+func (b *nodeBuilder) NodeArgs(args ...string) *nodeBuilder {
+	if b.node.Annotations == nil {
+		b.node.Annotations = make(map[string]string)
+	}
+	nodeArgs, _ := json.Marshal(args)
+	b.node.Annotations[util.NodeArgsAnnotationKey] = string(nodeArgs)
+	return b
+}
+
+func (b *nodeBuilder) Build() *corev1.Node {
+	return b.node
+}
+
 type NetworkAttachmentDefinitionBuilder struct {
 	nad *cniv1.NetworkAttachmentDefinition
 }
@@ -429,6 +775,19 @@ func (b *NetworkAttachmentDefinitionBuilder) Label(key, value string) *NetworkAt
 	return b
 }
 
+func (b *NetworkAttachmentDefinitionBuilder) Annotation(key, value string) *NetworkAttachmentDefinitionBuilder {
+	if b.nad.Annotations == nil {
+		b.nad.Annotations = make(map[string]string)
+	}
+	b.nad.Annotations[key] = value
+	return b
+}
+
+func (b *NetworkAttachmentDefinitionBuilder) Config(config string) *NetworkAttachmentDefinitionBuilder {
+	b.nad.Spec.Config = config
+	return b
+}
+
 func (b *NetworkAttachmentDefinitionBuilder) Build() *cniv1.NetworkAttachmentDefinition {
 	return b.nad
 }
@@ -436,6 +795,13 @@ func (b *NetworkAttachmentDefinitionBuilder) Build() *cniv1.NetworkAttachmentDef
 func SanitizeStatus(status *networkv1.IPPoolStatus) {
 	now := time.Time{}
 	status.LastUpdate = metav1.NewTime(now)
+	status.LastChange = metav1.NewTime(now)
+	if status.IPv4 != nil {
+		for ip, entry := range status.IPv4.Entries {
+			entry.Since = nil
+			status.IPv4.Entries[ip] = entry
+		}
+	}
 	for i := range status.Conditions {
 		status.Conditions[i].LastTransitionTime = ""
 		status.Conditions[i].LastUpdateTime = ""
@@ -0,0 +1,155 @@
+package ippool
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/agent/decline"
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/dhcp"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+const reasonIPConflict = "IPConflict"
+
+// syncConflicts records the IP addresses declined by guests, as reported by
+// the agent, in ipv4Status, and keeps them out of the IPAM until their
+// quarantine is over. The ones still leased are left to the vmnetcfg
+// controller, which moves their owners to other IP addresses.
+func (h *Handler) syncConflicts(ipPool *networkv1.IPPool, ipv4Status *networkv1.IPv4Status) error {
+	now := h.clock.Now()
+
+	for _, d := range h.agentDeclines(ipPool) {
+		until := d.Time.Add(h.conflictQuarantine)
+		if h.conflictQuarantine <= 0 || !until.After(now) {
+			continue
+		}
+		if !util.IsIPInBetweenOf(d.IP, ipPool.Spec.IPv4Config.Pool.Start, util.PoolEnd(ipPool)) {
+			continue
+		}
+		if conflict, ok := ipv4Status.Conflicts[d.IP]; ok && !d.Time.After(conflict.DeclinedAt.Time) {
+			continue
+		}
+
+		if ipv4Status.Conflicts == nil {
+			ipv4Status.Conflicts = make(map[string]networkv1.IPConflict)
+		}
+		ipv4Status.Conflicts[d.IP] = networkv1.IPConflict{
+			MACAddress: d.MACAddress,
+			DeclinedAt: metav1.NewTime(d.Time),
+			Until:      metav1.NewTime(until),
+		}
+
+		logrus.Warnf("(ippool.syncConflicts) ip %s of ippool %s/%s was declined by %s, quarantine it until %s",
+			d.IP, ipPool.Namespace, ipPool.Name, d.MACAddress, until.Format(time.RFC3339))
+		if h.recorder != nil {
+			h.recorder.Eventf(ipPool, corev1.EventTypeWarning, reasonIPConflict,
+				"IP address %s was declined by %s as already in use, quarantined until %s", d.IP, d.MACAddress, until.Format(time.RFC3339))
+		}
+	}
+
+	if len(ipv4Status.Conflicts) == 0 {
+		return nil
+	}
+
+	ipamName := util.IPAMName(ipPool)
+	initialized := h.ipAllocator.IsNetworkInitialized(ipamName)
+	entries := util.AllocationEntries(ipv4Status)
+
+	var nextExpiry time.Time
+	for ip, conflict := range ipv4Status.Conflicts {
+		// Excluded, reserved, and leased IP addresses are kept out of the
+		// IPAM, or revoked by the vmnetcfg controller, regardless
+		_, hasEntry := entries[ip]
+
+		if !conflict.Until.Time.After(now) {
+			delete(ipv4Status.Conflicts, ip)
+			logrus.Infof("(ippool.syncConflicts) quarantine of ip %s of ippool %s/%s is over", ip, ipPool.Namespace, ipPool.Name)
+			if hasEntry || !initialized {
+				continue
+			}
+			if err := h.ipAllocator.RestoreIP(ipamName, ip); err != nil {
+				return err
+			}
+			logrus.Infof("(ippool.syncConflicts) conflicted ip %s was restored in ipam %s", ip, ipamName)
+			continue
+		}
+
+		if nextExpiry.IsZero() || conflict.Until.Time.Before(nextExpiry) {
+			nextExpiry = conflict.Until.Time
+		}
+
+		if hasEntry || !initialized {
+			continue
+		}
+		if allocated, err := h.ipAllocator.IsAllocated(ipamName, ip); err != nil || allocated {
+			// Already revoked, or leased in the meantime
+			continue
+		}
+		if err := h.ipAllocator.RevokeIP(ipamName, ip); err != nil {
+			return err
+		}
+		logrus.Infof("(ippool.syncConflicts) conflicted ip %s was revoked in ipam %s", ip, ipamName)
+	}
+
+	// The controller isn't set up in tests not caring about it
+	if !nextExpiry.IsZero() && h.ippoolController != nil {
+		h.ippoolController.EnqueueAfter(ipPool.Namespace, ipPool.Name, nextExpiry.Sub(now))
+	}
+
+	return nil
+}
+
+// agentDeclines returns the DHCPDECLINEs reported by the agent of ipPool. A
+// malformed report is only logged, as it mustn't hold up the IPPool.
+func (h *Handler) agentDeclines(ipPool *networkv1.IPPool) []dhcp.Decline {
+	if h.noAgent || ipPool.Status.AgentPodRef == nil {
+		return nil
+	}
+
+	agentPod, err := h.podCache.Get(ipPool.Status.AgentPodRef.Namespace, ipPool.Status.AgentPodRef.Name)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logrus.Warnf("(ippool.agentDeclines) failed to get agent pod of ippool %s/%s: %s", ipPool.Namespace, ipPool.Name, err.Error())
+		}
+		return nil
+	}
+	if agentPod.GetUID() != ipPool.Status.AgentPodRef.UID {
+		return nil
+	}
+
+	declines, err := decline.ParseDeclines(agentPod.Annotations)
+	if err != nil {
+		logrus.Warnf("(ippool.agentDeclines) agent pod %s reports malformed declines: %s", agentPod.Name, err.Error())
+		return nil
+	}
+
+	return declines
+}
+
+// quarantinedIPs returns the IP addresses of ipPool whose quarantine isn't
+// over yet. The ones still leased are left out, as they're revoked once given
+// up by their owners.
+func quarantinedIPs(ipPool *networkv1.IPPool, now time.Time) []string {
+	if ipPool.Status.IPv4 == nil {
+		return nil
+	}
+
+	leases := util.Leases(ipPool.Status.IPv4)
+	var ips []string
+	for ip, conflict := range ipPool.Status.IPv4.Conflicts {
+		if !conflict.Until.Time.After(now) {
+			continue
+		}
+		if _, ok := leases[ip]; ok {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+
+	return ips
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/rancher/wrangler/v3/pkg/kv"
 	"github.com/rancher/wrangler/v3/pkg/relatedresource"
@@ -11,18 +13,27 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 
+	"github.com/harvester/vm-dhcp-controller/pkg/agent"
+	"github.com/harvester/vm-dhcp-controller/pkg/agent/netcheck"
 	"github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io"
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/audit"
 	"github.com/harvester/vm-dhcp-controller/pkg/cache"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+	"github.com/harvester/vm-dhcp-controller/pkg/clusterinfo"
 	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/externalipam"
+	"github.com/harvester/vm-dhcp-controller/pkg/forecast"
 	ctlcorev1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/core/v1"
 	ctlcniv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/k8s.cni.cncf.io/v1"
+	ctlkubevirtv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/kubevirt.io/v1"
 	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
 	"github.com/harvester/vm-dhcp-controller/pkg/ipam"
 	"github.com/harvester/vm-dhcp-controller/pkg/metrics"
+	"github.com/harvester/vm-dhcp-controller/pkg/reconcile"
 	"github.com/harvester/vm-dhcp-controller/pkg/util"
 )
 
@@ -32,6 +43,14 @@ const (
 	multusNetworksAnnotationKey         = "k8s.v1.cni.cncf.io/networks"
 	holdIPPoolAgentUpgradeAnnotationKey = "network.harvesterhci.io/hold-ippool-agent-upgrade"
 
+	// reasonPoolTooLarge is the reason of the Degraded condition of the
+	// IPPools with more allocatable addresses than allowed.
+	reasonPoolTooLarge = "PoolTooLarge"
+
+	// reasonInvalidNetworkConfig is the reason of the warning events of the
+	// IPPools whose NetworkAttachmentDefinition config can't be parsed.
+	reasonInvalidNetworkConfig = "InvalidNetworkConfig"
+
 	vmDHCPControllerLabelKey = network.GroupName + "/vm-dhcp-controller"
 	clusterNetworkLabelKey   = network.GroupName + "/clusternetwork"
 
@@ -53,6 +72,7 @@ type Network struct {
 	Namespace     string `json:"namespace"`
 	Name          string `json:"name"`
 	InterfaceName string `json:"interface"`
+	MACAddress    string `json:"mac,omitempty"`
 }
 
 type Handler struct {
@@ -61,24 +81,71 @@ type Handler struct {
 	agentServiceAccountName string
 	noAgent                 bool
 	noDHCP                  bool
+	enableCacheDumpAPI      bool
+	typedAllocationEntries  bool
+	maxPoolSize             int
+	conflictQuarantine      time.Duration
 
 	cacheAllocator   *cache.CacheAllocator
 	ipAllocator      *ipam.IPAllocator
 	metricsAllocator *metrics.MetricsAllocator
+	clock            clock.Clock
+	recorder         record.EventRecorder
+
+	// allocationTracker follows the pace of the allocations committed by the
+	// vmnetcfg controller for the exhaustion forecasts
+	allocationTracker *forecast.Tracker
+	// externalIPAM tells which IPPools have their external IPAM given up on
+	externalIPAM *externalipam.Client
+	// denialLog keeps the denied allocations of the IPPools
+	denialLog *audit.DenialLog
+
+	clusterInfo clusterinfo.Resolver
+
+	// cachesSynced reports whether the IPPool and Pod caches have synced
+	cachesSynced func() bool
+	// warmup gates the handlers touching the IPAM and MAC caches until they
+	// are built from the existing IPPools
+	warmup *config.Warmup
+	// upgrade holds off the agent Pod GC and the resyncs until the objects
+	// of former releases are upgraded
+	upgrade *config.Upgrade
+	// orphanedAgentPods tracks since when each agent Pod without a backing
+	// IPPool was first seen. Only the agent Pod GC touches it.
+	orphanedAgentPods map[string]time.Time
+	// agentPods keeps the last state seen of each agent Pod for the agent
+	// Pod watcher
+	agentPods *agentPodTracker
+	// resyncLimiter spreads the resyncs asked for with the resync annotation
+	// over time
+	resyncLimiter *reconcile.ResyncLimiter
+	// embedded hosts the agents of the IPPools of the networks the
+	// controller is attached to, if any
+	embedded *agent.Embedded
+	// vips keeps the load balancer VIPs seen, which are kept out of the
+	// IPAM like the known external hosts
+	vips *vipTracker
 
 	ippoolController ctlnetworkv1.IPPoolController
 	ippoolClient     ctlnetworkv1.IPPoolClient
 	ippoolCache      ctlnetworkv1.IPPoolCache
+	vmnetcfgCache    ctlnetworkv1.VirtualMachineNetworkConfigCache
 	podClient        ctlcorev1.PodClient
 	podCache         ctlcorev1.PodCache
 	nadClient        ctlcniv1.NetworkAttachmentDefinitionClient
 	nadCache         ctlcniv1.NetworkAttachmentDefinitionCache
+	// pinnedAllocationsAnnotation is the annotation of the VMs their IP
+	// addresses are pinned in, read from vmCache, when enabled
+	pinnedAllocationsAnnotation string
+	vmCache                     ctlkubevirtv1.VirtualMachineCache
 }
 
 func Register(ctx context.Context, management *config.Management) error {
 	ippools := management.HarvesterNetworkFactory.Network().V1alpha1().IPPool()
 	pods := management.CoreFactory.Core().V1().Pod()
 	nads := management.CniFactory.K8s().V1().NetworkAttachmentDefinition()
+	nodes := management.CoreFactory.Core().V1().Node()
+	vmnetcfgs := management.HarvesterNetworkFactory.Network().V1alpha1().VirtualMachineNetworkConfig()
 
 	handler := &Handler{
 		agentNamespace:          management.Options.AgentNamespace,
@@ -86,63 +153,170 @@ func Register(ctx context.Context, management *config.Management) error {
 		agentServiceAccountName: management.Options.AgentServiceAccountName,
 		noAgent:                 management.Options.NoAgent,
 		noDHCP:                  management.Options.NoDHCP,
+		enableCacheDumpAPI:      management.Options.EnableCacheDumpAPI,
+		typedAllocationEntries:  management.Options.TypedAllocationEntries,
+		maxPoolSize:             management.Options.MaxPoolSize,
+		conflictQuarantine:      management.Options.IPConflictQuarantine,
 
 		cacheAllocator:   management.CacheAllocator,
 		ipAllocator:      management.IPAllocator,
 		metricsAllocator: management.MetricsAllocator,
+		clock:            management.Clock,
+		recorder:         management.NewRecorder(controllerName, "", ""),
+
+		allocationTracker: management.AllocationTracker,
+		externalIPAM:      management.ExternalIPAM,
+		denialLog:         management.DenialLog,
+
+		clusterInfo: clusterinfo.NewNodeResolver(nodes.Cache()),
+
+		cachesSynced: func() bool {
+			return ippools.Informer().HasSynced() && pods.Informer().HasSynced()
+		},
+		warmup:        management.Warmup,
+		upgrade:       management.Upgrade,
+		agentPods:     newAgentPodTracker(),
+		vips:          newVIPTracker(),
+		resyncLimiter: reconcile.NewResyncLimiter(management.Options.ResyncInterval, management.Options.ResyncBurst, management.Clock),
 
 		ippoolController: ippools,
 		ippoolClient:     ippools,
 		ippoolCache:      ippools.Cache(),
+		vmnetcfgCache:    vmnetcfgs.Cache(),
 		podClient:        pods,
 		podCache:         pods.Cache(),
 		nadClient:        nads,
 		nadCache:         nads.Cache(),
 	}
 
+	// The pinned allocations are restored during the warmup, once the VMs
+	// are cached as well
+	if management.Options.PinnedAllocationsAnnotation != "" {
+		vms := management.KubeVirtFactory.Kubevirt().V1().VirtualMachine()
+		handler.pinnedAllocationsAnnotation = management.Options.PinnedAllocationsAnnotation
+		handler.vmCache = vms.Cache()
+		handler.cachesSynced = func() bool {
+			return ippools.Informer().HasSynced() && pods.Informer().HasSynced() && vms.Informer().HasSynced()
+		}
+	}
+
+	// The embedded agents serve the leases off the IPPools cached by the
+	// controller, and only as long as it's the leader
+	if !handler.noAgent && len(management.Options.EmbeddedAgentNetworks) > 0 {
+		handler.embedded = agent.NewEmbedded(ctx, management.Options.EmbeddedAgentNetworks, ippools.Informer(), handler.noDHCP, management.Clock)
+	}
+
+	limiter := reconcile.NewLimiter(controllerName, management.Options.ReconcileTimeout, management.MetricsAllocator)
+
 	ctlnetworkv1.RegisterIPPoolStatusHandler(
 		ctx,
 		ippools,
 		networkv1.Registered,
 		"ippool-register",
-		handler.DeployAgent,
+		reconcile.StatusHandler(limiter, "ippool-register", handler.DeployAgent),
 	)
 	ctlnetworkv1.RegisterIPPoolStatusHandler(
 		ctx,
 		ippools,
 		networkv1.CacheReady,
 		"ippool-cache-builder",
-		handler.BuildCache,
+		reconcile.StatusHandler(limiter, "ippool-cache-builder", handler.BuildCache),
 	)
 	ctlnetworkv1.RegisterIPPoolStatusHandler(
 		ctx,
 		ippools,
 		networkv1.AgentReady,
 		"ippool-agent-monitor",
-		handler.MonitorAgent,
+		reconcile.StatusHandler(limiter, "ippool-agent-monitor", handler.MonitorAgent),
+	)
+	ctlnetworkv1.RegisterIPPoolStatusHandler(
+		ctx,
+		ippools,
+		"",
+		"ippool-network-verifier",
+		reconcile.StatusHandler(limiter, "ippool-network-verifier", handler.VerifyNetwork),
+	)
+	ctlnetworkv1.RegisterIPPoolStatusHandler(
+		ctx,
+		ippools,
+		"",
+		"ippool-size-guard",
+		reconcile.StatusHandler(limiter, "ippool-size-guard", handler.GuardPoolSize),
+	)
+	ctlnetworkv1.RegisterIPPoolStatusHandler(
+		ctx,
+		ippools,
+		"",
+		"ippool-external-ipam-guard",
+		reconcile.StatusHandler(limiter, "ippool-external-ipam-guard", handler.GuardExternalIPAM),
+	)
+	ctlnetworkv1.RegisterIPPoolStatusHandler(
+		ctx,
+		ippools,
+		"",
+		"ippool-gateway-guard",
+		reconcile.StatusHandler(limiter, "ippool-gateway-guard", handler.GuardGateways),
 	)
 
-	relatedresource.Watch(ctx, "ippool-trigger", func(namespace, name string, obj runtime.Object) ([]relatedresource.Key, error) {
-		var keys []relatedresource.Key
-		sets := labels.Set{
-			"network.harvesterhci.io/vm-dhcp-controller": "agent",
+	// IPPools get their external IPAM given up on, or working again,
+	// reported right away
+	management.ExternalIPAM.OnStateChange(func(ipPoolKey string) {
+		ipPoolNamespace, ipPoolName := kv.RSplit(ipPoolKey, "/")
+		ippools.Enqueue(ipPoolNamespace, ipPoolName)
+	})
+
+	// IPPools get their agent's transitions right away rather than on the
+	// next retry
+	pods.OnChange(ctx, "ippool-agent-watcher", handler.OnAgentPodChange)
+
+	// Delegated IPPools follow the agent of the delegating one
+	relatedresource.Watch(ctx, "ippool-delegation-trigger", func(namespace, name string, obj runtime.Object) ([]relatedresource.Key, error) {
+		ipPool, ok := obj.(*networkv1.IPPool)
+		if !ok {
+			return nil, nil
 		}
-		pods, err := handler.podCache.List(namespace, sets.AsSelector())
-		if err != nil {
-			return nil, err
+		var keys []relatedresource.Key
+		childKeys := util.DelegatedPools(ipPool)
+		if ipPool.Spec.OverflowPool != "" {
+			childKeys = append(childKeys, ipPool.Spec.OverflowPool)
 		}
-		for _, pod := range pods {
-			key := relatedresource.Key{
-				Namespace: pod.Labels[util.IPPoolNamespaceLabelKey],
-				Name:      pod.Labels[util.IPPoolNameLabelKey],
-			}
-			keys = append(keys, key)
+		for _, key := range childKeys {
+			childNamespace, childName := kv.RSplit(key, "/")
+			keys = append(keys, relatedresource.Key{
+				Namespace: childNamespace,
+				Name:      childName,
+			})
 		}
 		return keys, nil
-	}, ippools, pods)
+	}, ippools, ippools)
+
+	// NetworkAttachmentDefinitions labeled with a missing IPPool are
+	// reported, and checked again once it's created or deleted
+	nads.OnChange(ctx, "ippool-nad-watcher", handler.OnNADChange)
+	relatedresource.Watch(ctx, "ippool-nad-trigger", handler.nadsOfIPPool, nads, ippools)
+
+	// DHCP checks asked for are launched, and their IPPools are enqueued as
+	// soon as the checker Pods are done
+	ippools.OnChange(ctx, "ippool-dhcp-checker", reconcile.Handler(limiter, "ippool-dhcp-checker", handler.OnDHCPCheck))
+	relatedresource.Watch(ctx, "ippool-dhcp-check-trigger", ipPoolOfDHCPCheckPod, ippools, pods)
 
-	ippools.OnChange(ctx, controllerName, handler.OnChange)
-	ippools.OnRemove(ctx, controllerName, handler.OnRemove)
+	// Resyncs asked for are run once per request ID
+	ippools.OnChange(ctx, "ippool-resyncer", reconcile.Handler(limiter, "ippool-resyncer", handler.OnResync))
+
+	ippools.OnChange(ctx, controllerName, reconcile.Handler(limiter, "ippool-onchange", handler.OnChange))
+	ippools.OnRemove(ctx, controllerName, reconcile.Handler(limiter, "ippool-onremove", handler.OnRemove))
+
+	handler.warmup.Start()
+	go handler.runWarmup(ctx)
+	go handler.runForecast(ctx)
+
+	if !handler.noAgent {
+		go handler.runAgentPodGC(ctx)
+	}
+
+	// The load balancer VIPs are watched through the dynamic client, as the
+	// Harvester load balancer CRD may not be installed
+	go handler.runVIPWatch(ctx, management.DynamicClient, management.ClientSet.Discovery())
 
 	return nil
 }
@@ -154,6 +328,10 @@ func (h *Handler) OnChange(key string, ipPool *networkv1.IPPool) (*networkv1.IPP
 
 	logrus.Debugf("(ippool.OnChange) ippool configuration %s has been changed: %+v", key, ipPool.Spec.IPv4Config)
 
+	if err := h.waitForWarmup(ipPool); err != nil {
+		return ipPool, err
+	}
+
 	// Build the relationship between IPPool and NetworkAttachmentDefinition for VirtualMachineNetworkConfig to reference
 	if err := h.ensureNADLabels(ipPool); err != nil {
 		return ipPool, err
@@ -161,6 +339,10 @@ func (h *Handler) OnChange(key string, ipPool *networkv1.IPPool) (*networkv1.IPP
 
 	ipPoolCpy := ipPool.DeepCopy()
 
+	// Any status written from here on is at the current schema version, which
+	// lets the other handlers trust what is absent in it
+	ipPoolCpy.Status.SchemaVersion = networkv1.IPPoolStatusSchemaVersion
+
 	// Check if the IPPool is administratively disabled
 	if ipPool.Spec.Paused != nil && *ipPool.Spec.Paused {
 		logrus.Infof("(ippool.OnChange) try to cleanup cache and agent for ippool %s", key)
@@ -176,7 +358,7 @@ func (h *Handler) OnChange(key string, ipPool *networkv1.IPPool) (*networkv1.IPP
 	}
 	networkv1.Stopped.False(ipPoolCpy)
 
-	if !h.ipAllocator.IsNetworkInitialized(ipPool.Spec.NetworkName) {
+	if !h.ipAllocator.IsNetworkInitialized(util.IPAMName(ipPool)) {
 		networkv1.CacheReady.False(ipPoolCpy)
 		networkv1.CacheReady.Reason(ipPoolCpy, "NotInitialized")
 		networkv1.CacheReady.Message(ipPoolCpy, "")
@@ -184,6 +366,23 @@ func (h *Handler) OnChange(key string, ipPool *networkv1.IPPool) (*networkv1.IPP
 			logrus.Warningf("(ippool.OnChange) ipam for ippool %s/%s is not initialized", ipPool.Namespace, ipPool.Name)
 			return h.ippoolClient.UpdateStatus(ipPoolCpy)
 		}
+	} else if hash := util.AllocatorInputsHash(ipPool); networkv1.CacheReady.IsTrue(ipPool) && ipPool.Status.AllocatorHash != hash {
+		if ipPool.Status.AllocatorHash == "" {
+			// The IPAM was built before the hash was recorded
+			ipPoolCpy.Status.AllocatorHash = hash
+		} else {
+			// Have BuildCache rebuild the IPAM from the changed spec
+			logrus.Infof("(ippool.OnChange) ipam inputs of ippool %s/%s changed, rebuilding it", ipPool.Namespace, ipPool.Name)
+			networkv1.CacheReady.False(ipPoolCpy)
+			networkv1.CacheReady.Reason(ipPoolCpy, "InputsChanged")
+			networkv1.CacheReady.Message(ipPoolCpy, "")
+			return h.ippoolClient.UpdateStatus(ipPoolCpy)
+		}
+	}
+
+	// Keep the known external hosts out of the IPAM before counting
+	if err := h.syncKnownExternalHosts(ipPool); err != nil {
+		return ipPool, err
 	}
 
 	// Update IPPool status based on up-to-date IPAM
@@ -193,13 +392,23 @@ func (h *Handler) OnChange(key string, ipPool *networkv1.IPPool) (*networkv1.IPP
 		ipv4Status = new(networkv1.IPv4Status)
 	}
 
-	used, err := h.ipAllocator.GetUsed(ipPool.Spec.NetworkName)
+	// Quarantine the IP addresses declined by guests, and let go of the ones
+	// whose quarantine is over, before counting
+	if err := h.syncConflicts(ipPool, ipv4Status); err != nil {
+		return ipPool, err
+	}
+
+	used, err := h.ipAllocator.GetUsed(util.IPAMName(ipPool))
 	if err != nil {
 		return nil, err
 	}
+	// The test lease of a running DHCP check isn't counted as in use
+	if _, _, ok := util.DHCPCheckLease(ipPool); ok && used > 0 {
+		used--
+	}
 	ipv4Status.Used = used
 
-	available, err := h.ipAllocator.GetAvailable(ipPool.Spec.NetworkName)
+	available, err := h.ipAllocator.GetAvailable(util.IPAMName(ipPool))
 	if err != nil {
 		return nil, err
 	}
@@ -218,30 +427,64 @@ func (h *Handler) OnChange(key string, ipPool *networkv1.IPPool) (*networkv1.IPP
 		available,
 	)
 
-	allocated := ipv4Status.Allocated
-	if allocated == nil {
-		allocated = make(map[string]string)
+	// Surface corrupted allocation records instead of silently skipping them
+	_, _, _, malformedList := util.LoadAllocated(util.AllocationEntries(ipv4Status))
+	if len(malformedList) > 0 {
+		logrus.Warnf("(ippool.OnChange) ippool %s/%s has malformed allocation records: %s", ipPool.Namespace, ipPool.Name, strings.Join(malformedList, ", "))
+	}
+	h.metricsAllocator.UpdateIPPoolMalformed(key, len(malformedList))
+
+	// Convert legacy allocation records into typed entries once. Records are
+	// kept in whichever format the status is in afterward.
+	if h.typedAllocationEntries {
+		if util.MigrateAllocated(ipv4Status, h.clock.Now()) {
+			logrus.Infof("(ippool.OnChange) migrated allocation records of ippool %s/%s to typed entries", ipPool.Namespace, ipPool.Name)
+		}
+		if ipv4Status.Entries == nil {
+			ipv4Status.Entries = make(map[string]networkv1.AllocationEntry)
+		}
 	}
-	if util.IsIPInBetweenOf(ipPool.Spec.IPv4Config.ServerIP, ipPool.Spec.IPv4Config.Pool.Start, ipPool.Spec.IPv4Config.Pool.End) {
-		allocated[ipPool.Spec.IPv4Config.ServerIP] = util.ReservedMark
+
+	reserved := networkv1.AllocationEntry{Type: networkv1.AllocationTypeReserved}
+	if util.IsIPInBetweenOf(ipPool.Spec.IPv4Config.ServerIP, ipPool.Spec.IPv4Config.Pool.Start, util.PoolEnd(ipPool)) {
+		util.SetAllocationEntry(ipv4Status, ipPool.Spec.IPv4Config.ServerIP, reserved, h.clock.Now())
 	}
-	if util.IsIPInBetweenOf(ipPool.Spec.IPv4Config.Router, ipPool.Spec.IPv4Config.Pool.Start, ipPool.Spec.IPv4Config.Pool.End) {
-		allocated[ipPool.Spec.IPv4Config.Router] = util.ReservedMark
+	if util.IsIPInBetweenOf(ipPool.Spec.IPv4Config.Router, ipPool.Spec.IPv4Config.Pool.Start, util.PoolEnd(ipPool)) {
+		util.SetAllocationEntry(ipv4Status, ipPool.Spec.IPv4Config.Router, reserved, h.clock.Now())
 	}
 	for _, eIP := range ipPool.Spec.IPv4Config.Pool.Exclude {
-		allocated[eIP] = util.ExcludedMark
+		util.SetAllocationEntry(ipv4Status, eIP, networkv1.AllocationEntry{Type: networkv1.AllocationTypeExcluded}, h.clock.Now())
+	}
+	externalIPs := h.externalIPs(ipPool)
+	for ip := range externalIPs {
+		util.SetAllocationEntry(ipv4Status, ip, networkv1.AllocationEntry{Type: networkv1.AllocationTypeExcluded}, h.clock.Now())
+	}
+	for _, ip := range staleExclusions(ipPool, ipv4Status, externalIPs) {
+		util.DeleteAllocationEntry(ipv4Status, ip)
 	}
 	// For DeepEqual
-	if len(allocated) == 0 {
-		allocated = nil
+	if len(ipv4Status.Allocated) == 0 {
+		ipv4Status.Allocated = nil
+	}
+	if len(ipv4Status.Entries) == 0 {
+		ipv4Status.Entries = nil
+	}
+	if len(ipv4Status.Conflicts) == 0 {
+		ipv4Status.Conflicts = nil
 	}
-	ipv4Status.Allocated = allocated
 
 	ipPoolCpy.Status.IPv4 = ipv4Status
+	h.updateAddressMetrics(key, ipPool, ipv4Status)
+
+	if err := h.syncIPv6Status(ipPool, ipPoolCpy); err != nil {
+		return ipPool, err
+	}
+
+	h.syncServiceRoutes(ipPoolCpy)
 
 	if !reflect.DeepEqual(ipPoolCpy, ipPool) {
 		logrus.Infof("(ippool.OnChange) update ippool %s/%s", ipPool.Namespace, ipPool.Name)
-		ipPoolCpy.Status.LastUpdate = metav1.Now()
+		ipPoolCpy.Status.LastUpdate = metav1.NewTime(h.clock.Now())
 		return h.ippoolClient.UpdateStatus(ipPoolCpy)
 	}
 
@@ -255,6 +498,23 @@ func (h *Handler) OnRemove(key string, ipPool *networkv1.IPPool) (*networkv1.IPP
 
 	logrus.Debugf("(ippool.OnRemove) ippool configuration %s/%s has been removed", ipPool.Namespace, ipPool.Name)
 
+	if err := h.waitForWarmup(ipPool); err != nil {
+		return ipPool, err
+	}
+
+	if h.allocationTracker != nil {
+		h.allocationTracker.Forget(key)
+	}
+	if h.externalIPAM != nil {
+		h.externalIPAM.Forget(key)
+	}
+	if h.denialLog != nil {
+		h.denialLog.Forget(key)
+	}
+	h.metricsAllocator.DeleteIPPool(key)
+	h.metricsAllocator.DeleteIPPoolForecast(key)
+	h.metricsAllocator.DeleteIPPoolAllocations(key)
+
 	if h.noAgent {
 		return ipPool, nil
 	}
@@ -279,6 +539,20 @@ func (h *Handler) DeployAgent(ipPool *networkv1.IPPool, status networkv1.IPPoolS
 		return status, nil
 	}
 
+	// Delegated IPPools are served by the agent of the delegating one
+	if _, ok := util.DelegatingPool(ipPool); ok {
+		if _, err := h.getDelegatingPool(ipPool); err != nil {
+			return status, err
+		}
+		return status, nil
+	}
+
+	// The IPPools of the networks the controller is attached to are served
+	// by embedded agents, the others fall back to agent Pods
+	if nic, ok := h.embedded.NIC(ipPool); ok {
+		return h.deployEmbeddedAgent(ipPool, status, nic)
+	}
+
 	nadNamespace, nadName := kv.RSplit(ipPool.Spec.NetworkName, "/")
 	nad, err := h.nadCache.Get(nadNamespace, nadName)
 	if err != nil {
@@ -316,7 +590,19 @@ func (h *Handler) DeployAgent(ipPool *networkv1.IPPool, status networkv1.IPPoolS
 		}
 	}
 
-	agent, err := prepareAgentPod(ipPool, h.noDHCP, h.agentNamespace, clusterNetwork, h.agentServiceAccountName, h.agentImage)
+	// The MTU only goes into the network verification of the agent, which
+	// is no reason to leave the IPPool without one
+	mtu, err := util.GetMTUFromNAD(nad)
+	if err != nil {
+		logrus.Warnf("(ippool.DeployAgent) fall back to the default mtu for ippool %s/%s: %s", ipPool.Namespace, ipPool.Name, err.Error())
+		if h.recorder != nil {
+			h.recorder.Eventf(ipPool, corev1.EventTypeWarning, reasonInvalidNetworkConfig,
+				"Cannot tell the MTU of network %s, the agent doesn't verify it: %s", ipPool.Spec.NetworkName, err)
+		}
+		mtu = 0
+	}
+
+	agent, err := prepareAgentPod(ipPool, h.noDHCP, h.enableCacheDumpAPI, h.agentNamespace, clusterNetwork, mtu, h.agentServiceAccountName, h.agentImage)
 	if err != nil {
 		return status, err
 	}
@@ -356,62 +642,174 @@ func (h *Handler) BuildCache(ipPool *networkv1.IPPool, status networkv1.IPPoolSt
 		return status, fmt.Errorf("ippool %s/%s was administratively disabled", ipPool.Namespace, ipPool.Name)
 	}
 
-	if networkv1.CacheReady.IsTrue(ipPool) {
+	// The IPAM built from the same spec is reused. A status predating the
+	// hash is taken as matching, and OnChange records the hash shortly.
+	hash := util.AllocatorInputsHash(ipPool)
+	if networkv1.CacheReady.IsTrue(ipPool) &&
+		(status.AllocatorHash == "" || status.AllocatorHash == hash) &&
+		h.ipAllocator.IsNetworkInitialized(util.IPAMName(ipPool)) {
 		return status, nil
 	}
 
+	// A status predating the current schema may lack allocation records,
+	// which would leave their IP addresses free for the taking in the IPAM.
+	// OnChange writes the status at the current schema version shortly.
+	if !util.IsStatusCurrent(ipPool) {
+		return status, fmt.Errorf("status of ippool %s/%s predates schema version %d, not building ipam from it", ipPool.Namespace, ipPool.Name, networkv1.IPPoolStatusSchemaVersion)
+	}
+
+	if err := h.waitForWarmup(ipPool); err != nil {
+		return status, err
+	}
+
+	// The pinned allocations the status lacks are restored before the IPAM
+	// is built from it, so no other VM gets their IP addresses meanwhile
+	ipPoolCpy := ipPool.DeepCopy()
+	if err := h.restorePinnedAllocations(ipPoolCpy, &status); err != nil {
+		return status, err
+	}
+	ipPoolCpy.Status = status
+
+	if err := h.buildIPAM(ipPoolCpy); err != nil {
+		return status, err
+	}
+	status.AllocatorHash = hash
+
+	return status, nil
+}
+
+// buildIPAM initializes the IPAM and MAC caches of ipPool from its spec and
+// status, replacing whatever they held for it.
+func (h *Handler) buildIPAM(ipPool *networkv1.IPPool) error {
+	// The IPAM keeps track of every address in the range, so the ones too
+	// large are turned down before it is touched
+	if err := h.checkPoolSize(ipPool); err != nil {
+		return err
+	}
+
+	ipamName := util.IPAMName(ipPool)
+
+	start := h.clock.Now()
+	defer func() {
+		h.metricsAllocator.ObserveIPPoolAllocatorRebuild(ipPool.Namespace+"/"+ipPool.Name, h.clock.Since(start))
+	}()
+
 	logrus.Infof("(ippool.BuildCache) initialize ipam for ippool %s/%s", ipPool.Namespace, ipPool.Name)
 	if err := h.ipAllocator.NewIPSubnet(
-		ipPool.Spec.NetworkName,
+		ipamName,
 		ipPool.Spec.IPv4Config.CIDR,
 		ipPool.Spec.IPv4Config.Pool.Start,
-		ipPool.Spec.IPv4Config.Pool.End,
+		util.PoolEnd(ipPool),
+		ipPool.Spec.IPv4Config.Pool.AllowNetworkBroadcast,
 	); err != nil {
-		return status, err
+		return err
 	}
 
 	logrus.Infof("(ippool.BuildCache) initialize mac cache for ippool %s/%s", ipPool.Namespace, ipPool.Name)
-	if err := h.cacheAllocator.NewMACSet(ipPool.Spec.NetworkName); err != nil {
-		return status, err
+	if err := h.cacheAllocator.NewMACSet(ipamName); err != nil {
+		return err
+	}
+
+	// Keep the reserved IP addresses for their MAC addresses. The ones
+	// revoked below stay out of the IPAM nonetheless.
+	for _, reservation := range ipPool.Spec.IPv4Config.Reservations {
+		if err := h.ipAllocator.ReserveIP(ipamName, reservation.IPAddress); err != nil {
+			return err
+		}
+		logrus.Debugf("(ippool.BuildCache) ip %s was reserved for %s in ipam %s", reservation.IPAddress, reservation.MACAddress, ipamName)
+	}
+
+	// Keep the held-back IP addresses for when the rest of the range is
+	// exhausted
+	if holdBack := ipPool.Spec.IPv4Config.Pool.HoldBack; holdBack != nil {
+		if err := h.ipAllocator.HoldBack(ipamName, holdBack.Start, holdBack.End); err != nil {
+			return err
+		}
+		logrus.Debugf("(ippool.BuildCache) ips from %s to %s were held back in ipam %s", holdBack.Start, holdBack.End, ipamName)
 	}
 
 	// Revoke server IP address in IPAM
-	if err := h.ipAllocator.RevokeIP(ipPool.Spec.NetworkName, ipPool.Spec.IPv4Config.ServerIP); err != nil {
-		return status, err
+	if err := h.ipAllocator.RevokeIP(ipamName, ipPool.Spec.IPv4Config.ServerIP); err != nil {
+		return err
 	}
-	logrus.Debugf("(ippool.BuildCache) server ip %s was revoked in ipam %s", ipPool.Spec.IPv4Config.ServerIP, ipPool.Spec.NetworkName)
+	logrus.Debugf("(ippool.BuildCache) server ip %s was revoked in ipam %s", ipPool.Spec.IPv4Config.ServerIP, ipamName)
 
 	// Revoke router IP address in IPAM
-	if err := h.ipAllocator.RevokeIP(ipPool.Spec.NetworkName, ipPool.Spec.IPv4Config.Router); err != nil {
-		return status, err
+	if err := h.ipAllocator.RevokeIP(ipamName, ipPool.Spec.IPv4Config.Router); err != nil {
+		return err
 	}
-	logrus.Debugf("(ippool.BuildCache) router ip %s was revoked in ipam %s", ipPool.Spec.IPv4Config.Router, ipPool.Spec.NetworkName)
+	logrus.Debugf("(ippool.BuildCache) router ip %s was revoked in ipam %s", ipPool.Spec.IPv4Config.Router, ipamName)
 
 	// Revoke excluded IP addresses in IPAM
 	for _, eIP := range ipPool.Spec.IPv4Config.Pool.Exclude {
-		if err := h.ipAllocator.RevokeIP(ipPool.Spec.NetworkName, eIP); err != nil {
-			return status, err
+		if err := h.ipAllocator.RevokeIP(ipamName, eIP); err != nil {
+			return err
+		}
+		logrus.Infof("(ippool.BuildCache) excluded ip %s was revoked in ipam %s", eIP, ipamName)
+	}
+
+	// Revoke IP addresses of known external hosts and VIPs in IPAM
+	for ip := range h.externalIPs(ipPool) {
+		if err := h.ipAllocator.RevokeIP(ipamName, ip); err != nil {
+			return err
+		}
+		logrus.Infof("(ippool.BuildCache) ip %s of known external host or vip was revoked in ipam %s", ip, ipamName)
+	}
+
+	// Keep the IP addresses found in use by guests out of the IPAM until
+	// their quarantine is over
+	for _, ip := range quarantinedIPs(ipPool, h.clock.Now()) {
+		if err := h.ipAllocator.RevokeIP(ipamName, ip); err != nil {
+			return err
 		}
-		logrus.Infof("(ippool.BuildCache) excluded ip %s was revoked in ipam %s", eIP, ipPool.Spec.NetworkName)
+		logrus.Infof("(ippool.BuildCache) conflicted ip %s was revoked in ipam %s", ip, ipamName)
+	}
+
+	// Keep the test lease of a running DHCP check until it's done
+	if ip, _, ok := util.DHCPCheckLease(ipPool); ok {
+		if _, err := h.ipAllocator.AllocateIP(ipamName, ip); err != nil {
+			return err
+		}
+		logrus.Infof("(ippool.BuildCache) test lease %s of dhcp check was re-allocated in ipam %s", ip, ipamName)
 	}
 
 	// (Re)build caches from IPPool status
 	if ipPool.Status.IPv4 != nil {
-		for ip, mac := range ipPool.Status.IPv4.Allocated {
-			if mac == util.ExcludedMark || mac == util.ReservedMark {
-				continue
-			}
-			if _, err := h.ipAllocator.AllocateIP(ipPool.Spec.NetworkName, ip); err != nil {
-				return status, err
+		for ip, mac := range util.Leases(ipPool.Status.IPv4) {
+			if _, err := h.ipAllocator.AllocateIP(ipamName, ip); err != nil {
+				return err
 			}
-			if err := h.cacheAllocator.AddMAC(ipPool.Spec.NetworkName, mac, ip); err != nil {
-				return status, err
+			if err := h.cacheAllocator.AddMAC(ipamName, mac, ip); err != nil {
+				return err
 			}
-			logrus.Infof("(ippool.BuildCache) previously allocated ip %s was re-allocated in ipam %s", ip, ipPool.Spec.NetworkName)
+			logrus.Infof("(ippool.BuildCache) previously allocated ip %s was re-allocated in ipam %s", ip, ipamName)
 		}
 	}
 
-	logrus.Infof("(ippool.BuildCache) ipam and mac cache %s for ippool %s/%s has been updated", ipPool.Spec.NetworkName, ipPool.Namespace, ipPool.Name)
+	if err := h.buildIPv6IPAM(ipPool); err != nil {
+		return err
+	}
+
+	logrus.Infof("(ippool.BuildCache) ipam and mac cache %s for ippool %s/%s has been updated", ipamName, ipPool.Namespace, ipPool.Name)
+
+	return nil
+}
+
+// deployEmbeddedAgent starts the embedded agent of ipPool on nic. The agent
+// pod the IPPool had before the controller got attached to its network is
+// removed, so its leases aren't served twice.
+func (h *Handler) deployEmbeddedAgent(ipPool *networkv1.IPPool, status networkv1.IPPoolStatus, nic string) (networkv1.IPPoolStatus, error) {
+	if ipPool.Status.AgentPodRef != nil {
+		logrus.Infof("(ippool.deployEmbeddedAgent) remove agent pod %s/%s superseded by embedded agent of ippool %s/%s", ipPool.Status.AgentPodRef.Namespace, ipPool.Status.AgentPodRef.Name, ipPool.Namespace, ipPool.Name)
+		if err := h.podClient.Delete(ipPool.Status.AgentPodRef.Namespace, ipPool.Status.AgentPodRef.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return status, err
+		}
+		status.AgentPodRef = nil
+	}
+
+	if err := h.embedded.Start(ipPool, nic); err != nil {
+		return status, err
+	}
 
 	return status, nil
 }
@@ -431,11 +829,34 @@ func (h *Handler) MonitorAgent(ipPool *networkv1.IPPool, status networkv1.IPPool
 		return status, nil
 	}
 
+	if _, ok := util.DelegatingPool(ipPool); ok {
+		parent, err := h.getDelegatingPool(ipPool)
+		if err != nil {
+			return status, err
+		}
+		if !networkv1.AgentReady.IsTrue(parent) {
+			return status, h.waitForAgent(ipPool, fmt.Errorf("agent for delegating ippool %s/%s is not ready", parent.Namespace, parent.Name))
+		}
+		return status, nil
+	}
+
+	if _, ok := h.embedded.NIC(ipPool); ok {
+		if !h.embedded.IsRunning(ipPool.Namespace + "/" + ipPool.Name) {
+			return status, h.waitForAgent(ipPool, fmt.Errorf("embedded agent for ippool %s/%s is not running", ipPool.Namespace, ipPool.Name))
+		}
+		return status, nil
+	}
+
+	// The agent pod watcher enqueues the IPPool on the transitions of its
+	// agent, so waiting for it isn't retried with backoff
 	if ipPool.Status.AgentPodRef == nil {
-		return status, fmt.Errorf("agent for ippool %s/%s is not deployed", ipPool.Namespace, ipPool.Name)
+		return status, h.waitForAgent(ipPool, fmt.Errorf("agent for ippool %s/%s is not deployed", ipPool.Namespace, ipPool.Name))
 	}
 
 	agentPod, err := h.podCache.Get(ipPool.Status.AgentPodRef.Namespace, ipPool.Status.AgentPodRef.Name)
+	if apierrors.IsNotFound(err) {
+		return status, h.waitForAgent(ipPool, err)
+	}
 	if err != nil {
 		return status, err
 	}
@@ -445,20 +866,124 @@ func (h *Handler) MonitorAgent(ipPool *networkv1.IPPool, status networkv1.IPPool
 			return status, fmt.Errorf("agent pod %s marked for deletion", agentPod.Name)
 		}
 
+		// The agent pod reference of a status predating the current schema
+		// may lack fields, e.g., the image, which isn't a mismatch
+		if !util.IsStatusCurrent(ipPool) {
+			return status, h.waitForAgent(ipPool, fmt.Errorf("status of ippool %s/%s predates schema version %d, not purging agent pod %s", ipPool.Namespace, ipPool.Name, networkv1.IPPoolStatusSchemaVersion, agentPod.Name))
+		}
+
 		if err := h.podClient.Delete(agentPod.Namespace, agentPod.Name, &metav1.DeleteOptions{}); err != nil {
 			return status, err
 		}
 
-		return status, fmt.Errorf("agent pod %s obsolete and purged", agentPod.Name)
+		return status, h.waitForAgent(ipPool, fmt.Errorf("agent pod %s obsolete and purged", agentPod.Name))
 	}
 
 	if !isPodReady(agentPod) {
-		return status, fmt.Errorf("agent pod %s not ready", agentPod.Name)
+		return status, h.waitForAgent(ipPool, fmt.Errorf("agent pod %s not ready", agentPod.Name))
+	}
+
+	result, err := netcheck.ParseResult(agentPod.Annotations)
+	if err != nil {
+		return status, err
+	}
+	if result != nil && len(result.Mismatches) > 0 {
+		return status, h.waitForAgent(ipPool, fmt.Errorf("agent pod %s reports network mismatch", agentPod.Name))
 	}
 
 	return status, nil
 }
 
+// VerifyNetwork reconciles ipPool and surfaces the network verification result
+// reported by the agent pod. The returned status reports whether the agent's
+// attachment doesn't match what the ipPool expects.
+func (h *Handler) VerifyNetwork(ipPool *networkv1.IPPool, status networkv1.IPPoolStatus) (networkv1.IPPoolStatus, error) {
+	logrus.Debugf("(ippool.VerifyNetwork) verify network for ippool %s/%s", ipPool.Namespace, ipPool.Name)
+
+	if h.noAgent || ipPool.Status.AgentPodRef == nil {
+		return status, nil
+	}
+
+	if ipPool.Spec.SkipNetworkVerification != nil && *ipPool.Spec.SkipNetworkVerification {
+		networkv1.NetworkMismatch.False(&status)
+		networkv1.NetworkMismatch.Reason(&status, "VerificationSkipped")
+		networkv1.NetworkMismatch.Message(&status, "")
+		return status, nil
+	}
+
+	agentPod, err := h.podCache.Get(ipPool.Status.AgentPodRef.Namespace, ipPool.Status.AgentPodRef.Name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return status, nil
+		}
+		return status, err
+	}
+
+	if agentPod.GetUID() != ipPool.Status.AgentPodRef.UID {
+		return status, nil
+	}
+
+	result, err := netcheck.ParseResult(agentPod.Annotations)
+	if err != nil {
+		return status, err
+	}
+
+	if result == nil {
+		networkv1.NetworkMismatch.Unknown(&status)
+		networkv1.NetworkMismatch.Reason(&status, "VerificationPending")
+		networkv1.NetworkMismatch.Message(&status, "")
+		return status, nil
+	}
+
+	if len(result.Mismatches) > 0 {
+		networkv1.NetworkMismatch.True(&status)
+		networkv1.NetworkMismatch.Reason(&status, "MismatchDetected")
+		networkv1.NetworkMismatch.Message(&status, strings.Join(result.Mismatches, "; "))
+		return status, nil
+	}
+
+	networkv1.NetworkMismatch.False(&status)
+	networkv1.NetworkMismatch.Reason(&status, "")
+	networkv1.NetworkMismatch.Message(&status, "")
+
+	return status, nil
+}
+
+// GuardPoolSize marks the IPPool as degraded if it has more allocatable
+// addresses than allowed. Its cache is never built in that case, so it cannot
+// hand out any address until the range is narrowed or the limit raised.
+func (h *Handler) GuardPoolSize(ipPool *networkv1.IPPool, status networkv1.IPPoolStatus) (networkv1.IPPoolStatus, error) {
+	if err := h.checkPoolSize(ipPool); err != nil {
+		networkv1.Degraded.True(&status)
+		networkv1.Degraded.Reason(&status, reasonPoolTooLarge)
+		networkv1.Degraded.Message(&status, err.Error())
+		return status, nil
+	}
+
+	if networkv1.Degraded.GetReason(&status) == reasonPoolTooLarge {
+		networkv1.Degraded.False(&status)
+		networkv1.Degraded.Reason(&status, "")
+		networkv1.Degraded.Message(&status, "")
+	}
+
+	return status, nil
+}
+
+// checkPoolSize makes sure the IPPool has no more allocatable addresses than
+// allowed. The IPPools which cannot be parsed are left to the IPAM to report.
+func (h *Handler) checkPoolSize(ipPool *networkv1.IPPool) error {
+	poolInfo, err := util.LoadPool(ipPool)
+	if err != nil {
+		return nil
+	}
+
+	if err := util.CheckPoolSize(poolInfo, ipPool.Spec.IPv4Config.Pool.Exclude, h.maxPoolSize); err != nil {
+		return fmt.Errorf("ippool %s/%s: %w", ipPool.Namespace, ipPool.Name, err)
+	}
+
+	return nil
+}
+
 func isPodReady(pod *corev1.Pod) bool {
 	for _, c := range pod.Status.Conditions {
 		if c.Type == corev1.PodReady {
@@ -477,27 +1002,194 @@ func (h *Handler) getAgentImage(ipPool *networkv1.IPPool) string {
 }
 
 func (h *Handler) cleanup(ipPool *networkv1.IPPool) error {
-	if ipPool.Status.AgentPodRef == nil {
+	h.embedded.Stop(ipPool.Namespace + "/" + ipPool.Name)
+
+	// Delegated IPPools have no agent of their own to remove
+	if _, ok := util.DelegatingPool(ipPool); !ok {
+		if ipPool.Status.AgentPodRef == nil {
+			return nil
+		}
+
+		logrus.Infof("(ippool.cleanup) remove the backing agent %s/%s for ippool %s/%s", ipPool.Status.AgentPodRef.Namespace, ipPool.Status.AgentPodRef.Name, ipPool.Namespace, ipPool.Name)
+		if err := h.podClient.Delete(ipPool.Status.AgentPodRef.Namespace, ipPool.Status.AgentPodRef.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if isDHCPCheckRunning(ipPool) {
+		logrus.Infof("(ippool.cleanup) remove the checker pod %s/%s for ippool %s/%s", h.agentNamespace, ipPool.Status.LastCheck.PodName, ipPool.Namespace, ipPool.Name)
+		if err := h.podClient.Delete(h.agentNamespace, ipPool.Status.LastCheck.PodName, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	h.ipAllocator.DeleteIPSubnet(util.IPAMName(ipPool))
+	h.cacheAllocator.DeleteMACSet(util.IPAMName(ipPool))
+	h.ipAllocator.DeleteIPSubnet(util.IPv6IPAMName(ipPool))
+	h.cacheAllocator.DeleteMACSet(util.IPv6IPAMName(ipPool))
+
+	return nil
+}
+
+// updateAddressMetrics publishes the size of the pool range of the IPPool,
+// and the amount of its addresses of each kind. The reserved ones are the
+// server and router addresses within the range, and the addresses reserved
+// for MAC addresses which aren't leased yet.
+func (h *Handler) updateAddressMetrics(key string, ipPool *networkv1.IPPool, ipv4Status *networkv1.IPv4Status) {
+	addresses := map[string]int{
+		metrics.AddressKindAllocated: 0,
+		metrics.AddressKindExcluded:  0,
+		metrics.AddressKindReserved:  0,
+	}
+	if pi, err := util.LoadPool(ipPool); err == nil {
+		addresses[metrics.AddressKindTotal] = int(pi.Size(nil))
+	}
+	entries := util.AllocationEntries(ipv4Status)
+	for _, entry := range entries {
+		switch entry.Type {
+		case networkv1.AllocationTypeLease:
+			addresses[metrics.AddressKindAllocated]++
+		case networkv1.AllocationTypeExcluded:
+			addresses[metrics.AddressKindExcluded]++
+		case networkv1.AllocationTypeReserved:
+			addresses[metrics.AddressKindReserved]++
+		}
+	}
+	for _, reservation := range ipPool.Spec.IPv4Config.Reservations {
+		if _, ok := entries[reservation.IPAddress]; ok {
+			continue
+		}
+		if util.IsIPInBetweenOf(reservation.IPAddress, ipPool.Spec.IPv4Config.Pool.Start, util.PoolEnd(ipPool)) {
+			addresses[metrics.AddressKindReserved]++
+		}
+	}
+	h.metricsAllocator.UpdateIPPoolAddresses(key, addresses)
+}
+
+// syncKnownExternalHosts revokes the IP addresses of the known external hosts
+// and the load balancer VIPs in the IPAM, and restores the ones of the hosts
+// no longer listed and the VIPs gone. It's a no-op until the IPAM is
+// initialized, as BuildCache takes care of it then.
+func (h *Handler) syncKnownExternalHosts(ipPool *networkv1.IPPool) error {
+	ipamName := util.IPAMName(ipPool)
+	if !h.ipAllocator.IsNetworkInitialized(ipamName) {
 		return nil
 	}
 
-	logrus.Infof("(ippool.cleanup) remove the backing agent %s/%s for ippool %s/%s", ipPool.Status.AgentPodRef.Namespace, ipPool.Status.AgentPodRef.Name, ipPool.Namespace, ipPool.Name)
-	if err := h.podClient.Delete(ipPool.Status.AgentPodRef.Namespace, ipPool.Status.AgentPodRef.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
-		return err
+	externalIPs := h.externalIPs(ipPool)
+	for ip := range externalIPs {
+		if allocated, err := h.ipAllocator.IsAllocated(ipamName, ip); err != nil || allocated {
+			// Already revoked, or leased in the meantime
+			continue
+		}
+		if err := h.ipAllocator.RevokeIP(ipamName, ip); err != nil {
+			return err
+		}
+		logrus.Infof("(ippool.syncKnownExternalHosts) ip %s of known external host or vip was revoked in ipam %s", ip, ipamName)
 	}
 
-	h.ipAllocator.DeleteIPSubnet(ipPool.Spec.NetworkName)
-	h.cacheAllocator.DeleteMACSet(ipPool.Spec.NetworkName)
-	h.metricsAllocator.DeleteIPPool(
-		ipPool.Spec.NetworkName,
-		ipPool.Spec.IPv4Config.CIDR,
-		ipPool.Spec.NetworkName,
-	)
+	for _, ip := range staleExclusions(ipPool, ipPool.Status.IPv4, externalIPs) {
+		if err := h.ipAllocator.RestoreIP(ipamName, ip); err != nil {
+			return err
+		}
+		logrus.Infof("(ippool.syncKnownExternalHosts) ip %s of former known external host or vip was restored in ipam %s", ip, ipamName)
+	}
 
 	return nil
 }
 
+// knownExternalIPs returns the IP addresses of the known external hosts that
+// are within the pool range. The ones leased to VMs are left out, so listing
+// a host never disturbs an existing lease.
+func knownExternalIPs(ipPool *networkv1.IPPool) map[string]struct{} {
+	if len(ipPool.Spec.KnownExternalHosts) == 0 {
+		return nil
+	}
+
+	leases := util.Leases(ipPool.Status.IPv4)
+	ips := make(map[string]struct{}, len(ipPool.Spec.KnownExternalHosts))
+	for _, host := range ipPool.Spec.KnownExternalHosts {
+		if !util.IsIPInBetweenOf(host.IP, ipPool.Spec.IPv4Config.Pool.Start, util.PoolEnd(ipPool)) {
+			continue
+		}
+		if mac, ok := leases[host.IP]; ok {
+			logrus.Warningf("(ippool.knownExternalIPs) ip %s of known external host is leased to %s, skip", host.IP, mac)
+			continue
+		}
+		ips[host.IP] = struct{}{}
+	}
+
+	return ips
+}
+
+// staleExclusions returns the excluded IP addresses of ipv4Status which are
+// neither excluded in the spec nor belong to a known external host, i.e., the
+// ones left behind by hosts removed from the list.
+func staleExclusions(ipPool *networkv1.IPPool, ipv4Status *networkv1.IPv4Status, externalIPs map[string]struct{}) []string {
+	excluded := make(map[string]struct{}, len(ipPool.Spec.IPv4Config.Pool.Exclude))
+	for _, eIP := range ipPool.Spec.IPv4Config.Pool.Exclude {
+		excluded[eIP] = struct{}{}
+	}
+
+	var stale []string
+	for ip, entry := range util.AllocationEntries(ipv4Status) {
+		if entry.Type != networkv1.AllocationTypeExcluded {
+			continue
+		}
+		if _, ok := excluded[ip]; ok {
+			continue
+		}
+		if _, ok := externalIPs[ip]; ok {
+			continue
+		}
+		stale = append(stale, ip)
+	}
+
+	return stale
+}
+
+// syncServiceRoutes records the routes toward the Kubernetes service and
+// cluster CIDRs in ipPool's status if the IPPool asks to advertise them. A
+// failed resolution of the CIDRs is reported with the ServiceRoutesReady
+// condition instead of an error, so the rest of the IPPool keeps being served,
+// and clears the routes recorded before, which may be stale.
+func (h *Handler) syncServiceRoutes(ipPool *networkv1.IPPool) {
+	if ipPool.Spec.AdvertiseServiceRoutes == nil || !*ipPool.Spec.AdvertiseServiceRoutes {
+		ipPool.Status.ServiceRoutes = nil
+		return
+	}
+
+	serviceCIDR, clusterCIDR, err := h.clusterInfo.CIDRs()
+	if err != nil {
+		logrus.Warningf("(ippool.syncServiceRoutes) cannot resolve cluster cidrs for ippool %s/%s: %v", ipPool.Namespace, ipPool.Name, err)
+		ipPool.Status.ServiceRoutes = nil
+		networkv1.ServiceRoutesReady.False(ipPool)
+		networkv1.ServiceRoutesReady.Reason(ipPool, "CIDRsNotResolved")
+		networkv1.ServiceRoutesReady.Message(ipPool, err.Error())
+		return
+	}
+
+	ipPool.Status.ServiceRoutes = []networkv1.Route{
+		{
+			Destination: serviceCIDR,
+			Gateway:     ipPool.Spec.ServiceGateway,
+		},
+		{
+			Destination: clusterCIDR,
+			Gateway:     ipPool.Spec.ServiceGateway,
+		},
+	}
+	networkv1.ServiceRoutesReady.True(ipPool)
+	networkv1.ServiceRoutesReady.Reason(ipPool, "")
+	networkv1.ServiceRoutesReady.Message(ipPool, "")
+}
+
 func (h *Handler) ensureNADLabels(ipPool *networkv1.IPPool) error {
+	// The NetworkAttachmentDefinition keeps pointing to the delegating IPPool
+	if _, ok := util.DelegatingPool(ipPool); ok {
+		return nil
+	}
+
 	nadNamespace, nadName := kv.RSplit(ipPool.Spec.NetworkName, "/")
 	nad, err := h.nadCache.Get(nadNamespace, nadName)
 	if err != nil {
@@ -520,3 +1212,20 @@ func (h *Handler) ensureNADLabels(ipPool *networkv1.IPPool) error {
 
 	return nil
 }
+
+// getDelegatingPool returns the IPPool delegating to ipPool, provided the
+// delegation is declared on both sides.
+func (h *Handler) getDelegatingPool(ipPool *networkv1.IPPool) (*networkv1.IPPool, error) {
+	key, _ := util.DelegatingPool(ipPool)
+	parentNamespace, parentName := kv.RSplit(key, "/")
+	parent, err := h.ippoolCache.Get(parentNamespace, parentName)
+	if err != nil {
+		return nil, fmt.Errorf("delegating ippool %s of ippool %s/%s: %w", key, ipPool.Namespace, ipPool.Name, err)
+	}
+
+	if !util.IsDelegated(parent, ipPool) {
+		return nil, fmt.Errorf("ippool %s does not delegate to ippool %s/%s", key, ipPool.Namespace, ipPool.Name)
+	}
+
+	return parent, nil
+}
@@ -1,20 +1,45 @@
 package ippool
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	"github.com/rancher/wrangler/v3/pkg/relatedresource"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	kubevirtv1 "kubevirt.io/api/core/v1"
 
+	"github.com/harvester/vm-dhcp-controller/pkg/agent"
+	"github.com/harvester/vm-dhcp-controller/pkg/agent/dhcpcheck"
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
 	"github.com/harvester/vm-dhcp-controller/pkg/cache"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+	"github.com/harvester/vm-dhcp-controller/pkg/clusterinfo"
 	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/dhcp"
+	"github.com/harvester/vm-dhcp-controller/pkg/externalipam"
+	"github.com/harvester/vm-dhcp-controller/pkg/forecast"
 	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
 	"github.com/harvester/vm-dhcp-controller/pkg/ipam"
 	"github.com/harvester/vm-dhcp-controller/pkg/metrics"
+	"github.com/harvester/vm-dhcp-controller/pkg/reconcile"
 	"github.com/harvester/vm-dhcp-controller/pkg/util"
 	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
 )
@@ -47,6 +72,10 @@ const (
 	testImage              = testImageRepository + ":" + testImageTag
 	testImageNew           = testImageRepository + ":" + testImageTagNew
 	testContainerName      = "agent"
+	testServiceGateway     = "192.168.0.253"
+	testServiceCIDR        = "10.53.0.0/16"
+	testClusterCIDR        = "10.52.0.0/16"
+	testNodeName           = "node-0"
 
 	testExcludedIP1 = "192.168.0.150"
 	testExcludedIP2 = "192.168.0.187"
@@ -87,6 +116,12 @@ func newTestNetworkAttachmentDefinitionBuilder() *NetworkAttachmentDefinitionBui
 	return NewNetworkAttachmentDefinitionBuilder(testNADNamespace, testNADName)
 }
 
+func newTestNodeBuilder() *nodeBuilder {
+	return newNodeBuilder(testNodeName).
+		Label(util.ManagementNodeLabelKey, "true").
+		NodeArgs(util.ClusterCIDRFlag, testClusterCIDR, util.ServiceCIDRFlag, testServiceCIDR)
+}
+
 func TestHandler_OnChange(t *testing.T) {
 	t.Run("new ippool", func(t *testing.T) {
 		key := testIPPoolNamespace + "/" + testIPPoolName
@@ -96,6 +131,7 @@ func TestHandler_OnChange(t *testing.T) {
 		givenNAD := newTestNetworkAttachmentDefinitionBuilder().Build()
 
 		expectedIPPool := newTestIPPoolBuilder().
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
 			NetworkName(testNetworkName).
 			StoppedCondition(corev1.ConditionFalse, "", "").
 			CacheReadyCondition(corev1.ConditionFalse, "NotInitialized", "").Build()
@@ -157,6 +193,8 @@ func TestHandler_OnChange(t *testing.T) {
 		givenNAD := newTestNetworkAttachmentDefinitionBuilder().Build()
 
 		expectedIPPool := newTestIPPoolBuilder().
+			AllocatorHash(util.AllocatorInputsHash(givenIPPool)).
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
 			ServerIP(testServerIP1).
 			CIDR(testCIDR).
 			PoolRange(testStartIP, testEndIP).
@@ -189,6 +227,146 @@ func TestHandler_OnChange(t *testing.T) {
 			},
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			nadClient:        fakeclient.NetworkAttachmentDefinitionClient(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}
+
+		ipPool, err := handler.OnChange(key, givenIPPool)
+		assert.Nil(t, err)
+
+		SanitizeStatus(&expectedIPPool.Status)
+		SanitizeStatus(&ipPool.Status)
+
+		assert.Equal(t, expectedIPPool, ipPool)
+	})
+
+	t.Run("ippool with legacy allocation records migrated to typed entries", func(t *testing.T) {
+		key := testIPPoolNamespace + "/" + testIPPoolName
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Build()
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			Exclude(testExcludedIP1).
+			NetworkName(testNetworkName).
+			Allocated(testAllocatedIP1, testMAC1).
+			Allocated(testExcludedIP1, util.ExcludedMark).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().Build()
+
+		expectedIPPool := newTestIPPoolBuilder().
+			AllocatorHash(util.AllocatorInputsHash(givenIPPool)).
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			Exclude(testExcludedIP1).
+			NetworkName(testNetworkName).
+			AllocationEntry(testAllocatedIP1, networkv1.AllocationTypeLease, testMAC1).
+			AllocationEntry(testExcludedIP1, networkv1.AllocationTypeExcluded, "").
+			Available(100).
+			Used(0).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").
+			StoppedCondition(corev1.ConditionFalse, "", "").Build()
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		err = clientset.Tracker().Add(givenIPPool)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handler := Handler{
+			typedAllocationEntries: true,
+			ipAllocator:            givenIPAllocator,
+			metricsAllocator:       metrics.New(),
+			clock:                  clock.RealClock{},
+			ippoolClient:           fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			nadClient:              fakeclient.NetworkAttachmentDefinitionClient(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			nadCache:               fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}
+
+		ipPool, err := handler.OnChange(key, givenIPPool)
+		assert.Nil(t, err)
+
+		for ip, entry := range ipPool.Status.IPv4.Entries {
+			assert.NotNil(t, entry.Since, ip)
+		}
+
+		SanitizeStatus(&expectedIPPool.Status)
+		SanitizeStatus(&ipPool.Status)
+
+		assert.Equal(t, expectedIPPool, ipPool)
+	})
+
+	t.Run("ippool with known external hosts changed", func(t *testing.T) {
+		key := testIPPoolNamespace + "/" + testIPPoolName
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Revoke(testNetworkName, testExcludedIP2).
+			Allocate(testNetworkName, testAllocatedIP1).
+			Build()
+		// testExcludedIP2 belonged to a host removed from the list, while
+		// testAllocatedIP1 is listed although it's leased to a VM
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			KnownExternalHost(testExcludedIP1, "", "printer").
+			KnownExternalHost(testAllocatedIP1, "", "").
+			Allocated(testAllocatedIP1, testMAC1).
+			Allocated(testExcludedIP2, util.ExcludedMark).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().Build()
+
+		expectedIPPool := newTestIPPoolBuilder().
+			AllocatorHash(util.AllocatorInputsHash(givenIPPool)).
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			KnownExternalHost(testExcludedIP1, "", "printer").
+			KnownExternalHost(testAllocatedIP1, "", "").
+			Allocated(testAllocatedIP1, testMAC1).
+			Allocated(testExcludedIP1, util.ExcludedMark).
+			Available(98).
+			Used(1).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").
+			StoppedCondition(corev1.ConditionFalse, "", "").Build()
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		err = clientset.Tracker().Add(givenIPPool)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handler := Handler{
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			nadClient:        fakeclient.NetworkAttachmentDefinitionClient(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
 			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
@@ -201,6 +379,15 @@ func TestHandler_OnChange(t *testing.T) {
 		SanitizeStatus(&ipPool.Status)
 
 		assert.Equal(t, expectedIPPool, ipPool)
+
+		_, err = givenIPAllocator.IsAllocated(testNetworkName, testExcludedIP1)
+		assert.NotNil(t, err, "known external host should be revoked")
+		allocated, err := givenIPAllocator.IsAllocated(testNetworkName, testExcludedIP2)
+		assert.Nil(t, err, "former known external host should be restored")
+		assert.False(t, allocated)
+		allocated, err = givenIPAllocator.IsAllocated(testNetworkName, testAllocatedIP1)
+		assert.Nil(t, err)
+		assert.True(t, allocated, "vm lease should be left untouched")
 	})
 
 	t.Run("pause ippool", func(t *testing.T) {
@@ -216,6 +403,7 @@ func TestHandler_OnChange(t *testing.T) {
 
 		expectedIPAllocator := newTestIPAllocatorBuilder().Build()
 		expectedIPPool := newTestIPPoolBuilder().
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
 			NetworkName(testNetworkName).
 			Paused().
 			StoppedCondition(corev1.ConditionTrue, "", "").Build()
@@ -248,6 +436,7 @@ func TestHandler_OnChange(t *testing.T) {
 			ipAllocator:      givenIPAllocator,
 			cacheAllocator:   cache.New(),
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			podClient:        fakeclient.PodClient(k8sclientset.CoreV1().Pods),
 			nadClient:        fakeclient.NetworkAttachmentDefinitionClient(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
@@ -280,6 +469,8 @@ func TestHandler_OnChange(t *testing.T) {
 		givenNAD := newTestNetworkAttachmentDefinitionBuilder().Build()
 
 		expectedIPPool := newTestIPPoolBuilder().
+			AllocatorHash(util.AllocatorInputsHash(givenIPPool)).
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
 			NetworkName(testNetworkName).
 			UnPaused().
 			Available(100).
@@ -310,6 +501,7 @@ func TestHandler_OnChange(t *testing.T) {
 			},
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			nadClient:        fakeclient.NetworkAttachmentDefinitionClient(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
 			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
@@ -323,33 +515,37 @@ func TestHandler_OnChange(t *testing.T) {
 
 		assert.Equal(t, expectedIPPool, ipPool)
 	})
-}
 
-func TestHandler_DeployAgent(t *testing.T) {
-	t.Run("ippool created", func(t *testing.T) {
+	t.Run("ippool advertising service routes", func(t *testing.T) {
+		key := testIPPoolNamespace + "/" + testIPPoolName
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Build()
 		givenIPPool := newTestIPPoolBuilder().
 			ServerIP(testServerIP1).
 			CIDR(testCIDR).
-			NetworkName(testNetworkName).Build()
-		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
-			Label(clusterNetworkLabelKey, testClusterNetwork).Build()
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			AdvertiseServiceRoutes(testServiceGateway).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().Build()
+		givenNode := newTestNodeBuilder().Build()
 
-		expectedStatus := newTestIPPoolStatusBuilder().
-			AgentPodRef(testPodNamespace, testPodName, testImage, "").Build()
-		expectedPod, _ := prepareAgentPod(
-			NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
-				ServerIP(testServerIP1).
-				CIDR(testCIDR).
-				NetworkName(testNetworkName).Build(),
-			false,
-			testPodNamespace,
-			testClusterNetwork,
-			testServiceAccountName,
-			&config.Image{
-				Repository: testImageRepository,
-				Tag:        testImageTag,
-			},
-		)
+		expectedIPPool := newTestIPPoolBuilder().
+			AllocatorHash(util.AllocatorInputsHash(givenIPPool)).
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			AdvertiseServiceRoutes(testServiceGateway).
+			Available(100).
+			Used(0).
+			ServiceRoute(testServiceCIDR, testServiceGateway).
+			ServiceRoute(testClusterCIDR, testServiceGateway).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").
+			StoppedCondition(corev1.ConditionFalse, "", "").
+			ServiceRoutesReadyCondition(corev1.ConditionTrue, "", "").Build()
 
 		nadGVR := schema.GroupVersionResource{
 			Group:    "k8s.cni.cncf.io",
@@ -361,51 +557,64 @@ func TestHandler_DeployAgent(t *testing.T) {
 		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
 		assert.Nil(t, err, "mock resource should add into fake controller tracker")
 
+		err = clientset.Tracker().Add(givenIPPool)
+		if err != nil {
+			t.Fatal(err)
+		}
+
 		k8sclientset := k8sfake.NewSimpleClientset()
+		err = k8sclientset.Tracker().Add(givenNode)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
 
 		handler := Handler{
-			agentNamespace: testPodNamespace,
-			agentImage: &config.Image{
-				Repository: testImageRepository,
-				Tag:        testImageTag,
-			},
-			agentServiceAccountName: testServiceAccountName,
-			nadCache:                fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
-			podClient:               fakeclient.PodClient(k8sclientset.CoreV1().Pods),
-			podCache:                fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			clusterInfo:      clusterinfo.NewNodeResolver(fakeclient.NodeCache(k8sclientset.CoreV1().Nodes)),
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			nadClient:        fakeclient.NetworkAttachmentDefinitionClient(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
 		}
 
-		status, err := handler.DeployAgent(givenIPPool, givenIPPool.Status)
-		assert.Nil(t, err)
-		assert.Equal(t, expectedStatus, status)
-
-		pod, err := handler.podClient.Get(testPodNamespace, testPodName, metav1.GetOptions{})
+		ipPool, err := handler.OnChange(key, givenIPPool)
 		assert.Nil(t, err)
-		assert.Equal(t, expectedPod, pod)
-	})
-
-	t.Run("ippool paused", func(t *testing.T) {
-		givenIPPool := newTestIPPoolBuilder().
-			Paused().Build()
 
-		handler := Handler{
-			agentNamespace: testPodNamespace,
-			agentImage: &config.Image{
-				Repository: testImageRepository,
-				Tag:        testImageTag,
-			},
-			agentServiceAccountName: testServiceAccountName,
-		}
+		SanitizeStatus(&expectedIPPool.Status)
+		SanitizeStatus(&ipPool.Status)
 
-		_, err := handler.DeployAgent(givenIPPool, givenIPPool.Status)
-		assert.Equal(t, fmt.Errorf("ippool %s was administratively disabled", testIPPoolNamespace+"/"+testIPPoolName), err)
+		assert.Equal(t, expectedIPPool, ipPool)
 	})
 
-	t.Run("nad not found", func(t *testing.T) {
+	t.Run("ippool advertising service routes with unresolvable cluster cidrs", func(t *testing.T) {
+		key := testIPPoolNamespace + "/" + testIPPoolName
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Build()
 		givenIPPool := newTestIPPoolBuilder().
-			NetworkName("you-cant-find-me").Build()
-		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
-			Label(clusterNetworkLabelKey, testClusterNetwork).Build()
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			AdvertiseServiceRoutes(testServiceGateway).
+			ServiceRoute(testServiceCIDR, testServiceGateway).
+			ServiceRoute(testClusterCIDR, testServiceGateway).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().Build()
+
+		// The routes resolved before are cleared, as they may be stale
+		expectedIPPool := newTestIPPoolBuilder().
+			AllocatorHash(util.AllocatorInputsHash(givenIPPool)).
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			AdvertiseServiceRoutes(testServiceGateway).
+			Available(100).
+			Used(0).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").
+			StoppedCondition(corev1.ConditionFalse, "", "").
+			ServiceRoutesReadyCondition(corev1.ConditionFalse, "CIDRsNotResolved", "no management node found").Build()
 
 		nadGVR := schema.GroupVersionResource{
 			Group:    "k8s.cni.cncf.io",
@@ -417,30 +626,326 @@ func TestHandler_DeployAgent(t *testing.T) {
 		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
 		assert.Nil(t, err, "mock resource should add into fake controller tracker")
 
+		err = clientset.Tracker().Add(givenIPPool)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		k8sclientset := k8sfake.NewSimpleClientset()
+
 		handler := Handler{
-			nadCache: fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			clusterInfo:      clusterinfo.NewNodeResolver(fakeclient.NodeCache(k8sclientset.CoreV1().Nodes)),
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			nadClient:        fakeclient.NetworkAttachmentDefinitionClient(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
 		}
 
-		_, err = handler.DeployAgent(givenIPPool, givenIPPool.Status)
-		assert.Equal(t, fmt.Sprintf("network-attachment-definitions.k8s.cni.cncf.io \"%s\" not found", "you-cant-find-me"), err.Error())
+		ipPool, err := handler.OnChange(key, givenIPPool)
+		assert.Nil(t, err)
+
+		SanitizeStatus(&expectedIPPool.Status)
+		SanitizeStatus(&ipPool.Status)
+
+		assert.Equal(t, expectedIPPool, ipPool)
 	})
 
-	t.Run("agent pod already exists", func(t *testing.T) {
+	t.Run("ippool with ipam inputs changed", func(t *testing.T) {
+		key := testIPPoolNamespace + "/" + testIPPoolName
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Build()
 		givenIPPool := newTestIPPoolBuilder().
 			ServerIP(testServerIP1).
 			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
 			NetworkName(testNetworkName).
-			AgentPodRef(testPodNamespace, testPodName, testImage, "").Build()
-		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
-			Label(clusterNetworkLabelKey, testClusterNetwork).Build()
-		givenPod, _ := prepareAgentPod(
-			NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
-				ServerIP(testServerIP1).
-				CIDR(testCIDR).
-				NetworkName(testNetworkName).Build(),
-			false,
-			testPodNamespace,
+			AllocatorHash("stale").
+			CacheReadyCondition(corev1.ConditionTrue, "", "").
+			Exclude(testExcludedIP1).Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().Build()
+
+		expectedIPPool := newTestIPPoolBuilder().
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			AllocatorHash("stale").
+			CacheReadyCondition(corev1.ConditionFalse, "InputsChanged", "").
+			StoppedCondition(corev1.ConditionFalse, "", "").
+			Exclude(testExcludedIP1).Build()
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		err = clientset.Tracker().Add(givenIPPool)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handler := Handler{
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			nadClient:        fakeclient.NetworkAttachmentDefinitionClient(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}
+
+		ipPool, err := handler.OnChange(key, givenIPPool)
+		assert.Nil(t, err)
+
+		SanitizeStatus(&expectedIPPool.Status)
+		SanitizeStatus(&ipPool.Status)
+
+		assert.Equal(t, expectedIPPool, ipPool)
+	})
+}
+
+func TestHandler_DeployAgent(t *testing.T) {
+	t.Run("ippool created", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			NetworkName(testNetworkName).Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(clusterNetworkLabelKey, testClusterNetwork).Build()
+
+		expectedStatus := newTestIPPoolStatusBuilder().
+			AgentPodRef(testPodNamespace, testPodName, testImage, "").Build()
+		expectedPod, _ := prepareAgentPod(
+			NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+				ServerIP(testServerIP1).
+				CIDR(testCIDR).
+				NetworkName(testNetworkName).Build(),
+			false,
+			false,
+			testPodNamespace,
+			testClusterNetwork,
+			0,
+			testServiceAccountName,
+			&config.Image{
+				Repository: testImageRepository,
+				Tag:        testImageTag,
+			},
+		)
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		k8sclientset := k8sfake.NewSimpleClientset()
+
+		handler := Handler{
+			agentNamespace: testPodNamespace,
+			agentImage: &config.Image{
+				Repository: testImageRepository,
+				Tag:        testImageTag,
+			},
+			agentServiceAccountName: testServiceAccountName,
+			nadCache:                fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			podClient:               fakeclient.PodClient(k8sclientset.CoreV1().Pods),
+			podCache:                fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+		}
+
+		status, err := handler.DeployAgent(givenIPPool, givenIPPool.Status)
+		assert.Nil(t, err)
+		assert.Equal(t, expectedStatus, status)
+
+		pod, err := handler.podClient.Get(testPodNamespace, testPodName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, expectedPod, pod)
+	})
+
+	t.Run("ippool created on network with custom mtu", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			Router(testRouter1).
+			NetworkName(testNetworkName).Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(clusterNetworkLabelKey, testClusterNetwork).
+			Config(`{"cniVersion":"0.3.1","type":"bridge","bridge":"mgmt-br","mtu":9000}`).Build()
+
+		expectedPod, _ := prepareAgentPod(
+			givenIPPool,
+			false,
+			false,
+			testPodNamespace,
+			testClusterNetwork,
+			9000,
+			testServiceAccountName,
+			&config.Image{
+				Repository: testImageRepository,
+				Tag:        testImageTag,
+			},
+		)
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		k8sclientset := k8sfake.NewSimpleClientset()
+
+		handler := Handler{
+			agentNamespace: testPodNamespace,
+			agentImage: &config.Image{
+				Repository: testImageRepository,
+				Tag:        testImageTag,
+			},
+			agentServiceAccountName: testServiceAccountName,
+			nadCache:                fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			podClient:               fakeclient.PodClient(k8sclientset.CoreV1().Pods),
+			podCache:                fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+		}
+
+		_, err = handler.DeployAgent(givenIPPool, givenIPPool.Status)
+		assert.Nil(t, err)
+
+		pod, err := handler.podClient.Get(testPodNamespace, testPodName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, expectedPod, pod)
+		assert.Equal(t, []string{
+			"--ippool-ref", testIPPoolNamespace + "/" + testIPPoolName,
+			"--verify-cidr", testCIDR,
+			"--verify-router", testRouter1,
+			"--verify-mtu", "9000",
+		}, pod.Spec.Containers[0].Args)
+	})
+
+	t.Run("ippool created on network with unparsable config", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			Router(testRouter1).
+			NetworkName(testNetworkName).Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(clusterNetworkLabelKey, testClusterNetwork).
+			Config(`{"cniVersion":"0.3.1","type":"bridge","mtu":"9000"}`).Build()
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		k8sclientset := k8sfake.NewSimpleClientset()
+		recorder := record.NewFakeRecorder(10)
+
+		handler := Handler{
+			agentNamespace: testPodNamespace,
+			agentImage: &config.Image{
+				Repository: testImageRepository,
+				Tag:        testImageTag,
+			},
+			agentServiceAccountName: testServiceAccountName,
+			recorder:                recorder,
+			nadCache:                fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			podClient:               fakeclient.PodClient(k8sclientset.CoreV1().Pods),
+			podCache:                fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+		}
+
+		_, err = handler.DeployAgent(givenIPPool, givenIPPool.Status)
+		assert.Nil(t, err)
+
+		pod, err := handler.podClient.Get(testPodNamespace, testPodName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{
+			"--ippool-ref", testIPPoolNamespace + "/" + testIPPoolName,
+			"--verify-cidr", testCIDR,
+			"--verify-router", testRouter1,
+		}, pod.Spec.Containers[0].Args)
+
+		if assert.Len(t, recorder.Events, 1) {
+			assert.Contains(t, <-recorder.Events, "Warning "+reasonInvalidNetworkConfig)
+		}
+	})
+
+	t.Run("ippool paused", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			Paused().Build()
+
+		handler := Handler{
+			agentNamespace: testPodNamespace,
+			agentImage: &config.Image{
+				Repository: testImageRepository,
+				Tag:        testImageTag,
+			},
+			agentServiceAccountName: testServiceAccountName,
+		}
+
+		_, err := handler.DeployAgent(givenIPPool, givenIPPool.Status)
+		assert.Equal(t, fmt.Errorf("ippool %s was administratively disabled", testIPPoolNamespace+"/"+testIPPoolName), err)
+	})
+
+	t.Run("nad not found", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			NetworkName("you-cant-find-me").Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(clusterNetworkLabelKey, testClusterNetwork).Build()
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		handler := Handler{
+			nadCache: fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}
+
+		_, err = handler.DeployAgent(givenIPPool, givenIPPool.Status)
+		assert.Equal(t, fmt.Sprintf("network-attachment-definitions.k8s.cni.cncf.io \"%s\" not found", "you-cant-find-me"), err.Error())
+	})
+
+	t.Run("agent pod already exists", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			NetworkName(testNetworkName).
+			AgentPodRef(testPodNamespace, testPodName, testImage, "").Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(clusterNetworkLabelKey, testClusterNetwork).Build()
+		givenPod, _ := prepareAgentPod(
+			NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+				ServerIP(testServerIP1).
+				CIDR(testCIDR).
+				NetworkName(testNetworkName).Build(),
+			false,
+			false,
+			testPodNamespace,
 			testClusterNetwork,
+			0,
 			testServiceAccountName,
 			&config.Image{
 				Repository: testImageRepository,
@@ -456,8 +961,10 @@ func TestHandler_DeployAgent(t *testing.T) {
 				CIDR(testCIDR).
 				NetworkName(testNetworkName).Build(),
 			false,
+			false,
 			testPodNamespace,
 			testClusterNetwork,
+			0,
 			testServiceAccountName,
 			&config.Image{
 				Repository: testImageRepository,
@@ -516,8 +1023,10 @@ func TestHandler_DeployAgent(t *testing.T) {
 				CIDR(testCIDR).
 				NetworkName(testNetworkNameLong).Build(),
 			false,
+			false,
 			testPodNamespace,
 			testClusterNetwork,
+			0,
 			testServiceAccountName,
 			&config.Image{
 				Repository: testImageRepository,
@@ -572,8 +1081,10 @@ func TestHandler_DeployAgent(t *testing.T) {
 				CIDR(testCIDR).
 				NetworkName(testNetworkName).Build(),
 			false,
+			false,
 			testPodNamespace,
 			testClusterNetwork,
+			0,
 			testServiceAccountName,
 			&config.Image{
 				Repository: testImageRepository,
@@ -630,8 +1141,10 @@ func TestHandler_DeployAgent(t *testing.T) {
 				CIDR(testCIDR).
 				NetworkName(testNetworkName).Build(),
 			false,
+			false,
 			testPodNamespace,
 			testClusterNetwork,
+			0,
 			testServiceAccountName,
 			&config.Image{
 				Repository: testImageRepository,
@@ -687,8 +1200,10 @@ func TestHandler_DeployAgent(t *testing.T) {
 				CIDR(testCIDR).
 				NetworkName(testNetworkName).Build(),
 			false,
+			false,
 			testPodNamespace,
 			testClusterNetwork,
+			0,
 			testServiceAccountName,
 			&config.Image{
 				Repository: testImageRepository,
@@ -725,10 +1240,78 @@ func TestHandler_DeployAgent(t *testing.T) {
 		_, err = handler.DeployAgent(givenIPPool, givenIPPool.Status)
 		assert.Equal(t, fmt.Sprintf("agent pod %s uid mismatch", testPodName), err.Error())
 	})
-}
 
-func TestHandler_BuildCache(t *testing.T) {
-	t.Run("new ippool", func(t *testing.T) {
+	t.Run("ippool served by embedded agent", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			NetworkName(testNetworkName).
+			AgentPodRef(testPodNamespace, testPodName, testImage, testUID).Build()
+		givenPod, _ := prepareAgentPod(
+			NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+				ServerIP(testServerIP1).
+				CIDR(testCIDR).
+				NetworkName(testNetworkName).Build(),
+			false,
+			false,
+			testPodNamespace,
+			testClusterNetwork,
+			0,
+			testServiceAccountName,
+			&config.Image{
+				Repository: testImageRepository,
+				Tag:        testImageTag,
+			},
+		)
+
+		k8sclientset := k8sfake.NewSimpleClientset()
+		err := k8sclientset.Tracker().Add(givenPod)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		informer := k8scache.NewSharedIndexInformer(&k8scache.ListWatch{
+			ListFunc: func(_ metav1.ListOptions) (runtime.Object, error) {
+				return &networkv1.IPPoolList{}, nil
+			},
+			WatchFunc: func(_ metav1.ListOptions) (watch.Interface, error) {
+				return watch.NewFake(), nil
+			},
+		}, &networkv1.IPPool{}, 0, k8scache.Indexers{})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// The DHCP service is left out, as with --no-dhcp, so no nic is
+		// needed
+		handler := Handler{
+			agentNamespace:   testPodNamespace,
+			embedded:         agent.NewEmbedded(ctx, map[string]string{testNetworkName: "net1"}, informer, true, clock.RealClock{}),
+			ipAllocator:      ipam.New(),
+			cacheAllocator:   cache.New(),
+			metricsAllocator: metrics.New(),
+			podClient:        fakeclient.PodClient(k8sclientset.CoreV1().Pods),
+			podCache:         fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+		}
+
+		status, err := handler.DeployAgent(givenIPPool, givenIPPool.Status)
+		assert.Nil(t, err)
+		assert.Nil(t, status.AgentPodRef, "ippool should be served without agent pod")
+		assert.True(t, handler.embedded.IsRunning(testKey), "embedded agent should be running")
+
+		_, err = handler.podClient.Get(testPodNamespace, testPodName, metav1.GetOptions{})
+		assert.True(t, apierrors.IsNotFound(err), "superseded agent pod should be removed")
+
+		givenIPPool.Status = status
+		_, err = handler.MonitorAgent(givenIPPool, givenIPPool.Status)
+		assert.Nil(t, err)
+
+		err = handler.cleanup(givenIPPool)
+		assert.Nil(t, err)
+		assert.False(t, handler.embedded.IsRunning(testKey), "embedded agent should be stopped")
+	})
+}
+
+func TestHandler_BuildCache(t *testing.T) {
+	t.Run("new ippool", func(t *testing.T) {
 		givenIPAllocator := newTestIPAllocatorBuilder().Build()
 		givenCacheAllocator := newTestCacheAllocatorBuilder().Build()
 		givenIPPool := newTestIPPoolBuilder().
@@ -742,8 +1325,10 @@ func TestHandler_BuildCache(t *testing.T) {
 			MACSet(testNetworkName).Build()
 
 		handler := Handler{
-			cacheAllocator: givenCacheAllocator,
-			ipAllocator:    givenIPAllocator,
+			cacheAllocator:   givenCacheAllocator,
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
 		}
 
 		_, err := handler.BuildCache(givenIPPool, givenIPPool.Status)
@@ -764,19 +1349,82 @@ func TestHandler_BuildCache(t *testing.T) {
 	})
 
 	t.Run("cache is already ready", func(t *testing.T) {
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build()
 		givenIPPool := newTestIPPoolBuilder().
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
 			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
 
 		expectedStatus := newTestIPPoolStatusBuilder().
 			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
 
-		handler := Handler{}
+		handler := Handler{
+			ipAllocator: givenIPAllocator,
+		}
 
 		status, err := handler.BuildCache(givenIPPool, givenIPPool.Status)
 		assert.Nil(t, err)
 		assert.Equal(t, expectedStatus, status)
 	})
 
+	t.Run("cache is ready with ipam inputs unchanged", func(t *testing.T) {
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build()
+		givenIPPool := newTestIPPoolBuilder().
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenIPPool.Status.AllocatorHash = util.AllocatorInputsHash(givenIPPool)
+
+		metricsAllocator := metrics.New()
+		handler := Handler{
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metricsAllocator,
+		}
+
+		status, err := handler.BuildCache(givenIPPool, givenIPPool.Status)
+		assert.Nil(t, err)
+		assert.Equal(t, givenIPPool.Status, status)
+		assert.NotContains(t, scrapeMetrics(metricsAllocator), metrics.IPPoolAllocatorRebuildsMetricName+"{")
+	})
+
+	t.Run("cache is ready with ipam inputs changed", func(t *testing.T) {
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build()
+		givenCacheAllocator := newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).Build()
+		givenIPPool := newTestIPPoolBuilder().
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			AllocatorHash("stale").
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").
+			Exclude(testExcludedIP1).Build()
+
+		expectedIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Revoke(testNetworkName, testExcludedIP1).Build()
+
+		metricsAllocator := metrics.New()
+		handler := Handler{
+			cacheAllocator:   givenCacheAllocator,
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metricsAllocator,
+			clock:            clock.RealClock{},
+		}
+
+		status, err := handler.BuildCache(givenIPPool, givenIPPool.Status)
+		assert.Nil(t, err)
+		assert.Equal(t, util.AllocatorInputsHash(givenIPPool), status.AllocatorHash)
+		assert.Equal(t, expectedIPAllocator, handler.ipAllocator)
+		assert.Contains(t, scrapeMetrics(metricsAllocator),
+			fmt.Sprintf("%s{ippool=%q} 1", metrics.IPPoolAllocatorRebuildsMetricName, testKey))
+	})
+
 	t.Run("ippool with excluded ips", func(t *testing.T) {
 		givenIPAllocator := newTestIPAllocatorBuilder().Build()
 		givenCacheAllocator := newTestCacheAllocatorBuilder().Build()
@@ -793,8 +1441,10 @@ func TestHandler_BuildCache(t *testing.T) {
 			MACSet(testNetworkName).Build()
 
 		handler := Handler{
-			cacheAllocator: givenCacheAllocator,
-			ipAllocator:    givenIPAllocator,
+			cacheAllocator:   givenCacheAllocator,
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
 		}
 
 		_, err := handler.BuildCache(givenIPPool, givenIPPool.Status)
@@ -813,7 +1463,8 @@ func TestHandler_BuildCache(t *testing.T) {
 			Exclude(testExcludedIP1, testExcludedIP2).
 			NetworkName(testNetworkName).
 			Allocated(testAllocatedIP1, testMAC1).
-			Allocated(testAllocatedIP2, testMAC2).Build()
+			Allocated(testAllocatedIP2, testMAC2).
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).Build()
 
 		expectedIPAllocator := newTestIPAllocatorBuilder().
 			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
@@ -825,8 +1476,10 @@ func TestHandler_BuildCache(t *testing.T) {
 			Add(testNetworkName, testMAC2, testAllocatedIP2).Build()
 
 		handler := Handler{
-			cacheAllocator: givenCacheAllocator,
-			ipAllocator:    givenIPAllocator,
+			cacheAllocator:   givenCacheAllocator,
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
 		}
 
 		_, err := handler.BuildCache(givenIPPool, givenIPPool.Status)
@@ -835,6 +1488,35 @@ func TestHandler_BuildCache(t *testing.T) {
 		assert.Equal(t, expectedIPAllocator, handler.ipAllocator)
 		assert.Equal(t, expectedCacheAllocator, handler.cacheAllocator)
 	})
+
+	t.Run("ippool too large", func(t *testing.T) {
+		givenIPAllocator := newTestIPAllocatorBuilder().Build()
+		givenCacheAllocator := newTestCacheAllocatorBuilder().Build()
+		givenIPPool := newTestIPPoolBuilder().
+			CIDR("10.0.0.0/8").
+			PoolRange("10.0.0.1", "10.255.255.254").
+			NetworkName(testNetworkName).Build()
+
+		handler := Handler{
+			maxPoolSize:      util.DefaultMaxPoolSize,
+			cacheAllocator:   givenCacheAllocator,
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+		}
+
+		_, err := handler.BuildCache(givenIPPool, givenIPPool.Status)
+		assert.Equal(t, fmt.Sprintf("ippool %s/%s: pool range has 16777214 allocatable addresses, more than the maximum of 65536; narrow the range or raise the limit with --max-pool-size", testIPPoolNamespace, testIPPoolName), err.Error())
+
+		assert.Equal(t, newTestIPAllocatorBuilder().Build(), handler.ipAllocator, "ipam should never be touched")
+		assert.Equal(t, newTestCacheAllocatorBuilder().Build(), handler.cacheAllocator, "mac cache should never be touched")
+	})
+}
+
+func scrapeMetrics(metricsAllocator *metrics.MetricsAllocator) string {
+	recorder := httptest.NewRecorder()
+	metricsAllocator.GetHTTPHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return recorder.Body.String()
 }
 
 func TestHandler_MonitorAgent(t *testing.T) {
@@ -873,6 +1555,39 @@ func TestHandler_MonitorAgent(t *testing.T) {
 		assert.Equal(t, fmt.Sprintf("agent pod %s not ready", testPodName), err.Error())
 	})
 
+	t.Run("agent pod no longer ready", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			NetworkName(testNetworkName).
+			AgentPodRef(testPodNamespace, testPodName, testImage, "").
+			AgentReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenPod := newTestPodBuilder().
+			Container(testContainerName, testImageRepository, testImageTag).Build()
+
+		k8sclientset := k8sfake.NewSimpleClientset()
+
+		err := k8sclientset.Tracker().Add(givenPod)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		recorder := record.NewFakeRecorder(1)
+		handler := Handler{
+			podCache: fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+			recorder: recorder,
+		}
+
+		_, err = handler.MonitorAgent(givenIPPool, givenIPPool.Status)
+		assert.Equal(t, fmt.Sprintf("agent pod %s not ready", testPodName), err.Error())
+		if assert.Len(t, recorder.Events, 1) {
+			assert.Equal(t, fmt.Sprintf("Warning %s Agent serving network %s is not ready: agent pod %s not ready",
+				reasonAgentNotReady, testNetworkName, testPodName), <-recorder.Events)
+		}
+
+		// Agents yet to come up don't get one
+		givenIPPool = newTestIPPoolBuilder().NetworkName(testNetworkName).Build()
+		_, err = handler.MonitorAgent(givenIPPool, givenIPPool.Status)
+		assert.NotNil(t, err)
+		assert.Empty(t, recorder.Events)
+	})
+
 	t.Run("agent pod ready", func(t *testing.T) {
 		givenIPPool := newTestIPPoolBuilder().AgentPodRef(testPodNamespace, testPodName, testImage, "").Build()
 		givenPod := newTestPodBuilder().
@@ -923,7 +1638,8 @@ func TestHandler_MonitorAgent(t *testing.T) {
 
 	t.Run("outdated agent pod", func(t *testing.T) {
 		givenIPPool := newTestIPPoolBuilder().
-			AgentPodRef(testPodNamespace, testPodName, testImageNew, "").Build()
+			AgentPodRef(testPodNamespace, testPodName, testImageNew, "").
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).Build()
 		givenPod := newTestPodBuilder().
 			Container(testContainerName, testImageRepository, testImageTag).
 			PodReady(corev1.ConditionTrue).Build()
@@ -944,4 +1660,1599 @@ func TestHandler_MonitorAgent(t *testing.T) {
 		_, err = handler.podClient.Get(testPodNamespace, testPodName, metav1.GetOptions{})
 		assert.Equal(t, fmt.Sprintf("pods \"%s\" not found", testPodName), err.Error())
 	})
+
+	t.Run("agent pod reports network mismatch", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().AgentPodRef(testPodNamespace, testPodName, testImage, "").Build()
+		givenPod := newTestPodBuilder().
+			Container(testContainerName, testImageRepository, testImageTag).
+			Annotation(util.NetworkVerificationAnnotationKey, `{"mismatches":["interface eth1 has mtu 1500, expected 9000"]}`).
+			PodReady(corev1.ConditionTrue).Build()
+
+		k8sclientset := k8sfake.NewSimpleClientset()
+
+		err := k8sclientset.Tracker().Add(givenPod)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		handler := Handler{
+			podCache: fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+		}
+
+		_, err = handler.MonitorAgent(givenIPPool, givenIPPool.Status)
+		assert.Equal(t, fmt.Sprintf("agent pod %s reports network mismatch", testPodName), err.Error())
+	})
+}
+
+// TestHandler_StatusSchemaUpgrade feeds an IPPool whose status predates the
+// current schema, as delivered by the informers while the CRDs are upgraded,
+// through the handlers. The status lacks the image of the agent pod and looks
+// as if nothing was allocated, yet nothing is to be purged or released.
+func TestHandler_StatusSchemaUpgrade(t *testing.T) {
+	key := testIPPoolNamespace + "/" + testIPPoolName
+	givenIPAllocator := newTestIPAllocatorBuilder().Build()
+	givenCacheAllocator := newTestCacheAllocatorBuilder().Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP1).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		AgentPodRef(testPodNamespace, testPodName, "", "").
+		AllocationEntry(testAllocatedIP1, networkv1.AllocationTypeLease, testMAC1).
+		CacheReadyCondition(corev1.ConditionFalse, "NotInitialized", "").Build()
+	givenPod := newTestPodBuilder().
+		Container(testContainerName, testImageRepository, testImageTag).
+		PodReady(corev1.ConditionTrue).Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset()
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+	err = clientset.Tracker().Add(givenIPPool)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	k8sclientset := k8sfake.NewSimpleClientset()
+	err = k8sclientset.Tracker().Add(givenPod)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	handler := Handler{
+		cacheAllocator:   givenCacheAllocator,
+		ipAllocator:      givenIPAllocator,
+		metricsAllocator: metrics.New(),
+		clock:            clock.RealClock{},
+		ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		nadClient:        fakeclient.NetworkAttachmentDefinitionClient(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		podClient:        fakeclient.PodClient(k8sclientset.CoreV1().Pods),
+		podCache:         fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+	}
+
+	_, err = handler.MonitorAgent(givenIPPool, givenIPPool.Status)
+	assert.Equal(t, fmt.Sprintf("status of ippool %s predates schema version %d, not purging agent pod %s", key, networkv1.IPPoolStatusSchemaVersion, testPodName), err.Error())
+	_, err = handler.podClient.Get(testPodNamespace, testPodName, metav1.GetOptions{})
+	assert.Nil(t, err, "agent pod should not be purged")
+
+	_, err = handler.BuildCache(givenIPPool, givenIPPool.Status)
+	assert.Equal(t, fmt.Sprintf("status of ippool %s predates schema version %d, not building ipam from it", key, networkv1.IPPoolStatusSchemaVersion), err.Error())
+	assert.Equal(t, newTestIPAllocatorBuilder().Build(), handler.ipAllocator)
+	assert.Equal(t, newTestCacheAllocatorBuilder().Build(), handler.cacheAllocator)
+
+	// Once OnChange writes the status at the current schema version, the
+	// leases recorded in it are taken over
+	ipPool, err := handler.OnChange(key, givenIPPool)
+	assert.Nil(t, err)
+	assert.Equal(t, networkv1.IPPoolStatusSchemaVersion, ipPool.Status.SchemaVersion)
+
+	_, err = handler.BuildCache(ipPool, ipPool.Status)
+	assert.Nil(t, err)
+
+	expectedIPAllocator := newTestIPAllocatorBuilder().
+		IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+		Allocate(testNetworkName, testAllocatedIP1).Build()
+	expectedCacheAllocator := newTestCacheAllocatorBuilder().
+		MACSet(testNetworkName).
+		Add(testNetworkName, testMAC1, testAllocatedIP1).Build()
+	assert.Equal(t, expectedIPAllocator, handler.ipAllocator)
+	assert.Equal(t, expectedCacheAllocator, handler.cacheAllocator)
+}
+
+// TestHandler_WarmUp restarts the controller on an IPPool whose status still
+// reports its caches as ready. The allocations made once the caches are
+// warmed up must respect the leases recorded before the restart.
+func TestHandler_WarmUp(t *testing.T) {
+	pausedNetworkName := testNADNamespace + "/net-2"
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP1).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		AllocationEntry(testAllocatedIP1, networkv1.AllocationTypeLease, testMAC1).
+		SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenPausedIPPool := NewIPPoolBuilder(testIPPoolNamespace, "net-2").
+		CIDR(testCIDR).
+		NetworkName(pausedNetworkName).
+		Paused().Build()
+	givenUninitializedIPPool := NewIPPoolBuilder(testIPPoolNamespace, "net-3").
+		CIDR(testCIDR).
+		NetworkName(testNADNamespace + "/net-3").Build()
+
+	clientset := fake.NewSimpleClientset(givenIPPool, givenPausedIPPool)
+
+	warmup := config.NewWarmup()
+	warmup.Start()
+
+	handler := Handler{
+		cacheAllocator:   newTestCacheAllocatorBuilder().Build(),
+		ipAllocator:      newTestIPAllocatorBuilder().Build(),
+		metricsAllocator: metrics.New(),
+		clock:            clock.RealClock{},
+		warmup:           warmup,
+		ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+	}
+
+	assert.ErrorIs(t, warmup.Check(), config.ErrWarmingUp, "controller should not be ready while warming up")
+
+	_, err := handler.BuildCache(givenUninitializedIPPool, givenUninitializedIPPool.Status)
+	assert.ErrorIs(t, err, config.ErrWarmingUp)
+	assert.ErrorIs(t, err, generic.ErrSkip, "waiting for the warm-up should not be retried with backoff")
+
+	handler.runWarmup(context.Background())
+
+	assert.True(t, warmup.IsDone())
+	assert.Nil(t, warmup.Check())
+	assert.False(t, handler.ipAllocator.IsNetworkInitialized(pausedNetworkName), "paused ippool should not be warmed up")
+
+	ip, err := handler.cacheAllocator.GetIPByMAC(testNetworkName, testMAC1)
+	assert.Nil(t, err)
+	assert.Equal(t, testAllocatedIP1, ip)
+
+	_, err = handler.ipAllocator.AllocateIP(testNetworkName, testAllocatedIP1)
+	assert.ErrorIs(t, err, ipam.ErrAlreadyAllocated)
+
+	var allocated int
+	for {
+		ip, err := handler.ipAllocator.AllocateIP(testNetworkName, "")
+		if err != nil {
+			assert.ErrorIs(t, err, ipam.ErrExhausted)
+			break
+		}
+		assert.NotEqual(t, testAllocatedIP1, ip, "ip leased before the restart should not be allocated again")
+		allocated++
+	}
+	// The range holds 100 addresses, one of which was leased already
+	assert.Equal(t, 99, allocated)
+}
+
+func TestHandler_VerifyNetwork(t *testing.T) {
+	testCases := []struct {
+		name            string
+		skip            bool
+		annotation      string
+		expectedStatus  corev1.ConditionStatus
+		expectedReason  string
+		expectedMessage string
+	}{
+		{
+			name:           "verification pending",
+			expectedStatus: corev1.ConditionUnknown,
+			expectedReason: "VerificationPending",
+		},
+		{
+			name:           "verification passed",
+			annotation:     `{}`,
+			expectedStatus: corev1.ConditionFalse,
+		},
+		{
+			name:            "mismatches reported",
+			annotation:      `{"mismatches":["interface eth1 has mtu 1500, expected 9000","router 192.168.0.1 unreachable from 192.168.0.2: i/o timeout"]}`,
+			expectedStatus:  corev1.ConditionTrue,
+			expectedReason:  "MismatchDetected",
+			expectedMessage: "interface eth1 has mtu 1500, expected 9000; router 192.168.0.1 unreachable from 192.168.0.2: i/o timeout",
+		},
+		{
+			name:           "verification skipped",
+			skip:           true,
+			annotation:     `{"mismatches":["interface eth1 has mtu 1500, expected 9000"]}`,
+			expectedStatus: corev1.ConditionFalse,
+			expectedReason: "VerificationSkipped",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ipPoolBuilder := newTestIPPoolBuilder().AgentPodRef(testPodNamespace, testPodName, testImage, "")
+			if tc.skip {
+				ipPoolBuilder = ipPoolBuilder.SkipNetworkVerification()
+			}
+			givenIPPool := ipPoolBuilder.Build()
+
+			podBuilder := newTestPodBuilder().
+				Container(testContainerName, testImageRepository, testImageTag).
+				PodReady(corev1.ConditionTrue)
+			if tc.annotation != "" {
+				podBuilder = podBuilder.Annotation(util.NetworkVerificationAnnotationKey, tc.annotation)
+			}
+			givenPod := podBuilder.Build()
+
+			k8sclientset := k8sfake.NewSimpleClientset()
+
+			err := k8sclientset.Tracker().Add(givenPod)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+			handler := Handler{
+				podCache: fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+			}
+
+			status, err := handler.VerifyNetwork(givenIPPool, givenIPPool.Status)
+			assert.Nil(t, err)
+			assert.Equal(t, string(tc.expectedStatus), networkv1.NetworkMismatch.GetStatus(&status))
+			assert.Equal(t, tc.expectedReason, networkv1.NetworkMismatch.GetReason(&status))
+			assert.Equal(t, tc.expectedMessage, networkv1.NetworkMismatch.GetMessage(&status))
+		})
+	}
+}
+
+func TestHandler_GuardPoolSize(t *testing.T) {
+	testCases := []struct {
+		name           string
+		ipPool         *networkv1.IPPool
+		expectedStatus corev1.ConditionStatus
+		expectedReason string
+	}{
+		{
+			name: "small range of a huge cidr",
+			ipPool: newTestIPPoolBuilder().
+				CIDR("10.0.0.0/8").
+				PoolRange("10.0.0.1", "10.0.0.254").Build(),
+		},
+		{
+			name: "range exceeding the limit",
+			ipPool: newTestIPPoolBuilder().
+				CIDR("10.0.0.0/8").
+				PoolRange("10.0.0.1", "10.1.0.1").Build(),
+			expectedStatus: corev1.ConditionTrue,
+			expectedReason: reasonPoolTooLarge,
+		},
+		{
+			name: "range within the limit after exclusions",
+			ipPool: newTestIPPoolBuilder().
+				CIDR("10.0.0.0/8").
+				PoolRange("10.0.0.1", "10.1.0.1").
+				Exclude("10.0.0.1", "10.1.0.1").Build(),
+		},
+		{
+			name: "range narrowed after being too large",
+			ipPool: newTestIPPoolBuilder().
+				CIDR("10.0.0.0/8").
+				PoolRange("10.0.0.1", "10.0.0.254").
+				DegradedCondition(corev1.ConditionTrue, reasonPoolTooLarge, "").Build(),
+			expectedStatus: corev1.ConditionFalse,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := Handler{
+				maxPoolSize: util.DefaultMaxPoolSize,
+			}
+
+			status, err := handler.GuardPoolSize(tc.ipPool, tc.ipPool.Status)
+			assert.Nil(t, err)
+			assert.Equal(t, string(tc.expectedStatus), networkv1.Degraded.GetStatus(&status))
+			assert.Equal(t, tc.expectedReason, networkv1.Degraded.GetReason(&status))
+		})
+	}
+}
+
+func TestHandler_GuardExternalIPAM(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name            string
+		ipPool          *networkv1.IPPool
+		failing         bool
+		expectedStatus  corev1.ConditionStatus
+		expectedReason  string
+		expectedMessage string
+	}{
+		{
+			name: "external ipam working",
+			ipPool: newTestIPPoolBuilder().
+				ExternalIPAM(server.URL, "").Build(),
+		},
+		{
+			name: "external ipam given up on",
+			ipPool: newTestIPPoolBuilder().
+				ExternalIPAM(server.URL, networkv1.ExternalIPAMFailurePolicyAllocateLocally).Build(),
+			failing:        true,
+			expectedStatus: corev1.ConditionTrue,
+			expectedReason: reasonExternalIPAMUnavailable,
+			expectedMessage: fmt.Sprintf("external ipam %s failed repeatedly, allocations follow the AllocateLocally failure policy: "+
+				"external ipam answered 503 Service Unavailable to Allocate", server.URL),
+		},
+		{
+			name: "another reason is kept",
+			ipPool: newTestIPPoolBuilder().
+				ExternalIPAM(server.URL, "").
+				DegradedCondition(corev1.ConditionTrue, reasonPoolTooLarge, "").Build(),
+			failing:        true,
+			expectedStatus: corev1.ConditionTrue,
+			expectedReason: reasonPoolTooLarge,
+		},
+		{
+			name: "external ipam working again",
+			ipPool: newTestIPPoolBuilder().
+				ExternalIPAM(server.URL, "").
+				DegradedCondition(corev1.ConditionTrue, reasonExternalIPAMUnavailable, "").Build(),
+			expectedStatus: corev1.ConditionFalse,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := externalipam.NewClient(clock.RealClock{}, 1, externalipam.DefaultCooldown)
+			if tc.failing {
+				key := tc.ipPool.Namespace + "/" + tc.ipPool.Name
+				_, err := client.Allocate(context.Background(), key, externalipam.Endpoint{URL: server.URL}, externalipam.Request{}, nil)
+				assert.NotNil(t, err)
+			}
+			handler := Handler{
+				externalIPAM: client,
+			}
+
+			status, err := handler.GuardExternalIPAM(tc.ipPool, tc.ipPool.Status)
+			assert.Nil(t, err)
+			assert.Equal(t, string(tc.expectedStatus), networkv1.Degraded.GetStatus(&status))
+			assert.Equal(t, tc.expectedReason, networkv1.Degraded.GetReason(&status))
+			assert.Equal(t, tc.expectedMessage, networkv1.Degraded.GetMessage(&status))
+		})
+	}
+}
+
+func TestHandler_GuardGateways(t *testing.T) {
+	testCases := []struct {
+		name           string
+		ipPool         *networkv1.IPPool
+		expectedStatus corev1.ConditionStatus
+		expectedReason string
+	}{
+		{
+			name: "gateways within the cidr",
+			ipPool: newTestIPPoolBuilder().
+				CIDR(testCIDR).
+				ServerIP(testServerIP1).
+				Router(testRouter1).Build(),
+		},
+		{
+			name: "router out of the cidr",
+			ipPool: newTestIPPoolBuilder().
+				CIDR(testCIDR).
+				ServerIP(testServerIP1).
+				Router("192.168.1.1").Build(),
+			expectedStatus: corev1.ConditionTrue,
+			expectedReason: reasonInvalidGateway,
+		},
+		{
+			name: "another reason is kept",
+			ipPool: newTestIPPoolBuilder().
+				CIDR(testCIDR).
+				Router("192.168.0.255").
+				DegradedCondition(corev1.ConditionTrue, reasonPoolTooLarge, "").Build(),
+			expectedStatus: corev1.ConditionTrue,
+			expectedReason: reasonPoolTooLarge,
+		},
+		{
+			name: "router fixed",
+			ipPool: newTestIPPoolBuilder().
+				CIDR(testCIDR).
+				Router(testRouter1).
+				DegradedCondition(corev1.ConditionTrue, reasonInvalidGateway, "").Build(),
+			expectedStatus: corev1.ConditionFalse,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := Handler{}
+
+			status, err := handler.GuardGateways(tc.ipPool, tc.ipPool.Status)
+			assert.Nil(t, err)
+			assert.Equal(t, string(tc.expectedStatus), networkv1.Degraded.GetStatus(&status))
+			assert.Equal(t, tc.expectedReason, networkv1.Degraded.GetReason(&status))
+		})
+	}
+}
+
+func TestHandler_CollectOrphanedAgentPods(t *testing.T) {
+	const testUIDNew = "6d2c0b1e-7a0f-4d3e-9b8a-3c5f1e2d4a6b"
+
+	newAgentPod := func(name, uid string) *corev1.Pod {
+		return newPodBuilder(testPodNamespace, name).
+			Label(vmDHCPControllerLabelKey, "agent").
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).
+			Label(util.IPPoolUIDLabelKey, uid).Build()
+	}
+
+	testCases := []struct {
+		name        string
+		givenIPPool *networkv1.IPPool
+		givenPod    *corev1.Pod
+		// upgrading holds the objects of former releases as not upgraded
+		// yet
+		upgrading      bool
+		expectedDelete bool
+	}{
+		{
+			name:        "agent of an existing ippool is kept",
+			givenIPPool: newTestIPPoolBuilder().UID(testUID).Build(),
+			givenPod:    newAgentPod(testPodName, testUID),
+		},
+		{
+			name:           "agent of an ippool deleted while the controller was down is removed",
+			givenPod:       newAgentPod(testPodName, testUID),
+			expectedDelete: true,
+		},
+		{
+			name:           "agent of a deleted ippool recreated with the same name is removed",
+			givenIPPool:    newTestIPPoolBuilder().UID(testUIDNew).Build(),
+			givenPod:       newAgentPod(testPodName, testUID),
+			expectedDelete: true,
+		},
+		{
+			name:        "agent without the uid label is matched by name",
+			givenIPPool: newTestIPPoolBuilder().UID(testUIDNew).Build(),
+			givenPod: newPodBuilder(testPodNamespace, testPodName).
+				Label(vmDHCPControllerLabelKey, "agent").
+				Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+				Label(util.IPPoolNameLabelKey, testIPPoolName).Build(),
+		},
+		{
+			name:      "agent of a deleted ippool is kept while upgrading",
+			givenPod:  newAgentPod(testPodName, testUID),
+			upgrading: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			if tc.givenIPPool != nil {
+				err := clientset.Tracker().Add(tc.givenIPPool)
+				assert.Nil(t, err, "mock resource should add into fake controller tracker")
+			}
+
+			k8sclientset := k8sfake.NewSimpleClientset()
+			err := k8sclientset.Tracker().Add(tc.givenPod)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+			fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			recorder := record.NewFakeRecorder(1)
+
+			handler := Handler{
+				agentNamespace: testPodNamespace,
+				clock:          fakeClock,
+				recorder:       recorder,
+				ippoolCache:    fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+				podClient:      fakeclient.PodClient(k8sclientset.CoreV1().Pods),
+				podCache:       fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+			}
+			if tc.upgrading {
+				handler.upgrade = config.NewUpgrade()
+			}
+
+			// The first sweeps only mark orphaned agents
+			err = handler.collectOrphanedAgentPods()
+			assert.Nil(t, err)
+			fakeClock.Step(agentPodGCGracePeriod / 2)
+			err = handler.collectOrphanedAgentPods()
+			assert.Nil(t, err)
+
+			_, err = k8sclientset.CoreV1().Pods(testPodNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+			assert.Nil(t, err, "agent pod should survive the grace period")
+
+			fakeClock.Step(agentPodGCGracePeriod / 2)
+			err = handler.collectOrphanedAgentPods()
+			assert.Nil(t, err)
+
+			_, err = k8sclientset.CoreV1().Pods(testPodNamespace).Get(context.TODO(), testPodName, metav1.GetOptions{})
+			if tc.expectedDelete {
+				assert.True(t, apierrors.IsNotFound(err), "agent pod should be deleted")
+				if assert.Len(t, recorder.Events, 1) {
+					assert.Contains(t, <-recorder.Events, orphanedAgentPodReason)
+				}
+			} else {
+				assert.Nil(t, err, "agent pod should be kept")
+				assert.Empty(t, recorder.Events)
+			}
+			assert.Empty(t, handler.orphanedAgentPods)
+		})
+	}
+}
+
+// ipPoolQueue stands in for the work queue of the IPPool controller, keeping
+// when each IPPool enqueued is due.
+type ipPoolQueue struct {
+	ctlnetworkv1.IPPoolController
+
+	clock clock.Clock
+	due   map[string]time.Time
+}
+
+func newIPPoolQueue(clock clock.Clock) *ipPoolQueue {
+	return &ipPoolQueue{
+		clock: clock,
+		due:   make(map[string]time.Time),
+	}
+}
+
+func (q *ipPoolQueue) Enqueue(namespace, name string) {
+	q.EnqueueAfter(namespace, name, 0)
+}
+
+// EnqueueAfter keeps the earliest due time of the IPPool, as the work queue
+// does.
+func (q *ipPoolQueue) EnqueueAfter(namespace, name string, duration time.Duration) {
+	key := namespace + "/" + name
+	due := q.clock.Now().Add(duration)
+	if current, ok := q.due[key]; !ok || due.Before(current) {
+		q.due[key] = due
+	}
+}
+
+// next returns the IPPool due next along with when.
+func (q *ipPoolQueue) next() (string, time.Time, bool) {
+	var (
+		next    string
+		nextDue time.Time
+	)
+	for key, due := range q.due {
+		if next == "" || due.Before(nextDue) {
+			next, nextDue = key, due
+		}
+	}
+	return next, nextDue, next != ""
+}
+
+func TestHandler_AgentReadyLatency(t *testing.T) {
+	// The fast agent serves this long after its pod is created
+	const agentStartup = 300 * time.Millisecond
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(start)
+	podKey := testPodNamespace + "/" + testPodName
+
+	givenIPPool := newTestIPPoolBuilder().
+		AgentPodRef(testPodNamespace, testPodName, testImage, "").Build()
+	newAgentPodBuilder := func() *podBuilder {
+		return newTestPodBuilder().
+			Label(vmDHCPControllerLabelKey, "agent").
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).
+			Container(testContainerName, testImageRepository, testImageTag)
+	}
+	givenPod := newAgentPodBuilder().Build()
+
+	k8sclientset := k8sfake.NewSimpleClientset(givenPod)
+	queue := newIPPoolQueue(fakeClock)
+
+	handler := Handler{
+		agentPods:        newAgentPodTracker(),
+		ippoolController: queue,
+		podCache:         fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+	}
+
+	// The fake agent pod is seen unready first
+	_, err := handler.OnAgentPodChange(podKey, givenPod)
+	assert.Nil(t, err)
+
+	var readyAt time.Time
+	agentServingAt := start.Add(agentStartup)
+	agentServing := false
+	for readyAt.IsZero() {
+		key, due, ok := queue.next()
+		if !assert.True(t, ok, "ippool should stay enqueued until its agent is ready") {
+			return
+		}
+
+		// The agent turns ready while the IPPool waits
+		if !agentServing && !due.Before(agentServingAt) {
+			fakeClock.Step(agentServingAt.Sub(fakeClock.Now()))
+			readyPod := newAgentPodBuilder().PodReady(corev1.ConditionTrue).Build()
+			_, err := k8sclientset.CoreV1().Pods(testPodNamespace).Update(context.TODO(), readyPod, metav1.UpdateOptions{})
+			assert.Nil(t, err)
+			_, err = handler.OnAgentPodChange(podKey, readyPod)
+			assert.Nil(t, err)
+			agentServing = true
+			continue
+		}
+
+		assert.Equal(t, testKey, key)
+		delete(queue.due, key)
+		if due.After(fakeClock.Now()) {
+			fakeClock.Step(due.Sub(fakeClock.Now()))
+		}
+
+		_, err := handler.MonitorAgent(givenIPPool, givenIPPool.Status)
+		if err == nil {
+			readyAt = fakeClock.Now()
+			break
+		}
+		assert.ErrorIs(t, err, generic.ErrSkip, "waiting for the agent shouldn't be retried with backoff")
+		assert.NotEqual(t, generic.ErrSkip, err, "waiting for the agent should still be reported in the condition")
+	}
+
+	latency := readyAt.Sub(agentServingAt)
+	t.Logf("ippool ready %s after creation, %s after its agent", readyAt.Sub(start), latency)
+	assert.Less(t, latency, time.Second, "ippool should be ready within a second of its agent")
+
+	// Changes MonitorAgent doesn't care about don't enqueue the IPPool again
+	relabeledPod := newAgentPodBuilder().PodReady(corev1.ConditionTrue).Label("foo", "bar").Build()
+	_, err = handler.OnAgentPodChange(podKey, relabeledPod)
+	assert.Nil(t, err)
+	assert.Empty(t, queue.due)
+
+	// The IPPool redeploys its agent as soon as it's gone
+	_, err = handler.OnAgentPodChange(podKey, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]time.Time{testKey: fakeClock.Now()}, queue.due)
+}
+
+func TestHandler_OnNADChange(t *testing.T) {
+	testCases := []struct {
+		name          string
+		givenNAD      *cniv1.NetworkAttachmentDefinition
+		expectedEvent string
+	}{
+		{
+			name: "nad labeled with an existing ippool",
+			givenNAD: newTestNetworkAttachmentDefinitionBuilder().
+				Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+				Label(util.IPPoolNameLabelKey, testIPPoolName).Build(),
+		},
+		{
+			name: "nad labeled with a missing ippool",
+			givenNAD: newTestNetworkAttachmentDefinitionBuilder().
+				Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+				Label(util.IPPoolNameLabelKey, "typo").Build(),
+			expectedEvent: "Warning DanglingIPPoolReference IPPool default/typo referenced by the labels does not exist; VMs on the network get no IP address until it's created or the labels are fixed",
+		},
+		{
+			name:     "nad without ippool labels",
+			givenNAD: newTestNetworkAttachmentDefinitionBuilder().Build(),
+		},
+	}
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(newTestIPPoolBuilder().Build())
+			err := clientset.Tracker().Create(nadGVR, tc.givenNAD, tc.givenNAD.Namespace)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+			recorder := record.NewFakeRecorder(1)
+			handler := Handler{
+				recorder:    recorder,
+				ippoolCache: fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+				nadCache:    fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			}
+
+			_, err = handler.OnNADChange(testNADNamespace+"/"+testNADName, tc.givenNAD)
+			assert.Nil(t, err)
+
+			if tc.expectedEvent == "" {
+				assert.Len(t, recorder.Events, 0)
+			} else if assert.Len(t, recorder.Events, 1) {
+				assert.Equal(t, tc.expectedEvent, <-recorder.Events)
+			}
+
+			// The NetworkAttachmentDefinitions labeled with an IPPool are
+			// checked again as it comes and goes
+			keys, err := handler.nadsOfIPPool(testIPPoolNamespace, "typo", nil)
+			assert.Nil(t, err)
+			if tc.expectedEvent == "" {
+				assert.Empty(t, keys)
+			} else {
+				assert.Equal(t, []relatedresource.Key{{Namespace: testNADNamespace, Name: testNADName}}, keys)
+			}
+		})
+	}
+}
+
+func TestHandler_OnDHCPCheck(t *testing.T) {
+	testCheckPodName := testPodName + dhcpCheckPodSuffix
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	t.Run("start dhcp check", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			UID(testUID).
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			Annotation(util.RunDHCPCheckAnnotationKey, "true").
+			CacheReadyCondition(corev1.ConditionTrue, "", "").
+			AgentReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(clusterNetworkLabelKey, testClusterNetwork).Build()
+
+		clientset := fake.NewSimpleClientset(givenIPPool)
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		k8sclientset := k8sfake.NewSimpleClientset()
+
+		handler := Handler{
+			agentNamespace: testPodNamespace,
+			agentImage: &config.Image{
+				Repository: testImageRepository,
+				Tag:        testImageTag,
+			},
+			cacheAllocator: newTestCacheAllocatorBuilder().MACSet(testNetworkName).Build(),
+			ipAllocator:    newTestIPAllocatorBuilder().IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+			clock:          clock.RealClock{},
+			ippoolClient:   fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			nadCache:       fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			podClient:      fakeclient.PodClient(k8sclientset.CoreV1().Pods),
+			podCache:       fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+		}
+
+		ipPool, err := handler.OnDHCPCheck(testKey, givenIPPool)
+		assert.Nil(t, err)
+		assert.NotContains(t, ipPool.Annotations, util.RunDHCPCheckAnnotationKey)
+		if assert.NotNil(t, ipPool.Status.LastCheck) {
+			assert.Equal(t, networkv1.DHCPCheckRunning, ipPool.Status.LastCheck.State)
+			assert.Equal(t, testCheckPodName, ipPool.Status.LastCheck.PodName)
+			assert.Equal(t, util.DHCPCheckMACAddress(givenIPPool), ipPool.Status.LastCheck.MACAddress)
+			assert.NotEmpty(t, ipPool.Status.LastCheck.IPAddress)
+		}
+
+		used, err := handler.ipAllocator.GetUsed(testNetworkName)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, used, "test lease should be set aside in the ipam")
+
+		pod, err := handler.podClient.Get(testPodNamespace, testCheckPodName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{
+			"check",
+			"--mac", util.DHCPCheckMACAddress(givenIPPool),
+			"--server-ip", testServerIP1,
+			"--timeout", "30s",
+		}, pod.Spec.Containers[0].Args)
+	})
+
+	t.Run("start dhcp check while agent not ready", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			Annotation(util.RunDHCPCheckAnnotationKey, "true").
+			CacheReadyCondition(corev1.ConditionTrue, "", "").
+			AgentReadyCondition(corev1.ConditionFalse, "", "").Build()
+
+		clientset := fake.NewSimpleClientset(givenIPPool)
+
+		handler := Handler{
+			ipAllocator:  newTestIPAllocatorBuilder().IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+			clock:        clock.RealClock{},
+			ippoolClient: fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		}
+
+		ipPool, err := handler.OnDHCPCheck(testKey, givenIPPool)
+		assert.Nil(t, err)
+		assert.NotContains(t, ipPool.Annotations, util.RunDHCPCheckAnnotationKey)
+		if assert.NotNil(t, ipPool.Status.LastCheck) {
+			assert.Equal(t, networkv1.DHCPCheckFailed, ipPool.Status.LastCheck.State)
+			assert.Equal(t, "agent of ippool is not ready", ipPool.Status.LastCheck.Message)
+		}
+	})
+
+	t.Run("dhcp check asked for while one is running", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			NetworkName(testNetworkName).
+			Annotation(util.RunDHCPCheckAnnotationKey, "true").
+			DHCPCheck(networkv1.DHCPCheckRunning, testCheckPodName, testMAC1, testAllocatedIP1).Build()
+		givenPod := newPodBuilder(testPodNamespace, testCheckPodName).Build()
+
+		clientset := fake.NewSimpleClientset(givenIPPool)
+		k8sclientset := k8sfake.NewSimpleClientset(givenPod)
+
+		recorder := record.NewFakeRecorder(1)
+		handler := Handler{
+			agentNamespace: testPodNamespace,
+			recorder:       recorder,
+			clock:          clock.RealClock{},
+			ippoolClient:   fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			podClient:      fakeclient.PodClient(k8sclientset.CoreV1().Pods),
+			podCache:       fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+		}
+
+		ipPool, err := handler.OnDHCPCheck(testKey, givenIPPool)
+		assert.Nil(t, err)
+		assert.NotContains(t, ipPool.Annotations, util.RunDHCPCheckAnnotationKey)
+		assert.Equal(t, networkv1.DHCPCheckRunning, ipPool.Status.LastCheck.State)
+		if assert.Len(t, recorder.Events, 1) {
+			assert.Equal(t, "Warning DHCPCheckInProgress DHCP check "+testCheckPodName+" is still running; the new one was dropped", <-recorder.Events)
+		}
+	})
+
+	t.Run("dhcp check finished", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			NetworkName(testNetworkName).
+			DHCPCheck(networkv1.DHCPCheckRunning, testCheckPodName, testMAC1, testAllocatedIP1).Build()
+		result, _ := json.Marshal(dhcpcheck.Result{
+			Succeeded:           true,
+			IPAddress:           testAllocatedIP1,
+			LatencyMilliseconds: 12,
+		})
+		givenPod := newPodBuilder(testPodNamespace, testCheckPodName).Build()
+		givenPod.Status.Phase = corev1.PodSucceeded
+		givenPod.Status.ContainerStatuses = []corev1.ContainerStatus{
+			{
+				Name: "checker",
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{
+						Message: string(result),
+					},
+				},
+			},
+		}
+
+		clientset := fake.NewSimpleClientset(givenIPPool)
+		k8sclientset := k8sfake.NewSimpleClientset(givenPod)
+
+		handler := Handler{
+			agentNamespace: testPodNamespace,
+			ipAllocator: newTestIPAllocatorBuilder().
+				IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+				Allocate(testNetworkName, testAllocatedIP1).Build(),
+			clock:        clock.RealClock{},
+			ippoolClient: fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			podClient:    fakeclient.PodClient(k8sclientset.CoreV1().Pods),
+			podCache:     fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+		}
+
+		ipPool, err := handler.OnDHCPCheck(testKey, givenIPPool)
+		assert.Nil(t, err)
+		assert.Equal(t, networkv1.DHCPCheckSucceeded, ipPool.Status.LastCheck.State)
+		assert.Equal(t, int64(12), ipPool.Status.LastCheck.LatencyMilliseconds)
+		assert.NotNil(t, ipPool.Status.LastCheck.CompletionTime)
+
+		used, err := handler.ipAllocator.GetUsed(testNetworkName)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, used, "test lease should be released")
+
+		_, err = handler.podClient.Get(testPodNamespace, testCheckPodName, metav1.GetOptions{})
+		assert.True(t, apierrors.IsNotFound(err), "checker pod should be removed")
+	})
+
+	t.Run("checker pod gone", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			NetworkName(testNetworkName).
+			DHCPCheck(networkv1.DHCPCheckRunning, testCheckPodName, testMAC1, testAllocatedIP1).Build()
+
+		clientset := fake.NewSimpleClientset(givenIPPool)
+		k8sclientset := k8sfake.NewSimpleClientset()
+
+		handler := Handler{
+			agentNamespace: testPodNamespace,
+			ipAllocator: newTestIPAllocatorBuilder().
+				IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+				Allocate(testNetworkName, testAllocatedIP1).Build(),
+			clock:        clock.RealClock{},
+			ippoolClient: fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			podClient:    fakeclient.PodClient(k8sclientset.CoreV1().Pods),
+			podCache:     fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+		}
+
+		ipPool, err := handler.OnDHCPCheck(testKey, givenIPPool)
+		assert.Nil(t, err)
+		assert.Equal(t, networkv1.DHCPCheckFailed, ipPool.Status.LastCheck.State)
+		assert.Equal(t, "checker pod "+testCheckPodName+" is gone", ipPool.Status.LastCheck.Message)
+
+		used, err := handler.ipAllocator.GetUsed(testNetworkName)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, used, "test lease should be released")
+	})
+}
+
+func TestHandler_SyncConflicts(t *testing.T) {
+	declinedAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+
+	newHandler := func(t *testing.T, ipAllocator *ipam.IPAllocator, quarantine time.Duration, declines ...dhcp.Decline) *Handler {
+		podBuilder := newTestPodBuilder().
+			Container(testContainerName, testImageRepository, testImageTag).
+			PodReady(corev1.ConditionTrue)
+		if len(declines) > 0 {
+			declinesStr, err := json.Marshal(declines)
+			if err != nil {
+				t.Fatal(err)
+			}
+			podBuilder = podBuilder.Annotation(util.DeclinedIPsAnnotationKey, string(declinesStr))
+		}
+
+		k8sclientset := k8sfake.NewSimpleClientset()
+		err := k8sclientset.Tracker().Add(podBuilder.Build())
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		return &Handler{
+			conflictQuarantine: quarantine,
+			ipAllocator:        ipAllocator,
+			clock:              clock.RealClock{},
+			podCache:           fakeclient.PodCache(k8sclientset.CoreV1().Pods),
+		}
+	}
+
+	newIPPoolBuilder := func() *IPPoolBuilder {
+		return newTestIPPoolBuilder().
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			AgentPodRef(testPodNamespace, testPodName, testImage, "")
+	}
+
+	t.Run("declined ip quarantined", func(t *testing.T) {
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build()
+		givenIPPool := newIPPoolBuilder().Build()
+		handler := newHandler(t, givenIPAllocator, time.Hour, dhcp.Decline{IP: testExcludedIP1, MACAddress: testMAC1, Time: declinedAt})
+
+		ipv4Status := new(networkv1.IPv4Status)
+		err := handler.syncConflicts(givenIPPool, ipv4Status)
+		assert.Nil(t, err)
+
+		assert.Equal(t, map[string]networkv1.IPConflict{
+			testExcludedIP1: {
+				MACAddress: testMAC1,
+				DeclinedAt: metav1.NewTime(declinedAt),
+				Until:      metav1.NewTime(declinedAt.Add(time.Hour)),
+			},
+		}, ipv4Status.Conflicts)
+
+		_, err = givenIPAllocator.IsAllocated(testNetworkName, testExcludedIP1)
+		assert.NotNil(t, err, "conflicted ip should be revoked")
+		_, err = givenIPAllocator.AllocateIP(testNetworkName, testExcludedIP1)
+		assert.NotNil(t, err, "conflicted ip should not be allocatable")
+	})
+
+	t.Run("declined lease left to its owner", func(t *testing.T) {
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Allocate(testNetworkName, testAllocatedIP1).Build()
+		givenIPPool := newIPPoolBuilder().
+			Allocated(testAllocatedIP1, testMAC1).Build()
+		handler := newHandler(t, givenIPAllocator, time.Hour, dhcp.Decline{IP: testAllocatedIP1, MACAddress: testMAC1, Time: declinedAt})
+
+		ipv4Status := givenIPPool.Status.IPv4.DeepCopy()
+		err := handler.syncConflicts(givenIPPool, ipv4Status)
+		assert.Nil(t, err)
+
+		assert.Contains(t, ipv4Status.Conflicts, testAllocatedIP1)
+		allocated, err := givenIPAllocator.IsAllocated(testNetworkName, testAllocatedIP1)
+		assert.Nil(t, err)
+		assert.True(t, allocated, "lease should be left to the vmnetcfg controller")
+	})
+
+	t.Run("quarantine over", func(t *testing.T) {
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Revoke(testNetworkName, testExcludedIP1).Build()
+		givenIPPool := newIPPoolBuilder().Build()
+		// The agent still reports the decline, which isn't taken again
+		handler := newHandler(t, givenIPAllocator, time.Second, dhcp.Decline{IP: testExcludedIP1, MACAddress: testMAC1, Time: declinedAt})
+
+		ipv4Status := &networkv1.IPv4Status{
+			Conflicts: map[string]networkv1.IPConflict{
+				testExcludedIP1: {
+					MACAddress: testMAC1,
+					DeclinedAt: metav1.NewTime(declinedAt),
+					Until:      metav1.NewTime(declinedAt.Add(time.Second)),
+				},
+			},
+		}
+		err := handler.syncConflicts(givenIPPool, ipv4Status)
+		assert.Nil(t, err)
+
+		assert.Empty(t, ipv4Status.Conflicts)
+		allocated, err := givenIPAllocator.IsAllocated(testNetworkName, testExcludedIP1)
+		assert.Nil(t, err, "ip should be restored once the quarantine is over")
+		assert.False(t, allocated)
+	})
+
+	t.Run("declines ignored", func(t *testing.T) {
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build()
+		givenIPPool := newIPPoolBuilder().Build()
+		handler := newHandler(t, givenIPAllocator, 0, dhcp.Decline{IP: testExcludedIP1, MACAddress: testMAC1, Time: declinedAt})
+
+		ipv4Status := new(networkv1.IPv4Status)
+		err := handler.syncConflicts(givenIPPool, ipv4Status)
+		assert.Nil(t, err)
+
+		assert.Empty(t, ipv4Status.Conflicts)
+		allocated, err := givenIPAllocator.IsAllocated(testNetworkName, testExcludedIP1)
+		assert.Nil(t, err)
+		assert.False(t, allocated)
+	})
+}
+
+func TestHandler_OnVIPChange(t *testing.T) {
+	const testVIPKey = "services/default/lb-0"
+
+	newHandler := func(t *testing.T, ipAllocator *ipam.IPAllocator, ipPool *networkv1.IPPool) (*Handler, *record.FakeRecorder) {
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().Build()
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		err = clientset.Tracker().Add(ipPool)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		vips := newVIPTracker()
+		vips.markSynced()
+		recorder := record.NewFakeRecorder(10)
+		return &Handler{
+			ipAllocator:      ipAllocator,
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			recorder:         recorder,
+			vips:             vips,
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadClient:        fakeclient.NetworkAttachmentDefinitionClient(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}, recorder
+	}
+
+	newIPPoolBuilder := func() *IPPoolBuilder {
+		return newTestIPPoolBuilder().
+			ServerIP(testServerIP1).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			CacheReadyCondition(corev1.ConditionTrue, "", "")
+	}
+
+	t.Run("vip appears before any allocation", func(t *testing.T) {
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build()
+		givenIPPool := newIPPoolBuilder().Build()
+		handler, recorder := newHandler(t, givenIPAllocator, givenIPPool)
+
+		err := handler.OnVIPChange(testVIPKey, []string{testExcludedIP1, testExcludedIP3})
+		assert.Nil(t, err)
+		assert.Empty(t, recorder.Events)
+
+		ipPool, err := handler.OnChange(testKey, givenIPPool)
+		assert.Nil(t, err)
+		assert.Equal(t, networkv1.AllocationTypeExcluded, util.AllocationEntries(ipPool.Status.IPv4)[testExcludedIP1].Type)
+		assert.NotContains(t, util.AllocationEntries(ipPool.Status.IPv4), testExcludedIP3, "vip out of the pool range should be ignored")
+		_, err = givenIPAllocator.AllocateIP(testNetworkName, testExcludedIP1)
+		assert.NotNil(t, err, "vip should not be allocatable")
+
+		// The VIP is given back once the load balancer is gone
+		err = handler.OnVIPChange(testVIPKey, nil)
+		assert.Nil(t, err)
+
+		ipPool, err = handler.OnChange(testKey, ipPool)
+		assert.Nil(t, err)
+		assert.NotContains(t, util.AllocationEntries(ipPool.Status.IPv4), testExcludedIP1)
+		allocated, err := givenIPAllocator.IsAllocated(testNetworkName, testExcludedIP1)
+		assert.Nil(t, err, "former vip should be restored")
+		assert.False(t, allocated)
+	})
+
+	t.Run("vip appears on a leased ip", func(t *testing.T) {
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Allocate(testNetworkName, testAllocatedIP1).Build()
+		givenIPPool := newIPPoolBuilder().
+			Allocated(testAllocatedIP1, testMAC1).Build()
+		handler, recorder := newHandler(t, givenIPAllocator, givenIPPool)
+
+		err := handler.OnVIPChange(testVIPKey, []string{testAllocatedIP1})
+		assert.Nil(t, err)
+		if assert.Len(t, recorder.Events, 1) {
+			assert.Equal(t, "Warning VIPConflict IP address "+testAllocatedIP1+" is leased to "+testMAC1+" and is a VIP of "+testVIPKey+" as well", <-recorder.Events)
+		}
+
+		// Seeing the same VIP again isn't warned about twice
+		err = handler.OnVIPChange(testVIPKey, []string{testAllocatedIP1})
+		assert.Nil(t, err)
+		assert.Empty(t, recorder.Events)
+
+		ipPool, err := handler.OnChange(testKey, givenIPPool)
+		assert.Nil(t, err)
+		assert.Equal(t, testMAC1, util.Leases(ipPool.Status.IPv4)[testAllocatedIP1], "vm lease should be left untouched")
+		allocated, err := givenIPAllocator.IsAllocated(testNetworkName, testAllocatedIP1)
+		assert.Nil(t, err)
+		assert.True(t, allocated)
+	})
+
+	t.Run("exclusions kept until vips synced", func(t *testing.T) {
+		givenIPPool := newIPPoolBuilder().
+			Allocated(testExcludedIP1, util.ExcludedMark).Build()
+		handler := &Handler{vips: newVIPTracker()}
+
+		assert.Contains(t, handler.externalIPs(givenIPPool), testExcludedIP1)
+
+		handler.vips.markSynced()
+		assert.NotContains(t, handler.externalIPs(givenIPPool), testExcludedIP1)
+	})
+}
+
+func TestHandler_AddressMetrics(t *testing.T) {
+	givenIPAllocator := newTestIPAllocatorBuilder().
+		IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+		Revoke(testNetworkName, testExcludedIP1).
+		Allocate(testNetworkName, testAllocatedIP1).
+		Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP1).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		Exclude(testExcludedIP1).
+		Reservation(testMAC2, testAllocatedIP2).
+		Allocated(testAllocatedIP1, testMAC1).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset()
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+	err = clientset.Tracker().Add(givenIPPool)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	metricsAllocator := metrics.New()
+	handler := Handler{
+		noAgent:          true,
+		ipAllocator:      givenIPAllocator,
+		metricsAllocator: metricsAllocator,
+		clock:            clock.RealClock{},
+		ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		nadClient:        fakeclient.NetworkAttachmentDefinitionClient(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	ipPool, err := handler.OnChange(testKey, givenIPPool)
+	assert.Nil(t, err)
+
+	body := scrapeMetrics(metricsAllocator)
+	for kind, count := range map[string]int{
+		metrics.AddressKindTotal:     100,
+		metrics.AddressKindAllocated: 1,
+		metrics.AddressKindExcluded:  1,
+		metrics.AddressKindReserved:  1,
+	} {
+		assert.Contains(t, body, fmt.Sprintf("%s{ippool=%q,kind=%q} %d", metrics.IPPoolAddressesMetricName, testKey, kind, count))
+	}
+	assert.Contains(t, body, fmt.Sprintf("vmdhcpcontroller_ippool_available{cidr=%q,ippool=%q,network=%q} 98", testCIDR, testKey, testNetworkName))
+
+	// No series is left behind once the IPPool is gone
+	_, err = handler.OnRemove(testKey, ipPool)
+	assert.Nil(t, err)
+
+	body = scrapeMetrics(metricsAllocator)
+	assert.NotContains(t, body, testKey)
+}
+
+func TestServiceVIPs(t *testing.T) {
+	newService := func(svcType corev1.ServiceType) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "lb-0",
+				Annotations: map[string]string{
+					kubeVIPLoadBalancerIPsAnnotationKey: testExcludedIP1 + ", " + testExcludedIP2,
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Type:           svcType,
+				LoadBalancerIP: testExcludedIP1,
+			},
+			Status: corev1.ServiceStatus{
+				LoadBalancer: corev1.LoadBalancerStatus{
+					Ingress: []corev1.LoadBalancerIngress{{IP: testExcludedIP4}, {Hostname: "lb.example.com"}},
+				},
+			},
+		}
+	}
+	toUnstructured := func(svc *corev1.Service) *unstructured.Unstructured {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(svc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &unstructured.Unstructured{Object: obj}
+	}
+
+	assert.Equal(t,
+		[]string{testExcludedIP1, testExcludedIP2, testExcludedIP4},
+		normalizeVIPs(serviceVIPs(toUnstructured(newService(corev1.ServiceTypeLoadBalancer)))))
+	assert.Empty(t, normalizeVIPs(serviceVIPs(toUnstructured(newService(corev1.ServiceTypeClusterIP)))))
+}
+
+// TestHandler_OnResync injects drift of every kind into an IPPool and its
+// caches, and checks the resync repairs and counts each of them.
+func TestHandler_OnResync(t *testing.T) {
+	const (
+		testStaleIP  = "192.168.0.122"
+		testMissedIP = "192.168.0.133"
+		testStrayIP  = "192.168.0.144"
+		testMAC3     = "33:44:55:66:77:88"
+		testMAC4     = "44:55:66:77:88:99"
+	)
+
+	newVmNetCfg := func(name, ipAddress, macAddress string) *networkv1.VirtualMachineNetworkConfig {
+		return &networkv1.VirtualMachineNetworkConfig{
+			ObjectMeta: metav1.ObjectMeta{Namespace: testIPPoolNamespace, Name: name},
+			Spec: networkv1.VirtualMachineNetworkConfigSpec{
+				VMName: name,
+				NetworkConfigs: []networkv1.NetworkConfig{
+					{MACAddress: macAddress, NetworkName: testNetworkName},
+				},
+			},
+			Status: networkv1.VirtualMachineNetworkConfigStatus{
+				NetworkConfigs: []networkv1.NetworkConfigStatus{
+					{
+						AllocatedIPAddress: ipAddress,
+						MACAddress:         macAddress,
+						NetworkName:        testNetworkName,
+						State:              networkv1.AllocatedState,
+						IPPoolRef:          testKey,
+					},
+				},
+			},
+		}
+	}
+
+	// The lease of testMAC2 has no owner left, the one of testMAC3 went
+	// missing, and the caches disagree with the status on testStaleIP,
+	// testStrayIP, testMAC2, and testMAC4
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP1).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		Annotation(util.ResyncAnnotationKey, "r1").
+		SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
+		AllocationEntry(testAllocatedIP1, networkv1.AllocationTypeLease, testMAC1).
+		AllocationEntry(testStaleIP, networkv1.AllocationTypeLease, testMAC2).
+		AllocationRevision(3).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenIPAllocator := newTestIPAllocatorBuilder().
+		IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+		Allocate(testNetworkName, testAllocatedIP1, testStrayIP).Build()
+	givenCacheAllocator := newTestCacheAllocatorBuilder().
+		MACSet(testNetworkName).
+		Add(testNetworkName, testMAC1, testAllocatedIP1).
+		Add(testNetworkName, testMAC4, testStrayIP).Build()
+
+	clientset := fake.NewSimpleClientset(givenIPPool,
+		newVmNetCfg("vm-1", testAllocatedIP1, testMAC1),
+		newVmNetCfg("vm-3", testMissedIP, testMAC3),
+	)
+
+	handler := Handler{
+		cacheAllocator:   givenCacheAllocator,
+		ipAllocator:      givenIPAllocator,
+		metricsAllocator: metrics.New(),
+		clock:            clock.RealClock{},
+		resyncLimiter:    reconcile.NewResyncLimiter(time.Hour, 1, clock.RealClock{}),
+		ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		vmnetcfgCache:    fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+	}
+
+	ipPool, err := handler.OnResync(testKey, givenIPPool)
+	assert.Nil(t, err)
+	if assert.NotNil(t, ipPool.Status.LastResync) {
+		assert.Equal(t, "r1", ipPool.Status.LastResync.RequestID)
+		assert.Equal(t, networkv1.ResyncRepairs{
+			StaleLeases:   1,
+			MissingLeases: 1,
+			IPAMEntries:   2,
+			MACEntries:    2,
+		}, ipPool.Status.LastResync.Repairs)
+		assert.Empty(t, ipPool.Status.LastResync.Message)
+	}
+	assert.Equal(t, map[string]string{
+		testAllocatedIP1: testMAC1,
+		testMissedIP:     testMAC3,
+	}, util.Leases(ipPool.Status.IPv4))
+	assert.Equal(t, testIPPoolNamespace, ipPool.Status.IPv4.Entries[testMissedIP].Namespace)
+	assert.Equal(t, int64(4), ipPool.Status.AllocationRevision)
+
+	expectedIPAllocator := newTestIPAllocatorBuilder().
+		IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+		Allocate(testNetworkName, testAllocatedIP1, testMissedIP).Build()
+	expectedCacheAllocator := newTestCacheAllocatorBuilder().
+		MACSet(testNetworkName).
+		Add(testNetworkName, testMAC1, testAllocatedIP1).
+		Add(testNetworkName, testMAC3, testMissedIP).Build()
+	assert.Equal(t, expectedIPAllocator, handler.ipAllocator)
+	assert.Equal(t, expectedCacheAllocator, handler.cacheAllocator)
+
+	// The same request ID is only run once
+	again, err := handler.OnResync(testKey, ipPool)
+	assert.Nil(t, err)
+	assert.Equal(t, ipPool, again)
+
+	// A new request ID within the interval is held back
+	ipPool.Annotations[util.ResyncAnnotationKey] = "r2"
+	heldBack, err := handler.OnResync(testKey, ipPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "r1", heldBack.Status.LastResync.RequestID, "resync should be held back by the rate limit")
+}
+
+func TestHandler_UpdateForecast(t *testing.T) {
+	givenIPPool := newTestIPPoolBuilder().
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		Available(100).Build()
+
+	clientset := fake.NewSimpleClientset(givenIPPool)
+	fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tracker := forecast.NewTracker(fakeClock, forecast.DefaultWindow, forecast.DefaultSmoothingPeriod)
+	metricsAllocator := metrics.New()
+
+	handler := Handler{
+		metricsAllocator:  metricsAllocator,
+		clock:             fakeClock,
+		allocationTracker: tracker,
+		ippoolClient:      fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+	}
+
+	getIPPool := func() *networkv1.IPPool {
+		ipPool, err := clientset.NetworkV1alpha1().IPPools(testIPPoolNamespace).Get(context.TODO(), testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		return ipPool
+	}
+
+	// Nothing is known of the pace yet
+	err := handler.updateForecast(givenIPPool)
+	assert.Nil(t, err)
+	ipPool := getIPPool()
+	if assert.NotNil(t, ipPool.Status.Forecast) {
+		assert.Equal(t, "0.00", ipPool.Status.Forecast.NetAllocationRate)
+		assert.Nil(t, ipPool.Status.Forecast.ExhaustionTime, "exhaustion should be unknown at a zero rate")
+	}
+	assert.NotContains(t, scrapeMetrics(metricsAllocator), metrics.IPPoolExhaustionTimestampMetricName+"{")
+
+	// Allocations make the exhaustion known right away
+	tracker.Record(testKey, 50)
+	fakeClock.Step(forecastInterval)
+	err = handler.updateForecast(ipPool)
+	assert.Nil(t, err)
+	ipPool = getIPPool()
+	if assert.NotNil(t, ipPool.Status.Forecast) && assert.NotNil(t, ipPool.Status.Forecast.ExhaustionTime) {
+		assert.True(t, ipPool.Status.Forecast.ExhaustionTime.After(fakeClock.Now()))
+	}
+	assert.Contains(t, scrapeMetrics(metricsAllocator), metrics.IPPoolExhaustionTimestampMetricName+"{")
+	persisted := ipPool.Status.Forecast.DeepCopy()
+
+	// The status isn't updated again until the persist interval is over,
+	// while the metrics are
+	tracker.Record(testKey, 10)
+	fakeClock.Step(forecastInterval)
+	err = handler.updateForecast(ipPool)
+	assert.Nil(t, err)
+	ipPool = getIPPool()
+	assert.Equal(t, persisted, ipPool.Status.Forecast)
+
+	fakeClock.Step(forecastPersistInterval)
+	err = handler.updateForecast(ipPool)
+	assert.Nil(t, err)
+	ipPool = getIPPool()
+	assert.NotEqual(t, persisted.LastUpdate, ipPool.Status.Forecast.LastUpdate)
+
+	// A restart resumes from the persisted rate
+	handler.allocationTracker = forecast.NewTracker(fakeClock, forecast.DefaultWindow, forecast.DefaultSmoothingPeriod)
+	persisted = ipPool.Status.Forecast.DeepCopy()
+	fakeClock.Step(forecastPersistInterval)
+	err = handler.updateForecast(ipPool)
+	assert.Nil(t, err)
+	ipPool = getIPPool()
+	assert.Equal(t, persisted.NetAllocationRate, ipPool.Status.Forecast.NetAllocationRate)
+}
+
+func TestHandler_RestorePinnedAllocations(t *testing.T) {
+	pin := func(allocations ...util.PinnedAllocation) map[string]string {
+		data, err := json.Marshal(allocations)
+		assert.Nil(t, err)
+		return map[string]string{util.PinnedAllocationsAnnotationKey: string(data)}
+	}
+	givenVMs := []runtime.Object{
+		&kubevirtv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: testIPPoolNamespace,
+				Name:      "vm-1",
+				Annotations: pin(
+					util.PinnedAllocation{MACAddress: testMAC1, IPAddress: testAllocatedIP1, IPPool: testKey},
+					util.PinnedAllocation{MACAddress: testMAC2, IPAddress: testAllocatedIP2, IPPool: testIPPoolNamespace + "/net-2"},
+				),
+			},
+		},
+		&kubevirtv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   testIPPoolNamespace,
+				Name:        "vm-2",
+				Annotations: pin(util.PinnedAllocation{MACAddress: "33:44:55:66:77:88", IPAddress: "192.168.0.50", IPPool: testKey}),
+			},
+		},
+		&kubevirtv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   testIPPoolNamespace,
+				Name:        "vm-3",
+				Annotations: map[string]string{util.PinnedAllocationsAnnotationKey: "not json"},
+			},
+		},
+	}
+
+	// The IPPool was recreated, e.g., by a reinstall, so its status is blank
+	newHandler := func(annotation string) Handler {
+		clientset := fake.NewSimpleClientset(givenVMs...)
+		return Handler{
+			cacheAllocator:              newTestCacheAllocatorBuilder().Build(),
+			ipAllocator:                 newTestIPAllocatorBuilder().Build(),
+			metricsAllocator:            metrics.New(),
+			clock:                       clock.RealClock{},
+			pinnedAllocationsAnnotation: annotation,
+			vmCache:                     fakeclient.VirtualMachineCache(clientset.KubevirtV1().VirtualMachines),
+		}
+	}
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP1).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).Build()
+
+	t.Run("pinned allocations are restored", func(t *testing.T) {
+		handler := newHandler(util.PinnedAllocationsAnnotationKey)
+
+		status, err := handler.BuildCache(givenIPPool, givenIPPool.Status)
+		assert.Nil(t, err)
+
+		assert.Equal(t, map[string]string{testAllocatedIP1: testMAC1}, util.Leases(status.IPv4), "only the allocation pinned to the ippool within its range should be restored")
+		assert.Equal(t, int64(1), status.AllocationRevision)
+
+		ip, err := handler.cacheAllocator.GetIPByMAC(testNetworkName, testMAC1)
+		assert.Nil(t, err)
+		assert.Equal(t, testAllocatedIP1, ip)
+		_, err = handler.ipAllocator.AllocateIP(testNetworkName, testAllocatedIP1)
+		assert.ErrorIs(t, err, ipam.ErrAlreadyAllocated, "restored ip should not be allocated to another vm")
+
+		// Restoring again changes nothing
+		givenIPPool := givenIPPool.DeepCopy()
+		givenIPPool.Status = status
+		restored := *status.DeepCopy()
+		assert.Nil(t, handler.restorePinnedAllocations(givenIPPool, &restored))
+		assert.Equal(t, status, restored)
+	})
+
+	t.Run("pinned allocations disabled", func(t *testing.T) {
+		handler := newHandler("")
+
+		status, err := handler.BuildCache(givenIPPool, givenIPPool.Status)
+		assert.Nil(t, err)
+		assert.Empty(t, util.Leases(status.IPv4))
+		assert.Equal(t, int64(0), status.AllocationRevision)
+	})
+}
+
+func TestHandler_IPv6(t *testing.T) {
+	const (
+		testIPv6CIDR     = "2001:db8::/120"
+		testIPv6ServerIP = "2001:db8::1"
+		testIPv6StartIP  = "2001:db8::1"
+		testIPv6EndIP    = "2001:db8::10"
+		testIPv6Lease    = "2001:db8::5"
+	)
+	ipv6IPAMName := util.IPv6IPAMNameOf(testNetworkName)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	newIPPool := func() *networkv1.IPPool {
+		ipPool := newTestIPPoolBuilder().
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			IPv6PoolRange(testIPv6CIDR, testIPv6ServerIP, testIPv6StartIP, testIPv6EndIP).
+			SchemaVersion(networkv1.IPPoolStatusSchemaVersion).Build()
+		ipPool.Spec.IPv6Config.Pool.Exclude = []string{"2001:0db8::9"}
+		ipPool.Status.IPv6 = &networkv1.IPv6Status{
+			Entries: map[string]networkv1.AllocationEntry{
+				testIPv6Lease: {Type: networkv1.AllocationTypeLease, Owner: testMAC1},
+			},
+		}
+		return ipPool
+	}
+
+	t.Run("build cache", func(t *testing.T) {
+		givenIPPool := newIPPool()
+
+		handler := Handler{
+			cacheAllocator:   newTestCacheAllocatorBuilder().Build(),
+			ipAllocator:      newTestIPAllocatorBuilder().Build(),
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+		}
+
+		_, err := handler.BuildCache(givenIPPool, givenIPPool.Status)
+		assert.Nil(t, err)
+
+		assert.True(t, handler.ipAllocator.IsNetworkInitialized(testNetworkName))
+		isAllocated, err := handler.ipAllocator.IsAllocated(ipv6IPAMName, testIPv6Lease)
+		assert.Nil(t, err)
+		assert.True(t, isAllocated)
+		ip, err := handler.cacheAllocator.GetIPByMAC(ipv6IPAMName, testMAC1)
+		assert.Nil(t, err)
+		assert.Equal(t, testIPv6Lease, ip)
+		// 16 addresses less the server and the excluded ones
+		available, err := handler.ipAllocator.GetAvailable(ipv6IPAMName)
+		assert.Nil(t, err)
+		assert.Equal(t, 13, available)
+
+		// Dropping the ipv6 config drops its ipam as well
+		givenIPPool.Spec.IPv6Config = nil
+		assert.Nil(t, handler.buildIPAM(givenIPPool))
+		assert.False(t, handler.ipAllocator.IsNetworkInitialized(ipv6IPAMName))
+		assert.True(t, handler.ipAllocator.IsNetworkInitialized(testNetworkName))
+	})
+
+	t.Run("status", func(t *testing.T) {
+		givenIPPool := newIPPool()
+
+		handler := Handler{
+			cacheAllocator:   newTestCacheAllocatorBuilder().Build(),
+			ipAllocator:      newTestIPAllocatorBuilder().Build(),
+			metricsAllocator: metrics.New(),
+			clock:            clock.NewFakeClock(now),
+		}
+		assert.Nil(t, handler.buildIPAM(givenIPPool))
+
+		ipPoolCpy := givenIPPool.DeepCopy()
+		assert.Nil(t, handler.syncIPv6Status(givenIPPool, ipPoolCpy))
+
+		since := metav1.NewTime(now)
+		assert.Equal(t, &networkv1.IPv6Status{
+			Entries: map[string]networkv1.AllocationEntry{
+				testIPv6Lease:    {Type: networkv1.AllocationTypeLease, Owner: testMAC1},
+				testIPv6ServerIP: {Type: networkv1.AllocationTypeReserved, Since: &since},
+				"2001:db8::9":    {Type: networkv1.AllocationTypeExcluded, Since: &since},
+			},
+			Used:      1,
+			Available: 13,
+		}, ipPoolCpy.Status.IPv6)
+
+		givenIPPool.Spec.IPv6Config = nil
+		assert.Nil(t, handler.syncIPv6Status(givenIPPool, ipPoolCpy))
+		assert.Nil(t, ipPoolCpy.Status.IPv6)
+	})
 }
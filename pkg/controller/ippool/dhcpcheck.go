@@ -0,0 +1,374 @@
+package ippool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rancher/wrangler/v3/pkg/kv"
+	"github.com/rancher/wrangler/v3/pkg/relatedresource"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/agent/dhcpcheck"
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/ipam"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+const (
+	dhcpCheckPodSuffix     = "-dhcp-check"
+	dhcpCheckPodLabelValue = "dhcp-check"
+
+	// dhcpCheckTimeout is how long a DHCP check may take, the scheduling of
+	// the checker Pod included, before it's taken as failed.
+	dhcpCheckTimeout = 2 * time.Minute
+
+	// reasonDHCPCheckInProgress is the reason of the warning events on the
+	// IPPools asked for a DHCP check while one is running.
+	reasonDHCPCheckInProgress = "DHCPCheckInProgress"
+)
+
+// OnDHCPCheck runs the DHCP check asked for with the run-dhcp-check annotation
+// and follows the one running until its checker Pod reports back. The
+// annotation is removed once the check is launched, or refused as another one
+// is running.
+func (h *Handler) OnDHCPCheck(key string, ipPool *networkv1.IPPool) (*networkv1.IPPool, error) {
+	if ipPool == nil || ipPool.DeletionTimestamp != nil {
+		return ipPool, nil
+	}
+
+	if isDHCPCheckRunning(ipPool) {
+		var err error
+		if ipPool, err = h.trackDHCPCheck(ipPool); err != nil {
+			return ipPool, err
+		}
+	}
+
+	if ipPool.Annotations[util.RunDHCPCheckAnnotationKey] != "true" {
+		return ipPool, nil
+	}
+
+	if isDHCPCheckRunning(ipPool) {
+		logrus.Warnf("(ippool.OnDHCPCheck) dhcp check of ippool %s is still running, drop the new one", key)
+		if h.recorder != nil {
+			h.recorder.Eventf(ipPool, corev1.EventTypeWarning, reasonDHCPCheckInProgress,
+				"DHCP check %s is still running; the new one was dropped", ipPool.Status.LastCheck.PodName)
+		}
+		return h.removeDHCPCheckAnnotation(ipPool)
+	}
+
+	ipPool, err := h.startDHCPCheck(ipPool)
+	if err != nil {
+		return ipPool, err
+	}
+
+	return h.removeDHCPCheckAnnotation(ipPool)
+}
+
+// ipPoolOfDHCPCheckPod returns the key of the IPPool a checker Pod runs the
+// DHCP check of.
+func ipPoolOfDHCPCheckPod(_, _ string, obj runtime.Object) ([]relatedresource.Key, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Labels[vmDHCPControllerLabelKey] != dhcpCheckPodLabelValue {
+		return nil, nil
+	}
+
+	ipPoolNamespace, ipPoolName := pod.Labels[util.IPPoolNamespaceLabelKey], pod.Labels[util.IPPoolNameLabelKey]
+	if ipPoolNamespace == "" || ipPoolName == "" {
+		return nil, nil
+	}
+
+	return []relatedresource.Key{
+		{
+			Namespace: ipPoolNamespace,
+			Name:      ipPoolName,
+		},
+	}, nil
+}
+
+func isDHCPCheckRunning(ipPool *networkv1.IPPool) bool {
+	return ipPool.Status.LastCheck != nil && ipPool.Status.LastCheck.State == networkv1.DHCPCheckRunning
+}
+
+// startDHCPCheck sets an IP address aside in the IPAM for the test MAC
+// address, records it as the running check so the agent serves it, and
+// launches the checker Pod. Checks which can't run are recorded as failed
+// right away.
+func (h *Handler) startDHCPCheck(ipPool *networkv1.IPPool) (*networkv1.IPPool, error) {
+	macAddress := util.DHCPCheckMACAddress(ipPool)
+	ipamName := util.IPAMName(ipPool)
+
+	var reason string
+	switch {
+	case ipPool.Spec.Paused != nil && *ipPool.Spec.Paused:
+		reason = "ippool is administratively disabled"
+	case h.noAgent:
+		reason = "controller runs without agents"
+	case !networkv1.CacheReady.IsTrue(ipPool) || !h.ipAllocator.IsNetworkInitialized(ipamName):
+		reason = "ipam of ippool is not ready"
+	case !networkv1.AgentReady.IsTrue(ipPool):
+		reason = "agent of ippool is not ready"
+	}
+	if reason != "" {
+		return h.finishDHCPCheck(ipPool, newFailedDHCPCheck(macAddress, reason, h.clock.Now()))
+	}
+
+	if inUse, err := h.cacheAllocator.HasMAC(ipamName, macAddress); err != nil {
+		return ipPool, err
+	} else if inUse {
+		return h.finishDHCPCheck(ipPool, newFailedDHCPCheck(macAddress, fmt.Sprintf("test mac address %s is leased to a vm", macAddress), h.clock.Now()))
+	}
+
+	nadNamespace, nadName := kv.RSplit(ipPool.Spec.NetworkName, "/")
+	nad, err := h.nadCache.Get(nadNamespace, nadName)
+	if err != nil {
+		return ipPool, err
+	}
+	clusterNetwork, ok := nad.Labels[clusterNetworkLabelKey]
+	if !ok {
+		return h.finishDHCPCheck(ipPool, newFailedDHCPCheck(macAddress, fmt.Sprintf("could not find clusternetwork for nad %s", ipPool.Spec.NetworkName), h.clock.Now()))
+	}
+
+	ipAddress, err := h.ipAllocator.AllocateIP(ipamName, "")
+	if err != nil {
+		if errors.Is(err, ipam.ErrExhausted) {
+			return h.finishDHCPCheck(ipPool, newFailedDHCPCheck(macAddress, "no ip address left for the test lease", h.clock.Now()))
+		}
+		return ipPool, err
+	}
+
+	pod := prepareDHCPCheckPod(ipPool, h.agentNamespace, clusterNetwork, h.agentImage, macAddress)
+
+	// The test lease is recorded before the checker Pod exists, so it's
+	// released even if the controller goes away in between
+	now := metav1.NewTime(h.clock.Now())
+	ipPoolCpy := ipPool.DeepCopy()
+	ipPoolCpy.Status.LastCheck = &networkv1.DHCPCheck{
+		State:      networkv1.DHCPCheckRunning,
+		PodName:    pod.Name,
+		MACAddress: macAddress,
+		IPAddress:  ipAddress,
+		StartTime:  &now,
+	}
+	updatedIPPool, err := h.ippoolClient.UpdateStatus(ipPoolCpy)
+	if err != nil {
+		if deallocErr := h.ipAllocator.DeallocateIP(ipamName, ipAddress); deallocErr != nil {
+			logrus.Warnf("(ippool.startDHCPCheck) cannot release test lease %s of ippool %s/%s: %s", ipAddress, ipPool.Namespace, ipPool.Name, deallocErr.Error())
+		}
+		return ipPool, err
+	}
+
+	if _, err := h.podClient.Create(pod); err != nil && !apierrors.IsAlreadyExists(err) {
+		return h.finishDHCPCheck(updatedIPPool, failDHCPCheck(updatedIPPool.Status.LastCheck, fmt.Sprintf("cannot create checker pod: %s", err.Error()), h.clock.Now()))
+	}
+
+	logrus.Infof("(ippool.startDHCPCheck) dhcp check %s of ippool %s/%s started with test lease %s for %s", pod.Name, ipPool.Namespace, ipPool.Name, ipAddress, macAddress)
+
+	// Checker Pods stuck in scheduling are given up on in time
+	if h.ippoolController != nil {
+		h.ippoolController.EnqueueAfter(ipPool.Namespace, ipPool.Name, dhcpCheckTimeout)
+	}
+
+	return updatedIPPool, nil
+}
+
+// trackDHCPCheck records the result of the running check once its checker
+// Pod is done, gone, or out of time.
+func (h *Handler) trackDHCPCheck(ipPool *networkv1.IPPool) (*networkv1.IPPool, error) {
+	check := ipPool.Status.LastCheck
+
+	pod, err := h.podCache.Get(h.agentNamespace, check.PodName)
+	if apierrors.IsNotFound(err) {
+		// The checker Pod just created may not be in the cache yet
+		pod, err = h.podClient.Get(h.agentNamespace, check.PodName, metav1.GetOptions{})
+	}
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return ipPool, err
+		}
+		return h.finishDHCPCheck(ipPool, failDHCPCheck(check, fmt.Sprintf("checker pod %s is gone", check.PodName), h.clock.Now()))
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded, corev1.PodFailed:
+		return h.finishDHCPCheck(ipPool, dhcpCheckFromPod(check, pod, h.clock.Now()))
+	}
+
+	var elapsed time.Duration
+	if check.StartTime != nil {
+		elapsed = h.clock.Since(check.StartTime.Time)
+	}
+	if elapsed >= dhcpCheckTimeout {
+		return h.finishDHCPCheck(ipPool, failDHCPCheck(check, fmt.Sprintf("checker pod %s did not finish within %s", check.PodName, dhcpCheckTimeout), h.clock.Now()))
+	}
+
+	if h.ippoolController != nil {
+		h.ippoolController.EnqueueAfter(ipPool.Namespace, ipPool.Name, dhcpCheckTimeout-elapsed)
+	}
+	return ipPool, nil
+}
+
+// finishDHCPCheck records the finished check, then releases its test lease
+// and removes its checker Pod. The agent stops serving the test lease as soon
+// as the check isn't running anymore.
+func (h *Handler) finishDHCPCheck(ipPool *networkv1.IPPool, check *networkv1.DHCPCheck) (*networkv1.IPPool, error) {
+	ipAddress, _, hasLease := util.DHCPCheckLease(ipPool)
+	podName := ""
+	if isDHCPCheckRunning(ipPool) {
+		podName = ipPool.Status.LastCheck.PodName
+	}
+
+	ipPoolCpy := ipPool.DeepCopy()
+	ipPoolCpy.Status.LastCheck = check
+	updatedIPPool, err := h.ippoolClient.UpdateStatus(ipPoolCpy)
+	if err != nil {
+		return ipPool, err
+	}
+
+	if check.State == networkv1.DHCPCheckFailed {
+		logrus.Warnf("(ippool.finishDHCPCheck) dhcp check of ippool %s/%s failed: %s", ipPool.Namespace, ipPool.Name, check.Message)
+	} else {
+		logrus.Infof("(ippool.finishDHCPCheck) dhcp check of ippool %s/%s succeeded in %dms", ipPool.Namespace, ipPool.Name, check.LatencyMilliseconds)
+	}
+
+	if hasLease {
+		if err := h.ipAllocator.DeallocateIP(util.IPAMName(ipPool), ipAddress); err != nil {
+			logrus.Warnf("(ippool.finishDHCPCheck) cannot release test lease %s of ippool %s/%s: %s", ipAddress, ipPool.Namespace, ipPool.Name, err.Error())
+		}
+	}
+
+	if podName != "" {
+		if err := h.podClient.Delete(h.agentNamespace, podName, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return updatedIPPool, err
+		}
+	}
+
+	return updatedIPPool, nil
+}
+
+func (h *Handler) removeDHCPCheckAnnotation(ipPool *networkv1.IPPool) (*networkv1.IPPool, error) {
+	ipPoolCpy := ipPool.DeepCopy()
+	delete(ipPoolCpy.Annotations, util.RunDHCPCheckAnnotationKey)
+	return h.ippoolClient.Update(ipPoolCpy)
+}
+
+func newFailedDHCPCheck(macAddress, message string, now time.Time) *networkv1.DHCPCheck {
+	startTime := metav1.NewTime(now)
+	return failDHCPCheck(&networkv1.DHCPCheck{
+		MACAddress: macAddress,
+		StartTime:  &startTime,
+	}, message, now)
+}
+
+func failDHCPCheck(check *networkv1.DHCPCheck, message string, now time.Time) *networkv1.DHCPCheck {
+	completionTime := metav1.NewTime(now)
+	check = check.DeepCopy()
+	check.State = networkv1.DHCPCheckFailed
+	check.CompletionTime = &completionTime
+	check.Message = message
+	return check
+}
+
+// dhcpCheckFromPod reads the result the checker reported in the termination
+// message of its container.
+func dhcpCheckFromPod(check *networkv1.DHCPCheck, pod *corev1.Pod, now time.Time) *networkv1.DHCPCheck {
+	var terminated *corev1.ContainerStateTerminated
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		if containerStatus.Name == "checker" {
+			terminated = containerStatus.State.Terminated
+		}
+	}
+	if terminated == nil {
+		return failDHCPCheck(check, fmt.Sprintf("checker pod %s ended without running", pod.Name), now)
+	}
+
+	result, err := dhcpcheck.ParseResult(terminated.Message)
+	if err != nil {
+		return failDHCPCheck(check, fmt.Sprintf("checker pod %s exited with code %d and no result", pod.Name, terminated.ExitCode), now)
+	}
+
+	completionTime := metav1.NewTime(now)
+	check = check.DeepCopy()
+	check.State = networkv1.DHCPCheckSucceeded
+	check.CompletionTime = &completionTime
+	check.LatencyMilliseconds = result.LatencyMilliseconds
+	check.Options = result.Options
+	check.Message = result.Message
+	if !result.Succeeded {
+		check.State = networkv1.DHCPCheckFailed
+	} else if result.IPAddress != check.IPAddress {
+		check.State = networkv1.DHCPCheckFailed
+		check.Message = fmt.Sprintf("lease %s acknowledged rather than the test lease %s", result.IPAddress, check.IPAddress)
+	}
+	return check
+}
+
+func prepareDHCPCheckPod(
+	ipPool *networkv1.IPPool,
+	agentNamespace string,
+	clusterNetwork string,
+	agentImage *config.Image,
+	macAddress string,
+) *corev1.Pod {
+	nadNamespace, nadName := kv.RSplit(ipPool.Spec.NetworkName, "/")
+	networks := []Network{
+		{
+			Namespace:     nadNamespace,
+			Name:          nadName,
+			InterfaceName: "eth1",
+			MACAddress:    macAddress,
+		},
+	}
+	networksStr, _ := json.Marshal(networks)
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				multusNetworksAnnotationKey: string(networksStr),
+			},
+			Labels: map[string]string{
+				vmDHCPControllerLabelKey:     dhcpCheckPodLabelValue,
+				util.IPPoolNamespaceLabelKey: ipPool.Namespace,
+				util.IPPoolNameLabelKey:      ipPool.Name,
+				util.IPPoolUIDLabelKey:       string(ipPool.UID),
+			},
+			Name:      util.SafeAgentConcatName(ipPool.Namespace, ipPool.Name) + dhcpCheckPodSuffix,
+			Namespace: agentNamespace,
+		},
+		Spec: corev1.PodSpec{
+			Affinity:      clusterNetworkAffinity(clusterNetwork),
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{
+				{
+					Name:            "checker",
+					Image:           agentImage.String(),
+					ImagePullPolicy: corev1.PullIfNotPresent,
+					Args: []string{
+						"check",
+						"--mac", macAddress,
+						"--server-ip", ipPool.Spec.IPv4Config.ServerIP,
+						"--timeout", dhcpcheck.DefaultTimeout.String(),
+					},
+					TerminationMessagePath:   dhcpcheck.TerminationMessagePath,
+					TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+					SecurityContext: &corev1.SecurityContext{
+						RunAsUser:  &runAsUserID,
+						RunAsGroup: &runAsGroupID,
+						Capabilities: &corev1.Capabilities{
+							Add: []corev1.Capability{
+								"NET_ADMIN",
+								"NET_RAW",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,49 @@
+package ippool
+
+import (
+	"fmt"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// reasonExternalIPAMUnavailable is the reason of the Degraded condition of the
+// IPPools whose external IPAM is given up on after failing repeatedly.
+const reasonExternalIPAMUnavailable = "ExternalIPAMUnavailable"
+
+// GuardExternalIPAM marks the IPPool as degraded while the webhook of its
+// external IPAM is given up on, and clears the condition once it works again.
+// A Degraded condition set for another reason is left as it is.
+func (h *Handler) GuardExternalIPAM(ipPool *networkv1.IPPool, status networkv1.IPPoolStatus) (networkv1.IPPoolStatus, error) {
+	if h.externalIPAM == nil {
+		return status, nil
+	}
+
+	key := ipPool.Namespace + "/" + ipPool.Name
+	if ipPool.Spec.ExternalIPAM == nil {
+		h.externalIPAM.Forget(key)
+	}
+
+	reason := networkv1.Degraded.GetReason(&status)
+	if unavailable, lastErr := h.externalIPAM.Unavailable(key); unavailable {
+		if networkv1.Degraded.IsTrue(&status) && reason != reasonExternalIPAMUnavailable {
+			return status, nil
+		}
+		message := fmt.Sprintf("external ipam %s failed repeatedly, allocations follow the %s failure policy", ipPool.Spec.ExternalIPAM.URL, util.ExternalIPAMFailurePolicy(ipPool))
+		if lastErr != nil {
+			message += ": " + lastErr.Error()
+		}
+		networkv1.Degraded.True(&status)
+		networkv1.Degraded.Reason(&status, reasonExternalIPAMUnavailable)
+		networkv1.Degraded.Message(&status, message)
+		return status, nil
+	}
+
+	if reason == reasonExternalIPAMUnavailable {
+		networkv1.Degraded.False(&status)
+		networkv1.Degraded.Reason(&status, "")
+		networkv1.Degraded.Message(&status, "")
+	}
+
+	return status, nil
+}
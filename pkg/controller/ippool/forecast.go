@@ -0,0 +1,96 @@
+package ippool
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/forecast"
+)
+
+const (
+	forecastInterval = 5 * time.Minute
+	// forecastPersistInterval is how often the forecast is written to the
+	// IPPool status at most, unless it turns known or unknown. The metrics
+	// are updated on each pass.
+	forecastPersistInterval = time.Hour
+)
+
+// runForecast updates the exhaustion forecasts of the IPPools right away and
+// then periodically until ctx is done.
+func (h *Handler) runForecast(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(context.Context) {
+		if err := h.updateForecasts(); err != nil {
+			logrus.Errorf("(ippool.updateForecasts) %s", err.Error())
+		}
+	}, forecastInterval)
+}
+
+// updateForecasts updates the exhaustion forecast of each IPPool.
+func (h *Handler) updateForecasts() error {
+	if h.cachesSynced != nil && !h.cachesSynced() {
+		logrus.Debug("(ippool.updateForecasts) caches not synced yet, skip")
+		return nil
+	}
+
+	ipPools, err := h.ippoolCache.List("", labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, ipPool := range ipPools {
+		if err := h.updateForecast(ipPool); err != nil {
+			logrus.Errorf("(ippool.updateForecast) ippool %s/%s: %s", ipPool.Namespace, ipPool.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// updateForecast evaluates the net allocation rate of ipPool, and publishes it
+// along with when the available addresses run out at that rate. The rate
+// persisted in the status seeds the evaluation after a restart, and the
+// status is only updated coarsely so the periodic pass doesn't churn it.
+func (h *Handler) updateForecast(ipPool *networkv1.IPPool) error {
+	// The tracker isn't set up in tests not caring about it
+	if h.allocationTracker == nil || ipPool.DeletionTimestamp != nil || ipPool.Status.IPv4 == nil {
+		return nil
+	}
+
+	key := ipPool.Namespace + "/" + ipPool.Name
+	previous := ipPool.Status.Forecast
+
+	var seed float64
+	if previous != nil {
+		seed, _ = strconv.ParseFloat(previous.NetAllocationRate, 64)
+	}
+
+	now := h.clock.Now()
+	rate := h.allocationTracker.Evaluate(key, seed)
+	exhaustion, known := forecast.Exhaustion(now, ipPool.Status.IPv4.Available, rate)
+	h.metricsAllocator.UpdateIPPoolForecast(key, rate, exhaustion, known)
+
+	if previous != nil && (previous.ExhaustionTime != nil) == known && now.Sub(previous.LastUpdate.Time) < forecastPersistInterval {
+		return nil
+	}
+
+	ipPoolCpy := ipPool.DeepCopy()
+	ipPoolCpy.Status.Forecast = &networkv1.AllocationForecast{
+		NetAllocationRate: strconv.FormatFloat(rate, 'f', 2, 64),
+		LastUpdate:        metav1.NewTime(now),
+	}
+	if known {
+		exhaustionTime := metav1.NewTime(exhaustion)
+		ipPoolCpy.Status.Forecast.ExhaustionTime = &exhaustionTime
+	}
+
+	logrus.Debugf("(ippool.updateForecast) ippool %s allocates %s addresses per hour, exhaustion known: %t", key, ipPoolCpy.Status.Forecast.NetAllocationRate, known)
+	_, err := h.ippoolClient.UpdateStatus(ipPoolCpy)
+	return err
+}
@@ -0,0 +1,44 @@
+package ippool
+
+import (
+	"fmt"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// reasonInvalidGateway is the reason of the Degraded condition of the IPPools
+// whose server or router IP address isn't a host address of their CIDR.
+const reasonInvalidGateway = "InvalidGateway"
+
+// GuardGateways marks the IPPool as degraded while its server or router IP
+// address isn't a host address of its CIDR, e.g., an IPPool admitted before
+// the webhook checked them, as the VMs would get a gateway they can't reach.
+// It's checked with util.ValidateGatewayAddrs, like the webhook does. The
+// IPPools which cannot be parsed are left to the IPAM to report, and a
+// Degraded condition set for another reason is left as it is.
+func (h *Handler) GuardGateways(ipPool *networkv1.IPPool, status networkv1.IPPoolStatus) (networkv1.IPPoolStatus, error) {
+	reason := networkv1.Degraded.GetReason(&status)
+
+	var err error
+	if pi, loadErr := util.LoadPool(ipPool); loadErr == nil {
+		err = util.ValidateGatewayAddrs(pi)
+	}
+	if err != nil {
+		if networkv1.Degraded.IsTrue(&status) && reason != reasonInvalidGateway {
+			return status, nil
+		}
+		networkv1.Degraded.True(&status)
+		networkv1.Degraded.Reason(&status, reasonInvalidGateway)
+		networkv1.Degraded.Message(&status, fmt.Sprintf("ippool %s/%s: %s", ipPool.Namespace, ipPool.Name, err.Error()))
+		return status, nil
+	}
+
+	if reason == reasonInvalidGateway {
+		networkv1.Degraded.False(&status)
+		networkv1.Degraded.Reason(&status, "")
+		networkv1.Degraded.Message(&status, "")
+	}
+
+	return status, nil
+}
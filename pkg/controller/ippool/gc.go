@@ -0,0 +1,122 @@
+package ippool
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+const (
+	agentPodGCInterval    = time.Minute
+	agentPodGCGracePeriod = 2 * time.Minute
+
+	orphanedAgentPodReason = "OrphanedAgentPod"
+)
+
+// runAgentPodGC sweeps orphaned agent Pods right away and then periodically
+// until ctx is done.
+func (h *Handler) runAgentPodGC(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(context.Context) {
+		if err := h.collectOrphanedAgentPods(); err != nil {
+			logrus.Errorf("(ippool.collectOrphanedAgentPods) %s", err.Error())
+		}
+	}, agentPodGCInterval)
+}
+
+// collectOrphanedAgentPods deletes the agent Pods whose IPPool no longer
+// exists. It happens when an IPPool is deleted while the controller is down,
+// as its finalizer never gets to remove the agent. A Pod is only deleted
+// after being seen orphaned for the whole grace period, so a briefly
+// inconsistent cache doesn't take down a working agent.
+func (h *Handler) collectOrphanedAgentPods() error {
+	if h.cachesSynced != nil && !h.cachesSynced() {
+		logrus.Debug("(ippool.collectOrphanedAgentPods) caches not synced yet, skip")
+		return nil
+	}
+	if !h.upgrade.IsDone() {
+		logrus.Debug("(ippool.collectOrphanedAgentPods) objects of former releases not upgraded yet, skip")
+		return nil
+	}
+
+	sets := labels.Set{
+		vmDHCPControllerLabelKey: "agent",
+	}
+	pods, err := h.podCache.List(h.agentNamespace, sets.AsSelector())
+	if err != nil {
+		return err
+	}
+
+	orphaned := make(map[string]time.Time, len(h.orphanedAgentPods))
+	for _, pod := range pods {
+		isOrphaned, err := h.isOrphanedAgentPod(pod)
+		if err != nil {
+			return err
+		}
+		if !isOrphaned {
+			continue
+		}
+
+		key := pod.Namespace + "/" + pod.Name
+		since, ok := h.orphanedAgentPods[key]
+		if !ok {
+			since = h.clock.Now()
+			logrus.Infof("(ippool.collectOrphanedAgentPods) agent pod %s has no backing ippool %s/%s", key, pod.Labels[util.IPPoolNamespaceLabelKey], pod.Labels[util.IPPoolNameLabelKey])
+		}
+		if h.clock.Since(since) < agentPodGCGracePeriod {
+			orphaned[key] = since
+			continue
+		}
+
+		logrus.Infof("(ippool.collectOrphanedAgentPods) remove orphaned agent pod %s", key)
+		if h.recorder != nil {
+			h.recorder.Eventf(pod, corev1.EventTypeWarning, orphanedAgentPodReason,
+				"Deleting agent pod as its ippool %s/%s no longer exists",
+				pod.Labels[util.IPPoolNamespaceLabelKey], pod.Labels[util.IPPoolNameLabelKey])
+		}
+		if err := h.podClient.Delete(pod.Namespace, pod.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			orphaned[key] = since
+			return err
+		}
+	}
+	h.orphanedAgentPods = orphaned
+
+	return nil
+}
+
+// isOrphanedAgentPod reports whether the IPPool the agent Pod was deployed
+// for is gone. An IPPool recreated with the same name doesn't count, which
+// is told apart by the UID label. Pods deployed before the label was
+// introduced are matched by name only.
+func (h *Handler) isOrphanedAgentPod(pod *corev1.Pod) (bool, error) {
+	ipPoolNamespace, ok := pod.Labels[util.IPPoolNamespaceLabelKey]
+	if !ok {
+		return false, nil
+	}
+	ipPoolName, ok := pod.Labels[util.IPPoolNameLabelKey]
+	if !ok {
+		return false, nil
+	}
+
+	ipPool, err := h.ippoolCache.Get(ipPoolNamespace, ipPoolName)
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	uid, ok := pod.Labels[util.IPPoolUIDLabelKey]
+	if !ok || uid == "" || ipPool.UID == "" {
+		return false, nil
+	}
+
+	return uid != string(ipPool.UID), nil
+}
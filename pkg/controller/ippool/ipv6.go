@@ -0,0 +1,131 @@
+package ippool
+
+import (
+	"github.com/sirupsen/logrus"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// buildIPv6IPAM initializes the IPAM and MAC caches of the IPv6 addressing of
+// ipPool from its spec and status, or drops them if it has none.
+func (h *Handler) buildIPv6IPAM(ipPool *networkv1.IPPool) error {
+	ipamName := util.IPv6IPAMName(ipPool)
+	ipv6Config := ipPool.Spec.IPv6Config
+	if ipv6Config == nil {
+		h.ipAllocator.DeleteIPSubnet(ipamName)
+		h.cacheAllocator.DeleteMACSet(ipamName)
+		return nil
+	}
+
+	logrus.Infof("(ippool.BuildCache) initialize ipv6 ipam for ippool %s/%s", ipPool.Namespace, ipPool.Name)
+	if err := h.ipAllocator.NewIPSubnet(
+		ipamName,
+		ipv6Config.CIDR,
+		ipv6Config.Pool.Start,
+		util.IPv6PoolEnd(ipPool),
+		false,
+	); err != nil {
+		return err
+	}
+	if err := h.cacheAllocator.NewMACSet(ipamName); err != nil {
+		return err
+	}
+
+	// The IPAM keys its addresses by their canonical form, which the spec
+	// doesn't have to be written in
+	revoked := append([]string{ipv6Config.ServerIP, ipv6Config.Router}, ipv6Config.Pool.Exclude...)
+	for _, ip := range revoked {
+		if ip == "" {
+			continue
+		}
+		if err := h.ipAllocator.RevokeIP(ipamName, util.CanonicalIP(ip)); err != nil {
+			return err
+		}
+		logrus.Debugf("(ippool.BuildCache) ip %s was revoked in ipam %s", ip, ipamName)
+	}
+
+	for ip, mac := range util.IPv6Leases(ipPool.Status.IPv6) {
+		if _, err := h.ipAllocator.AllocateIP(ipamName, ip); err != nil {
+			return err
+		}
+		if err := h.cacheAllocator.AddMAC(ipamName, mac, ip); err != nil {
+			return err
+		}
+		logrus.Infof("(ippool.BuildCache) previously allocated ip %s was re-allocated in ipam %s", ip, ipamName)
+	}
+
+	return nil
+}
+
+// syncIPv6Status records the reserved and excluded addresses of the IPv6
+// addressing of ipPool in the status of ipPoolCpy, along with the usage of its
+// IPAM. The IPv6 status goes away with the IPv6 config.
+func (h *Handler) syncIPv6Status(ipPool, ipPoolCpy *networkv1.IPPool) error {
+	ipv6Config := ipPool.Spec.IPv6Config
+	if ipv6Config == nil {
+		ipPoolCpy.Status.IPv6 = nil
+		return nil
+	}
+
+	ipamName := util.IPv6IPAMName(ipPool)
+	// BuildCache sets it up shortly, as the IPv6 config is among its inputs
+	if !h.ipAllocator.IsNetworkInitialized(ipamName) {
+		return nil
+	}
+
+	ipv6Status := ipPoolCpy.Status.IPv6
+	if ipv6Status == nil {
+		ipv6Status = new(networkv1.IPv6Status)
+	}
+
+	used, err := h.ipAllocator.GetUsed(ipamName)
+	if err != nil {
+		return err
+	}
+	ipv6Status.Used = used
+
+	available, err := h.ipAllocator.GetAvailable(ipamName)
+	if err != nil {
+		return err
+	}
+	ipv6Status.Available = available
+
+	// Reserved and excluded entries are derived from the spec, so the ones
+	// no longer in it go away
+	for ip, entry := range ipv6Status.Entries {
+		if entry.Type != networkv1.AllocationTypeLease {
+			delete(ipv6Status.Entries, ip)
+		}
+	}
+	start, end := ipv6Config.Pool.Start, util.IPv6PoolEnd(ipPool)
+	reserved := networkv1.AllocationEntry{Type: networkv1.AllocationTypeReserved}
+	for _, ip := range []string{ipv6Config.ServerIP, ipv6Config.Router} {
+		if ip != "" && util.IsIPInBetweenOf(ip, start, end) {
+			h.setIPv6Entry(ipPool, ipv6Status, ip, reserved)
+		}
+	}
+	for _, ip := range ipv6Config.Pool.Exclude {
+		h.setIPv6Entry(ipPool, ipv6Status, ip, networkv1.AllocationEntry{Type: networkv1.AllocationTypeExcluded})
+	}
+	// For DeepEqual
+	if len(ipv6Status.Entries) == 0 {
+		ipv6Status.Entries = nil
+	}
+
+	ipPoolCpy.Status.IPv6 = ipv6Status
+
+	return nil
+}
+
+// setIPv6Entry records entry for ip in ipv6Status, keeping the timestamp the
+// previous status of ipPool had for the same entry.
+func (h *Handler) setIPv6Entry(ipPool *networkv1.IPPool, ipv6Status *networkv1.IPv6Status, ip string, entry networkv1.AllocationEntry) {
+	ip = util.CanonicalIP(ip)
+	if ipPool.Status.IPv6 != nil {
+		if previous, ok := ipPool.Status.IPv6.Entries[ip]; ok && previous.Type == entry.Type {
+			entry.Since = previous.Since
+		}
+	}
+	util.SetIPv6AllocationEntry(ipv6Status, ip, entry, h.clock.Now())
+}
@@ -0,0 +1,71 @@
+package ippool
+
+import (
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/rancher/wrangler/v3/pkg/relatedresource"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// reasonDanglingIPPoolReference is the reason of the warning events on the
+// NetworkAttachmentDefinitions labeled with an IPPool which doesn't exist.
+const reasonDanglingIPPoolReference = "DanglingIPPoolReference"
+
+// OnNADChange warns with an event on the NetworkAttachmentDefinition when its
+// IPPool labels point to an IPPool which doesn't exist, e.g., as the labels
+// were set by hand with a typo or the IPPool was deleted. Allocations on the
+// network fail until either is fixed, which is otherwise only seen in the
+// conditions of the VirtualMachineNetworkConfigs.
+func (h *Handler) OnNADChange(key string, nad *cniv1.NetworkAttachmentDefinition) (*cniv1.NetworkAttachmentDefinition, error) {
+	if nad == nil || nad.DeletionTimestamp != nil {
+		return nad, nil
+	}
+
+	ipPoolNamespace, hasNamespace := nad.Labels[util.IPPoolNamespaceLabelKey]
+	ipPoolName, hasName := nad.Labels[util.IPPoolNameLabelKey]
+	if !hasNamespace || !hasName {
+		return nad, nil
+	}
+
+	_, err := h.ippoolCache.Get(ipPoolNamespace, ipPoolName)
+	if !apierrors.IsNotFound(err) {
+		return nad, err
+	}
+
+	logrus.Warnf("(ippool.OnNADChange) nad %s is labeled with ippool %s/%s which doesn't exist", key, ipPoolNamespace, ipPoolName)
+	if h.recorder != nil {
+		h.recorder.Eventf(nad, corev1.EventTypeWarning, reasonDanglingIPPoolReference,
+			"IPPool %s/%s referenced by the labels does not exist; VMs on the network get no IP address until it's created or the labels are fixed",
+			ipPoolNamespace, ipPoolName)
+	}
+
+	return nad, nil
+}
+
+// nadsOfIPPool returns the keys of the NetworkAttachmentDefinitions labeled
+// with the IPPool, so they're checked again whenever it's created or deleted.
+func (h *Handler) nadsOfIPPool(namespace, name string, _ runtime.Object) ([]relatedresource.Key, error) {
+	selector := labels.SelectorFromSet(labels.Set{
+		util.IPPoolNamespaceLabelKey: namespace,
+		util.IPPoolNameLabelKey:      name,
+	})
+	nads, err := h.nadCache.List(metav1.NamespaceAll, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]relatedresource.Key, 0, len(nads))
+	for _, nad := range nads {
+		keys = append(keys, relatedresource.Key{
+			Namespace: nad.Namespace,
+			Name:      nad.Name,
+		})
+	}
+	return keys, nil
+}
@@ -0,0 +1,95 @@
+package ippool
+
+import (
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// restorePinnedAllocations records again in status the IP addresses of
+// ipPool pinned on the VMs which it lacks a lease of, e.g., after the IPPool
+// was recreated by a reinstall. IP addresses out of the pool range, reserved,
+// excluded, or leased to another MAC address are left alone, as are MAC
+// addresses leased another IP address already. The allocation revision moves
+// on if any lease is restored. It's a no-op unless the pinned allocations are
+// enabled.
+func (h *Handler) restorePinnedAllocations(ipPool *networkv1.IPPool, status *networkv1.IPPoolStatus) error {
+	if h.pinnedAllocationsAnnotation == "" {
+		return nil
+	}
+
+	key := ipPool.Namespace + "/" + ipPool.Name
+
+	vms, err := h.vmCache.List("", labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	ipv4Status := status.IPv4
+	if ipv4Status == nil {
+		ipv4Status = new(networkv1.IPv4Status)
+	}
+
+	unavailable := map[string]struct{}{
+		ipPool.Spec.IPv4Config.ServerIP: {},
+		ipPool.Spec.IPv4Config.Router:   {},
+	}
+	for ip := range h.externalIPs(ipPool) {
+		unavailable[ip] = struct{}{}
+	}
+	for _, ip := range ipPool.Spec.IPv4Config.Pool.Exclude {
+		unavailable[ip] = struct{}{}
+	}
+
+	leasedMACs := make(map[string]string)
+	for ip, mac := range util.Leases(ipv4Status) {
+		leasedMACs[util.NormalizeMAC(mac)] = ip
+	}
+	entries := util.AllocationEntries(ipv4Status)
+
+	var restored int
+	for _, vm := range vms {
+		pinned, err := util.PinnedAllocations(vm.Annotations, h.pinnedAllocationsAnnotation)
+		if err != nil {
+			logrus.Warnf("(ippool.restorePinnedAllocations) vm %s/%s: %s", vm.Namespace, vm.Name, err.Error())
+			continue
+		}
+
+		for _, allocation := range pinned {
+			ip, mac := allocation.IPAddress, util.NormalizeMAC(allocation.MACAddress)
+			if allocation.IPPool != key || leasedMACs[mac] != "" {
+				continue
+			}
+			if _, ok := entries[ip]; ok {
+				logrus.Warnf("(ippool.restorePinnedAllocations) ip %s pinned on vm %s/%s is taken in ippool %s", ip, vm.Namespace, vm.Name, key)
+				continue
+			}
+			if _, ok := unavailable[ip]; ok || !util.IsIPInBetweenOf(ip, ipPool.Spec.IPv4Config.Pool.Start, util.PoolEnd(ipPool)) {
+				logrus.Warnf("(ippool.restorePinnedAllocations) ip %s pinned on vm %s/%s is not allocatable from ippool %s", ip, vm.Namespace, vm.Name, key)
+				continue
+			}
+
+			entry := networkv1.AllocationEntry{
+				Type:      networkv1.AllocationTypeLease,
+				Owner:     allocation.MACAddress,
+				Namespace: vm.Namespace,
+			}
+			util.SetAllocationEntry(ipv4Status, ip, entry, h.clock.Now())
+			entries[ip] = entry
+			leasedMACs[mac] = ip
+			restored++
+			logrus.Infof("(ippool.restorePinnedAllocations) restored lease %s of %s pinned on vm %s/%s in ippool %s", ip, allocation.MACAddress, vm.Namespace, vm.Name, key)
+		}
+	}
+
+	if restored > 0 {
+		status.IPv4 = ipv4Status
+		status.AllocationRevision++
+		status.LastChange = metav1.NewTime(h.clock.Now())
+	}
+
+	return nil
+}
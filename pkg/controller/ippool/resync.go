@@ -0,0 +1,296 @@
+package ippool
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// reasonResynced is the reason of the events about the resyncs run on
+// IPPools.
+const reasonResynced = "Resynced"
+
+// OnResync runs the resync asked for with the resync annotation, once per
+// request ID. The allocations recorded in the IPPool status are checked
+// against the VirtualMachineNetworkConfigs and the IPAM and MAC caches, the
+// drift is repaired, and the caches are rebuilt from the repaired status. The
+// outcome is recorded in the status, which the agent takes as its cue to
+// resync its leases in full. The annotation is left in place.
+func (h *Handler) OnResync(key string, ipPool *networkv1.IPPool) (*networkv1.IPPool, error) {
+	if ipPool == nil || ipPool.DeletionTimestamp != nil {
+		return ipPool, nil
+	}
+
+	requestID := ipPool.Annotations[util.ResyncAnnotationKey]
+	if requestID == "" || (ipPool.Status.LastResync != nil && ipPool.Status.LastResync.RequestID == requestID) {
+		return ipPool, nil
+	}
+
+	if ipPool.Spec.Paused != nil && *ipPool.Spec.Paused {
+		return h.finishResync(ipPool.DeepCopy(), requestID, networkv1.ResyncRepairs{}, "ippool is administratively disabled")
+	}
+
+	// The caches are only checked against a status they were built from
+	if !networkv1.CacheReady.IsTrue(ipPool) {
+		return ipPool, fmt.Errorf("ippool %s is not ready; resync %s postponed", key, requestID)
+	}
+	if !util.IsStatusCurrent(ipPool) {
+		return ipPool, fmt.Errorf("status of ippool %s predates schema version %d; resync %s postponed", key, networkv1.IPPoolStatusSchemaVersion, requestID)
+	}
+
+	if err := h.waitForWarmup(ipPool); err != nil {
+		return ipPool, err
+	}
+	if !h.upgrade.IsDone() {
+		return ipPool, fmt.Errorf("resync %s of ippool %s postponed: %w", requestID, key, config.ErrUpgrading)
+	}
+
+	if delay := h.resyncLimiter.Wait(); delay > 0 {
+		logrus.Infof("(ippool.OnResync) resync %s of ippool %s held back for %s", requestID, key, delay)
+		// The controller isn't set up in tests not caring about it
+		if h.ippoolController != nil {
+			h.ippoolController.EnqueueAfter(ipPool.Namespace, ipPool.Name, delay)
+		}
+		return ipPool, nil
+	}
+
+	return h.resync(ipPool, requestID)
+}
+
+// resync repairs the drift of ipPool and rebuilds its caches.
+func (h *Handler) resync(ipPool *networkv1.IPPool, requestID string) (*networkv1.IPPool, error) {
+	key := ipPool.Namespace + "/" + ipPool.Name
+	logrus.Infof("(ippool.resync) run resync %s of ippool %s", requestID, key)
+
+	var repairs networkv1.ResyncRepairs
+
+	// The caches are checked against the status they were built from, before
+	// it's repaired
+	ipamName := util.IPAMName(ipPool)
+	if h.ipAllocator.IsNetworkInitialized(ipamName) {
+		var err error
+		if repairs.IPAMEntries, repairs.MACEntries, err = h.cacheDrift(ipPool); err != nil {
+			return ipPool, err
+		}
+	}
+
+	vmNetCfgs, err := h.vmnetcfgCache.List("", labels.Everything())
+	if err != nil {
+		return ipPool, err
+	}
+
+	ipPoolCpy := ipPool.DeepCopy()
+	ipv4Status := ipPoolCpy.Status.IPv4
+	if ipv4Status == nil {
+		ipv4Status = new(networkv1.IPv4Status)
+	}
+
+	var unrepaired []string
+	repairs.StaleLeases = releaseStaleLeases(ipPool, ipv4Status, vmNetCfgs)
+	repairs.MissingLeases, unrepaired = h.restoreMissingLeases(ipPool, ipv4Status, vmNetCfgs)
+	if repairs.StaleLeases > 0 || repairs.MissingLeases > 0 {
+		ipPoolCpy.Status.IPv4 = ipv4Status
+	}
+
+	if err := h.buildIPAM(ipPoolCpy); err != nil {
+		return ipPool, err
+	}
+	ipPoolCpy.Status.AllocatorHash = util.AllocatorInputsHash(ipPool)
+
+	// The revision moves on without the changes being recorded, so the
+	// consumers of the leases export fall back to a full resync as well
+	if repairs.StaleLeases > 0 || repairs.MissingLeases > 0 {
+		ipPoolCpy.Status.AllocationRevision = ipPool.Status.AllocationRevision + 1
+		ipPoolCpy.Status.LastChange = metav1.NewTime(h.clock.Now())
+	}
+
+	return h.finishResync(ipPoolCpy, requestID, repairs, strings.Join(unrepaired, "; "))
+}
+
+// finishResync records the outcome of the resync in the status of ipPoolCpy.
+func (h *Handler) finishResync(ipPoolCpy *networkv1.IPPool, requestID string, repairs networkv1.ResyncRepairs, message string) (*networkv1.IPPool, error) {
+	now := metav1.NewTime(h.clock.Now())
+	ipPoolCpy.Status.LastResync = &networkv1.ResyncResult{
+		RequestID:      requestID,
+		CompletionTime: now,
+		Repairs:        repairs,
+		Message:        message,
+	}
+	ipPoolCpy.Status.LastUpdate = now
+
+	updated, err := h.ippoolClient.UpdateStatus(ipPoolCpy)
+	if err != nil {
+		return ipPoolCpy, err
+	}
+
+	logrus.Infof("(ippool.finishResync) resync %s of ippool %s/%s is done: %+v", requestID, ipPoolCpy.Namespace, ipPoolCpy.Name, repairs)
+	if h.recorder != nil {
+		eventType := corev1.EventTypeNormal
+		if message != "" {
+			message = "; " + message
+			eventType = corev1.EventTypeWarning
+		}
+		h.recorder.Eventf(updated, eventType, reasonResynced,
+			"Resync %s repaired %d stale and %d missing leases, %d IPAM and %d MAC cache entries%s",
+			requestID, repairs.StaleLeases, repairs.MissingLeases, repairs.IPAMEntries, repairs.MACEntries, message)
+	}
+
+	return updated, nil
+}
+
+// cacheDrift returns the amounts of IPAM and MAC cache entries of ipPool that
+// disagree with its status, i.e., the IP addresses allocated without a lease
+// or free despite one, and the MAC addresses cached with another IP address
+// than their lease, or without any.
+func (h *Handler) cacheDrift(ipPool *networkv1.IPPool) (int, int, error) {
+	ipamName := util.IPAMName(ipPool)
+	leases := util.Leases(ipPool.Status.IPv4)
+
+	allocated := make(map[string]struct{}, len(leases)+1)
+	leasedMACs := make(map[string]string, len(leases))
+	for ip, mac := range leases {
+		allocated[ip] = struct{}{}
+		leasedMACs[mac] = ip
+	}
+	// The test lease of a running DHCP check is only held in the IPAM
+	if ip, _, ok := util.DHCPCheckLease(ipPool); ok {
+		allocated[ip] = struct{}{}
+	}
+
+	ips, err := h.ipAllocator.ListAll(ipamName)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ipamDrift int
+	for ip := range allocated {
+		if ips[ip] != "true" {
+			ipamDrift++
+		}
+	}
+	for ip, isAllocated := range ips {
+		if _, ok := allocated[ip]; !ok && isAllocated == "true" {
+			ipamDrift++
+		}
+	}
+
+	macs, err := h.cacheAllocator.ListAll(ipamName)
+	if err != nil {
+		return 0, 0, err
+	}
+	var macDrift int
+	for mac, ip := range leasedMACs {
+		if cachedIP, ok := macs[mac]; !ok || cachedIP != ip {
+			macDrift++
+		}
+	}
+	for mac := range macs {
+		if _, ok := leasedMACs[mac]; !ok {
+			macDrift++
+		}
+	}
+
+	return ipamDrift, macDrift, nil
+}
+
+// releaseStaleLeases drops the leases of ipv4Status whose MAC address belongs
+// to no VirtualMachineNetworkConfig, and returns their amount.
+func releaseStaleLeases(ipPool *networkv1.IPPool, ipv4Status *networkv1.IPv4Status, vmNetCfgs []*networkv1.VirtualMachineNetworkConfig) int {
+	// The MAC addresses of the spec count as well, as the IPPool carries the
+	// lease before the VirtualMachineNetworkConfig status does
+	owned := make(map[string]struct{})
+	for _, vmNetCfg := range vmNetCfgs {
+		for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+			owned[util.NormalizeMAC(nc.MACAddress)] = struct{}{}
+		}
+		for _, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+			owned[util.NormalizeMAC(ncStatus.MACAddress)] = struct{}{}
+		}
+	}
+
+	var stale int
+	for ip, mac := range util.Leases(ipv4Status) {
+		if _, ok := owned[util.NormalizeMAC(mac)]; ok {
+			continue
+		}
+		util.DeleteAllocationEntry(ipv4Status, ip)
+		stale++
+		logrus.Infof("(ippool.resync) released stale lease %s of %s from ippool %s/%s", ip, mac, ipPool.Namespace, ipPool.Name)
+	}
+
+	return stale
+}
+
+// restoreMissingLeases records again in ipv4Status the IP addresses allocated
+// from the IPPool to VirtualMachineNetworkConfigs which it lacks a record of.
+// It returns their amount, and why the ones which couldn't be restored weren't.
+func (h *Handler) restoreMissingLeases(ipPool *networkv1.IPPool, ipv4Status *networkv1.IPv4Status, vmNetCfgs []*networkv1.VirtualMachineNetworkConfig) (int, []string) {
+	key := ipPool.Namespace + "/" + ipPool.Name
+
+	leasedMACs := make(map[string]string)
+	for ip, mac := range util.Leases(ipv4Status) {
+		leasedMACs[util.NormalizeMAC(mac)] = ip
+	}
+
+	var (
+		missing    int
+		unrepaired []string
+	)
+	for _, vmNetCfg := range vmNetCfgs {
+		for _, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+			ip := ncStatus.AllocatedIPAddress
+			if ncStatus.IPPoolRef != key || ncStatus.State != networkv1.AllocatedState || ip == "" {
+				continue
+			}
+			mac := util.NormalizeMAC(ncStatus.MACAddress)
+			if leasedMACs[mac] == ip {
+				continue
+			}
+
+			vmNetCfgKey := vmNetCfg.Namespace + "/" + vmNetCfg.Name
+			switch entry, ok := util.AllocationEntries(ipv4Status)[ip]; {
+			case ok:
+				unrepaired = append(unrepaired, fmt.Sprintf("ip %s of vmnetcfg %s is recorded as %s of %q", ip, vmNetCfgKey, entry.Type, entry.Owner))
+				continue
+			case leasedMACs[mac] != "":
+				unrepaired = append(unrepaired, fmt.Sprintf("mac %s of vmnetcfg %s holds ip %s rather than %s", ncStatus.MACAddress, vmNetCfgKey, leasedMACs[mac], ip))
+				continue
+			case !util.IsIPInBetweenOf(ip, ipPool.Spec.IPv4Config.Pool.Start, util.PoolEnd(ipPool)):
+				unrepaired = append(unrepaired, fmt.Sprintf("ip %s of vmnetcfg %s is out of the pool range", ip, vmNetCfgKey))
+				continue
+			}
+
+			var (
+				defaultRoute *bool
+				mode         networkv1.NetworkConfigMode
+			)
+			for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+				if util.NormalizeMAC(nc.MACAddress) == mac {
+					defaultRoute = nc.DefaultRoute
+					mode = nc.Mode
+				}
+			}
+			util.SetAllocationEntry(ipv4Status, ip, networkv1.AllocationEntry{
+				Type:         networkv1.AllocationTypeLease,
+				Owner:        ncStatus.MACAddress,
+				Namespace:    vmNetCfg.Namespace,
+				DefaultRoute: defaultRoute,
+				Mode:         mode,
+			}, h.clock.Now())
+			leasedMACs[mac] = ip
+			missing++
+			logrus.Infof("(ippool.resync) restored missing lease %s of %s of vmnetcfg %s in ippool %s", ip, ncStatus.MACAddress, vmNetCfgKey, key)
+		}
+	}
+	sort.Strings(unrepaired)
+
+	return missing, unrepaired
+}
@@ -0,0 +1,400 @@
+package ippool
+
+import (
+	"context"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	toolscache "k8s.io/client-go/tools/cache"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+const (
+	reasonVIPConflict = "VIPConflict"
+
+	// kubeVIPLoadBalancerIPsAnnotationKey lists the VIPs kube-vip is asked
+	// to serve a LoadBalancer Service on, comma-separated
+	kubeVIPLoadBalancerIPsAnnotationKey = "kube-vip.io/loadbalancerIPs"
+
+	// vipDiscoveryInterval is how often the optional VIP sources not served
+	// by the cluster are looked for again
+	vipDiscoveryInterval = 5 * time.Minute
+)
+
+// vipSource is a kind of object load balancer VIPs are read from.
+type vipSource struct {
+	gvr schema.GroupVersionResource
+	// optional sources are only watched once their CRD is installed
+	optional bool
+	vips     func(obj *unstructured.Unstructured) []string
+}
+
+var vipSources = []vipSource{
+	{
+		gvr:  corev1.SchemeGroupVersion.WithResource("services"),
+		vips: serviceVIPs,
+	},
+	{
+		gvr:      schema.GroupVersionResource{Group: "loadbalancer.harvesterhci.io", Version: "v1beta1", Resource: "loadbalancers"},
+		optional: true,
+		vips:     loadBalancerVIPs,
+	},
+}
+
+// serviceVIPs returns the VIPs of a LoadBalancer Service, whether requested
+// or already assigned.
+func serviceVIPs(obj *unstructured.Unstructured) []string {
+	var svc corev1.Service
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &svc); err != nil {
+		logrus.Warnf("(ippool.serviceVIPs) cannot convert service %s/%s: %s", obj.GetNamespace(), obj.GetName(), err.Error())
+		return nil
+	}
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return nil
+	}
+
+	ips := []string{svc.Spec.LoadBalancerIP}
+	if v := svc.Annotations[kubeVIPLoadBalancerIPsAnnotationKey]; v != "" {
+		ips = append(ips, strings.Split(v, ",")...)
+	}
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		ips = append(ips, ingress.IP)
+	}
+	return ips
+}
+
+// loadBalancerVIPs returns the VIP of a Harvester load balancer.
+func loadBalancerVIPs(obj *unstructured.Unstructured) []string {
+	address, _, _ := unstructured.NestedString(obj.Object, "status", "address")
+	return []string{address}
+}
+
+// normalizeVIPs returns the valid IPv4 addresses of ips, sorted and without
+// duplicates.
+func normalizeVIPs(ips []string) []string {
+	set := make(map[string]struct{}, len(ips))
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+		if err != nil || !addr.Is4() {
+			continue
+		}
+		set[addr.String()] = struct{}{}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	normalized := make([]string, 0, len(set))
+	for ip := range set {
+		normalized = append(normalized, ip)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// vipTracker keeps the VIPs of each load balancer object, keyed by its
+// resource and namespaced name.
+type vipTracker struct {
+	vips map[string][]string
+	// synced tells whether the VIPs of the sources watched at first are
+	// all known
+	synced bool
+	mutex  sync.RWMutex
+}
+
+func newVIPTracker() *vipTracker {
+	return &vipTracker{
+		vips: make(map[string][]string),
+	}
+}
+
+// set records the VIPs of the object, none for a removed one, and returns
+// the ones it gained and lost.
+func (t *vipTracker) set(key string, ips []string) (added, removed []string) {
+	ips = normalizeVIPs(ips)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	previous := make(map[string]struct{}, len(t.vips[key]))
+	for _, ip := range t.vips[key] {
+		previous[ip] = struct{}{}
+	}
+	for _, ip := range ips {
+		if _, ok := previous[ip]; ok {
+			delete(previous, ip)
+			continue
+		}
+		added = append(added, ip)
+	}
+	for ip := range previous {
+		removed = append(removed, ip)
+	}
+	sort.Strings(removed)
+
+	if len(ips) == 0 {
+		delete(t.vips, key)
+	} else {
+		t.vips[key] = ips
+	}
+	return added, removed
+}
+
+func (t *vipTracker) markSynced() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.synced = true
+}
+
+func (t *vipTracker) isSynced() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.synced
+}
+
+// all returns the VIPs of all the objects.
+func (t *vipTracker) all() map[string]struct{} {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	all := make(map[string]struct{})
+	for _, ips := range t.vips {
+		for _, ip := range ips {
+			all[ip] = struct{}{}
+		}
+	}
+	return all
+}
+
+// OnVIPChange records the VIPs of a load balancer object, none for a removed
+// one, and enqueues the IPPools whose range holds the VIPs gained or lost, so
+// they're kept out of, or given back to, the IPAM. A VIP landing on an IP
+// address already leased to a VM is warned about on its IPPool, as both now
+// answer on it and only taking either away settles it.
+func (h *Handler) OnVIPChange(key string, ips []string) error {
+	if h.vips == nil {
+		return nil
+	}
+
+	added, removed := h.vips.set(key, ips)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	ipPools, err := h.ippoolCache.List(metav1.NamespaceAll, labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, ipPool := range ipPools {
+		if ipPool.DeletionTimestamp != nil {
+			continue
+		}
+
+		var affected bool
+		leases := util.Leases(ipPool.Status.IPv4)
+		for _, ip := range added {
+			if !util.IsIPInBetweenOf(ip, ipPool.Spec.IPv4Config.Pool.Start, util.PoolEnd(ipPool)) {
+				continue
+			}
+			affected = true
+			mac, ok := leases[ip]
+			if !ok {
+				continue
+			}
+			logrus.Warnf("(ippool.OnVIPChange) vip %s of %s is leased to %s by ippool %s/%s", ip, key, mac, ipPool.Namespace, ipPool.Name)
+			if h.recorder != nil {
+				h.recorder.Eventf(ipPool, corev1.EventTypeWarning, reasonVIPConflict,
+					"IP address %s is leased to %s and is a VIP of %s as well", ip, mac, key)
+			}
+		}
+		for _, ip := range removed {
+			if util.IsIPInBetweenOf(ip, ipPool.Spec.IPv4Config.Pool.Start, util.PoolEnd(ipPool)) {
+				affected = true
+			}
+		}
+
+		// The controller isn't set up in tests not caring about it
+		if affected && h.ippoolController != nil {
+			logrus.Debugf("(ippool.OnVIPChange) vips of %s changed, enqueue ippool %s/%s", key, ipPool.Namespace, ipPool.Name)
+			h.ippoolController.Enqueue(ipPool.Namespace, ipPool.Name)
+		}
+	}
+
+	return nil
+}
+
+// vipIPs returns the load balancer VIPs that are within the pool range. The
+// ones leased to VMs are left out, as OnVIPChange warns about them instead.
+func (h *Handler) vipIPs(ipPool *networkv1.IPPool) map[string]struct{} {
+	if h.vips == nil {
+		return nil
+	}
+
+	vips := h.vips.all()
+	if len(vips) == 0 {
+		return nil
+	}
+
+	leases := util.Leases(ipPool.Status.IPv4)
+	ips := make(map[string]struct{})
+	for ip := range vips {
+		if !util.IsIPInBetweenOf(ip, ipPool.Spec.IPv4Config.Pool.Start, util.PoolEnd(ipPool)) {
+			continue
+		}
+		if _, ok := leases[ip]; ok {
+			continue
+		}
+		ips[ip] = struct{}{}
+	}
+
+	return ips
+}
+
+// externalIPs returns the IP addresses of the pool range used outside of the
+// IPAM, i.e., the ones of the known external hosts and the load balancer
+// VIPs. Until the VIPs are all known, the IP addresses already excluded are
+// kept as they are, so no VIP is handed out during the startup.
+func (h *Handler) externalIPs(ipPool *networkv1.IPPool) map[string]struct{} {
+	ips := knownExternalIPs(ipPool)
+	vips := h.vipIPs(ipPool)
+	if h.vips != nil && !h.vips.isSynced() {
+		if vips == nil {
+			vips = make(map[string]struct{})
+		}
+		for ip, entry := range util.AllocationEntries(ipPool.Status.IPv4) {
+			if entry.Type == networkv1.AllocationTypeExcluded {
+				vips[ip] = struct{}{}
+			}
+		}
+	}
+	if len(vips) == 0 {
+		return ips
+	}
+	if ips == nil {
+		ips = make(map[string]struct{}, len(vips))
+	}
+	for ip := range vips {
+		ips[ip] = struct{}{}
+	}
+	return ips
+}
+
+// runVIPWatch watches the objects load balancer VIPs are read from. The
+// optional sources not served by the cluster, e.g., the Harvester load
+// balancer when it's not installed, are skipped and looked for again every
+// vipDiscoveryInterval, so installing them later needs no restart.
+// Once the sources first watched are synced, all the IPPools are enqueued to
+// let go of the exclusions kept meanwhile that are no longer needed.
+func (h *Handler) runVIPWatch(ctx context.Context, client dynamic.Interface, discoveryClient discovery.DiscoveryInterface) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	watched := make(map[schema.GroupVersionResource]bool, len(vipSources))
+
+	wait.UntilWithContext(ctx, func(context.Context) {
+		for _, source := range vipSources {
+			if watched[source.gvr] {
+				continue
+			}
+			if source.optional && !isServed(discoveryClient, source.gvr) {
+				logrus.Debugf("(ippool.runVIPWatch) %s is not served, skip", source.gvr.String())
+				continue
+			}
+			h.watchVIPSource(factory, source)
+			watched[source.gvr] = true
+			logrus.Infof("(ippool.runVIPWatch) watching vips of %s", source.gvr.String())
+		}
+		factory.Start(ctx.Done())
+
+		if h.vips.isSynced() {
+			return
+		}
+		for gvr, ok := range factory.WaitForCacheSync(ctx.Done()) {
+			if !ok {
+				logrus.Warnf("(ippool.runVIPWatch) cannot sync %s", gvr.String())
+				return
+			}
+		}
+		h.vips.markSynced()
+		h.enqueueAll()
+	}, vipDiscoveryInterval)
+}
+
+func (h *Handler) enqueueAll() {
+	ipPools, err := h.ippoolCache.List(metav1.NamespaceAll, labels.Everything())
+	if err != nil {
+		logrus.Errorf("(ippool.enqueueAll) %s", err.Error())
+		return
+	}
+	for _, ipPool := range ipPools {
+		h.ippoolController.Enqueue(ipPool.Namespace, ipPool.Name)
+	}
+}
+
+func (h *Handler) watchVIPSource(factory dynamicinformer.DynamicSharedInformerFactory, source vipSource) {
+	resource := source.gvr.GroupResource().String()
+	onChange := func(obj interface{}) {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+		key := resource + "/" + u.GetNamespace() + "/" + u.GetName()
+		if err := h.OnVIPChange(key, source.vips(u)); err != nil {
+			logrus.Errorf("(ippool.watchVIPSource) %s", err.Error())
+		}
+	}
+	onDelete := func(obj interface{}) {
+		if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+		key := resource + "/" + u.GetNamespace() + "/" + u.GetName()
+		if err := h.OnVIPChange(key, nil); err != nil {
+			logrus.Errorf("(ippool.watchVIPSource) %s", err.Error())
+		}
+	}
+
+	_, err := factory.ForResource(source.gvr).Informer().AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    onChange,
+		UpdateFunc: func(_, obj interface{}) { onChange(obj) },
+		DeleteFunc: onDelete,
+	})
+	if err != nil {
+		logrus.Errorf("(ippool.watchVIPSource) cannot watch %s: %s", resource, err.Error())
+	}
+}
+
+// isServed tells whether the cluster serves the resource.
+func isServed(discoveryClient discovery.DiscoveryInterface, gvr schema.GroupVersionResource) bool {
+	resources, err := discoveryClient.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logrus.Warnf("(ippool.isServed) cannot discover %s: %s", gvr.GroupVersion().String(), err.Error())
+		}
+		return false
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == gvr.Resource {
+			return true
+		}
+	}
+	return false
+}
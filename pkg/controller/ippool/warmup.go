@@ -0,0 +1,97 @@
+package ippool
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// warmupRetryPeriod is how long an IPPool waits before being checked again
+// while the caches are warming up.
+const warmupRetryPeriod = time.Second
+
+// runWarmup warms up the IPAM and MAC caches once the IPPool cache has synced
+// and then lets the handlers touching them through.
+func (h *Handler) runWarmup(ctx context.Context) {
+	if h.cachesSynced != nil && !cache.WaitForCacheSync(ctx.Done(), h.cachesSynced) {
+		return
+	}
+
+	h.warmUp()
+	h.warmup.Done()
+}
+
+// warmUp builds the IPAM and MAC caches of the existing IPPools from their
+// status. The statuses still report the caches of the IPPools built before a
+// restart as ready, so the allocations made right after it would otherwise
+// take the IP addresses leased before then as free. IPPools the caches can't
+// be built for are left to BuildCache, which builds them once OnChange finds
+// them uninitialized, as for new IPPools.
+func (h *Handler) warmUp() {
+	ipPools, err := h.ippoolCache.List("", labels.Everything())
+	if err != nil {
+		logrus.Errorf("(ippool.warmUp) %s", err.Error())
+		return
+	}
+
+	var warmed int
+	for _, ipPool := range ipPools {
+		if ipPool.DeletionTimestamp != nil || (ipPool.Spec.Paused != nil && *ipPool.Spec.Paused) {
+			continue
+		}
+		// The status lacks the allocation records of a former schema
+		if !util.IsStatusCurrent(ipPool) {
+			continue
+		}
+		if h.ipAllocator.IsNetworkInitialized(util.IPAMName(ipPool)) {
+			continue
+		}
+
+		// The pinned allocations the status lacks are written to it first,
+		// as BuildCache leaves the IPPools warmed up alone
+		ipPoolCpy := ipPool.DeepCopy()
+		if err := h.restorePinnedAllocations(ipPoolCpy, &ipPoolCpy.Status); err != nil {
+			logrus.Warnf("(ippool.warmUp) cannot restore pinned allocations of ippool %s/%s: %s", ipPool.Namespace, ipPool.Name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(ipPoolCpy.Status, ipPool.Status) {
+			updated, err := h.ippoolClient.UpdateStatus(ipPoolCpy)
+			if err != nil {
+				logrus.Warnf("(ippool.warmUp) cannot restore pinned allocations of ippool %s/%s: %s", ipPool.Namespace, ipPool.Name, err.Error())
+				continue
+			}
+			ipPool = updated
+		}
+
+		if err := h.buildIPAM(ipPool); err != nil {
+			logrus.Warnf("(ippool.warmUp) cannot warm up ipam for ippool %s/%s: %s", ipPool.Namespace, ipPool.Name, err.Error())
+			continue
+		}
+		warmed++
+	}
+
+	logrus.Infof("(ippool.warmUp) warmed up ipam and mac caches of %d out of %d ippools", warmed, len(ipPools))
+}
+
+// waitForWarmup requeues the IPPool shortly and returns config.ErrWarmingUp
+// while the caches are warming up.
+func (h *Handler) waitForWarmup(ipPool *networkv1.IPPool) error {
+	if h.warmup.IsDone() {
+		return nil
+	}
+
+	// The controller isn't set up in tests not caring about it
+	if h.ippoolController != nil {
+		h.ippoolController.EnqueueAfter(ipPool.Namespace, ipPool.Name, warmupRetryPeriod)
+	}
+	return fmt.Errorf("ippool %s/%s: %w", ipPool.Namespace, ipPool.Name, config.ErrWarmingUp)
+}
@@ -0,0 +1,439 @@
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	ctlcorev1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/core/v1"
+	ctlcniv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/k8s.cni.cncf.io/v1"
+	ctlkubevirtv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/kubevirt.io/v1"
+	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+const (
+	// SchemaVersion is the version of the invariants the objects are
+	// upgraded to. It's bumped whenever a release relies on something the
+	// objects written by former releases may lack. Version 2 stores MAC
+	// addresses in their canonical form only.
+	SchemaVersion = 2
+
+	// MarkerName is the name of the ConfigMap, in the namespace of the
+	// controller, recording the outcome of the last upgrade
+	MarkerName = "vm-dhcp-controller-upgrade"
+
+	schemaVersionKey  = "schemaVersion"
+	completionTimeKey = "completionTime"
+	failuresKey       = "failures"
+
+	// vmLabelKey is the label the vm controller tells the
+	// VirtualMachineNetworkConfig of each VM with
+	vmLabelKey = "harvesterhci.io/vmName"
+)
+
+// Failure is an object the upgrade couldn't bring in line, as recorded in the
+// marker.
+type Failure struct {
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+type Handler struct {
+	namespace              string
+	typedAllocationEntries bool
+
+	clock clock.Clock
+	// upgrade is marked as done once the objects are upgraded, letting the
+	// destructive actions of the other controllers through
+	upgrade *config.Upgrade
+	// cachesSynced reports whether the caches the upgrade reads have synced
+	cachesSynced func() bool
+
+	vmnetcfgClient  ctlnetworkv1.VirtualMachineNetworkConfigClient
+	vmnetcfgCache   ctlnetworkv1.VirtualMachineNetworkConfigCache
+	ippoolClient    ctlnetworkv1.IPPoolClient
+	ippoolCache     ctlnetworkv1.IPPoolCache
+	nadCache        ctlcniv1.NetworkAttachmentDefinitionCache
+	vmCache         ctlkubevirtv1.VirtualMachineCache
+	configMapClient ctlcorev1.ConfigMapClient
+}
+
+// Register runs the upgrade once the caches have synced. It's a one-shot job
+// rather than a handler, as it has to be done with every object before the
+// other controllers act on what any of them lacks.
+func Register(ctx context.Context, management *config.Management) error {
+	vmnetcfgs := management.HarvesterNetworkFactory.Network().V1alpha1().VirtualMachineNetworkConfig()
+	ippools := management.HarvesterNetworkFactory.Network().V1alpha1().IPPool()
+	nads := management.CniFactory.K8s().V1().NetworkAttachmentDefinition()
+	vms := management.KubeVirtFactory.Kubevirt().V1().VirtualMachine()
+
+	handler := &Handler{
+		namespace:              management.Options.AgentNamespace,
+		typedAllocationEntries: management.Options.TypedAllocationEntries,
+
+		clock:   management.Clock,
+		upgrade: management.Upgrade,
+		cachesSynced: func() bool {
+			return vmnetcfgs.Informer().HasSynced() && ippools.Informer().HasSynced() &&
+				nads.Informer().HasSynced() && vms.Informer().HasSynced()
+		},
+
+		vmnetcfgClient: vmnetcfgs,
+		vmnetcfgCache:  vmnetcfgs.Cache(),
+		ippoolClient:   ippools,
+		ippoolCache:    ippools.Cache(),
+		nadCache:       nads.Cache(),
+		vmCache:        vms.Cache(),
+		// The marker is read through the client rather than a cache so the
+		// ConfigMaps of the whole cluster aren't held in memory
+		configMapClient: management.CoreFactory.Core().V1().ConfigMap(),
+	}
+
+	go handler.run(ctx)
+
+	return nil
+}
+
+// run upgrades the objects once the caches have synced and then lets the
+// destructive actions of the other controllers through. They're let through
+// even if some objects couldn't be upgraded, as those are recorded in the
+// marker and retried on the next start.
+func (h *Handler) run(ctx context.Context) {
+	if h.cachesSynced != nil && !cache.WaitForCacheSync(ctx.Done(), h.cachesSynced) {
+		return
+	}
+
+	if err := h.Upgrade(); err != nil {
+		logrus.Errorf("(upgrade.Upgrade) %s", err.Error())
+	}
+	h.upgrade.Done()
+}
+
+// Upgrade brings the IPPools and VirtualMachineNetworkConfigs written by
+// former releases in line with the invariants of SchemaVersion, unless the
+// marker tells it's done already. The outcome is recorded in the marker, whose
+// schema version is only advanced once every object is upgraded.
+func (h *Handler) Upgrade() error {
+	marker, err := h.configMapClient.Get(h.namespace, MarkerName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		marker = nil
+	} else if err != nil {
+		return err
+	}
+
+	if marker != nil {
+		if version, err := strconv.Atoi(marker.Data[schemaVersionKey]); err == nil && version >= SchemaVersion {
+			logrus.Debugf("(upgrade.Upgrade) objects are at schema version %d already", version)
+			return nil
+		}
+	}
+
+	logrus.Infof("(upgrade.Upgrade) upgrade objects to schema version %d", SchemaVersion)
+
+	var failures []Failure
+	ipPoolFailures, err := h.upgradeIPPools()
+	if err != nil {
+		return err
+	}
+	failures = append(failures, ipPoolFailures...)
+	vmNetCfgFailures, err := h.upgradeVmNetCfgs()
+	if err != nil {
+		return err
+	}
+	failures = append(failures, vmNetCfgFailures...)
+
+	for _, failure := range failures {
+		logrus.Warnf("(upgrade.Upgrade) cannot upgrade %s %s: %s", failure.Kind, failure.Key, failure.Reason)
+	}
+	logrus.Infof("(upgrade.Upgrade) upgrade to schema version %d done with %d failures", SchemaVersion, len(failures))
+
+	return h.recordMarker(marker, failures)
+}
+
+// recordMarker writes the outcome of the upgrade to the marker, creating it if
+// it doesn't exist yet.
+func (h *Handler) recordMarker(marker *corev1.ConfigMap, failures []Failure) error {
+	if failures == nil {
+		failures = []Failure{}
+	}
+	failuresJSON, err := json.Marshal(failures)
+	if err != nil {
+		return err
+	}
+
+	exists := marker != nil
+	if !exists {
+		marker = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: h.namespace,
+				Name:      MarkerName,
+			},
+		}
+	} else {
+		marker = marker.DeepCopy()
+	}
+	if marker.Data == nil {
+		marker.Data = make(map[string]string)
+	}
+	if len(failures) == 0 {
+		marker.Data[schemaVersionKey] = strconv.Itoa(SchemaVersion)
+	}
+	marker.Data[completionTimeKey] = h.clock.Now().UTC().Format(time.RFC3339)
+	marker.Data[failuresKey] = string(failuresJSON)
+
+	if exists {
+		_, err = h.configMapClient.Update(marker)
+	} else {
+		_, err = h.configMapClient.Create(marker)
+	}
+	return err
+}
+
+// upgradeIPPools migrates the legacy allocation records of the IPPools to
+// typed entries, when enabled, and normalizes the MAC addresses they hold.
+// IPPools carrying records in both formats are left for an operator to sort
+// out, as the webhook rejects them.
+func (h *Handler) upgradeIPPools() ([]Failure, error) {
+	ipPools, err := h.ippoolCache.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ipPools, func(i, j int) bool {
+		return ipPools[i].Namespace+"/"+ipPools[i].Name < ipPools[j].Namespace+"/"+ipPools[j].Name
+	})
+
+	var failures []Failure
+	for _, ipPool := range ipPools {
+		if ipPool.DeletionTimestamp != nil {
+			continue
+		}
+		key := ipPool.Namespace + "/" + ipPool.Name
+
+		if util.IsMixedAllocationFormat(ipPool.Status.IPv4) {
+			failures = append(failures, Failure{Kind: "IPPool", Key: key, Reason: "status carries allocation records in both the legacy and the typed format"})
+			continue
+		}
+
+		ipPoolCpy := ipPool.DeepCopy()
+		migrated := h.typedAllocationEntries && util.MigrateAllocated(ipPoolCpy.Status.IPv4, h.clock.Now())
+		for _, reason := range normalizeIPPoolMACs(&ipPoolCpy.Status) {
+			failures = append(failures, Failure{Kind: "IPPool", Key: key, Reason: reason})
+		}
+		if reflect.DeepEqual(ipPoolCpy.Status, ipPool.Status) {
+			continue
+		}
+		if _, err := h.ippoolClient.UpdateStatus(ipPoolCpy); err != nil {
+			failures = append(failures, Failure{Kind: "IPPool", Key: key, Reason: err.Error()})
+			continue
+		}
+		if migrated {
+			logrus.Infof("(upgrade.upgradeIPPools) migrated allocation records of ippool %s to typed entries", key)
+		} else {
+			logrus.Infof("(upgrade.upgradeIPPools) normalized mac addresses of ippool %s", key)
+		}
+	}
+
+	return failures, nil
+}
+
+// upgradeVmNetCfgs gives the VirtualMachineNetworkConfigs the VM label and
+// owner reference the vm controller sets nowadays, and back-fills the IPPool
+// of their allocations, each only if it's missing. The MAC addresses of their
+// specs and statuses are normalized along the way.
+func (h *Handler) upgradeVmNetCfgs() ([]Failure, error) {
+	vmNetCfgs, err := h.vmnetcfgCache.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(vmNetCfgs, func(i, j int) bool {
+		return vmNetCfgs[i].Namespace+"/"+vmNetCfgs[i].Name < vmNetCfgs[j].Namespace+"/"+vmNetCfgs[j].Name
+	})
+
+	var failures []Failure
+	for _, vmNetCfg := range vmNetCfgs {
+		if vmNetCfg.DeletionTimestamp != nil {
+			continue
+		}
+		for _, reason := range h.upgradeVmNetCfg(vmNetCfg) {
+			failures = append(failures, Failure{
+				Kind:   "VirtualMachineNetworkConfig",
+				Key:    vmNetCfg.Namespace + "/" + vmNetCfg.Name,
+				Reason: reason,
+			})
+		}
+	}
+
+	return failures, nil
+}
+
+// upgradeVmNetCfg upgrades vmNetCfg and returns why the parts of it that
+// couldn't be upgraded couldn't.
+func (h *Handler) upgradeVmNetCfg(vmNetCfg *networkv1.VirtualMachineNetworkConfig) []string {
+	var reasons []string
+	key := vmNetCfg.Namespace + "/" + vmNetCfg.Name
+
+	vmName := vmNetCfg.Spec.VMName
+	if vmName == "" {
+		vmName = vmNetCfg.Name
+	}
+
+	// The ones of containers have no VM to be labeled with or owned by
+	_, isContainer := vmNetCfg.Annotations[util.CNIContainerIDAnnotationKey]
+
+	vmNetCfgCpy := vmNetCfg.DeepCopy()
+	if _, ok := vmNetCfgCpy.Labels[vmLabelKey]; !ok && !isContainer {
+		if vmNetCfgCpy.Labels == nil {
+			vmNetCfgCpy.Labels = make(map[string]string)
+		}
+		vmNetCfgCpy.Labels[vmLabelKey] = vmName
+	}
+	if !hasVMOwner(vmNetCfgCpy) && !isContainer {
+		vm, err := h.vmCache.Get(vmNetCfg.Namespace, vmName)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("cannot add owner reference: %s", err.Error()))
+		} else {
+			vmNetCfgCpy.OwnerReferences = append(vmNetCfgCpy.OwnerReferences, metav1.OwnerReference{
+				APIVersion: kubevirtv1.SchemeGroupVersion.String(),
+				Kind:       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+				Name:       vm.Name,
+				UID:        vm.UID,
+			})
+		}
+	}
+	for i := range vmNetCfgCpy.Spec.NetworkConfigs {
+		nc := &vmNetCfgCpy.Spec.NetworkConfigs[i]
+		if macAddress, err := util.ParseMAC(nc.MACAddress); err != nil {
+			reasons = append(reasons, fmt.Sprintf("cannot normalize network config of network %s: %s", nc.NetworkName, err.Error()))
+		} else {
+			nc.MACAddress = macAddress
+		}
+	}
+	if !reflect.DeepEqual(vmNetCfgCpy.ObjectMeta, vmNetCfg.ObjectMeta) || !reflect.DeepEqual(vmNetCfgCpy.Spec, vmNetCfg.Spec) {
+		updated, err := h.vmnetcfgClient.Update(vmNetCfgCpy)
+		if err != nil {
+			return append(reasons, err.Error())
+		}
+		logrus.Infof("(upgrade.upgradeVmNetCfg) added missing label and owner reference and normalized mac addresses of vmnetcfg %s", key)
+		vmNetCfg = updated
+	}
+
+	vmNetCfgCpy = vmNetCfg.DeepCopy()
+	for i, ncStatus := range vmNetCfgCpy.Status.NetworkConfigs {
+		if macAddress, err := util.ParseMAC(ncStatus.MACAddress); err != nil {
+			reasons = append(reasons, fmt.Sprintf("cannot normalize network config status of network %s: %s", ncStatus.NetworkName, err.Error()))
+		} else {
+			vmNetCfgCpy.Status.NetworkConfigs[i].MACAddress = macAddress
+		}
+		if ncStatus.State != networkv1.AllocatedState || ncStatus.AllocatedIPAddress == "" || ncStatus.IPPoolRef != "" {
+			continue
+		}
+		ipPoolRef, err := h.ipPoolRefOf(vmNetCfg.Namespace, ncStatus)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("cannot back-fill ippool of %s: %s", ncStatus.MACAddress, err.Error()))
+			continue
+		}
+		vmNetCfgCpy.Status.NetworkConfigs[i].IPPoolRef = ipPoolRef
+	}
+	if !reflect.DeepEqual(vmNetCfgCpy.Status, vmNetCfg.Status) {
+		if _, err := h.vmnetcfgClient.UpdateStatus(vmNetCfgCpy); err != nil {
+			return append(reasons, err.Error())
+		}
+		logrus.Infof("(upgrade.upgradeVmNetCfg) back-filled ippool references and normalized mac addresses of vmnetcfg %s", key)
+	}
+
+	return reasons
+}
+
+// ipPoolRefOf returns the IPPool the allocation of ncStatus was made from, as
+// a namespace/name pair. The IPPool is resolved from the network of ncStatus
+// the way the labels of its NetworkAttachmentDefinition tell, and is only
+// taken if it holds the lease of the allocation, as the labels may have
+// changed since.
+func (h *Handler) ipPoolRefOf(namespace string, ncStatus networkv1.NetworkConfigStatus) (string, error) {
+	ipPool, err := util.GetIPPoolFromNetworkName(h.nadCache, h.ippoolCache, ncStatus.NetworkName, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	ipPoolRef := ipPool.Namespace + "/" + ipPool.Name
+	entry, ok := util.AllocationEntries(ipPool.Status.IPv4)[ncStatus.AllocatedIPAddress]
+	if !ok || entry.Type != networkv1.AllocationTypeLease || util.NormalizeMAC(entry.Owner) != util.NormalizeMAC(ncStatus.MACAddress) {
+		return "", fmt.Errorf("ippool %s holds no lease of %s for it", ipPoolRef, ncStatus.AllocatedIPAddress)
+	}
+
+	return ipPoolRef, nil
+}
+
+// normalizeIPPoolMACs rewrites the MAC addresses held by the IPPool status in
+// their canonical form, the one the agents key their leases by. It returns
+// why the ones left as they are couldn't be normalized.
+func normalizeIPPoolMACs(status *networkv1.IPPoolStatus) []string {
+	var reasons []string
+	normalize := func(macAddress *string, ip string) {
+		normalized, err := util.ParseMAC(*macAddress)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("cannot normalize owner of %s: %s", ip, err.Error()))
+			return
+		}
+		*macAddress = normalized
+	}
+
+	if status.IPv4 != nil {
+		for ip, val := range status.IPv4.Allocated {
+			if val == util.ExcludedMark || val == util.ReservedMark {
+				continue
+			}
+			normalize(&val, ip)
+			status.IPv4.Allocated[ip] = val
+		}
+		for ip, entry := range status.IPv4.Entries {
+			if entry.Type != networkv1.AllocationTypeLease {
+				continue
+			}
+			normalize(&entry.Owner, ip)
+			status.IPv4.Entries[ip] = entry
+		}
+		for ip, conflict := range status.IPv4.Conflicts {
+			normalize(&conflict.MACAddress, ip)
+			status.IPv4.Conflicts[ip] = conflict
+		}
+	}
+	if status.IPv6 != nil {
+		for ip, entry := range status.IPv6.Entries {
+			if entry.Type != networkv1.AllocationTypeLease {
+				continue
+			}
+			normalize(&entry.Owner, ip)
+			status.IPv6.Entries[ip] = entry
+		}
+	}
+	sort.Strings(reasons)
+
+	return reasons
+}
+
+func hasVMOwner(vmNetCfg *networkv1.VirtualMachineNetworkConfig) bool {
+	for _, owner := range vmNetCfg.OwnerReferences {
+		if owner.Kind == kubevirtv1.VirtualMachineGroupVersionKind.Kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/ippool"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/vmnetcfg"
+	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
+)
+
+const (
+	testNamespace       = "harvester-system"
+	testVMNamespace     = "default"
+	testVMName          = "vm-1"
+	testVMUID           = "7f4e5c1a-0b1d-4f3e-9a5b-2c6d8e0f1a2b"
+	testOrphanName      = "vm-2"
+	testNADName         = "net-1"
+	testNetworkName     = testVMNamespace + "/" + testNADName
+	testIPPoolNamespace = "test"
+	testIPPoolName      = "pool-1"
+	testIPPoolKey       = testIPPoolNamespace + "/" + testIPPoolName
+
+	testIPAddress1  = "192.168.0.111"
+	testIPAddress2  = "192.168.0.150"
+	testMACAddress1 = "11:22:33:44:55:66"
+	testMACAddress2 = "22:33:44:55:66:77"
+)
+
+var nadGVR = schema.GroupVersionResource{
+	Group:    "k8s.cni.cncf.io",
+	Version:  "v1",
+	Resource: "network-attachment-definitions",
+}
+
+// newTestHandler returns a handler over the given objects, along with the
+// clientsets they're kept in.
+func newTestHandler(t *testing.T, typedAllocationEntries bool, configMaps []runtime.Object, objs ...runtime.Object) (*Handler, *fake.Clientset, *k8sfake.Clientset) {
+	nad := ippool.NewNetworkAttachmentDefinitionBuilder(testVMNamespace, testNADName).
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	clientset := fake.NewSimpleClientset(objs...)
+	err := clientset.Tracker().Create(nadGVR, nad, nad.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+	k8sclientset := k8sfake.NewSimpleClientset(configMaps...)
+
+	return &Handler{
+		namespace:              testNamespace,
+		typedAllocationEntries: typedAllocationEntries,
+		clock:                  clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+		upgrade:                config.NewUpgrade(),
+		vmnetcfgClient:         fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		vmnetcfgCache:          fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		ippoolClient:           fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:            fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:               fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		vmCache:                fakeclient.VirtualMachineCache(clientset.KubevirtV1().VirtualMachines),
+		configMapClient:        fakeclient.ConfigMapClient(k8sclientset.CoreV1().ConfigMaps),
+	}, clientset, k8sclientset
+}
+
+func newTestVM() *kubevirtv1.VirtualMachine {
+	return &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: testVMNamespace,
+			Name:      testVMName,
+			UID:       testVMUID,
+		},
+	}
+}
+
+// newTestIPPool returns an IPPool whose status was written by a former
+// release, in the legacy allocation format.
+func newTestIPPool() *networkv1.IPPool {
+	return ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+		ServerIP("192.168.0.2").
+		CIDR("192.168.0.0/24").
+		PoolRange("192.168.0.101", "192.168.0.200").
+		NetworkName(testNetworkName).
+		Allocated(testIPAddress1, testMACAddress1).Build()
+}
+
+func TestHandler_Upgrade(t *testing.T) {
+	t.Run("legacy objects", func(t *testing.T) {
+		// A vmnetcfg of a former release, lacking its label, owner reference
+		// and IPPool reference
+		givenVmNetCfg := vmnetcfg.NewVmNetCfgBuilder(testVMNamespace, testVMName).
+			WithVMName(testVMName).
+			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).Build()
+		// A vmnetcfg whose VM is gone, and whose allocation the IPPool holds
+		// no lease of
+		givenOrphanVmNetCfg := vmnetcfg.NewVmNetCfgBuilder(testVMNamespace, testOrphanName).
+			WithNetworkConfigStatus(testIPAddress2, testMACAddress2, testNetworkName, networkv1.AllocatedState).Build()
+
+		handler, clientset, k8sclientset := newTestHandler(t, true, nil, givenVmNetCfg, givenOrphanVmNetCfg, newTestIPPool(), newTestVM())
+
+		err := handler.Upgrade()
+		assert.Nil(t, err)
+
+		vmNetCfg, err := clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs(testVMNamespace).Get(context.TODO(), testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, testVMName, vmNetCfg.Labels[vmLabelKey])
+		assert.Equal(t, []metav1.OwnerReference{{
+			APIVersion: "kubevirt.io/v1",
+			Kind:       "VirtualMachine",
+			Name:       testVMName,
+			UID:        testVMUID,
+		}}, vmNetCfg.OwnerReferences)
+		assert.Equal(t, testIPPoolKey, vmNetCfg.Status.NetworkConfigs[0].IPPoolRef)
+
+		orphanVmNetCfg, err := clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs(testVMNamespace).Get(context.TODO(), testOrphanName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, testOrphanName, orphanVmNetCfg.Labels[vmLabelKey])
+		assert.Empty(t, orphanVmNetCfg.OwnerReferences)
+		assert.Empty(t, orphanVmNetCfg.Status.NetworkConfigs[0].IPPoolRef)
+
+		ipPool, err := clientset.NetworkV1alpha1().IPPools(testIPPoolNamespace).Get(context.TODO(), testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Nil(t, ipPool.Status.IPv4.Allocated)
+		assert.Equal(t, networkv1.AllocationTypeLease, ipPool.Status.IPv4.Entries[testIPAddress1].Type)
+		assert.Equal(t, testMACAddress1, ipPool.Status.IPv4.Entries[testIPAddress1].Owner)
+
+		// The failures are retried on the next start, so the schema version
+		// isn't advanced
+		marker, err := k8sclientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), MarkerName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.NotContains(t, marker.Data, schemaVersionKey)
+		assert.Equal(t, "2024-01-01T00:00:00Z", marker.Data[completionTimeKey])
+		var failures []Failure
+		assert.Nil(t, json.Unmarshal([]byte(marker.Data[failuresKey]), &failures))
+		assert.Len(t, failures, 2)
+		for _, failure := range failures {
+			assert.Equal(t, "VirtualMachineNetworkConfig", failure.Kind)
+			assert.Equal(t, testVMNamespace+"/"+testOrphanName, failure.Key)
+		}
+	})
+
+	t.Run("upgraded objects", func(t *testing.T) {
+		givenVmNetCfg := vmnetcfg.NewVmNetCfgBuilder(testVMNamespace, testVMName).
+			WithVMName(testVMName).
+			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).Build()
+		givenMarker := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: MarkerName},
+			Data:       map[string]string{failuresKey: `[{"kind":"IPPool","key":"test/pool-0","reason":"gone"}]`},
+		}
+
+		handler, clientset, k8sclientset := newTestHandler(t, false, []runtime.Object{givenMarker}, givenVmNetCfg, newTestIPPool(), newTestVM())
+
+		err := handler.Upgrade()
+		assert.Nil(t, err)
+
+		// The legacy allocation format is kept unless typed entries are on
+		ipPool, err := clientset.NetworkV1alpha1().IPPools(testIPPoolNamespace).Get(context.TODO(), testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, testMACAddress1, ipPool.Status.IPv4.Allocated[testIPAddress1])
+
+		marker, err := k8sclientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), MarkerName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, strconv.Itoa(SchemaVersion), marker.Data[schemaVersionKey])
+		assert.Equal(t, "[]", marker.Data[failuresKey])
+	})
+
+	t.Run("current schema version", func(t *testing.T) {
+		givenVmNetCfg := vmnetcfg.NewVmNetCfgBuilder(testVMNamespace, testVMName).
+			WithVMName(testVMName).
+			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).Build()
+		givenMarker := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: MarkerName},
+			Data:       map[string]string{schemaVersionKey: strconv.Itoa(SchemaVersion)},
+		}
+
+		handler, clientset, _ := newTestHandler(t, true, []runtime.Object{givenMarker}, givenVmNetCfg, newTestIPPool(), newTestVM())
+
+		err := handler.Upgrade()
+		assert.Nil(t, err)
+
+		vmNetCfg, err := clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs(testVMNamespace).Get(context.TODO(), testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, givenVmNetCfg, vmNetCfg)
+	})
+
+	t.Run("mixed allocation formats", func(t *testing.T) {
+		givenIPPool := newTestIPPool()
+		givenIPPool.Status.IPv4.Entries = map[string]networkv1.AllocationEntry{
+			testIPAddress2: {Type: networkv1.AllocationTypeLease, Owner: testMACAddress2},
+		}
+
+		handler, clientset, k8sclientset := newTestHandler(t, true, nil, givenIPPool)
+
+		err := handler.Upgrade()
+		assert.Nil(t, err)
+
+		ipPool, err := clientset.NetworkV1alpha1().IPPools(testIPPoolNamespace).Get(context.TODO(), testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, givenIPPool.Status, ipPool.Status)
+
+		marker, err := k8sclientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), MarkerName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		var failures []Failure
+		assert.Nil(t, json.Unmarshal([]byte(marker.Data[failuresKey]), &failures))
+		assert.Equal(t, []Failure{{
+			Kind:   "IPPool",
+			Key:    testIPPoolKey,
+			Reason: "status carries allocation records in both the legacy and the typed format",
+		}}, failures)
+	})
+}
+
+func TestHandler_Upgrade_MACAddressForms(t *testing.T) {
+	const (
+		testIPAddress3  = "192.168.0.160"
+		testIPAddress4  = "192.168.0.170"
+		testIPv6Address = "fd00::111"
+	)
+
+	// A vmnetcfg and an IPPool written before MAC addresses were normalized,
+	// in the dash-separated, uppercase and Cisco dotted forms
+	givenVmNetCfg := vmnetcfg.NewVmNetCfgBuilder(testVMNamespace, testVMName).
+		WithVMName(testVMName).
+		WithNetworkConfig(testIPAddress1, "11-22-33-44-55-66", testNetworkName).
+		WithNetworkConfigStatus(testIPAddress1, "11-22-33-44-55-66", testNetworkName, networkv1.AllocatedState).Build()
+	givenVmNetCfg.Labels = map[string]string{vmLabelKey: testVMName}
+	givenVmNetCfg.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "kubevirt.io/v1",
+		Kind:       "VirtualMachine",
+		Name:       testVMName,
+		UID:        testVMUID,
+	}}
+	givenVmNetCfg.Status.NetworkConfigs[0].IPPoolRef = testIPPoolKey
+	givenIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+		ServerIP("192.168.0.2").
+		CIDR("192.168.0.0/24").
+		PoolRange("192.168.0.101", "192.168.0.200").
+		NetworkName(testNetworkName).Build()
+	givenIPPool.Status.IPv4 = &networkv1.IPv4Status{
+		Entries: map[string]networkv1.AllocationEntry{
+			testIPAddress1: {Type: networkv1.AllocationTypeLease, Owner: "11-22-33-44-55-66"},
+			testIPAddress2: {Type: networkv1.AllocationTypeLease, Owner: "22:33:44:55:66:77"},
+			testIPAddress3: {Type: networkv1.AllocationTypeLease, Owner: "3344.5566.7788"},
+			testIPAddress4: {Type: networkv1.AllocationTypeExcluded},
+		},
+		Conflicts: map[string]networkv1.IPConflict{
+			"192.168.0.180": {MACAddress: "AA:BB:CC:DD:EE:FF"},
+		},
+	}
+	givenIPPool.Status.IPv6 = &networkv1.IPv6Status{
+		Entries: map[string]networkv1.AllocationEntry{
+			testIPv6Address: {Type: networkv1.AllocationTypeLease, Owner: "11-22-33-44-55-66"},
+		},
+	}
+	// An IPPool holding a MAC address that can't be normalized
+	givenInvalidIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, "pool-2").
+		Allocated(testIPAddress1, "11:22:33:44:55").
+		Allocated(testIPAddress2, util.ExcludedMark).Build()
+
+	handler, clientset, k8sclientset := newTestHandler(t, false, nil, givenVmNetCfg, givenIPPool, givenInvalidIPPool, newTestVM())
+
+	err := handler.Upgrade()
+	assert.Nil(t, err)
+
+	vmNetCfg, err := clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs(testVMNamespace).Get(context.TODO(), testVMName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, testMACAddress1, vmNetCfg.Spec.NetworkConfigs[0].MACAddress)
+	assert.Equal(t, testMACAddress1, vmNetCfg.Status.NetworkConfigs[0].MACAddress)
+
+	ipPool, err := clientset.NetworkV1alpha1().IPPools(testIPPoolNamespace).Get(context.TODO(), testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]networkv1.AllocationEntry{
+		testIPAddress1: {Type: networkv1.AllocationTypeLease, Owner: testMACAddress1},
+		testIPAddress2: {Type: networkv1.AllocationTypeLease, Owner: testMACAddress2},
+		testIPAddress3: {Type: networkv1.AllocationTypeLease, Owner: "33:44:55:66:77:88"},
+		testIPAddress4: {Type: networkv1.AllocationTypeExcluded},
+	}, ipPool.Status.IPv4.Entries)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", ipPool.Status.IPv4.Conflicts["192.168.0.180"].MACAddress)
+	assert.Equal(t, testMACAddress1, ipPool.Status.IPv6.Entries[testIPv6Address].Owner)
+
+	// The MAC address that can't be normalized is left as it is
+	invalidIPPool, err := clientset.NetworkV1alpha1().IPPools(testIPPoolNamespace).Get(context.TODO(), "pool-2", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, givenInvalidIPPool.Status, invalidIPPool.Status)
+
+	marker, err := k8sclientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), MarkerName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.NotContains(t, marker.Data, schemaVersionKey)
+	var failures []Failure
+	assert.Nil(t, json.Unmarshal([]byte(marker.Data[failuresKey]), &failures))
+	assert.Equal(t, []Failure{{
+		Kind:   "IPPool",
+		Key:    testIPPoolNamespace + "/pool-2",
+		Reason: `cannot normalize owner of ` + testIPAddress1 + `: mac address "11:22:33:44:55" is not valid`,
+	}}, failures)
+}
+
+func TestHandler_run(t *testing.T) {
+	givenVmNetCfg := vmnetcfg.NewVmNetCfgBuilder(testVMNamespace, testVMName).
+		WithVMName(testVMName).Build()
+
+	handler, clientset, _ := newTestHandler(t, false, nil, givenVmNetCfg, newTestVM())
+	assert.False(t, handler.upgrade.IsDone())
+
+	handler.run(context.TODO())
+
+	// The objects are upgraded before the gate opens
+	assert.True(t, handler.upgrade.IsDone())
+	vmNetCfg, err := clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs(testVMNamespace).Get(context.TODO(), testVMName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, testVMName, vmNetCfg.Labels[vmLabelKey])
+}
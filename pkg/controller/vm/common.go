@@ -3,21 +3,17 @@ package vm
 import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
 )
 
-func prepareVmNetCfg(vm *kubevirtv1.VirtualMachine, ncm map[string]networkv1.NetworkConfig) *networkv1.VirtualMachineNetworkConfig {
+func prepareVmNetCfg(vm *kubevirtv1.VirtualMachine, ncs []networkv1.NetworkConfig) *networkv1.VirtualMachineNetworkConfig {
 	sets := labels.Set{
 		vmLabelKey: vm.Name,
 	}
 
-	ncs := make([]networkv1.NetworkConfig, 0, len(ncm))
-	for _, nc := range ncm {
-		ncs = append(ncs, nc)
-	}
-
 	return &networkv1.VirtualMachineNetworkConfig{
 		ObjectMeta: metav1.ObjectMeta{
 			Labels:    sets,
@@ -25,8 +21,8 @@ func prepareVmNetCfg(vm *kubevirtv1.VirtualMachine, ncm map[string]networkv1.Net
 			Namespace: vm.Namespace,
 			OwnerReferences: []metav1.OwnerReference{
 				{
-					APIVersion: vm.APIVersion,
-					Kind:       vm.Kind,
+					APIVersion: kubevirtv1.SchemeGroupVersion.String(),
+					Kind:       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
 					Name:       vm.Name,
 					UID:        vm.UID,
 				},
@@ -39,6 +35,48 @@ func prepareVmNetCfg(vm *kubevirtv1.VirtualMachine, ncm map[string]networkv1.Net
 	}
 }
 
+// adoptVmNetCfg returns a copy of the VirtualMachineNetworkConfig owned by the
+// VM, and whether it wasn't already. A VM recreated under the same name, e.g.,
+// restored from a backup, finds the vmnetcfg of its former self still owned
+// by the UID of the deleted VM, which would get it garbage collected along
+// with its leases.
+func adoptVmNetCfg(vm *kubevirtv1.VirtualMachine, vmNetCfg *networkv1.VirtualMachineNetworkConfig) (*networkv1.VirtualMachineNetworkConfig, bool) {
+	if vm.UID == "" {
+		return vmNetCfg, false
+	}
+
+	owner := metav1.OwnerReference{
+		APIVersion: kubevirtv1.SchemeGroupVersion.String(),
+		Kind:       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+		Name:       vm.Name,
+		UID:        vm.UID,
+	}
+	ownerReferences := []metav1.OwnerReference{owner}
+	adopted := false
+	found := false
+	for _, ref := range vmNetCfg.OwnerReferences {
+		if ref.Kind != owner.Kind {
+			ownerReferences = append(ownerReferences, ref)
+			continue
+		}
+		if ref.UID != owner.UID || ref.Name != owner.Name {
+			adopted = true
+		}
+		found = true
+	}
+	if found && !adopted && vmNetCfg.Labels[vmLabelKey] == vm.Name {
+		return vmNetCfg, false
+	}
+
+	vmNetCfgCpy := vmNetCfg.DeepCopy()
+	vmNetCfgCpy.OwnerReferences = ownerReferences
+	if vmNetCfgCpy.Labels == nil {
+		vmNetCfgCpy.Labels = make(map[string]string)
+	}
+	vmNetCfgCpy.Labels[vmLabelKey] = vm.Name
+	return vmNetCfgCpy, true
+}
+
 type vmBuilder struct {
 	vm *kubevirtv1.VirtualMachine
 }
@@ -54,6 +92,11 @@ func newVMBuilder(namespace, name string) *vmBuilder {
 	}
 }
 
+func (b *vmBuilder) WithUID(uid types.UID) *vmBuilder {
+	b.vm.UID = uid
+	return b
+}
+
 // WithAnnotation adds an annotation to the VM metadata.
 func (b *vmBuilder) WithAnnotation(key, value string) *vmBuilder {
 	if b.vm.Annotations == nil {
@@ -105,6 +148,12 @@ func (b *vmBuilder) WithNetwork(nicName, networkName string) *vmBuilder {
 	return b
 }
 
+// Created marks the VM as having a running instance.
+func (b *vmBuilder) Created() *vmBuilder {
+	b.vm.Status.Created = true
+	return b
+}
+
 func (b *vmBuilder) Build() *kubevirtv1.VirtualMachine {
 	return b.vm
 }
@@ -3,18 +3,27 @@ package vm
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
 	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	ctlcorev1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/core/v1"
 	ctlcniv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/k8s.cni.cncf.io/v1"
 	ctlkubevirtv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/kubevirt.io/v1"
 	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
+	"github.com/harvester/vm-dhcp-controller/pkg/reconcile"
 	"github.com/harvester/vm-dhcp-controller/pkg/util"
 )
 
@@ -22,10 +31,65 @@ const (
 	controllerName = "vm-dhcp-vm-controller"
 
 	vmLabelKey            = "harvesterhci.io/vmName"
-	macAddressAnnotation  = "harvesterhci.io/mac-address"
+	macAddressAnnotation  = util.MACAddressAnnotationKey
+	// defaultRouteAnnotation holds whether each interface gets the router of
+	// its IPPool as the default route, e.g., {"nic-1": true, "nic-2": false}
+	defaultRouteAnnotation = "network.harvesterhci.io/default-route"
+	// dhcpModeAnnotation holds the mode of each interface, i.e., whether its
+	// IP address is served over DHCP or only reserved, e.g.,
+	// {"nic-1": "reserveOnly"}. Interfaces left out default to dhcp.
+	dhcpModeAnnotation = "network.harvesterhci.io/dhcp-mode"
+	// skippedNetworksAnnotation lists the interfaces of the VM left out of
+	// DHCP management, along with their network and the reason, e.g.,
+	// [{"interface":"nic-2","networkName":"default/net-2","reason":"NoIPPool"}]
+	skippedNetworksAnnotation = "network.harvesterhci.io/skipped-networks"
+
+	pendingMACReason         = "PendingMAC"
+	ambiguousNetworkReason   = "AmbiguousNetwork"
+	unknownNetworkTypeReason = "UnknownNetworkType"
+	duplicateInterfaceReason = "DuplicateInterfaceName"
+	invalidMACReason         = "InvalidMAC"
+	macAddressInUseReason    = "MACAddressInUse"
+	restartRequiredReason    = "RestartRequired"
+
+	// vmNetCfgDeletionRetryDelay is how long a VM whose vmnetcfg is being
+	// deleted waits before looking again
+	vmNetCfgDeletionRetryDelay = 5 * time.Second
 )
 
+// skippedNetwork is an entry of the skipped-networks annotation.
+type skippedNetwork struct {
+	InterfaceName string     `json:"interface"`
+	NetworkName   string     `json:"networkName"`
+	Reason        SkipReason `json:"reason"`
+	// Candidates are the NetworkAttachmentDefinitions an ambiguous network
+	// matches
+	Candidates []string `json:"candidates,omitempty"`
+}
+
 type Handler struct {
+	pendingMACPolicy string
+	recorder         record.EventRecorder
+	createThrottle   *createThrottle
+	// enqueueGuard backs off the VMs re-enqueueing themselves in a tight
+	// loop
+	enqueueGuard *enqueueGuard
+
+	terminatingNamespaces *terminatingNamespaces
+
+	clock clock.Clock
+	// cachesSynced reports whether the VM and vmnetcfg caches have synced
+	cachesSynced func() bool
+	// upgrade holds off the vmnetcfg GC until the objects of former releases
+	// are upgraded
+	upgrade *config.Upgrade
+	// orphanedVmNetCfgs tracks since when each vmnetcfg without a backing VM
+	// was first seen, and pinnedOrphanedVmNetCfgs the ones kept as their
+	// leases are pinned, which have been reported. Only the vmnetcfg GC
+	// touches them.
+	orphanedVmNetCfgs       map[string]time.Time
+	pinnedOrphanedVmNetCfgs map[string]struct{}
+
 	vmController   ctlkubevirtv1.VirtualMachineController
 	vmClient       ctlkubevirtv1.VirtualMachineClient
 	vmCache        ctlkubevirtv1.VirtualMachineCache
@@ -33,6 +97,7 @@ type Handler struct {
 	vmnetcfgCache  ctlnetworkv1.VirtualMachineNetworkConfigCache
 	ippoolCache    ctlnetworkv1.IPPoolCache
 	nadCache       ctlcniv1.NetworkAttachmentDefinitionCache
+	namespaceCache ctlcorev1.NamespaceCache
 }
 
 func Register(ctx context.Context, management *config.Management) error {
@@ -40,8 +105,23 @@ func Register(ctx context.Context, management *config.Management) error {
 	vmnetcfgs := management.HarvesterNetworkFactory.Network().V1alpha1().VirtualMachineNetworkConfig()
 	ippools := management.HarvesterNetworkFactory.Network().V1alpha1().IPPool()
 	nads := management.CniFactory.K8s().V1().NetworkAttachmentDefinition()
+	namespaces := management.CoreFactory.Core().V1().Namespace()
 
 	handler := &Handler{
+		pendingMACPolicy: management.Options.PendingMACPolicy,
+		recorder:         management.NewRecorder(controllerName, "", ""),
+		createThrottle: newCreateThrottle(management.Options.VmNetCfgCreateQPS,
+			management.Options.VmNetCfgCreateBurst, management.Clock),
+		enqueueGuard: newEnqueueGuard(management.Clock),
+
+		terminatingNamespaces: newTerminatingNamespaces(),
+
+		clock: management.Clock,
+		cachesSynced: func() bool {
+			return vms.Informer().HasSynced() && vmnetcfgs.Informer().HasSynced()
+		},
+		upgrade: management.Upgrade,
+
 		vmController:   vms,
 		vmClient:       vms,
 		vmCache:        vms.Cache(),
@@ -49,15 +129,28 @@ func Register(ctx context.Context, management *config.Management) error {
 		vmnetcfgCache:  vmnetcfgs.Cache(),
 		ippoolCache:    ippools.Cache(),
 		nadCache:       nads.Cache(),
+		namespaceCache: namespaces.Cache(),
 	}
 
-	vms.OnChange(ctx, controllerName, handler.OnChange)
+	// Lets the MAC addresses applied from the annotation be checked against
+	// the ones on the same network
+	vmnetcfgs.Cache().AddIndexer(indexer.VmNetCfgByNetworkMACIndex, util.VmNetCfgByNetworkMAC)
+
+	limiter := reconcile.NewLimiter(controllerName, management.Options.ReconcileTimeout, management.MetricsAllocator)
+
+	vms.OnChange(ctx, controllerName, reconcile.Handler(limiter, "vm-onchange", handler.OnChange))
+
+	// VMs deleted while the controller was down leave the vmnetcfgs lacking
+	// an owner reference behind
+	go handler.runVmNetCfgGC(ctx)
 
 	return nil
 }
 
 func (h *Handler) OnChange(key string, vm *kubevirtv1.VirtualMachine) (*kubevirtv1.VirtualMachine, error) {
 	if vm == nil || vm.DeletionTimestamp != nil {
+		h.createThrottle.forget(key)
+		h.enqueueGuard.forget(key)
 		return nil, nil
 	}
 
@@ -79,41 +172,21 @@ func (h *Handler) OnChange(key string, vm *kubevirtv1.VirtualMachine) (*kubevirt
 		}
 	}
 
-	ncm := make(map[string]networkv1.NetworkConfig, 1)
-
-	// Construct initial network config map
-	if len(vm.Spec.Template.Spec.Domain.Devices.Interfaces) == 0 {
-		logrus.Debugf("(vm.OnChange) vm %s has no network interfaces, skipping", key)
-		return vm, nil
-	}
-
-	for _, nic := range vm.Spec.Template.Spec.Domain.Devices.Interfaces {
-		if nic.MacAddress == "" {
-			continue
-		}
-		ncm[nic.Name] = networkv1.NetworkConfig{
-			MACAddress: nic.MacAddress,
-		}
-	}
-
-	// Update network name for each network config if it's of type Multus
-	for _, network := range vm.Spec.Template.Spec.Networks {
-		if network.Multus == nil {
-			continue
-		}
-		nc, ok := ncm[network.Name]
-		if !ok {
-			continue
+	// Assign generated MAC addresses to the interfaces still missing one
+	if h.pendingMACPolicy == config.PendingMACPolicyGenerate {
+		vmCopy, updated := h.applyGeneratedMACAddresses(vm)
+		if updated {
+			logrus.Infof("(vm.OnChange) applied generated MAC addresses to vm %s", key)
+			vm, err = h.vmClient.Update(vmCopy)
+			if err != nil {
+				return vm, err
+			}
 		}
-		nc.NetworkName = network.Multus.NetworkName
-		ncm[network.Name] = nc
 	}
 
-	// Remove incomplete network configs
-	for i, nc := range ncm {
-		if nc.NetworkName == "" {
-			delete(ncm, i)
-		}
+	if vm.Spec.Template == nil || len(vm.Spec.Template.Spec.Domain.Devices.Interfaces) == 0 {
+		logrus.Debugf("(vm.OnChange) vm %s has no network interfaces, skipping", key)
+		return vm, nil
 	}
 
 	// Filter out networks that don't have IPPools.
@@ -123,40 +196,95 @@ func (h *Handler) OnChange(key string, vm *kubevirtv1.VirtualMachine) (*kubevirt
 	// DHCP/IPPools, some with static IPs or other configurations).
 	//
 	// Error handling philosophy: This controller proactively filters networks and silently
-	// skips those without IPPools (see hasIPPool). In contrast, the vmnetcfg controller
+	// skips those without IPPools (see resolveIPPool). In contrast, the vmnetcfg controller
 	// and webhook validator return errors for invalid configurations (they validate).
 	// This difference is intentional:
 	// - VM controller: "try to help where possible, skip what we can't handle"
 	// - vmnetcfg/webhook: "enforce data integrity, reject invalid input"
-	originalCount := len(ncm)
-	for i, nc := range ncm {
-		if !h.hasIPPool(vm, nc.NetworkName) {
-			logrus.Debugf("(vm.OnChange) network %s has no IPPool, skipping DHCP management for vm %s", nc.NetworkName, key)
-			delete(ncm, i)
+	ncs, skipped := BuildNetworkConfigs(vm, func(networkName string) error {
+		return h.resolveIPPool(vm, networkName)
+	})
+
+	var pendingMACNICs []SkippedInterface
+	var unmanagedNICs []string
+	var filteredCount int
+	for _, skip := range skipped {
+		switch skip.Reason {
+		case SkipReasonNotMultus:
+			unmanagedNICs = append(unmanagedNICs, skip.InterfaceName)
+		case SkipReasonUnmanagedBinding:
+			unmanagedNICs = append(unmanagedNICs, skip.InterfaceName+" ("+skip.Binding+")")
+		case SkipReasonUnknownNetworkType:
+			h.reportUnknownNetworkType(vm, skip)
+		case SkipReasonDuplicateInterfaceName:
+			h.reportDuplicateInterfaceName(vm, skip)
+		case SkipReasonPendingMAC:
+			pendingMACNICs = append(pendingMACNICs, skip)
+		case SkipReasonNoIPPool:
+			logrus.Debugf("(vm.OnChange) network %s has no IPPool, skipping DHCP management for vm %s", skip.NetworkName, key)
+			if skip.MACAddress != "" {
+				filteredCount++
+			}
+		case SkipReasonDuplicateMAC:
+			logrus.Warnf("(vm.OnChange) interface %s of vm %s shares mac address %s with another interface, skipping it", skip.InterfaceName, key, skip.MACAddress)
+		case SkipReasonInvalidMAC:
+			h.reportInvalidMAC(vm, skip)
+		case SkipReasonAmbiguousNetwork:
+			h.reportAmbiguousNetwork(vm, skip)
 		}
 	}
 
+	if h.pendingMACPolicy == config.PendingMACPolicyReport {
+		h.reportPendingMAC(vm, pendingMACNICs)
+	}
+
+	if len(unmanagedNICs) > 0 {
+		logrus.Debugf("(vm.OnChange) vm %s: interfaces %s are on the pod network or bound behind the pod, skipping DHCP management", key, strings.Join(unmanagedNICs, ", "))
+	}
+
 	// Log summary of filtering results
-	filteredCount := originalCount - len(ncm)
 	if filteredCount > 0 {
-		logrus.Infof("(vm.OnChange) vm %s: %d/%d networks have IPPools, %d filtered (no IPPool)", key, len(ncm), originalCount, filteredCount)
-	} else if len(ncm) > 0 {
-		logrus.Debugf("(vm.OnChange) vm %s: all %d networks have IPPools", key, len(ncm))
+		logrus.Infof("(vm.OnChange) vm %s: %d/%d networks have IPPools, %d filtered (no IPPool)", key, len(ncs), len(ncs)+filteredCount, filteredCount)
+	} else if len(ncs) > 0 {
+		logrus.Debugf("(vm.OnChange) vm %s: all %d networks have IPPools", key, len(ncs))
+	}
+
+	// Let users see which networks aren't DHCP-managed without digging
+	// through the logs
+	vm, err = h.recordSkippedNetworks(vm, skipped)
+	if err != nil {
+		return vm, err
 	}
 
 	// If no network config is found, return early
-	if len(ncm) == 0 {
+	if len(ncs) == 0 {
 		logrus.Infof("(vm.OnChange) no effective network configs found for vm %s, skipping", key)
 		return vm, nil
 	}
 
-	vmNetCfg := prepareVmNetCfg(vm, ncm)
+	vmNetCfg := prepareVmNetCfg(vm, ncs)
 
 	oldVmNetCfg, err := h.vmnetcfgCache.Get(vm.Namespace, vm.Name)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
+			// Nothing new can be created in namespaces being deleted
+			if h.isNamespaceTerminating(vm.Namespace) {
+				h.skipTerminatingNamespace(key, vm.Namespace)
+				return vm, nil
+			}
+			if delay := h.createThrottle.wait(key); delay > 0 {
+				logrus.Debugf("(vm.OnChange) vmnetcfg creation for vm %s throttled; retry in %s", key, delay)
+				h.vmController.EnqueueAfter(vm.Namespace, vm.Name, delay)
+				return vm, nil
+			}
 			logrus.Infof("(vm.OnChange) create vmnetcfg for vm %s", key)
 			if _, err := h.vmnetcfgClient.Create(vmNetCfg); err != nil {
+				// The namespace started terminating since the cache was
+				// read, which retrying won't change
+				if isNamespaceTerminatingError(err) {
+					h.skipTerminatingNamespace(key, vm.Namespace)
+					return vm, nil
+				}
 				return vm, err
 			}
 			return vm, nil
@@ -165,6 +293,22 @@ func (h *Handler) OnChange(key string, vm *kubevirtv1.VirtualMachine) (*kubevirt
 	}
 
 	logrus.Debugf("(vm.OnChange) vmnetcfg for vm %s already exists", key)
+	h.createThrottle.forget(key)
+
+	// The leases of a vmnetcfg being deleted are being released, so the VM
+	// waits for it to be gone to get a new one
+	if oldVmNetCfg.DeletionTimestamp != nil {
+		logrus.Infof("(vm.OnChange) vmnetcfg of vm %s is being deleted, wait for it to be gone", key)
+		h.vmController.EnqueueAfter(vm.Namespace, vm.Name, vmNetCfgDeletionRetryDelay)
+		return vm, nil
+	}
+
+	if adopted, ok := adoptVmNetCfg(vm, oldVmNetCfg); ok {
+		logrus.Infof("(vm.OnChange) adopt vmnetcfg %s/%s left behind by a former vm %s", adopted.Namespace, adopted.Name, key)
+		if oldVmNetCfg, err = h.vmnetcfgClient.Update(adopted); err != nil {
+			return vm, err
+		}
+	}
 
 	vmNetCfgCpy := oldVmNetCfg.DeepCopy()
 	vmNetCfgCpy.Spec.NetworkConfigs = vmNetCfg.Spec.NetworkConfigs
@@ -195,41 +339,234 @@ func (h *Handler) OnChange(key string, vm *kubevirtv1.VirtualMachine) (*kubevirt
 		}
 
 		// Enqueue the VirtualMachine in order to update the network config of its corresponding VirtualMachineNetworkConfig
+		if delay := h.enqueueGuard.enqueue(key); delay > 0 {
+			h.reportEnqueueStorm(vm, delay)
+			h.vmController.EnqueueAfter(vm.Namespace, vm.Name, delay)
+			return vm, nil
+		}
 		h.vmController.Enqueue(vm.Namespace, vm.Name)
+	} else if !networkv1.InSynced.IsFalse(oldVmNetCfg) {
+		h.enqueueGuard.forget(key)
 	}
 
 	return vm, nil
 }
 
-// hasIPPool checks if a network has an associated IPPool by looking up its NetworkAttachmentDefinition
-// and checking for IPPool labels. Returns true if an IPPool exists, false otherwise.
+// reportEnqueueStorm lets users know that the VM keeps re-enqueueing itself
+// without its vmnetcfg getting in sync, and is backed off for delay.
+func (h *Handler) reportEnqueueStorm(vm *kubevirtv1.VirtualMachine, delay time.Duration) {
+	logrus.Warnf("(vm.reportEnqueueStorm) vm %s/%s re-enqueued more than %d times without its vmnetcfg getting in sync, backing off for %s",
+		vm.Namespace, vm.Name, enqueueStormLimit, delay)
+
+	if h.recorder != nil {
+		h.recorder.Eventf(vm, corev1.EventTypeWarning, enqueueStormReason,
+			"Network config keeps changing without the VirtualMachineNetworkConfig getting in sync; backing off for %s", delay)
+	}
+}
+
+// resolveIPPool checks if a network has an associated IPPool by looking up its NetworkAttachmentDefinition
+// and checking for IPPool labels. Returns nil if an IPPool exists, or why it doesn't otherwise.
 // If networkName doesn't include a namespace, uses the VM's namespace (Kubernetes/Multus convention).
 //
-// This function is intentionally permissive: it returns false for expected cases (network without IPPool)
-// so the VM controller can filter them out proactively. Unexpected errors (cache failures, API issues)
-// are logged at Warning level to aid troubleshooting.
-func (h *Handler) hasIPPool(vm *kubevirtv1.VirtualMachine, networkName string) bool {
+// This function is intentionally permissive: the error only tells the VM controller to filter the
+// network out proactively. Unexpected errors (cache failures, API issues) are logged at Warning level
+// to aid troubleshooting.
+func (h *Handler) resolveIPPool(vm *kubevirtv1.VirtualMachine, networkName string) error {
 	// If caches aren't initialized (e.g., in tests), assume IPPool exists for backward compatibility
 	if h.nadCache == nil || h.ippoolCache == nil {
-		return true
+		return nil
 	}
 
 	_, err := util.GetIPPoolFromNetworkName(h.nadCache, h.ippoolCache, networkName, vm.Namespace)
 	if err != nil {
-		// Expected: NAD or IPPool doesn't exist, or NAD lacks IPPool labels
+		// Expected: NAD or IPPool doesn't exist, NAD lacks IPPool labels, or
+		// the network name is ambiguous, which is reported by OnChange
 		// This is normal for networks with static IPs, BGP peering, etc.
-		if apierrors.IsNotFound(err) {
-			logrus.Debugf("(vm.hasIPPool) %v", err)
-			return false
+		if apierrors.IsNotFound(err) || errors.Is(err, util.ErrAmbiguousNetwork) {
+			logrus.Debugf("(vm.resolveIPPool) %v", err)
+			return err
 		}
 
 		// Unexpected: cache failures, API server issues, etc.
 		// Log at Warning level so infrastructure problems are visible
-		logrus.Warnf("(vm.hasIPPool) unexpected error checking IPPool for network %s on vm %s/%s: %v",
+		logrus.Warnf("(vm.resolveIPPool) unexpected error checking IPPool for network %s on vm %s/%s: %v",
 			networkName, vm.Namespace, vm.Name, err)
-		return false
+		return err
+	}
+	return nil
+}
+
+// recordSkippedNetworks keeps the skipped-networks annotation of the VM in line
+// with the interfaces left out for lack of an IPPool, for an ambiguous network,
+// for an unknown network type, for a duplicate name or for an invalid MAC
+// address. The annotation is removed once there's none left.
+func (h *Handler) recordSkippedNetworks(vm *kubevirtv1.VirtualMachine, skipped []SkippedInterface) (*kubevirtv1.VirtualMachine, error) {
+	var records []skippedNetwork
+	for _, skip := range skipped {
+		switch skip.Reason {
+		case SkipReasonNoIPPool, SkipReasonAmbiguousNetwork, SkipReasonUnknownNetworkType, SkipReasonDuplicateInterfaceName, SkipReasonInvalidMAC:
+		default:
+			continue
+		}
+		records = append(records, skippedNetwork{
+			InterfaceName: skip.InterfaceName,
+			NetworkName:   skip.NetworkName,
+			Reason:        skip.Reason,
+			Candidates:    skip.Candidates,
+		})
+	}
+
+	var annotation string
+	if len(records) > 0 {
+		data, err := json.Marshal(records)
+		if err != nil {
+			return vm, err
+		}
+		annotation = string(data)
+	}
+
+	current, ok := vm.Annotations[skippedNetworksAnnotation]
+	if current == annotation && ok == (annotation != "") {
+		return vm, nil
+	}
+
+	vmCopy := vm.DeepCopy()
+	if annotation == "" {
+		delete(vmCopy.Annotations, skippedNetworksAnnotation)
+	} else {
+		if vmCopy.Annotations == nil {
+			vmCopy.Annotations = make(map[string]string)
+		}
+		vmCopy.Annotations[skippedNetworksAnnotation] = annotation
+	}
+
+	logrus.Infof("(vm.recordSkippedNetworks) update skipped networks of vm %s/%s: %s", vm.Namespace, vm.Name, annotation)
+	return h.vmClient.Update(vmCopy)
+}
+
+// reportPendingMAC lets users know that the allocation for interfaces without
+// a MAC address is deferred rather than abandoned. Only interfaces attached to
+// networks backed by an IPPool are passed in since others aren't managed anyway.
+func (h *Handler) reportPendingMAC(vm *kubevirtv1.VirtualMachine, nics []SkippedInterface) {
+	for _, nic := range nics {
+		logrus.Infof("(vm.reportPendingMAC) interface %s of vm %s/%s on network %s is pending MAC address assignment",
+			nic.InterfaceName, vm.Namespace, vm.Name, nic.NetworkName)
+
+		if h.recorder != nil {
+			h.recorder.Eventf(vm, corev1.EventTypeNormal, pendingMACReason,
+				"Interface %s on network %s is pending MAC address assignment, IP allocation is deferred",
+				nic.InterfaceName, nic.NetworkName)
+		}
+	}
+}
+
+// reportRestartRequired lets users know that the interfaces of a running VM
+// only get a generated MAC address, and IP addresses along with it, once the
+// VM is stopped.
+func (h *Handler) reportRestartRequired(vm *kubevirtv1.VirtualMachine, nics []SkippedInterface) {
+	for _, nic := range nics {
+		logrus.Infof("(vm.reportRestartRequired) interface %s of vm %s/%s on network %s is missing a MAC address, holding off generating one while the vm is running",
+			nic.InterfaceName, vm.Namespace, vm.Name, nic.NetworkName)
+
+		if h.recorder != nil {
+			h.recorder.Eventf(vm, corev1.EventTypeWarning, restartRequiredReason,
+				"Interface %s on network %s has no MAC address; stop the VM to have one generated, IP allocation is deferred until then",
+				nic.InterfaceName, nic.NetworkName)
+		}
+	}
+}
+
+// reportAmbiguousNetwork lets users know that the interface is left out as its
+// network matches NetworkAttachmentDefinitions of different IPPools, and how
+// to tell which one is meant.
+func (h *Handler) reportAmbiguousNetwork(vm *kubevirtv1.VirtualMachine, nic SkippedInterface) {
+	candidates := strings.Join(nic.Candidates, " and ")
+	logrus.Warnf("(vm.reportAmbiguousNetwork) network %s of interface %s of vm %s/%s matches %s of different ippools, skipping it",
+		nic.NetworkName, nic.InterfaceName, vm.Namespace, vm.Name, candidates)
+
+	if h.recorder != nil {
+		h.recorder.Eventf(vm, corev1.EventTypeWarning, ambiguousNetworkReason,
+			"Interface %s on network %s is not DHCP-managed as it matches %s of different IPPools; qualify the network with a namespace",
+			nic.InterfaceName, nic.NetworkName, candidates)
+	}
+}
+
+// reportUnknownNetworkType lets users know that the interface is left out as
+// its network type or binding plugin isn't known, rather than guessing whether
+// it can be served.
+func (h *Handler) reportUnknownNetworkType(vm *kubevirtv1.VirtualMachine, nic SkippedInterface) {
+	what := "network of an unknown type"
+	if nic.Binding != "" {
+		what = fmt.Sprintf("network %s with unknown binding %s", nic.NetworkName, nic.Binding)
+	}
+	logrus.Warnf("(vm.reportUnknownNetworkType) interface %s of vm %s/%s is attached to a %s, skipping it",
+		nic.InterfaceName, vm.Namespace, vm.Name, what)
+
+	if h.recorder != nil {
+		h.recorder.Eventf(vm, corev1.EventTypeWarning, unknownNetworkTypeReason,
+			"Interface %s is not DHCP-managed as it is attached to a %s", nic.InterfaceName, what)
+	}
+}
+
+// reportDuplicateInterfaceName lets users know that the interfaces sharing a
+// name are left out, as there's no telling which of them the network is meant
+// for.
+func (h *Handler) reportDuplicateInterfaceName(vm *kubevirtv1.VirtualMachine, nic SkippedInterface) {
+	logrus.Warnf("(vm.reportDuplicateInterfaceName) more than one interface of vm %s/%s is named %s, skipping them",
+		vm.Namespace, vm.Name, nic.InterfaceName)
+
+	if h.recorder != nil {
+		h.recorder.Eventf(vm, corev1.EventTypeWarning, duplicateInterfaceReason,
+			"Interfaces named %s are not DHCP-managed as more than one interface has the name; give each interface a unique name",
+			nic.InterfaceName)
+	}
+}
+
+// reportInvalidMAC lets users know that the interface is left out as its MAC
+// address isn't a valid 48-bit MAC address, rather than having it rejected
+// further down.
+func (h *Handler) reportInvalidMAC(vm *kubevirtv1.VirtualMachine, nic SkippedInterface) {
+	logrus.Warnf("(vm.reportInvalidMAC) interface %s of vm %s/%s has invalid mac address %q, skipping it",
+		nic.InterfaceName, vm.Namespace, vm.Name, nic.MACAddress)
+
+	if h.recorder != nil {
+		h.recorder.Eventf(vm, corev1.EventTypeWarning, invalidMACReason,
+			"Interface %s on network %s is not DHCP-managed as its MAC address %q is not valid",
+			nic.InterfaceName, nic.NetworkName, nic.MACAddress)
+	}
+}
+
+// reportMACAddressInUse lets users know that the MAC address applied to the
+// interface is already used on its network by another vmnetcfg, e.g., of the
+// VM it was cloned from, which the webhook would reject the vmnetcfg of the VM
+// for.
+func (h *Handler) reportMACAddressInUse(vm *kubevirtv1.VirtualMachine, nicName, networkName, macAddress string) {
+	if networkName == "" {
+		return
+	}
+
+	getter := util.VmnetcfgGetter{VmnetcfgCache: h.vmnetcfgCache}
+	vmNetCfgs, err := getter.WhoHasMACOnNetwork(vm.Namespace, networkName, macAddress)
+	if err != nil {
+		logrus.Warnf("(vm.reportMACAddressInUse) failed to look up mac address %s on network %s: %s", macAddress, networkName, err.Error())
+		return
+	}
+
+	for _, vmNetCfg := range vmNetCfgs {
+		// The vmnetcfg of the VM itself, or one on its way out
+		if (vmNetCfg.Namespace == vm.Namespace && vmNetCfg.Name == vm.Name) || vmNetCfg.DeletionTimestamp != nil {
+			continue
+		}
+
+		logrus.Warnf("(vm.reportMACAddressInUse) mac address %s of interface %s on vm %s/%s is already used on network %s by vmnetcfg %s/%s",
+			macAddress, nicName, vm.Namespace, vm.Name, networkName, vmNetCfg.Namespace, vmNetCfg.Name)
+		if h.recorder != nil {
+			h.recorder.Eventf(vm, corev1.EventTypeWarning, macAddressInUseReason,
+				"MAC address %s of interface %s is already used on network %s by vmnetcfg %s/%s; give the interface a unique MAC address",
+				macAddress, nicName, networkName, vmNetCfg.Namespace, vmNetCfg.Name)
+		}
+		return
 	}
-	return true
 }
 
 // applyMACAddressAnnotation applies MAC addresses from the annotation to VM interfaces that don't have MAC addresses set.
@@ -256,6 +593,13 @@ func (h *Handler) applyMACAddressAnnotation(vm *kubevirtv1.VirtualMachine) (*kub
 	vmCopy := vm.DeepCopy()
 	updated := false
 
+	multusNetworks := make(map[string]string, len(vmCopy.Spec.Template.Spec.Networks))
+	for _, network := range vmCopy.Spec.Template.Spec.Networks {
+		if network.Multus != nil {
+			multusNetworks[network.Name] = network.Multus.NetworkName
+		}
+	}
+
 	// Apply MAC addresses to interfaces that don't have them set
 	for i := range vmCopy.Spec.Template.Spec.Domain.Devices.Interfaces {
 		nic := &vmCopy.Spec.Template.Spec.Domain.Devices.Interfaces[i]
@@ -267,11 +611,66 @@ func (h *Handler) applyMACAddressAnnotation(vm *kubevirtv1.VirtualMachine) (*kub
 
 		// Check if we have a MAC address for this interface in the annotation
 		if macAddr, ok := macAddresses[nic.Name]; ok && macAddr != "" {
+			normalized, err := util.ParseMAC(macAddr)
+			if err != nil {
+				logrus.Warnf("(vm.applyMACAddressAnnotation) skip MAC address of interface %s on vm %s/%s: %s", nic.Name, vm.Namespace, vm.Name, err.Error())
+				continue
+			}
+			macAddr = normalized
 			logrus.Infof("(vm.applyMACAddressAnnotation) applying MAC address %s to interface %s on vm %s/%s", macAddr, nic.Name, vm.Namespace, vm.Name)
 			nic.MacAddress = macAddr
 			updated = true
+			h.reportMACAddressInUse(vm, nic.Name, multusNetworks[nic.Name], macAddr)
 		}
 	}
 
 	return vmCopy, updated, nil
 }
+
+// applyGeneratedMACAddresses assigns generated MAC addresses to the interfaces
+// without one that would be managed otherwise, i.e., the ones attached to
+// networks backed by an IPPool. The addresses are derived from the VM UID, so
+// they stay the same however many times they're generated. As KubeVirt only
+// picks up the MAC addresses on the next start, they're held off for VMs
+// running already, which are told to be restarted instead.
+// It returns a deep copy of the VM with the MAC addresses assigned and a boolean indicating if any updates were made.
+func (h *Handler) applyGeneratedMACAddresses(vm *kubevirtv1.VirtualMachine) (*kubevirtv1.VirtualMachine, bool) {
+	if vm.UID == "" {
+		return vm, false
+	}
+
+	_, skipped := BuildNetworkConfigs(vm, func(networkName string) error {
+		return h.resolveIPPool(vm, networkName)
+	})
+
+	pendingMACNICs := make(map[string]struct{})
+	var pending []SkippedInterface
+	for _, skip := range skipped {
+		if skip.Reason == SkipReasonPendingMAC {
+			pendingMACNICs[skip.InterfaceName] = struct{}{}
+			pending = append(pending, skip)
+		}
+	}
+	if len(pendingMACNICs) == 0 {
+		return vm, false
+	}
+
+	// The VM instance keeps running with the MAC addresses it was started
+	// with, so the leases would go to addresses nobody asks for
+	if vm.Status.Created {
+		h.reportRestartRequired(vm, pending)
+		return vm, false
+	}
+
+	vmCopy := vm.DeepCopy()
+	for i := range vmCopy.Spec.Template.Spec.Domain.Devices.Interfaces {
+		nic := &vmCopy.Spec.Template.Spec.Domain.Devices.Interfaces[i]
+		if _, ok := pendingMACNICs[nic.Name]; !ok || nic.MacAddress != "" {
+			continue
+		}
+		nic.MacAddress = util.GenerateMACAddress(vm.UID, nic.Name)
+		logrus.Infof("(vm.applyGeneratedMACAddresses) applying generated MAC address %s to interface %s on vm %s/%s", nic.MacAddress, nic.Name, vm.Namespace, vm.Name)
+	}
+
+	return vmCopy, true
+}
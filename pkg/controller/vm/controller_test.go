@@ -1,16 +1,33 @@
 package vm
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	kubevirtv1 "kubevirt.io/api/core/v1"
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/ippool"
 	"github.com/harvester/vm-dhcp-controller/pkg/controller/vmnetcfg"
 	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
 	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
 	"github.com/harvester/vm-dhcp-controller/pkg/util/fakecontroller"
 )
@@ -28,8 +45,17 @@ const (
 	testNICName           = "nic1"
 	testVmNetCfgNamespace = "default"
 	testVmNetCfgName      = "test-vm"
+	testIPPoolNamespace   = "default"
+	testIPPoolName        = "test-pool"
+	testVMUID             = "3a955369-9eaa-43db-94f3-9153289d7dc2"
 )
 
+var nadGVR = schema.GroupVersionResource{
+	Group:    "k8s.cni.cncf.io",
+	Version:  "v1",
+	Resource: "network-attachment-definitions",
+}
+
 func newTestVMBuilder() *vmBuilder {
 	return newVMBuilder(testVMNamespace, testVMName)
 }
@@ -70,7 +96,9 @@ func TestHandler_OnChange(t *testing.T) {
 		expectedVmNetCfg := newTestVmNetCfgBuilder().
 			Label(vmLabelKey, testVMName).
 			OwnerRef(metav1.OwnerReference{
-				Name: testVMName,
+				APIVersion: kubevirtv1.SchemeGroupVersion.String(),
+				Kind:       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+				Name:       testVMName,
 			}).
 			WithVMName(testVMName).
 			WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
@@ -242,7 +270,9 @@ func TestHandler_OnChange(t *testing.T) {
 		expectedVmNetCfg := newTestVmNetCfgBuilder().
 			Label(vmLabelKey, testVMName).
 			OwnerRef(metav1.OwnerReference{
-				Name: testVMName,
+				APIVersion: kubevirtv1.SchemeGroupVersion.String(),
+				Kind:       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+				Name:       testVMName,
 			}).
 			WithVMName(testVMName).
 			WithNetworkConfig("", testMACAddress2, testNetworkName).Build()
@@ -255,7 +285,7 @@ func TestHandler_OnChange(t *testing.T) {
 
 		handler := Handler{
 			vmClient:       fakeclient.VirtualMachineClient(clientset.KubevirtV1().VirtualMachines),
-			vmnetcfgCache:  fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgCache:  indexedVmNetCfgCache{fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)},
 			vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
 		}
 
@@ -272,4 +302,869 @@ func TestHandler_OnChange(t *testing.T) {
 		assert.Nil(t, err)
 		assert.Equal(t, expectedVmNetCfg, vmNetCfg)
 	})
+
+	t.Run("vm with mac annotation in use on the same network reports it", func(t *testing.T) {
+		givenVM := newTestVMBuilder().
+			WithInterface("", testNICName).
+			WithInterface("", "nic2").
+			WithNetwork(testNICName, testNetworkName).
+			WithNetwork("nic2", testNADName+"-2").
+			WithAnnotation(macAddressAnnotation, `{"nic1":"22:33:44:55:66:77","nic2":"33:44:55:66:77:88"}`).Build()
+		// The VM it was cloned from, and one on another network
+		givenVmNetCfgs := []*networkv1.VirtualMachineNetworkConfig{
+			vmnetcfg.NewVmNetCfgBuilder(testVMNamespace, "source-vm").
+				WithNetworkConfig("", "22-33-44-55-66-77", testNADName).Build(),
+			vmnetcfg.NewVmNetCfgBuilder(testVMNamespace, "other-vm").
+				WithNetworkConfig("", "33:44:55:66:77:88", testNetworkName).Build(),
+		}
+
+		clientset := fake.NewSimpleClientset(givenVM)
+		for _, vmNetCfg := range givenVmNetCfgs {
+			err := clientset.Tracker().Add(vmNetCfg)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		}
+		recorder := record.NewFakeRecorder(10)
+
+		handler := Handler{
+			recorder:      recorder,
+			vmClient:      fakeclient.VirtualMachineClient(clientset.KubevirtV1().VirtualMachines),
+			vmnetcfgCache: indexedVmNetCfgCache{fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)},
+		}
+
+		_, updated, err := handler.applyMACAddressAnnotation(givenVM)
+		assert.Nil(t, err)
+		assert.True(t, updated)
+
+		if assert.Len(t, recorder.Events, 1) {
+			assert.Equal(t,
+				"Warning MACAddressInUse MAC address 22:33:44:55:66:77 of interface nic1 is already used on network "+testNetworkName+" by vmnetcfg default/source-vm; give the interface a unique MAC address",
+				<-recorder.Events,
+			)
+		}
+	})
+
+	t.Run("new vm without mac on pool-backed network reports pending mac", func(t *testing.T) {
+		givenVM := newTestVMBuilder().
+			WithInterface("", testNICName).
+			WithNetwork(testNICName, testNetworkName).Build()
+		givenNAD := ippool.NewNetworkAttachmentDefinitionBuilder(testNADNamespace, testNADName).
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+		givenIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+			NetworkName(testNetworkName).Build()
+
+		clientset := fake.NewSimpleClientset(givenVM, givenIPPool)
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		recorder := record.NewFakeRecorder(10)
+
+		handler := Handler{
+			pendingMACPolicy: config.PendingMACPolicyReport,
+			recorder:         recorder,
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			vmnetcfgCache:    fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		}
+
+		_, err = handler.OnChange(testKey, givenVM)
+		assert.Nil(t, err)
+
+		_, err = handler.vmnetcfgClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+		assert.NotNil(t, err, "expected error when getting vmnetcfg")
+
+		if assert.Len(t, recorder.Events, 1) {
+			assert.Equal(t,
+				"Normal PendingMAC Interface nic1 on network default/test-nad is pending MAC address assignment, IP allocation is deferred",
+				<-recorder.Events,
+			)
+		}
+	})
+
+	t.Run("new vm without mac on pool-backed network gets a generated mac", func(t *testing.T) {
+		givenVM := newTestVMBuilder().
+			WithUID(testVMUID).
+			WithInterface("", testNICName).
+			WithInterface("", "nic2").
+			WithNetwork(testNICName, testNetworkName).
+			WithNetwork("nic2", "default/no-pool").Build()
+		givenNAD := ippool.NewNetworkAttachmentDefinitionBuilder(testNADNamespace, testNADName).
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+		givenIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+			NetworkName(testNetworkName).Build()
+
+		generatedMAC := util.GenerateMACAddress(testVMUID, testNICName)
+		expectedVmNetCfg := newTestVmNetCfgBuilder().
+			Label(vmLabelKey, testVMName).
+			OwnerRef(metav1.OwnerReference{
+				APIVersion: kubevirtv1.SchemeGroupVersion.String(),
+				Kind:       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+				Name:       testVMName,
+				UID:        testVMUID,
+			}).
+			WithVMName(testVMName).
+			WithNetworkConfig("", generatedMAC, testNetworkName).Build()
+
+		clientset := fake.NewSimpleClientset(givenVM, givenIPPool)
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		handler := Handler{
+			pendingMACPolicy: config.PendingMACPolicyGenerate,
+			vmClient:         fakeclient.VirtualMachineClient(clientset.KubevirtV1().VirtualMachines),
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			vmnetcfgCache:    fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		}
+
+		_, err = handler.OnChange(testKey, givenVM)
+		assert.Nil(t, err)
+
+		// Only the interface on the pool-backed network gets a MAC address
+		updatedVM, err := handler.vmClient.Get(testVMNamespace, testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, generatedMAC, updatedVM.Spec.Template.Spec.Domain.Devices.Interfaces[0].MacAddress)
+		assert.Equal(t, "", updatedVM.Spec.Template.Spec.Domain.Devices.Interfaces[1].MacAddress)
+
+		vmNetCfg, err := handler.vmnetcfgClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, expectedVmNetCfg, vmNetCfg)
+
+		// Reconciling again leaves the assigned MAC address alone
+		_, err = handler.OnChange(testKey, updatedVM)
+		assert.Nil(t, err)
+
+		updatedVM, err = handler.vmClient.Get(testVMNamespace, testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, generatedMAC, updatedVM.Spec.Template.Spec.Domain.Devices.Interfaces[0].MacAddress)
+	})
+
+	t.Run("running vm without mac on pool-backed network is asked to be stopped", func(t *testing.T) {
+		givenVM := newTestVMBuilder().
+			WithUID(testVMUID).
+			WithInterface("", testNICName).
+			WithNetwork(testNICName, testNetworkName).
+			Created().Build()
+		givenNAD := ippool.NewNetworkAttachmentDefinitionBuilder(testNADNamespace, testNADName).
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+		givenIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+			NetworkName(testNetworkName).Build()
+
+		clientset := fake.NewSimpleClientset(givenVM, givenIPPool)
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		recorder := record.NewFakeRecorder(10)
+
+		handler := Handler{
+			pendingMACPolicy: config.PendingMACPolicyGenerate,
+			recorder:         recorder,
+			vmClient:         fakeclient.VirtualMachineClient(clientset.KubevirtV1().VirtualMachines),
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			vmnetcfgCache:    fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		}
+
+		_, err = handler.OnChange(testKey, givenVM)
+		assert.Nil(t, err)
+
+		updatedVM, err := handler.vmClient.Get(testVMNamespace, testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, "", updatedVM.Spec.Template.Spec.Domain.Devices.Interfaces[0].MacAddress)
+
+		_, err = handler.vmnetcfgClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+		assert.True(t, apierrors.IsNotFound(err), "no vmnetcfg should be created for the running vm")
+
+		if assert.Len(t, recorder.Events, 1) {
+			assert.Contains(t, <-recorder.Events, "Warning "+restartRequiredReason)
+		}
+	})
+
+	t.Run("new vm without mac on network without ippool reports nothing", func(t *testing.T) {
+		givenVM := newTestVMBuilder().
+			WithInterface("", testNICName).
+			WithNetwork(testNICName, testNetworkName).Build()
+		givenNAD := ippool.NewNetworkAttachmentDefinitionBuilder(testNADNamespace, testNADName).Build()
+
+		clientset := fake.NewSimpleClientset(givenVM)
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		recorder := record.NewFakeRecorder(10)
+
+		handler := Handler{
+			pendingMACPolicy: config.PendingMACPolicyReport,
+			recorder:         recorder,
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			vmClient:         fakeclient.VirtualMachineClient(clientset.KubevirtV1().VirtualMachines),
+			vmnetcfgCache:    fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		}
+
+		_, err = handler.OnChange(testKey, givenVM)
+		assert.Nil(t, err)
+		assert.Len(t, recorder.Events, 0)
+	})
+
+	t.Run("vm with networks without ippool reports them", func(t *testing.T) {
+		givenVM := newTestVMBuilder().
+			WithInterface(testMACAddress1, testNICName).
+			WithNetwork(testNICName, testNetworkName).
+			WithInterface(testMACAddress2, "nic2").
+			WithNetwork("nic2", "default/no-pool").Build()
+		givenNAD := ippool.NewNetworkAttachmentDefinitionBuilder(testNADNamespace, testNADName).
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+		givenIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+			NetworkName(testNetworkName).Build()
+		givenOtherNAD := ippool.NewNetworkAttachmentDefinitionBuilder("default", "no-pool").Build()
+
+		clientset := fake.NewSimpleClientset(givenVM, givenIPPool)
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		err = clientset.Tracker().Create(nadGVR, givenOtherNAD, givenOtherNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		handler := Handler{
+			ippoolCache:    fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:       fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			vmClient:       fakeclient.VirtualMachineClient(clientset.KubevirtV1().VirtualMachines),
+			vmController:   fakecontroller.VirtualMachineController(clientset.KubevirtV1().VirtualMachines),
+			vmnetcfgCache:  fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		}
+
+		_, err = handler.OnChange(testKey, givenVM)
+		assert.Nil(t, err)
+
+		updatedVM, err := handler.vmClient.Get(testVMNamespace, testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, `[{"interface":"nic2","networkName":"default/no-pool","reason":"NoIPPool"}]`, updatedVM.Annotations[skippedNetworksAnnotation])
+
+		vmNetCfg, err := handler.vmnetcfgClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Len(t, vmNetCfg.Spec.NetworkConfigs, 1)
+
+		// The annotation goes away once the network is backed by an IPPool
+		givenOtherNAD.Labels = map[string]string{
+			util.IPPoolNamespaceLabelKey: testIPPoolNamespace,
+			util.IPPoolNameLabelKey:      "other-pool",
+		}
+		_, err = clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions("default").Update(context.TODO(), givenOtherNAD, metav1.UpdateOptions{})
+		assert.Nil(t, err)
+		_, err = clientset.NetworkV1alpha1().IPPools(testIPPoolNamespace).Create(context.TODO(), ippool.NewIPPoolBuilder(testIPPoolNamespace, "other-pool").
+			NetworkName("default/no-pool").Build(), metav1.CreateOptions{})
+		assert.Nil(t, err)
+
+		_, err = handler.OnChange(testKey, updatedVM)
+		assert.Nil(t, err)
+
+		updatedVM, err = handler.vmClient.Get(testVMNamespace, testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.NotContains(t, updatedVM.Annotations, skippedNetworksAnnotation)
+	})
+
+	t.Run("vm with ambiguous network skips and reports it", func(t *testing.T) {
+		givenVM := newVMBuilder("tenant", testVMName).
+			WithInterface(testMACAddress1, testNICName).
+			WithNetwork(testNICName, "vlan100").
+			WithInterface(testMACAddress2, "nic2").
+			WithNetwork("nic2", "tenant/vlan100").Build()
+		givenGlobalNAD := ippool.NewNetworkAttachmentDefinitionBuilder("default", "vlan100").
+			Label(util.IPPoolNamespaceLabelKey, "default").
+			Label(util.IPPoolNameLabelKey, "pool-100").Build()
+		givenTenantNAD := ippool.NewNetworkAttachmentDefinitionBuilder("tenant", "vlan100").
+			Label(util.IPPoolNamespaceLabelKey, "tenant").
+			Label(util.IPPoolNameLabelKey, "tenant-100").Build()
+		givenGlobalIPPool := ippool.NewIPPoolBuilder("default", "pool-100").
+			NetworkName("default/vlan100").Build()
+		givenTenantIPPool := ippool.NewIPPoolBuilder("tenant", "tenant-100").
+			NetworkName("tenant/vlan100").Build()
+
+		clientset := fake.NewSimpleClientset(givenVM, givenGlobalIPPool, givenTenantIPPool)
+		for _, nad := range []*cniv1.NetworkAttachmentDefinition{givenGlobalNAD, givenTenantNAD} {
+			err := clientset.Tracker().Create(nadGVR, nad, nad.Namespace)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		}
+
+		recorder := record.NewFakeRecorder(10)
+
+		handler := Handler{
+			recorder:       recorder,
+			ippoolCache:    fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:       fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			vmClient:       fakeclient.VirtualMachineClient(clientset.KubevirtV1().VirtualMachines),
+			vmController:   fakecontroller.VirtualMachineController(clientset.KubevirtV1().VirtualMachines),
+			vmnetcfgCache:  fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		}
+
+		_, err := handler.OnChange("tenant/"+testVMName, givenVM)
+		assert.Nil(t, err)
+
+		if assert.Len(t, recorder.Events, 1) {
+			assert.Equal(t,
+				"Warning AmbiguousNetwork Interface nic1 on network vlan100 is not DHCP-managed as it matches tenant/vlan100 and default/vlan100 of different IPPools; qualify the network with a namespace",
+				<-recorder.Events,
+			)
+		}
+
+		updatedVM, err := handler.vmClient.Get("tenant", testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t,
+			`[{"interface":"nic1","networkName":"vlan100","reason":"AmbiguousNetwork","candidates":["tenant/vlan100","default/vlan100"]}]`,
+			updatedVM.Annotations[skippedNetworksAnnotation])
+
+		// The fully-qualified network is managed all the same
+		vmNetCfg, err := handler.vmnetcfgClient.Get("tenant", testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, []networkv1.NetworkConfig{
+			{MACAddress: testMACAddress2, NetworkName: "tenant/vlan100"},
+		}, vmNetCfg.Spec.NetworkConfigs)
+	})
+
+	t.Run("vm with unknown binding plugin skips and reports it", func(t *testing.T) {
+		givenVM := newVMBuilder(testVMNamespace, testVMName).
+			WithInterface(testMACAddress1, testNICName).
+			WithNetwork(testNICName, testNetworkName).Build()
+		givenVM.Spec.Template.Spec.Domain.Devices.Interfaces[0].Binding = &kubevirtv1.PluginBinding{Name: "vdpa"}
+
+		clientset := fake.NewSimpleClientset(givenVM)
+		recorder := record.NewFakeRecorder(10)
+
+		handler := Handler{
+			recorder:       recorder,
+			ippoolCache:    fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:       fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			vmClient:       fakeclient.VirtualMachineClient(clientset.KubevirtV1().VirtualMachines),
+			vmController:   fakecontroller.VirtualMachineController(clientset.KubevirtV1().VirtualMachines),
+			vmnetcfgCache:  fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		}
+
+		_, err := handler.OnChange(testKey, givenVM)
+		assert.Nil(t, err)
+
+		if assert.Len(t, recorder.Events, 1) {
+			assert.Equal(t,
+				"Warning UnknownNetworkType Interface nic1 is not DHCP-managed as it is attached to a network "+testNetworkName+" with unknown binding vdpa",
+				<-recorder.Events,
+			)
+		}
+
+		updatedVM, err := handler.vmClient.Get(testVMNamespace, testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t,
+			`[{"interface":"nic1","networkName":"`+testNetworkName+`","reason":"UnknownNetworkType"}]`,
+			updatedVM.Annotations[skippedNetworksAnnotation])
+
+		_, err = handler.vmnetcfgClient.Get(testVMNamespace, testVMName, metav1.GetOptions{})
+		assert.True(t, apierrors.IsNotFound(err))
+	})
+
+	t.Run("vm with duplicate interface names skips and reports them", func(t *testing.T) {
+		givenVM := newVMBuilder(testVMNamespace, testVMName).
+			WithInterface(testMACAddress1, testNICName).
+			WithInterface(testMACAddress2, testNICName).
+			WithInterface(testMACAddress3, "nic2").
+			WithNetwork(testNICName, testNetworkName).
+			WithNetwork("nic2", testNetworkName).Build()
+		givenNAD := ippool.NewNetworkAttachmentDefinitionBuilder(testNADNamespace, testNADName).
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+		givenIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+			NetworkName(testNetworkName).Build()
+
+		clientset := fake.NewSimpleClientset(givenVM, givenIPPool)
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		recorder := record.NewFakeRecorder(10)
+
+		handler := Handler{
+			recorder:       recorder,
+			ippoolCache:    fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:       fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			vmClient:       fakeclient.VirtualMachineClient(clientset.KubevirtV1().VirtualMachines),
+			vmController:   fakecontroller.VirtualMachineController(clientset.KubevirtV1().VirtualMachines),
+			vmnetcfgCache:  fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		}
+
+		_, err = handler.OnChange(testKey, givenVM)
+		assert.Nil(t, err)
+
+		if assert.Len(t, recorder.Events, 1) {
+			assert.Equal(t,
+				"Warning DuplicateInterfaceName Interfaces named nic1 are not DHCP-managed as more than one interface has the name; give each interface a unique name",
+				<-recorder.Events,
+			)
+		}
+
+		updatedVM, err := handler.vmClient.Get(testVMNamespace, testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t,
+			`[{"interface":"nic1","networkName":"`+testNetworkName+`","reason":"DuplicateInterfaceName"}]`,
+			updatedVM.Annotations[skippedNetworksAnnotation])
+
+		// Neither of the interfaces sharing the name gets an IP address, and
+		// the others are managed all the same
+		vmNetCfg, err := handler.vmnetcfgClient.Get(testVMNamespace, testVMName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, []networkv1.NetworkConfig{
+			{MACAddress: testMACAddress3, NetworkName: testNetworkName},
+		}, vmNetCfg.Spec.NetworkConfigs)
+	})
+
+	t.Run("recreated vm adopts the vmnetcfg of its former self", func(t *testing.T) {
+		const testVMUIDNew = "6d2c0b1e-7a0f-4d3e-9b8a-3c5f1e2d4a6b"
+
+		givenVM := newTestVMBuilder().
+			WithUID(testVMUIDNew).
+			WithInterface(testMACAddress1, testNICName).
+			WithNetwork(testNICName, testNetworkName).Build()
+		givenVmNetCfg := newTestVmNetCfgBuilder().
+			Label(vmLabelKey, testVMName).
+			OwnerRef(metav1.OwnerReference{
+				APIVersion: kubevirtv1.SchemeGroupVersion.String(),
+				Kind:       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+				Name:       testVMName,
+				UID:        testVMUID,
+			}).
+			WithVMName(testVMName).
+			WithNetworkConfig("", testMACAddress1, testNetworkName).
+			WithNetworkConfigStatus(testIPAddress, testMACAddress1, testNetworkName, networkv1.AllocatedState).Build()
+
+		clientset := fake.NewSimpleClientset(givenVM, givenVmNetCfg)
+		handler := Handler{
+			vmnetcfgCache:  fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		}
+
+		_, err := handler.OnChange(testKey, givenVM)
+		assert.Nil(t, err)
+
+		vmNetCfg, err := handler.vmnetcfgClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, []metav1.OwnerReference{{
+			APIVersion: kubevirtv1.SchemeGroupVersion.String(),
+			Kind:       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+			Name:       testVMName,
+			UID:        testVMUIDNew,
+		}}, vmNetCfg.OwnerReferences, "owner reference should point at the recreated vm")
+		assert.Equal(t, givenVmNetCfg.Status, vmNetCfg.Status, "leases should be kept")
+
+		// The vmnetcfg is no longer deemed orphaned
+		handler.vmCache = fakeclient.VirtualMachineCache(clientset.KubevirtV1().VirtualMachines)
+		isOrphaned, err := handler.isOrphanedVmNetCfg(vmNetCfg)
+		assert.Nil(t, err)
+		assert.False(t, isOrphaned)
+	})
+
+	t.Run("vm waits for its vmnetcfg being deleted", func(t *testing.T) {
+		givenVM := newTestVMBuilder().
+			WithUID(testVMUID).
+			WithInterface(testMACAddress1, testNICName).
+			WithNetwork(testNICName, testNetworkName).Build()
+		givenVmNetCfg := newTestVmNetCfgBuilder().
+			Label(vmLabelKey, testVMName).
+			WithVMName(testVMName).
+			WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+		now := metav1.Now()
+		givenVmNetCfg.DeletionTimestamp = &now
+		givenVmNetCfg.Finalizers = []string{"wrangler.cattle.io/vm-dhcp-vmnetcfg-controller"}
+
+		clientset := fake.NewSimpleClientset(givenVM, givenVmNetCfg)
+		vmController := &requeueRecorder{
+			VirtualMachineController: fakecontroller.VirtualMachineController(clientset.KubevirtV1().VirtualMachines),
+			requeued:                 make(map[string]time.Duration),
+		}
+		handler := Handler{
+			vmController:   vmController,
+			vmnetcfgCache:  fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		}
+
+		_, err := handler.OnChange(testKey, givenVM)
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]time.Duration{testKey: vmNetCfgDeletionRetryDelay}, vmController.requeued)
+
+		vmNetCfg, err := handler.vmnetcfgClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Empty(t, vmNetCfg.OwnerReferences, "vmnetcfg being deleted should not be adopted")
+	})
+}
+
+// requeueRecorder records the VMs requeued by the handler along with their
+// delay.
+type requeueRecorder struct {
+	fakecontroller.VirtualMachineController
+	requeued map[string]time.Duration
+}
+
+func (r *requeueRecorder) EnqueueAfter(namespace, name string, duration time.Duration) {
+	r.requeued[namespace+"/"+name] = duration
+}
+
+func TestHandler_CreateThrottle(t *testing.T) {
+	const (
+		vmCount = 30
+		qps     = 5
+		burst   = 10
+	)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(start)
+
+	clientset := fake.NewSimpleClientset()
+	vms := make(map[string]*kubevirtv1.VirtualMachine, vmCount)
+	for i := 0; i < vmCount; i++ {
+		vm := newVMBuilder(testVMNamespace, fmt.Sprintf("vm-%02d", i)).
+			WithInterface(fmt.Sprintf("11:22:33:44:55:%02x", i), testNICName).
+			WithNetwork(testNICName, testNetworkName).Build()
+		if err := clientset.Tracker().Add(vm); err != nil {
+			t.Fatal(err)
+		}
+		vms[vm.Namespace+"/"+vm.Name] = vm
+	}
+
+	recorder := &requeueRecorder{
+		VirtualMachineController: fakecontroller.VirtualMachineController(clientset.KubevirtV1().VirtualMachines),
+		requeued:                 make(map[string]time.Duration),
+	}
+	handler := Handler{
+		createThrottle: newCreateThrottle(qps, burst, fakeClock),
+		vmController:   recorder,
+		vmnetcfgCache:  fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+	}
+
+	countCreated := func() int {
+		vmNetCfgs, err := clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs(testVMNamespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(vmNetCfgs.Items)
+	}
+
+	// The import lands all at once
+	for key, vm := range vms {
+		_, err := handler.OnChange(key, vm)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, burst, countCreated(), "only a burst of vmnetcfgs should be created at once")
+	assert.Len(t, recorder.requeued, vmCount-burst, "the vms held back should be requeued")
+
+	// Work through the requeued vms in order, the way the workqueue does
+	for len(recorder.requeued) > 0 {
+		var (
+			next     string
+			earliest time.Duration
+		)
+		for key, delay := range recorder.requeued {
+			if next == "" || delay < earliest {
+				next, earliest = key, delay
+			}
+		}
+		delete(recorder.requeued, next)
+		for key := range recorder.requeued {
+			recorder.requeued[key] -= earliest
+		}
+		fakeClock.Step(earliest)
+
+		_, err := handler.OnChange(next, vms[next])
+		assert.Nil(t, err)
+
+		elapsed := fakeClock.Since(start)
+		assert.LessOrEqual(t, countCreated(), burst+int(elapsed.Seconds()*qps), "creation should stay within the rate after %s", elapsed)
+	}
+
+	assert.Equal(t, vmCount, countCreated(), "every vm should eventually get its vmnetcfg")
+	assert.Equal(t, time.Duration(vmCount-burst)*time.Second/qps, fakeClock.Since(start), "creation should be spread at the configured rate")
+	assert.Empty(t, handler.createThrottle.slots, "no slot should be left behind")
+}
+
+func TestHandler_EnqueueStorm(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	givenVM := newTestVMBuilder().
+		WithInterface(testMACAddress2, testNICName).
+		WithNetwork(testNICName, testNetworkName).Build()
+	// A vmnetcfg reverted to in-sync with its former network config each
+	// time it's flagged out-of-sync, so the VM never gets to update it
+	staleVmNetCfg := newTestVmNetCfgBuilder().
+		Label(vmLabelKey, testVMName).
+		WithVMName(testVMName).
+		WithNetworkConfig("", testMACAddress1, testNetworkName).
+		WithNetworkConfigStatus(testIPAddress, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+		InSyncedCondition(corev1.ConditionTrue, "", "").Build()
+
+	clientset := fake.NewSimpleClientset(givenVM, staleVmNetCfg)
+	vmController := &requeueRecorder{
+		VirtualMachineController: fakecontroller.VirtualMachineController(clientset.KubevirtV1().VirtualMachines),
+		requeued:                 make(map[string]time.Duration),
+	}
+	recorder := record.NewFakeRecorder(enqueueStormLimit)
+
+	handler := Handler{
+		recorder:       recorder,
+		enqueueGuard:   newEnqueueGuard(fakeClock),
+		vmController:   vmController,
+		vmnetcfgCache:  fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+	}
+
+	onChange := func() {
+		err := clientset.Tracker().Update(networkv1.SchemeGroupVersion.WithResource("virtualmachinenetworkconfigs"), staleVmNetCfg.DeepCopy(), testVmNetCfgNamespace)
+		assert.Nil(t, err)
+		_, err = handler.OnChange(testKey, givenVM)
+		assert.Nil(t, err)
+		fakeClock.Step(100 * time.Millisecond)
+	}
+
+	// The VM spins freely at first
+	for i := 0; i < enqueueStormLimit; i++ {
+		onChange()
+	}
+	assert.Empty(t, vmController.requeued)
+	assert.Empty(t, recorder.Events)
+
+	// and is backed off once it's found spinning
+	onChange()
+	assert.Equal(t, map[string]time.Duration{testKey: enqueueStormBackoff}, vmController.requeued)
+	if assert.Len(t, recorder.Events, 1) {
+		assert.Equal(t,
+			"Warning EnqueueStorm Network config keeps changing without the VirtualMachineNetworkConfig getting in sync; backing off for 30s",
+			<-recorder.Events,
+		)
+	}
+
+	// The count decays, so the VM spins freely again after a while
+	delete(vmController.requeued, testKey)
+	fakeClock.Step(5 * enqueueStormHalfLife)
+	onChange()
+	assert.Empty(t, vmController.requeued)
+}
+
+func TestHandler_TerminatingNamespace(t *testing.T) {
+	givenVM := newTestVMBuilder().
+		WithInterface(testMACAddress1, testNICName).
+		WithNetwork(testNICName, testNetworkName).Build()
+	givenNamespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: testVMNamespace},
+		Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceActive},
+	}
+
+	clientset := fake.NewSimpleClientset(givenVM)
+	k8sclientset := k8sfake.NewSimpleClientset(givenNamespace)
+
+	// The namespace starts terminating right after the cache was read, and
+	// the API server refuses the vmnetcfg the way the NamespaceLifecycle
+	// admission plugin does
+	var creates int
+	clientset.PrependReactor("create", "virtualmachinenetworkconfigs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		creates++
+		namespace := givenNamespace.DeepCopy()
+		namespace.Status.Phase = corev1.NamespaceTerminating
+		if _, err := k8sclientset.CoreV1().Namespaces().UpdateStatus(context.TODO(), namespace, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		err := apierrors.NewForbidden(networkv1.Resource("virtualmachinenetworkconfigs"), testVMName,
+			fmt.Errorf("unable to create new content in namespace %s because it is being terminated", testVMNamespace))
+		err.ErrStatus.Details.Causes = append(err.ErrStatus.Details.Causes, metav1.StatusCause{
+			Type:    corev1.NamespaceTerminatingCause,
+			Message: fmt.Sprintf("namespace %s is being terminated", testVMNamespace),
+			Field:   "metadata.namespace",
+		})
+		return true, nil, err
+	})
+
+	handler := Handler{
+		terminatingNamespaces: newTerminatingNamespaces(),
+		vmnetcfgCache:         fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		vmnetcfgClient:        fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		namespaceCache:        fakeclient.NamespaceCache(k8sclientset.CoreV1().Namespaces),
+	}
+
+	_, err := handler.OnChange(testKey, givenVM)
+	assert.Nil(t, err, "refusal due to the terminating namespace should not be retried")
+	assert.Equal(t, 1, creates)
+
+	_, err = handler.OnChange(testKey, givenVM)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, creates, "no vmnetcfg should be created in a terminating namespace")
+	assert.Contains(t, handler.terminatingNamespaces.namespaces, testVMNamespace)
+
+	// Deleted VMs are still let go of
+	deletedVM := givenVM.DeepCopy()
+	deletedVM.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	_, err = handler.OnChange(testKey, deletedVM)
+	assert.Nil(t, err)
+}
+
+func TestHandler_CollectOrphanedVmNetCfgs(t *testing.T) {
+	const testVMUIDNew = "6d2c0b1e-7a0f-4d3e-9b8a-3c5f1e2d4a6b"
+
+	newLabeledVmNetCfg := func() *networkv1.VirtualMachineNetworkConfig {
+		return newTestVmNetCfgBuilder().
+			Label(vmLabelKey, testVMName).
+			WithVMName(testVMName).
+			WithNetworkConfig("", testMACAddress1, testNetworkName).
+			WithNetworkConfigStatus(testIPAddress, testMACAddress1, testNetworkName, networkv1.AllocatedState).Build()
+	}
+	newOwnedVmNetCfg := func() *networkv1.VirtualMachineNetworkConfig {
+		vmNetCfg := newLabeledVmNetCfg()
+		vmNetCfg.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: kubevirtv1.SchemeGroupVersion.String(),
+			Kind:       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+			Name:       testVMName,
+			UID:        testVMUID,
+		}}
+		return vmNetCfg
+	}
+
+	testCases := []struct {
+		name          string
+		givenVM       *kubevirtv1.VirtualMachine
+		givenVmNetCfg *networkv1.VirtualMachineNetworkConfig
+		// upgrading holds the objects of former releases as not upgraded
+		// yet
+		upgrading      bool
+		expectedDelete bool
+		expectedPinned bool
+	}{
+		{
+			name:          "vmnetcfg of an existing vm is kept",
+			givenVM:       newTestVMBuilder().WithUID(testVMUID).Build(),
+			givenVmNetCfg: newOwnedVmNetCfg(),
+		},
+		{
+			name:           "vmnetcfg of a vm deleted while the controller was down is removed",
+			givenVmNetCfg:  newLabeledVmNetCfg(),
+			expectedDelete: true,
+		},
+		{
+			name:           "vmnetcfg of a deleted vm recreated with the same name is removed",
+			givenVM:        newTestVMBuilder().WithUID(testVMUIDNew).Build(),
+			givenVmNetCfg:  newOwnedVmNetCfg(),
+			expectedDelete: true,
+		},
+		{
+			name:          "vmnetcfg without the vm label is left alone",
+			givenVmNetCfg: newTestVmNetCfgBuilder().WithVMName(testVMName).Build(),
+		},
+		{
+			name:          "vmnetcfg of a deleted vm is kept while upgrading",
+			givenVmNetCfg: newLabeledVmNetCfg(),
+			upgrading:     true,
+		},
+		{
+			name: "vmnetcfg of a deleted vm with pinned leases is kept",
+			givenVmNetCfg: func() *networkv1.VirtualMachineNetworkConfig {
+				vmNetCfg := newLabeledVmNetCfg()
+				vmNetCfg.Annotations = map[string]string{util.PinLeaseAnnotationKey: "true"}
+				return vmNetCfg
+			}(),
+			expectedPinned: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(tc.givenVmNetCfg)
+			if tc.givenVM != nil {
+				err := clientset.Tracker().Add(tc.givenVM)
+				assert.Nil(t, err, "mock resource should add into fake controller tracker")
+			}
+
+			fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			recorder := record.NewFakeRecorder(1)
+
+			handler := Handler{
+				clock:          fakeClock,
+				recorder:       recorder,
+				vmCache:        fakeclient.VirtualMachineCache(clientset.KubevirtV1().VirtualMachines),
+				vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+				vmnetcfgCache:  fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			}
+			if tc.upgrading {
+				handler.upgrade = config.NewUpgrade()
+			}
+
+			// The first sweeps only mark orphaned vmnetcfgs
+			err := handler.collectOrphanedVmNetCfgs()
+			assert.Nil(t, err)
+			fakeClock.Step(vmNetCfgGCGracePeriod / 2)
+			err = handler.collectOrphanedVmNetCfgs()
+			assert.Nil(t, err)
+
+			_, err = handler.vmnetcfgClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+			assert.Nil(t, err, "vmnetcfg should survive the grace period")
+
+			fakeClock.Step(vmNetCfgGCGracePeriod / 2)
+			err = handler.collectOrphanedVmNetCfgs()
+			assert.Nil(t, err)
+
+			// The finalizer of the vmnetcfg controller releases the IP
+			// addresses once the deletion goes through
+			_, err = handler.vmnetcfgClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+			if tc.expectedDelete {
+				assert.True(t, apierrors.IsNotFound(err), "vmnetcfg should be deleted")
+				if assert.Len(t, recorder.Events, 1) {
+					assert.Contains(t, <-recorder.Events, orphanedVmNetCfgReason)
+				}
+			} else if tc.expectedPinned {
+				assert.Nil(t, err, "vmnetcfg should be kept")
+				if assert.Len(t, recorder.Events, 1) {
+					assert.Contains(t, <-recorder.Events, pinnedLeasesReason)
+				}
+
+				// The blocker is only reported once
+				fakeClock.Step(vmNetCfgGCInterval)
+				err = handler.collectOrphanedVmNetCfgs()
+				assert.Nil(t, err)
+				assert.Empty(t, recorder.Events)
+				_, err = handler.vmnetcfgClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+				assert.Nil(t, err, "vmnetcfg should still be kept")
+				return
+			} else {
+				assert.Nil(t, err, "vmnetcfg should be kept")
+				assert.Empty(t, recorder.Events)
+			}
+			assert.Empty(t, handler.orphanedVmNetCfgs)
+		})
+	}
+}
+
+// indexedVmNetCfgCache serves the indexes the controller adds to the vmnetcfg
+// cache.
+type indexedVmNetCfgCache struct {
+	fakeclient.VirtualMachineNetworkConfigCache
+}
+
+func (c indexedVmNetCfgCache) GetByIndex(indexName, key string) ([]*networkv1.VirtualMachineNetworkConfig, error) {
+	if indexName != indexer.VmNetCfgByNetworkMACIndex {
+		return c.VirtualMachineNetworkConfigCache.GetByIndex(indexName, key)
+	}
+
+	vmNetCfgs, err := c.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var result []*networkv1.VirtualMachineNetworkConfig
+	for _, vmNetCfg := range vmNetCfgs {
+		keys, _ := util.VmNetCfgByNetworkMAC(vmNetCfg)
+		for _, k := range keys {
+			if k == key {
+				result = append(result, vmNetCfg)
+				break
+			}
+		}
+	}
+	return result, nil
 }
@@ -0,0 +1,159 @@
+package vm
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+const (
+	vmNetCfgGCInterval    = time.Minute
+	vmNetCfgGCGracePeriod = 2 * time.Minute
+
+	orphanedVmNetCfgReason = "OrphanedVmNetCfg"
+	// pinnedLeasesReason is the reason of the events about orphaned
+	// vmnetcfgs kept as their leases are pinned
+	pinnedLeasesReason = "PinnedLeases"
+)
+
+// runVmNetCfgGC sweeps orphaned VirtualMachineNetworkConfigs right away and
+// then periodically until ctx is done.
+func (h *Handler) runVmNetCfgGC(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(context.Context) {
+		if err := h.collectOrphanedVmNetCfgs(); err != nil {
+			logrus.Errorf("(vm.collectOrphanedVmNetCfgs) %s", err.Error())
+		}
+	}, vmNetCfgGCInterval)
+}
+
+// collectOrphanedVmNetCfgs deletes the VirtualMachineNetworkConfigs whose VM
+// no longer exists. The garbage collector of Kubernetes takes care of the ones
+// owned by their VM, but not of the ones whose owner reference got lost, e.g.,
+// by being restored from a backup, which are left behind for good when their
+// VM is deleted while the controller is down. Only the ones labeled with the
+// name of their VM are considered, so the ones created by hand are left
+// alone. A VirtualMachineNetworkConfig is only deleted after being seen
+// orphaned for the whole grace period, so a briefly inconsistent cache
+// doesn't take the IP addresses of a running VM. Their IP addresses are
+// released by the finalizer of the vmnetcfg controller as usual, which is why
+// the ones whose leases are pinned are kept, and reported as such once.
+func (h *Handler) collectOrphanedVmNetCfgs() error {
+	if h.cachesSynced != nil && !h.cachesSynced() {
+		logrus.Debug("(vm.collectOrphanedVmNetCfgs) caches not synced yet, skip")
+		return nil
+	}
+	if h.upgrade != nil && !h.upgrade.IsDone() {
+		logrus.Debug("(vm.collectOrphanedVmNetCfgs) objects of former releases not upgraded yet, skip")
+		return nil
+	}
+
+	requirement, err := labels.NewRequirement(vmLabelKey, selection.Exists, nil)
+	if err != nil {
+		return err
+	}
+	vmNetCfgs, err := h.vmnetcfgCache.List(metav1.NamespaceAll, labels.NewSelector().Add(*requirement))
+	if err != nil {
+		return err
+	}
+
+	orphaned := make(map[string]time.Time, len(h.orphanedVmNetCfgs))
+	for _, vmNetCfg := range vmNetCfgs {
+		if vmNetCfg.DeletionTimestamp != nil {
+			continue
+		}
+
+		isOrphaned, err := h.isOrphanedVmNetCfg(vmNetCfg)
+		if err != nil {
+			return err
+		}
+		if !isOrphaned {
+			continue
+		}
+
+		key := vmNetCfg.Namespace + "/" + vmNetCfg.Name
+		since, ok := h.orphanedVmNetCfgs[key]
+		if !ok {
+			since = h.clock.Now()
+			logrus.Infof("(vm.collectOrphanedVmNetCfgs) vmnetcfg %s has no backing vm %s/%s", key, vmNetCfg.Namespace, vmNetCfg.Labels[vmLabelKey])
+		}
+		if h.clock.Since(since) < vmNetCfgGCGracePeriod {
+			orphaned[key] = since
+			continue
+		}
+
+		if util.IsLeasePinned(vmNetCfg) {
+			orphaned[key] = since
+			if _, ok := h.pinnedOrphanedVmNetCfgs[key]; ok {
+				continue
+			}
+			logrus.Warnf("(vm.collectOrphanedVmNetCfgs) keep orphaned vmnetcfg %s as its leases are pinned", key)
+			if h.recorder != nil {
+				h.recorder.Eventf(vmNetCfg, corev1.EventTypeWarning, pinnedLeasesReason,
+					"Keeping vmnetcfg although its vm %s/%s no longer exists, as its leases are pinned; remove the %s annotation to release them",
+					vmNetCfg.Namespace, vmNetCfg.Labels[vmLabelKey], util.PinLeaseAnnotationKey)
+			}
+			if h.pinnedOrphanedVmNetCfgs == nil {
+				h.pinnedOrphanedVmNetCfgs = make(map[string]struct{})
+			}
+			h.pinnedOrphanedVmNetCfgs[key] = struct{}{}
+			continue
+		}
+
+		logrus.Infof("(vm.collectOrphanedVmNetCfgs) remove orphaned vmnetcfg %s", key)
+		if h.recorder != nil {
+			h.recorder.Eventf(vmNetCfg, corev1.EventTypeWarning, orphanedVmNetCfgReason,
+				"Deleting vmnetcfg as its vm %s/%s no longer exists", vmNetCfg.Namespace, vmNetCfg.Labels[vmLabelKey])
+		}
+		if err := h.vmnetcfgClient.Delete(vmNetCfg.Namespace, vmNetCfg.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			orphaned[key] = since
+			h.orphanedVmNetCfgs = orphaned
+			return err
+		}
+	}
+	h.orphanedVmNetCfgs = orphaned
+	for key := range h.pinnedOrphanedVmNetCfgs {
+		if _, ok := orphaned[key]; !ok {
+			delete(h.pinnedOrphanedVmNetCfgs, key)
+		}
+	}
+
+	return nil
+}
+
+// isOrphanedVmNetCfg reports whether the VM the VirtualMachineNetworkConfig
+// was created for is gone. A VM recreated with the same name doesn't count,
+// which is told apart by the UID of the owner reference, if any.
+func (h *Handler) isOrphanedVmNetCfg(vmNetCfg *networkv1.VirtualMachineNetworkConfig) (bool, error) {
+	vmName := vmNetCfg.Labels[vmLabelKey]
+	if vmName == "" {
+		return false, nil
+	}
+
+	vm, err := h.vmCache.Get(vmNetCfg.Namespace, vmName)
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, owner := range vmNetCfg.OwnerReferences {
+		if owner.Kind == kubevirtv1.VirtualMachineGroupVersionKind.Kind && owner.Name == vm.Name &&
+			owner.UID != "" && vm.UID != "" {
+			return owner.UID != vm.UID, nil
+		}
+	}
+
+	return false, nil
+}
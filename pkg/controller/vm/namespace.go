@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// terminatingNamespaces keeps the namespaces being deleted the creation of
+// vmnetcfgs was skipped for, so the skip is only logged once per namespace.
+type terminatingNamespaces struct {
+	namespaces map[string]struct{}
+	mutex      sync.Mutex
+}
+
+func newTerminatingNamespaces() *terminatingNamespaces {
+	return &terminatingNamespaces{
+		namespaces: make(map[string]struct{}),
+	}
+}
+
+// observe records the namespace as terminating and reports whether it's the
+// first time.
+func (t *terminatingNamespaces) observe(namespace string) bool {
+	if t == nil {
+		return true
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.namespaces[namespace]; ok {
+		return false
+	}
+	t.namespaces[namespace] = struct{}{}
+	return true
+}
+
+// forget drops the namespace, e.g., as it was created again under the same
+// name.
+func (t *terminatingNamespaces) forget(namespace string) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.namespaces, namespace)
+}
+
+// isNamespaceTerminating tells whether the namespace is being deleted, in
+// which case the API server refuses to create anything new in it. Namespaces
+// which cannot be read are deemed active, leaving the verdict to the API
+// server.
+func (h *Handler) isNamespaceTerminating(namespace string) bool {
+	// The cache isn't set up in tests not caring about it
+	if h.namespaceCache == nil {
+		return false
+	}
+
+	ns, err := h.namespaceCache.Get(namespace)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logrus.Warnf("(vm.isNamespaceTerminating) cannot get namespace %s: %v", namespace, err)
+		}
+		return false
+	}
+
+	terminating := ns.DeletionTimestamp != nil || ns.Status.Phase == corev1.NamespaceTerminating
+	if !terminating {
+		h.terminatingNamespaces.forget(namespace)
+	}
+	return terminating
+}
+
+// skipTerminatingNamespace logs, once per namespace, that no vmnetcfg is
+// created in the namespace as it's being deleted.
+func (h *Handler) skipTerminatingNamespace(key, namespace string) {
+	h.createThrottle.forget(key)
+	if h.terminatingNamespaces.observe(namespace) {
+		logrus.Debugf("(vm.OnChange) namespace %s is being deleted, skip creating vmnetcfgs in it, starting with vm %s", namespace, key)
+	}
+}
+
+// isNamespaceTerminatingError tells whether the API server refused to create
+// an object as its namespace is being deleted.
+func isNamespaceTerminatingError(err error) bool {
+	return apierrors.HasStatusCause(err, corev1.NamespaceTerminatingCause)
+}
@@ -0,0 +1,277 @@
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// SkipReason tells why an interface of a VirtualMachine is left out of its
+// VirtualMachineNetworkConfig.
+type SkipReason string
+
+const (
+	// SkipReasonNotMultus is for interfaces not attached to a Multus
+	// network, e.g., the ones on the pod network or without any network.
+	SkipReasonNotMultus SkipReason = "NotMultus"
+	// SkipReasonNoIPPool is for interfaces attached to a network which isn't
+	// backed by an IPPool.
+	SkipReasonNoIPPool SkipReason = "NoIPPool"
+	// SkipReasonPendingMAC is for interfaces that would be managed if they
+	// had a MAC address.
+	SkipReasonPendingMAC SkipReason = "PendingMAC"
+	// SkipReasonInvalidMAC is for interfaces whose MAC address isn't a
+	// valid 48-bit MAC address, which no agent could serve.
+	SkipReasonInvalidMAC SkipReason = "InvalidMAC"
+	// SkipReasonDuplicateMAC is for interfaces sharing the MAC address of an
+	// interface before them. The agents key their leases by MAC address, so
+	// only the first one can be served.
+	SkipReasonDuplicateMAC SkipReason = "DuplicateMAC"
+	// SkipReasonAmbiguousNetwork is for interfaces attached to a network
+	// given without a namespace that matches NetworkAttachmentDefinitions
+	// pointing to different IPPools.
+	SkipReasonAmbiguousNetwork SkipReason = "AmbiguousNetwork"
+	// SkipReasonDuplicateInterfaceName is for interfaces sharing their name
+	// with another interface. There's no telling which network and MAC
+	// address belong together, so none of them is kept.
+	SkipReasonDuplicateInterfaceName SkipReason = "DuplicateInterfaceName"
+	// SkipReasonUnmanagedBinding is for interfaces attached to a Multus
+	// network with a binding hiding the guest behind the pod, e.g.,
+	// masquerade or passt, so it never sees the DHCP server of the network.
+	SkipReasonUnmanagedBinding SkipReason = "UnmanagedBinding"
+	// SkipReasonUnknownNetworkType is for interfaces attached to a network
+	// of a type, or with a binding plugin, this controller doesn't know of.
+	// They're skipped rather than guessed at, likely being from a KubeVirt
+	// newer than the one vendored.
+	SkipReasonUnknownNetworkType SkipReason = "UnknownNetworkType"
+)
+
+// interfaceBindings tells whether the guest behind an interface of each
+// binding KubeVirt supports reaches the DHCP server of a Multus network. The
+// deprecated core bindings and the binding plugins share their names.
+var interfaceBindings = map[string]bool{
+	"bridge":     true,
+	"sriov":      true,
+	"macvtap":    true,
+	"managedTap": true,
+	"masquerade": false,
+	"slirp":      false,
+	"passt":      false,
+}
+
+// SkippedInterface is an interface left out of the VirtualMachineNetworkConfig.
+type SkippedInterface struct {
+	InterfaceName string
+	MACAddress    string
+	NetworkName   string
+	// Binding is the binding of the interface, only given if the interface
+	// is skipped for it.
+	Binding string
+	Reason  SkipReason
+	// Candidates are the NetworkAttachmentDefinitions an ambiguous network
+	// matches, as <namespace>/<name>.
+	Candidates []string
+}
+
+// IPPoolResolver returns nil if the network is backed by an IPPool, or why
+// it isn't otherwise.
+type IPPoolResolver func(networkName string) error
+
+// BuildNetworkConfigs returns the network configs the VirtualMachine needs an
+// IP address for, in the order of its interfaces, along with the interfaces
+// skipped. Only interfaces with a MAC address attached to a Multus network
+// backed by an IPPool are kept.
+//
+// Interfaces on the pod network, whatever their binding, and the ones bound to
+// a Multus network in a way hiding the guest behind the pod are unmanaged.
+// Networks of an unknown type and unknown binding plugins are skipped as such.
+//
+// Networks given without a namespace that match NetworkAttachmentDefinitions
+// pointing to different IPPools are skipped rather than guessed, see
+// util.GetIPPoolFromNetworkName.
+//
+// Interface names showing up more than once, which KubeVirt would refuse
+// anyway, are skipped altogether, at the position of their first appearance,
+// rather than collapsed into one of them. Network names showing up more than
+// once have the last Multus network of the name win. The MAC addresses of the
+// network configs are normalized, and interfaces sharing a MAC address only
+// have the first of them kept.
+//
+// The default route settings of the interfaces are taken from the
+// default-route annotation. Interfaces left out of it go with the setting of
+// their IPPool.
+func BuildNetworkConfigs(vm *kubevirtv1.VirtualMachine, resolveIPPool IPPoolResolver) ([]networkv1.NetworkConfig, []SkippedInterface) {
+	if vm == nil || vm.Spec.Template == nil {
+		return nil, nil
+	}
+
+	multusNetworks := make(map[string]string, len(vm.Spec.Template.Spec.Networks))
+	unknownNetworks := make(map[string]struct{})
+	for _, network := range vm.Spec.Template.Spec.Networks {
+		switch {
+		case network.Multus != nil:
+			multusNetworks[network.Name] = network.Multus.NetworkName
+		case network.Pod != nil:
+			// The pod network is never managed
+		default:
+			unknownNetworks[network.Name] = struct{}{}
+		}
+	}
+
+	// Interfaces are keyed by name, keeping the position of their first
+	// appearance
+	var names []string
+	macAddresses := make(map[string]string)
+	bindings := make(map[string]string)
+	occurrences := make(map[string]int)
+	for _, nic := range vm.Spec.Template.Spec.Domain.Devices.Interfaces {
+		if occurrences[nic.Name] == 0 {
+			names = append(names, nic.Name)
+		}
+		occurrences[nic.Name]++
+		macAddresses[nic.Name] = nic.MacAddress
+		bindings[nic.Name] = interfaceBinding(nic)
+	}
+
+	defaultRoutes := parseDefaultRouteAnnotation(vm)
+	modes := parseDHCPModeAnnotation(vm)
+
+	var (
+		ncs     []networkv1.NetworkConfig
+		skipped []SkippedInterface
+	)
+	seenMACAddresses := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		skip := SkippedInterface{
+			InterfaceName: name,
+			MACAddress:    macAddresses[name],
+			NetworkName:   multusNetworks[name],
+		}
+
+		managed, knownBinding := interfaceBindings[bindings[name]]
+		_, unknownNetwork := unknownNetworks[name]
+
+		var (
+			poolErr   error
+			ambiguous *util.AmbiguousNetworkError
+		)
+		macAddress, macErr := util.ParseMAC(skip.MACAddress)
+		if skip.NetworkName != "" && managed && occurrences[name] == 1 {
+			poolErr = resolveIPPool(skip.NetworkName)
+		}
+
+		switch {
+		case occurrences[name] > 1:
+			skip.Reason = SkipReasonDuplicateInterfaceName
+			skip.MACAddress = ""
+		case skip.NetworkName == "" && unknownNetwork:
+			skip.Reason = SkipReasonUnknownNetworkType
+		case skip.NetworkName == "":
+			skip.Reason = SkipReasonNotMultus
+		case !knownBinding:
+			skip.Reason = SkipReasonUnknownNetworkType
+			skip.Binding = bindings[name]
+		case !managed:
+			skip.Reason = SkipReasonUnmanagedBinding
+			skip.Binding = bindings[name]
+		case errors.As(poolErr, &ambiguous):
+			skip.Reason = SkipReasonAmbiguousNetwork
+			skip.Candidates = ambiguous.Candidates
+		case poolErr != nil:
+			skip.Reason = SkipReasonNoIPPool
+		case skip.MACAddress == "":
+			skip.Reason = SkipReasonPendingMAC
+		case macErr != nil:
+			skip.Reason = SkipReasonInvalidMAC
+		case hasMACAddress(seenMACAddresses, macAddress):
+			skip.Reason = SkipReasonDuplicateMAC
+		default:
+			seenMACAddresses[macAddress] = struct{}{}
+			nc := networkv1.NetworkConfig{
+				MACAddress:  macAddress,
+				NetworkName: skip.NetworkName,
+			}
+			if defaultRoute, ok := defaultRoutes[name]; ok {
+				nc.DefaultRoute = &defaultRoute
+			}
+			nc.Mode = modes[name]
+			ncs = append(ncs, nc)
+			continue
+		}
+
+		skipped = append(skipped, skip)
+	}
+
+	return ncs, skipped
+}
+
+// interfaceBinding returns the name of the binding of nic, i.e., the one of its
+// binding plugin or of its core binding, which defaults to bridge.
+func interfaceBinding(nic kubevirtv1.Interface) string {
+	switch {
+	case nic.Binding != nil:
+		return nic.Binding.Name
+	case nic.Masquerade != nil:
+		return "masquerade"
+	case nic.SRIOV != nil:
+		return "sriov"
+	case nic.DeprecatedSlirp != nil:
+		return "slirp"
+	case nic.DeprecatedMacvtap != nil:
+		return "macvtap"
+	case nic.DeprecatedPasst != nil:
+		return "passt"
+	default:
+		return "bridge"
+	}
+}
+
+func hasMACAddress(macAddresses map[string]struct{}, macAddress string) bool {
+	_, ok := macAddresses[macAddress]
+	return ok
+}
+
+// parseDefaultRouteAnnotation returns the default route settings of the
+// interfaces by name. A malformed annotation is ignored as a whole.
+func parseDefaultRouteAnnotation(vm *kubevirtv1.VirtualMachine) map[string]bool {
+	annotation, ok := vm.Annotations[defaultRouteAnnotation]
+	if !ok || annotation == "" {
+		return nil
+	}
+
+	var defaultRoutes map[string]bool
+	if err := json.Unmarshal([]byte(annotation), &defaultRoutes); err != nil {
+		logrus.Warnf("(vm.parseDefaultRouteAnnotation) failed to parse default route annotation for vm %s/%s: %v", vm.Namespace, vm.Name, err)
+		return nil
+	}
+
+	return defaultRoutes
+}
+
+// parseDHCPModeAnnotation returns the modes of the interfaces by name. A
+// malformed annotation, or one with an unknown mode, is ignored as a whole.
+func parseDHCPModeAnnotation(vm *kubevirtv1.VirtualMachine) map[string]networkv1.NetworkConfigMode {
+	annotation, ok := vm.Annotations[dhcpModeAnnotation]
+	if !ok || annotation == "" {
+		return nil
+	}
+
+	var modes map[string]networkv1.NetworkConfigMode
+	if err := json.Unmarshal([]byte(annotation), &modes); err != nil {
+		logrus.Warnf("(vm.parseDHCPModeAnnotation) failed to parse dhcp mode annotation for vm %s/%s: %v", vm.Namespace, vm.Name, err)
+		return nil
+	}
+	for name, mode := range modes {
+		if mode != networkv1.NetworkConfigModeDHCP && mode != networkv1.NetworkConfigModeReserveOnly {
+			logrus.Warnf("(vm.parseDHCPModeAnnotation) unknown dhcp mode %q of interface %s for vm %s/%s", mode, name, vm.Namespace, vm.Name)
+			return nil
+		}
+	}
+
+	return modes
+}
@@ -0,0 +1,602 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+const (
+	testNetworkNameNoIPPool  = testNADNamespace + "/no-pool"
+	testNetworkNameAmbiguous = "vlan100"
+	testMACAddress3          = "33:44:55:66:77:88"
+)
+
+var testAmbiguousCandidates = []string{"tenant/vlan100", "default/vlan100"}
+
+// testIPPoolResolver resolves the networks given, and testNetworkNameAmbiguous
+// as ambiguous.
+func testIPPoolResolver(networkNames ...string) IPPoolResolver {
+	return func(networkName string) error {
+		if networkName == testNetworkNameAmbiguous {
+			return &util.AmbiguousNetworkError{
+				NetworkName: networkName,
+				Candidates:  testAmbiguousCandidates,
+				IPPools:     []string{"tenant/tenant-100", "default/pool-100"},
+			}
+		}
+		for _, n := range networkNames {
+			if n == networkName {
+				return nil
+			}
+		}
+		return errors.New("no ippool")
+	}
+}
+
+func TestBuildNetworkConfigs(t *testing.T) {
+	withInterfaceState := func(vm *kubevirtv1.VirtualMachine, nicName string, state kubevirtv1.InterfaceState) *kubevirtv1.VirtualMachine {
+		for i := range vm.Spec.Template.Spec.Domain.Devices.Interfaces {
+			if vm.Spec.Template.Spec.Domain.Devices.Interfaces[i].Name == nicName {
+				vm.Spec.Template.Spec.Domain.Devices.Interfaces[i].State = state
+			}
+		}
+		return vm
+	}
+	withEmptyMultusNetwork := func(vm *kubevirtv1.VirtualMachine, nicName string) *kubevirtv1.VirtualMachine {
+		vm.Spec.Template.Spec.Networks = append(vm.Spec.Template.Spec.Networks, kubevirtv1.Network{
+			Name: nicName,
+			NetworkSource: kubevirtv1.NetworkSource{
+				Multus: &kubevirtv1.MultusNetwork{},
+			},
+		})
+		return vm
+	}
+	withBinding := func(vm *kubevirtv1.VirtualMachine, nicName string, bind func(nic *kubevirtv1.Interface)) *kubevirtv1.VirtualMachine {
+		for i := range vm.Spec.Template.Spec.Domain.Devices.Interfaces {
+			if vm.Spec.Template.Spec.Domain.Devices.Interfaces[i].Name == nicName {
+				bind(&vm.Spec.Template.Spec.Domain.Devices.Interfaces[i])
+			}
+		}
+		return vm
+	}
+	withUnknownNetwork := func(vm *kubevirtv1.VirtualMachine, nicName string) *kubevirtv1.VirtualMachine {
+		vm.Spec.Template.Spec.Networks = append(vm.Spec.Template.Spec.Networks, kubevirtv1.Network{Name: nicName})
+		return vm
+	}
+	defaultRoute, noDefaultRoute := true, false
+
+	testCases := []struct {
+		name            string
+		vm              *kubevirtv1.VirtualMachine
+		expectedConfigs []networkv1.NetworkConfig
+		expectedSkipped []SkippedInterface
+	}{
+		{
+			name: "nil vm",
+		},
+		{
+			name: "vm without template",
+			vm:   newTestVMBuilder().Build(),
+		},
+		{
+			name: "vm without interfaces",
+			vm: newTestVMBuilder().
+				WithNetwork(testNICName, testNetworkName).Build(),
+		},
+		{
+			name: "interface on pool-backed network",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+			},
+		},
+		{
+			name: "interface on pod network",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, "default").
+				WithNetwork("default", "").Build(),
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "default", MACAddress: testMACAddress1, Reason: SkipReasonNotMultus},
+			},
+		},
+		{
+			name: "passt plugin interface on pod network",
+			vm: withBinding(newTestVMBuilder().
+				WithInterface(testMACAddress1, "default").
+				WithNetwork("default", "").Build(), "default", func(nic *kubevirtv1.Interface) {
+				nic.Binding = &kubevirtv1.PluginBinding{Name: "passt"}
+			}),
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "default", MACAddress: testMACAddress1, Reason: SkipReasonNotMultus},
+			},
+		},
+		{
+			name: "masquerade interface on pool-backed network",
+			vm: withBinding(newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNetworkName).Build(), testNICName, func(nic *kubevirtv1.Interface) {
+				nic.Masquerade = &kubevirtv1.InterfaceMasquerade{}
+			}),
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: testNICName, MACAddress: testMACAddress1, NetworkName: testNetworkName, Binding: "masquerade", Reason: SkipReasonUnmanagedBinding},
+			},
+		},
+		{
+			name: "managedTap plugin interface on pool-backed network",
+			vm: withBinding(newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNetworkName).Build(), testNICName, func(nic *kubevirtv1.Interface) {
+				nic.Binding = &kubevirtv1.PluginBinding{Name: "managedTap"}
+			}),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+			},
+		},
+		{
+			name: "unknown plugin interface on pool-backed network",
+			vm: withBinding(newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNetworkName).Build(), testNICName, func(nic *kubevirtv1.Interface) {
+				nic.Binding = &kubevirtv1.PluginBinding{Name: "vdpa"}
+			}),
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: testNICName, MACAddress: testMACAddress1, NetworkName: testNetworkName, Binding: "vdpa", Reason: SkipReasonUnknownNetworkType},
+			},
+		},
+		{
+			name: "interface on network of unknown type",
+			vm: withUnknownNetwork(newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).
+				WithInterface(testMACAddress2, "nic2").
+				WithNetwork("nic2", testNetworkName).Build(), testNICName),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress2, NetworkName: testNetworkName},
+			},
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: testNICName, MACAddress: testMACAddress1, Reason: SkipReasonUnknownNetworkType},
+			},
+		},
+		{
+			name: "interface on ambiguous network",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNetworkNameAmbiguous).
+				WithInterface(testMACAddress2, "nic2").
+				WithNetwork("nic2", testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress2, NetworkName: testNetworkName},
+			},
+			expectedSkipped: []SkippedInterface{
+				{
+					InterfaceName: testNICName,
+					MACAddress:    testMACAddress1,
+					NetworkName:   testNetworkNameAmbiguous,
+					Reason:        SkipReasonAmbiguousNetwork,
+					Candidates:    testAmbiguousCandidates,
+				},
+			},
+		},
+		{
+			name: "interface without mac on ambiguous network",
+			vm: newTestVMBuilder().
+				WithInterface("", testNICName).
+				WithNetwork(testNICName, testNetworkNameAmbiguous).Build(),
+			expectedSkipped: []SkippedInterface{
+				{
+					InterfaceName: testNICName,
+					NetworkName:   testNetworkNameAmbiguous,
+					Reason:        SkipReasonAmbiguousNetwork,
+					Candidates:    testAmbiguousCandidates,
+				},
+			},
+		},
+		{
+			name: "interface without network",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).Build(),
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: testNICName, MACAddress: testMACAddress1, Reason: SkipReasonNotMultus},
+			},
+		},
+		{
+			name: "network without interface",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNetworkName).
+				WithNetwork("nic2", testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+			},
+		},
+		{
+			name: "multus network without network name",
+			vm: withEmptyMultusNetwork(newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).Build(), testNICName),
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: testNICName, MACAddress: testMACAddress1, Reason: SkipReasonNotMultus},
+			},
+		},
+		{
+			name: "interface on network without ippool",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNetworkNameNoIPPool).Build(),
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: testNICName, MACAddress: testMACAddress1, NetworkName: testNetworkNameNoIPPool, Reason: SkipReasonNoIPPool},
+			},
+		},
+		{
+			name: "interface without mac on pool-backed network",
+			vm: newTestVMBuilder().
+				WithInterface("", testNICName).
+				WithNetwork(testNICName, testNetworkName).Build(),
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: testNICName, NetworkName: testNetworkName, Reason: SkipReasonPendingMAC},
+			},
+		},
+		{
+			name: "interface without mac on network without ippool",
+			vm: newTestVMBuilder().
+				WithInterface("", testNICName).
+				WithNetwork(testNICName, testNetworkNameNoIPPool).Build(),
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: testNICName, NetworkName: testNetworkNameNoIPPool, Reason: SkipReasonNoIPPool},
+			},
+		},
+		{
+			name: "interface without mac on pod network",
+			vm: newTestVMBuilder().
+				WithInterface("", "default").
+				WithNetwork("default", "").Build(),
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "default", Reason: SkipReasonNotMultus},
+			},
+		},
+		{
+			name: "configs follow the interface order rather than the network order",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress2, "nic2").
+				WithInterface(testMACAddress1, "nic1").
+				WithNetwork("nic1", testNetworkName).
+				WithNetwork("nic2", "default/other").Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress2, NetworkName: "default/other"},
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+			},
+		},
+		{
+			name: "interfaces on the same network",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, "nic1").
+				WithInterface(testMACAddress2, "nic2").
+				WithNetwork("nic1", testNetworkName).
+				WithNetwork("nic2", testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+				{MACAddress: testMACAddress2, NetworkName: testNetworkName},
+			},
+		},
+		{
+			name: "mixed pod, pool-backed, and unmanaged networks",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, "default").
+				WithInterface(testMACAddress2, "nic1").
+				WithInterface(testMACAddress3, "nic2").
+				WithInterface("", "nic3").
+				WithNetwork("default", "").
+				WithNetwork("nic1", testNetworkName).
+				WithNetwork("nic2", testNetworkNameNoIPPool).
+				WithNetwork("nic3", testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress2, NetworkName: testNetworkName},
+			},
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "default", MACAddress: testMACAddress1, Reason: SkipReasonNotMultus},
+				{InterfaceName: "nic2", MACAddress: testMACAddress3, NetworkName: testNetworkNameNoIPPool, Reason: SkipReasonNoIPPool},
+				{InterfaceName: "nic3", NetworkName: testNetworkName, Reason: SkipReasonPendingMAC},
+			},
+		},
+		{
+			name: "pod network sharing its name with a multus network",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, "default").
+				WithNetwork("default", "").
+				WithNetwork("default", testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+			},
+		},
+		{
+			name: "network listed twice",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNetworkNameNoIPPool).
+				WithNetwork(testNICName, testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+			},
+		},
+		{
+			name: "interface listed twice",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, "nic1").
+				WithInterface(testMACAddress2, "nic2").
+				WithInterface(testMACAddress3, "nic1").
+				WithInterface("", "nic1").
+				WithNetwork("nic1", testNetworkName).
+				WithNetwork("nic2", testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress2, NetworkName: testNetworkName},
+			},
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "nic1", NetworkName: testNetworkName, Reason: SkipReasonDuplicateInterfaceName},
+			},
+		},
+		{
+			name: "interfaces sharing a mac address",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, "nic1").
+				WithInterface(strings.ToUpper(testMACAddress1), "nic2").
+				WithInterface(testMACAddress2, "nic3").
+				WithNetwork("nic1", testNetworkName).
+				WithNetwork("nic2", "default/other").
+				WithNetwork("nic3", testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+				{MACAddress: testMACAddress2, NetworkName: testNetworkName},
+			},
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "nic2", MACAddress: strings.ToUpper(testMACAddress1), NetworkName: "default/other", Reason: SkipReasonDuplicateMAC},
+			},
+		},
+		{
+			name: "mac addresses in other forms",
+			vm: newTestVMBuilder().
+				WithInterface("FA:CF:8E:50:82:FC", "nic1").
+				WithInterface("fa-cf-8e-50-82-fd", "nic2").
+				WithInterface("facf.8e50.82fe", "nic3").
+				WithInterface("FA-CF-8E-50-82-FC", "nic4").
+				WithNetwork("nic1", testNetworkName).
+				WithNetwork("nic2", testNetworkName).
+				WithNetwork("nic3", testNetworkName).
+				WithNetwork("nic4", testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: "fa:cf:8e:50:82:fc", NetworkName: testNetworkName},
+				{MACAddress: "fa:cf:8e:50:82:fd", NetworkName: testNetworkName},
+				{MACAddress: "fa:cf:8e:50:82:fe", NetworkName: testNetworkName},
+			},
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "nic4", MACAddress: "FA-CF-8E-50-82-FC", NetworkName: testNetworkName, Reason: SkipReasonDuplicateMAC},
+			},
+		},
+		{
+			name: "invalid mac addresses",
+			vm: newTestVMBuilder().
+				WithInterface("fa:cf:8e:50:82", "nic1").
+				WithInterface("fa:cf:8e:ff:fe:50:82:fc", "nic2").
+				WithInterface(testMACAddress1, "nic3").
+				WithNetwork("nic1", testNetworkName).
+				WithNetwork("nic2", testNetworkName).
+				WithNetwork("nic3", testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+			},
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "nic1", MACAddress: "fa:cf:8e:50:82", NetworkName: testNetworkName, Reason: SkipReasonInvalidMAC},
+				{InterfaceName: "nic2", MACAddress: "fa:cf:8e:ff:fe:50:82:fc", NetworkName: testNetworkName, Reason: SkipReasonInvalidMAC},
+			},
+		},
+		{
+			name: "interface with absent state",
+			vm: withInterfaceState(newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNetworkName).Build(), testNICName, kubevirtv1.InterfaceStateAbsent),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+			},
+		},
+		{
+			name: "network name without namespace",
+			vm: newTestVMBuilder().
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNADName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNADName},
+			},
+		},
+		{
+			name: "default route settings from the annotation",
+			vm: newTestVMBuilder().
+				WithAnnotation(defaultRouteAnnotation, `{"nic1":true,"nic2":false,"nic4":false}`).
+				WithInterface(testMACAddress1, "nic1").
+				WithInterface(testMACAddress2, "nic2").
+				WithInterface(testMACAddress3, "nic3").
+				WithNetwork("nic1", testNetworkName).
+				WithNetwork("nic2", "default/other").
+				WithNetwork("nic3", testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName, DefaultRoute: &defaultRoute},
+				{MACAddress: testMACAddress2, NetworkName: "default/other", DefaultRoute: &noDefaultRoute},
+				{MACAddress: testMACAddress3, NetworkName: testNetworkName},
+			},
+		},
+		{
+			name: "malformed default route annotation",
+			vm: newTestVMBuilder().
+				WithAnnotation(defaultRouteAnnotation, `{"nic1":"no"}`).
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+			},
+		},
+		{
+			name: "dhcp modes from the annotation",
+			vm: newTestVMBuilder().
+				WithAnnotation(dhcpModeAnnotation, `{"nic1":"reserveOnly","nic2":"dhcp"}`).
+				WithInterface(testMACAddress1, "nic1").
+				WithInterface(testMACAddress2, "nic2").
+				WithInterface(testMACAddress3, "nic3").
+				WithNetwork("nic1", testNetworkName).
+				WithNetwork("nic2", "default/other").
+				WithNetwork("nic3", testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName, Mode: networkv1.NetworkConfigModeReserveOnly},
+				{MACAddress: testMACAddress2, NetworkName: "default/other", Mode: networkv1.NetworkConfigModeDHCP},
+				{MACAddress: testMACAddress3, NetworkName: testNetworkName},
+			},
+		},
+		{
+			name: "unknown dhcp mode in the annotation",
+			vm: newTestVMBuilder().
+				WithAnnotation(dhcpModeAnnotation, `{"nic1":"static"}`).
+				WithInterface(testMACAddress1, testNICName).
+				WithNetwork(testNICName, testNetworkName).Build(),
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+			},
+		},
+	}
+
+	hasIPPool := testIPPoolResolver(testNetworkName, testNADName, "default/other")
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ncs, skipped := BuildNetworkConfigs(tc.vm, hasIPPool)
+			assert.Equal(t, tc.expectedConfigs, ncs)
+			assert.Equal(t, tc.expectedSkipped, skipped)
+		})
+	}
+}
+
+// TestBuildNetworkConfigs_Manifests runs VirtualMachine manifests collected
+// from real clusters through BuildNetworkConfigs. The expectations match what
+// the controller produced before the logic was extracted from OnChange. There
+// is a manifest for each binding the vendored KubeVirt supports as well.
+func TestBuildNetworkConfigs_Manifests(t *testing.T) {
+	testCases := map[string]struct {
+		expectedConfigs []networkv1.NetworkConfig
+		expectedSkipped []SkippedInterface
+	}{
+		"absent-interface.yaml": {
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: "8a:2b:7c:10:00:01", NetworkName: "default/net-48"},
+				{MACAddress: "8a:2b:7c:10:00:02", NetworkName: "default/net-48"},
+			},
+		},
+		"management-and-vlan.yaml": {
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: "fa:e7:60:2e:37:dd", NetworkName: "default/net-48"},
+			},
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "default", MACAddress: "5a:8e:0a:5b:9e:01", Reason: SkipReasonNotMultus},
+			},
+		},
+		"multiple-nics.yaml": {
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: "52:54:00:0a:00:01", NetworkName: "default/net-48"},
+				{MACAddress: "52:54:00:0a:00:02", NetworkName: "tenant-a/lan"},
+				{MACAddress: "52:54:00:0a:00:03", NetworkName: "tenant-a/lan"},
+			},
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "storage", MACAddress: "52:54:00:0a:00:04", NetworkName: "storage/iscsi", Reason: SkipReasonNoIPPool},
+			},
+		},
+		"no-interfaces.yaml": {},
+		"pending-mac.yaml": {
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "default", NetworkName: "default/net-48", Reason: SkipReasonPendingMAC},
+				{InterfaceName: "nic-1", NetworkName: "default/net-100", Reason: SkipReasonNoIPPool},
+			},
+		},
+		"pod-network-only.yaml": {
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "default", MACAddress: "6e:44:2a:9d:00:01", Reason: SkipReasonNotMultus},
+			},
+		},
+		"sriov.yaml": {
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: "52:54:00:8a:00:01", NetworkName: "default/net-48"},
+			},
+		},
+		"macvtap.yaml": {
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: "52:54:00:9a:00:01", NetworkName: "default/net-48"},
+			},
+		},
+		"slirp.yaml": {
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "default", MACAddress: "52:54:00:10:00:01", Reason: SkipReasonNotMultus},
+			},
+		},
+		"passt.yaml": {
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "default", MACAddress: "52:54:00:11:00:01", Reason: SkipReasonNotMultus},
+			},
+		},
+		"binding-passt.yaml": {
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: "52:54:00:12:00:02", NetworkName: "default/net-48"},
+			},
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "default", MACAddress: "52:54:00:12:00:01", Reason: SkipReasonNotMultus},
+			},
+		},
+		"binding-managed-tap.yaml": {
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: "52:54:00:13:00:02", NetworkName: "default/net-48"},
+			},
+			expectedSkipped: []SkippedInterface{
+				{InterfaceName: "default", MACAddress: "52:54:00:13:00:01", Reason: SkipReasonNotMultus},
+			},
+		},
+		"short-network-name.yaml": {
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: "3e:1f:5c:88:02:11", NetworkName: "net-48"},
+			},
+		},
+		"single-bridge.yaml": {
+			expectedConfigs: []networkv1.NetworkConfig{
+				{MACAddress: "c6:d6:82:39:d3:c3", NetworkName: "default/net-48"},
+			},
+		},
+	}
+
+	files, err := filepath.Glob(filepath.Join("testdata", "vms", "*.yaml"))
+	assert.Nil(t, err)
+	assert.Len(t, files, len(testCases), "every manifest should have an expectation")
+
+	hasIPPool := testIPPoolResolver("default/net-48", "net-48", "tenant-a/lan")
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			tc, ok := testCases[filepath.Base(file)]
+			if !assert.True(t, ok, "manifest has no expectation") {
+				return
+			}
+
+			data, err := os.ReadFile(file)
+			if !assert.Nil(t, err) {
+				return
+			}
+			var vm kubevirtv1.VirtualMachine
+			if !assert.Nil(t, yaml.UnmarshalStrict(data, &vm)) {
+				return
+			}
+
+			ncs, skipped := BuildNetworkConfigs(&vm, hasIPPool)
+			assert.Equal(t, tc.expectedConfigs, ncs)
+			assert.Equal(t, tc.expectedSkipped, skipped)
+		})
+	}
+}
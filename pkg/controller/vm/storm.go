@@ -0,0 +1,84 @@
+package vm
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+const (
+	// enqueueStormLimit is how many times a VM may re-enqueue itself within
+	// about enqueueStormHalfLife before it's backed off
+	enqueueStormLimit = 10
+	// enqueueStormHalfLife is how long it takes the enqueue count of a VM to
+	// decay by half
+	enqueueStormHalfLife = time.Minute
+	// enqueueStormBackoff is how long a VM caught in an enqueue storm waits
+	// before being reconciled again
+	enqueueStormBackoff = 30 * time.Second
+
+	enqueueStormReason = "EnqueueStorm"
+)
+
+// enqueueGuard keeps VMs from re-enqueueing themselves in a tight loop, e.g.,
+// when their vmnetcfg keeps being marked out-of-sync without ever getting in
+// sync. The count of each VM decays over time, so VMs whose network config
+// changes now and then are never held back.
+type enqueueGuard struct {
+	clock  clock.Clock
+	counts map[string]enqueueCount
+	mutex  sync.Mutex
+}
+
+type enqueueCount struct {
+	value float64
+	last  time.Time
+}
+
+func newEnqueueGuard(clock clock.Clock) *enqueueGuard {
+	return &enqueueGuard{
+		clock:  clock,
+		counts: make(map[string]enqueueCount),
+	}
+}
+
+// enqueue counts a re-enqueue of the VM and returns how long it has to wait
+// before being reconciled again, zero if it doesn't have to. A nil guard never
+// holds VMs back.
+func (g *enqueueGuard) enqueue(key string) time.Duration {
+	if g == nil {
+		return 0
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := g.clock.Now()
+	count := g.counts[key]
+	if !count.last.IsZero() {
+		count.value *= math.Pow(0.5, float64(now.Sub(count.last))/float64(enqueueStormHalfLife))
+	}
+	count.value++
+	count.last = now
+	g.counts[key] = count
+
+	if count.value > enqueueStormLimit {
+		return enqueueStormBackoff
+	}
+	return 0
+}
+
+// forget resets the count of the VM, e.g., as its vmnetcfg got in sync or the
+// VM is gone.
+func (g *enqueueGuard) forget(key string) {
+	if g == nil {
+		return
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	delete(g.counts, key)
+}
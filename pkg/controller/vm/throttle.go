@@ -0,0 +1,80 @@
+package vm
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+// createThrottle spreads the creation of vmnetcfgs over time, e.g., during
+// mass VM imports. Each VM held back gets a slot of its own, so they're
+// created in turn at the configured rate rather than racing for the next
+// token on every retry.
+type createThrottle struct {
+	limiter *rate.Limiter
+	clock   clock.Clock
+	slots   map[string]*rate.Reservation
+	mutex   sync.Mutex
+}
+
+// newCreateThrottle returns a throttle letting qps vmnetcfgs be created per
+// second, with bursts of up to burst of them. It returns nil, which throttles
+// nothing, if qps is zero or less.
+func newCreateThrottle(qps float64, burst int, clock clock.Clock) *createThrottle {
+	if qps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &createThrottle{
+		limiter: rate.NewLimiter(rate.Limit(qps), burst),
+		clock:   clock,
+		slots:   make(map[string]*rate.Reservation),
+	}
+}
+
+// wait returns how long the VM has to wait before its vmnetcfg can be
+// created. The VM keeps its slot until it's created or forgotten.
+func (t *createThrottle) wait(key string) time.Duration {
+	if t == nil {
+		return 0
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.clock.Now()
+	slot, ok := t.slots[key]
+	if !ok {
+		slot = t.limiter.ReserveN(now, 1)
+	}
+
+	if delay := slot.DelayFrom(now); delay > 0 {
+		t.slots[key] = slot
+		return delay
+	}
+
+	delete(t.slots, key)
+	return 0
+}
+
+// forget gives the slot of the VM back, e.g., as the VM is gone or its
+// vmnetcfg was created in the meantime.
+func (t *createThrottle) forget(key string) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if slot, ok := t.slots[key]; ok {
+		slot.CancelAt(t.clock.Now())
+		delete(t.slots, key)
+	}
+}
@@ -0,0 +1,218 @@
+package vmnetcfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// maxAllocationsShardSize bounds the data of each shard of the allocations
+// ConfigMap, well below the 1 MiB limit of objects.
+const maxAllocationsShardSize = 512 * 1024
+
+// vmAllocation is an IP address allocated to a VM, as mirrored into the
+// allocations ConfigMap.
+type vmAllocation struct {
+	MACAddress  string `json:"macAddress"`
+	IPAddress   string `json:"ipAddress"`
+	NetworkName string `json:"networkName"`
+}
+
+// MirrorAllocations keeps the allocations ConfigMap of the namespace of the
+// VirtualMachineNetworkConfig in line with the IP addresses allocated to the
+// VMs of the namespace, for tooling unable to read CRDs. It runs on removals
+// as well, so the entries of deleted VMs go away.
+func (h *Handler) MirrorAllocations(key string, vmNetCfg *networkv1.VirtualMachineNetworkConfig) (*networkv1.VirtualMachineNetworkConfig, error) {
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return vmNetCfg, err
+	}
+
+	if err := h.mirrorAllocations(namespace); err != nil {
+		return vmNetCfg, err
+	}
+
+	return vmNetCfg, nil
+}
+
+// mirrorAllocations writes the allocations of the VMs of namespace to the
+// shards of the allocations ConfigMap, and deletes the shards left over. Each
+// VM has an entry, keyed by its name, listing its allocations as JSON.
+func (h *Handler) mirrorAllocations(namespace string) error {
+	vmNetCfgs, err := h.vmnetcfgCache.List(namespace, labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]string, len(vmNetCfgs))
+	for _, vmNetCfg := range vmNetCfgs {
+		if vmNetCfg.DeletionTimestamp != nil {
+			continue
+		}
+
+		var allocations []vmAllocation
+		for _, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+			if ncStatus.State != networkv1.AllocatedState || ncStatus.AllocatedIPAddress == "" {
+				continue
+			}
+			allocations = append(allocations, vmAllocation{
+				MACAddress:  ncStatus.MACAddress,
+				IPAddress:   ncStatus.AllocatedIPAddress,
+				NetworkName: ncStatus.NetworkName,
+			})
+		}
+		if len(allocations) == 0 {
+			continue
+		}
+
+		data, err := json.Marshal(allocations)
+		if err != nil {
+			return err
+		}
+		vmName := vmNetCfg.Spec.VMName
+		if vmName == "" {
+			vmName = vmNetCfg.Name
+		}
+		entries[vmName] = string(data)
+	}
+
+	shards := shardAllocations(entries, maxAllocationsShardSize)
+
+	// The amount of shards written last time tells which ones are left over
+	previous := 0
+	first, err := h.configMapClient.Get(namespace, util.AllocationsConfigMapName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		previous, _ = strconv.Atoi(first.Annotations[util.AllocationsShardsAnnotationKey])
+		previous = max(previous, 1)
+	case !apierrors.IsNotFound(err):
+		return err
+	}
+
+	for i, data := range shards {
+		if err := h.writeAllocationsShard(namespace, i, len(shards), data); err != nil {
+			return err
+		}
+	}
+
+	for i := len(shards); i < previous; i++ {
+		name := allocationsShardName(i)
+		if err := h.configMapClient.Delete(namespace, name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		logrus.Debugf("(vmnetcfg.mirrorAllocations) deleted allocations configmap %s/%s", namespace, name)
+	}
+
+	return nil
+}
+
+// writeAllocationsShard creates or updates the shard of the allocations
+// ConfigMap at index with data, if it differs.
+func (h *Handler) writeAllocationsShard(namespace string, index, total int, data map[string]string) error {
+	name := allocationsShardName(index)
+	shardLabels := map[string]string{
+		util.AllocationsShardLabelKey: strconv.Itoa(index),
+	}
+	var shardAnnotations map[string]string
+	if index == 0 {
+		shardAnnotations = map[string]string{
+			util.AllocationsShardsAnnotationKey: strconv.Itoa(total),
+		}
+	}
+
+	configMap, err := h.configMapClient.Get(namespace, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Labels:      shardLabels,
+				Annotations: shardAnnotations,
+			},
+			Data: data,
+		}
+		logrus.Infof("(vmnetcfg.writeAllocationsShard) create allocations configmap %s/%s", namespace, name)
+		if _, err := h.configMapClient.Create(configMap); err != nil {
+			// Nothing new can be created in namespaces being deleted
+			if apierrors.HasStatusCause(err, corev1.NamespaceTerminatingCause) {
+				return nil
+			}
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	configMapCpy := configMap.DeepCopy()
+	if configMapCpy.Labels == nil {
+		configMapCpy.Labels = make(map[string]string)
+	}
+	for k, v := range shardLabels {
+		configMapCpy.Labels[k] = v
+	}
+	if index == 0 {
+		if configMapCpy.Annotations == nil {
+			configMapCpy.Annotations = make(map[string]string)
+		}
+		configMapCpy.Annotations[util.AllocationsShardsAnnotationKey] = strconv.Itoa(total)
+	}
+	configMapCpy.Data = data
+
+	if reflect.DeepEqual(configMapCpy, configMap) {
+		return nil
+	}
+
+	logrus.Debugf("(vmnetcfg.writeAllocationsShard) update allocations configmap %s/%s", namespace, name)
+	_, err = h.configMapClient.Update(configMapCpy)
+	return err
+}
+
+// shardAllocations splits the entries, in the order of their keys, into
+// shards whose keys and values add up to maxSize at most. An entry larger
+// than maxSize gets a shard of its own.
+func shardAllocations(entries map[string]string, maxSize int) []map[string]string {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var (
+		shards []map[string]string
+		size   int
+	)
+	for _, k := range keys {
+		n := len(k) + len(entries[k])
+		if len(shards) == 0 || (size+n > maxSize && size > 0) {
+			shards = append(shards, make(map[string]string))
+			size = 0
+		}
+		shards[len(shards)-1][k] = entries[k]
+		size += n
+	}
+
+	return shards
+}
+
+// allocationsShardName returns the name of the shard of the allocations
+// ConfigMap at index.
+func allocationsShardName(index int) string {
+	if index == 0 {
+		return util.AllocationsConfigMapName
+	}
+	return fmt.Sprintf("%s-%d", util.AllocationsConfigMapName, index)
+}
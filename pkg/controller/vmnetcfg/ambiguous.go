@@ -0,0 +1,61 @@
+package vmnetcfg
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// ReasonAmbiguousNetwork is the reason of the network config statuses whose
+// network, given without a namespace, matches NetworkAttachmentDefinitions
+// pointing to different IPPools.
+const ReasonAmbiguousNetwork = "AmbiguousNetwork"
+
+// syncAmbiguousNetworks keeps the statuses of the network configs attached to
+// an ambiguous network pending, with the candidates in their message, and
+// clears them once the network is unambiguous again. Allocate refuses such
+// network configs rather than guessing the IPPool, while the IP addresses
+// allocated before the network got ambiguous are kept until it's resolved.
+func (h *Handler) syncAmbiguousNetworks(vmNetCfg *networkv1.VirtualMachineNetworkConfig) {
+	for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+		var ambiguous *util.AmbiguousNetworkError
+		_, err := h.getIPPoolFromNetworkConfig(vmNetCfg.Namespace, nc)
+		isAmbiguous := errors.As(err, &ambiguous)
+
+		i := findNetworkConfigStatusIndex(vmNetCfg.Status.NetworkConfigs, nc.MACAddress)
+		switch {
+		case isAmbiguous && i < 0:
+			vmNetCfg.Status.NetworkConfigs = append(vmNetCfg.Status.NetworkConfigs, networkv1.NetworkConfigStatus{
+				MACAddress:  nc.MACAddress,
+				NetworkName: nc.NetworkName,
+				State:       networkv1.PendingState,
+				Reason:      ReasonAmbiguousNetwork,
+				Message:     ambiguous.Error(),
+			})
+		case isAmbiguous:
+			ncStatus := &vmNetCfg.Status.NetworkConfigs[i]
+			if ncStatus.Reason != ReasonAmbiguousNetwork {
+				logrus.Warnf("(vmnetcfg.syncAmbiguousNetworks) %s of vmnetcfg %s/%s: %s",
+					nc.MACAddress, vmNetCfg.Namespace, vmNetCfg.Name, ambiguous.Error())
+			}
+			ncStatus.State = networkv1.PendingState
+			ncStatus.Reason = ReasonAmbiguousNetwork
+			ncStatus.Message = ambiguous.Error()
+		case i >= 0 && vmNetCfg.Status.NetworkConfigs[i].Reason == ReasonAmbiguousNetwork:
+			vmNetCfg.Status.NetworkConfigs[i].Reason = ""
+			vmNetCfg.Status.NetworkConfigs[i].Message = ""
+		}
+	}
+}
+
+func findNetworkConfigStatusIndex(ncStatuses []networkv1.NetworkConfigStatus, macAddress string) int {
+	for i, ncStatus := range ncStatuses {
+		if ncStatus.MACAddress == macAddress {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,80 @@
+package vmnetcfg
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+)
+
+// staleWriterError tells the allocations prepared from an IPPool weren't
+// committed, as another controller instance wrote to the IPPool since then
+// while this one doesn't hold the leader lease. The object is retried with
+// backoff, which prepares the allocations again from the IPPool as it is now.
+type staleWriterError struct {
+	ipPoolKey  string
+	lastWriter string
+	identity   string
+}
+
+func (e staleWriterError) Error() string {
+	return fmt.Sprintf("ippool %s was written by %s since the allocations of %s were prepared, and %s isn't the leader",
+		e.ipPoolKey, e.lastWriter, e.identity, e.identity)
+}
+
+// commitIPPoolStatus writes the status of ipPoolCpy, prepared from ipPool,
+// and records the changes of its allocation revision, both stamped with the
+// identity of the instance. Two instances may run at once for a while, e.g.,
+// during a botched upgrade, so an instance not holding the leader lease
+// refuses to commit allocations prepared before another one wrote to the
+// IPPool.
+func (h *Handler) commitIPPoolStatus(ipPool, ipPoolCpy *networkv1.IPPool) (*networkv1.IPPool, error) {
+	if err := h.checkLastWriter(ipPool); err != nil {
+		return nil, err
+	}
+
+	changes := h.bumpAllocationRevision(ipPool, ipPoolCpy)
+	for i := range changes {
+		changes[i].Writer = h.identity
+	}
+	if h.identity != "" {
+		ipPoolCpy.Status.LastWriter = h.identity
+	}
+	ipPoolCpy.Status.LastUpdate = metav1.NewTime(h.clock.Now())
+
+	updated, err := h.ippoolClient.UpdateStatus(ipPoolCpy)
+	if err != nil {
+		return nil, err
+	}
+	h.recordChanges(updated, changes)
+
+	return updated, nil
+}
+
+// checkLastWriter returns a staleWriterError if another instance wrote to the
+// IPPool since ipPool was read, unless this one holds the leader lease.
+func (h *Handler) checkLastWriter(ipPool *networkv1.IPPool) error {
+	if h.leadership.IsLeader() {
+		return nil
+	}
+
+	current, err := h.ippoolCache.Get(ipPool.Namespace, ipPool.Name)
+	if err != nil {
+		// Left to the status update to report
+		return nil
+	}
+	if current.Status.LastWriter == ipPool.Status.LastWriter {
+		return nil
+	}
+
+	err = staleWriterError{
+		ipPoolKey:  ipPool.Namespace + "/" + ipPool.Name,
+		lastWriter: current.Status.LastWriter,
+		identity:   h.identity,
+	}
+	logrus.Warnf("(vmnetcfg.commitIPPoolStatus) %s", err.Error())
+
+	return err
+}
@@ -54,6 +54,14 @@ func (b *VmNetCfgBuilder) Label(key, value string) *VmNetCfgBuilder {
 	return b
 }
 
+func (b *VmNetCfgBuilder) Annotation(key, value string) *VmNetCfgBuilder {
+	if b.vmNetCfg.Annotations == nil {
+		b.vmNetCfg.Annotations = make(map[string]string)
+	}
+	b.vmNetCfg.Annotations[key] = value
+	return b
+}
+
 func (b *VmNetCfgBuilder) OwnerRef(owner metav1.OwnerReference) *VmNetCfgBuilder {
 	if b.vmNetCfg.OwnerReferences == nil {
 		b.vmNetCfg.OwnerReferences = []metav1.OwnerReference{}
@@ -102,6 +110,12 @@ func (b *VmNetCfgBuilder) WithNetworkConfigStatus(ipAddress, macAddress, network
 	return b
 }
 
+// IPPoolRef sets the IPPool of the last network config status added.
+func (b *VmNetCfgBuilder) IPPoolRef(ipPoolRef string) *VmNetCfgBuilder {
+	b.vmNetCfg.Status.NetworkConfigs[len(b.vmNetCfg.Status.NetworkConfigs)-1].IPPoolRef = ipPoolRef
+	return b
+}
+
 func (b *VmNetCfgBuilder) AllocatedCondition(status corev1.ConditionStatus, reason, message string) *VmNetCfgBuilder {
 	setAllocatedCondition(b.vmNetCfg, status, reason, message)
 	return b
@@ -142,6 +156,12 @@ func (b *vmNetCfgStatusBuilder) WithNetworkConfigStatus(ipAddress, macAddress, n
 	return b
 }
 
+// IPPoolRef sets the IPPool of the last network config status added.
+func (b *vmNetCfgStatusBuilder) IPPoolRef(ipPoolRef string) *vmNetCfgStatusBuilder {
+	b.vmNetCfgStatus.NetworkConfigs[len(b.vmNetCfgStatus.NetworkConfigs)-1].IPPoolRef = ipPoolRef
+	return b
+}
+
 func (b *vmNetCfgStatusBuilder) InSyncedCondition(status corev1.ConditionStatus, reason, message string) *vmNetCfgStatusBuilder {
 	networkv1.InSynced.SetStatus(&b.vmNetCfgStatus, string(status))
 	networkv1.InSynced.Reason(&b.vmNetCfgStatus, reason)
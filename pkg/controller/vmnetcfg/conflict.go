@@ -0,0 +1,137 @@
+package vmnetcfg
+
+import (
+	"reflect"
+
+	"github.com/rancher/wrangler/v3/pkg/relatedresource"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// conflictedIP returns the IP address of the IPPool held by the MAC address
+// if the guest declined it as already in use and it's still quarantined.
+func (h *Handler) conflictedIP(ipPool *networkv1.IPPool, macAddress, heldIP string) (string, bool) {
+	if ipPool.Status.IPv4 == nil || heldIP == "" {
+		return "", false
+	}
+
+	conflict, ok := ipPool.Status.IPv4.Conflicts[heldIP]
+	if !ok || util.NormalizeMAC(conflict.MACAddress) != util.NormalizeMAC(macAddress) {
+		return "", false
+	}
+	if !conflict.Until.Time.After(h.clock.Now()) {
+		return "", false
+	}
+
+	return heldIP, true
+}
+
+// releaseConflictedIP gives up the IP address held by the network config if
+// the guest declined it as already in use, so a new one is allocated instead.
+// The IP address is revoked rather than deallocated, which keeps it from being
+// handed out until the ippool controller restores it once the quarantine is
+// over. Static IP addresses and pinned leases are kept. It returns the IPPool
+// as updated, and whether the IP address was released.
+func (h *Handler) releaseConflictedIP(
+	vmNetCfg *networkv1.VirtualMachineNetworkConfig,
+	ipPool *networkv1.IPPool,
+	nc networkv1.NetworkConfig,
+	prevNcStatus networkv1.NetworkConfigStatus,
+	hasPrev bool,
+) (*networkv1.IPPool, bool, error) {
+	ipamName := util.IPAMName(ipPool)
+
+	heldIP, err := h.cacheAllocator.GetIPByMAC(ipamName, nc.MACAddress)
+	if err != nil {
+		heldIP = ""
+		if hasPrev {
+			heldIP = prevNcStatus.AllocatedIPAddress
+		}
+	}
+
+	ip, ok := h.conflictedIP(ipPool, nc.MACAddress, heldIP)
+	if !ok {
+		return ipPool, false, nil
+	}
+
+	vmNetCfgKey := vmNetCfg.Namespace + "/" + vmNetCfg.Name
+	if nc.IPAddress != nil && *nc.IPAddress == ip {
+		logrus.Warnf("(vmnetcfg.releaseConflictedIP) static ip %s of %s of vmnetcfg %s was declined as already in use, keep it", ip, nc.MACAddress, vmNetCfgKey)
+		return ipPool, false, nil
+	}
+	if util.IsLeasePinned(vmNetCfg) {
+		logrus.Warnf("(vmnetcfg.releaseConflictedIP) pinned ip %s of %s of vmnetcfg %s was declined as already in use, keep it", ip, nc.MACAddress, vmNetCfgKey)
+		return ipPool, false, nil
+	}
+
+	logrus.Infof("(vmnetcfg.releaseConflictedIP) release ip %s declined by %s of vmnetcfg %s", ip, nc.MACAddress, vmNetCfgKey)
+
+	if err := h.ipAllocator.RevokeIP(ipamName, ip); err != nil {
+		return ipPool, false, err
+	}
+	if exists, err := h.cacheAllocator.HasMAC(ipamName, nc.MACAddress); err != nil {
+		return ipPool, false, err
+	} else if exists {
+		if err := h.cacheAllocator.DeleteMAC(ipamName, nc.MACAddress); err != nil {
+			return ipPool, false, err
+		}
+	}
+
+	// The IPPool is carried on with, so the new lease isn't recorded along
+	// with the former one
+	ipPoolCpy := ipPool.DeepCopy()
+	if owner, ok := util.Leases(ipPoolCpy.Status.IPv4)[ip]; ok && util.NormalizeMAC(owner) == util.NormalizeMAC(nc.MACAddress) {
+		util.DeleteAllocationEntry(ipPoolCpy.Status.IPv4, ip)
+	}
+	if !reflect.DeepEqual(ipPoolCpy, ipPool) {
+		logrus.Infof("(vmnetcfg.releaseConflictedIP) update ippool %s/%s", ipPool.Namespace, ipPool.Name)
+		updated, err := h.commitIPPoolStatus(ipPool, ipPoolCpy)
+		if err != nil {
+			return ipPool, false, err
+		}
+		ipPool = updated
+	}
+
+	if h.recorder != nil {
+		h.recorder.Eventf(vmNetCfg, corev1.EventTypeWarning, ReasonConflictedIPReleased,
+			"Released ip %s of %s as the guest declined it as already in use", ip, nc.MACAddress)
+	}
+
+	return ipPool, true, nil
+}
+
+// vmNetCfgsOfConflicts returns the keys of the VirtualMachineNetworkConfigs
+// still holding an IP address of the IPPool their guest declined, so they're
+// moved to new ones.
+func (h *Handler) vmNetCfgsOfConflicts(ipPool *networkv1.IPPool) ([]relatedresource.Key, error) {
+	if ipPool.Status.IPv4 == nil || len(ipPool.Status.IPv4.Conflicts) == 0 {
+		return nil, nil
+	}
+
+	leases := util.Leases(ipPool.Status.IPv4)
+
+	var keys []relatedresource.Key
+	for ip, conflict := range ipPool.Status.IPv4.Conflicts {
+		owner, ok := leases[ip]
+		if !ok || util.NormalizeMAC(owner) != util.NormalizeMAC(conflict.MACAddress) {
+			continue
+		}
+
+		vmNetCfgs, err := h.vmnetcfgCache.GetByIndex(indexer.VmNetCfgByMACIndex, util.NormalizeMAC(owner))
+		if err != nil {
+			return nil, err
+		}
+		for _, vmNetCfg := range vmNetCfgs {
+			keys = append(keys, relatedresource.Key{
+				Namespace: vmNetCfg.Namespace,
+				Name:      vmNetCfg.Name,
+			})
+		}
+	}
+
+	return keys, nil
+}
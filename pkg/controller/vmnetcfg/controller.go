@@ -2,30 +2,154 @@ package vmnetcfg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"reflect"
+	"sort"
+	"strings"
+	"time"
 
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/rancher/wrangler/v3/pkg/kv"
+	"github.com/rancher/wrangler/v3/pkg/relatedresource"
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
-	"github.com/harvester/vm-dhcp-controller/pkg/cache"
+	"github.com/harvester/vm-dhcp-controller/pkg/audit"
+	dhcpcache "github.com/harvester/vm-dhcp-controller/pkg/cache"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
 	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/externalipam"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
+	"github.com/harvester/vm-dhcp-controller/pkg/forecast"
+	ctlcorev1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/core/v1"
 	ctlcniv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/k8s.cni.cncf.io/v1"
+	ctlkubevirtv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/kubevirt.io/v1"
 	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
 	"github.com/harvester/vm-dhcp-controller/pkg/ipam"
 	"github.com/harvester/vm-dhcp-controller/pkg/metrics"
+	"github.com/harvester/vm-dhcp-controller/pkg/reconcile"
 	"github.com/harvester/vm-dhcp-controller/pkg/util"
 )
 
-const controllerName = "vm-dhcp-vmnetcfg-controller"
+const (
+	controllerName = "vm-dhcp-vmnetcfg-controller"
+
+	// warmupRetryPeriod is how long a VirtualMachineNetworkConfig waits
+	// before being checked again while the caches are warming up.
+	warmupRetryPeriod = time.Second
+
+	// ReasonPoolRebound is the reason of the InSynced condition of the
+	// VirtualMachineNetworkConfigs to be moved to the IPPool their network
+	// was re-pointed to.
+	ReasonPoolRebound = "PoolRebound"
+
+	// ReasonPinnedLeases is the reason of the events about the
+	// VirtualMachineNetworkConfigs kept from being moved by their pin.
+	ReasonPinnedLeases = "PinnedLeases"
+
+	// ReasonDuplicateMACAddress is the reason of the Repaired condition of the
+	// VirtualMachineNetworkConfigs which had network configs sharing a MAC
+	// address dropped, and of the events about them.
+	ReasonDuplicateMACAddress = "DuplicateMACAddress"
+
+	// ReasonStaticIPInUse is the reason of the events about the
+	// VirtualMachineNetworkConfigs requesting a static IP address leased to
+	// another MAC address.
+	ReasonStaticIPInUse = "StaticIPInUse"
+
+	// ReasonLeaseReclaimed is the reason of the events about the leases of
+	// deleted namespaces given back to their IPPool.
+	ReasonLeaseReclaimed = "LeaseReclaimed"
+
+	// ReasonConflictedIPReleased is the reason of the events about the IP
+	// addresses given up for new ones after being declined by the guest as
+	// already in use.
+	ReasonConflictedIPReleased = "ConflictedIPReleased"
+
+	// ReasonResynced is the reason of the events about the re-verifications
+	// asked for with the resync annotation.
+	ReasonResynced = "Resynced"
+
+	// ReasonHeldBackIP is the reason of the events about the IP addresses of
+	// the held-back range allocated as the rest of the IPPool was exhausted.
+	ReasonHeldBackIP = "HeldBackIP"
+
+	// ReasonAllocationFailed is the reason of the events about the
+	// VirtualMachineNetworkConfigs failing to get an IP address for any
+	// other reason than the ones having their own.
+	ReasonAllocationFailed = "AllocationFailed"
+
+	// ReasonPoolExhausted is the reason of the events about the
+	// VirtualMachineNetworkConfigs left without an IP address by their
+	// exhausted IPPool, and of the ones about the IPPool itself.
+	ReasonPoolExhausted = "PoolExhausted"
+
+	// ReasonExternalIPAMFailed is the reason of the events about the
+	// allocations the external IPAM of the IPPool failed for.
+	ReasonExternalIPAMFailed = "ExternalIPAMFailed"
+)
 
 type Handler struct {
-	cacheAllocator   *cache.CacheAllocator
+	cacheAllocator   *dhcpcache.CacheAllocator
 	ipAllocator      *ipam.IPAllocator
 	metricsAllocator *metrics.MetricsAllocator
+	denialLog        *audit.DenialLog
+	changeLog        *audit.ChangeLog
+	// allocationTracker follows the pace of the allocations for the
+	// exhaustion forecasts of the IPPool controller
+	allocationTracker *forecast.Tracker
+	clock             clock.Clock
+	recorder          record.EventRecorder
+
+	// externalIPAM asks the external IPAMs of the IPPools having one for
+	// their allocations, with the tokens read with secretClient, as long as
+	// their URLs are among externalIPAMURLs
+	externalIPAM     *externalipam.Client
+	externalIPAMURLs []string
+	secretClient     corev1client.SecretsGetter
+
+	// identity is stamped on the allocations committed by the instance, and
+	// leadership tells whether it holds the leader lease
+	identity   string
+	leadership *config.Leadership
+
+	pending *pendingIndex
+	// poolGenerations tells the spec changes of the IPPools from their
+	// status updates
+	poolGenerations *poolGenerations
+
+	// defaultAllocationTiming is when the IP addresses of VMs without the
+	// allocation-timing annotation are allocated
+	defaultAllocationTiming string
+
+	// cachesSynced reports whether the IPPool and Namespace caches have synced
+	cachesSynced func() bool
+	// warmup gates the handlers touching the IPAM and MAC caches until the
+	// IPPool controller has built them from the existing IPPools
+	warmup *config.Warmup
+	// upgrade holds off the lease reclaimer and the resyncs until the
+	// objects of former releases are upgraded
+	upgrade *config.Upgrade
+	// orphanedLeases tracks since when each lease of a deleted namespace was
+	// first seen, keyed by IPPool and IP address. Only the lease reclaimer
+	// touches it.
+	orphanedLeases map[string]time.Time
+	// resyncLimiter spreads the re-verifications asked for with the resync
+	// annotation over time
+	resyncLimiter *reconcile.ResyncLimiter
+	featureGates  *featuregate.Gates
 
 	vmnetcfgController ctlnetworkv1.VirtualMachineNetworkConfigController
 	vmnetcfgClient     ctlnetworkv1.VirtualMachineNetworkConfigClient
@@ -34,17 +158,52 @@ type Handler struct {
 	ippoolClient       ctlnetworkv1.IPPoolClient
 	ippoolCache        ctlnetworkv1.IPPoolCache
 	nadCache           ctlcniv1.NetworkAttachmentDefinitionCache
+	vmCache            ctlkubevirtv1.VirtualMachineCache
+	namespaceCache     ctlcorev1.NamespaceCache
+	// configMapClient writes the allocations ConfigMaps, only when mirroring
+	// the allocations into them is enabled
+	configMapClient ctlcorev1.ConfigMapClient
+	// pinnedAllocationsAnnotation is the annotation of the VMs their IP
+	// addresses are pinned in, written with vmClient, when enabled
+	pinnedAllocationsAnnotation string
+	vmClient                    ctlkubevirtv1.VirtualMachineClient
 }
 
 func Register(ctx context.Context, management *config.Management) error {
 	vmnetcfgs := management.HarvesterNetworkFactory.Network().V1alpha1().VirtualMachineNetworkConfig()
 	ippools := management.HarvesterNetworkFactory.Network().V1alpha1().IPPool()
 	nads := management.CniFactory.K8s().V1().NetworkAttachmentDefinition()
+	vms := management.KubeVirtFactory.Kubevirt().V1().VirtualMachine()
+	namespaces := management.CoreFactory.Core().V1().Namespace()
 
 	handler := &Handler{
-		cacheAllocator:   management.CacheAllocator,
-		ipAllocator:      management.IPAllocator,
-		metricsAllocator: management.MetricsAllocator,
+		cacheAllocator:    management.CacheAllocator,
+		ipAllocator:       management.IPAllocator,
+		metricsAllocator:  management.MetricsAllocator,
+		denialLog:         management.DenialLog,
+		changeLog:         management.ChangeLog,
+		allocationTracker: management.AllocationTracker,
+		externalIPAM:      management.ExternalIPAM,
+		externalIPAMURLs:  management.Options.ExternalIPAMAllowedURLs,
+		secretClient:      management.ClientSet.CoreV1(),
+		clock:             management.Clock,
+		recorder:          management.NewRecorder(controllerName, "", ""),
+
+		identity:   management.Identity.String(),
+		leadership: management.Leadership,
+
+		pending:         newPendingIndex(management.Clock),
+		poolGenerations: newPoolGenerations(),
+
+		defaultAllocationTiming: management.Options.AllocationTiming,
+
+		cachesSynced: func() bool {
+			return ippools.Informer().HasSynced() && namespaces.Informer().HasSynced()
+		},
+		warmup:        management.Warmup,
+		upgrade:       management.Upgrade,
+		resyncLimiter: reconcile.NewResyncLimiter(management.Options.ResyncInterval, management.Options.ResyncBurst, management.Clock),
+		featureGates:  management.Options.FeatureGates,
 
 		vmnetcfgController: vmnetcfgs,
 		vmnetcfgClient:     vmnetcfgs,
@@ -53,26 +212,63 @@ func Register(ctx context.Context, management *config.Management) error {
 		ippoolClient:       ippools,
 		ippoolCache:        ippools.Cache(),
 		nadCache:           nads.Cache(),
+		vmCache:            vms.Cache(),
+		namespaceCache:     namespaces.Cache(),
 	}
 
-	ctlnetworkv1.RegisterVirtualMachineNetworkConfigStatusHandler(
-		ctx,
-		vmnetcfgs,
-		networkv1.Allocated,
-		"vmnetcfg-allocate",
-		handler.Allocate,
-	)
+	limiter := reconcile.NewLimiter(controllerName, management.Options.ReconcileTimeout, management.MetricsAllocator)
+
+	// The Allocated condition tells a missing, draining, or paused IPPool
+	// apart from the other failures by its reason
+	allocate := &allocateStatusHandler{
+		client:  vmnetcfgs,
+		handler: reconcile.StatusHandler(limiter, "vmnetcfg-allocate", handler.Allocate),
+		clock:   handler.clock,
+	}
+	vmnetcfgs.OnChange(ctx, "vmnetcfg-allocate", allocate.sync)
 
 	ctlnetworkv1.RegisterVirtualMachineNetworkConfigStatusHandler(
 		ctx,
 		vmnetcfgs,
 		networkv1.InSynced,
 		"vmnetcfg-sync",
-		handler.Sync,
+		reconcile.StatusHandler(limiter, "vmnetcfg-sync", handler.Sync),
 	)
 
-	vmnetcfgs.OnChange(ctx, controllerName, handler.OnChange)
-	vmnetcfgs.OnRemove(ctx, controllerName, handler.OnRemove)
+	// VMs gaining the annotations required by an IPPool, or started for the
+	// first time with their allocation deferred, get their IP addresses
+	// without waiting for the next retry
+	relatedresource.Watch(ctx, "vmnetcfg-vm-trigger", func(namespace, name string, obj runtime.Object) ([]relatedresource.Key, error) {
+		return []relatedresource.Key{{Namespace: namespace, Name: name}}, nil
+	}, vmnetcfgs, vms)
+
+	// Lets the controller's HTTP server tell who a MAC address belongs to
+	vmnetcfgs.Cache().AddIndexer(indexer.VmNetCfgByMACIndex, util.VmNetCfgByMAC)
+
+	// Edits of an IPPool, e.g., of its DNS servers, reach the
+	// VirtualMachineNetworkConfigs on its network without waiting for them
+	// to change
+	vmnetcfgs.Cache().AddIndexer(indexer.VmNetCfgByQualifiedNetworkIndex, util.VmNetCfgByQualifiedNetwork)
+	relatedresource.Watch(ctx, "vmnetcfg-ippool-trigger", handler.vmNetCfgsOfIPPool, vmnetcfgs, ippools)
+
+	vmnetcfgs.OnChange(ctx, controllerName, reconcile.Handler(limiter, "vmnetcfg-onchange", handler.OnChange))
+	vmnetcfgs.OnChange(ctx, "vmnetcfg-resyncer", reconcile.Handler(limiter, "vmnetcfg-resyncer", handler.OnResync))
+	vmnetcfgs.OnRemove(ctx, controllerName, reconcile.Handler(limiter, "vmnetcfg-onremove", handler.OnRemove))
+
+	// The ConfigMaps are read through the client rather than a cache so the
+	// ConfigMaps of the whole cluster aren't held in memory
+	if management.Options.AllocationConfigMaps {
+		handler.configMapClient = management.CoreFactory.Core().V1().ConfigMap()
+		vmnetcfgs.OnChange(ctx, "vmnetcfg-allocations-mirror", reconcile.Handler(limiter, "vmnetcfg-allocations-mirror", handler.MirrorAllocations))
+	}
+	if management.Options.PinnedAllocationsAnnotation != "" {
+		handler.pinnedAllocationsAnnotation = management.Options.PinnedAllocationsAnnotation
+		handler.vmClient = vms
+		vmnetcfgs.OnChange(ctx, "vmnetcfg-allocations-pinner", reconcile.Handler(limiter, "vmnetcfg-allocations-pinner", handler.PinAllocations))
+	}
+	nads.OnChange(ctx, controllerName, handler.OnNADChange)
+
+	go handler.runLeaseReclaimer(ctx)
 
 	return nil
 }
@@ -84,6 +280,10 @@ func (h *Handler) OnChange(key string, vmNetCfg *networkv1.VirtualMachineNetwork
 
 	logrus.Debugf("(vmnetcfg.OnChange) vmnetcfg configuration %s has been changed: %+v", key, vmNetCfg.Spec.NetworkConfigs)
 
+	if err := h.waitForWarmup(vmNetCfg); err != nil {
+		return vmNetCfg, err
+	}
+
 	vmNetCfgCpy := vmNetCfg.DeepCopy()
 
 	// Check if the VirtualMachineNetworkConfig is administratively disabled
@@ -92,6 +292,7 @@ func (h *Handler) OnChange(key string, vmNetCfg *networkv1.VirtualMachineNetwork
 		if err := h.cleanup(vmNetCfg, false); err != nil {
 			return vmNetCfg, err
 		}
+		h.removePending(key)
 		networkv1.Disabled.True(vmNetCfgCpy)
 		updateAllNetworkConfigState(vmNetCfgCpy.Status.NetworkConfigs, networkv1.PendingState)
 		if !reflect.DeepEqual(vmNetCfgCpy, vmNetCfg) {
@@ -101,6 +302,17 @@ func (h *Handler) OnChange(key string, vmNetCfg *networkv1.VirtualMachineNetwork
 	}
 	networkv1.Disabled.False(vmNetCfgCpy)
 
+	if kept, duplicates := util.DedupNetworkConfigs(vmNetCfg.Spec.NetworkConfigs); len(duplicates) > 0 {
+		return h.dropDuplicateNetworkConfigs(vmNetCfgCpy, kept, duplicates)
+	}
+
+	deferred, err := h.isAllocationDeferred(vmNetCfg)
+	if err != nil {
+		return vmNetCfg, err
+	}
+	syncDeferredAllocation(vmNetCfgCpy, deferred)
+	h.syncAmbiguousNetworks(vmNetCfgCpy)
+
 	if !reflect.DeepEqual(vmNetCfgCpy, vmNetCfg) {
 		return h.vmnetcfgClient.UpdateStatus(vmNetCfgCpy)
 	}
@@ -108,6 +320,143 @@ func (h *Handler) OnChange(key string, vmNetCfg *networkv1.VirtualMachineNetwork
 	return vmNetCfg, nil
 }
 
+// dropDuplicateNetworkConfigs repairs a VirtualMachineNetworkConfig listing a
+// MAC address more than once, e.g., one created before the webhook rejected
+// them. Only the first network config of each MAC address is kept, and the IP
+// addresses allocated for the others are given back, as the agents would
+// never serve them.
+func (h *Handler) dropDuplicateNetworkConfigs(vmNetCfg *networkv1.VirtualMachineNetworkConfig, kept, duplicates []networkv1.NetworkConfig) (*networkv1.VirtualMachineNetworkConfig, error) {
+	keptNetworks := make(map[string]string, len(kept))
+	for _, nc := range kept {
+		keptNetworks[util.NormalizeMAC(nc.MACAddress)] = nc.NetworkName
+	}
+
+	// The status of the network config kept is the first one of its MAC
+	// address on its network
+	keptStatuses := make(map[string]int)
+	for i, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+		macAddress := util.NormalizeMAC(ncStatus.MACAddress)
+		if _, ok := keptStatuses[macAddress]; ok {
+			continue
+		}
+		if networkName, ok := keptNetworks[macAddress]; ok && ncStatus.NetworkName == networkName {
+			keptStatuses[macAddress] = i
+		}
+	}
+
+	var ncStatuses []networkv1.NetworkConfigStatus
+	for i, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+		macAddress := util.NormalizeMAC(ncStatus.MACAddress)
+		j, hasKeptStatus := keptStatuses[macAddress]
+		if _, ok := keptNetworks[macAddress]; !ok || (hasKeptStatus && j == i) {
+			// Network configs gone from the spec are up to Sync
+			ncStatuses = append(ncStatuses, ncStatus)
+			continue
+		}
+
+		// Duplicates on the same network got the IP address of the kept
+		// network config from the MAC cache, which must stay
+		if hasKeptStatus && ncStatus.IPPoolRef == vmNetCfg.Status.NetworkConfigs[j].IPPoolRef &&
+			ncStatus.AllocatedIPAddress == vmNetCfg.Status.NetworkConfigs[j].AllocatedIPAddress {
+			continue
+		}
+		if ncStatus.AllocatedIPAddress == "" {
+			continue
+		}
+
+		logrus.Infof("(vmnetcfg.dropDuplicateNetworkConfigs) release %s of duplicate %s of vmnetcfg %s/%s",
+			ncStatus.AllocatedIPAddress, ncStatus.MACAddress, vmNetCfg.Namespace, vmNetCfg.Name)
+		if err := h.release(vmNetCfg, ncStatus); err != nil && !apierrors.IsNotFound(err) {
+			return vmNetCfg, err
+		}
+	}
+
+	dropped := make([]string, 0, len(duplicates))
+	for _, nc := range duplicates {
+		dropped = append(dropped, fmt.Sprintf("%s on %s", nc.MACAddress, nc.NetworkName))
+	}
+	logrus.Warnf("(vmnetcfg.dropDuplicateNetworkConfigs) drop network configs of vmnetcfg %s/%s repeating a mac address: %s",
+		vmNetCfg.Namespace, vmNetCfg.Name, strings.Join(dropped, ", "))
+
+	vmNetCfg.Status.NetworkConfigs = ncStatuses
+	networkv1.Repaired.True(vmNetCfg)
+	networkv1.Repaired.Reason(vmNetCfg, ReasonDuplicateMACAddress)
+	networkv1.Repaired.Message(vmNetCfg, fmt.Sprintf("Dropped network configs repeating a MAC address: %s", strings.Join(dropped, ", ")))
+	if h.recorder != nil {
+		for _, nc := range duplicates {
+			h.recorder.Eventf(vmNetCfg, corev1.EventTypeWarning, ReasonDuplicateMACAddress,
+				"Dropped network config repeating mac address %s on network %s", nc.MACAddress, nc.NetworkName)
+		}
+	}
+
+	updated, err := h.vmnetcfgClient.UpdateStatus(vmNetCfg)
+	if err != nil {
+		return vmNetCfg, err
+	}
+
+	updated = updated.DeepCopy()
+	updated.Spec.NetworkConfigs = kept
+	return h.vmnetcfgClient.Update(updated)
+}
+
+// OnNADChange marks the VirtualMachineNetworkConfigs holding IP addresses of
+// another IPPool than the one the NetworkAttachmentDefinition points to as
+// out-of-sync, so they get moved over. Only NetworkAttachmentDefinitions
+// opted in to rebinding are considered, as some users re-point the labels
+// temporarily. Pinned VirtualMachineNetworkConfigs stay where they are and are
+// reported as blockers in an event on the NetworkAttachmentDefinition.
+func (h *Handler) OnNADChange(key string, nad *cniv1.NetworkAttachmentDefinition) (*cniv1.NetworkAttachmentDefinition, error) {
+	if nad == nil || nad.DeletionTimestamp != nil {
+		return nil, nil
+	}
+
+	if !util.IsAutoRebindEnabled(nad) {
+		return nad, nil
+	}
+
+	vmNetCfgs, err := h.vmnetcfgCache.List(metav1.NamespaceAll, labels.Everything())
+	if err != nil {
+		return nad, err
+	}
+
+	var pinned []string
+	for _, vmNetCfg := range vmNetCfgs {
+		if networkv1.InSynced.IsFalse(vmNetCfg) {
+			continue
+		}
+
+		ncStatus, ok := h.findReboundNetworkConfigStatus(vmNetCfg, nad)
+		if !ok {
+			continue
+		}
+
+		if util.IsLeasePinned(vmNetCfg) {
+			logrus.Infof("(vmnetcfg.OnNADChange) vmnetcfg %s/%s holds %s of ippool %s while nad %s points elsewhere; keep it as it's pinned",
+				vmNetCfg.Namespace, vmNetCfg.Name, ncStatus.AllocatedIPAddress, ncStatus.IPPoolRef, key)
+			pinned = append(pinned, vmNetCfg.Namespace+"/"+vmNetCfg.Name)
+			continue
+		}
+
+		logrus.Infof("(vmnetcfg.OnNADChange) vmnetcfg %s/%s holds %s of ippool %s while nad %s points elsewhere; mark it out-of-sync",
+			vmNetCfg.Namespace, vmNetCfg.Name, ncStatus.AllocatedIPAddress, ncStatus.IPPoolRef, key)
+
+		vmNetCfgCpy := vmNetCfg.DeepCopy()
+		setInSyncedCondition(vmNetCfgCpy, corev1.ConditionFalse, ReasonPoolRebound,
+			fmt.Sprintf("Network %s has been re-pointed away from ippool %s", ncStatus.NetworkName, ncStatus.IPPoolRef))
+		if _, err := h.vmnetcfgClient.UpdateStatus(vmNetCfgCpy); err != nil {
+			return nad, err
+		}
+	}
+
+	if len(pinned) > 0 && h.recorder != nil {
+		sort.Strings(pinned)
+		h.recorder.Eventf(nad, corev1.EventTypeWarning, ReasonPinnedLeases,
+			"Pinned vmnetcfgs keep the IP addresses of the former ippool: %s", strings.Join(pinned, ", "))
+	}
+
+	return nad, nil
+}
+
 // Allocate allocates IP addresses for the VirtualMachineNetworkConfig only
 // when it is in-synced.
 //
@@ -131,17 +480,112 @@ func (h *Handler) Allocate(vmNetCfg *networkv1.VirtualMachineNetworkConfig, stat
 		return status, fmt.Errorf("vmnetcfg %s/%s is out-of-sync; waiting for reconcile", vmNetCfg.Namespace, vmNetCfg.Name)
 	}
 
+	if err := h.waitForWarmup(vmNetCfg); err != nil {
+		return status, err
+	}
+
+	vmNetCfgKey := vmNetCfg.Namespace + "/" + vmNetCfg.Name
+
+	// The VM trigger enqueues the VirtualMachineNetworkConfig once the VM is
+	// started, so this isn't retried with backoff
+	deferred, err := h.isAllocationDeferred(vmNetCfg)
+	if err != nil {
+		return status, err
+	}
+	if deferred {
+		return status, allocationDeferredError{vmNetCfgKey: vmNetCfgKey}
+	}
+
+	// Network configs repeating a MAC address are dropped by OnChange first,
+	// which needs the status of their allocations to give them back
+	if _, duplicates := util.DedupNetworkConfigs(vmNetCfg.Spec.NetworkConfigs); len(duplicates) > 0 {
+		return status, fmt.Errorf("vmnetcfg %s/%s lists mac address %s more than once; waiting for repair",
+			vmNetCfg.Namespace, vmNetCfg.Name, duplicates[0].MACAddress)
+	}
+
 	var ncStatuses []networkv1.NetworkConfigStatus
 	for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+		// The MAC address is allocated for, and recorded, in its normalized
+		// form, the one the agents key their leases by
+		macAddress, err := util.ParseMAC(nc.MACAddress)
+		if err != nil {
+			return status, fmt.Errorf("vmnetcfg %s/%s: %w", vmNetCfg.Namespace, vmNetCfg.Name, err)
+		}
+		nc.MACAddress = macAddress
+
+		// Ambiguous networks are refused rather than guessed, and reported
+		// in the status of their network configs by OnChange. The IPPool may
+		// be gone since the webhook admitted the network, in which case the
+		// allocation is retried as soon as it's back.
 		ipPool, err := h.getIPPoolFromNetworkConfig(vmNetCfg.Namespace, nc)
+		if err != nil {
+			return status, asPoolMissing(err)
+		}
+		primaryKey := ipPool.Namespace + "/" + ipPool.Name
+
+		chain, err := util.OverflowChain(h.ippoolCache, ipPool)
 		if err != nil {
 			return status, err
 		}
+
+		prevNcStatus, hasPrev := findNetworkConfigStatusByMACAddress(vmNetCfg.Status.NetworkConfigs, nc.MACAddress)
+		if hasPrev {
+			prevNcStatus.MACAddress = nc.MACAddress
+		}
+
+		// IP addresses overflowed into an IPPool of the chain stay there
+		if overflowPool := h.findOverflowAllocation(chain, prevNcStatus, hasPrev, nc.MACAddress); overflowPool != nil {
+			ipPool = overflowPool
+		}
+
+		// The IP address stays with the IPPool it was allocated from when
+		// the network gets re-pointed to another one, unless the network
+		// opted in to rebinding, without the lease being pinned, or the
+		// former IPPool is gone
+		var reboundFrom *networkv1.NetworkConfigStatus
+		if hasPrev && prevNcStatus.IPPoolRef != "" && prevNcStatus.IPPoolRef != ipPool.Namespace+"/"+ipPool.Name {
+			_, err := h.getIPPoolFromNetworkConfigStatus(vmNetCfg.Namespace, prevNcStatus)
+			switch {
+			case apierrors.IsNotFound(err):
+				hasPrev = false
+			case err != nil:
+				return status, err
+			case h.isAutoRebindEnabled(vmNetCfg.Namespace, nc.NetworkName) && !util.IsLeasePinned(vmNetCfg):
+				reboundFrom = &prevNcStatus
+				hasPrev = false
+			default:
+				logrus.Debugf("(vmnetcfg.Allocate) keep %s of vmnetcfg %s/%s with ippool %s", nc.MACAddress, vmNetCfg.Namespace, vmNetCfg.Name, prevNcStatus.IPPoolRef)
+				prevNcStatus.State = networkv1.AllocatedState
+				ncStatuses = append(ncStatuses, prevNcStatus)
+				continue
+			}
+		}
+
+		ipPoolKey := ipPool.Namespace + "/" + ipPool.Name
+		if err := checkIPPoolAvailable(ipPool); err != nil {
+			if allocatedReason(err) == ReasonPoolPaused {
+				h.addPending(vmNetCfgKey, ipPoolKey, networkv1.PendingReasonPoolPaused)
+				h.recordDenial(vmNetCfg, ipPoolKey, nc.MACAddress, audit.DenialReasonPoolPaused, err)
+			}
+			return status, err
+		}
 		if !networkv1.CacheReady.IsTrue(ipPool) {
 			return status, fmt.Errorf("ippool %s/%s is not ready", ipPool.Namespace, ipPool.Name)
 		}
+		ipamName := util.IPAMName(ipPool)
+
+		// IP addresses the guest declined as already in use are given up
+		// for new ones while they're quarantined
+		var released bool
+		ipPool, released, err = h.releaseConflictedIP(vmNetCfg, ipPool, nc, prevNcStatus, hasPrev)
+		if err != nil {
+			return status, err
+		}
+		if released {
+			prevNcStatus.AllocatedIPAddress = ""
+		}
 
-		exists, err := h.cacheAllocator.HasMAC(nc.NetworkName, nc.MACAddress)
+		exists, err := h.cacheAllocator.HasMAC(ipamName, nc.MACAddress)
 		if err != nil {
 			return status, err
 		}
@@ -150,38 +594,125 @@ func (h *Handler) Allocate(vmNetCfg *networkv1.VirtualMachineNetworkConfig, stat
 
 		if exists {
 			// Recover IP from cache
-			ip, err = h.cacheAllocator.GetIPByMAC(nc.NetworkName, nc.MACAddress)
+			ip, err = h.cacheAllocator.GetIPByMAC(ipamName, nc.MACAddress)
 			if err != nil {
 				return status, err
 			}
 		} else {
+			if err := h.checkRequiredVMAnnotations(vmNetCfg, ipPool); err != nil {
+				h.addPending(vmNetCfgKey, ipPoolKey, networkv1.PendingReasonAnnotationMismatch)
+				h.recordDenial(vmNetCfg, ipPoolKey, nc.MACAddress, audit.DenialReasonAnnotationMismatch, err)
+				return status, err
+			}
+
 			dIP := net.IPv4zero.String()
 			if nc.IPAddress != nil {
 				dIP = *nc.IPAddress
 			}
 
 			// Recover IP from status (resume from paused state)
-			if oIP, err := findIPAddressFromNetworkConfigStatusByMACAddress(vmNetCfg.Status.NetworkConfigs, nc.MACAddress); err == nil {
-				dIP = oIP
+			if hasPrev && prevNcStatus.AllocatedIPAddress != "" {
+				dIP = prevNcStatus.AllocatedIPAddress
+			}
+
+			// The IP address reserved for the MAC address comes first,
+			// unless the interface asks for a static one
+			if reservedIP, ok := util.ReservedIPAddress(ipPool, nc.MACAddress); ok && nc.IPAddress == nil {
+				dIP = reservedIP
 			}
 
 			// Allocate new IP
-			ip, err = h.ipAllocator.AllocateIP(nc.NetworkName, dIP)
+			allocationStart := h.clock.Now()
+
+			// New IP addresses are spread over a weighted overflow chain,
+			// going back to filling it in order when the IPPool picked is
+			// exhausted or unavailable
+			var weightedPool *networkv1.IPPool
+			if dIP == net.IPv4zero.String() && ipPoolKey == primaryKey {
+				if pick := util.WeightedOverflowPool(ipPool, chain, nc.MACAddress); pick != nil && pick != ipPool {
+					weightedPool, ip, err = h.allocateOverflow(vmNetCfg, []*networkv1.IPPool{pick}, nc.MACAddress)
+					if err != nil {
+						h.recordAllocationFailure(vmNetCfg, ipPool, nc, err)
+						return status, err
+					}
+				}
+			}
+			if weightedPool != nil {
+				weightedKey := weightedPool.Namespace + "/" + weightedPool.Name
+				logrus.Infof("(vmnetcfg.Allocate) allocate %s for %s of vmnetcfg %s from weighted overflow ippool %s of ippool %s",
+					ip, nc.MACAddress, vmNetCfgKey, weightedKey, ipPoolKey)
+				h.metricsAllocator.IncIPPoolOverflowAllocations(primaryKey, weightedKey)
+				ipPool, ipPoolKey, ipamName = weightedPool, weightedKey, util.IPAMName(weightedPool)
+			} else {
+				ip, err = h.allocateIPFromIPPool(vmNetCfg, ipPool, nc, dIP)
+			}
+
+			// Overflow into the chain once the IPPool is exhausted. Static
+			// IP addresses never overflow, as they're bound to the IPPool.
+			if errors.Is(err, ipam.ErrExhausted) && dIP == net.IPv4zero.String() && len(chain) > 0 {
+				overflowPool, overflowIP, overflowErr := h.allocateOverflow(vmNetCfg, chain, nc.MACAddress)
+				if overflowErr != nil {
+					h.recordAllocationFailure(vmNetCfg, ipPool, nc, overflowErr)
+					return status, overflowErr
+				}
+				if overflowPool != nil {
+					overflowKey := overflowPool.Namespace + "/" + overflowPool.Name
+					logrus.Infof("(vmnetcfg.Allocate) ippool %s is exhausted, allocate %s for %s of vmnetcfg %s from overflow ippool %s",
+						ipPoolKey, overflowIP, nc.MACAddress, vmNetCfgKey, overflowKey)
+					h.metricsAllocator.IncIPPoolOverflowAllocations(primaryKey, overflowKey)
+					ipPool, ipPoolKey, ipamName = overflowPool, overflowKey, util.IPAMName(overflowPool)
+					ip, err = overflowIP, nil
+				}
+			}
+			h.metricsAllocator.ObserveIPPoolAllocation(primaryKey, h.clock.Since(allocationStart), err != nil)
+
 			if err != nil {
+				switch {
+				case errors.Is(err, ipam.ErrExhausted):
+					h.addPending(vmNetCfgKey, ipPoolKey, networkv1.PendingReasonPoolExhausted)
+					h.recordDenial(vmNetCfg, ipPoolKey, nc.MACAddress, audit.DenialReasonPoolExhausted, err)
+				case errors.Is(err, ipam.ErrAlreadyAllocated):
+					// Leased to another MAC address rather than excluded or
+					// reserved, so the holder is named
+					if holder := h.staticIPHolder(ipPool, dIP, nc.MACAddress); holder != nil {
+						err = holder
+						h.addPending(vmNetCfgKey, ipPoolKey, networkv1.PendingReasonStaticIPInUse)
+						if h.recorder != nil {
+							h.recorder.Event(vmNetCfg, corev1.EventTypeWarning, ReasonStaticIPInUse, err.Error())
+						}
+					}
+					h.recordDenial(vmNetCfg, ipPoolKey, nc.MACAddress, audit.DenialReasonStaticConflict, err)
+				}
+				// Static IP addresses in use have their own event
+				var inUse *staticIPInUseError
+				if !errors.As(err, &inUse) {
+					h.recordAllocationFailure(vmNetCfg, ipPool, nc, err)
+				}
 				return status, err
 			}
 
-			if err := h.cacheAllocator.AddMAC(nc.NetworkName, nc.MACAddress, ip); err != nil {
+			if err := h.cacheAllocator.AddMAC(ipamName, nc.MACAddress, ip); err != nil {
 				return status, err
 			}
 		}
 
+		var prevIPv6 string
+		if hasPrev {
+			prevIPv6 = prevNcStatus.AllocatedIPv6Address
+		}
+		ipv6, err := h.allocateIPv6(ipPool, nc.MACAddress, prevIPv6)
+		if err != nil {
+			return status, err
+		}
+
 		// Prepare VirtualMachineNetworkConfig status
 		ncStatus := networkv1.NetworkConfigStatus{
-			AllocatedIPAddress: ip,
-			MACAddress:         nc.MACAddress,
-			NetworkName:        nc.NetworkName,
-			State:              networkv1.AllocatedState,
+			AllocatedIPAddress:   ip,
+			AllocatedIPv6Address: ipv6,
+			MACAddress:           nc.MACAddress,
+			NetworkName:          nc.NetworkName,
+			State:                networkv1.AllocatedState,
+			IPPoolRef:            ipPoolKey,
 		}
 
 		ncStatuses = append(ncStatuses, ncStatus)
@@ -203,20 +734,55 @@ func (h *Handler) Allocate(vmNetCfg *networkv1.VirtualMachineNetworkConfig, stat
 			ipv4Status = new(networkv1.IPv4Status)
 		}
 
-		allocated := ipv4Status.Allocated
-		if allocated == nil {
-			allocated = make(map[string]string)
-		}
+		leased := util.NormalizeMAC(util.Leases(ipv4Status)[ip]) == util.NormalizeMAC(nc.MACAddress)
+		util.SetAllocationEntry(ipv4Status, ip, networkv1.AllocationEntry{
+			Type:         networkv1.AllocationTypeLease,
+			Owner:        nc.MACAddress,
+			Namespace:    vmNetCfg.Namespace,
+			DefaultRoute: nc.DefaultRoute,
+			Mode:         nc.Mode,
+		}, h.clock.Now())
 
-		allocated[ip] = nc.MACAddress
-
-		ipv4Status.Allocated = allocated
 		ipPoolCpy.Status.IPv4 = ipv4Status
 
+		if ipv6 != "" {
+			ipv6Status := ipPoolCpy.Status.IPv6
+			if ipv6Status == nil {
+				ipv6Status = new(networkv1.IPv6Status)
+			}
+			util.SetIPv6AllocationEntry(ipv6Status, ipv6, networkv1.AllocationEntry{
+				Type:      networkv1.AllocationTypeLease,
+				Owner:     nc.MACAddress,
+				Namespace: vmNetCfg.Namespace,
+				Mode:      nc.Mode,
+			}, h.clock.Now())
+			ipPoolCpy.Status.IPv6 = ipv6Status
+		}
+
 		if !reflect.DeepEqual(ipPoolCpy, ipPool) {
 			logrus.Infof("(vmnetcfg.Allocate) update ippool %s/%s", ipPool.Namespace, ipPool.Name)
-			ipPoolCpy.Status.LastUpdate = metav1.Now()
-			if _, err = h.ippoolClient.UpdateStatus(ipPoolCpy); err != nil {
+			if _, err = h.commitIPPoolStatus(ipPool, ipPoolCpy); err != nil {
+				return status, err
+			}
+			if !leased {
+				h.metricsAllocator.IncIPPoolAllocations(ipPoolKey, vmNetCfg.Namespace+"/"+vmNetCfg.Spec.VMName)
+			}
+		}
+
+		// The former IPPool is only let go of once the new one carries the
+		// lease, so the VM is never left without one in between. IPPools of
+		// the same network share the IPAM subnet and MAC cache, which the new
+		// IPPool rebuilt without the former allocation.
+		if reboundFrom != nil {
+			logrus.Infof("(vmnetcfg.Allocate) move %s of vmnetcfg %s/%s from ippool %s to %s",
+				nc.MACAddress, vmNetCfg.Namespace, vmNetCfg.Name, reboundFrom.IPPoolRef, ipPoolKey)
+			if reboundIPAMName := h.getIPAMName(vmNetCfg.Namespace, *reboundFrom); reboundIPAMName != ipamName {
+				if err := h.releaseIP(reboundIPAMName, *reboundFrom); err != nil {
+					return status, err
+				}
+			}
+			h.reportRelease(vmNetCfg, *reboundFrom)
+			if err := h.deleteAllocationEntry(vmNetCfg.Namespace, *reboundFrom); err != nil {
 				return status, err
 			}
 		}
@@ -227,11 +793,103 @@ func (h *Handler) Allocate(vmNetCfg *networkv1.VirtualMachineNetworkConfig, stat
 		return status, fmt.Errorf("no network configs found for vmnetcfg %s/%s", vmNetCfg.Namespace, vmNetCfg.Name)
 	}
 
+	h.removePending(vmNetCfgKey)
+
 	status.NetworkConfigs = ncStatuses
 
 	return status, nil
 }
 
+// allocateIP allocates the IP address dIP of the IPPool to the MAC address, or
+// any IP address left if dIP is unspecified. Falling back on the held-back
+// range in the latter case is warned about on the IPPool.
+func (h *Handler) allocateIP(ipPool *networkv1.IPPool, dIP, macAddress string) (string, error) {
+	ipamName := util.IPAMName(ipPool)
+
+	// Reserved IP addresses are never allocated to other MAC addresses
+	if owner, ok := util.ReservationOwner(ipPool, dIP); ok && util.NormalizeMAC(owner) != util.NormalizeMAC(macAddress) {
+		return net.IPv4zero.String(), fmt.Errorf("designated ip %s is reserved for mac %s: %w", dIP, owner, ipam.ErrAlreadyAllocated)
+	}
+	if dIP != net.IPv4zero.String() {
+		return h.ipAllocator.AllocateIP(ipamName, dIP)
+	}
+
+	var ip string
+	var err error
+	if ipPool.Spec.AllocationStrategy == networkv1.AllocationStrategyMACHashed {
+		ip, err = h.ipAllocator.AllocateIPByMAC(ipamName, macAddress)
+	} else {
+		ip, err = h.ipAllocator.AllocateIP(ipamName, dIP)
+	}
+	if err == nil && h.ipAllocator.IsHeldBack(ipamName, ip) {
+		logrus.Warnf("(vmnetcfg.allocateIP) allocated held-back ip %s of ippool %s/%s to %s as the rest is exhausted",
+			ip, ipPool.Namespace, ipPool.Name, macAddress)
+		if h.recorder != nil {
+			h.recorder.Eventf(ipPool, corev1.EventTypeWarning, ReasonHeldBackIP,
+				"allocated held-back ip %s to %s as the rest of the pool is exhausted", ip, macAddress)
+		}
+	}
+
+	return ip, err
+}
+
+// allocateOverflow allocates an IP address to the MAC address from the first
+// IPPool of the overflow chain having one left. IPPools which are paused, not
+// ready, or require VM annotations the VM lacks are passed over. It returns a
+// nil IPPool if the whole chain is exhausted.
+func (h *Handler) allocateOverflow(vmNetCfg *networkv1.VirtualMachineNetworkConfig, chain []*networkv1.IPPool, macAddress string) (*networkv1.IPPool, string, error) {
+	for _, overflowPool := range chain {
+		if overflowPool.Spec.Paused != nil && *overflowPool.Spec.Paused {
+			continue
+		}
+		if !networkv1.CacheReady.IsTrue(overflowPool) {
+			continue
+		}
+		if err := h.checkRequiredVMAnnotations(vmNetCfg, overflowPool); err != nil {
+			continue
+		}
+
+		ip, err := h.allocateIP(overflowPool, net.IPv4zero.String(), macAddress)
+		if err != nil {
+			if errors.Is(err, ipam.ErrExhausted) {
+				continue
+			}
+			return nil, "", err
+		}
+
+		return overflowPool, ip, nil
+	}
+
+	return nil, "", nil
+}
+
+// findOverflowAllocation returns the IPPool of the overflow chain the IP
+// address of the MAC address was allocated from, if any, going by the status
+// or else by the MAC caches.
+func (h *Handler) findOverflowAllocation(chain []*networkv1.IPPool, prevNcStatus networkv1.NetworkConfigStatus, hasPrev bool, macAddress string) *networkv1.IPPool {
+	if hasPrev && prevNcStatus.IPPoolRef != "" {
+		return findIPPool(chain, prevNcStatus.IPPoolRef)
+	}
+
+	for _, overflowPool := range chain {
+		if exists, err := h.cacheAllocator.HasMAC(util.IPAMName(overflowPool), macAddress); err == nil && exists {
+			return overflowPool
+		}
+	}
+
+	return nil
+}
+
+// findIPPool returns the IPPool with the key among ipPools.
+func findIPPool(ipPools []*networkv1.IPPool, key string) *networkv1.IPPool {
+	for _, ipPool := range ipPools {
+		if ipPool.Namespace+"/"+ipPool.Name == key {
+			return ipPool
+		}
+	}
+	return nil
+}
+
 // Sync ensures that the VirtualMachineNetworkConfig is in-sync by
 // comparing the Spec and Status and cleaning up stale records.
 func (h *Handler) Sync(vmNetCfg *networkv1.VirtualMachineNetworkConfig, status networkv1.VirtualMachineNetworkConfigStatus) (networkv1.VirtualMachineNetworkConfigStatus, error) {
@@ -249,17 +907,18 @@ func (h *Handler) Sync(vmNetCfg *networkv1.VirtualMachineNetworkConfig, status n
 
 	logrus.Infof("(vmnetcfg.InSynced) vmnetcfg %s/%s is out-of-sync; start reconciling", vmNetCfg.Namespace, vmNetCfg.Name)
 
-	// Build a set of MAC addresses from the Spec
+	// Build a set of MAC addresses from the Spec, normalized as the ones
+	// in the Status are
 	var macAddressSet = make(map[string]struct{})
 	for _, nc := range vmNetCfg.Spec.NetworkConfigs {
-		macAddressSet[nc.MACAddress] = struct{}{}
+		macAddressSet[util.NormalizeMAC(nc.MACAddress)] = struct{}{}
 	}
 
 	// Mark the NetworkConfigStatus as stale if the MAC address is not in
 	// the Spec; otherwise, add it to the non-stale list.
 	var nonStaleNetworkConfigs []networkv1.NetworkConfigStatus
 	for i, ncStatus := range status.NetworkConfigs {
-		if _, ok := macAddressSet[ncStatus.MACAddress]; !ok {
+		if _, ok := macAddressSet[util.NormalizeMAC(ncStatus.MACAddress)]; !ok {
 			status.NetworkConfigs[i].State = networkv1.StaleState
 			continue
 		}
@@ -284,13 +943,225 @@ func (h *Handler) OnRemove(key string, vmNetCfg *networkv1.VirtualMachineNetwork
 
 	logrus.Debugf("(vmnetcfg.OnRemove) vmnetcfg configuration %s/%s has been removed", vmNetCfg.Namespace, vmNetCfg.Name)
 
+	if err := h.waitForWarmup(vmNetCfg); err != nil {
+		return vmNetCfg, err
+	}
+
 	if err := h.cleanup(vmNetCfg, false); err != nil {
 		return vmNetCfg, err
 	}
 
+	h.removePending(key)
+
 	return vmNetCfg, nil
 }
 
+// waitForWarmup requeues the VirtualMachineNetworkConfig shortly and returns
+// config.ErrWarmingUp while the IPAM and MAC caches are warming up, so nothing
+// is allocated from or released to them before they hold the existing leases.
+func (h *Handler) waitForWarmup(vmNetCfg *networkv1.VirtualMachineNetworkConfig) error {
+	if h.warmup.IsDone() {
+		return nil
+	}
+
+	// The controller isn't set up in tests not caring about it
+	if h.vmnetcfgController != nil {
+		h.vmnetcfgController.EnqueueAfter(vmNetCfg.Namespace, vmNetCfg.Name, warmupRetryPeriod)
+	}
+	return fmt.Errorf("vmnetcfg %s/%s: %w", vmNetCfg.Namespace, vmNetCfg.Name, config.ErrWarmingUp)
+}
+
+// checkRequiredVMAnnotations makes sure the VM of the
+// VirtualMachineNetworkConfig carries the annotations required by the IPPool.
+func (h *Handler) checkRequiredVMAnnotations(vmNetCfg *networkv1.VirtualMachineNetworkConfig, ipPool *networkv1.IPPool) error {
+	if len(ipPool.Spec.RequiredVMAnnotations) == 0 {
+		return nil
+	}
+
+	vm, err := h.vmCache.Get(vmNetCfg.Namespace, vmNetCfg.Spec.VMName)
+	if err != nil {
+		return fmt.Errorf("cannot check annotations required by ippool %s/%s: %w", ipPool.Namespace, ipPool.Name, err)
+	}
+
+	var mismatches []string
+	for key, value := range ipPool.Spec.RequiredVMAnnotations {
+		actual, ok := vm.Annotations[key]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, fmt.Sprintf("%s is missing", key))
+		case actual != value:
+			mismatches = append(mismatches, fmt.Sprintf("%s is %q rather than %q", key, actual, value))
+		}
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	sort.Strings(mismatches)
+
+	return fmt.Errorf("vm %s/%s lacks annotations required by ippool %s/%s: %s",
+		vm.Namespace, vm.Name, ipPool.Namespace, ipPool.Name, strings.Join(mismatches, ", "))
+}
+
+// recordDenial keeps a record of the denied allocation for auditing.
+func (h *Handler) recordDenial(vmNetCfg *networkv1.VirtualMachineNetworkConfig, ipPoolKey, macAddress string, reason audit.DenialReason, err error) {
+	h.metricsAllocator.IncIPPoolDenials(ipPoolKey, string(reason))
+	h.denialLog.Record(ipPoolKey, audit.Denial{
+		MACAddress: macAddress,
+		Reason:     reason,
+		VmNetCfg:   vmNetCfg.Namespace + "/" + vmNetCfg.Name,
+		VMName:     vmNetCfg.Spec.VMName,
+		Message:    err.Error(),
+	})
+}
+
+// recordAllocationFailure emits the events about the failed allocation of an
+// IP address for nc, naming its network and MAC address. An exhausted ipPool
+// gets one as well.
+func (h *Handler) recordAllocationFailure(vmNetCfg *networkv1.VirtualMachineNetworkConfig, ipPool *networkv1.IPPool, nc networkv1.NetworkConfig, err error) {
+	if h.recorder == nil {
+		return
+	}
+
+	if errors.Is(err, ipam.ErrExhausted) {
+		h.recorder.Eventf(vmNetCfg, corev1.EventTypeWarning, ReasonPoolExhausted,
+			"No IP address left in ippool %s/%s for mac address %s on network %s", ipPool.Namespace, ipPool.Name, nc.MACAddress, nc.NetworkName)
+		h.recorder.Eventf(ipPool, corev1.EventTypeWarning, ReasonPoolExhausted,
+			"No IP address left for mac address %s of vmnetcfg %s/%s on network %s", nc.MACAddress, vmNetCfg.Namespace, vmNetCfg.Name, nc.NetworkName)
+		return
+	}
+
+	h.recorder.Eventf(vmNetCfg, corev1.EventTypeWarning, ReasonAllocationFailed,
+		"Failed to allocate an IP address for mac address %s on network %s: %s", nc.MACAddress, nc.NetworkName, err)
+}
+
+// bumpAllocationRevision moves the allocation revision of ipPoolCpy one step
+// forward if its leases differ from the ones of ipPool, and returns the
+// differences.
+func (h *Handler) bumpAllocationRevision(ipPool, ipPoolCpy *networkv1.IPPool) []audit.Change {
+	changes := diffLeases(util.Leases(ipPool.Status.IPv4), util.Leases(ipPoolCpy.Status.IPv4))
+	if len(changes) == 0 {
+		return nil
+	}
+
+	ipPoolCpy.Status.AllocationRevision = ipPool.Status.AllocationRevision + 1
+	ipPoolCpy.Status.LastChange = metav1.NewTime(h.clock.Now())
+
+	return changes
+}
+
+// recordChanges keeps the changes of the committed allocation revision of the
+// IPPool for the consumers of the leases export, and counts them toward the
+// allocation pace of the IPPool.
+func (h *Handler) recordChanges(ipPool *networkv1.IPPool, changes []audit.Change) {
+	if len(changes) == 0 {
+		return
+	}
+	ipPoolKey := ipPool.Namespace + "/" + ipPool.Name
+
+	// The change log and the tracker aren't set up in tests not caring
+	// about them
+	if h.changeLog != nil {
+		h.changeLog.Record(ipPoolKey, ipPool.Status.AllocationRevision, changes)
+	}
+	if h.allocationTracker != nil {
+		var delta int
+		for _, change := range changes {
+			switch change.Type {
+			case audit.ChangeTypeAllocated:
+				delta++
+			case audit.ChangeTypeReleased:
+				delta--
+			}
+		}
+		h.allocationTracker.Record(ipPoolKey, delta)
+	}
+}
+
+// diffLeases returns the leases released and allocated going from before to
+// after, ordered by IP address.
+func diffLeases(before, after map[string]string) []audit.Change {
+	var changes []audit.Change
+	for ip, mac := range before {
+		if after[ip] != mac {
+			changes = append(changes, audit.Change{Type: audit.ChangeTypeReleased, IPAddress: ip, MACAddress: mac})
+		}
+	}
+	for ip, mac := range after {
+		if before[ip] != mac {
+			changes = append(changes, audit.Change{Type: audit.ChangeTypeAllocated, IPAddress: ip, MACAddress: mac})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].IPAddress != changes[j].IPAddress {
+			return changes[i].IPAddress < changes[j].IPAddress
+		}
+		// A lease changing hands is released before being allocated again
+		return changes[i].Type == audit.ChangeTypeReleased && changes[j].Type != audit.ChangeTypeReleased
+	})
+
+	return changes
+}
+
+func (h *Handler) addPending(vmNetCfgKey, ipPoolKey string, reason networkv1.PendingReason) {
+	if previous := h.pending.Add(vmNetCfgKey, ipPoolKey, reason); previous != "" && previous != ipPoolKey {
+		h.syncPending(previous)
+	}
+	h.syncPending(ipPoolKey)
+}
+
+func (h *Handler) removePending(vmNetCfgKey string) {
+	if previous := h.pending.Remove(vmNetCfgKey); previous != "" {
+		h.syncPending(previous)
+	}
+}
+
+// syncPending publishes the pending allocations of the IPPool to the metrics
+// and the IPPool status. The status is updated on a best-effort basis as the
+// metrics are authoritative.
+func (h *Handler) syncPending(ipPoolKey string) {
+	pending := h.pending.Stats(ipPoolKey)
+
+	reasons := make(map[string]int, len(pendingReasons))
+	var oldestSince time.Time
+	for _, reason := range pendingReasons {
+		reasons[string(reason)] = 0
+	}
+	if pending != nil {
+		for reason, count := range pending.Reasons {
+			reasons[string(reason)] = count
+		}
+		oldestSince = pending.OldestSince.Time
+	}
+	h.metricsAllocator.UpdateIPPoolPending(ipPoolKey, reasons, oldestSince)
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(ipPoolKey)
+	if err != nil {
+		logrus.Warnf("(vmnetcfg.syncPending) %s", err.Error())
+		return
+	}
+
+	if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		ipPool, err := h.ippoolCache.Get(namespace, name)
+		if err != nil {
+			return err
+		}
+
+		if pendingAllocationsEqual(ipPool.Status.PendingAllocations, pending) {
+			return nil
+		}
+
+		ipPoolCpy := ipPool.DeepCopy()
+		ipPoolCpy.Status.PendingAllocations = pending
+
+		logrus.Infof("(vmnetcfg.syncPending) update ippool %s/%s", ipPool.Namespace, ipPool.Name)
+		_, err = h.ippoolClient.UpdateStatus(ipPoolCpy)
+		return err
+	}); err != nil && !apierrors.IsNotFound(err) {
+		logrus.Warnf("(vmnetcfg.syncPending) failed to update pending allocations of ippool %s: %s", ipPoolKey, err.Error())
+	}
+}
+
 func (h *Handler) cleanup(vmNetCfg *networkv1.VirtualMachineNetworkConfig, cleanupStaleOnly bool) error {
 	if !cleanupStaleOnly {
 		h.metricsAllocator.DeleteVmNetCfgStatus(vmNetCfg.Namespace + "/" + vmNetCfg.Name)
@@ -298,62 +1169,145 @@ func (h *Handler) cleanup(vmNetCfg *networkv1.VirtualMachineNetworkConfig, clean
 
 	for _, ncStatus := range vmNetCfg.Status.NetworkConfigs {
 		if !cleanupStaleOnly || ncStatus.State == networkv1.StaleState {
-			// Deallocate IP address from IPAM
-			isAllocated, err := h.ipAllocator.IsAllocated(ncStatus.NetworkName, ncStatus.AllocatedIPAddress)
-			if err != nil {
+			if err := h.release(vmNetCfg, ncStatus); err != nil {
 				return err
 			}
-			if isAllocated {
-				if err := h.ipAllocator.DeallocateIP(ncStatus.NetworkName, ncStatus.AllocatedIPAddress); err != nil {
-					return err
-				}
-			}
+		}
+	}
+	return nil
+}
 
-			// Remove entry from cache
-			exists, err := h.cacheAllocator.HasMAC(ncStatus.NetworkName, ncStatus.MACAddress)
-			if err != nil {
-				return err
-			}
-			if exists {
-				if err := h.cacheAllocator.DeleteMAC(ncStatus.NetworkName, ncStatus.MACAddress); err != nil {
-					return err
-				}
-			}
+// release gives the IP address of ncStatus back to the IPPool it was
+// allocated from, and reports it to its external IPAM, if any.
+func (h *Handler) release(vmNetCfg *networkv1.VirtualMachineNetworkConfig, ncStatus networkv1.NetworkConfigStatus) error {
+	if err := h.releaseIP(h.getIPAMName(vmNetCfg.Namespace, ncStatus), ncStatus); err != nil {
+		return err
+	}
+	h.reportRelease(vmNetCfg, ncStatus)
+	return h.deleteAllocationEntry(vmNetCfg.Namespace, ncStatus)
+}
 
-			if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
-				ipPool, err := h.getIPPoolFromNetworkConfigStatus(vmNetCfg.Namespace, ncStatus)
-				if err != nil {
-					return err
-				}
+// releaseIP drops the allocation of ncStatus from the IPAM subnet and the MAC
+// cache.
+func (h *Handler) releaseIP(ipamName string, ncStatus networkv1.NetworkConfigStatus) error {
+	// Deallocate IP address from IPAM
+	isAllocated, err := h.ipAllocator.IsAllocated(ipamName, ncStatus.AllocatedIPAddress)
+	if err != nil {
+		return err
+	}
+	if isAllocated {
+		if err := h.ipAllocator.DeallocateIP(ipamName, ncStatus.AllocatedIPAddress); err != nil {
+			return err
+		}
+	}
 
-				ipPoolCpy := ipPool.DeepCopy()
+	// Remove entry from cache
+	exists, err := h.cacheAllocator.HasMAC(ipamName, ncStatus.MACAddress)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := h.cacheAllocator.DeleteMAC(ipamName, ncStatus.MACAddress); err != nil {
+			return err
+		}
+	}
 
-				// Remove record in IPPool status
-				delete(ipPoolCpy.Status.IPv4.Allocated, ncStatus.AllocatedIPAddress)
+	return h.releaseIPv6(util.IPv6IPAMNameOf(ipamName), ncStatus)
+}
 
-				if !reflect.DeepEqual(ipPoolCpy, ipPool) {
-					logrus.Infof("(vmnetcfg.cleanup) update ippool %s/%s", ipPool.Namespace, ipPool.Name)
-					ipPoolCpy.Status.LastUpdate = metav1.Now()
-					_, err := h.ippoolClient.UpdateStatus(ipPoolCpy)
-					return err
-				}
+// deleteAllocationEntry removes the allocation of ncStatus from the status of
+// the IPPool it was allocated from.
+func (h *Handler) deleteAllocationEntry(vmNetCfgNamespace string, ncStatus networkv1.NetworkConfigStatus) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		ipPool, err := h.getIPPoolFromNetworkConfigStatus(vmNetCfgNamespace, ncStatus)
+		if err != nil {
+			return err
+		}
+
+		ipPoolCpy := ipPool.DeepCopy()
+
+		// Remove record in IPPool status
+		util.DeleteAllocationEntry(ipPoolCpy.Status.IPv4, ncStatus.AllocatedIPAddress)
+		if ipPoolCpy.Status.IPv6 != nil && ncStatus.AllocatedIPv6Address != "" {
+			delete(ipPoolCpy.Status.IPv6.Entries, ncStatus.AllocatedIPv6Address)
+		}
 
-				return nil
-			}); err != nil {
+		if !reflect.DeepEqual(ipPoolCpy, ipPool) {
+			logrus.Infof("(vmnetcfg.deleteAllocationEntry) update ippool %s/%s", ipPool.Namespace, ipPool.Name)
+			if _, err := h.commitIPPoolStatus(ipPool, ipPoolCpy); err != nil {
 				return err
 			}
 		}
-	}
-	return nil
+
+		return nil
+	})
 }
 
-func findIPAddressFromNetworkConfigStatusByMACAddress(ncStatuses []networkv1.NetworkConfigStatus, macAddress string) (ipAddress string, err error) {
+// findNetworkConfigStatusByMACAddress returns the status of the network
+// config with the MAC address.
+func findNetworkConfigStatusByMACAddress(ncStatuses []networkv1.NetworkConfigStatus, macAddress string) (networkv1.NetworkConfigStatus, bool) {
 	for _, ncStatus := range ncStatuses {
-		if ncStatus.MACAddress == macAddress && ncStatus.AllocatedIPAddress != "" {
-			return ncStatus.AllocatedIPAddress, nil
+		if util.NormalizeMAC(ncStatus.MACAddress) == util.NormalizeMAC(macAddress) {
+			return ncStatus, true
 		}
 	}
-	return net.IPv4zero.String(), fmt.Errorf("could not find allocated ip for mac %s", macAddress)
+	return networkv1.NetworkConfigStatus{}, false
+}
+
+// findReboundNetworkConfigStatus returns the status of the network config of
+// vmNetCfg attached to the NetworkAttachmentDefinition which holds an IP
+// address of another IPPool than the one the NetworkAttachmentDefinition
+// points to.
+func (h *Handler) findReboundNetworkConfigStatus(vmNetCfg *networkv1.VirtualMachineNetworkConfig, nad *cniv1.NetworkAttachmentDefinition) (networkv1.NetworkConfigStatus, bool) {
+	for _, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+		if ncStatus.IPPoolRef == "" || ncStatus.State != networkv1.AllocatedState {
+			continue
+		}
+
+		nadNamespace, nadName := kv.RSplit(ncStatus.NetworkName, "/")
+		if nadNamespace == "" {
+			nadNamespace = vmNetCfg.Namespace
+		}
+		if nadNamespace != nad.Namespace || nadName != nad.Name {
+			continue
+		}
+
+		ipPool, err := h.getIPPoolFromNetworkName(vmNetCfg.Namespace, ncStatus.NetworkName)
+		if err != nil {
+			logrus.Debugf("(vmnetcfg.findReboundNetworkConfigStatus) %s", err.Error())
+			continue
+		}
+		if ncStatus.IPPoolRef == ipPool.Namespace+"/"+ipPool.Name {
+			continue
+		}
+
+		// IP addresses overflowed into the chain of the IPPool aren't rebound
+		chain, err := util.OverflowChain(h.ippoolCache, ipPool)
+		if err != nil {
+			logrus.Debugf("(vmnetcfg.findReboundNetworkConfigStatus) %s", err.Error())
+			continue
+		}
+		if findIPPool(chain, ncStatus.IPPoolRef) == nil {
+			return ncStatus, true
+		}
+	}
+	return networkv1.NetworkConfigStatus{}, false
+}
+
+// isAutoRebindEnabled reports whether the network opted in to moving the IP
+// addresses over when re-pointed to another IPPool.
+func (h *Handler) isAutoRebindEnabled(vmNetCfgNamespace string, networkName string) bool {
+	nadNamespace, nadName := kv.RSplit(networkName, "/")
+	if nadNamespace == "" {
+		nadNamespace = vmNetCfgNamespace
+	}
+
+	nad, err := h.nadCache.Get(nadNamespace, nadName)
+	if err != nil {
+		return false
+	}
+
+	return util.IsAutoRebindEnabled(nad)
 }
 
 func (h *Handler) getIPPoolFromNetworkName(vmNetCfgNamespace string, networkName string) (*networkv1.IPPool, error) {
@@ -366,6 +1320,25 @@ func (h *Handler) getIPPoolFromNetworkConfig(vmNetCfgNamespace string, nc networ
 	return h.getIPPoolFromNetworkName(vmNetCfgNamespace, nc.NetworkName)
 }
 
+// getIPPoolFromNetworkConfigStatus returns the IPPool the IP address of
+// ncStatus was allocated from, which isn't the one the network points to
+// anymore if it got re-pointed since.
 func (h *Handler) getIPPoolFromNetworkConfigStatus(vmNetCfgNamespace string, ncStatus networkv1.NetworkConfigStatus) (*networkv1.IPPool, error) {
+	if ncStatus.IPPoolRef != "" {
+		ipPoolNamespace, ipPoolName := kv.RSplit(ncStatus.IPPoolRef, "/")
+		return h.ippoolCache.Get(ipPoolNamespace, ipPoolName)
+	}
 	return h.getIPPoolFromNetworkName(vmNetCfgNamespace, ncStatus.NetworkName)
 }
+
+// getIPAMName returns the name of the IPAM subnet holding the allocation of
+// ncStatus. It falls back to the network name if the IPPool is gone, which is
+// the name of any IPPool but the delegated ones.
+func (h *Handler) getIPAMName(vmNetCfgNamespace string, ncStatus networkv1.NetworkConfigStatus) string {
+	ipPool, err := h.getIPPoolFromNetworkConfigStatus(vmNetCfgNamespace, ncStatus)
+	if err != nil {
+		return ncStatus.NetworkName
+	}
+
+	return util.IPAMName(ipPool)
+}
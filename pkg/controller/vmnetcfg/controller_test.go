@@ -1,20 +1,43 @@
 package vmnetcfg
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	"github.com/rancher/wrangler/v3/pkg/relatedresource"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	kubevirtv1 "kubevirt.io/api/core/v1"
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/audit"
 	"github.com/harvester/vm-dhcp-controller/pkg/cache"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+	"github.com/harvester/vm-dhcp-controller/pkg/config"
 	"github.com/harvester/vm-dhcp-controller/pkg/controller/ippool"
+	"github.com/harvester/vm-dhcp-controller/pkg/externalipam"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
 	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
 	"github.com/harvester/vm-dhcp-controller/pkg/ipam"
 	"github.com/harvester/vm-dhcp-controller/pkg/metrics"
+	"github.com/harvester/vm-dhcp-controller/pkg/reconcile"
 	"github.com/harvester/vm-dhcp-controller/pkg/util"
 	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
 )
@@ -111,6 +134,8 @@ func TestHandler_OnChange(t *testing.T) {
 
 		handler := Handler{
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
 		}
 
@@ -180,6 +205,8 @@ func TestHandler_OnChange(t *testing.T) {
 			cacheAllocator:   givenCacheAllocator,
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
@@ -218,8 +245,11 @@ func TestHandler_Allocate(t *testing.T) {
 
 		expectedStatus := newTestVmNetCfgStatusBuilder().
 			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
-			WithNetworkConfigStatus(testIPAddress2, testMACAddress2, testNetworkName, networkv1.AllocatedState).Build()
+			IPPoolRef(testIPPoolNamespace+"/"+testIPPoolName).
+			WithNetworkConfigStatus(testIPAddress2, testMACAddress2, testNetworkName, networkv1.AllocatedState).
+			IPPoolRef(testIPPoolNamespace + "/" + testIPPoolName).Build()
 		expectedIPPool := newTestIPPoolBuilder().
+			AllocationRevision(2).
 			ServerIP(testServerIP).
 			CIDR(testCIDR).
 			PoolRange(testStartIP, testEndIP).
@@ -258,6 +288,8 @@ func TestHandler_Allocate(t *testing.T) {
 			cacheAllocator:   givenCacheAllocator,
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
 			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
@@ -281,6 +313,170 @@ func TestHandler_Allocate(t *testing.T) {
 		assert.Equal(t, expectedCacheAllocator, handler.cacheAllocator)
 	})
 
+	t.Run("vmnetcfg on a mac-hashed ippool", func(t *testing.T) {
+		givenVmNetCfg := newTestVmNetCfgBuilder().
+			WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			AllocationStrategy(networkv1.AllocationStrategyMACHashed).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		// The same MAC address gets the same IP address, controller after
+		// controller
+		var ips []string
+		for i := 0; i < 2; i++ {
+			clientset := fake.NewSimpleClientset(givenVmNetCfg, givenIPPool)
+			err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+			handler := Handler{
+				cacheAllocator: newTestCacheAllocatorBuilder().
+					MACSet(testNetworkName).Build(),
+				ipAllocator: newTestIPAllocatorBuilder().
+					IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+				metricsAllocator: metrics.New(),
+				clock:            clock.RealClock{},
+				pending:          newPendingIndex(clock.RealClock{}),
+				ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+				ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+				nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			}
+
+			status, err := handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+			assert.Nil(t, err)
+			assert.Len(t, status.NetworkConfigs, 1)
+			ips = append(ips, status.NetworkConfigs[0].AllocatedIPAddress)
+		}
+
+		expectedIP, err := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build().
+			AllocateIPByMAC(testNetworkName, testMACAddress1)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{expectedIP, expectedIP}, ips)
+	})
+
+	t.Run("vmnetcfg in a namespace delegated to", func(t *testing.T) {
+		const (
+			delegatedStartIP = "192.168.0.150"
+			delegatingEndIP  = "192.168.0.149"
+		)
+		delegatedIPAMName := testNetworkName + "@" + testVmNetCfgNamespace + "/" + testIPPoolName
+
+		givenVmNetCfg := newTestVmNetCfgBuilder().
+			WithNetworkConfig(testIPAddress2, testMACAddress2, testNetworkName).
+			WithNetworkConfig(testIPAddress3, testMACAddress3, testNetworkName).Build()
+		givenIPPool := newTestIPPoolBuilder().
+			Annotation(util.DelegatedPoolsAnnotationKey, testVmNetCfgNamespace+"/"+testIPPoolName).
+			ServerIP(testServerIP).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, delegatingEndIP).
+			NetworkName(testNetworkName).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenDelegatedIPPool := ippool.NewIPPoolBuilder(testVmNetCfgNamespace, testIPPoolName).
+			Annotation(util.DelegatedFromAnnotationKey, testIPPoolNamespace+"/"+testIPPoolName).
+			ServerIP(testServerIP).
+			CIDR(testCIDR).
+			PoolRange(delegatedStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenCacheAllocator := newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).
+			MACSet(delegatedIPAMName).Build()
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, delegatingEndIP).
+			IPSubnet(delegatedIPAMName, testCIDR, delegatedStartIP, testEndIP).Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+		expectedStatus := newTestVmNetCfgStatusBuilder().
+			WithNetworkConfigStatus(testIPAddress2, testMACAddress2, testNetworkName, networkv1.AllocatedState).
+			IPPoolRef(testVmNetCfgNamespace+"/"+testIPPoolName).
+			WithNetworkConfigStatus(testIPAddress3, testMACAddress3, testNetworkName, networkv1.AllocatedState).
+			IPPoolRef(testVmNetCfgNamespace + "/" + testIPPoolName).Build()
+		expectedDelegatedIPPool := ippool.NewIPPoolBuilder(testVmNetCfgNamespace, testIPPoolName).
+			AllocationRevision(2).
+			Annotation(util.DelegatedFromAnnotationKey, testIPPoolNamespace+"/"+testIPPoolName).
+			ServerIP(testServerIP).
+			CIDR(testCIDR).
+			PoolRange(delegatedStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			Allocated(testIPAddress2, testMACAddress2).
+			Allocated(testIPAddress3, testMACAddress3).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		expectedCacheAllocator := newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).
+			MACSet(delegatedIPAMName).
+			Add(delegatedIPAMName, testMACAddress2, testIPAddress2).
+			Add(delegatedIPAMName, testMACAddress3, testIPAddress3).Build()
+		expectedIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, delegatingEndIP).
+			IPSubnet(delegatedIPAMName, testCIDR, delegatedStartIP, testEndIP).
+			Allocate(delegatedIPAMName, testIPAddress2, testIPAddress3).Build()
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset(givenVmNetCfg, givenIPPool, givenDelegatedIPPool)
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		handler := Handler{
+			cacheAllocator:   givenCacheAllocator,
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}
+
+		status, err := handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+		assert.Nil(t, err)
+
+		SanitizeStatus(&expectedStatus)
+		SanitizeStatus(&status)
+		assert.Equal(t, expectedStatus, status)
+
+		// Only the delegated IPPool records the allocations
+		ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, givenIPPool, ipPool)
+
+		delegatedIPPool, err := handler.ippoolClient.Get(testVmNetCfgNamespace, testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		ippool.SanitizeStatus(&expectedDelegatedIPPool.Status)
+		ippool.SanitizeStatus(&delegatedIPPool.Status)
+		assert.Equal(t, expectedDelegatedIPPool, delegatedIPPool)
+
+		assert.Equal(t, expectedIPAllocator, handler.ipAllocator)
+		assert.Equal(t, expectedCacheAllocator, handler.cacheAllocator)
+
+		// Cleaning up releases the addresses from the delegated IPAM
+		vmNetCfg := givenVmNetCfg.DeepCopy()
+		vmNetCfg.Status = status
+		err = handler.cleanup(vmNetCfg, false)
+		assert.Nil(t, err)
+
+		assert.Equal(t, givenIPAllocator, handler.ipAllocator)
+	})
+
 	t.Run("rebuild caches", func(t *testing.T) {
 		givenVmNetCfg := newTestVmNetCfgBuilder().
 			WithNetworkConfig(testIPAddress1, testMACAddress1, testNetworkName).
@@ -330,6 +526,8 @@ func TestHandler_Allocate(t *testing.T) {
 			cacheAllocator:   givenCacheAllocator,
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
 			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
@@ -376,8 +574,11 @@ func TestHandler_Allocate(t *testing.T) {
 
 		expectedStatus := newTestVmNetCfgStatusBuilder().
 			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
-			WithNetworkConfigStatus(testIPAddress2, testMACAddress2, testNetworkName, networkv1.AllocatedState).Build()
+			IPPoolRef(testIPPoolNamespace+"/"+testIPPoolName).
+			WithNetworkConfigStatus(testIPAddress2, testMACAddress2, testNetworkName, networkv1.AllocatedState).
+			IPPoolRef(testIPPoolNamespace + "/" + testIPPoolName).Build()
 		expectedIPPool := newTestIPPoolBuilder().
+			AllocationRevision(2).
 			ServerIP(testServerIP).
 			CIDR(testCIDR).
 			PoolRange(testStartIP, testEndIP).
@@ -404,6 +605,8 @@ func TestHandler_Allocate(t *testing.T) {
 		handler := Handler{
 			cacheAllocator:   givenCacheAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
 			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
@@ -530,6 +733,2199 @@ func TestHandler_Allocate(t *testing.T) {
 	})
 }
 
+func scrapeMetrics(metricsAllocator *metrics.MetricsAllocator) string {
+	recorder := httptest.NewRecorder()
+	metricsAllocator.GetHTTPHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return recorder.Body.String()
+}
+
+func TestHandler_PendingAllocations(t *testing.T) {
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+	exhaustedMetric := fmt.Sprintf("%s{ippool=%q,reason=%q}", metrics.IPPoolPendingAllocationsMetricName, ipPoolKey, networkv1.PendingReasonPoolExhausted)
+	pausedMetric := fmt.Sprintf("%s{ippool=%q,reason=%q}", metrics.IPPoolPendingAllocationsMetricName, ipPoolKey, networkv1.PendingReasonPoolPaused)
+	ageMetric := fmt.Sprintf("%s{ippool=%q}", metrics.IPPoolPendingAllocationOldestAgeMetricName, ipPoolKey)
+
+	t.Run("waiters on an exhausted ippool are counted until satisfied", func(t *testing.T) {
+		givenVmNetCfg := newTestVmNetCfgBuilder().
+			WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testStartIP).
+			NetworkName(testNetworkName).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenCacheAllocator := newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).Build()
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testStartIP).
+			Allocate(testNetworkName, testStartIP).Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		err = clientset.Tracker().Add(givenIPPool)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		fakeClock := clock.NewFakeClock(start)
+
+		handler := Handler{
+			cacheAllocator:   givenCacheAllocator,
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metrics.NewMetricsAllocator(fakeClock),
+			denialLog:        audit.NewDenialLog(fakeClock, audit.DefaultDenialLogSize),
+			clock:            fakeClock,
+			pending:          newPendingIndex(fakeClock),
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}
+
+		_, err = handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+		assert.ErrorIs(t, err, ipam.ErrExhausted)
+
+		ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		if assert.NotNil(t, ipPool.Status.PendingAllocations) {
+			assert.Equal(t, 1, ipPool.Status.PendingAllocations.Count)
+			assert.Equal(t, map[networkv1.PendingReason]int{
+				networkv1.PendingReasonPoolExhausted: 1,
+			}, ipPool.Status.PendingAllocations.Reasons)
+			assert.Equal(t, metav1.NewTime(start), *ipPool.Status.PendingAllocations.OldestSince)
+		}
+
+		body := scrapeMetrics(handler.metricsAllocator)
+		assert.Contains(t, body, exhaustedMetric+" 1")
+		assert.Contains(t, body, pausedMetric+" 0")
+		assert.Contains(t, body, ageMetric+" 0")
+
+		// Retrying keeps the time the vmnetcfg started waiting
+		fakeClock.Step(90 * time.Second)
+
+		_, err = handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+		assert.ErrorIs(t, err, ipam.ErrExhausted)
+
+		ipPool, err = handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		if assert.NotNil(t, ipPool.Status.PendingAllocations) {
+			assert.Equal(t, metav1.NewTime(start), *ipPool.Status.PendingAllocations.OldestSince)
+		}
+
+		body = scrapeMetrics(handler.metricsAllocator)
+		assert.Contains(t, body, ageMetric+" 90")
+
+		err = handler.ipAllocator.DeallocateIP(testNetworkName, testStartIP)
+		assert.Nil(t, err)
+
+		_, err = handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+		assert.Nil(t, err)
+
+		ipPool, err = handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Nil(t, ipPool.Status.PendingAllocations)
+
+		body = scrapeMetrics(handler.metricsAllocator)
+		assert.Contains(t, body, exhaustedMetric+" 0")
+		assert.NotContains(t, body, ageMetric)
+
+		// Each attempt is counted, the ones on the exhausted ippool as failed
+		assert.Contains(t, body, fmt.Sprintf("%s{ippool=%q} 3", metrics.IPPoolAllocationAttemptsMetricName, ipPoolKey))
+		assert.Contains(t, body, fmt.Sprintf("%s{ippool=%q} 2", metrics.IPPoolAllocationFailuresMetricName, ipPoolKey))
+		assert.Contains(t, body, fmt.Sprintf("%s_count{ippool=%q} 3", metrics.IPPoolAllocationDurationMetricName, ipPoolKey))
+	})
+
+	t.Run("waiters on a paused ippool are counted until removed", func(t *testing.T) {
+		givenVmNetCfg := newTestVmNetCfgBuilder().
+			WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			Paused().Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		err = clientset.Tracker().Add(givenIPPool)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handler := Handler{
+			cacheAllocator:   newTestCacheAllocatorBuilder().Build(),
+			ipAllocator:      newTestIPAllocatorBuilder().Build(),
+			metricsAllocator: metrics.New(),
+			denialLog:        audit.NewDenialLog(clock.RealClock{}, audit.DefaultDenialLogSize),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}
+
+		_, err = handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+		assert.Equal(t, fmt.Sprintf("ippool %s/%s is paused", testIPPoolNamespace, testIPPoolName), err.Error())
+
+		ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		if assert.NotNil(t, ipPool.Status.PendingAllocations) {
+			assert.Equal(t, map[networkv1.PendingReason]int{
+				networkv1.PendingReasonPoolPaused: 1,
+			}, ipPool.Status.PendingAllocations.Reasons)
+		}
+
+		body := scrapeMetrics(handler.metricsAllocator)
+		assert.Contains(t, body, pausedMetric+" 1")
+		assert.Contains(t, body, ageMetric)
+
+		_, err = handler.OnRemove(testKey, givenVmNetCfg)
+		assert.Nil(t, err)
+
+		ipPool, err = handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Nil(t, ipPool.Status.PendingAllocations)
+
+		body = scrapeMetrics(handler.metricsAllocator)
+		assert.Contains(t, body, pausedMetric+" 0")
+		assert.NotContains(t, body, ageMetric)
+	})
+}
+
+func TestHandler_AllocationDenials(t *testing.T) {
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+
+	testCases := []struct {
+		name           string
+		ipAddress      string
+		ipPoolBuilder  *ippool.IPPoolBuilder
+		ipAllocator    *ipam.IPAllocator
+		expectedReason audit.DenialReason
+		expectedEvents []string
+	}{
+		{
+			name: "ippool paused",
+			ipPoolBuilder: newTestIPPoolBuilder().
+				Paused(),
+			ipAllocator:    newTestIPAllocatorBuilder().Build(),
+			expectedReason: audit.DenialReasonPoolPaused,
+		},
+		{
+			name: "ippool exhausted",
+			ipPoolBuilder: newTestIPPoolBuilder().
+				CacheReadyCondition(corev1.ConditionTrue, "", ""),
+			ipAllocator: newTestIPAllocatorBuilder().
+				IPSubnet(testNetworkName, testCIDR, testStartIP, testStartIP).
+				Allocate(testNetworkName, testStartIP).Build(),
+			expectedReason: audit.DenialReasonPoolExhausted,
+			expectedEvents: []string{
+				fmt.Sprintf("Warning %s No IP address left in ippool %s for mac address %s on network %s",
+					ReasonPoolExhausted, ipPoolKey, testMACAddress1, testNetworkName),
+				fmt.Sprintf("Warning %s No IP address left for mac address %s of vmnetcfg %s on network %s",
+					ReasonPoolExhausted, testMACAddress1, testKey, testNetworkName),
+			},
+		},
+		{
+			name:      "designated ip already allocated",
+			ipAddress: testIPAddress1,
+			ipPoolBuilder: newTestIPPoolBuilder().
+				CacheReadyCondition(corev1.ConditionTrue, "", ""),
+			ipAllocator: newTestIPAllocatorBuilder().
+				IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+				Allocate(testNetworkName, testIPAddress1).Build(),
+			expectedReason: audit.DenialReasonStaticConflict,
+			expectedEvents: []string{
+				fmt.Sprintf("Warning %s Failed to allocate an IP address for mac address %s on network %s: ",
+					ReasonAllocationFailed, testMACAddress1, testNetworkName),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			givenVmNetCfg := newTestVmNetCfgBuilder().
+				WithVMName(testVmNetCfgName).
+				WithNetworkConfig(tc.ipAddress, testMACAddress1, testNetworkName).Build()
+			givenIPPool := tc.ipPoolBuilder.
+				ServerIP(testServerIP).
+				CIDR(testCIDR).
+				PoolRange(testStartIP, testEndIP).
+				NetworkName(testNetworkName).Build()
+			givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+				Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+				Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+			nadGVR := schema.GroupVersionResource{
+				Group:    "k8s.cni.cncf.io",
+				Version:  "v1",
+				Resource: "network-attachment-definitions",
+			}
+
+			clientset := fake.NewSimpleClientset()
+			err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+			err = clientset.Tracker().Add(givenIPPool)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			fakeClock := clock.NewFakeClock(start)
+			recorder := record.NewFakeRecorder(10)
+
+			handler := Handler{
+				cacheAllocator: newTestCacheAllocatorBuilder().
+					MACSet(testNetworkName).Build(),
+				ipAllocator:      tc.ipAllocator,
+				metricsAllocator: metrics.NewMetricsAllocator(fakeClock),
+				denialLog:        audit.NewDenialLog(fakeClock, audit.DefaultDenialLogSize),
+				clock:            fakeClock,
+				recorder:         recorder,
+				pending:          newPendingIndex(fakeClock),
+				ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+				ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+				nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			}
+
+			_, err = handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+			if !assert.NotNil(t, err) {
+				return
+			}
+
+			denials := handler.denialLog.List(ipPoolKey)
+			if assert.Len(t, denials, 1) {
+				assert.Equal(t, audit.Denial{
+					Timestamp:  start,
+					LastSeen:   start,
+					Count:      1,
+					MACAddress: testMACAddress1,
+					Reason:     tc.expectedReason,
+					VmNetCfg:   testKey,
+					VMName:     testVmNetCfgName,
+					Message:    err.Error(),
+				}, denials[0])
+			}
+
+			body := scrapeMetrics(handler.metricsAllocator)
+			assert.Contains(t, body, fmt.Sprintf("%s{ippool=%q,reason=%q} 1", metrics.IPPoolAllocationDenialsMetricName, ipPoolKey, tc.expectedReason))
+
+			// The events name the network and the MAC address
+			for _, expected := range tc.expectedEvents {
+				if assert.NotEmpty(t, recorder.Events) {
+					assert.True(t, strings.HasPrefix(<-recorder.Events, expected), "expected event %q", expected)
+				}
+			}
+			assert.Empty(t, recorder.Events)
+		})
+	}
+}
+
+func TestHandler_RequiredVMAnnotations(t *testing.T) {
+	const approvedAnnotation = "provisioning.example.com/approved"
+
+	testCases := []struct {
+		name          string
+		vmAnnotations map[string]string
+		expectedErr   string
+	}{
+		{
+			name:          "vm carrying the required annotations",
+			vmAnnotations: map[string]string{approvedAnnotation: "true", "other": "value"},
+		},
+		{
+			name:        "vm without the required annotations",
+			expectedErr: fmt.Sprintf("vm %s/%s lacks annotations required by ippool %s/%s: %s is missing", testVmNetCfgNamespace, testVmNetCfgName, testIPPoolNamespace, testIPPoolName, approvedAnnotation),
+		},
+		{
+			name:          "vm with mismatched annotations",
+			vmAnnotations: map[string]string{approvedAnnotation: "false"},
+			expectedErr:   fmt.Sprintf(`vm %s/%s lacks annotations required by ippool %s/%s: %s is "false" rather than "true"`, testVmNetCfgNamespace, testVmNetCfgName, testIPPoolNamespace, testIPPoolName, approvedAnnotation),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			givenVM := &kubevirtv1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   testVmNetCfgNamespace,
+					Name:        testVmNetCfgName,
+					Annotations: tc.vmAnnotations,
+				},
+			}
+			givenVmNetCfg := newTestVmNetCfgBuilder().
+				WithVMName(testVmNetCfgName).
+				WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+			givenIPPool := newTestIPPoolBuilder().
+				ServerIP(testServerIP).
+				CIDR(testCIDR).
+				PoolRange(testStartIP, testEndIP).
+				NetworkName(testNetworkName).
+				RequiredVMAnnotation(approvedAnnotation, "true").
+				CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+			givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+				Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+				Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+			nadGVR := schema.GroupVersionResource{
+				Group:    "k8s.cni.cncf.io",
+				Version:  "v1",
+				Resource: "network-attachment-definitions",
+			}
+
+			clientset := fake.NewSimpleClientset(givenVM, givenIPPool)
+			err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+			handler := Handler{
+				cacheAllocator: newTestCacheAllocatorBuilder().
+					MACSet(testNetworkName).Build(),
+				ipAllocator: newTestIPAllocatorBuilder().
+					IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+				metricsAllocator: metrics.New(),
+				denialLog:        audit.NewDenialLog(clock.RealClock{}, audit.DefaultDenialLogSize),
+				clock:            clock.RealClock{},
+				pending:          newPendingIndex(clock.RealClock{}),
+				ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+				ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+				nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+				vmCache:          fakeclient.VirtualMachineCache(clientset.KubevirtV1().VirtualMachines),
+			}
+
+			status, err := handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+
+			ipPool, getErr := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+			assert.Nil(t, getErr)
+
+			if tc.expectedErr == "" {
+				assert.Nil(t, err)
+				if assert.Len(t, status.NetworkConfigs, 1) {
+					assert.Equal(t, networkv1.AllocatedState, status.NetworkConfigs[0].State)
+				}
+				assert.Nil(t, ipPool.Status.PendingAllocations)
+				assert.Empty(t, handler.denialLog.List(testIPPoolNamespace+"/"+testIPPoolName))
+				return
+			}
+
+			if assert.NotNil(t, err) {
+				assert.Equal(t, tc.expectedErr, err.Error())
+			}
+			assert.Empty(t, status.NetworkConfigs)
+			if assert.NotNil(t, ipPool.Status.PendingAllocations) {
+				assert.Equal(t, map[networkv1.PendingReason]int{
+					networkv1.PendingReasonAnnotationMismatch: 1,
+				}, ipPool.Status.PendingAllocations.Reasons)
+			}
+			denials := handler.denialLog.List(testIPPoolNamespace + "/" + testIPPoolName)
+			if assert.Len(t, denials, 1) {
+				assert.Equal(t, audit.DenialReasonAnnotationMismatch, denials[0].Reason)
+			}
+			used, err := handler.ipAllocator.GetUsed(testNetworkName)
+			assert.Nil(t, err)
+			assert.Equal(t, 0, used, "no ip should be allocated")
+		})
+	}
+}
+
+func TestHandler_PoolRebound(t *testing.T) {
+	const (
+		newIPPoolName = "pool-2"
+		newCIDR       = "192.168.1.0/24"
+		// A single address makes the one allocated predictable
+		newStartIP = "192.168.1.101"
+		newEndIP   = "192.168.1.101"
+	)
+	oldIPPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+	newIPPoolKey := testIPPoolNamespace + "/" + newIPPoolName
+
+	testCases := []struct {
+		name                   string
+		autoRebind             bool
+		pinned                 bool
+		expectedIPAddress      string
+		expectedIPPoolRef      string
+		expectedOldLeases      map[string]string
+		expectedNewLeases      map[string]string
+		expectedInSyncedReason string
+		expectedEvents         []string
+	}{
+		{
+			name:                   "nad opted in to rebinding",
+			autoRebind:             true,
+			expectedIPAddress:      newStartIP,
+			expectedIPPoolRef:      newIPPoolKey,
+			expectedOldLeases:      map[string]string{},
+			expectedNewLeases:      map[string]string{newStartIP: testMACAddress1},
+			expectedInSyncedReason: ReasonPoolRebound,
+		},
+		{
+			name:              "nad re-pointed temporarily",
+			expectedIPAddress: testIPAddress1,
+			expectedIPPoolRef: oldIPPoolKey,
+			expectedOldLeases: map[string]string{testIPAddress1: testMACAddress1},
+			expectedNewLeases: map[string]string{},
+		},
+		{
+			name:              "pinned vmnetcfg on a nad opted in to rebinding",
+			autoRebind:        true,
+			pinned:            true,
+			expectedIPAddress: testIPAddress1,
+			expectedIPPoolRef: oldIPPoolKey,
+			expectedOldLeases: map[string]string{testIPAddress1: testMACAddress1},
+			expectedNewLeases: map[string]string{},
+			expectedEvents: []string{
+				"Warning PinnedLeases Pinned vmnetcfgs keep the IP addresses of the former ippool: " + testVmNetCfgNamespace + "/" + testVmNetCfgName,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			givenVmNetCfgBuilder := newTestVmNetCfgBuilder().
+				WithNetworkConfig("", testMACAddress1, testNetworkName).
+				WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+				IPPoolRef(oldIPPoolKey)
+			if tc.pinned {
+				givenVmNetCfgBuilder.Annotation(util.PinLeaseAnnotationKey, "true")
+			}
+			givenVmNetCfg := givenVmNetCfgBuilder.Build()
+			givenOldIPPool := newTestIPPoolBuilder().
+				ServerIP(testServerIP).
+				CIDR(testCIDR).
+				PoolRange(testStartIP, testEndIP).
+				NetworkName(testNetworkName).
+				Allocated(testIPAddress1, testMACAddress1).
+				CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+			givenNewIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, newIPPoolName).
+				ServerIP("192.168.1.2").
+				CIDR(newCIDR).
+				PoolRange(newStartIP, newEndIP).
+				NetworkName(testNetworkName).
+				CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+			givenNADBuilder := newTestNetworkAttachmentDefinitionBuilder().
+				Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+				Label(util.IPPoolNameLabelKey, newIPPoolName)
+			if tc.autoRebind {
+				givenNADBuilder.Annotation(util.AutoRebindAnnotationKey, "true")
+			}
+			givenNAD := givenNADBuilder.Build()
+
+			nadGVR := schema.GroupVersionResource{
+				Group:    "k8s.cni.cncf.io",
+				Version:  "v1",
+				Resource: "network-attachment-definitions",
+			}
+
+			clientset := fake.NewSimpleClientset(givenVmNetCfg, givenOldIPPool, givenNewIPPool)
+			err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+			recorder := record.NewFakeRecorder(10)
+
+			// Both IPPools are on the same network, so the IPAM subnet and MAC
+			// cache are the ones rebuilt for the new IPPool
+			handler := Handler{
+				cacheAllocator: newTestCacheAllocatorBuilder().
+					MACSet(testNetworkName).Build(),
+				ipAllocator: newTestIPAllocatorBuilder().
+					IPSubnet(testNetworkName, newCIDR, newStartIP, newEndIP).Build(),
+				metricsAllocator: metrics.New(),
+				clock:            clock.RealClock{},
+				recorder:         recorder,
+				pending:          newPendingIndex(clock.RealClock{}),
+				vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+				vmnetcfgCache:    fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+				ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+				ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+				nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			}
+
+			_, err = handler.OnNADChange(testNetworkName, givenNAD)
+			assert.Nil(t, err)
+
+			var events []string
+			for len(recorder.Events) > 0 {
+				events = append(events, <-recorder.Events)
+			}
+			assert.Equal(t, tc.expectedEvents, events)
+
+			vmNetCfg, err := handler.vmnetcfgClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+			assert.Nil(t, err)
+			if tc.expectedInSyncedReason != "" {
+				assert.True(t, networkv1.InSynced.IsFalse(vmNetCfg), "vmnetcfg should be marked out-of-sync")
+				assert.Equal(t, tc.expectedInSyncedReason, networkv1.InSynced.GetReason(vmNetCfg))
+			} else {
+				assert.Equal(t, givenVmNetCfg, vmNetCfg, "vmnetcfg should be left alone")
+			}
+
+			status, err := handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+			assert.Nil(t, err)
+			if assert.Len(t, status.NetworkConfigs, 1) {
+				assert.Equal(t, tc.expectedIPAddress, status.NetworkConfigs[0].AllocatedIPAddress)
+				assert.Equal(t, tc.expectedIPPoolRef, status.NetworkConfigs[0].IPPoolRef)
+				assert.Equal(t, networkv1.AllocatedState, status.NetworkConfigs[0].State)
+			}
+
+			oldIPPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectedOldLeases, util.Leases(oldIPPool.Status.IPv4))
+
+			newIPPool, err := handler.ippoolClient.Get(testIPPoolNamespace, newIPPoolName, metav1.GetOptions{})
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectedNewLeases, util.Leases(newIPPool.Status.IPv4))
+		})
+	}
+}
+
+func TestHandler_DuplicateMACAddresses(t *testing.T) {
+	const (
+		otherNADName    = "net-2"
+		otherIPPoolName = "pool-2"
+		otherCIDR       = "192.168.1.0/24"
+		otherStartIP    = "192.168.1.101"
+		otherEndIP      = "192.168.1.200"
+		otherIPAddress  = "192.168.1.111"
+	)
+	otherNetworkName := testNADNamespace + "/" + otherNADName
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+	otherIPPoolKey := testIPPoolNamespace + "/" + otherIPPoolName
+
+	// A vmnetcfg from before the webhook rejected duplicates, with the MAC
+	// address granted an IP address on both networks
+	newGivenVmNetCfg := func() *networkv1.VirtualMachineNetworkConfig {
+		return newTestVmNetCfgBuilder().
+			WithNetworkConfig("", testMACAddress1, testNetworkName).
+			WithNetworkConfig("", testMACAddress1, otherNetworkName).
+			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+			IPPoolRef(ipPoolKey).
+			WithNetworkConfigStatus(otherIPAddress, testMACAddress1, otherNetworkName, networkv1.AllocatedState).
+			IPPoolRef(otherIPPoolKey).Build()
+	}
+
+	newHandler := func(t *testing.T, givenVmNetCfg *networkv1.VirtualMachineNetworkConfig) *Handler {
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			Allocated(testIPAddress1, testMACAddress1).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenOtherIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, otherIPPoolName).
+			ServerIP("192.168.1.2").
+			CIDR(otherCIDR).
+			PoolRange(otherStartIP, otherEndIP).
+			NetworkName(otherNetworkName).
+			Allocated(otherIPAddress, testMACAddress1).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+		givenOtherNAD := ippool.NewNetworkAttachmentDefinitionBuilder(testNADNamespace, otherNADName).
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, otherIPPoolName).Build()
+
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset(givenVmNetCfg, givenIPPool, givenOtherIPPool)
+		for _, nad := range []*cniv1.NetworkAttachmentDefinition{givenNAD, givenOtherNAD} {
+			err := clientset.Tracker().Create(nadGVR, nad, nad.Namespace)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		}
+
+		return &Handler{
+			cacheAllocator: newTestCacheAllocatorBuilder().
+				MACSet(testNetworkName).
+				Add(testNetworkName, testMACAddress1, testIPAddress1).
+				MACSet(otherNetworkName).
+				Add(otherNetworkName, testMACAddress1, otherIPAddress).Build(),
+			ipAllocator: newTestIPAllocatorBuilder().
+				IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+				Allocate(testNetworkName, testIPAddress1).
+				IPSubnet(otherNetworkName, otherCIDR, otherStartIP, otherEndIP).
+				Allocate(otherNetworkName, otherIPAddress).Build(),
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
+			vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}
+	}
+
+	t.Run("allocation waits for the repair", func(t *testing.T) {
+		givenVmNetCfg := newGivenVmNetCfg()
+		handler := newHandler(t, givenVmNetCfg)
+
+		status, err := handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+		assert.NotNil(t, err)
+		assert.Equal(t, givenVmNetCfg.Status, status, "status should be left for the repair")
+	})
+
+	t.Run("repair of a pre-existing duplicate", func(t *testing.T) {
+		givenVmNetCfg := newGivenVmNetCfg()
+		handler := newHandler(t, givenVmNetCfg)
+		recorder := record.NewFakeRecorder(10)
+		handler.recorder = recorder
+
+		vmNetCfg, err := handler.OnChange(testKey, givenVmNetCfg)
+		assert.Nil(t, err)
+
+		assert.Equal(t, []networkv1.NetworkConfig{
+			{MACAddress: testMACAddress1, NetworkName: testNetworkName},
+		}, vmNetCfg.Spec.NetworkConfigs, "only the first network config of the mac address should be kept")
+		if assert.Len(t, vmNetCfg.Status.NetworkConfigs, 1) {
+			assert.Equal(t, testIPAddress1, vmNetCfg.Status.NetworkConfigs[0].AllocatedIPAddress)
+			assert.Equal(t, ipPoolKey, vmNetCfg.Status.NetworkConfigs[0].IPPoolRef)
+		}
+		assert.True(t, networkv1.Repaired.IsTrue(vmNetCfg))
+		assert.Equal(t, ReasonDuplicateMACAddress, networkv1.Repaired.GetReason(vmNetCfg))
+		assert.Equal(t, "Dropped network configs repeating a MAC address: "+testMACAddress1+" on "+otherNetworkName,
+			networkv1.Repaired.GetMessage(vmNetCfg))
+		if assert.Len(t, recorder.Events, 1) {
+			assert.Equal(t, fmt.Sprintf("Warning %s Dropped network config repeating mac address %s on network %s",
+				ReasonDuplicateMACAddress, testMACAddress1, otherNetworkName), <-recorder.Events)
+		}
+
+		isAllocated, err := handler.ipAllocator.IsAllocated(testNetworkName, testIPAddress1)
+		assert.Nil(t, err)
+		assert.True(t, isAllocated, "ip address of the kept network config should stay allocated")
+		isAllocated, err = handler.ipAllocator.IsAllocated(otherNetworkName, otherIPAddress)
+		assert.Nil(t, err)
+		assert.False(t, isAllocated, "ip address of the dropped network config should be released")
+
+		ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{testIPAddress1: testMACAddress1}, util.Leases(ipPool.Status.IPv4))
+		otherIPPool, err := handler.ippoolClient.Get(testIPPoolNamespace, otherIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{}, util.Leases(otherIPPool.Status.IPv4))
+
+		status, err := handler.Allocate(vmNetCfg, vmNetCfg.Status)
+		assert.Nil(t, err)
+		if assert.Len(t, status.NetworkConfigs, 1) {
+			assert.Equal(t, testIPAddress1, status.NetworkConfigs[0].AllocatedIPAddress)
+		}
+	})
+}
+
+// indexedVmNetCfgCache serves the indexes the controller adds to the vmnetcfg
+// cache.
+type indexedVmNetCfgCache struct {
+	fakeclient.VirtualMachineNetworkConfigCache
+}
+
+var testVmNetCfgIndexers = map[string]func(*networkv1.VirtualMachineNetworkConfig) ([]string, error){
+	indexer.VmNetCfgByMACIndex:              util.VmNetCfgByMAC,
+	indexer.VmNetCfgByQualifiedNetworkIndex: util.VmNetCfgByQualifiedNetwork,
+}
+
+func (c indexedVmNetCfgCache) GetByIndex(indexName, key string) ([]*networkv1.VirtualMachineNetworkConfig, error) {
+	indexFunc, ok := testVmNetCfgIndexers[indexName]
+	if !ok {
+		return c.VirtualMachineNetworkConfigCache.GetByIndex(indexName, key)
+	}
+
+	vmNetCfgs, err := c.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var result []*networkv1.VirtualMachineNetworkConfig
+	for _, vmNetCfg := range vmNetCfgs {
+		values, _ := indexFunc(vmNetCfg)
+		for _, value := range values {
+			if value == key {
+				result = append(result, vmNetCfg)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func TestHandler_AmbiguousNetwork(t *testing.T) {
+	const (
+		tenantNamespace = "tenant"
+		tenantIPAddress = "192.168.1.111"
+	)
+
+	// vlan100 of the tenant and of the global namespace point to different
+	// ippools, while vlan200 of both point to the same one
+	givenNADs := []*cniv1.NetworkAttachmentDefinition{
+		ippool.NewNetworkAttachmentDefinitionBuilder(util.GlobalNetworkNamespace, "vlan100").
+			Label(util.IPPoolNamespaceLabelKey, util.GlobalNetworkNamespace).
+			Label(util.IPPoolNameLabelKey, "pool-100").Build(),
+		ippool.NewNetworkAttachmentDefinitionBuilder(tenantNamespace, "vlan100").
+			Label(util.IPPoolNamespaceLabelKey, tenantNamespace).
+			Label(util.IPPoolNameLabelKey, "tenant-100").Build(),
+		ippool.NewNetworkAttachmentDefinitionBuilder(util.GlobalNetworkNamespace, "vlan200").
+			Label(util.IPPoolNamespaceLabelKey, util.GlobalNetworkNamespace).
+			Label(util.IPPoolNameLabelKey, "pool-200").Build(),
+		ippool.NewNetworkAttachmentDefinitionBuilder(tenantNamespace, "vlan200").
+			Label(util.IPPoolNamespaceLabelKey, util.GlobalNetworkNamespace).
+			Label(util.IPPoolNameLabelKey, "pool-200").Build(),
+	}
+	givenIPPools := []runtime.Object{
+		ippool.NewIPPoolBuilder(util.GlobalNetworkNamespace, "pool-100").NetworkName("default/vlan100").Build(),
+		ippool.NewIPPoolBuilder(tenantNamespace, "tenant-100").NetworkName("tenant/vlan100").Build(),
+		ippool.NewIPPoolBuilder(util.GlobalNetworkNamespace, "pool-200").NetworkName("default/vlan200").Build(),
+	}
+	givenVmNetCfg := NewVmNetCfgBuilder(tenantNamespace, testVmNetCfgName).
+		WithNetworkConfig("", testMACAddress1, "vlan100").
+		WithNetworkConfig("", testMACAddress2, "vlan200").
+		WithNetworkConfigStatus(tenantIPAddress, testMACAddress1, "vlan100", networkv1.AllocatedState).
+		IPPoolRef("tenant/tenant-100").Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(append(givenIPPools, givenVmNetCfg)...)
+	for _, nad := range givenNADs {
+		err := clientset.Tracker().Create(nadGVR, nad, nad.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+	}
+
+	handler := Handler{
+		pending:        newPendingIndex(clock.RealClock{}),
+		vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		ippoolCache:    fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:       fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	// The ambiguous network config is left pending with the candidates named,
+	// while the IP address it was allocated is kept
+	vmNetCfg, err := handler.OnChange(tenantNamespace+"/"+testVmNetCfgName, givenVmNetCfg)
+	assert.Nil(t, err)
+	if assert.Len(t, vmNetCfg.Status.NetworkConfigs, 1) {
+		ncStatus := vmNetCfg.Status.NetworkConfigs[0]
+		assert.Equal(t, tenantIPAddress, ncStatus.AllocatedIPAddress)
+		assert.Equal(t, networkv1.PendingState, ncStatus.State)
+		assert.Equal(t, ReasonAmbiguousNetwork, ncStatus.Reason)
+		assert.Contains(t, ncStatus.Message, "tenant/vlan100 (ippool tenant/tenant-100) and default/vlan100 (ippool default/pool-100)")
+	}
+
+	status, err := handler.Allocate(vmNetCfg, vmNetCfg.Status)
+	assert.ErrorIs(t, err, util.ErrAmbiguousNetwork)
+	assert.Equal(t, vmNetCfg.Status, status, "status should be left as reported")
+
+	// The network config is taken over again once the network is unambiguous
+	err = clientset.Tracker().Delete(nadGVR, util.GlobalNetworkNamespace, "vlan100")
+	assert.Nil(t, err)
+
+	vmNetCfg, err = handler.OnChange(tenantNamespace+"/"+testVmNetCfgName, vmNetCfg)
+	assert.Nil(t, err)
+	if assert.Len(t, vmNetCfg.Status.NetworkConfigs, 1) {
+		assert.Empty(t, vmNetCfg.Status.NetworkConfigs[0].Reason)
+		assert.Empty(t, vmNetCfg.Status.NetworkConfigs[0].Message)
+	}
+}
+
+func TestHandler_StaticIPInUse(t *testing.T) {
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+
+	givenVmNetCfgA := NewVmNetCfgBuilder(testVmNetCfgNamespace, "vm-a").
+		WithVMName("vm-a").
+		WithNetworkConfig(testIPAddress1, testMACAddress1, testNetworkName).Build()
+	givenVmNetCfgB := NewVmNetCfgBuilder(testVmNetCfgNamespace, "vm-b").
+		WithVMName("vm-b").
+		WithNetworkConfig(testIPAddress1, testMACAddress2, testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfgA, givenVmNetCfgB, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	recorder := record.NewFakeRecorder(10)
+
+	handler := Handler{
+		cacheAllocator: newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).Build(),
+		ipAllocator: newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+		metricsAllocator: metrics.NewMetricsAllocator(fakeClock),
+		denialLog:        audit.NewDenialLog(fakeClock, audit.DefaultDenialLogSize),
+		clock:            fakeClock,
+		recorder:         recorder,
+		pending:          newPendingIndex(fakeClock),
+		vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		vmnetcfgCache: indexedVmNetCfgCache{
+			VirtualMachineNetworkConfigCache: fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		},
+		ippoolClient: fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:  fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:     fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	allocate := func(vmNetCfg *networkv1.VirtualMachineNetworkConfig) (*networkv1.VirtualMachineNetworkConfig, error) {
+		status, err := handler.Allocate(vmNetCfg, vmNetCfg.Status)
+		if err != nil {
+			return vmNetCfg, err
+		}
+		vmNetCfgCpy := vmNetCfg.DeepCopy()
+		vmNetCfgCpy.Status = status
+		return handler.vmnetcfgClient.UpdateStatus(vmNetCfgCpy)
+	}
+
+	vmNetCfgA, err := allocate(givenVmNetCfgA)
+	assert.Nil(t, err, "vm-a should get the static ip address while it's free")
+
+	// vm-b requests the static IP address while vm-a holds it
+	_, err = allocate(givenVmNetCfgB)
+	if assert.NotNil(t, err) {
+		assert.True(t, errors.Is(err, ipam.ErrAlreadyAllocated))
+		assert.Equal(t, fmt.Sprintf("static ip %s of ippool %s is in use by mac %s of vmnetcfg %s/vm-a",
+			testIPAddress1, ipPoolKey, testMACAddress1, testVmNetCfgNamespace), err.Error())
+	}
+	if assert.Len(t, recorder.Events, 1) {
+		assert.Equal(t, fmt.Sprintf("%s %s %s", corev1.EventTypeWarning, ReasonStaticIPInUse, err), <-recorder.Events)
+	}
+	assert.Equal(t, map[networkv1.PendingReason]int{networkv1.PendingReasonStaticIPInUse: 1}, handler.pending.Stats(ipPoolKey).Reasons)
+
+	// Once vm-a is gone the static IP address is free again
+	_, err = handler.OnRemove(testVmNetCfgNamespace+"/vm-a", vmNetCfgA)
+	assert.Nil(t, err)
+
+	vmNetCfgB, err := allocate(givenVmNetCfgB)
+	if assert.Nil(t, err, "vm-b should get the static ip address released by vm-a") {
+		assert.Equal(t, testIPAddress1, vmNetCfgB.Status.NetworkConfigs[0].AllocatedIPAddress)
+	}
+	assert.Nil(t, handler.pending.Stats(ipPoolKey), "vm-b should no longer be pending")
+}
+
+func TestHandler_HoldBack(t *testing.T) {
+	// The pool range has a single address left besides the held-back one
+	const heldBackIPAddress = "192.168.0.102"
+
+	givenVmNetCfgA := NewVmNetCfgBuilder(testVmNetCfgNamespace, "vm-a").
+		WithVMName("vm-a").
+		WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+	givenVmNetCfgB := NewVmNetCfgBuilder(testVmNetCfgNamespace, "vm-b").
+		WithVMName("vm-b").
+		WithNetworkConfig("", testMACAddress2, testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, heldBackIPAddress).
+		HoldBack(heldBackIPAddress, heldBackIPAddress).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfgA, givenVmNetCfgB, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	recorder := record.NewFakeRecorder(1)
+	handler := Handler{
+		cacheAllocator: newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).Build(),
+		ipAllocator: newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, heldBackIPAddress).
+			HoldBack(testNetworkName, heldBackIPAddress, heldBackIPAddress).Build(),
+		metricsAllocator: metrics.New(),
+		recorder:         recorder,
+		clock:            clock.RealClock{},
+		pending:          newPendingIndex(clock.RealClock{}),
+		ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	// The held-back address is avoided while another one is left
+	status, err := handler.Allocate(givenVmNetCfgA, givenVmNetCfgA.Status)
+	if assert.Nil(t, err) && assert.Len(t, status.NetworkConfigs, 1) {
+		assert.Equal(t, testStartIP, status.NetworkConfigs[0].AllocatedIPAddress)
+	}
+	assert.Empty(t, recorder.Events)
+
+	// and only handed out once the rest is exhausted, with a warning
+	status, err = handler.Allocate(givenVmNetCfgB, givenVmNetCfgB.Status)
+	if assert.Nil(t, err) && assert.Len(t, status.NetworkConfigs, 1) {
+		assert.Equal(t, heldBackIPAddress, status.NetworkConfigs[0].AllocatedIPAddress)
+	}
+	if assert.Len(t, recorder.Events, 1) {
+		assert.Equal(t, fmt.Sprintf("Warning %s allocated held-back ip %s to %s as the rest of the pool is exhausted",
+			ReasonHeldBackIP, heldBackIPAddress, testMACAddress2), <-recorder.Events)
+	}
+}
+
+func TestHandler_Reservations(t *testing.T) {
+	// Reserved out of the pool range, so only the reservation can hand it out
+	const reservedIPAddress = "192.168.0.50"
+
+	givenVmNetCfgA := NewVmNetCfgBuilder(testVmNetCfgNamespace, "vm-a").
+		WithVMName("vm-a").
+		WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+	givenVmNetCfgB := NewVmNetCfgBuilder(testVmNetCfgNamespace, "vm-b").
+		WithVMName("vm-b").
+		WithNetworkConfig(reservedIPAddress, testMACAddress2, testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		Reservation(testMACAddress1, reservedIPAddress).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfgA, givenVmNetCfgB, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	handler := Handler{
+		cacheAllocator: newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).Build(),
+		ipAllocator: newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Reserve(testNetworkName, reservedIPAddress).Build(),
+		metricsAllocator: metrics.NewMetricsAllocator(fakeClock),
+		denialLog:        audit.NewDenialLog(fakeClock, audit.DefaultDenialLogSize),
+		clock:            fakeClock,
+		recorder:         record.NewFakeRecorder(10),
+		pending:          newPendingIndex(fakeClock),
+		vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		vmnetcfgCache: indexedVmNetCfgCache{
+			VirtualMachineNetworkConfigCache: fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		},
+		ippoolClient: fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:  fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:     fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	// vm-b requests the IP address reserved for the MAC address of vm-a,
+	// which is denied even though it's still free
+	_, err = handler.Allocate(givenVmNetCfgB, givenVmNetCfgB.Status)
+	if assert.NotNil(t, err) {
+		assert.True(t, errors.Is(err, ipam.ErrAlreadyAllocated))
+		assert.Contains(t, err.Error(), fmt.Sprintf("designated ip %s is reserved for mac %s", reservedIPAddress, testMACAddress1))
+	}
+
+	// vm-a doesn't request any IP address, so it gets the reserved one
+	status, err := handler.Allocate(givenVmNetCfgA, givenVmNetCfgA.Status)
+	if assert.Nil(t, err) && assert.Len(t, status.NetworkConfigs, 1) {
+		assert.Equal(t, reservedIPAddress, status.NetworkConfigs[0].AllocatedIPAddress)
+	}
+}
+
+func TestHandler_MACAddressForms(t *testing.T) {
+	givenVmNetCfg := newTestVmNetCfgBuilder().
+		WithNetworkConfig(testIPAddress1, "11-22-33-44-55-66", testNetworkName).Build()
+	givenInvalidVmNetCfg := NewVmNetCfgBuilder(testVmNetCfgNamespace, "vm-invalid").
+		WithNetworkConfig("", "11:22:33:44:55", testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfg, givenInvalidVmNetCfg, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	handler := Handler{
+		cacheAllocator: newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).Build(),
+		ipAllocator: newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+		metricsAllocator: metrics.New(),
+		clock:            clock.RealClock{},
+		pending:          newPendingIndex(clock.RealClock{}),
+		ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	// The MAC address is recorded in the form the agents key their leases by
+	status, err := handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+	if assert.Nil(t, err) && assert.Len(t, status.NetworkConfigs, 1) {
+		assert.Equal(t, testMACAddress1, status.NetworkConfigs[0].MACAddress)
+		assert.Equal(t, testIPAddress1, status.NetworkConfigs[0].AllocatedIPAddress)
+	}
+	ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, map[string]string{testIPAddress1: testMACAddress1}, util.Leases(ipPool.Status.IPv4))
+	}
+	ip, err := handler.cacheAllocator.GetIPByMAC(testNetworkName, "11:22:33:44:55:66")
+	assert.Nil(t, err)
+	assert.Equal(t, testIPAddress1, ip)
+
+	// Allocating again with the status recorded is a no-op
+	vmNetCfg := givenVmNetCfg.DeepCopy()
+	vmNetCfg.Status = status
+	status, err = handler.Allocate(vmNetCfg, vmNetCfg.Status)
+	if assert.Nil(t, err) && assert.Len(t, status.NetworkConfigs, 1) {
+		assert.Equal(t, testIPAddress1, status.NetworkConfigs[0].AllocatedIPAddress)
+	}
+
+	_, err = handler.Allocate(givenInvalidVmNetCfg, givenInvalidVmNetCfg.Status)
+	assert.EqualError(t, err, fmt.Sprintf(`vmnetcfg %s/vm-invalid: mac address "11:22:33:44:55" is not valid`, testVmNetCfgNamespace))
+}
+
+func TestHandler_ConflictedIP(t *testing.T) {
+	givenVmNetCfg := NewVmNetCfgBuilder(testVmNetCfgNamespace, testVmNetCfgName).
+		WithVMName(testVmNetCfgName).
+		WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfg, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	recorder := record.NewFakeRecorder(10)
+	ipAllocator := newTestIPAllocatorBuilder().
+		IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build()
+
+	handler := Handler{
+		cacheAllocator: newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).Build(),
+		ipAllocator:      ipAllocator,
+		metricsAllocator: metrics.NewMetricsAllocator(fakeClock),
+		denialLog:        audit.NewDenialLog(fakeClock, audit.DefaultDenialLogSize),
+		clock:            fakeClock,
+		recorder:         recorder,
+		pending:          newPendingIndex(fakeClock),
+		vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		vmnetcfgCache: indexedVmNetCfgCache{
+			VirtualMachineNetworkConfigCache: fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		},
+		ippoolClient: fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:  fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:     fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	allocate := func(vmNetCfg *networkv1.VirtualMachineNetworkConfig) (*networkv1.VirtualMachineNetworkConfig, error) {
+		status, err := handler.Allocate(vmNetCfg, vmNetCfg.Status)
+		if err != nil {
+			return vmNetCfg, err
+		}
+		vmNetCfgCpy := vmNetCfg.DeepCopy()
+		vmNetCfgCpy.Status = status
+		return handler.vmnetcfgClient.UpdateStatus(vmNetCfgCpy)
+	}
+
+	vmNetCfg, err := allocate(givenVmNetCfg)
+	if !assert.Nil(t, err) {
+		return
+	}
+	declinedIP := vmNetCfg.Status.NetworkConfigs[0].AllocatedIPAddress
+
+	// The guest declines its IP address, which the ippool controller
+	// quarantines
+	ipPool, err := handler.ippoolCache.Get(testIPPoolNamespace, testIPPoolName)
+	assert.Nil(t, err)
+	ipPoolCpy := ipPool.DeepCopy()
+	ipPoolCpy.Status.IPv4.Conflicts = map[string]networkv1.IPConflict{
+		declinedIP: {
+			MACAddress: testMACAddress1,
+			DeclinedAt: metav1.NewTime(fakeClock.Now()),
+			Until:      metav1.NewTime(fakeClock.Now().Add(time.Hour)),
+		},
+	}
+	_, err = handler.ippoolClient.UpdateStatus(ipPoolCpy)
+	assert.Nil(t, err)
+
+	keys, err := handler.vmNetCfgsOfConflicts(ipPoolCpy)
+	assert.Nil(t, err)
+	assert.Equal(t, []relatedresource.Key{{Namespace: testVmNetCfgNamespace, Name: testVmNetCfgName}}, keys)
+
+	vmNetCfg, err = allocate(vmNetCfg)
+	if !assert.Nil(t, err) {
+		return
+	}
+	newIP := vmNetCfg.Status.NetworkConfigs[0].AllocatedIPAddress
+	assert.NotEqual(t, declinedIP, newIP, "declined ip should be given up for a new one")
+
+	_, err = ipAllocator.IsAllocated(testNetworkName, declinedIP)
+	assert.NotNil(t, err, "declined ip should stay revoked while quarantined")
+
+	ipPool, err = handler.ippoolCache.Get(testIPPoolNamespace, testIPPoolName)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{newIP: testMACAddress1}, util.Leases(ipPool.Status.IPv4))
+	assert.Contains(t, ipPool.Status.IPv4.Conflicts, declinedIP)
+	if assert.Len(t, recorder.Events, 1) {
+		assert.Equal(t, fmt.Sprintf("%s %s Released ip %s of %s as the guest declined it as already in use",
+			corev1.EventTypeWarning, ReasonConflictedIPReleased, declinedIP, testMACAddress1), <-recorder.Events)
+	}
+
+	keys, err = handler.vmNetCfgsOfConflicts(ipPool)
+	assert.Nil(t, err)
+	assert.Empty(t, keys, "vmnetcfg moved to a new ip should no longer be enqueued")
+}
+
+func TestHandler_OverflowChain(t *testing.T) {
+	const (
+		overflowIPPoolName1 = "pool-1-overflow-1"
+		overflowIPPoolName2 = "pool-1-overflow-2"
+		// A single address per IPPool makes each of them exhausted in turn
+		overflowIPAddress1 = "192.168.0.102"
+		overflowIPAddress2 = "192.168.0.103"
+	)
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+	overflowIPPoolKey1 := testIPPoolNamespace + "/" + overflowIPPoolName1
+	overflowIPPoolKey2 := testIPPoolNamespace + "/" + overflowIPPoolName2
+
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testStartIP).
+		NetworkName(testNetworkName).
+		OverflowPool(overflowIPPoolKey1).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenOverflowIPPool1 := ippool.NewIPPoolBuilder(testIPPoolNamespace, overflowIPPoolName1).
+		Annotation(util.DelegatedFromAnnotationKey, ipPoolKey).
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(overflowIPAddress1, overflowIPAddress1).
+		NetworkName(testNetworkName).
+		OverflowPool(overflowIPPoolKey2).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenOverflowIPPool2 := ippool.NewIPPoolBuilder(testIPPoolNamespace, overflowIPPoolName2).
+		Annotation(util.DelegatedFromAnnotationKey, overflowIPPoolKey1).
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(overflowIPAddress2, overflowIPAddress2).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	var givenVmNetCfgs []*networkv1.VirtualMachineNetworkConfig
+	for i, macAddress := range []string{testMACAddress1, testMACAddress2, testMACAddress3, testMACAddress4} {
+		name := fmt.Sprintf("vm-%d", i+1)
+		givenVmNetCfgs = append(givenVmNetCfgs, NewVmNetCfgBuilder(testVmNetCfgNamespace, name).
+			WithVMName(name).
+			WithNetworkConfig("", macAddress, testNetworkName).Build())
+	}
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenIPPool, givenOverflowIPPool1, givenOverflowIPPool2)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+	for _, vmNetCfg := range givenVmNetCfgs {
+		err := clientset.Tracker().Add(vmNetCfg)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+	}
+
+	fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	handler := Handler{
+		cacheAllocator: newTestCacheAllocatorBuilder().
+			MACSet(util.IPAMName(givenIPPool)).
+			MACSet(util.IPAMName(givenOverflowIPPool1)).
+			MACSet(util.IPAMName(givenOverflowIPPool2)).Build(),
+		ipAllocator: newTestIPAllocatorBuilder().
+			IPSubnet(util.IPAMName(givenIPPool), testCIDR, testStartIP, testStartIP).
+			IPSubnet(util.IPAMName(givenOverflowIPPool1), testCIDR, overflowIPAddress1, overflowIPAddress1).
+			IPSubnet(util.IPAMName(givenOverflowIPPool2), testCIDR, overflowIPAddress2, overflowIPAddress2).Build(),
+		metricsAllocator: metrics.NewMetricsAllocator(fakeClock),
+		denialLog:        audit.NewDenialLog(fakeClock, audit.DefaultDenialLogSize),
+		clock:            fakeClock,
+		pending:          newPendingIndex(fakeClock),
+		vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		vmnetcfgCache:    fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	allocate := func(vmNetCfg *networkv1.VirtualMachineNetworkConfig) (*networkv1.VirtualMachineNetworkConfig, error) {
+		status, err := handler.Allocate(vmNetCfg, vmNetCfg.Status)
+		if err != nil {
+			return vmNetCfg, err
+		}
+		vmNetCfgCpy := vmNetCfg.DeepCopy()
+		vmNetCfgCpy.Status = status
+		return handler.vmnetcfgClient.UpdateStatus(vmNetCfgCpy)
+	}
+
+	expected := []struct {
+		ipAddress string
+		ipPoolRef string
+	}{
+		{testStartIP, ipPoolKey},
+		{overflowIPAddress1, overflowIPPoolKey1},
+		{overflowIPAddress2, overflowIPPoolKey2},
+	}
+	var vmNetCfgs []*networkv1.VirtualMachineNetworkConfig
+	for i, e := range expected {
+		vmNetCfg, err := allocate(givenVmNetCfgs[i])
+		if assert.Nil(t, err) && assert.Len(t, vmNetCfg.Status.NetworkConfigs, 1) {
+			assert.Equal(t, e.ipAddress, vmNetCfg.Status.NetworkConfigs[0].AllocatedIPAddress)
+			assert.Equal(t, e.ipPoolRef, vmNetCfg.Status.NetworkConfigs[0].IPPoolRef, "ippool serving %s", vmNetCfg.Name)
+		}
+		vmNetCfgs = append(vmNetCfgs, vmNetCfg)
+	}
+
+	// Allocating again keeps the IP address with the overflow IPPool
+	status, err := handler.Allocate(vmNetCfgs[2], vmNetCfgs[2].Status)
+	if assert.Nil(t, err) && assert.Len(t, status.NetworkConfigs, 1) {
+		assert.Equal(t, overflowIPAddress2, status.NetworkConfigs[0].AllocatedIPAddress)
+		assert.Equal(t, overflowIPPoolKey2, status.NetworkConfigs[0].IPPoolRef)
+	}
+
+	// The whole chain is exhausted, which is told by the primary IPPool
+	_, err = allocate(givenVmNetCfgs[3])
+	assert.ErrorIs(t, err, ipam.ErrExhausted)
+	assert.Equal(t, map[networkv1.PendingReason]int{networkv1.PendingReasonPoolExhausted: 1}, handler.pending.Stats(ipPoolKey).Reasons)
+
+	body := scrapeMetrics(handler.metricsAllocator)
+	for _, overflowIPPoolKey := range []string{overflowIPPoolKey1, overflowIPPoolKey2} {
+		assert.Contains(t, body, fmt.Sprintf("%s{ippool=%q,overflow=%q} 1", metrics.IPPoolOverflowAllocationsMetricName, ipPoolKey, overflowIPPoolKey))
+	}
+
+	for _, ipPoolKey := range []string{ipPoolKey, overflowIPPoolKey1, overflowIPPoolKey2} {
+		ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, strings.TrimPrefix(ipPoolKey, testIPPoolNamespace+"/"), metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Len(t, util.Leases(ipPool.Status.IPv4), 1, "ippool %s should hold a single lease", ipPoolKey)
+	}
+
+	// The IP address goes back to the overflow IPPool it came from
+	_, err = handler.OnRemove(testVmNetCfgNamespace+"/vm-3", vmNetCfgs[2])
+	assert.Nil(t, err)
+
+	overflowIPPool2, err := handler.ippoolClient.Get(testIPPoolNamespace, overflowIPPoolName2, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, util.Leases(overflowIPPool2.Status.IPv4))
+	isAllocated, err := handler.ipAllocator.IsAllocated(util.IPAMName(givenOverflowIPPool2), overflowIPAddress2)
+	assert.Nil(t, err)
+	assert.False(t, isAllocated)
+
+	vmNetCfg, err := allocate(givenVmNetCfgs[3])
+	if assert.Nil(t, err) && assert.Len(t, vmNetCfg.Status.NetworkConfigs, 1) {
+		assert.Equal(t, overflowIPAddress2, vmNetCfg.Status.NetworkConfigs[0].AllocatedIPAddress)
+		assert.Equal(t, overflowIPPoolKey2, vmNetCfg.Status.NetworkConfigs[0].IPPoolRef)
+	}
+}
+
+func TestHandler_WeightedOverflowChain(t *testing.T) {
+	const (
+		overflowIPPoolName = "pool-1-overflow"
+		overflowIPAddress  = "192.168.0.102"
+	)
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+	overflowIPPoolKey := testIPPoolNamespace + "/" + overflowIPPoolName
+
+	// The primary IPPool weighing 0 leaves new IP addresses to the overflow
+	// IPPool until it's exhausted
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testStartIP).
+		NetworkName(testNetworkName).
+		OverflowPool(overflowIPPoolKey).
+		OverflowWeight(0).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenOverflowIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, overflowIPPoolName).
+		Annotation(util.DelegatedFromAnnotationKey, ipPoolKey).
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(overflowIPAddress, overflowIPAddress).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	var givenVmNetCfgs []*networkv1.VirtualMachineNetworkConfig
+	for i, macAddress := range []string{testMACAddress1, testMACAddress2} {
+		name := fmt.Sprintf("vm-%d", i+1)
+		givenVmNetCfgs = append(givenVmNetCfgs, NewVmNetCfgBuilder(testVmNetCfgNamespace, name).
+			WithVMName(name).
+			WithNetworkConfig("", macAddress, testNetworkName).Build())
+	}
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenIPPool, givenOverflowIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+	for _, vmNetCfg := range givenVmNetCfgs {
+		err := clientset.Tracker().Add(vmNetCfg)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+	}
+
+	fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	handler := Handler{
+		cacheAllocator: newTestCacheAllocatorBuilder().
+			MACSet(util.IPAMName(givenIPPool)).
+			MACSet(util.IPAMName(givenOverflowIPPool)).Build(),
+		ipAllocator: newTestIPAllocatorBuilder().
+			IPSubnet(util.IPAMName(givenIPPool), testCIDR, testStartIP, testStartIP).
+			IPSubnet(util.IPAMName(givenOverflowIPPool), testCIDR, overflowIPAddress, overflowIPAddress).Build(),
+		metricsAllocator: metrics.NewMetricsAllocator(fakeClock),
+		denialLog:        audit.NewDenialLog(fakeClock, audit.DefaultDenialLogSize),
+		clock:            fakeClock,
+		pending:          newPendingIndex(fakeClock),
+		vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		vmnetcfgCache:    fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	expected := []struct {
+		ipAddress string
+		ipPoolRef string
+	}{
+		{overflowIPAddress, overflowIPPoolKey},
+		// The overflow IPPool picked is exhausted, so the chain is filled
+		// in order
+		{testStartIP, ipPoolKey},
+	}
+	for i, e := range expected {
+		status, err := handler.Allocate(givenVmNetCfgs[i], givenVmNetCfgs[i].Status)
+		if assert.Nil(t, err) && assert.Len(t, status.NetworkConfigs, 1) {
+			assert.Equal(t, e.ipAddress, status.NetworkConfigs[0].AllocatedIPAddress)
+			assert.Equal(t, e.ipPoolRef, status.NetworkConfigs[0].IPPoolRef, "ippool serving %s", givenVmNetCfgs[i].Name)
+		}
+	}
+
+	body := scrapeMetrics(handler.metricsAllocator)
+	assert.Contains(t, body, fmt.Sprintf("%s{ippool=%q,overflow=%q} 1", metrics.IPPoolOverflowAllocationsMetricName, ipPoolKey, overflowIPPoolKey))
+}
+
+func TestHandler_ReclaimOrphanedLeases(t *testing.T) {
+	const deletedNamespace = "team-a"
+
+	// The IPPool lives in another namespace than both VMs
+	givenVmNetCfg := newTestVmNetCfgBuilder().
+		WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+	givenDeletedVmNetCfg := NewVmNetCfgBuilder(deletedNamespace, testVmNetCfgName).
+		WithNetworkConfig("", testMACAddress2, testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		AllocationEntry(testIPAddress3, networkv1.AllocationTypeLease, testMACAddress3).
+		SchemaVersion(networkv1.IPPoolStatusSchemaVersion).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfg, givenDeletedVmNetCfg, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	k8sclientset := k8sfake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testVmNetCfgNamespace}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: deletedNamespace}},
+	)
+
+	fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	handler := Handler{
+		cacheAllocator: newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).
+			Add(testNetworkName, testMACAddress3, testIPAddress3).Build(),
+		ipAllocator: newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Allocate(testNetworkName, testIPAddress3).Build(),
+		metricsAllocator: metrics.NewMetricsAllocator(fakeClock),
+		clock:            fakeClock,
+		pending:          newPendingIndex(fakeClock),
+		vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		vmnetcfgCache:    fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		namespaceCache:   fakeclient.NamespaceCache(k8sclientset.CoreV1().Namespaces),
+	}
+
+	var allocated []string
+	for _, vmNetCfg := range []*networkv1.VirtualMachineNetworkConfig{givenVmNetCfg, givenDeletedVmNetCfg} {
+		status, err := handler.Allocate(vmNetCfg, vmNetCfg.Status)
+		if assert.Nil(t, err) && assert.Len(t, status.NetworkConfigs, 1) {
+			allocated = append(allocated, status.NetworkConfigs[0].AllocatedIPAddress)
+		}
+	}
+	if !assert.Len(t, allocated, 2) {
+		return
+	}
+
+	ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	entries := util.AllocationEntries(ipPool.Status.IPv4)
+	assert.Equal(t, testVmNetCfgNamespace, entries[allocated[0]].Namespace)
+	assert.Equal(t, deletedNamespace, entries[allocated[1]].Namespace, "leases should record the namespace of their vm")
+
+	// The namespace goes away without its vmnetcfg being removed
+	err = k8sclientset.CoreV1().Namespaces().Delete(context.TODO(), deletedNamespace, metav1.DeleteOptions{})
+	assert.Nil(t, err)
+
+	assert.Nil(t, handler.reclaimOrphanedLeases())
+	ipPool, err = handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, util.Leases(ipPool.Status.IPv4), 3, "leases should be kept during the grace period")
+
+	// The status comes back at the former schema, e.g., while the CRDs are
+	// upgraded, which restarts the grace period once current again
+	setSchemaVersion := func(version int64) {
+		ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		ipPool.Status.SchemaVersion = version
+		_, err = handler.ippoolClient.UpdateStatus(ipPool)
+		assert.Nil(t, err)
+	}
+	setSchemaVersion(0)
+	fakeClock.Step(leaseReclaimGracePeriod)
+	assert.Nil(t, handler.reclaimOrphanedLeases())
+	ipPool, err = handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, util.Leases(ipPool.Status.IPv4), 3, "leases should be kept while the status predates the current schema")
+	isAllocated, err := handler.ipAllocator.IsAllocated(testNetworkName, allocated[1])
+	assert.Nil(t, err)
+	assert.True(t, isAllocated)
+
+	setSchemaVersion(networkv1.IPPoolStatusSchemaVersion)
+	assert.Nil(t, handler.reclaimOrphanedLeases())
+
+	// Nothing is reclaimed with the feature turned off
+	handler.featureGates, err = featuregate.New(map[string]string{string(featuregate.LeaseReclaim): "false"})
+	assert.Nil(t, err)
+	fakeClock.Step(leaseReclaimGracePeriod)
+	assert.Nil(t, handler.reclaimOrphanedLeases())
+	ipPool, err = handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, util.Leases(ipPool.Status.IPv4), 3, "leases should be kept with lease reclaim disabled")
+
+	handler.featureGates = nil
+	assert.Nil(t, handler.reclaimOrphanedLeases())
+
+	ipPool, err = handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		allocated[0]:   testMACAddress1,
+		testIPAddress3: testMACAddress3,
+	}, util.Leases(ipPool.Status.IPv4), "only the lease of the deleted namespace should be reclaimed, not the one without a namespace")
+
+	isAllocated, err = handler.ipAllocator.IsAllocated(testNetworkName, allocated[1])
+	assert.Nil(t, err)
+	assert.False(t, isAllocated)
+	exists, err := handler.cacheAllocator.HasMAC(testNetworkName, testMACAddress2)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Empty(t, handler.orphanedLeases)
+}
+
+// slowIPPoolClient holds IPPool status updates back until released, like an
+// API server slowed down to a crawl.
+type slowIPPoolClient struct {
+	fakeclient.IPPoolClient
+	release chan struct{}
+}
+
+func (c slowIPPoolClient) UpdateStatus(ipPool *networkv1.IPPool) (*networkv1.IPPool, error) {
+	<-c.release
+	return c.IPPoolClient.UpdateStatus(ipPool)
+}
+
+// deferredAllocationTest reconciles the vmnetcfg of a VM the way the
+// controller does, with OnChange first and Allocate then.
+type deferredAllocationTest struct {
+	t         *testing.T
+	handler   *Handler
+	clientset *fake.Clientset
+}
+
+func newDeferredAllocationTest(t *testing.T, defaultAllocationTiming string, vm *kubevirtv1.VirtualMachine) *deferredAllocationTest {
+	givenVmNetCfg := newTestVmNetCfgBuilder().
+		WithVMName(testVmNetCfgName).
+		WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(vm, givenVmNetCfg, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	return &deferredAllocationTest{
+		t:         t,
+		clientset: clientset,
+		handler: &Handler{
+			cacheAllocator: newTestCacheAllocatorBuilder().
+				MACSet(testNetworkName).Build(),
+			ipAllocator: newTestIPAllocatorBuilder().
+				IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+			metricsAllocator:        metrics.New(),
+			clock:                   clock.RealClock{},
+			pending:                 newPendingIndex(clock.RealClock{}),
+			defaultAllocationTiming: defaultAllocationTiming,
+			vmnetcfgClient:          fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			ippoolClient:            fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			ippoolCache:             fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:                fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			vmCache:                 fakeclient.VirtualMachineCache(clientset.KubevirtV1().VirtualMachines),
+		},
+	}
+}
+
+func (d *deferredAllocationTest) updateVM(mutate func(vm *kubevirtv1.VirtualMachine)) {
+	vm, err := d.clientset.KubevirtV1().VirtualMachines(testVmNetCfgNamespace).Get(context.TODO(), testVmNetCfgName, metav1.GetOptions{})
+	assert.Nil(d.t, err)
+	mutate(vm)
+	_, err = d.clientset.KubevirtV1().VirtualMachines(testVmNetCfgNamespace).Update(context.TODO(), vm, metav1.UpdateOptions{})
+	assert.Nil(d.t, err)
+}
+
+// reconcile returns the vmnetcfg reconciled along with the error of Allocate.
+func (d *deferredAllocationTest) reconcile() (*networkv1.VirtualMachineNetworkConfig, error) {
+	key := testVmNetCfgNamespace + "/" + testVmNetCfgName
+	vmNetCfg, err := d.handler.vmnetcfgClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+	assert.Nil(d.t, err)
+
+	vmNetCfg, err = d.handler.OnChange(key, vmNetCfg)
+	assert.Nil(d.t, err)
+
+	status, allocateErr := d.handler.Allocate(vmNetCfg, vmNetCfg.Status)
+	if allocateErr == nil {
+		vmNetCfg.Status = status
+		vmNetCfg, err = d.handler.vmnetcfgClient.UpdateStatus(vmNetCfg)
+		assert.Nil(d.t, err)
+	}
+
+	return vmNetCfg, allocateErr
+}
+
+func (d *deferredAllocationTest) used() int {
+	used, err := d.handler.ipAllocator.GetUsed(testNetworkName)
+	assert.Nil(d.t, err)
+	return used
+}
+
+func TestHandler_DeferredAllocation(t *testing.T) {
+	halted := kubevirtv1.RunStrategyHalted
+	always := kubevirtv1.RunStrategyAlways
+	newTestVM := func(runStrategy *kubevirtv1.VirtualMachineRunStrategy, annotations map[string]string) *kubevirtv1.VirtualMachine {
+		return &kubevirtv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   testVmNetCfgNamespace,
+				Name:        testVmNetCfgName,
+				Annotations: annotations,
+			},
+			Spec: kubevirtv1.VirtualMachineSpec{
+				RunStrategy: runStrategy,
+			},
+		}
+	}
+	setRunStrategy := func(runStrategy *kubevirtv1.VirtualMachineRunStrategy) func(vm *kubevirtv1.VirtualMachine) {
+		return func(vm *kubevirtv1.VirtualMachine) {
+			vm.Spec.RunStrategy = runStrategy
+		}
+	}
+
+	t.Run("vm created stopped, started, stopped, and started again", func(t *testing.T) {
+		d := newDeferredAllocationTest(t, config.AllocationTimingOnFirstStart, newTestVM(&halted, nil))
+
+		vmNetCfg, err := d.reconcile()
+		assert.True(t, errors.Is(err, generic.ErrSkip), "deferred allocation should not be retried with backoff")
+		assert.True(t, networkv1.DeferredAllocation.IsTrue(vmNetCfg))
+		assert.Equal(t, ReasonVMNotStarted, networkv1.DeferredAllocation.GetReason(vmNetCfg))
+		assert.Empty(t, vmNetCfg.Status.NetworkConfigs)
+		assert.Equal(t, 0, d.used())
+
+		d.updateVM(setRunStrategy(&always))
+		vmNetCfg, err = d.reconcile()
+		assert.Nil(t, err)
+		assert.True(t, networkv1.DeferredAllocation.IsFalse(vmNetCfg))
+		if !assert.Len(t, vmNetCfg.Status.NetworkConfigs, 1) {
+			return
+		}
+		allocatedIP := vmNetCfg.Status.NetworkConfigs[0].AllocatedIPAddress
+		assert.NotEmpty(t, allocatedIP)
+		assert.Equal(t, 1, d.used())
+
+		for _, runStrategy := range []*kubevirtv1.VirtualMachineRunStrategy{&halted, &always} {
+			d.updateVM(setRunStrategy(runStrategy))
+			vmNetCfg, err = d.reconcile()
+			assert.Nil(t, err)
+			assert.True(t, networkv1.DeferredAllocation.IsFalse(vmNetCfg))
+			if assert.Len(t, vmNetCfg.Status.NetworkConfigs, 1) {
+				assert.Equal(t, allocatedIP, vmNetCfg.Status.NetworkConfigs[0].AllocatedIPAddress)
+			}
+			assert.Equal(t, 1, d.used(), "ip address should be allocated only once")
+		}
+
+		ipPool, err := d.handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{allocatedIP: testMACAddress1}, util.Leases(ipPool.Status.IPv4))
+	})
+
+	t.Run("vm started through the api", func(t *testing.T) {
+		manual := kubevirtv1.RunStrategyManual
+		d := newDeferredAllocationTest(t, config.AllocationTimingOnFirstStart, newTestVM(&manual, nil))
+
+		_, err := d.reconcile()
+		assert.True(t, errors.Is(err, generic.ErrSkip))
+		assert.Equal(t, 0, d.used())
+
+		d.updateVM(func(vm *kubevirtv1.VirtualMachine) {
+			vm.Status.Created = true
+		})
+		_, err = d.reconcile()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, d.used())
+	})
+
+	t.Run("deferred vm switched to immediate", func(t *testing.T) {
+		d := newDeferredAllocationTest(t, config.AllocationTimingOnFirstStart, newTestVM(&halted, nil))
+
+		_, err := d.reconcile()
+		assert.True(t, errors.Is(err, generic.ErrSkip))
+		assert.Equal(t, 0, d.used())
+
+		d.updateVM(func(vm *kubevirtv1.VirtualMachine) {
+			vm.Annotations = map[string]string{util.AllocationTimingAnnotationKey: config.AllocationTimingImmediate}
+		})
+		vmNetCfg, err := d.reconcile()
+		assert.Nil(t, err)
+		assert.True(t, networkv1.DeferredAllocation.IsFalse(vmNetCfg))
+		assert.Len(t, vmNetCfg.Status.NetworkConfigs, 1)
+		assert.Equal(t, 1, d.used())
+	})
+
+	t.Run("stopped vm deferring allocation by annotation", func(t *testing.T) {
+		d := newDeferredAllocationTest(t, config.AllocationTimingImmediate, newTestVM(&halted, map[string]string{
+			util.AllocationTimingAnnotationKey: config.AllocationTimingOnFirstStart,
+		}))
+
+		vmNetCfg, err := d.reconcile()
+		assert.True(t, errors.Is(err, generic.ErrSkip))
+		assert.True(t, networkv1.DeferredAllocation.IsTrue(vmNetCfg))
+		assert.Equal(t, 0, d.used())
+	})
+
+	t.Run("stopped vm allocated immediately", func(t *testing.T) {
+		d := newDeferredAllocationTest(t, config.AllocationTimingImmediate, newTestVM(&halted, nil))
+
+		vmNetCfg, err := d.reconcile()
+		assert.Nil(t, err)
+		assert.Empty(t, networkv1.DeferredAllocation.GetStatus(vmNetCfg), "condition should only be added once an allocation is deferred")
+		assert.Equal(t, 1, d.used())
+	})
+}
+
+// TestHandler_Warmup makes sure nothing is allocated from the IPAM before it
+// is warmed up from the existing IPPools after a restart.
+func TestHandler_Warmup(t *testing.T) {
+	givenVmNetCfg := newTestVmNetCfgBuilder().
+		WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfg, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	warmup := config.NewWarmup()
+	warmup.Start()
+
+	handler := Handler{
+		cacheAllocator: newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).Build(),
+		ipAllocator: newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+		metricsAllocator: metrics.New(),
+		clock:            clock.RealClock{},
+		pending:          newPendingIndex(clock.RealClock{}),
+		warmup:           warmup,
+		ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	status, err := handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+	assert.ErrorIs(t, err, config.ErrWarmingUp)
+	assert.ErrorIs(t, err, generic.ErrSkip, "waiting for the warm-up should not be retried with backoff")
+	assert.Equal(t, givenVmNetCfg.Status, status)
+
+	used, err := handler.ipAllocator.GetUsed(testNetworkName)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, used, "nothing should be allocated while warming up")
+
+	warmup.Done()
+
+	status, err = handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+	assert.Nil(t, err)
+	if assert.Len(t, status.NetworkConfigs, 1) {
+		assert.Equal(t, networkv1.AllocatedState, status.NetworkConfigs[0].State)
+	}
+}
+
+func TestHandler_ReconcileTimeout(t *testing.T) {
+	givenVmNetCfg := newTestVmNetCfgBuilder().
+		WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfg, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	release := make(chan struct{})
+	metricsAllocator := metrics.New()
+
+	handler := Handler{
+		cacheAllocator: newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).Build(),
+		ipAllocator: newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+		metricsAllocator: metricsAllocator,
+		clock:            clock.RealClock{},
+		pending:          newPendingIndex(clock.RealClock{}),
+		vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		vmnetcfgCache:    fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		ippoolClient: slowIPPoolClient{
+			IPPoolClient: fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			release:      release,
+		},
+		ippoolCache: fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:    fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	limiter := reconcile.NewLimiter(controllerName, 20*time.Millisecond, metricsAllocator)
+	allocate := reconcile.StatusHandler(limiter, "vmnetcfg-allocate", handler.Allocate)
+
+	status, err := allocate(givenVmNetCfg, givenVmNetCfg.Status)
+	assert.ErrorIs(t, err, reconcile.ErrTimeout)
+	assert.Equal(t, givenVmNetCfg.Status, status, "status of the reconcile timed out should be dropped")
+
+	// The reconcile timed out is still stuck on the IPPool update
+	_, err = allocate(givenVmNetCfg, givenVmNetCfg.Status)
+	assert.ErrorIs(t, err, reconcile.ErrInFlight, "no other reconcile should start next to the one timed out")
+
+	assert.Contains(t, scrapeMetrics(metricsAllocator),
+		fmt.Sprintf("%s{controller=%q,handler=%q} 1", metrics.ReconcileTimeoutsMetricName, controllerName, "vmnetcfg-allocate"))
+
+	// Once the API server catches up, the requeued reconcile picks up the
+	// allocation the one timed out made
+	close(release)
+	assert.Eventually(t, func() bool {
+		status, err = allocate(givenVmNetCfg, givenVmNetCfg.Status)
+		return !errors.Is(err, reconcile.ErrInFlight)
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, err)
+
+	ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	leases := util.Leases(ipPool.Status.IPv4)
+	if assert.Len(t, leases, 1) && assert.Len(t, status.NetworkConfigs, 1) {
+		assert.Equal(t, testMACAddress1, leases[status.NetworkConfigs[0].AllocatedIPAddress])
+	}
+}
+
+func TestHandler_AllocationRevision(t *testing.T) {
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+
+	givenVmNetCfg1 := newTestVmNetCfgBuilder().
+		WithNetworkConfig(testIPAddress1, testMACAddress1, testNetworkName).Build()
+	givenVmNetCfg2 := NewVmNetCfgBuilder(testVmNetCfgNamespace, "test-vm-2").
+		WithNetworkConfig(testIPAddress2, testMACAddress2, testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfg1, givenVmNetCfg2, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	// Each handler stands for a controller instance starting from scratch
+	// but the API server
+	newHandler := func() Handler {
+		return Handler{
+			cacheAllocator: newTestCacheAllocatorBuilder().
+				MACSet(testNetworkName).Build(),
+			ipAllocator: newTestIPAllocatorBuilder().
+				IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+			metricsAllocator: metrics.New(),
+			changeLog:        audit.NewChangeLog(audit.DefaultChangeLogSize),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}
+	}
+
+	handler := newHandler()
+	status, err := handler.Allocate(givenVmNetCfg1, givenVmNetCfg1.Status)
+	assert.Nil(t, err)
+
+	ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), ipPool.Status.AllocationRevision)
+	assert.False(t, ipPool.Status.LastChange.IsZero())
+	changes, ok := handler.changeLog.Since(ipPoolKey, 0, 1)
+	assert.True(t, ok)
+	assert.Equal(t, []audit.Change{
+		{Revision: 1, Type: audit.ChangeTypeAllocated, IPAddress: testIPAddress1, MACAddress: testMACAddress1},
+	}, changes)
+
+	// Allocating what's already there is no change
+	_, err = handler.Allocate(givenVmNetCfg1, status)
+	assert.Nil(t, err)
+	ipPool, err = handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), ipPool.Status.AllocationRevision)
+
+	// The revision carries on from the status after a restart, while the
+	// changes before it are gone
+	handler = newHandler()
+	_, err = handler.Allocate(givenVmNetCfg2, givenVmNetCfg2.Status)
+	assert.Nil(t, err)
+
+	ipPool, err = handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), ipPool.Status.AllocationRevision)
+	_, ok = handler.changeLog.Since(ipPoolKey, 0, 2)
+	assert.False(t, ok, "changes made before the restart should call for a resync")
+
+	givenVmNetCfg1.Status = status
+	err = handler.cleanup(givenVmNetCfg1, false)
+	assert.Nil(t, err)
+
+	ipPool, err = handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), ipPool.Status.AllocationRevision)
+	changes, ok = handler.changeLog.Since(ipPoolKey, 1, 3)
+	assert.True(t, ok)
+	assert.Equal(t, []audit.Change{
+		{Revision: 2, Type: audit.ChangeTypeAllocated, IPAddress: testIPAddress2, MACAddress: testMACAddress2},
+		{Revision: 3, Type: audit.ChangeTypeReleased, IPAddress: testIPAddress1, MACAddress: testMACAddress1},
+	}, changes)
+}
+
+func TestHandler_AllocationExemplars(t *testing.T) {
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+
+	givenVmNetCfg := newTestVmNetCfgBuilder().
+		WithNetworkConfig(testIPAddress1, testMACAddress1, testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfg, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	metricsAllocator := metrics.NewMetricsAllocator(fakeClock)
+	metricsAllocator.EnableAllocationExemplars(1)
+
+	handler := Handler{
+		cacheAllocator: newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).Build(),
+		ipAllocator: newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+		metricsAllocator: metricsAllocator,
+		clock:            fakeClock,
+		pending:          newPendingIndex(fakeClock),
+		ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+	}
+
+	scrapeOpenMetrics := func() string {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+		metricsAllocator.GetHTTPHandler().ServeHTTP(recorder, request)
+		return recorder.Body.String()
+	}
+	counter := fmt.Sprintf("%s{ippool=%q} 1.0", metrics.IPPoolAllocationsMetricName, ipPoolKey)
+	exemplar := fmt.Sprintf("# {%s=%q} 1.0", metrics.LabelVMName, givenVmNetCfg.Namespace+"/"+givenVmNetCfg.Spec.VMName)
+
+	status, err := handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+	assert.Nil(t, err)
+	assert.Contains(t, scrapeOpenMetrics(), counter+" "+exemplar, "new allocation should be attached as an exemplar")
+
+	// Allocating what's already there isn't counted again
+	_, err = handler.Allocate(givenVmNetCfg, status)
+	assert.Nil(t, err)
+	assert.Contains(t, scrapeOpenMetrics(), counter+" "+exemplar)
+
+	// The exemplar goes away once the allocation is no longer recent
+	fakeClock.Step(time.Hour)
+	body := scrapeOpenMetrics()
+	assert.Contains(t, body, counter+"\n")
+	assert.NotContains(t, body, exemplar)
+}
+
+func TestHandler_StaleWriterInterlock(t *testing.T) {
+	const (
+		oldIdentity = "vm-dhcp-controller-old/0a1b2c3d"
+		newIdentity = "vm-dhcp-controller-new/4e5f6a7b"
+	)
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+
+	givenVmNetCfg1 := newTestVmNetCfgBuilder().
+		WithNetworkConfig(testIPAddress1, testMACAddress1, testNetworkName).Build()
+	givenVmNetCfg2 := NewVmNetCfgBuilder(testVmNetCfgNamespace, "test-vm-2").
+		WithNetworkConfig(testIPAddress2, testMACAddress2, testNetworkName).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+		Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfg1, givenVmNetCfg2, givenIPPool)
+	err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	// Both instances run at once, e.g., during a botched upgrade, while only
+	// the new one holds the leader lease
+	newHandler := func(identity string, leader bool) Handler {
+		leadership := config.NewLeadership(nil)
+		if leader {
+			leadership.Acquire()
+		}
+		return Handler{
+			cacheAllocator: newTestCacheAllocatorBuilder().
+				MACSet(testNetworkName).Build(),
+			ipAllocator: newTestIPAllocatorBuilder().
+				IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+			metricsAllocator: metrics.New(),
+			changeLog:        audit.NewChangeLog(audit.DefaultChangeLogSize),
+			clock:            clock.RealClock{},
+			identity:         identity,
+			leadership:       leadership,
+			pending:          newPendingIndex(clock.RealClock{}),
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}
+	}
+	oldInstance := newHandler(oldIdentity, false)
+	newInstance := newHandler(newIdentity, true)
+
+	// The old instance prepares its allocations from the IPPool as it is
+	// before the new one writes to it
+	prepared, err := oldInstance.ippoolCache.Get(testIPPoolNamespace, testIPPoolName)
+	assert.Nil(t, err)
+	preparedCpy := prepared.DeepCopy()
+	preparedCpy.Status.IPv4 = &networkv1.IPv4Status{}
+	util.SetAllocationEntry(preparedCpy.Status.IPv4, testIPAddress1, networkv1.AllocationEntry{
+		Type:  networkv1.AllocationTypeLease,
+		Owner: testMACAddress2,
+	}, time.Now())
+
+	_, err = newInstance.Allocate(givenVmNetCfg1, givenVmNetCfg1.Status)
+	assert.Nil(t, err)
+
+	ipPool, err := newInstance.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, newIdentity, ipPool.Status.LastWriter)
+	changes, ok := newInstance.changeLog.Since(ipPoolKey, 0, 1)
+	assert.True(t, ok)
+	assert.Equal(t, []audit.Change{
+		{Revision: 1, Type: audit.ChangeTypeAllocated, IPAddress: testIPAddress1, MACAddress: testMACAddress1, Writer: newIdentity},
+	}, changes)
+
+	// The stale allocations of the old instance aren't committed
+	_, err = oldInstance.commitIPPoolStatus(prepared, preparedCpy)
+	var staleErr staleWriterError
+	if assert.True(t, errors.As(err, &staleErr), "stale commit should be refused, got %v", err) {
+		assert.Equal(t, fmt.Sprintf("ippool %s was written by %s since the allocations of %s were prepared, and %s isn't the leader",
+			ipPoolKey, newIdentity, oldIdentity, oldIdentity), err.Error())
+	}
+
+	ipPool, err = oldInstance.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{testIPAddress1: testMACAddress1}, util.Leases(ipPool.Status.IPv4))
+	assert.Equal(t, newIdentity, ipPool.Status.LastWriter)
+	assert.Empty(t, oldInstance.changeLog.List(ipPoolKey))
+
+	// The leader isn't held back by the writes of other instances
+	assert.Nil(t, newInstance.checkLastWriter(prepared))
+
+	// Once re-read, the allocations of the old instance are committed
+	_, err = oldInstance.Allocate(givenVmNetCfg2, givenVmNetCfg2.Status)
+	assert.Nil(t, err)
+
+	ipPool, err = oldInstance.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{testIPAddress1: testMACAddress1, testIPAddress2: testMACAddress2}, util.Leases(ipPool.Status.IPv4))
+	assert.Equal(t, oldIdentity, ipPool.Status.LastWriter)
+}
+
 func TestHandler_Sync(t *testing.T) {
 	t.Run("sync a vmnetcfg with an in-synced condition should succeed but should not alter anything", func(t *testing.T) {
 		givenVmNetCfg := newTestVmNetCfgBuilder().
@@ -573,6 +2969,8 @@ func TestHandler_Sync(t *testing.T) {
 			cacheAllocator:   givenCacheAllocator,
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
 		}
@@ -635,6 +3033,8 @@ func TestHandler_Sync(t *testing.T) {
 			cacheAllocator:   givenCacheAllocator,
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
 		}
@@ -657,6 +3057,62 @@ func TestHandler_Sync(t *testing.T) {
 		assert.Equal(t, expectedCacheAllocator, handler.cacheAllocator)
 	})
 
+	t.Run("sync an out-of-sync vmnetcfg with an uppercase mac address should keep its lease", func(t *testing.T) {
+		givenVmNetCfg := newTestVmNetCfgBuilder().
+			WithNetworkConfig(testIPAddress1, "AA-BB-CC-DD-EE-FF", testNetworkName).
+			WithNetworkConfigStatus(testIPAddress1, "aa:bb:cc:dd:ee:ff", testNetworkName, networkv1.AllocatedState).
+			InSyncedCondition(corev1.ConditionFalse, ReasonPoolRebound, "").Build()
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			Allocated(testIPAddress1, "aa:bb:cc:dd:ee:ff").
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+		givenCacheAllocator := newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).
+			Add(testNetworkName, "aa:bb:cc:dd:ee:ff", testIPAddress1).Build()
+		givenIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Allocate(testNetworkName, testIPAddress1).Build()
+
+		expectedStatus := newTestVmNetCfgStatusBuilder().
+			WithNetworkConfigStatus(testIPAddress1, "aa:bb:cc:dd:ee:ff", testNetworkName, networkv1.AllocatedState).
+			InSyncedCondition(corev1.ConditionFalse, ReasonPoolRebound, "").Build()
+		expectedCacheAllocator := newTestCacheAllocatorBuilder().
+			MACSet(testNetworkName).
+			Add(testNetworkName, "aa:bb:cc:dd:ee:ff", testIPAddress1).Build()
+		expectedIPAllocator := newTestIPAllocatorBuilder().
+			IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+			Allocate(testNetworkName, testIPAddress1).Build()
+
+		clientset := fake.NewSimpleClientset(givenVmNetCfg, givenIPPool)
+
+		handler := Handler{
+			cacheAllocator:   givenCacheAllocator,
+			ipAllocator:      givenIPAllocator,
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		}
+
+		status, err := handler.Sync(givenVmNetCfg, givenVmNetCfg.Status)
+		assert.Nil(t, err)
+
+		SanitizeStatus(&expectedStatus)
+		SanitizeStatus(&status)
+		assert.Equal(t, expectedStatus, status)
+
+		ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{testIPAddress1: "aa:bb:cc:dd:ee:ff"}, util.Leases(ipPool.Status.IPv4))
+
+		assert.Equal(t, expectedIPAllocator, handler.ipAllocator)
+		assert.Equal(t, expectedCacheAllocator, handler.cacheAllocator)
+	})
+
 	t.Run("sync new vmnetcfg with empty network config should succeed", func(t *testing.T) {
 		givenVmNetCfg := newTestVmNetCfgBuilder().Build()
 		givenIPPool := newTestIPPoolBuilder().
@@ -688,6 +3144,8 @@ func TestHandler_Sync(t *testing.T) {
 			cacheAllocator:   givenCacheAllocator,
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
 		}
@@ -743,6 +3201,8 @@ func TestHandler_Sync(t *testing.T) {
 			cacheAllocator:   givenCacheAllocator,
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
 		}
@@ -793,6 +3253,7 @@ func TestHandler_Sync(t *testing.T) {
 		expectedStatus := newTestVmNetCfgStatusBuilder().
 			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).Build()
 		expectedIPPool := newTestIPPoolBuilder().
+			AllocationRevision(1).
 			ServerIP(testServerIP).
 			CIDR(testCIDR).
 			PoolRange(testStartIP, testEndIP).
@@ -829,6 +3290,8 @@ func TestHandler_Sync(t *testing.T) {
 			cacheAllocator:   givenCacheAllocator,
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
 			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
@@ -901,6 +3364,8 @@ func TestHandler_Sync(t *testing.T) {
 			cacheAllocator:   givenCacheAllocator,
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
 		}
@@ -950,6 +3415,7 @@ func TestHandler_Sync(t *testing.T) {
 		expectedStatus := newTestVmNetCfgStatusBuilder().
 			WithNetworkConfigStatus(testIPAddress2, testMACAddress2, testNetworkName, networkv1.AllocatedState).Build()
 		expectedIPPool := newTestIPPoolBuilder().
+			AllocationRevision(1).
 			ServerIP(testServerIP).
 			CIDR(testCIDR).
 			PoolRange(testStartIP, testEndIP).
@@ -986,6 +3452,8 @@ func TestHandler_Sync(t *testing.T) {
 			cacheAllocator:   givenCacheAllocator,
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
 			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
@@ -1040,6 +3508,7 @@ func TestHandler_Sync(t *testing.T) {
 		expectedStatus := newTestVmNetCfgStatusBuilder().
 			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).Build()
 		expectedIPPool := newTestIPPoolBuilder().
+			AllocationRevision(2).
 			ServerIP(testServerIP).
 			CIDR(testCIDR).
 			PoolRange(testStartIP, testEndIP).
@@ -1076,6 +3545,8 @@ func TestHandler_Sync(t *testing.T) {
 			cacheAllocator:   givenCacheAllocator,
 			ipAllocator:      givenIPAllocator,
 			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
 			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
 			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
 			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
@@ -1099,3 +3570,714 @@ func TestHandler_Sync(t *testing.T) {
 		assert.Equal(t, expectedCacheAllocator, handler.cacheAllocator)
 	})
 }
+
+func TestHandler_IPPoolChange(t *testing.T) {
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).Build()
+	givenIPPool.Generation = 1
+	givenVmNetCfg := newTestVmNetCfgBuilder().
+		WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+	givenUnqualifiedVmNetCfg := NewVmNetCfgBuilder("tenant", "vm-unqualified").
+		WithNetworkConfig("", testMACAddress2, testNADName).Build()
+	givenUnrelatedVmNetCfg := NewVmNetCfgBuilder(testVmNetCfgNamespace, "vm-unrelated").
+		WithNetworkConfig("", testMACAddress3, testNADNamespace+"/net-2").Build()
+
+	clientset := fake.NewSimpleClientset(givenIPPool, givenVmNetCfg, givenUnqualifiedVmNetCfg, givenUnrelatedVmNetCfg)
+
+	handler := Handler{
+		poolGenerations: newPoolGenerations(),
+		vmnetcfgCache: indexedVmNetCfgCache{
+			fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		},
+	}
+
+	keys, err := handler.vmNetCfgsOfIPPool(testIPPoolNamespace, testIPPoolName, givenIPPool)
+	assert.Nil(t, err)
+	assert.Empty(t, keys, "ippool seen for the first time should not resync its vmnetcfgs")
+
+	// Status updates leave the generation as is
+	givenIPPool.Status.IPv4 = &networkv1.IPv4Status{Used: 1}
+	keys, err = handler.vmNetCfgsOfIPPool(testIPPoolNamespace, testIPPoolName, givenIPPool)
+	assert.Nil(t, err)
+	assert.Empty(t, keys, "status update of ippool should not resync its vmnetcfgs")
+
+	givenIPPool.Spec.IPv4Config.DNS = []string{"1.1.1.1"}
+	givenIPPool.Generation = 2
+	keys, err = handler.vmNetCfgsOfIPPool(testIPPoolNamespace, testIPPoolName, givenIPPool)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []relatedresource.Key{
+		{Namespace: givenVmNetCfg.Namespace, Name: givenVmNetCfg.Name},
+		{Namespace: givenUnqualifiedVmNetCfg.Namespace, Name: givenUnqualifiedVmNetCfg.Name},
+	}, keys, "vmnetcfgs on the network of the edited ippool should resync")
+
+	keys, err = handler.vmNetCfgsOfIPPool(testIPPoolNamespace, testIPPoolName, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+	assert.NotContains(t, handler.poolGenerations.generations, testIPPoolNamespace+"/"+testIPPoolName, "deleted ippool should be forgotten")
+}
+
+// TestHandler_OnResync injects drift of every kind into the allocation of a
+// vmnetcfg, and checks the re-verification repairs and counts each of them.
+func TestHandler_OnResync(t *testing.T) {
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+
+	// The IPPool lost the lease of testIPAddress1 and still holds a former
+	// one of the MAC address, which the caches follow
+	givenVmNetCfg := NewVmNetCfgBuilder(testVmNetCfgNamespace, testVmNetCfgName).
+		WithVMName(testVmNetCfgName).
+		Annotation(util.ResyncAnnotationKey, "r1").
+		WithNetworkConfig("", testMACAddress1, testNetworkName).
+		WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+		IPPoolRef(ipPoolKey).Build()
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		AllocationEntry(testIPAddress2, networkv1.AllocationTypeLease, testMACAddress1).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfg, givenIPPool)
+	recorder := record.NewFakeRecorder(10)
+	ipAllocator := newTestIPAllocatorBuilder().
+		IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+		Allocate(testNetworkName, testIPAddress2).Build()
+	cacheAllocator := newTestCacheAllocatorBuilder().
+		MACSet(testNetworkName).
+		Add(testNetworkName, testMACAddress1, testIPAddress2).Build()
+
+	handler := Handler{
+		cacheAllocator: cacheAllocator,
+		ipAllocator:    ipAllocator,
+		clock:          clock.RealClock{},
+		recorder:       recorder,
+		resyncLimiter:  reconcile.NewResyncLimiter(time.Hour, 1, clock.RealClock{}),
+		vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		ippoolClient:   fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		ippoolCache:    fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+	}
+
+	vmNetCfg, err := handler.OnResync(testKey, givenVmNetCfg)
+	assert.Nil(t, err)
+	if assert.NotNil(t, vmNetCfg.Status.LastResync) {
+		assert.Equal(t, "r1", vmNetCfg.Status.LastResync.RequestID)
+		assert.Equal(t, networkv1.ResyncRepairs{
+			StaleLeases:   1,
+			MissingLeases: 1,
+			IPAMEntries:   1,
+			MACEntries:    1,
+		}, vmNetCfg.Status.LastResync.Repairs)
+		assert.Empty(t, vmNetCfg.Status.LastResync.Message)
+	}
+
+	ipPool, err := handler.ippoolCache.Get(testIPPoolNamespace, testIPPoolName)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{testIPAddress1: testMACAddress1}, util.Leases(ipPool.Status.IPv4))
+
+	allocated, err := ipAllocator.IsAllocated(testNetworkName, testIPAddress1)
+	assert.Nil(t, err)
+	assert.True(t, allocated)
+	allocated, err = ipAllocator.IsAllocated(testNetworkName, testIPAddress2)
+	assert.Nil(t, err)
+	assert.False(t, allocated, "ip of the stale lease should be given back")
+	cachedIP, err := cacheAllocator.GetIPByMAC(testNetworkName, testMACAddress1)
+	assert.Nil(t, err)
+	assert.Equal(t, testIPAddress1, cachedIP)
+
+	if assert.Len(t, recorder.Events, 1) {
+		assert.Equal(t, fmt.Sprintf("%s %s Resync r1 repaired 1 stale and 1 missing leases, 1 IPAM and 1 MAC cache entries",
+			corev1.EventTypeNormal, ReasonResynced), <-recorder.Events)
+	}
+
+	// The same request ID is only run once, and a new one within the
+	// interval is held back
+	again, err := handler.OnResync(testKey, vmNetCfg)
+	assert.Nil(t, err)
+	assert.Equal(t, vmNetCfg, again)
+
+	vmNetCfg.Annotations[util.ResyncAnnotationKey] = "r2"
+	heldBack, err := handler.OnResync(testKey, vmNetCfg)
+	assert.Nil(t, err)
+	assert.Equal(t, "r1", heldBack.Status.LastResync.RequestID, "resync should be held back by the rate limit")
+}
+
+func TestHandler_MirrorAllocations(t *testing.T) {
+	givenVmNetCfg := NewVmNetCfgBuilder(testVmNetCfgNamespace, testVmNetCfgName).
+		WithVMName(testVmNetCfgName).
+		WithNetworkConfig("", testMACAddress1, testNetworkName).
+		WithNetworkConfig("", testMACAddress2, testNetworkName).
+		WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+		WithNetworkConfigStatus("", testMACAddress2, testNetworkName, networkv1.PendingState).Build()
+	givenOtherVmNetCfg := NewVmNetCfgBuilder(testVmNetCfgNamespace, "other-vm").
+		WithVMName("other-vm").
+		WithNetworkConfig("", testMACAddress3, testNetworkName).
+		WithNetworkConfigStatus(testIPAddress3, testMACAddress3, testNetworkName, networkv1.AllocatedState).Build()
+	givenPendingVmNetCfg := NewVmNetCfgBuilder(testVmNetCfgNamespace, "pending-vm").
+		WithVMName("pending-vm").
+		WithNetworkConfig("", testMACAddress4, testNetworkName).Build()
+	// A shard left over from when the namespace had more VMs
+	givenStaleShard := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      util.AllocationsConfigMapName + "-1",
+			Namespace: testVmNetCfgNamespace,
+			Labels:    map[string]string{util.AllocationsShardLabelKey: "1"},
+		},
+	}
+	givenFirstShard := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        util.AllocationsConfigMapName,
+			Namespace:   testVmNetCfgNamespace,
+			Labels:      map[string]string{util.AllocationsShardLabelKey: "0"},
+			Annotations: map[string]string{util.AllocationsShardsAnnotationKey: "2"},
+		},
+	}
+
+	clientset := fake.NewSimpleClientset(givenVmNetCfg, givenOtherVmNetCfg, givenPendingVmNetCfg)
+	k8sclientset := k8sfake.NewSimpleClientset(givenFirstShard, givenStaleShard)
+
+	handler := Handler{
+		vmnetcfgCache:   fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		configMapClient: fakeclient.ConfigMapClient(k8sclientset.CoreV1().ConfigMaps),
+	}
+
+	_, err := handler.MirrorAllocations(testKey, givenVmNetCfg)
+	assert.Nil(t, err)
+
+	configMap, err := handler.configMapClient.Get(testVmNetCfgNamespace, util.AllocationsConfigMapName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		testVmNetCfgName: `[{"macAddress":"` + testMACAddress1 + `","ipAddress":"` + testIPAddress1 + `","networkName":"` + testNetworkName + `"}]`,
+		"other-vm":       `[{"macAddress":"` + testMACAddress3 + `","ipAddress":"` + testIPAddress3 + `","networkName":"` + testNetworkName + `"}]`,
+	}, configMap.Data)
+	assert.Equal(t, "1", configMap.Annotations[util.AllocationsShardsAnnotationKey])
+
+	_, err = handler.configMapClient.Get(testVmNetCfgNamespace, util.AllocationsConfigMapName+"-1", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err), "shard left over should be deleted")
+
+	// The entries of deleted VMs go away, along with the ConfigMap once
+	// nothing is allocated anymore
+	for _, name := range []string{testVmNetCfgName, "other-vm"} {
+		err := clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs(testVmNetCfgNamespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+		assert.Nil(t, err)
+	}
+	_, err = handler.MirrorAllocations(testKey, nil)
+	assert.Nil(t, err)
+
+	_, err = handler.configMapClient.Get(testVmNetCfgNamespace, util.AllocationsConfigMapName, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestHandler_PinAllocations(t *testing.T) {
+	const testAnnotation = util.PinnedAllocationsAnnotationKey
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+
+	givenVM := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: testVmNetCfgNamespace,
+			Name:      testVmNetCfgName,
+			Annotations: map[string]string{
+				// Pinned before the VirtualMachineNetworkConfig got recreated,
+				// along with one of a MAC address gone from the VM since
+				testAnnotation: `[{"macAddress":"` + testMACAddress2 + `","ipAddress":"` + testIPAddress2 + `","ipPool":"` + ipPoolKey + `"},` +
+					`{"macAddress":"` + testMACAddress3 + `","ipAddress":"` + testIPAddress3 + `","ipPool":"` + ipPoolKey + `"}]`,
+			},
+		},
+	}
+	givenVmNetCfg := NewVmNetCfgBuilder(testVmNetCfgNamespace, testVmNetCfgName).
+		WithVMName(testVmNetCfgName).
+		WithNetworkConfig("", testMACAddress1, testNetworkName).
+		WithNetworkConfig("", testMACAddress2, testNetworkName).
+		WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+		IPPoolRef(ipPoolKey).Build()
+
+	clientset := fake.NewSimpleClientset(givenVM, givenVmNetCfg)
+
+	handler := Handler{
+		pinnedAllocationsAnnotation: testAnnotation,
+		vmClient:                    fakeclient.VirtualMachineClient(clientset.KubevirtV1().VirtualMachines),
+		vmCache:                     fakeclient.VirtualMachineCache(clientset.KubevirtV1().VirtualMachines),
+	}
+
+	_, err := handler.PinAllocations(testKey, givenVmNetCfg)
+	assert.Nil(t, err)
+
+	vm, err := handler.vmClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	pinned, err := util.PinnedAllocations(vm.Annotations, testAnnotation)
+	assert.Nil(t, err)
+	assert.Equal(t, []util.PinnedAllocation{
+		{MACAddress: testMACAddress1, IPAddress: testIPAddress1, IPPool: ipPoolKey},
+		{MACAddress: testMACAddress2, IPAddress: testIPAddress2, IPPool: ipPoolKey},
+	}, pinned)
+
+	// Nothing left to pin drops the annotation
+	givenVmNetCfg.Spec.NetworkConfigs = nil
+	_, err = handler.PinAllocations(testKey, givenVmNetCfg)
+	assert.Nil(t, err)
+
+	vm, err = handler.vmClient.Get(testVmNetCfgNamespace, testVmNetCfgName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.NotContains(t, vm.Annotations, testAnnotation)
+}
+
+func TestShardAllocations(t *testing.T) {
+	entries := map[string]string{
+		"vm-a": "0123456789",
+		"vm-b": "0123456789",
+		"vm-c": "0123456789012345678901234567890123456789",
+		"vm-d": "0123456789",
+	}
+
+	assert.Equal(t, []map[string]string{
+		{"vm-a": entries["vm-a"], "vm-b": entries["vm-b"]},
+		{"vm-c": entries["vm-c"]},
+		{"vm-d": entries["vm-d"]},
+	}, shardAllocations(entries, 30))
+	assert.Len(t, shardAllocations(entries, maxAllocationsShardSize), 1)
+	assert.Empty(t, shardAllocations(nil, maxAllocationsShardSize))
+}
+
+func TestHandler_IPv6(t *testing.T) {
+	const (
+		testIPv6CIDR    = "2001:db8::/120"
+		testIPv6StartIP = "2001:db8::10"
+		testIPv6EndIP   = "2001:db8::ff"
+	)
+	ipv6IPAMName := util.IPv6IPAMNameOf(testNetworkName)
+
+	setup := func(ipPool *networkv1.IPPool) (*Handler, *fake.Clientset) {
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+		nadGVR := schema.GroupVersionResource{
+			Group:    "k8s.cni.cncf.io",
+			Version:  "v1",
+			Resource: "network-attachment-definitions",
+		}
+
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		err = clientset.Tracker().Add(ipPool)
+		assert.Nil(t, err)
+
+		return &Handler{
+			cacheAllocator: newTestCacheAllocatorBuilder().
+				MACSet(testNetworkName).
+				MACSet(ipv6IPAMName).Build(),
+			ipAllocator: newTestIPAllocatorBuilder().
+				IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).
+				IPSubnet(ipv6IPAMName, testIPv6CIDR, testIPv6StartIP, testIPv6EndIP).Build(),
+			metricsAllocator: metrics.New(),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
+			ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}, clientset
+	}
+
+	givenIPPool := newTestIPPoolBuilder().
+		ServerIP(testServerIP).
+		CIDR(testCIDR).
+		PoolRange(testStartIP, testEndIP).
+		NetworkName(testNetworkName).
+		IPv6PoolRange(testIPv6CIDR, "", testIPv6StartIP, testIPv6EndIP).
+		CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+	givenVmNetCfg := newTestVmNetCfgBuilder().
+		WithNetworkConfig(testIPAddress1, testMACAddress1, testNetworkName).Build()
+
+	handler, _ := setup(givenIPPool)
+
+	status, err := handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+	assert.Nil(t, err)
+	assert.Len(t, status.NetworkConfigs, 1)
+	ncStatus := status.NetworkConfigs[0]
+	assert.Equal(t, testIPAddress1, ncStatus.AllocatedIPAddress)
+	ipv6 := ncStatus.AllocatedIPv6Address
+	assert.True(t, util.IsIPInBetweenOf(ipv6, testIPv6StartIP, testIPv6EndIP), "ipv6 address %q should be allocated from the pool range", ipv6)
+
+	ipPool, err := handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{ipv6: testMACAddress1}, util.IPv6Leases(ipPool.Status.IPv6))
+	assert.Equal(t, map[string]string{testIPAddress1: testMACAddress1}, util.Leases(ipPool.Status.IPv4))
+	cachedIP, err := handler.cacheAllocator.GetIPByMAC(ipv6IPAMName, testMACAddress1)
+	assert.Nil(t, err)
+	assert.Equal(t, ipv6, cachedIP)
+
+	// The ipv6 address of the status is taken again by a fresh IPAM
+	givenVmNetCfg.Status = status
+	handler, _ = setup(ipPool)
+	status, err = handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+	assert.Nil(t, err)
+	assert.Equal(t, ipv6, status.NetworkConfigs[0].AllocatedIPv6Address)
+
+	// Releasing the network config gives the ipv6 address back as well
+	err = handler.releaseIP(testNetworkName, status.NetworkConfigs[0])
+	assert.Nil(t, err)
+	err = handler.deleteAllocationEntry(givenVmNetCfg.Namespace, status.NetworkConfigs[0])
+	assert.Nil(t, err)
+
+	isAllocated, err := handler.ipAllocator.IsAllocated(ipv6IPAMName, ipv6)
+	assert.Nil(t, err)
+	assert.False(t, isAllocated)
+	exists, err := handler.cacheAllocator.HasMAC(ipv6IPAMName, testMACAddress1)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	ipPool, err = handler.ippoolClient.Get(testIPPoolNamespace, testIPPoolName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, util.IPv6Leases(ipPool.Status.IPv6))
+}
+
+func TestHandler_ExternalIPAM(t *testing.T) {
+	const externalIPAddress = "192.168.0.150"
+
+	testCases := []struct {
+		name          string
+		answer        func(w http.ResponseWriter)
+		failurePolicy networkv1.ExternalIPAMFailurePolicy
+		allocated     string
+		// otherURL allows another URL than the one of the webhook
+		otherURL    bool
+		unlabeled   bool
+		expectedIP  string
+		expectedErr string
+		fallback    bool
+	}{
+		{
+			name: "address answered is allocated",
+			answer: func(w http.ResponseWriter) {
+				_, _ = w.Write([]byte(`{"ipAddress":"` + externalIPAddress + `"}`))
+			},
+			expectedIP: externalIPAddress,
+		},
+		{
+			name: "address out of the pool range fails",
+			answer: func(w http.ResponseWriter) {
+				_, _ = w.Write([]byte(`{"ipAddress":"192.168.0.50"}`))
+			},
+			expectedErr: "ip 192.168.0.50 is out of the range 192.168.0.101-192.168.0.200 of ippool " + testIPPoolNamespace + "/" + testIPPoolName,
+		},
+		{
+			name: "address already allocated fails",
+			answer: func(w http.ResponseWriter) {
+				_, _ = w.Write([]byte(`{"ipAddress":"` + externalIPAddress + `"}`))
+			},
+			allocated:   externalIPAddress,
+			expectedErr: "designated ip " + externalIPAddress + " is already allocated",
+		},
+		{
+			name: "failing webhook fails",
+			answer: func(w http.ResponseWriter) {
+				http.Error(w, "boom", http.StatusBadGateway)
+			},
+			expectedErr: "external ipam answered 502 Bad Gateway to Allocate",
+		},
+		{
+			name: "failing webhook allocates locally",
+			answer: func(w http.ResponseWriter) {
+				http.Error(w, "boom", http.StatusBadGateway)
+			},
+			failurePolicy: networkv1.ExternalIPAMFailurePolicyAllocateLocally,
+			fallback:      true,
+		},
+		{
+			name: "url not allowed fails without asking",
+			answer: func(w http.ResponseWriter) {
+				_, _ = w.Write([]byte(`{"ipAddress":"` + externalIPAddress + `"}`))
+			},
+			otherURL:    true,
+			expectedErr: "is not allowed for external ipams",
+		},
+		{
+			name: "auth secret not labeled fails without asking",
+			answer: func(w http.ResponseWriter) {
+				_, _ = w.Write([]byte(`{"ipAddress":"` + externalIPAddress + `"}`))
+			},
+			unlabeled:   true,
+			expectedErr: "auth secret " + testIPPoolNamespace + "/ipam-token of the external ipam isn't labeled " + util.ExternalIPAMAuthLabelKey + "=true",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests []externalipam.Request
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var request externalipam.Request
+				_ = json.NewDecoder(r.Body).Decode(&request)
+				requests = append(requests, request)
+				assert.Equal(t, "Bearer token-1", r.Header.Get("Authorization"))
+				if request.Operation == externalipam.OperationRelease {
+					return
+				}
+				tc.answer(w)
+			}))
+			defer server.Close()
+
+			givenVmNetCfg := newTestVmNetCfgBuilder().
+				WithVMName(testVmNetCfgName).
+				WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+			givenIPPool := newTestIPPoolBuilder().
+				ServerIP(testServerIP).
+				CIDR(testCIDR).
+				PoolRange(testStartIP, testEndIP).
+				NetworkName(testNetworkName).
+				ExternalIPAM(server.URL, tc.failurePolicy).
+				ExternalIPAMAuthSecret("ipam-token", "token").
+				CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+			givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+				Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+				Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+			givenSecret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: testIPPoolNamespace,
+					Name:      "ipam-token",
+					Labels:    map[string]string{util.ExternalIPAMAuthLabelKey: "true"},
+				},
+				Data: map[string][]byte{"token": []byte("token-1\n")},
+			}
+			if tc.unlabeled {
+				givenSecret.Labels = nil
+			}
+			allowedURLs := []string{server.URL}
+			if tc.otherURL {
+				allowedURLs = []string{"https://ipam.example.com"}
+			}
+			externalIPAM := externalipam.NewClient(clock.RealClock{}, externalipam.DefaultFailureThreshold, externalipam.DefaultCooldown)
+			externalIPAM.SetTransport(server.Client().Transport)
+
+			nadGVR := schema.GroupVersionResource{
+				Group:    "k8s.cni.cncf.io",
+				Version:  "v1",
+				Resource: "network-attachment-definitions",
+			}
+
+			clientset := fake.NewSimpleClientset(givenIPPool)
+			err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+			ipAllocatorBuilder := newTestIPAllocatorBuilder().
+				IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP)
+			if tc.allocated != "" {
+				ipAllocatorBuilder = ipAllocatorBuilder.Allocate(testNetworkName, tc.allocated)
+			}
+
+			recorder := record.NewFakeRecorder(10)
+			handler := Handler{
+				cacheAllocator: newTestCacheAllocatorBuilder().
+					MACSet(testNetworkName).Build(),
+				ipAllocator:      ipAllocatorBuilder.Build(),
+				metricsAllocator: metrics.New(),
+				externalIPAM:     externalIPAM,
+				externalIPAMURLs: allowedURLs,
+				secretClient:     k8sfake.NewSimpleClientset(givenSecret).CoreV1(),
+				recorder:         recorder,
+				clock:            clock.RealClock{},
+				pending:          newPendingIndex(clock.RealClock{}),
+				ippoolClient:     fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+				ippoolCache:      fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+				nadCache:         fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			}
+
+			status, err := handler.Allocate(givenVmNetCfg, givenVmNetCfg.Status)
+
+			// The webhook is told who the address is for, unless it may not
+			// be asked with the token
+			if tc.otherURL || tc.unlabeled {
+				assert.Empty(t, requests)
+			} else if assert.NotEmpty(t, requests) {
+				assert.Equal(t, externalipam.Request{
+					Operation:   externalipam.OperationAllocate,
+					IPPool:      testIPPoolNamespace + "/" + testIPPoolName,
+					NetworkName: testNetworkName,
+					CIDR:        testCIDR,
+					MACAddress:  testMACAddress1,
+					VmNetCfg:    testKey,
+					VMName:      testVmNetCfgName,
+				}, requests[0])
+			}
+
+			if tc.expectedErr != "" {
+				if assert.NotNil(t, err) {
+					assert.Contains(t, err.Error(), tc.expectedErr)
+				}
+				if assert.NotEmpty(t, recorder.Events) {
+					assert.True(t, strings.HasPrefix(<-recorder.Events, "Warning "+ReasonExternalIPAMFailed+" "))
+				}
+				allocated, _ := handler.ipAllocator.IsAllocated(testNetworkName, externalIPAddress)
+				assert.Equal(t, tc.allocated != "", allocated, "address answered should only be held if it was already")
+				return
+			}
+
+			if !assert.Nil(t, err) || !assert.Len(t, status.NetworkConfigs, 1) {
+				return
+			}
+			ncStatus := status.NetworkConfigs[0]
+			if tc.fallback {
+				assert.NotEmpty(t, ncStatus.AllocatedIPAddress)
+				assert.Len(t, recorder.Events, 1)
+			} else {
+				assert.Equal(t, tc.expectedIP, ncStatus.AllocatedIPAddress)
+				assert.Empty(t, recorder.Events)
+			}
+
+			// The release is reported as well
+			requests = nil
+			givenVmNetCfg.Status = status
+			assert.Nil(t, handler.cleanup(givenVmNetCfg, false))
+			if assert.Len(t, requests, 1) {
+				assert.Equal(t, externalipam.OperationRelease, requests[0].Operation)
+				assert.Equal(t, ncStatus.AllocatedIPAddress, requests[0].IPAddress)
+			}
+		})
+	}
+}
+
+func TestHandler_IPPoolUnavailable(t *testing.T) {
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	newTestHandler := func(t *testing.T, objs ...runtime.Object) (*Handler, *fake.Clientset) {
+		givenNAD := newTestNetworkAttachmentDefinitionBuilder().
+			Label(util.IPPoolNamespaceLabelKey, testIPPoolNamespace).
+			Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+		clientset := fake.NewSimpleClientset(objs...)
+		err := clientset.Tracker().Create(nadGVR, givenNAD, givenNAD.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		return &Handler{
+			cacheAllocator: newTestCacheAllocatorBuilder().
+				MACSet(testNetworkName).Build(),
+			ipAllocator: newTestIPAllocatorBuilder().
+				IPSubnet(testNetworkName, testCIDR, testStartIP, testEndIP).Build(),
+			metricsAllocator: metrics.New(),
+			denialLog:        audit.NewDenialLog(clock.RealClock{}, audit.DefaultDenialLogSize),
+			clock:            clock.RealClock{},
+			pending:          newPendingIndex(clock.RealClock{}),
+			poolGenerations:  newPoolGenerations(),
+			vmnetcfgClient:   fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			vmnetcfgCache: indexedVmNetCfgCache{
+				fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			},
+			ippoolClient: fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			ippoolCache:  fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			nadCache:     fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		}, clientset
+	}
+
+	t.Run("ippool deleted after admission and recreated", func(t *testing.T) {
+		givenVmNetCfg := newTestVmNetCfgBuilder().
+			WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+		givenIPPool := newTestIPPoolBuilder().
+			ServerIP(testServerIP).
+			CIDR(testCIDR).
+			PoolRange(testStartIP, testEndIP).
+			NetworkName(testNetworkName).
+			CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+
+		handler, clientset := newTestHandler(t, givenVmNetCfg, givenIPPool)
+		allocate := &allocateStatusHandler{client: handler.vmnetcfgClient, handler: handler.Allocate, clock: handler.clock}
+
+		// Seen by the controller, then deleted before the vmnetcfg is first
+		// reconciled
+		_, err := handler.vmNetCfgsOfIPPool(testIPPoolNamespace, testIPPoolName, givenIPPool)
+		assert.Nil(t, err)
+		err = clientset.NetworkV1alpha1().IPPools(testIPPoolNamespace).Delete(context.Background(), testIPPoolName, metav1.DeleteOptions{})
+		assert.Nil(t, err)
+		_, err = handler.vmNetCfgsOfIPPool(testIPPoolNamespace, testIPPoolName, nil)
+		assert.Nil(t, err)
+
+		vmNetCfg, err := allocate.sync(testKey, givenVmNetCfg)
+		assert.NotNil(t, err)
+		assert.True(t, networkv1.Allocated.IsFalse(vmNetCfg))
+		assert.Equal(t, ReasonPoolMissing, networkv1.Allocated.GetReason(vmNetCfg))
+
+		// Recreating the ippool wakes the vmnetcfg up
+		_, err = clientset.NetworkV1alpha1().IPPools(testIPPoolNamespace).Create(context.Background(), givenIPPool, metav1.CreateOptions{})
+		assert.Nil(t, err)
+		keys, err := handler.vmNetCfgsOfIPPool(testIPPoolNamespace, testIPPoolName, givenIPPool)
+		assert.Nil(t, err)
+		assert.Equal(t, []relatedresource.Key{{Namespace: testVmNetCfgNamespace, Name: testVmNetCfgName}}, keys)
+
+		vmNetCfg, err = handler.vmnetcfgCache.Get(testVmNetCfgNamespace, testVmNetCfgName)
+		assert.Nil(t, err)
+		vmNetCfg, err = allocate.sync(testKey, vmNetCfg)
+		assert.Nil(t, err)
+		assert.True(t, networkv1.Allocated.IsTrue(vmNetCfg))
+		assert.Empty(t, networkv1.Allocated.GetReason(vmNetCfg))
+		if assert.Len(t, vmNetCfg.Status.NetworkConfigs, 1) {
+			assert.Equal(t, networkv1.AllocatedState, vmNetCfg.Status.NetworkConfigs[0].State)
+			assert.NotEmpty(t, vmNetCfg.Status.NetworkConfigs[0].AllocatedIPAddress)
+		}
+
+		// Only the vmnetcfgs awaiting an ippool are woken up
+		handler.poolGenerations.Forget(testIPPoolNamespace + "/" + testIPPoolName)
+		keys, err = handler.vmNetCfgsOfIPPool(testIPPoolNamespace, testIPPoolName, givenIPPool)
+		assert.Nil(t, err)
+		assert.Empty(t, keys)
+	})
+
+	testCases := []struct {
+		name     string
+		ipPool   *networkv1.IPPool
+		reason   string
+		errMsg   string
+		awaiting bool
+	}{
+		{
+			name: "ippool being deleted",
+			ipPool: func() *networkv1.IPPool {
+				ipPool := newTestIPPoolBuilder().
+					ServerIP(testServerIP).
+					CIDR(testCIDR).
+					PoolRange(testStartIP, testEndIP).
+					NetworkName(testNetworkName).
+					CacheReadyCondition(corev1.ConditionTrue, "", "").Build()
+				ipPool.Finalizers = []string{"wrangler.cattle.io/vm-dhcp-ippool-controller"}
+				ipPool.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+				return ipPool
+			}(),
+			reason:   ReasonPoolDraining,
+			errMsg:   fmt.Sprintf("ippool %s/%s is being deleted", testIPPoolNamespace, testIPPoolName),
+			awaiting: true,
+		},
+		{
+			name: "ippool paused",
+			ipPool: newTestIPPoolBuilder().
+				ServerIP(testServerIP).
+				CIDR(testCIDR).
+				PoolRange(testStartIP, testEndIP).
+				NetworkName(testNetworkName).
+				Paused().
+				CacheReadyCondition(corev1.ConditionTrue, "", "").Build(),
+			reason: ReasonPoolPaused,
+			errMsg: fmt.Sprintf("ippool %s/%s is paused", testIPPoolNamespace, testIPPoolName),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			givenVmNetCfg := newTestVmNetCfgBuilder().
+				WithNetworkConfig("", testMACAddress1, testNetworkName).Build()
+
+			handler, _ := newTestHandler(t, givenVmNetCfg, tc.ipPool)
+			now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			allocate := &allocateStatusHandler{client: handler.vmnetcfgClient, handler: handler.Allocate, clock: clock.NewFakeClock(now)}
+
+			vmNetCfg, err := allocate.sync(testKey, givenVmNetCfg)
+			assert.EqualError(t, err, tc.errMsg)
+			assert.True(t, networkv1.Allocated.IsFalse(vmNetCfg))
+			assert.Equal(t, tc.reason, networkv1.Allocated.GetReason(vmNetCfg))
+			assert.Equal(t, tc.errMsg, networkv1.Allocated.GetMessage(vmNetCfg))
+			assert.Equal(t, now.Format(time.RFC3339), networkv1.Allocated.GetLastUpdated(vmNetCfg))
+			assert.Equal(t, tc.awaiting, isAwaitingIPPool(vmNetCfg))
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package vmnetcfg
+
+import (
+	"fmt"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// ReasonVMNotStarted is the reason of the DeferredAllocation condition of the
+// VirtualMachineNetworkConfigs whose VM hasn't been started yet.
+const ReasonVMNotStarted = "VMNotStarted"
+
+// allocationDeferredError tells the allocation waits for the VM to be first
+// started. It sets the Allocated condition to false like any other error, but
+// isn't retried with backoff, as the VM trigger enqueues the
+// VirtualMachineNetworkConfig as soon as the VM changes.
+type allocationDeferredError struct {
+	vmNetCfgKey string
+}
+
+func (e allocationDeferredError) Error() string {
+	return fmt.Sprintf("allocation of vmnetcfg %s deferred until its vm is started", e.vmNetCfgKey)
+}
+
+// Is keeps the error from being retried by the controller. The condition is
+// still set, as only generic.ErrSkip itself is taken as a success.
+func (e allocationDeferredError) Is(target error) bool {
+	return target == generic.ErrSkip
+}
+
+// isAllocationDeferred reports whether the allocation of the IP addresses of
+// the VirtualMachineNetworkConfig waits for its VM to be first started. Only
+// VirtualMachineNetworkConfigs without any IP address yet are deferred, so
+// the VM keeps the ones it got on its first start when stopped and started
+// again.
+func (h *Handler) isAllocationDeferred(vmNetCfg *networkv1.VirtualMachineNetworkConfig) (bool, error) {
+	for _, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+		if ncStatus.AllocatedIPAddress != "" {
+			return false, nil
+		}
+	}
+
+	// The VM cache isn't set up in tests not caring about it
+	if h.vmCache == nil {
+		return false, nil
+	}
+
+	vm, err := h.vmCache.Get(vmNetCfg.Namespace, vmNetCfg.Spec.VMName)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if h.allocationTiming(vm) != config.AllocationTimingOnFirstStart {
+		return false, nil
+	}
+
+	return !isVMStarted(vm), nil
+}
+
+// allocationTiming returns the allocation timing of the VM, which falls back
+// to the one of the controller.
+func (h *Handler) allocationTiming(vm *kubevirtv1.VirtualMachine) string {
+	timing, ok := vm.Annotations[util.AllocationTimingAnnotationKey]
+	if !ok {
+		return h.defaultAllocationTiming
+	}
+
+	switch timing {
+	case config.AllocationTimingImmediate, config.AllocationTimingOnFirstStart:
+		return timing
+	default:
+		logrus.Warnf("(vmnetcfg.allocationTiming) vm %s/%s has invalid allocation timing %q, fall back to %q",
+			vm.Namespace, vm.Name, timing, h.defaultAllocationTiming)
+		return h.defaultAllocationTiming
+	}
+}
+
+// isVMStarted reports whether the VM is meant to run, or runs anyway, e.g.,
+// as it was started through the API with the Manual run strategy.
+func isVMStarted(vm *kubevirtv1.VirtualMachine) bool {
+	if vm.Status.Created {
+		return true
+	}
+
+	runStrategy, err := vm.RunStrategy()
+	if err != nil {
+		return false
+	}
+
+	switch runStrategy {
+	case kubevirtv1.RunStrategyAlways, kubevirtv1.RunStrategyRerunOnFailure, kubevirtv1.RunStrategyOnce:
+		return true
+	default:
+		return false
+	}
+}
+
+// syncDeferredAllocation sets the DeferredAllocation condition of the
+// VirtualMachineNetworkConfig. The condition is only added once an
+// allocation gets deferred.
+func syncDeferredAllocation(vmNetCfg *networkv1.VirtualMachineNetworkConfig, deferred bool) {
+	if deferred {
+		networkv1.DeferredAllocation.True(vmNetCfg)
+		networkv1.DeferredAllocation.Reason(vmNetCfg, ReasonVMNotStarted)
+		networkv1.DeferredAllocation.Message(vmNetCfg, fmt.Sprintf("IP addresses are allocated once vm %s is started", vmNetCfg.Spec.VMName))
+		return
+	}
+
+	if networkv1.DeferredAllocation.GetStatus(vmNetCfg) != "" {
+		networkv1.DeferredAllocation.False(vmNetCfg)
+		networkv1.DeferredAllocation.Reason(vmNetCfg, "")
+		networkv1.DeferredAllocation.Message(vmNetCfg, "")
+	}
+}
@@ -0,0 +1,179 @@
+package vmnetcfg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/externalipam"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// allocateIPFromIPPool allocates an IP address of the IPPool to the network
+// config, asking the external IPAM of the IPPool for it if it has one. An IP
+// address the external IPAM answers with is only taken if it's within the
+// range of the IPPool and free. Failing that, or the external IPAM failing,
+// either fails the allocation or falls back on allocating one locally, as
+// told by the failure policy.
+func (h *Handler) allocateIPFromIPPool(vmNetCfg *networkv1.VirtualMachineNetworkConfig, ipPool *networkv1.IPPool, nc networkv1.NetworkConfig, dIP string) (string, error) {
+	if ipPool.Spec.ExternalIPAM == nil || h.externalIPAM == nil {
+		return h.allocateIP(ipPool, dIP, nc.MACAddress)
+	}
+
+	ipPoolKey := ipPool.Namespace + "/" + ipPool.Name
+	ip, err := h.allocateExternally(vmNetCfg, ipPool, nc, dIP)
+	if err == nil {
+		return ip, nil
+	}
+
+	policy := util.ExternalIPAMFailurePolicy(ipPool)
+	logrus.Warnf("(vmnetcfg.allocateIPFromIPPool) external ipam of ippool %s failed for %s of vmnetcfg %s/%s, follow the %s failure policy: %s",
+		ipPoolKey, nc.MACAddress, vmNetCfg.Namespace, vmNetCfg.Name, policy, err.Error())
+	if h.recorder != nil {
+		h.recorder.Eventf(vmNetCfg, corev1.EventTypeWarning, ReasonExternalIPAMFailed,
+			"External ipam of ippool %s failed for mac address %s, following the %s failure policy: %s", ipPoolKey, nc.MACAddress, policy, err.Error())
+	}
+	if policy == networkv1.ExternalIPAMFailurePolicyAllocateLocally {
+		return h.allocateIP(ipPool, dIP, nc.MACAddress)
+	}
+
+	// The error isn't wrapped, so it's never mistaken for the exhaustion or
+	// conflict of the IPPool itself
+	return net.IPv4zero.String(), fmt.Errorf("external ipam of ippool %s: %s", ipPoolKey, err.Error())
+}
+
+// allocateExternally asks the external IPAM of the IPPool for the IP address
+// of the network config and allocates it.
+func (h *Handler) allocateExternally(vmNetCfg *networkv1.VirtualMachineNetworkConfig, ipPool *networkv1.IPPool, nc networkv1.NetworkConfig, dIP string) (string, error) {
+	endpoint, err := h.externalIPAMEndpoint(ipPool)
+	if err != nil {
+		return "", err
+	}
+
+	request := h.externalIPAMRequest(vmNetCfg.Namespace, vmNetCfg.Name, vmNetCfg.Spec.VMName, ipPool, nc.MACAddress)
+	if dIP != net.IPv4zero.String() {
+		request.IPAddress = dIP
+	}
+
+	return h.externalIPAM.Allocate(context.Background(), ipPool.Namespace+"/"+ipPool.Name, endpoint, request, func(ip string) error {
+		if err := checkInPoolRange(ipPool, ip); err != nil {
+			return err
+		}
+		_, err := h.allocateIP(ipPool, ip, nc.MACAddress)
+		return err
+	})
+}
+
+// reportRelease tells the external IPAM of the IPPool the IP address of
+// ncStatus was allocated from, if it has one, about its release. It's best
+// effort, a failure being logged only, as the IP address is released anyway.
+func (h *Handler) reportRelease(vmNetCfg *networkv1.VirtualMachineNetworkConfig, ncStatus networkv1.NetworkConfigStatus) {
+	if h.externalIPAM == nil || ncStatus.AllocatedIPAddress == "" {
+		return
+	}
+
+	ipPool, err := h.getIPPoolFromNetworkConfigStatus(vmNetCfg.Namespace, ncStatus)
+	if err != nil || ipPool.Spec.ExternalIPAM == nil {
+		return
+	}
+	ipPoolKey := ipPool.Namespace + "/" + ipPool.Name
+
+	endpoint, err := h.externalIPAMEndpoint(ipPool)
+	if err == nil {
+		request := h.externalIPAMRequest(vmNetCfg.Namespace, vmNetCfg.Name, vmNetCfg.Spec.VMName, ipPool, ncStatus.MACAddress)
+		request.IPAddress = ncStatus.AllocatedIPAddress
+		err = h.externalIPAM.Release(context.Background(), ipPoolKey, endpoint, request)
+	}
+	if err != nil {
+		logrus.Warnf("(vmnetcfg.reportRelease) failed to report the release of %s of vmnetcfg %s/%s to the external ipam of ippool %s: %s",
+			ncStatus.AllocatedIPAddress, vmNetCfg.Namespace, vmNetCfg.Name, ipPoolKey, err.Error())
+	}
+}
+
+func (h *Handler) externalIPAMRequest(vmNetCfgNamespace, vmNetCfgName, vmName string, ipPool *networkv1.IPPool, macAddress string) externalipam.Request {
+	return externalipam.Request{
+		IPPool:      ipPool.Namespace + "/" + ipPool.Name,
+		NetworkName: ipPool.Spec.NetworkName,
+		CIDR:        ipPool.Spec.IPv4Config.CIDR,
+		MACAddress:  macAddress,
+		VmNetCfg:    vmNetCfgNamespace + "/" + vmNetCfgName,
+		VMName:      vmName,
+	}
+}
+
+// externalIPAMEndpoint returns the endpoint of the external IPAM of the
+// IPPool, along with the token read from its auth Secret, if any. Anyone able
+// to write an IPPool picks the URL and the Secret, so the URL has to be one
+// the admin allowed, and the Secret one the admin labeled for the purpose,
+// before the token is read and sent along.
+func (h *Handler) externalIPAMEndpoint(ipPool *networkv1.IPPool) (externalipam.Endpoint, error) {
+	spec := ipPool.Spec.ExternalIPAM
+	if err := externalipam.CheckURL(spec.URL, h.externalIPAMURLs); err != nil {
+		return externalipam.Endpoint{}, err
+	}
+
+	endpoint := externalipam.Endpoint{
+		URL:     spec.URL,
+		Timeout: externalipam.DefaultTimeout,
+	}
+	if spec.TimeoutSeconds != nil && *spec.TimeoutSeconds > 0 {
+		endpoint.Timeout = time.Duration(*spec.TimeoutSeconds) * time.Second
+	}
+
+	ref := spec.AuthSecretRef
+	if ref == nil {
+		return endpoint, nil
+	}
+	if h.secretClient == nil {
+		return endpoint, fmt.Errorf("auth secret %s/%s of the external ipam can't be read", ipPool.Namespace, ref.Name)
+	}
+	secret, err := h.secretClient.Secrets(ipPool.Namespace).Get(context.Background(), ref.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) && ref.Optional != nil && *ref.Optional {
+		return endpoint, nil
+	}
+	if err != nil {
+		return endpoint, fmt.Errorf("auth secret %s/%s of the external ipam: %w", ipPool.Namespace, ref.Name, err)
+	}
+	if secret.Labels[util.ExternalIPAMAuthLabelKey] != "true" {
+		return endpoint, fmt.Errorf("auth secret %s/%s of the external ipam isn't labeled %s=true", ipPool.Namespace, ref.Name, util.ExternalIPAMAuthLabelKey)
+	}
+	token, ok := secret.Data[ref.Key]
+	if !ok {
+		if ref.Optional != nil && *ref.Optional {
+			return endpoint, nil
+		}
+		return endpoint, fmt.Errorf("auth secret %s/%s of the external ipam has no key %s", ipPool.Namespace, ref.Name, ref.Key)
+	}
+	endpoint.Token = strings.TrimSpace(string(token))
+
+	return endpoint, nil
+}
+
+// checkInPoolRange makes sure the IP address is within the range of the
+// IPPool.
+func checkInPoolRange(ipPool *networkv1.IPPool, ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is4() {
+		return fmt.Errorf("%s is not an ipv4 address", ip)
+	}
+
+	poolInfo, err := util.LoadPool(ipPool)
+	if err != nil {
+		return err
+	}
+	if addr.Less(poolInfo.StartIPAddr) || poolInfo.EndIPAddr.Less(addr) {
+		return fmt.Errorf("ip %s is out of the range %s-%s of ippool %s/%s",
+			ip, poolInfo.StartIPAddr, poolInfo.EndIPAddr, ipPool.Namespace, ipPool.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package vmnetcfg
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// allocateIPv6 returns the IPv6 address of the MAC address in the IPv6
+// addressing of ipPool, allocating one if it has none yet, or an empty string
+// if the IPPool has no IPv6 addressing. The address of the previous status,
+// prevIP, is asked for first, so it's kept across rebuilds of the IPAM.
+func (h *Handler) allocateIPv6(ipPool *networkv1.IPPool, macAddress, prevIP string) (string, error) {
+	if ipPool.Spec.IPv6Config == nil {
+		return "", nil
+	}
+
+	ipamName := util.IPv6IPAMName(ipPool)
+	if !h.ipAllocator.IsNetworkInitialized(ipamName) {
+		return "", fmt.Errorf("ipv6 ipam of ippool %s/%s is not initialized", ipPool.Namespace, ipPool.Name)
+	}
+
+	exists, err := h.cacheAllocator.HasMAC(ipamName, macAddress)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return h.cacheAllocator.GetIPByMAC(ipamName, macAddress)
+	}
+
+	var ip string
+	if prevIP != "" {
+		if ip, err = h.ipAllocator.AllocateIP(ipamName, prevIP); err != nil {
+			logrus.Warnf("(vmnetcfg.allocateIPv6) previous ip %s of %s is not available in ipam %s, allocate another one: %s", prevIP, macAddress, ipamName, err.Error())
+			ip = ""
+		}
+	}
+	if ip == "" {
+		if ip, err = h.ipAllocator.AllocateIP(ipamName, "::"); err != nil {
+			return "", err
+		}
+	}
+
+	if err := h.cacheAllocator.AddMAC(ipamName, macAddress, ip); err != nil {
+		return "", err
+	}
+
+	return ip, nil
+}
+
+// releaseIPv6 gives the IPv6 address of ncStatus back to the IPAM named
+// ipamName, if it's set up.
+func (h *Handler) releaseIPv6(ipamName string, ncStatus networkv1.NetworkConfigStatus) error {
+	if !h.ipAllocator.IsNetworkInitialized(ipamName) {
+		return nil
+	}
+
+	if ncStatus.AllocatedIPv6Address != "" {
+		isAllocated, err := h.ipAllocator.IsAllocated(ipamName, ncStatus.AllocatedIPv6Address)
+		if err != nil {
+			return err
+		}
+		if isAllocated {
+			if err := h.ipAllocator.DeallocateIP(ipamName, ncStatus.AllocatedIPv6Address); err != nil {
+				return err
+			}
+		}
+	}
+
+	exists, err := h.cacheAllocator.HasMAC(ipamName, ncStatus.MACAddress)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return h.cacheAllocator.DeleteMAC(ipamName, ncStatus.MACAddress)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package vmnetcfg
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+// pendingReasons are the reasons tracked by the pending index. Every one of
+// them is always reported, so the series don't disappear when they drop to
+// zero.
+var pendingReasons = []networkv1.PendingReason{
+	networkv1.PendingReasonPoolExhausted,
+	networkv1.PendingReasonPoolPaused,
+	networkv1.PendingReasonAnnotationMismatch,
+	networkv1.PendingReasonStaticIPInUse,
+}
+
+type waiter struct {
+	ipPoolKey string
+	reason    networkv1.PendingReason
+	since     time.Time
+}
+
+// pendingIndex keeps track of the VirtualMachineNetworkConfigs waiting for an
+// IP address. It lives in memory only, so the waiting time restarts along
+// with the controller.
+type pendingIndex struct {
+	clock   clock.Clock
+	waiters map[string]waiter
+	mutex   sync.RWMutex
+}
+
+func newPendingIndex(clock clock.Clock) *pendingIndex {
+	return &pendingIndex{
+		clock:   clock,
+		waiters: make(map[string]waiter),
+	}
+}
+
+// Add records the VirtualMachineNetworkConfig as waiting on the IPPool. The
+// waiting time is kept as long as it waits on the same IPPool. It returns
+// the key of the IPPool it was previously waiting on, if any.
+func (i *pendingIndex) Add(vmNetCfgKey, ipPoolKey string, reason networkv1.PendingReason) string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	previous, ok := i.waiters[vmNetCfgKey]
+	since := i.clock.Now()
+	if ok && previous.ipPoolKey == ipPoolKey {
+		since = previous.since
+	}
+
+	i.waiters[vmNetCfgKey] = waiter{
+		ipPoolKey: ipPoolKey,
+		reason:    reason,
+		since:     since,
+	}
+
+	return previous.ipPoolKey
+}
+
+// Remove drops the VirtualMachineNetworkConfig from the index and returns the
+// key of the IPPool it was waiting on, if any.
+func (i *pendingIndex) Remove(vmNetCfgKey string) string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	previous := i.waiters[vmNetCfgKey]
+	delete(i.waiters, vmNetCfgKey)
+
+	return previous.ipPoolKey
+}
+
+// Stats summarizes the waiters of the IPPool. It returns nil if nothing is
+// waiting on it.
+func (i *pendingIndex) Stats(ipPoolKey string) *networkv1.PendingAllocations {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	var (
+		pending     networkv1.PendingAllocations
+		oldestSince time.Time
+	)
+	for _, w := range i.waiters {
+		if w.ipPoolKey != ipPoolKey {
+			continue
+		}
+		if pending.Reasons == nil {
+			pending.Reasons = make(map[networkv1.PendingReason]int)
+		}
+		pending.Count++
+		pending.Reasons[w.reason]++
+		if oldestSince.IsZero() || w.since.Before(oldestSince) {
+			oldestSince = w.since
+		}
+	}
+
+	if pending.Count == 0 {
+		return nil
+	}
+
+	// Status timestamps are serialized with second precision
+	since := metav1.NewTime(oldestSince.Truncate(time.Second))
+	pending.OldestSince = &since
+
+	return &pending
+}
+
+func pendingAllocationsEqual(a, b *networkv1.PendingAllocations) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Count == b.Count && reflect.DeepEqual(a.Reasons, b.Reasons) && a.OldestSince.Equal(b.OldestSince)
+}
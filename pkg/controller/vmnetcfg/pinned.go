@@ -0,0 +1,90 @@
+package vmnetcfg
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// PinAllocations keeps the IP addresses allocated to the VM of the
+// VirtualMachineNetworkConfig pinned in the pinned allocations annotation of
+// the VM. The IPPool controller restores them from there into IPPools lacking
+// them, so the VMs keep their IP addresses when the IPPools are recreated,
+// e.g., after reinstalling the controller and its CRDs.
+func (h *Handler) PinAllocations(key string, vmNetCfg *networkv1.VirtualMachineNetworkConfig) (*networkv1.VirtualMachineNetworkConfig, error) {
+	if vmNetCfg == nil || vmNetCfg.DeletionTimestamp != nil {
+		return vmNetCfg, nil
+	}
+
+	vm, err := h.vmCache.Get(vmNetCfg.Namespace, vmNetCfg.Spec.VMName)
+	if apierrors.IsNotFound(err) {
+		return vmNetCfg, nil
+	}
+	if err != nil {
+		return vmNetCfg, err
+	}
+
+	previous, err := util.PinnedAllocations(vm.Annotations, h.pinnedAllocationsAnnotation)
+	if err != nil {
+		// Overwritten with what's allocated now
+		logrus.Warnf("(vmnetcfg.PinAllocations) vm %s/%s: %s", vm.Namespace, vm.Name, err.Error())
+	}
+	pinned := pinAllocations(vmNetCfg, previous)
+	if err == nil && reflect.DeepEqual(pinned, previous) {
+		return vmNetCfg, nil
+	}
+
+	vmCpy := vm.DeepCopy()
+	if len(pinned) == 0 {
+		delete(vmCpy.Annotations, h.pinnedAllocationsAnnotation)
+	} else {
+		data, err := json.Marshal(pinned)
+		if err != nil {
+			return vmNetCfg, err
+		}
+		if vmCpy.Annotations == nil {
+			vmCpy.Annotations = make(map[string]string)
+		}
+		vmCpy.Annotations[h.pinnedAllocationsAnnotation] = string(data)
+	}
+
+	logrus.Debugf("(vmnetcfg.PinAllocations) pin allocations of vm %s/%s: %s", vm.Namespace, vm.Name, vmCpy.Annotations[h.pinnedAllocationsAnnotation])
+	_, err = h.vmClient.Update(vmCpy)
+	return vmNetCfg, err
+}
+
+// pinAllocations returns the allocations to pin for the network configs of
+// vmNetCfg, in their order. Network configs without an allocated IP address
+// keep the one pinned before, if any, so a VirtualMachineNetworkConfig
+// recreated with an empty status doesn't wipe the pinned allocations out
+// before they're restored. Only the network configs gone from the spec lose
+// theirs.
+func pinAllocations(vmNetCfg *networkv1.VirtualMachineNetworkConfig, previous []util.PinnedAllocation) []util.PinnedAllocation {
+	previousByMAC := make(map[string]util.PinnedAllocation, len(previous))
+	for _, allocation := range previous {
+		previousByMAC[util.NormalizeMAC(allocation.MACAddress)] = allocation
+	}
+
+	var pinned []util.PinnedAllocation
+	for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+		ncStatus, ok := findNetworkConfigStatusByMACAddress(vmNetCfg.Status.NetworkConfigs, nc.MACAddress)
+		if ok && ncStatus.State == networkv1.AllocatedState && ncStatus.AllocatedIPAddress != "" && ncStatus.IPPoolRef != "" {
+			pinned = append(pinned, util.PinnedAllocation{
+				MACAddress: ncStatus.MACAddress,
+				IPAddress:  ncStatus.AllocatedIPAddress,
+				IPPool:     ncStatus.IPPoolRef,
+			})
+			continue
+		}
+		if allocation, ok := previousByMAC[util.NormalizeMAC(nc.MACAddress)]; ok {
+			pinned = append(pinned, allocation)
+		}
+	}
+
+	return pinned
+}
@@ -0,0 +1,175 @@
+package vmnetcfg
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rancher/wrangler/v3/pkg/relatedresource"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
+)
+
+const (
+	// ReasonPoolMissing is the reason of the Allocated condition of the
+	// VirtualMachineNetworkConfigs whose network has no IPPool anymore, e.g.,
+	// deleted after they were admitted.
+	ReasonPoolMissing = "PoolMissing"
+	// ReasonPoolDraining is the reason of the Allocated condition of the
+	// VirtualMachineNetworkConfigs whose IPPool is being deleted.
+	ReasonPoolDraining = "PoolDraining"
+	// ReasonPoolPaused is the reason of the Allocated condition of the
+	// VirtualMachineNetworkConfigs whose IPPool is paused.
+	ReasonPoolPaused = "PoolPaused"
+)
+
+// poolUnavailableError tells the allocation can't go on as the IPPool of the
+// network is missing, being deleted, or paused. Its reason is set on the
+// Allocated condition, so these are told apart from the other failures.
+type poolUnavailableError struct {
+	reason string
+	err    error
+}
+
+func (e *poolUnavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *poolUnavailableError) Unwrap() error {
+	return e.err
+}
+
+// checkIPPoolAvailable makes sure the IPPool can hand out IP addresses, i.e.,
+// it's neither being deleted nor paused.
+func checkIPPoolAvailable(ipPool *networkv1.IPPool) error {
+	if ipPool.DeletionTimestamp != nil {
+		return &poolUnavailableError{
+			reason: ReasonPoolDraining,
+			err:    fmt.Errorf("ippool %s/%s is being deleted", ipPool.Namespace, ipPool.Name),
+		}
+	}
+	if ipPool.Spec.Paused != nil && *ipPool.Spec.Paused {
+		return &poolUnavailableError{
+			reason: ReasonPoolPaused,
+			err:    fmt.Errorf("ippool %s/%s is paused", ipPool.Namespace, ipPool.Name),
+		}
+	}
+	return nil
+}
+
+// asPoolMissing marks the failure to look up the IPPool of the network as the
+// IPPool missing, which it is when the lookup failed on a NotFound.
+func asPoolMissing(err error) error {
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+	return &poolUnavailableError{reason: ReasonPoolMissing, err: err}
+}
+
+// allocatedReason returns the reason of the Allocated condition for the error
+// of Allocate, which is the generic one unless the IPPool is unavailable.
+func allocatedReason(err error) string {
+	var unavailable *poolUnavailableError
+	if errors.As(err, &unavailable) {
+		return unavailable.reason
+	}
+	return ""
+}
+
+// isAwaitingIPPool reports whether the allocation of the
+// VirtualMachineNetworkConfig failed for its IPPool being missing or being
+// deleted, which is only retried with backoff otherwise.
+func isAwaitingIPPool(vmNetCfg *networkv1.VirtualMachineNetworkConfig) bool {
+	if !networkv1.Allocated.IsFalse(vmNetCfg) {
+		return false
+	}
+	switch networkv1.Allocated.GetReason(vmNetCfg) {
+	case ReasonPoolMissing, ReasonPoolDraining:
+		return true
+	}
+	return false
+}
+
+// vmNetCfgsAwaitingIPPool returns the keys of the VirtualMachineNetworkConfigs
+// on the network of the IPPool waiting for an IPPool to (re)appear, so they're
+// allocated right away once it does. IPPools being unpaused have their spec
+// changed, which resyncs all of them anyway.
+func (h *Handler) vmNetCfgsAwaitingIPPool(ipPool *networkv1.IPPool) ([]relatedresource.Key, error) {
+	if ipPool.Spec.NetworkName == "" {
+		return nil, nil
+	}
+
+	vmNetCfgs, err := h.vmnetcfgCache.GetByIndex(indexer.VmNetCfgByQualifiedNetworkIndex, ipPool.Spec.NetworkName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []relatedresource.Key
+	for _, vmNetCfg := range vmNetCfgs {
+		if !isAwaitingIPPool(vmNetCfg) {
+			continue
+		}
+		keys = append(keys, relatedresource.Key{
+			Namespace: vmNetCfg.Namespace,
+			Name:      vmNetCfg.Name,
+		})
+	}
+
+	if len(keys) > 0 {
+		logrus.Infof("(vmnetcfg.vmNetCfgsAwaitingIPPool) ippool %s/%s appeared, retry %d vmnetcfg(s) awaiting it on network %s",
+			ipPool.Namespace, ipPool.Name, len(keys), ipPool.Spec.NetworkName)
+	}
+
+	return keys, nil
+}
+
+// allocateStatusHandler runs Allocate the way the status handlers registered
+// with ctlnetworkv1.RegisterVirtualMachineNetworkConfigStatusHandler are run,
+// except the Allocated condition gets the reason of an unavailable IPPool
+// rather than the generic one.
+type allocateStatusHandler struct {
+	client  ctlnetworkv1.VirtualMachineNetworkConfigClient
+	handler ctlnetworkv1.VirtualMachineNetworkConfigStatusHandler
+	clock   clock.Clock
+}
+
+func (a *allocateStatusHandler) sync(_ string, obj *networkv1.VirtualMachineNetworkConfig) (*networkv1.VirtualMachineNetworkConfig, error) {
+	if obj == nil {
+		return obj, nil
+	}
+
+	origStatus := obj.Status.DeepCopy()
+	obj = obj.DeepCopy()
+	newStatus, err := a.handler(obj, obj.Status)
+	if err != nil {
+		// Revert to old status on error
+		newStatus = *origStatus.DeepCopy()
+	}
+
+	if apierrors.IsConflict(err) {
+		networkv1.Allocated.SetError(&newStatus, "", nil)
+	} else {
+		networkv1.Allocated.SetError(&newStatus, allocatedReason(err), err)
+	}
+	if equality.Semantic.DeepEqual(origStatus, &newStatus) {
+		return obj, err
+	}
+
+	networkv1.Allocated.LastUpdated(&newStatus, a.clock.Now().UTC().Format(time.RFC3339))
+	obj.Status = newStatus
+	newObj, updateErr := a.client.UpdateStatus(obj)
+	if err == nil {
+		err = updateErr
+	}
+	if updateErr == nil {
+		obj = newObj
+	}
+
+	return obj, err
+}
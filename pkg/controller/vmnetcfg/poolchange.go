@@ -0,0 +1,107 @@
+package vmnetcfg
+
+import (
+	"sync"
+
+	"github.com/rancher/wrangler/v3/pkg/relatedresource"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
+)
+
+// poolGenerations keeps the last seen generation of each IPPool, which is
+// bumped by the spec changes only, so the status updates made on every
+// allocation don't enqueue the whole IPPool.
+type poolGenerations struct {
+	generations map[string]int64
+	mutex       sync.Mutex
+}
+
+func newPoolGenerations() *poolGenerations {
+	return &poolGenerations{
+		generations: make(map[string]int64),
+	}
+}
+
+// Changed records the generation of the IPPool and reports whether it differs
+// from the one seen before. The first generation seen of an IPPool isn't a
+// change, as the VirtualMachineNetworkConfigs are all reconciled on start.
+func (g *poolGenerations) Changed(ipPoolKey string, generation int64) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	previous, ok := g.generations[ipPoolKey]
+	g.generations[ipPoolKey] = generation
+	return ok && previous != generation
+}
+
+// Seen reports whether a generation of the IPPool was recorded already.
+func (g *poolGenerations) Seen(ipPoolKey string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	_, ok := g.generations[ipPoolKey]
+	return ok
+}
+
+func (g *poolGenerations) Forget(ipPoolKey string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	delete(g.generations, ipPoolKey)
+}
+
+// vmNetCfgsOfIPPool returns the keys of the VirtualMachineNetworkConfigs on
+// the network of the IPPool whose spec changed, so the options they're served
+// follow the edits of the IPPool, e.g., its router or DNS servers. The ones
+// holding an IP address declined by their guest are returned regardless.
+func (h *Handler) vmNetCfgsOfIPPool(namespace, name string, obj runtime.Object) ([]relatedresource.Key, error) {
+	ipPoolKey := namespace + "/" + name
+
+	ipPool, ok := obj.(*networkv1.IPPool)
+	if !ok || ipPool == nil || ipPool.DeletionTimestamp != nil {
+		h.poolGenerations.Forget(ipPoolKey)
+		return nil, nil
+	}
+
+	conflictKeys, err := h.vmNetCfgsOfConflicts(ipPool)
+	if err != nil {
+		return nil, err
+	}
+
+	// An IPPool seen for the first time, e.g., recreated, wakes up the
+	// VirtualMachineNetworkConfigs which failed for the lack of it
+	if !h.poolGenerations.Seen(ipPoolKey) {
+		awaitingKeys, err := h.vmNetCfgsAwaitingIPPool(ipPool)
+		if err != nil {
+			return nil, err
+		}
+		conflictKeys = append(conflictKeys, awaitingKeys...)
+	}
+
+	if !h.poolGenerations.Changed(ipPoolKey, ipPool.Generation) || ipPool.Spec.NetworkName == "" {
+		return conflictKeys, nil
+	}
+
+	vmNetCfgs, err := h.vmnetcfgCache.GetByIndex(indexer.VmNetCfgByQualifiedNetworkIndex, ipPool.Spec.NetworkName)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]relatedresource.Key, 0, len(vmNetCfgs)+len(conflictKeys))
+	keys = append(keys, conflictKeys...)
+	for _, vmNetCfg := range vmNetCfgs {
+		keys = append(keys, relatedresource.Key{
+			Namespace: vmNetCfg.Namespace,
+			Name:      vmNetCfg.Name,
+		})
+	}
+
+	if len(vmNetCfgs) > 0 {
+		logrus.Infof("(vmnetcfg.vmNetCfgsOfIPPool) spec of ippool %s changed, resync %d vmnetcfg(s) on network %s", ipPoolKey, len(vmNetCfgs), ipPool.Spec.NetworkName)
+	}
+
+	return keys, nil
+}
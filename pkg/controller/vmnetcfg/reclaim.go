@@ -0,0 +1,146 @@
+package vmnetcfg
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+const (
+	leaseReclaimInterval    = time.Minute
+	leaseReclaimGracePeriod = 2 * time.Minute
+)
+
+// runLeaseReclaimer sweeps the leases of deleted namespaces right away and
+// then periodically until ctx is done.
+func (h *Handler) runLeaseReclaimer(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(context.Context) {
+		if err := h.reclaimOrphanedLeases(); err != nil {
+			logrus.Errorf("(vmnetcfg.reclaimOrphanedLeases) %s", err.Error())
+		}
+	}, leaseReclaimInterval)
+}
+
+// reclaimOrphanedLeases gives back the leases held by VMs whose namespace no
+// longer exists. Deleting a namespace can leave them behind in the IPPools of
+// other namespaces, e.g., when the finalizers of its vmnetcfgs were removed
+// by hand. A lease is only reclaimed after being seen orphaned for the whole
+// grace period, so a briefly inconsistent cache doesn't take the IP address
+// of a running VM. Leases recorded without their namespace are left alone, and
+// so are the IPPools whose status predates the current schema.
+func (h *Handler) reclaimOrphanedLeases() error {
+	if !h.featureGates.Enabled(featuregate.LeaseReclaim) {
+		logrus.Debugf("(vmnetcfg.reclaimOrphanedLeases) feature gate %s disabled, skip", featuregate.LeaseReclaim)
+		return nil
+	}
+	if h.cachesSynced != nil && !h.cachesSynced() {
+		logrus.Debug("(vmnetcfg.reclaimOrphanedLeases) caches not synced yet, skip")
+		return nil
+	}
+	if !h.warmup.IsDone() {
+		logrus.Debug("(vmnetcfg.reclaimOrphanedLeases) ipam and mac caches not warmed up yet, skip")
+		return nil
+	}
+	if !h.upgrade.IsDone() {
+		logrus.Debug("(vmnetcfg.reclaimOrphanedLeases) objects of former releases not upgraded yet, skip")
+		return nil
+	}
+
+	ipPools, err := h.ippoolCache.List("", labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	orphaned := make(map[string]time.Time, len(h.orphanedLeases))
+	for _, ipPool := range ipPools {
+		ipPoolKey := ipPool.Namespace + "/" + ipPool.Name
+		if !util.IsStatusCurrent(ipPool) {
+			logrus.Debugf("(vmnetcfg.reclaimOrphanedLeases) status of ippool %s predates schema version %d, skip", ipPoolKey, networkv1.IPPoolStatusSchemaVersion)
+			continue
+		}
+		for ip, entry := range util.AllocationEntries(ipPool.Status.IPv4) {
+			if entry.Type != networkv1.AllocationTypeLease || entry.Namespace == "" {
+				continue
+			}
+
+			_, err := h.namespaceCache.Get(entry.Namespace)
+			if err == nil {
+				continue
+			}
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+
+			key := ipPoolKey + "/" + ip
+			since, ok := h.orphanedLeases[key]
+			if !ok {
+				since = h.clock.Now()
+				logrus.Infof("(vmnetcfg.reclaimOrphanedLeases) ip %s of ippool %s is held by %s of deleted namespace %s", ip, ipPoolKey, entry.Owner, entry.Namespace)
+			}
+			if h.clock.Since(since) < leaseReclaimGracePeriod {
+				orphaned[key] = since
+				continue
+			}
+
+			if err := h.reclaimLease(ipPool, ip, entry); err != nil {
+				orphaned[key] = since
+				h.orphanedLeases = orphaned
+				return err
+			}
+		}
+	}
+	h.orphanedLeases = orphaned
+
+	return nil
+}
+
+// reclaimLease drops the lease of the IP address from the IPPool status first,
+// so the IP address can't be handed out again before that, and then from the
+// IPAM subnet and the MAC cache.
+func (h *Handler) reclaimLease(ipPool *networkv1.IPPool, ip string, entry networkv1.AllocationEntry) error {
+	ipPoolKey := ipPool.Namespace + "/" + ipPool.Name
+	logrus.Infof("(vmnetcfg.reclaimLease) reclaim ip %s of ippool %s from %s of deleted namespace %s", ip, ipPoolKey, entry.Owner, entry.Namespace)
+
+	ncStatus := networkv1.NetworkConfigStatus{
+		AllocatedIPAddress: ip,
+		MACAddress:         entry.Owner,
+		IPPoolRef:          ipPoolKey,
+	}
+	if err := h.deleteAllocationEntry(entry.Namespace, ncStatus); err != nil {
+		return err
+	}
+
+	ipamName := util.IPAMName(ipPool)
+	isAllocated, err := h.ipAllocator.IsAllocated(ipamName, ip)
+	if err != nil {
+		return err
+	}
+	if isAllocated {
+		if err := h.ipAllocator.DeallocateIP(ipamName, ip); err != nil {
+			return err
+		}
+	}
+
+	// The MAC address may have moved on to another IP address of the IPPool
+	if cachedIP, err := h.cacheAllocator.GetIPByMAC(ipamName, entry.Owner); err == nil && cachedIP == ip {
+		if err := h.cacheAllocator.DeleteMAC(ipamName, entry.Owner); err != nil {
+			return err
+		}
+	}
+
+	if h.recorder != nil {
+		h.recorder.Eventf(ipPool, corev1.EventTypeNormal, ReasonLeaseReclaimed,
+			"Reclaimed ip %s from %s as namespace %s no longer exists", ip, entry.Owner, entry.Namespace)
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package vmnetcfg
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// OnResync re-verifies the allocations of the VirtualMachineNetworkConfig when
+// asked for with the resync annotation, once per request ID. Each allocated IP
+// address is checked against the lease of its IPPool and the IPAM and MAC
+// caches, and the drift is repaired. The outcome is recorded in the status,
+// and the annotation is left in place.
+func (h *Handler) OnResync(key string, vmNetCfg *networkv1.VirtualMachineNetworkConfig) (*networkv1.VirtualMachineNetworkConfig, error) {
+	if vmNetCfg == nil || vmNetCfg.DeletionTimestamp != nil {
+		return vmNetCfg, nil
+	}
+
+	requestID := vmNetCfg.Annotations[util.ResyncAnnotationKey]
+	if requestID == "" || (vmNetCfg.Status.LastResync != nil && vmNetCfg.Status.LastResync.RequestID == requestID) {
+		return vmNetCfg, nil
+	}
+
+	if vmNetCfg.Spec.Paused != nil && *vmNetCfg.Spec.Paused {
+		return h.finishResync(vmNetCfg, requestID, networkv1.ResyncRepairs{}, "vmnetcfg is administratively disabled")
+	}
+
+	if err := h.waitForWarmup(vmNetCfg); err != nil {
+		return vmNetCfg, err
+	}
+	if !h.upgrade.IsDone() {
+		return vmNetCfg, fmt.Errorf("resync %s of vmnetcfg %s postponed: %w", requestID, key, config.ErrUpgrading)
+	}
+
+	if delay := h.resyncLimiter.Wait(); delay > 0 {
+		logrus.Infof("(vmnetcfg.OnResync) resync %s of vmnetcfg %s held back for %s", requestID, key, delay)
+		// The controller isn't set up in tests not caring about it
+		if h.vmnetcfgController != nil {
+			h.vmnetcfgController.EnqueueAfter(vmNetCfg.Namespace, vmNetCfg.Name, delay)
+		}
+		return vmNetCfg, nil
+	}
+
+	logrus.Infof("(vmnetcfg.OnResync) run resync %s of vmnetcfg %s", requestID, key)
+
+	var (
+		repairs    networkv1.ResyncRepairs
+		unrepaired []string
+	)
+	for _, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+		if ncStatus.State != networkv1.AllocatedState || ncStatus.AllocatedIPAddress == "" {
+			continue
+		}
+		message, err := h.resyncNetworkConfig(vmNetCfg, ncStatus, &repairs)
+		if err != nil {
+			return vmNetCfg, err
+		}
+		if message != "" {
+			unrepaired = append(unrepaired, message)
+		}
+	}
+
+	return h.finishResync(vmNetCfg, requestID, repairs, strings.Join(unrepaired, "; "))
+}
+
+// resyncNetworkConfig repairs the drift of the allocation of ncStatus, and
+// counts it in repairs. It returns why the allocation couldn't be repaired,
+// if it couldn't.
+func (h *Handler) resyncNetworkConfig(vmNetCfg *networkv1.VirtualMachineNetworkConfig, ncStatus networkv1.NetworkConfigStatus, repairs *networkv1.ResyncRepairs) (string, error) {
+	ip, mac := ncStatus.AllocatedIPAddress, ncStatus.MACAddress
+
+	ipPool, err := h.getIPPoolFromNetworkConfigStatus(vmNetCfg.Namespace, ncStatus)
+	if apierrors.IsNotFound(err) {
+		return fmt.Sprintf("ippool of %s is gone", mac), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	ipPoolKey := ipPool.Namespace + "/" + ipPool.Name
+	if !networkv1.CacheReady.IsTrue(ipPool) {
+		return "", fmt.Errorf("ippool %s is not ready; resync postponed", ipPoolKey)
+	}
+	ipamName := util.IPAMName(ipPool)
+
+	// The lease of the IPPool comes first, so the IP address isn't handed out
+	// to another MAC address while the caches are repaired
+	ipPoolCpy := ipPool.DeepCopy()
+	ipv4Status := ipPoolCpy.Status.IPv4
+	if ipv4Status == nil {
+		ipv4Status = new(networkv1.IPv4Status)
+	}
+
+	var staleIPs []string
+	for leasedIP, owner := range util.Leases(ipv4Status) {
+		if leasedIP != ip && util.NormalizeMAC(owner) == util.NormalizeMAC(mac) {
+			util.DeleteAllocationEntry(ipv4Status, leasedIP)
+			staleIPs = append(staleIPs, leasedIP)
+			repairs.StaleLeases++
+			logrus.Infof("(vmnetcfg.resyncNetworkConfig) released stale lease %s of %s from ippool %s", leasedIP, mac, ipPoolKey)
+		}
+	}
+
+	entry, ok := util.AllocationEntries(ipv4Status)[ip]
+	switch {
+	case ok && (entry.Type != networkv1.AllocationTypeLease || util.NormalizeMAC(entry.Owner) != util.NormalizeMAC(mac)):
+		return fmt.Sprintf("ip %s of %s is recorded as %s of %q in ippool %s", ip, mac, entry.Type, entry.Owner, ipPoolKey), nil
+	case !ok:
+		var (
+			defaultRoute *bool
+			mode         networkv1.NetworkConfigMode
+		)
+		for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+			if util.NormalizeMAC(nc.MACAddress) == util.NormalizeMAC(mac) {
+				defaultRoute = nc.DefaultRoute
+				mode = nc.Mode
+			}
+		}
+		util.SetAllocationEntry(ipv4Status, ip, networkv1.AllocationEntry{
+			Type:         networkv1.AllocationTypeLease,
+			Owner:        mac,
+			Namespace:    vmNetCfg.Namespace,
+			DefaultRoute: defaultRoute,
+			Mode:         mode,
+		}, h.clock.Now())
+		repairs.MissingLeases++
+		logrus.Infof("(vmnetcfg.resyncNetworkConfig) restored missing lease %s of %s in ippool %s", ip, mac, ipPoolKey)
+	}
+	ipPoolCpy.Status.IPv4 = ipv4Status
+
+	if !reflect.DeepEqual(ipPoolCpy.Status.IPv4, ipPool.Status.IPv4) {
+		if _, err := h.commitIPPoolStatus(ipPool, ipPoolCpy); err != nil {
+			return "", err
+		}
+	}
+
+	// The IP addresses of the stale leases are given back along
+	for _, staleIP := range staleIPs {
+		if allocated, err := h.ipAllocator.IsAllocated(ipamName, staleIP); err == nil && allocated {
+			if err := h.ipAllocator.DeallocateIP(ipamName, staleIP); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	allocated, err := h.ipAllocator.IsAllocated(ipamName, ip)
+	if err != nil {
+		return fmt.Sprintf("ip %s of %s is kept out of the ipam of ippool %s", ip, mac, ipPoolKey), nil
+	}
+	if !allocated {
+		if _, err := h.ipAllocator.AllocateIP(ipamName, ip); err != nil {
+			return "", err
+		}
+		repairs.IPAMEntries++
+		logrus.Infof("(vmnetcfg.resyncNetworkConfig) re-allocated ip %s of %s in ipam %s", ip, mac, ipamName)
+	}
+
+	if cachedIP, err := h.cacheAllocator.GetIPByMAC(ipamName, mac); err != nil || cachedIP != ip {
+		if err == nil {
+			if err := h.cacheAllocator.DeleteMAC(ipamName, mac); err != nil {
+				return "", err
+			}
+		}
+		if err := h.cacheAllocator.AddMAC(ipamName, mac, ip); err != nil {
+			return "", err
+		}
+		repairs.MACEntries++
+		logrus.Infof("(vmnetcfg.resyncNetworkConfig) re-cached %s with ip %s in mac cache %s", mac, ip, ipamName)
+	}
+
+	return "", nil
+}
+
+// finishResync records the outcome of the resync in the status of vmNetCfg.
+func (h *Handler) finishResync(vmNetCfg *networkv1.VirtualMachineNetworkConfig, requestID string, repairs networkv1.ResyncRepairs, message string) (*networkv1.VirtualMachineNetworkConfig, error) {
+	vmNetCfgCpy := vmNetCfg.DeepCopy()
+	vmNetCfgCpy.Status.LastResync = &networkv1.ResyncResult{
+		RequestID:      requestID,
+		CompletionTime: metav1.NewTime(h.clock.Now()),
+		Repairs:        repairs,
+		Message:        message,
+	}
+
+	updated, err := h.vmnetcfgClient.UpdateStatus(vmNetCfgCpy)
+	if err != nil {
+		return vmNetCfg, err
+	}
+
+	logrus.Infof("(vmnetcfg.finishResync) resync %s of vmnetcfg %s/%s is done: %+v", requestID, vmNetCfg.Namespace, vmNetCfg.Name, repairs)
+	if h.recorder != nil {
+		eventType := corev1.EventTypeNormal
+		if message != "" {
+			message = "; " + message
+			eventType = corev1.EventTypeWarning
+		}
+		h.recorder.Eventf(updated, eventType, ReasonResynced,
+			"Resync %s repaired %d stale and %d missing leases, %d IPAM and %d MAC cache entries%s",
+			requestID, repairs.StaleLeases, repairs.MissingLeases, repairs.IPAMEntries, repairs.MACEntries, message)
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,72 @@
+package vmnetcfg
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
+	"github.com/harvester/vm-dhcp-controller/pkg/ipam"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// staticIPInUseError tells the static IP address requested is leased to
+// another MAC address, naming the current holder.
+type staticIPInUseError struct {
+	ipAddress  string
+	ipPoolKey  string
+	macAddress string
+	// vmNetCfg is the VirtualMachineNetworkConfig holding the IP address, if
+	// known
+	vmNetCfg string
+}
+
+func (e staticIPInUseError) Error() string {
+	holder := "mac " + e.macAddress
+	if e.vmNetCfg != "" {
+		holder += " of vmnetcfg " + e.vmNetCfg
+	}
+	return fmt.Sprintf("static ip %s of ippool %s is in use by %s", e.ipAddress, e.ipPoolKey, holder)
+}
+
+func (e staticIPInUseError) Unwrap() error {
+	return ipam.ErrAlreadyAllocated
+}
+
+// staticIPHolder tells who holds the IP address of the IPPool a static
+// request was denied for. It returns nil if the IP address isn't leased to
+// another MAC address, e.g., as it's excluded or reserved.
+func (h *Handler) staticIPHolder(ipPool *networkv1.IPPool, ipAddress, macAddress string) *staticIPInUseError {
+	entry, ok := util.AllocationEntries(ipPool.Status.IPv4)[ipAddress]
+	if !ok || entry.Type != networkv1.AllocationTypeLease || entry.Owner == "" {
+		return nil
+	}
+	if util.NormalizeMAC(entry.Owner) == util.NormalizeMAC(macAddress) {
+		return nil
+	}
+
+	ipPoolKey := ipPool.Namespace + "/" + ipPool.Name
+	holder := &staticIPInUseError{
+		ipAddress:  ipAddress,
+		ipPoolKey:  ipPoolKey,
+		macAddress: entry.Owner,
+	}
+
+	vmNetCfgs, err := h.vmnetcfgCache.GetByIndex(indexer.VmNetCfgByMACIndex, util.NormalizeMAC(entry.Owner))
+	if err != nil {
+		logrus.Warnf("(vmnetcfg.staticIPHolder) cannot look up the owner of %s: %s", entry.Owner, err.Error())
+		return holder
+	}
+	for _, vmNetCfg := range vmNetCfgs {
+		for _, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+			if ncStatus.AllocatedIPAddress == ipAddress && ncStatus.IPPoolRef == ipPoolKey &&
+				util.NormalizeMAC(ncStatus.MACAddress) == util.NormalizeMAC(entry.Owner) {
+				holder.vmNetCfg = vmNetCfg.Namespace + "/" + vmNetCfg.Name
+				return holder
+			}
+		}
+	}
+
+	return holder
+}
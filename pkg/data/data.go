@@ -79,7 +79,7 @@ func (fi bindataFileInfo) Sys() interface{} {
 	return nil
 }
 
-var _chartCrdsNetworkHarvesterhciIo_ippoolsYaml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\xcc\x19\x5d\x6f\xe3\xc6\xf1\x5d\xbf\x62\x8a\x3e\x38\x01\x4c\x19\x87\x14\x45\x21\xe0\xd0\x3a\xb2\x9a\x08\x71\x1d\x43\xb2\xaf\x08\x8a\x3e\x8c\xb8\x23\x69\xe3\xe5\x2e\xb3\x1f\xb2\xdd\x5c\xfe\x7b\x31\x4b\xd2\xa2\x28\x92\xa6\x75\x77\x41\xf6\x49\x9a\xdd\x9d\xef\x99\x9d\x19\x26\x49\x32\xc2\x5c\x7e\x20\xeb\xa4\xd1\x13\xc0\x5c\xd2\x93\x27\xcd\xff\xdc\xf8\xe1\x6f\x6e\x2c\xcd\xc5\xee\xdd\xe8\x41\x6a\x31\x81\x69\x70\xde\x64\x0b\x72\x26\xd8\x94\xae\x68\x2d\xb5\xf4\xd2\xe8\x51\x46\x1e\x05\x7a\x9c\x8c\x00\x50\x6b\xe3\x91\xc1\x8e\xff\x02\xfc\xfa\xdb\x08\x40\x63\x46\x13\x90\x79\x6e\x8c\x72\x63\x4d\xfe\xd1\xd8\x87\xf1\x16\xed\x8e\x9c\x27\xbb\x4d\xe5\x58\x9a\x91\xcb\x29\xe5\x4b\x1b\x6b\x42\x3e\x81\xae\x63\x05\xba\x12\x7d\xc1\xda\xfc\xf6\xd6\x18\x15\x01\x4a\x3a\xff\x43\x0d\x78\x2d\x9d\x8f\x1b\xb9\x0a\x16\xd5\x0b\x17\x11\xe6\xb6\xc6\xfa\x9b\x3d\xb6\x84\x77\x55\xed\x67\x79\x4c\xea\x4d\x50\x68\xab\xcb\x23\x00\x97\x9a\x9c\x26\x10\xef\xe6\x98\x92\x18\x01\xec\x0a\x3d\x46\x5c\x09\xa0\x10\x51\x3d\xa8\x6e\xad\xd4\x9e\xec\xd4\xa8\x90\xe9\x17\x4a\x3f\x3b\xa3\x6f\xd1\x6f\x27\x30\x66\xc1\x2b\xad\x30\xc6\x78\xa2\xd2\xda\xcd\xec\xee\xdf\x3f\x2e\x7e\x28\x61\xfe\x99\xc9\x3a\x6f\xa5\xde\xb4\x20\xf2\xe8\x83\x1b\xcb\x7c\xf7\x97\x31\xee\x50\x2a\x5c\xa9\x43\x6c\x97\x1f\x2e\xe7\xd7\x97\xdf\x5e\xcf\x0e\xf0\x31\x7f\x1b\xb2\xfd\x08\x83\x8b\x52\xee\x71\xdd\x2f\x67\x57\x6f\x42\x93\x1a\x5d\xe8\xc4\xfd\xe7\xef\x5f\xfd\x63\xcc\x97\xde\xbf\x3f\x5b\xd0\x46\xb2\x79\x49\x9c\x7d\xfd\xdf\xf2\xe8\x01\x9d\xc5\xec\xbb\xf9\xf2\x6e\xb6\x68\x50\x7b\x45\x09\xed\xc4\xa6\x98\x6e\x69\x41\x28\x9e\x3b\x88\x4d\x2f\xa7\xdf\xcf\x16\xb3\xcb\xab\x9f\x3e\x9d\xd8\xe5\x86\xb4\xef\x23\x76\xf9\xdd\xec\xe6\x6e\x38\xb1\x2a\xd0\xc6\xa9\xa5\x18\x63\x77\x32\x23\xe7\x31\xcb\x9b\x58\x0f\xd0\x09\xf4\x85\x13\x14\xdb\xbb\x77\xa8\xf2\x2d\xbe\x2b\x5c\x3b\xdd\x52\x86\x93\xf2\xbc\xc9\x49\x5f\xde\xce\x3f\x7c\xb3\x3c\x00\x03\xe4\xd6\xe4\x64\xbd\xac\x02\xa5\x58\xb5\xdc\x51\x83\x02\x08\x72\xa9\x95\xb9\x8f\x49\xe5\x63\x72\xb0\x07\xc0\x04\x8a\x5b\x20\x38\x89\x90\x03\xbf\xa5\x2a\x7a\x48\x94\x3c\x81\x59\x83\xdf\x4a\x07\x96\x72\x4b\x8e\x74\x91\x56\x18\x8c\x1a\xcc\xea\x67\x4a\xfd\xb8\x81\x7a\x49\x96\xd1\x70\x5c\x07\x25\x20\x35\x7a\x47\xd6\x83\xa5\xd4\x6c\xb4\xfc\xdf\x0b\x6e\x07\xde\x44\xa2\x0a\x3d\x39\x1f\x1d\xd7\x6a\x54\xb0\x43\x15\xe8\x1c\x50\x8b\x06\xe6\x0c\x9f\xc1\x12\xd3\x84\xa0\x6b\xf8\xe2\x05\xd7\xe4\xe3\x5f\xc6\x12\x48\xbd\x36\x13\xd8\x7a\x9f\xbb\xc9\xc5\xc5\x46\xfa\x2a\xa3\xa6\x26\xcb\x82\x96\xfe\xf9\x22\x35\xda\x5b\xb9\x0a\xde\x58\x77\x21\x68\x47\xea\xc2\xc9\x4d\x82\x36\xdd\x4a\x4f\xa9\x0f\x96\x2e\x30\x97\x49\x14\x44\x47\xff\x1a\x67\xe2\xcf\xb6\xcc\xc1\xee\x80\xec\x91\xef\x14\x2b\x66\xc8\x37\x98\x87\x93\x27\x48\x07\x58\xa2\x2a\x44\xdc\x5b\x81\x41\xac\xba\xc5\x6c\x79\x07\x15\x27\x85\xa5\x0a\xa3\xec\x8f\x1e\xe9\xa5\xb2\x0f\x6b\x53\xea\x35\xd9\xe2\xde\xda\x9a\x2c\xe2\x24\x2d\x72\x23\xb5\x8f\x7f\x52\x25\x49\x7b\x70\x61\x95\x49\xcf\x6e\xf0\x4b\x20\xe7\xd9\x74\x4d\xb4\xd3\xf8\xea\xc0\x8a\x20\xe4\xec\xec\xa2\x79\x60\xae\x61\x8a\x19\xa9\x29\x3a\xfa\x9d\x6d\xc5\x56\x71\x09\x1b\x61\x90\xb5\xea\x6f\x69\xf3\x70\xa1\xde\xda\x46\xf5\x60\xee\x57\x7b\x9c\xf2\xe2\x14\x3e\x35\x7a\x2d\x37\xcd\x9d\xbe\x5b\xbc\x52\x29\x6c\x1b\xbc\x53\x86\xfd\x7a\x4a\x1e\xc2\x8a\xac\x26\x4f\x2e\xd9\xa1\x92\xa2\x5e\x1a\x34\x57\x02\x19\x39\x87\x1b\xce\xc2\xf3\xab\x05\x3b\xa1\xcc\xb2\xe0\x6b\x8f\x58\x73\xd9\xa0\x98\x03\x52\x6b\x78\xff\x1e\x8c\x12\x4b\x52\xeb\x96\xb3\xa2\x8b\xe6\xda\xd8\x0c\xfd\x24\xaa\xa7\xf5\x80\xf4\x94\x75\xdc\x1d\xa0\x80\x0c\x9f\xe6\x11\x01\x7c\xd3\xa3\x41\xb4\x16\x9f\xdb\xb8\x36\x19\x4a\xcd\x15\xc1\x49\xfa\x2f\xae\x2f\x89\x5d\xb4\x1d\xc1\xa7\x09\xd7\xcf\xbc\x22\x74\xc4\x0f\x54\x1f\xef\xf5\x8a\xe1\x70\x69\x9f\x7f\x09\x9e\xf7\x06\x69\x37\x77\xbf\x4c\x5c\xfc\xb5\x93\xee\x0f\x21\x5e\xd4\x4c\xc3\xf5\xf5\xaa\x1b\x0e\x12\x0e\xde\x1c\x72\x70\x18\x76\xb3\x22\xf5\xbf\x16\x75\xf0\x86\xc8\x8b\xa2\x3f\xa5\x2a\x88\x0e\x47\x18\x2c\x7e\xaf\xe1\x61\xa8\x7e\xfa\x0d\x5c\xac\x4f\xd3\x61\x21\xec\x97\xd0\xa3\xf3\x68\xfd\x1f\xde\x89\x96\xcc\xe5\xe7\x17\x9f\xdf\x7f\x69\xa9\x23\x88\x12\x8e\xaf\x8e\x9d\xa8\xb6\x9e\x68\x3f\x7a\x57\xf7\xeb\xe4\x07\xac\x8c\xa4\x8a\x69\x30\x3a\x25\x70\xd4\x4e\xa5\x52\xc3\xd9\x9f\xb6\xe8\xbe\x2a\x95\x30\x2e\xa3\xe6\x6b\xf8\xf8\x11\x18\xee\xea\xc0\xb3\x16\x44\xd6\x04\x4f\x1d\x4f\xf5\xab\xbe\xf1\xe5\xde\xf2\x45\x64\xeb\x73\xbe\xe6\x2e\x96\x91\xf3\xdb\x3f\x9c\xa8\xcb\x92\xb1\xcf\x27\x6c\xb7\xd7\x27\xb1\x30\x6b\x01\xe7\xd5\x28\xe4\x10\x5c\x29\xed\x68\xab\x37\x08\x86\xab\xa2\xd5\xe2\x43\xfc\xbf\xcd\xf7\x0b\x57\x3e\x74\xfd\x12\xd6\xf4\xfc\xda\xdc\xe4\x98\xa9\x0c\x9f\xae\x49\x6f\xb8\x7b\xfe\xeb\xb1\x33\xf4\x3a\xc2\x49\x92\xdf\xec\x99\x79\xcd\x07\x86\xd8\x3f\xc7\xe0\xda\x6c\x5f\x30\xbe\x32\x46\x11\xea\x83\xdd\x76\x7f\x49\xe0\x78\xba\x54\xc7\x74\xdc\x59\xc4\x59\xc5\xd0\xde\x02\x37\xa4\xfd\xad\x11\x0b\x5a\xbf\xb5\xb9\x90\x19\xeb\xed\x94\x30\xd5\xa7\x96\xc5\xba\x9a\xd9\x9d\x74\x3b\xc8\x8e\x17\xa8\xbf\xab\xae\xd6\xfd\xfc\xaa\x68\xae\x99\x0c\xf8\x2d\x7a\xd8\x1a\x25\x1c\x04\x2d\x7f\x09\x04\xf3\xab\x72\xa4\x70\x0e\x52\x73\xaa\xe7\x76\xfb\xfe\x7e\x7e\xe5\xc6\x00\xdf\x52\xca\x0e\x01\x8f\x5d\x39\x45\x18\x7d\xe6\xe1\xc7\x9b\xeb\x9f\x80\xcf\xc5\x7b\xe7\x45\x8f\xcd\x44\x35\xa0\x92\xc5\xf0\xa3\x90\x2f\xe2\x64\x0a\x25\x3f\x29\xe6\xdc\xc7\xba\x0e\xf4\x5c\xad\x6b\x0f\xa8\x05\x6c\x49\xe5\xdc\xc7\x3f\x10\xb8\x60\x4b\x49\x98\x5c\xdc\x8d\x2a\x06\x61\x80\xdb\xf2\x0d\x79\x48\x8d\x5e\xab\xb6\xce\x7c\x80\xce\x7b\xf2\xd3\x7e\xec\x76\x6c\x93\xce\x72\xf1\xb5\x52\x5d\xa1\xf3\x77\x16\xb5\x93\xd5\x88\xad\xab\xec\x39\x30\xf9\x35\x3a\x0f\x5e\x66\x54\x0c\x2f\x2a\xce\xc0\xbf\xa0\x22\x51\x4c\x3a\x8c\x26\x38\x18\x06\xb6\x28\xc4\x00\x6a\xe3\xb7\x64\xdb\x15\x36\xe0\x11\x63\x31\xee\xe3\x38\x64\xb0\x08\x77\x71\x22\xb6\x17\x43\xba\x9a\x1c\x8f\xe8\xba\xc6\x2b\x83\x79\xaa\xf2\xe4\x10\x66\xbe\x0f\x19\xea\xc4\x12\x0a\x4e\xa0\xd5\x55\x90\x5a\xc8\x14\xe3\x14\x4a\x90\x47\xa9\x1c\xe0\xca\x84\xae\xc2\x0a\x4a\x81\x5e\x8c\x70\x2a\xeb\x96\xd0\x35\xe7\x9c\x1d\x9c\xb3\x1a\x8b\xe3\x5c\x8b\x1c\xba\xc3\x99\x6b\x32\x74\xb2\x32\xdb\x72\x74\x07\x47\xcb\x78\xb4\x98\xa8\xd6\x98\x39\x8f\xae\x68\xd6\x70\x67\x03\x9d\xc3\x3f\x51\x39\x3a\x87\x7b\xfd\xa0\xcd\xe3\xe9\x7c\xc5\x03\x83\xf4\xc4\x29\xc7\xac\x21\x55\xc1\x71\xbd\xf0\xc2\xd7\x89\xa4\xfb\x3a\x84\xa4\x3b\xe2\x92\x88\xb7\x65\xa3\xb7\x30\xea\xee\x23\xb9\xee\x7c\xeb\x33\x88\x4a\x99\x94\x43\xab\x5d\x71\xf5\x6f\x49\xaf\xcd\x19\x06\x8e\x6d\x3a\x9b\x9e\x97\xef\x46\xa7\xcd\x6d\xda\x0b\x96\xd7\x6f\xf6\x15\xba\xcd\x4f\x59\xf5\xbd\xda\x57\xa9\x41\x22\xee\xd3\xe2\x31\xa5\xaa\x73\xe0\xdd\x84\x73\xe0\xf0\x8a\xb1\x95\xe2\x11\x30\xd6\xe0\x62\x02\xde\x86\x02\xb7\xf3\xc6\xc6\xc2\x71\x0f\x09\xab\x97\xf1\x7e\xc5\x61\x19\xe9\xf0\xeb\x6f\xa3\xff\x07\x00\x00\xff\xff\x51\x01\x92\x53\xb3\x1d\x00\x00")
+var _chartCrdsNetworkHarvesterhciIo_ippoolsYaml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\xec\x3d\x6b\x73\xe3\x38\x72\xdf\xf5\x2b\x3a\x97\x0f\xb3\x5b\x25\x69\x32\xbb\x33\xbe\x44\x95\xbd\x44\x6b\x7b\x6f\x5c\x6b\x8f\x5d\xb6\xc7\x97\xab\x54\x3e\x40\x64\x4b\xc2\x99\x04\x78\x00\x28\x59\xf7\xf8\xef\xa9\xc6\x83\xa4\x24\xbe\x24\x79\x36\xb7\xa9\x31\xb7\x6a\x47\x24\xd8\x00\xfa\xdd\x8d\x06\x38\x1a\x8d\x06\x2c\xe3\x4f\xa8\x34\x97\x62\x02\x2c\xe3\xf8\x62\x50\xd0\x2f\x3d\x7e\xfe\x57\x3d\xe6\xf2\xed\xea\xdd\xe0\x99\x8b\x78\x02\xe7\xb9\x36\x32\xbd\x47\x2d\x73\x15\xe1\x05\xce\xb9\xe0\x86\x4b\x31\x48\xd1\xb0\x98\x19\x36\x19\x00\x30\x21\xa4\x61\x74\x5b\xd3\x4f\x80\xbf\xfe\x7d\x00\x20\x58\x8a\x13\xe0\x59\x26\x65\xa2\xc7\x02\xcd\x5a\xaa\xe7\xf1\x92\xa9\x15\x6a\x83\x6a\x19\xf1\x31\x97\x03\x9d\x61\x44\x2f\x2d\x94\xcc\xb3\x09\x34\x35\x73\xe0\x3c\x78\x37\xb4\xab\xbb\x3b\x29\x13\x7b\x23\xe1\xda\xfc\x5c\xb9\x79\xcd\xb5\xb1\x0f\xb2\x24\x57\x2c\x29\x46\x61\xef\xe9\xa5\x54\xe6\x53\x09\x6d\x44\x4f\x93\xca\x3f\xb5\xfd\xb7\xe6\x62\x91\x27\x4c\x85\x97\x07\x00\x3a\x92\x19\x4e\xc0\xbe\x9b\xb1\x08\xe3\x01\xc0\xca\xe1\xd1\x8e\x6c\x04\x2c\x8e\x2d\x7a\x58\x72\xa7\xb8\x30\xa8\xce\x65\x92\xa7\x01\x2d\x23\xf8\x93\x96\xe2\x8e\x99\xe5\x04\xc6\x34\xf1\x80\x15\x82\x68\x3b\x0d\x58\xfb\x74\xf9\xf8\x87\xdb\xfb\x9f\xfd\x3d\xb3\xa1\x6e\xb5\x51\x5c\x2c\x1a\x00\xb1\xdc\x2c\xa5\xe2\x44\x85\xd5\x36\xa8\xe9\xe7\xc7\x8f\xb7\xf7\x57\x8f\xd3\xc7\xab\xa7\xcb\x2d\x80\x33\x29\x13\x64\xa2\x06\xa2\x61\x26\xd7\x63\x9e\xad\xde\x8f\xd9\x8a\xf1\x84\xcd\x92\x1d\xa0\x4f\xd3\xab\xeb\xe9\x8f\xd7\xdb\x00\x69\xc6\x0b\x54\xed\x00\x73\x8d\xf1\x16\xac\xcf\x0f\x97\x17\x07\x81\x89\xa4\x70\x58\xd6\xff\xfd\x1f\xdf\xfc\xe7\x98\xfa\xfe\xe1\x87\x37\xf7\xb8\xe0\xc4\x57\x18\xbf\xf9\xf6\x7f\x7c\xd3\xad\x7e\xee\x2f\x7f\x7f\xf5\xf0\x78\x79\x7f\x79\xd1\x0f\xad\x6d\x9d\x9d\xb3\x68\x89\xf7\xc8\xe2\x4d\x43\x67\xe7\xd3\xf3\x8f\x97\xf7\x97\xd3\x8b\x3f\x9e\xde\xd9\x74\x81\xc2\xb4\x75\x36\xfd\xfd\xe5\xa7\xc7\xfe\x9d\x05\xd1\x1d\x47\x0a\xad\xd4\x3e\xf2\x14\xb5\x61\x69\xb6\x0b\x75\x0b\x5c\xcc\x8c\x63\x02\xd7\xe9\xea\x1d\x4b\xb2\x25\x7b\x67\x6f\xe9\x68\x89\xa9\xd5\x05\xf4\x4b\x66\x28\xa6\x77\x57\x4f\xdf\x3f\x6c\xdd\x06\xc8\x94\xcc\x50\x19\x1e\x44\xcf\x5d\x15\x6d\x54\xb9\x0b\x10\xa3\x8e\x14\xcf\x68\x84\x13\xf8\xdb\x68\xeb\x19\x00\x75\xe0\xde\x82\x98\xd4\x12\x6a\x30\x4b\x0c\xf2\x88\xb1\x1f\x13\xc8\x39\x98\x25\xd7\xa0\x30\x53\xa8\x51\x90\x88\x48\x41\xb7\x99\x00\x39\xfb\x13\x46\x66\xbc\x03\xfa\x01\x15\x81\x01\xbd\x94\x79\x12\x43\x24\xc5\x0a\x95\x01\x85\x91\x5c\x08\xfe\x97\x02\xb6\x06\x23\x6d\xa7\x09\x33\xa8\x8d\x65\x5c\x25\x58\x02\x2b\x96\xe4\x38\x04\x26\xe2\xc1\x16\x60\x48\xd9\x06\x14\x52\x9f\x90\x8b\x0a\x3c\xfb\x82\xde\x1d\xc7\x8d\x54\x08\x5c\xcc\xe5\x04\x96\xc6\x64\x7a\xf2\xf6\xed\x82\x9b\xa0\xa3\x23\x99\xa6\xb9\xe0\x66\xf3\x36\x92\xc2\x28\x3e\xcb\x8d\x54\xfa\x6d\x8c\x2b\x4c\xde\x6a\xbe\x18\x31\x15\x2d\xb9\xc1\xc8\xe4\x0a\xdf\xb2\x8c\x8f\xec\x44\x04\x4d\x5f\x8f\xd3\xf8\x9f\x95\xd7\xea\x81\x99\x1a\x78\xc7\xfd\x67\x75\xee\x01\xe4\x21\x75\x0c\x5c\x03\xf3\xa0\x1c\x4e\x4a\x2a\xd0\x2d\x42\xdd\xfd\xe5\xc3\x23\x84\x91\x38\x4a\x39\xa2\x94\x4d\x75\x13\x7d\x08\x9b\x5c\xcc\x51\xb9\xf7\xe6\x4a\xa6\x96\x1c\x28\xe2\x4c\x72\x61\xec\x8f\x28\xe1\x28\x0c\xe8\x7c\x96\x72\x43\x6c\xf0\xe7\x1c\xb5\x21\xd2\xed\x82\x3d\xb7\x76\x0c\x66\x08\x79\x46\xcc\x1e\xef\x36\xb8\x12\x70\xce\x52\x4c\xce\x99\xc6\x5f\x98\x56\x44\x15\x3d\x22\x22\xf4\xa2\x56\xd5\x3a\x97\x7f\xae\xb1\x43\x6f\xe5\x41\x30\xc1\x00\xed\x72\x4a\x17\x8b\x49\x14\xb8\x46\x92\x11\x1e\xe1\xbd\xcc\xcd\x7e\xab\x3a\x0b\x53\xfe\xb1\x24\x91\x91\x95\xc2\x07\xa3\x98\xc1\xc5\x66\xff\xfd\x76\xe6\xa2\x6b\xba\x07\x05\x0c\x26\x89\x86\xa5\x5c\x5b\xc2\x5f\xdd\x91\x39\x56\xa8\xb5\x15\x76\x78\xba\x81\x35\x37\x4b\x99\x1b\x60\x35\xf0\x62\xd4\x7c\x21\x88\xec\x20\x05\x12\xeb\x66\x3c\x7a\xc6\x78\x0c\x57\x86\x34\x0c\xcb\x13\xcb\x35\x30\x15\x9b\x5d\xe2\x03\xa0\xc8\xd3\xfd\x59\x8c\xa8\x71\xcd\xdd\x9b\xe9\xf9\x47\xa6\x97\x85\x21\xec\xa4\x67\x40\xdb\xfa\xc7\xdb\xdb\xc7\xbb\x63\xd1\xe5\xde\x86\x94\x3d\x7b\x65\xc9\xc8\xb2\x00\x13\x7a\x8d\x0a\xdc\xc3\x42\x3e\x98\x86\x35\x26\xc9\xd8\xdd\xaf\x81\xe8\x04\x4b\x83\xc0\x15\x2a\x50\x28\x70\x3d\x04\xed\x15\x22\x32\x8d\x1a\x34\x09\x6a\xec\xb5\x64\x0a\x4c\x21\xa4\x2c\x46\xc8\x50\xa5\x4c\xa0\x30\xe3\x06\x04\x34\x30\x4e\xd5\xc9\xa9\x43\x82\x25\xd2\x04\x8c\xca\x71\xb0\xf5\xa8\x1f\x8a\xaa\xe0\xf7\xb0\xf4\x69\xfa\x73\x89\x9c\xb9\x54\x81\xb9\x50\x03\x37\xb0\x64\x5a\xbc\x31\x83\x3d\x98\x0e\x13\x01\x05\x1e\x67\x96\xa5\xbc\x71\x99\x21\x98\x5c\x09\xe2\xba\xf9\x1c\xa4\x08\x1e\x30\x68\x5c\xa4\x28\xcc\xb6\xb8\x7b\x81\x5d\x32\x85\xb1\xe5\x66\x90\x66\x89\x0a\x2e\x3e\x9e\xdf\x39\x6c\x2b\x7d\x18\x4e\xc9\xc9\x3b\x97\x62\xce\x17\xfb\x08\x6d\x56\x03\x74\xb1\x64\xcd\x36\xfa\x01\x45\x7c\x9b\x55\x7c\xff\xc3\xf1\x4e\xd7\x74\x17\x98\xf5\xe9\x1d\x97\xda\xc9\x49\x7b\x1b\x22\x19\x5b\xbe\x22\xe5\x2e\x3d\x3a\x35\xe0\x0a\x05\xf0\x79\x03\x6c\xb3\xc4\xcd\x1b\x45\x4c\x39\x37\x40\xe2\x6f\x5d\x02\x84\x8c\x29\x96\xa2\xb1\xcc\x6b\x99\xde\xf6\x09\xdf\xf8\xae\x3e\x7c\xf8\x76\x1f\x95\x74\x71\x83\x69\xc3\x64\x01\x52\xf6\xc2\xd3\x3c\x9d\xc0\x77\x1f\xde\x37\x35\xe1\xc2\x35\x79\xd7\xd0\x60\xdf\x0d\xde\xfd\x73\x2d\x98\x52\x6c\x5f\xbd\x00\x44\x3c\x56\xf5\xe3\x6b\x51\x2f\xee\xbf\x97\xd1\x73\x3e\x43\x25\xd0\xa0\x1e\xad\x58\xc2\xe3\x6a\x5c\xb7\xfb\x37\x82\x14\xb5\x66\x0b\x72\x78\xaf\x2e\xee\x49\x69\xf2\x34\xcd\x4d\x25\x5e\xd8\xbd\x54\x9e\x90\x1f\x8c\xc9\x1c\x7e\xf8\x01\x64\x12\x3f\x60\x52\x47\x38\x2f\xcc\xd6\xbe\x9c\xc2\x58\x17\x15\x38\xde\x40\xac\x97\x68\x85\x86\x78\x4b\x11\x7c\x05\xbc\xd0\x55\xcc\xf1\x9c\xef\xde\x3d\x1f\x36\xc0\xe6\x63\x1c\x0f\xbd\x18\xda\x71\xc0\xf7\xe4\xf3\x01\x4b\xa4\xf7\x6e\xec\xeb\xd6\xfe\x78\xa6\x7a\xf7\xdd\xbb\xa1\x57\x06\x4d\x40\xc9\x89\x9c\xb3\x08\x35\x90\x37\xa2\xd9\x86\x5c\x25\x2b\xe6\x6b\xae\x71\xcf\x1c\x91\xb2\xab\xe7\xd3\x36\xb1\xa7\x2b\x6e\x22\xeb\x5c\xaa\x94\x19\x0a\x7c\x57\xef\x0f\x97\x80\x4e\x1e\x4b\xd9\xcb\x95\x15\x21\xf8\xfe\x08\xe6\x8e\x65\xca\xb8\xa0\x88\xb9\x07\x5b\x5c\x14\x8d\x89\xc4\x96\xb0\xf6\x8e\x0d\x71\x82\x1e\xf0\x5a\xa4\x89\xca\x9e\x31\xaa\x64\x7e\xf7\x61\x3c\x38\x62\xea\x6e\xe8\x0f\x48\x8e\xf9\x49\x3c\x5d\x81\x13\xe6\x65\x55\x97\x9c\xfb\xf9\xe9\xea\xc4\xac\x7b\x9d\xac\x90\xe2\x19\x55\x67\xa3\xe8\x5a\x4a\x6d\x08\x29\x1a\xb8\x18\xd6\xce\xf9\xdd\xbf\x8d\xbf\x00\x33\xb4\x13\xdb\x5a\x4f\x0a\x4f\x27\x83\x63\x14\xa5\x30\xd9\xe4\x0b\x8c\xb9\x64\xe0\xf7\x47\xcc\x49\x9e\x6e\x2d\x83\x8d\x24\x87\x6a\xc7\x42\x16\x8a\x6c\x86\x9a\xc7\xde\x83\x91\x02\x75\xe0\xf6\x39\xc7\x64\x27\x88\x28\x2f\x36\x93\x2b\x1c\xc2\x7a\xc9\xa3\xa5\x6d\xfd\xe9\xb1\xf0\x2b\xac\x6a\xab\x88\x90\x76\xfc\x67\x19\x8f\x06\xa2\xd1\x58\x5d\x58\xcf\x25\xed\xbe\x04\x5d\xf8\x62\x14\xbb\x6d\x43\x4e\x7f\x04\xd1\x75\x59\x81\x67\x5d\x4f\x8f\x18\xa7\xe1\x37\x74\x6b\x08\x38\x5e\x8c\x87\xf4\x1b\x1e\x7f\x2a\xa6\xea\xb4\xc3\x37\x67\x67\xdf\xb6\x80\x0f\xd8\x98\x49\x69\x60\xce\x13\x0c\x6f\xfd\xf6\x5b\x42\x75\x70\xe3\xe8\xb1\x1e\x02\xf9\x8b\x62\xe3\x69\x64\xfb\xa3\xa8\xab\x05\xfc\x92\x91\xfe\x77\xd4\x82\xb9\x54\x63\x78\x5c\xa2\x7f\xbf\xea\x96\xc6\xa8\xf8\x0a\x2b\xc1\x2f\xc1\x85\x88\x89\x37\x06\x66\x4d\x46\x98\x2e\xb9\x42\xa5\x78\x1c\xa3\xb0\x54\xa3\x77\xd3\x7a\xd2\x75\x0a\x4c\x3f\xfa\x7a\xdf\x44\xc6\xd8\xde\xa2\x97\x0f\xd5\xdb\x97\xea\xab\x2a\xca\x3f\xdb\xb2\x03\xda\x16\x17\x3e\x6e\x32\xdc\x89\x3d\x5d\xb2\x83\x6b\x58\xf0\x15\x0a\xb2\xd9\x1d\x00\x0b\x87\xc7\xda\xf4\x47\x7c\xa9\x09\x8d\xfa\x44\x9c\xdb\x7f\x23\x0b\xa9\xb3\xd1\x47\x7c\xe9\x68\xd3\xa9\x12\xc3\x65\x27\x7e\x10\xf6\x9e\x02\xaa\x88\xa7\x33\xb6\x49\x24\x8b\x83\xae\x72\xec\x3e\x74\x58\xec\x00\x0a\xc0\x28\x12\xd3\x8e\x1c\x9a\x6d\x6a\x02\xa1\xa3\x26\x45\x41\x1f\x57\xb8\x93\xfd\xda\xbe\x46\x36\x30\x69\x6d\x60\x31\xd3\xd2\xa2\x21\x39\x73\x88\x65\xa1\x2b\x35\xf9\x64\xd0\x0b\xf1\xad\xca\xf3\xe6\xf1\x73\xa0\x49\xe1\x90\xda\x9b\x35\x9e\xc1\x77\x67\x41\x8f\xbe\x7b\xff\xe1\x5f\x28\x86\x65\xa2\x05\x34\x29\x9e\x84\x6d\x82\x86\x1c\x0f\x3a\xd5\xc0\xd9\x87\x0f\xdf\x7f\x18\x74\xaa\x80\x0f\xbf\x3d\x1b\x1c\x2f\xfe\x1d\xf8\xa7\x25\xa0\xc9\xe0\x38\xcd\x67\x33\x37\x9f\xdc\x74\x7f\x54\x92\xc5\x11\xd3\xe6\x35\xa8\x34\xad\x03\x5c\xc9\x5c\x04\x23\x44\xb6\x6a\x56\x3c\x2f\x13\x17\xb2\x29\x64\xf6\x61\xb3\x8b\xea\x7c\xbe\x8e\x82\xba\x90\x15\x1a\x92\x49\xda\xa5\xa4\x86\xf5\x12\x9d\x47\x62\xe3\xed\x3f\xe5\x7e\x15\xae\xfe\x12\x14\x65\x24\x65\x1a\x85\xb4\xe4\x1b\x0d\x79\x16\x92\x25\x84\x56\x66\xa4\xa2\xdf\x34\x27\xd0\xb9\x87\x4e\xb6\xbb\x99\x6f\xba\xe2\x9e\x63\x22\xdd\x9d\x68\xb7\x1e\xf1\x3d\xc2\xdf\x43\x42\x60\xba\x22\x99\x8b\x57\x61\x95\x73\x02\x14\x44\x9a\xa5\xf6\x97\x9c\x97\xd8\x0f\x2a\x97\xf8\x1c\x14\x13\x0b\x74\x2e\xc5\x83\x61\xca\x00\x29\x61\xa6\xdb\xe5\x9a\x25\x06\x95\xb0\x0b\x90\x44\xb1\x4b\x11\x8f\xe1\x01\x8d\xa1\xf0\x75\x26\xcd\x92\x3a\x77\x6b\x1f\xce\x09\x63\xe9\x8c\x2f\x72\x99\xeb\x71\xb7\x68\xbf\x3b\x41\xb0\x4f\x26\x76\x81\xba\xd7\x26\x2e\xee\x2e\xa9\x1c\x47\xda\x4b\xb7\xd2\x42\xd4\x4b\x2a\xf2\xbd\x4f\x51\x2f\x61\xce\x65\x8c\x1d\x7d\xfd\xe4\x9a\x86\x48\x97\x59\x32\x3b\x7d\x72\xf0\xb9\xd0\x06\x59\x6c\xd7\xb6\xb6\xd3\x10\xa1\xf7\x5c\x13\xfb\xef\x0e\x82\x14\x49\x4b\x17\x65\x7a\xa3\xb1\x51\x67\x52\xa2\xb7\x49\x3f\x89\x19\x3c\xb2\x5f\x9d\x15\x5e\xa2\x24\x6f\xf3\x8c\x7b\x4d\xbf\xd3\x4b\xef\x85\x9f\x6e\x27\xe3\x54\x1c\xba\xc9\x7e\x09\x3c\x2e\x65\x12\xff\xc8\xa2\xe7\xd7\x90\xab\x8f\x1e\x16\x8d\x93\x51\xb6\xd8\xec\x8b\x14\x3c\x63\x66\xac\x31\xcc\x12\x26\x28\x8d\x4f\xc5\x00\xbc\x2d\xb2\x63\x5a\xf3\x85\xb0\xb9\xfd\x31\x7c\x16\x09\x7f\xb6\x46\x2d\xb0\x40\x1c\x44\x07\xf5\xd0\xfa\xb3\xc5\x4f\xb2\x7a\xa0\x0d\x4f\x92\x16\xe8\x4b\x26\x08\x06\xa5\xb9\x8d\x84\xa7\x1b\x5d\x2e\x7a\x55\x97\xb8\x3c\xd0\x21\xcc\x28\x1f\x2e\x92\x0d\x48\x61\xd7\x5f\x91\xb2\x45\x6d\x66\xdb\xa3\xc0\xcd\x9e\x6b\xc0\x97\x25\xcb\x75\xcd\x6a\xe9\x21\x1e\x52\xa7\x36\xec\x2d\x02\xbd\xb9\x1c\x40\x93\x69\xfb\x25\xbb\xec\x8e\x24\x46\x80\x7b\x35\x03\xe5\x35\x72\x43\x1e\x9c\x10\x42\x74\xcc\xb9\xd7\x7c\xbf\xbc\x92\x75\x4e\xc7\xab\xab\x87\x76\xfc\xb7\x61\xb7\x13\xb3\x87\x4d\xb7\xaa\x0b\x9d\x3d\x09\x43\x73\x62\xa8\xd1\x0c\xda\x26\xfb\xe6\x9f\x96\x4c\x7f\xe3\xa7\x3a\xf6\x8a\xe3\x5b\xf8\xdb\xdf\x68\x1d\xf2\x1b\x5d\xbd\xf9\xa6\x06\x10\x95\x55\xa8\x55\xdb\x00\xfb\x29\xc9\xfb\x0a\x1c\xc8\xb8\xa8\x2c\xb9\x53\x00\x22\xe1\x66\x7a\x5e\xde\x70\x19\xac\x9d\x55\xf9\x06\xc8\x95\x11\x12\x76\xac\x82\xb2\xcb\xcc\x3e\x16\x71\x2b\xaa\xa4\x1d\x2b\x5d\x84\xbc\xe5\x02\x0d\x65\x02\x1a\x40\xe7\x22\x41\xbd\x1b\xd9\x32\xfd\xec\x17\x75\xbd\xfe\xde\x19\x27\xf5\x24\xd7\x62\x3c\x38\xd8\xea\xf6\xd1\x7d\x3c\x9b\x3a\x94\x4c\x06\x27\xab\xa2\x5e\xc2\x99\xb2\xa8\x47\x8f\x3d\x40\xb5\x4b\x14\x31\x7a\x31\xb7\xc6\x16\xe5\x60\x06\x47\xaa\xb5\x76\x87\xc5\xae\xc1\x35\xac\x87\x76\x22\xb5\x13\x07\x47\x0b\xbe\x5d\x91\x54\x7d\x94\x5c\x5f\x05\x47\x22\x83\xea\xea\xee\x1f\x6e\xaa\x0f\x7e\x60\xaf\x3a\x59\x2b\xa6\x4d\xe5\x47\xaf\x22\x96\x31\x6a\xc3\x29\xa0\xdd\x2d\x4c\x3c\x10\x6f\x54\x10\xb7\x60\x06\xd7\x6c\x33\x69\x6c\xd0\x83\x40\xaf\x28\x95\x95\xa9\x35\xb6\xf1\x43\xfe\x32\x42\xa9\xf3\x99\x40\x73\xc3\xf4\xf3\xad\x5b\x87\xc0\x53\x0c\xd1\xc3\x1e\xb4\x10\x10\xbb\x7e\x20\x65\xfa\xd9\x55\x8d\x6c\x2d\x69\x86\x70\xd6\x3b\xb5\x0d\xd0\xa9\x1c\xcc\x7b\xbd\x14\xc6\x86\x64\x27\x83\x35\x8f\x51\xd9\x6a\x31\xca\x79\x86\x8a\x9d\xfd\xf2\x9c\x06\xb8\x6e\x6c\x7a\xfc\x05\xc4\xb5\x99\x03\x46\xb6\x3a\xa4\xe6\xb6\xaf\x71\xdf\xbe\x46\x85\x52\x19\x1c\xc4\x00\xfd\x55\x45\xad\x46\xec\xe3\x0d\xd5\x79\x42\x4e\xd5\x6f\x3b\x42\xfe\xde\xae\x1f\xc4\xb3\xd5\x59\x53\xdd\x53\x37\xd3\x5d\xdd\x85\xb7\x03\xa3\xd1\x9d\xe0\x31\x50\xc6\xcb\x33\x8c\xa3\xb1\x73\x7d\x28\x18\x5b\xa0\x01\x46\x8e\xd2\xaa\x2e\x57\x1d\x3c\x8e\xa2\x80\x84\x2b\x6a\xfa\x9e\x78\xac\xba\x2a\xeb\x2a\xd2\x2c\x69\xb4\xcd\xc2\xda\x02\xb0\xd5\xd9\x78\x70\x98\x9e\xfb\x7f\x51\x28\xd4\xd4\x67\x45\x82\xce\x0e\x37\x10\x07\x14\x01\x1c\x53\xc5\x72\xca\x72\xc2\xd7\x9c\xf0\xd7\x9c\xf0\xaf\x2b\x27\xfc\x25\x93\xc1\x67\x1d\x6c\xd0\x22\xc2\x27\x73\x81\xc7\xf2\xff\x65\x32\xb8\x79\xfa\xad\xea\xad\x37\x7e\xda\xd5\xd8\x3f\x76\x32\xb8\x7f\xb2\xeb\xec\x6b\xb2\xab\x77\xb2\xab\x67\x3c\x7d\x36\x38\x0a\x9d\x87\xa1\xb2\xd6\x7b\xec\xc2\xe3\xab\xc7\xd3\x67\xbf\xfa\x78\xfa\xb5\xe2\x85\x16\xd6\x79\x16\x72\x2d\x2e\x5f\xec\x1a\x71\xf2\x51\x6a\x53\x33\xcf\x6e\xfb\xf6\xf3\x1e\x14\x88\x65\x94\x53\xdc\xe5\xdc\x18\xaa\x63\xd5\x90\xf0\x15\x39\xe1\x14\x82\x71\x51\x0d\x04\x67\x79\x1d\x4b\xa7\x4c\xb0\x05\xc6\x80\x89\x46\x5b\xc3\x10\x62\xbc\xcc\xed\xe2\x25\x2f\x27\xf6\x8c\xaf\xad\x33\x6f\x1d\xf3\x60\xd7\xd0\x56\x62\xd6\xc0\x15\xfb\x39\xcb\xa7\x9b\x1a\xdf\xa6\x51\x55\x77\x39\x83\x55\x84\xd5\x36\xe8\xc1\x86\xbc\xa1\x46\xb6\x47\x0c\xda\x03\x7a\xca\xa2\x49\xed\x83\xce\x77\xdb\x14\x18\xe5\x15\x07\x07\x6a\xae\x66\x4b\xe6\xeb\x57\xea\x6b\xca\x53\xf6\x72\x8d\x62\x41\xdb\x74\xcf\xde\x0f\x0e\x9a\x43\x7f\x01\xaf\x08\xb7\xaf\x2a\x09\x35\xeb\x6d\xf2\xdd\x47\xb6\x29\x3a\x9c\x27\x72\x7d\x57\x1b\x70\x74\x0b\xdc\x6d\xe5\xfd\xe0\x51\xba\x9d\xf7\xb6\x22\xe4\xdf\x45\xd8\x0c\xff\xbb\xb7\xf6\xdf\xbf\x1b\x16\x71\x6e\x88\x5f\x6b\xa0\x96\x82\x63\x1d\x4e\xbf\xf6\x68\x33\xfd\x3b\x8b\x8a\xb4\xdd\x21\xcd\xb5\xdd\x96\x29\xbd\x28\x97\xbb\xe5\x6b\xa8\x68\x45\x95\x46\xe2\x00\xba\xb1\x02\x17\x76\x2d\x35\xc6\x04\x29\xaf\x15\x8f\x6c\xbf\xe5\xc1\x05\x76\x32\xdc\xbc\xa9\xcb\x41\x87\x82\xea\x4d\xd1\xbb\xdb\x12\x36\x3e\x84\x1b\x32\x46\x1b\xdf\x27\x83\x43\x8a\x95\x14\x26\x6c\xf3\x7b\x97\x86\xd3\xc7\x10\xef\xbe\x0a\xa0\xb2\xa3\xca\x02\xf6\x59\x84\x92\x14\xdf\x2c\x38\xfd\xf8\x16\xd6\x4b\xa9\x7d\xa3\x9a\x2d\x8a\x50\x6e\x83\xab\x54\x55\x17\xf5\xc7\x0e\xe1\x63\xd7\x37\xc6\x65\x63\xdb\xc2\xfa\xf6\x0e\x74\x0d\x60\x3b\x22\xab\x4c\xdd\x66\x2d\x1f\x43\x38\x90\xa4\xd5\x75\xd8\x37\x9c\x52\x07\x1e\xb0\xcb\x8b\x30\x85\xf5\x3b\xf0\xfc\x3c\xaa\x25\xe0\x0a\x17\x4c\xc5\xb4\x0e\x74\x80\x2e\xee\xd0\x86\xad\x9a\xa0\x59\xf7\x04\x2d\xf7\x74\x33\xdd\x3d\x45\xa3\xfa\x57\x3d\x58\xa2\xcd\x24\xb4\x8e\xa2\x0f\xc3\xd4\x8c\xa6\xd8\x66\x50\x39\xe7\x63\xe8\x73\x54\xa1\x74\x9c\x2b\xb7\xc1\x5b\x0f\x6b\xd7\xf4\x9e\x6e\x9c\x10\x47\x4c\xa9\x0d\x65\x02\x66\x58\x31\x8b\xac\xba\x72\xb8\xcf\x49\x7e\x75\x08\xeb\x64\x93\x25\x8a\x0e\x46\xa8\x02\x53\xbe\x28\xa3\x8d\xc8\x2d\x86\x82\xf8\x99\x47\xe8\xa5\x66\x32\x38\x88\x0d\x5a\xd0\xaf\x9f\x79\xe6\x75\xfb\x13\x2a\x3e\xe7\x51\xc3\xca\x42\xb3\x46\xa8\xb7\x88\xa3\xaa\xfd\x1a\xf4\x98\x25\xad\x70\xe6\x3b\xdc\xd3\xec\x68\x58\x99\xbc\x93\xf1\x3d\xce\x27\x83\xc3\xfc\x13\x9e\x92\x45\xab\x79\xd0\x8a\xa8\xe2\x88\x89\x63\x5f\xb4\xe6\xe8\xa8\x6e\x73\x5e\xa3\xa1\xfb\x49\x0e\x5d\x9f\xaf\x2e\xc8\x78\x31\x3b\x48\x97\x22\xa1\x7a\x24\x0d\xb9\xe0\x7f\xce\x11\xae\x2e\x0a\x21\xe1\x82\x42\x7c\x52\x66\x9f\x3f\x5f\x5d\xe8\x31\xc0\x8f\x18\x91\x89\x80\x75\x9d\x6d\xa3\x2b\x96\xb4\xa7\xe3\xf6\xd3\xf5\x1f\x81\xda\xd9\xf7\x68\xeb\x0a\x45\x3c\xe4\xa0\x02\x4b\x38\xed\x6d\x91\x7e\x7e\x16\x26\xf5\xe0\xc7\x13\xb1\x8c\x4e\x82\xd0\x2d\xfb\x0e\xc9\x1c\x88\x18\x96\x98\x64\x7a\xab\xe4\x96\x19\xa0\xee\x0a\xdb\xaa\x21\x96\x76\x7b\x22\xe5\xb3\x23\x29\xe6\x49\xdd\x79\x09\x3d\x70\xde\x22\x88\x5e\xa4\xb9\x14\xf7\xb8\xe2\xfb\xc7\x83\x1c\x7a\x4c\x40\x80\x42\xd8\x9a\xe5\x69\x16\x96\x17\x32\x54\x5e\x24\xfc\xb9\x0f\x10\x2d\x99\x58\x78\x43\x53\x03\xd2\x6e\x4a\x2b\x92\x59\x41\x4b\xd9\xd2\x4a\xab\x78\x42\xc4\xe1\x60\x6a\x49\xfb\xc3\x5d\x24\xb0\x90\xb5\xe8\x9f\xb1\xe8\x79\xcd\x54\x3c\xa4\xa3\x46\x8c\x92\x49\x62\xf7\x24\xdb\xf4\x05\xed\xc7\x23\x56\xa9\xc3\x6e\xa1\x8a\x84\x69\x74\x4d\xeb\xb3\xa0\x1e\xb7\x52\xd1\x31\x04\x27\xa0\xd5\x01\x08\x7e\x61\xcc\x17\xb4\x8b\xda\x23\x86\x0a\xe6\x0a\x2c\xd9\x5d\x49\xd4\xe6\xea\x6e\x7a\x03\x6b\x56\x87\x06\x5b\xbc\x3a\xcb\x79\x62\xac\x0d\x08\xf5\x22\xd3\x1b\x82\xaf\xd0\x3d\x29\xca\xd4\x2c\x44\x21\x81\xcc\x50\x6d\x96\x37\x65\x26\x5a\xda\xdd\xf9\xe3\xc1\x01\x3c\x59\x9e\xc1\x33\xe9\xef\x1b\xb4\xeb\x41\x37\xb5\x47\xc5\x84\xb6\x90\x9b\x37\x34\xee\xa0\xfe\x9a\x30\x62\xb8\xf5\x65\xb1\x1c\x19\x98\x02\x54\xf0\xbc\x68\x11\x72\xeb\x64\xa0\xfd\xcb\x48\x60\xc2\xfa\x5f\xe3\x41\x43\x8b\x36\x49\x0d\xd3\xf8\x6c\x65\xa4\xf7\x14\x1e\x43\x0e\xd8\x4f\x83\xeb\xca\x3c\xd6\x4c\x37\x9d\xb5\xd2\x83\x52\x9e\xcc\x3e\x70\xea\x33\x98\x8f\x79\xca\xc4\x88\x3c\x06\x4a\xb3\x85\x57\x81\x8b\xd8\x5a\x63\xb1\x80\x18\x0d\xe3\x89\x06\x36\x93\xb5\x99\x82\x12\x0f\x15\x22\x1c\x3b\x74\x85\x4c\x4b\xd1\x6b\xe4\x84\x46\xd7\x9c\xa2\xf2\x6d\x76\x78\xa3\x77\x07\x74\x34\x32\xeb\x5c\x83\x86\x11\x3d\xd8\xa6\x41\xbe\x8b\xc1\x0c\xc3\x72\xf9\xa3\xca\x71\x08\x3f\xb1\x44\xe3\x10\x3e\x0b\x9b\xfe\x39\x7a\x5c\x6d\x7b\xf2\xb6\xf1\x44\x96\x57\xce\x21\x4a\xa8\x26\x55\x95\xe3\x3a\xb2\xeb\x7a\x97\x2b\x38\x5e\x8d\x12\x37\xb2\xc4\xaf\x79\xd0\x62\xef\xda\xa2\x84\xb9\x54\x58\xbf\x69\xa8\x5b\x55\xff\xe4\xdf\x0d\x5a\x9a\x4a\x3f\x52\x32\x73\x72\x0e\xeb\x25\x8a\x8a\x15\x03\x95\x0b\x1d\x8e\xc8\x28\x03\x43\x56\x27\x09\xf4\x56\x94\x2b\x45\x2b\xd1\xa5\xa9\x06\x3a\xd0\xc7\x1b\x43\x85\x73\x85\x74\xca\x0d\x44\x92\x29\x8d\xc9\x66\xe8\xe4\xca\xd9\xdd\xbd\x70\x97\xfe\x5b\xca\x5c\x8d\x07\x87\xa9\x57\x9f\x2c\x68\x55\xac\xdd\x68\xa2\xeb\x72\x0b\x12\x21\xac\x2f\x82\xc2\x76\xab\x06\xc0\xf5\x08\xca\x85\x46\x33\xf4\xc7\x48\xe4\x4e\x44\x86\x65\x97\x84\x4a\x1a\xc3\x5f\x50\x49\x90\x75\x26\x8e\x2e\x41\x09\x0d\xbe\x6a\x58\x2c\x0b\x2e\x02\xe9\xd8\x11\xa9\xe0\xc1\x11\x42\x50\xaa\xfd\xc9\x97\xeb\x44\xa0\xa9\xf8\x6a\xcc\x9c\x44\xc8\x4f\xbb\xc0\x0a\xe6\x7f\xc9\xa4\x40\x61\x38\x4b\x92\x0d\xe8\x54\x92\x41\x8c\xeb\x16\xbf\xdb\x29\x89\x31\x1d\x62\x64\xd9\x75\x48\x74\x0f\x7a\xd0\xee\xb4\x57\x68\x5d\xc4\x38\x64\x91\x7f\xf3\x6e\xfc\xdd\x87\xdf\x38\xa9\xe8\xa0\xa2\xa3\xbe\x07\x60\x45\x91\x82\x99\x8a\x80\xe9\xf1\xe1\xc8\x6d\x56\x62\xa3\x0a\x6d\x6b\x1e\xee\xd1\x64\x70\x80\x3e\xa3\x00\x79\x72\xa0\x28\x17\xd8\xad\x7b\xd8\x3f\x0b\xd2\x89\x91\xfe\x9c\xe4\xe7\x8f\xe5\x72\x3a\x2e\x58\xb4\xf1\x3c\x1f\xc8\x5e\xd2\xc7\x9e\x12\xa8\x62\x1d\xca\x75\x52\x96\xe9\xfa\x1c\xa8\x9f\x90\x57\x21\x46\x02\x72\x72\xce\xb6\x8b\xa6\xc1\x1b\xfb\xcb\xff\x3a\xbf\xfe\x7c\x71\x79\xf1\xf6\xfe\xf2\xe1\xf2\xfe\xe9\xf2\x02\x52\xa6\x9e\xfd\x9e\xc9\x06\xe0\x3a\xcf\x50\x69\xa4\xed\x20\xb3\x0d\x5c\xd2\xb9\x73\xb4\x52\x21\x28\xee\x49\x36\xe5\xce\x15\xf2\x87\x28\xda\xc9\x45\xca\x17\xa4\x74\x62\xaf\xed\x5a\x79\xad\xc1\x86\x01\x14\x27\x86\x4e\x06\xc7\x14\x67\xd8\x68\x92\x47\x46\x9f\xce\x02\xfd\x28\x4c\xd5\x5c\xe7\xbe\x53\x1f\x49\x57\xb2\x51\x0c\x16\x39\x05\x35\x31\x46\x09\xa7\xfd\x3d\x36\xe3\xc5\x6c\xc1\xd5\xc5\xe5\xf9\xf5\xd5\xa7\x4b\x2f\xe6\x8d\xe0\x67\x3e\xb2\xa7\x04\xf4\xf4\xfe\x8e\x6a\x4f\x67\x08\x73\x99\xd3\x51\x41\xce\x23\xb7\xcb\x56\x90\xd3\x99\xb3\xb5\xf1\x4a\x1f\xd9\x09\x73\x76\xe3\x9c\xb6\x2c\x7c\xf7\xd5\xd8\x3d\x05\xa9\x7f\x45\x79\x5f\x82\xd0\x75\x33\x3d\xf7\x10\x83\xe4\x05\x92\xc8\xf9\x4e\xf5\xbe\x93\xb4\x82\x42\xd4\xb6\x51\xe2\x0a\x2e\x52\xb5\x89\xc1\x03\xa7\x9d\x0b\xc3\x93\xde\x33\xfe\x4c\xad\x77\xbc\x8a\x62\x56\x11\x13\x5b\x59\xd1\x16\xa0\x94\x94\x63\x5c\x8c\x7f\x39\x02\xf7\xa9\x28\x0e\x7c\x77\x7c\xa1\xff\xc8\xe1\xb3\xe1\x69\x87\xda\xe9\xcb\x5d\x41\xd4\xcb\xd3\x73\x4a\x22\xa0\x76\xd2\xae\x4b\x66\x62\xba\xc8\x31\x73\x61\x13\x6f\xcd\xf1\x5e\xb9\xe3\xde\xe6\x2e\xec\x26\x78\xa7\x65\x29\x44\x9f\x21\x49\x77\x41\x5f\x37\x57\x7a\x69\x03\xf8\x92\x71\x85\x47\x69\x5b\x74\x6a\xfd\x74\x65\xd9\x4f\xb9\x74\x1d\xca\x76\x08\x25\x6a\x0e\x68\xf3\x92\xae\x7d\x89\xe0\x9e\xa4\x53\x3a\xd5\x27\xe6\xdc\xc9\x8a\xad\x06\xd0\x63\x28\xcd\xcc\x06\xf8\x2e\x28\xca\xc5\x15\x27\xdf\xec\xf6\xe8\x93\x7a\x2d\x70\xdb\xd6\xed\xca\xbf\x54\xc6\xaf\x86\xa8\x1b\x59\x96\xb5\x13\xdc\x5e\xd8\x79\x2c\x0f\x0a\x92\xd8\x70\x44\x65\x79\xd1\xda\x07\xe5\x19\xec\xff\x6f\x69\xd3\x95\x05\xd3\xaa\x27\xbb\xce\xa1\x19\x41\xbc\x8c\xb2\x41\xe3\x73\x18\x55\x3b\x3c\x4d\x4d\x75\xe6\xff\x0f\xc7\x7a\x71\xd8\x7b\x40\x7d\xd1\x43\xc0\xff\xd3\x4d\x1d\xe2\x89\x2d\x3d\xeb\xcd\xa5\x6a\x67\xd0\x62\xe3\xaf\x88\x03\x2e\xe2\x20\xd8\x6e\xa7\x3d\xb9\x69\x3e\x24\x70\xfe\x25\xf9\x74\x48\x59\x01\x4a\x2e\xd7\xa7\x53\xcb\x3f\x2e\x8c\x92\x71\x1e\x61\xdc\xcd\xd1\x1d\xf8\x95\x6b\x81\xea\xb5\x70\x7b\x4b\xc0\x02\x5e\x2b\x6e\x6f\x37\x3e\xb7\x70\xd6\xda\xc7\x2e\x3e\x4f\xc6\x80\xe6\x22\xc2\x5f\xd4\xb7\xea\x3a\x90\xaa\x5b\x02\x2d\xeb\xb4\xb6\x08\xf8\x6c\x6d\x14\x70\x79\xda\x84\xba\x7d\x89\x86\xdc\x59\x0f\x6b\xd8\xd9\xa0\xbe\x08\xa3\x3b\x2e\x69\x1e\xf4\xa8\x0c\x78\x6a\x9e\x55\xbe\x76\xd0\x6b\x8c\x54\x4d\x38\x19\x1c\x2e\x54\xb4\xa1\xc4\x8a\x8d\xde\x89\x47\x0b\x77\xb9\x61\x83\x4a\xa8\xe5\xa9\xad\xf6\x66\x75\x47\x5d\xb7\x3b\x0a\x27\x46\x7f\x5e\x4a\xbf\xba\x33\x5f\xdd\x99\xaf\xee\xcc\x57\x77\xe6\xab\x3b\xf3\xd5\x9d\xf9\xea\xce\xfc\x7a\xdd\x19\x5a\x5d\x38\xa7\x6a\x9a\x1a\x8a\x6f\x89\xd6\x75\xd1\x70\x2b\x3f\xe6\x95\x84\x9c\x57\xd7\xe0\xd6\x58\x5b\x6c\x4f\x7d\xb9\xd2\x9d\x3a\xc5\xd0\xcd\xc6\x2d\xb4\x26\xd0\xe7\x4b\x8c\x9e\x3b\x66\x51\xab\x20\xae\xc3\xcb\x41\x35\x28\xd4\x74\xb4\xbc\x9f\x14\xc1\xb6\xd9\x64\x88\xa8\x07\x5a\x82\x0d\x85\xce\xc1\x37\xab\x55\xb8\x7e\xb5\x89\xda\x0b\xaa\xf6\x1a\x1c\xe6\x01\x45\x32\xcd\x12\x6c\xaf\x46\xe9\x27\xfa\x1d\x32\xd2\x71\xb8\x49\x37\xfe\xe8\xba\xba\xf3\x40\x02\x0e\x2b\x89\x53\xda\x82\xc8\xe8\xac\xeb\xa2\x32\xc2\x7e\x8c\xa9\xa2\x80\xad\xdf\xd0\x00\xd9\x79\x13\x76\x41\x84\x8e\xce\xa2\x72\x21\x5a\x75\xa3\xd5\x9b\xc4\x97\xdd\x04\xda\x35\x62\xba\x07\x16\xa8\x3e\x4e\x44\x9b\x1b\x9e\x24\x5c\x63\x24\x45\x7c\x12\x3e\xae\xf7\xc1\xd1\x08\xe9\xd3\x37\xc5\xb7\x07\xf0\xc5\x09\x43\x59\x50\x7b\x71\xf5\x70\x7e\xfb\x74\x79\x0f\x46\x36\xc0\xa5\x56\xd3\xf3\x9f\xc1\x48\xf9\x3c\x6e\xe5\x89\xfa\x9a\xb3\x6e\xcd\xd3\xbd\x54\xb0\x85\x81\xfd\x55\x80\xc2\x02\xee\x52\xb9\xe5\x04\x87\x42\xb2\x74\xcb\x09\xe5\x1d\x14\xf4\xc5\x42\x7d\xc6\xec\xcb\x8a\xc2\xd7\x26\x36\x15\x36\x9a\x33\x9e\x60\x7c\xd4\x00\xfc\xd9\xdf\x3d\x06\xd0\x7a\x3c\xbc\xc2\x08\x39\x79\x10\xbe\x4c\x71\x7a\xfe\x73\xfd\x70\x1a\x8b\xdd\x7a\x8c\xb5\xad\x96\x85\xae\x4c\xc6\x3d\xbf\xe0\x70\xe7\x5a\x06\xea\x6f\x7d\xb7\x81\xa8\x8a\x0a\xee\x64\x31\x19\x2b\xcd\x83\x0e\x5f\xfa\x28\xec\xdb\x62\xcc\x2f\xac\x2a\xa9\x9c\xa8\x01\x7e\xb3\x53\x34\x82\x7b\xa7\x97\x1a\x9e\x3e\xe4\x51\x84\xd8\xe4\x0b\x8d\xe0\x27\xcb\x91\x87\x0f\xb7\xcd\x85\xb0\x13\x39\xd4\x4f\xb8\x47\xbd\x11\x35\x9b\xc5\xba\x35\xe2\x75\xf1\x76\x60\x13\x99\x9b\x48\x96\x9c\x42\xe0\xc9\xdd\xdb\x88\x08\x98\x7e\xa6\xa2\x49\xa9\x8a\x68\xb9\x06\x62\x68\x5b\x6c\x78\xf8\x87\x35\xaf\xc7\xab\x25\x5f\xb4\xe4\xa7\x1a\xd1\xd7\xa8\xa8\xc0\x5c\x61\xc6\xb8\xa2\x84\x10\x7d\xb1\xc0\x2c\x8f\xb5\x78\x0e\x8e\xee\x31\xb0\x7b\xd7\xd2\x9d\x6b\xe1\x2b\x89\x15\x9f\x6f\x0d\x2f\xac\x96\xc7\x1e\x6e\x93\x0e\x6d\xa7\x0a\x5d\x3c\x63\xa9\xaf\x85\x68\x6a\xd2\x87\xe7\xc2\x1f\xd5\x27\x17\xa5\x15\x75\x0b\x8a\x34\x09\x2e\x46\x29\xa6\x52\x6d\x6c\x73\xaa\xaf\xf7\x0b\x8b\xdd\x6b\xbd\x52\xc1\x5c\x21\x65\x3d\xe8\xb3\x2e\xc6\xc3\xb7\x7e\xb0\xff\x68\x68\xe3\xcb\x5d\x86\xd8\x1b\xe3\x57\x44\xc6\xcd\xf4\x7c\x17\x17\x15\x03\xbd\x87\x0c\x7a\x16\xd1\x97\x54\x21\x65\x19\xd5\xe3\x1b\xd9\x75\x2c\xc4\x2e\x6e\x99\xd8\xc7\x08\x39\xcc\x0e\xc7\xe5\xd1\xa7\x36\x90\x38\x11\x55\xdc\x26\x4e\xaf\x09\xd2\xeb\x60\xab\x0a\xb0\x9e\x79\x76\xb7\x0e\xdb\xe3\x5a\x53\xf7\x9e\xf5\xeb\x5a\xc0\xd7\xe0\xc5\x15\x4a\x50\xfc\x54\xe6\x5d\x3a\x4a\x09\xfa\x60\x46\x1b\x96\xe0\xeb\xe1\xe5\xa1\x04\x57\x60\xa5\x36\x10\xf4\x3b\x2c\x04\x9d\x73\x0b\x72\x2d\xa8\x76\x67\x93\x4a\x85\x4d\x9f\x72\xa2\x6b\x0b\x07\x16\x6c\x7c\xca\xec\x9b\xcd\x60\xd8\xa7\x5c\xa8\x9b\x86\x16\xa5\x08\x36\x35\xa8\xf2\x49\x43\x9b\x0a\x09\x6a\x5b\xb4\xd8\xde\x30\x0b\xd4\xe6\xea\x62\x32\xe8\xa4\x9d\xdf\x77\xe9\xf6\x3a\x95\x1f\x3b\x91\xf3\xaa\xbe\x2e\x2d\x67\xe5\x6e\x2d\x6c\xa0\xb3\xc9\xc9\x1e\x1f\x61\x65\xda\x7c\x90\x6d\x0b\x5c\xd3\xa0\x98\xf3\xe0\x00\x64\xb5\x95\xc2\x76\xdb\xf3\x96\xc9\x10\xe0\x3f\x28\x5e\x7b\xb2\x46\xb7\xe8\x5c\x17\x6f\x07\xa2\xf0\x98\xaa\x5c\xcd\x26\xd0\xa5\xb2\xb3\x88\xec\x08\x13\x45\xdd\x14\xf5\x5c\x03\x92\x3e\x59\xcb\x0d\xa9\x1e\xaf\x84\x6c\xf4\xb0\xb5\x23\x37\x94\x2e\x53\x61\x1b\x39\xe1\xd6\x39\x27\x1b\x6d\x9d\xe5\xbc\x2e\x4b\x2e\xa8\xf4\x7b\x7c\x08\x62\x32\x14\xb4\x0a\x50\xd6\xa1\xea\x63\x10\x74\xb7\x07\x05\x74\x9e\xa6\x4c\xf1\xbf\x78\xb3\xf4\xc4\x95\xc9\x59\x72\xc3\xa2\x25\x17\xe8\x77\x6a\x52\xb1\x10\x5f\x68\x58\x33\x6e\xf6\x87\xe6\x89\xde\xb1\x7f\x75\x70\x98\x8f\xd2\x72\xba\x57\x97\x36\x92\x09\x9d\xeb\xf8\xd0\x9c\xd1\xed\xc6\x13\x5d\xb7\x25\x98\xed\x64\x1c\xed\xb4\xd2\x66\xe4\x91\xd1\x86\xb1\x06\xc8\x96\x2f\xa8\x86\xd2\x41\x18\x7f\x39\xb7\xd8\xed\x95\x79\x85\x75\xc4\x6e\x0b\xd0\xaa\x5a\xdb\x35\x54\x2e\xcc\x21\xca\xc7\x7d\xd1\xdc\x7f\xf5\x7c\x32\x38\x9c\xba\x0f\x55\x00\x85\xfa\xf6\x3f\xe5\x7c\x6b\xdb\xa2\x6d\xba\xab\x3a\x1a\x74\xc5\x5a\x49\xe3\x77\xe5\xb9\xb7\x99\x19\xc3\x34\xfc\xc8\x14\xd2\xc9\x36\x3e\x2d\x15\xf6\x8c\xf8\x0f\xb5\xdb\x4f\xa2\x27\x2c\x7a\xae\x01\x6b\x3f\x7e\xa6\x77\xc7\xa0\x30\x21\x07\x93\xce\x6c\x70\x7b\x2b\x39\xd5\x35\x81\x51\xb4\xe3\xc7\x3a\x4a\xde\xae\xfb\x25\xa6\x1a\xc0\x74\x5c\x7f\xae\x16\x3e\x5f\xa0\xc7\x8d\xaa\xbc\x3e\xcb\xd5\xc6\x13\xba\xfd\xbb\xd8\x47\xef\x20\xec\x71\x18\x6d\x87\x48\x74\x1e\x42\xdb\xba\xb3\xbd\x57\x17\xcd\xdc\xde\x7d\xe8\x6c\xdb\x81\xb3\x47\xed\x9a\xaa\x7d\x69\xef\x26\xd1\x0b\xe3\xca\x37\xa3\xb5\x91\x8a\x02\xea\xca\x9d\x7c\x56\x7c\x2a\x3f\xcc\x4c\x1b\x66\x72\x3d\x81\xbf\xfe\x7d\xf0\xbf\x03\x00\x7b\x89\x5f\x66\x51\x85\x00\x00")
 
 func chartCrdsNetworkHarvesterhciIo_ippoolsYamlBytes() ([]byte, error) {
 	return bindataRead(
@@ -94,12 +94,12 @@ func chartCrdsNetworkHarvesterhciIo_ippoolsYaml() (*asset, error) {
 		return nil, err
 	}
 
-	info := bindataFileInfo{name: "chart/crds/network.harvesterhci.io_ippools.yaml", size: 7603, mode: os.FileMode(420), modTime: time.Unix(1750154346, 0)}
+	info := bindataFileInfo{name: "chart/crds/network.harvesterhci.io_ippools.yaml", size: 34129, mode: os.FileMode(420), modTime: time.Unix(1792183512, 0)}
 	a := &asset{bytes: bytes, info: info}
 	return a, nil
 }
 
-var _chartCrdsNetworkHarvesterhciIo_virtualmachinenetworkconfigsYaml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\xbc\x57\xdd\x6f\x23\x35\x10\x7f\xcf\x5f\x31\x12\x0f\x07\xd2\x6d\xa2\x0a\x04\x28\x52\x05\x21\x3d\x20\xa2\x2d\xd5\xa5\x57\x09\x21\x1e\x26\xeb\x49\xe2\xab\x3f\x16\x7b\x9c\xbb\x72\xdc\xff\x8e\x6c\xef\x36\x9b\x8f\x4d\x73\xa1\xe0\xb7\xb5\x67\xe6\x37\xdf\x33\x5b\x14\x45\x0f\x2b\x79\x47\xce\x4b\x6b\x86\x80\x95\xa4\xf7\x4c\x26\x7e\xf9\xfe\xfd\xb7\xbe\x2f\xed\x60\x75\xd6\xbb\x97\x46\x0c\x61\x1c\x3c\x5b\xfd\x9a\xbc\x0d\xae\xa4\x0b\x9a\x4b\x23\x59\x5a\xd3\xd3\xc4\x28\x90\x71\xd8\x03\x40\x63\x2c\x63\xbc\xf6\xf1\x13\xe0\xc3\xc7\x1e\x80\x41\x4d\x43\x58\x49\xc7\x01\x95\xc6\x72\x29\x0d\x19\xe2\x77\xd6\xdd\x97\xd6\xcc\xe5\xc2\xf7\xeb\xcf\xfe\x12\xdd\x8a\x3c\x93\x5b\x96\xb2\x2f\x6d\xcf\x57\x54\x46\x49\x0b\x67\x43\x35\x84\x2e\xb2\x8c\x51\x63\x66\x7d\xef\x32\xdc\x55\x86\xbb\xce\x8c\xe3\x04\x97\xa8\x94\xf4\xfc\xcb\x53\x94\x97\xd2\x73\xa2\xae\x54\x70\xa8\x0e\x1b\x91\x08\xfd\xd2\x3a\xbe\x5e\x2b\x53\xc0\x4a\x1b\xe2\x72\xbe\xd8\xfa\xac\xc9\xa5\x59\x04\x85\xee\xa0\xe4\x1e\x80\x2f\x6d\x45\x43\x48\x82\x2b\x2c\x49\xf4\x00\x56\x39\x70\x09\xa8\x00\x14\x22\xc5\x03\xd5\x8d\x93\x86\xc9\x8d\xad\x0a\xda\x3c\xaa\xf1\xd6\x5b\x73\x83\xbc\x1c\x42\x3f\x3a\xb5\xbf\xd2\x51\x58\x7a\x6c\x22\x74\x77\x75\x3d\xba\x7a\x55\x5f\xf1\x43\x04\xf4\xec\xa4\x59\xec\x11\xc1\xc8\xc1\xf7\x4b\x6b\x32\xaa\xff\xfd\xbb\xcf\xbf\xef\x47\x9e\xf3\xf3\x17\x23\xa5\x6c\x89\x4c\xe2\xc5\x17\x7f\xd4\x94\x1b\x38\xa3\xcb\xcb\x5f\xc7\xa3\xdb\x57\x17\xff\x1e\xea\x42\x7a\x9c\xa9\x4e\xa4\x8b\xc9\x74\xf4\xc3\xe5\x73\x00\x4d\xcc\xf4\xc1\x94\x9d\x40\x93\xeb\xe9\x6f\xd7\xe3\x23\x81\x9a\x8a\xe9\x97\x8e\x52\xb1\xdc\x4a\x4d\x9e\x51\x57\x9b\x6e\xfa\x69\x33\x16\x02\x39\xc7\xab\xae\xa7\x33\x54\xd5\x12\xcf\x72\x1e\x95\x4b\xd2\x38\xac\xe9\x6d\x45\x66\x74\x33\xb9\xfb\x72\xba\x71\x0d\x50\x39\x5b\x91\x63\xd9\x64\x67\x3e\xad\x26\xd0\xba\x05\x10\xe4\x4b\x27\x2b\x4e\xdd\xe1\xef\x62\xe3\x0d\x20\x02\x64\x2e\x10\xb1\x1b\x90\x07\x5e\x52\x93\x95\x24\x6a\x9d\xc0\xce\x81\x97\xd2\x83\xa3\xca\x91\x27\x93\xfb\x43\xbc\x46\x03\x76\xf6\x96\x4a\xee\x6f\x89\x9e\x92\x8b\x62\x62\x31\x05\x25\xa0\xb4\x66\x45\x8e\xc1\x51\x69\x17\x46\xfe\xf5\x28\xdb\x03\xdb\x04\xaa\x90\xc9\x33\xa4\xbc\x37\xa8\x60\x85\x2a\xd0\x4b\x40\x23\xb6\x24\x6b\x7c\x00\x47\x11\x13\x82\x69\xc9\x4b\x0c\x7e\x5b\x8f\x2b\xeb\x08\xa4\x99\xdb\x21\x2c\x99\x2b\x3f\x1c\x0c\x16\x92\x9b\xd6\x58\x5a\xad\x83\x91\xfc\x30\x28\xad\x61\x27\x67\x81\xad\xf3\x03\x41\x2b\x52\x03\x2f\x17\x05\xba\x72\x29\x99\x4a\x0e\x8e\x06\x58\xc9\x22\x19\x62\x52\x6e\xf5\xb5\xf8\xcc\xd5\xcd\xd4\x6f\xc0\xee\xe4\x4e\x3e\xa9\xab\x7d\x42\x78\x62\x6f\x03\xe9\x01\x6b\x51\xd9\xc4\x75\x14\xe2\x55\x74\xdd\xeb\x57\xd3\x5b\x68\x34\xc9\x91\xca\x41\x59\x93\xee\xf8\xa5\x89\x4f\xf4\xa6\x34\x73\x72\x99\x6f\xee\xac\x4e\x32\xc9\x88\xca\x4a\xc3\xe9\xa3\x54\x92\x0c\x83\x0f\x33\x2d\x39\xa6\xc1\x9f\x81\x3c\xc7\xd0\x6d\x8b\x1d\xa7\xf1\x01\x33\x82\x50\xc5\x64\x17\xdb\x04\x13\x03\x63\xd4\xa4\xc6\xe8\xe9\x7f\x8e\x55\x8c\x8a\x2f\x62\x10\x8e\x8a\x56\x7b\x28\x6e\x13\x67\xf7\xb6\x1e\x9a\x21\xb7\x3e\xfb\xeb\x34\x1e\xd3\x1e\x4f\x3b\xaf\x00\x92\x49\xef\xb9\x3e\x24\xb2\x66\xac\x46\x42\x38\xf2\x1d\xcf\x00\x73\xeb\x34\xf2\x10\x64\xb5\xfa\xaa\x83\xa4\xc3\x19\xeb\xa3\xb1\x7c\x02\x45\xe3\xfb\x4b\x32\x8b\xd8\x27\xcf\xbe\x39\x15\xa6\x76\x52\x1c\x70\x47\xe0\x7c\x7d\xa2\x39\x31\x93\xa5\x23\xb1\x0f\xa2\x68\x99\xba\xf7\xb9\xa5\xe2\x9e\xf7\x8e\x44\x79\x54\x7d\x92\xa2\x0c\xbb\x8a\x67\x46\x74\x0e\x1f\xb6\xde\x2a\x0c\x7e\x9f\xae\x99\x63\x66\xad\x22\x34\x5b\xaf\x79\x47\xd8\xe5\x39\xec\xbc\x83\x6e\x7b\x5f\xdc\x87\x19\x39\x43\x4c\xbe\x58\xa1\x92\xa2\xbd\x2e\x6e\xfa\x48\x93\xf7\xb8\xc8\x8b\x09\x6a\x8a\xdd\x4c\x6a\x1d\x38\x4e\xfc\x7d\xf1\x08\x2a\xe2\x92\x9a\xc3\xf9\x39\x58\x25\xa6\xa4\xe6\x1b\x74\xfb\x23\x56\xc0\xc6\x2e\xd4\x36\x62\xb7\x54\xd3\xe8\x3f\xb6\x58\xd7\xab\xc4\x33\x16\xaa\x42\xcf\xb7\x0e\x8d\x97\xcd\xea\xd0\x95\xe3\x1b\x03\xe2\x12\x3d\x03\x4b\x4d\xb9\x29\x37\x9a\x01\x3f\x8a\x22\x91\x3b\xb8\x35\x04\x1b\x2b\xce\xee\x61\x0b\x68\x2c\x2f\xc9\x6d\xb7\xe1\x47\x8a\xa7\x6a\x34\x9a\xf1\x26\xb5\xf9\xa3\x4d\xb8\x4d\x93\x7e\x6d\x86\xf4\x2d\x3b\xde\xa1\xef\x1a\x1b\x47\xeb\xd4\x24\xdc\x31\xca\xfc\x1c\x34\x9a\xc2\x11\x8a\x98\x8e\x0d\x2b\x48\x23\x64\x89\x69\xba\x0a\x62\x94\xca\x03\xce\x6c\xd8\xad\xe2\xb6\x1f\x5a\x41\x38\x55\x75\x47\xe8\xb7\xf7\xb7\x0e\xcd\xa3\x1b\x33\x79\xec\xe9\x9b\xe9\xf0\xc2\x6f\x2b\x74\xb2\x33\xf7\x95\x4a\x87\x46\xd3\x44\x9a\x37\xc5\x96\x32\x2f\x53\x2a\xda\x39\xdc\xba\xb8\xcd\xfd\x88\xca\xd3\x4b\x78\x63\xee\x8d\x7d\x77\xba\x5e\x89\xe0\x28\x3f\x3d\x54\x09\xbd\x54\x21\xfe\x6a\xae\xf5\x3a\x11\xfa\xf0\xbc\xe8\xac\xb8\x22\xc9\xfd\xd4\x21\xd1\x3d\x08\xfe\xb3\x0d\x02\x9b\xdf\xbe\xc9\xcd\x13\x43\xfe\x19\xf6\x84\xe7\xd8\x01\x8e\x4a\xe1\x53\xb9\x4f\x8a\xce\x5e\xa6\x9d\x4b\x1f\xd7\x6f\x31\x04\x76\x21\xe7\x85\x67\xeb\xd2\xa0\x5c\xdf\x84\xd9\xe3\xdf\x45\x63\x40\x5d\x90\xf0\xe1\x63\xef\x9f\x00\x00\x00\xff\xff\xaa\xdd\x1c\xed\xfb\x11\x00\x00")
+var _chartCrdsNetworkHarvesterhciIo_virtualmachinenetworkconfigsYaml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\xbc\x59\x5f\x6f\xe3\xb8\x11\x7f\xf7\xa7\x18\xa0\x0f\xdb\x02\x91\x82\x45\x0f\xdb\xc2\xc0\xa2\x75\x9d\x6d\xcf\x68\xb2\x67\x24\xb9\x05\x8a\xa2\x0f\x63\x6a\x24\xf1\xc2\x3f\x2a\x49\x39\xeb\x5e\xef\xbb\x1f\x86\x92\x6c\xd9\x91\x1c\xc7\xc9\x9e\xb3\x0f\x2b\x6a\xf8\xe3\xfc\xe3\x6f\x86\x54\x92\x24\x13\xac\xe4\x17\x72\x5e\x5a\x33\x05\xac\x24\x7d\x0d\x64\xf8\xc9\xa7\x0f\x7f\xf6\xa9\xb4\x97\xeb\xf7\x93\x07\x69\xb2\x29\xcc\x6b\x1f\xac\xbe\x25\x6f\x6b\x27\xe8\x8a\x72\x69\x64\x90\xd6\x4c\x34\x05\xcc\x30\xe0\x74\x02\x80\xc6\xd8\x80\x3c\xec\xf9\x11\xe0\xe7\x5f\x26\x00\x06\x35\x4d\x61\x2d\x5d\xa8\x51\x69\x14\xa5\x34\x64\x28\x3c\x5a\xf7\x20\xac\xc9\x65\xe1\xd3\xf6\x31\x2d\xd1\xad\xc9\x07\x72\xa5\x90\xa9\xb4\x13\x5f\x91\x60\xa4\xc2\xd9\xba\x9a\xc2\x98\x58\xb3\x46\xbb\x66\xa3\xef\x97\x66\xb9\x9b\x66\xb9\xcf\xcd\xc4\x79\x5c\x2e\x4a\x29\xe9\xc3\x3f\x9f\x93\xbc\x96\x3e\x44\xe9\x4a\xd5\x0e\xd5\x71\x23\xa2\xa0\x2f\xad\x0b\x9f\x77\xca\x24\xb0\xd6\x86\x82\xc8\x8b\x83\xc7\x56\x5c\x9a\xa2\x56\xe8\x8e\x22\x4f\x00\xbc\xb0\x15\x4d\x21\x02\x57\x28\x28\x9b\x00\xac\x9b\xc0\x45\xab\x13\xc0\x2c\x8b\xf1\x40\xb5\x74\xd2\x04\x72\x73\xab\x6a\xdd\xc5\x21\x81\x9f\xbc\x35\x4b\x0c\xe5\x14\x52\x76\x6a\xba\xd6\x0c\x16\x95\xe8\x22\xf4\xe5\xe6\xf3\xec\xe6\x53\x3b\x14\x36\xbc\xa0\x0f\x4e\x9a\x62\x00\x22\x60\xa8\x7d\x2a\xac\x69\x56\xf5\xff\xfe\xcb\xef\xff\x9a\xf2\x9c\x8f\x1f\xdf\xcd\x94\xb2\x02\x03\x65\xef\xfe\xf0\x9f\x56\x72\x6f\x9d\xd9\xf5\xf5\x0f\xf3\xd9\xfd\xa7\xab\xd7\x2f\x75\x25\x3d\xae\xd4\xe8\x4a\x57\x8b\xbb\xd9\xdf\xae\xdf\x62\xa1\x85\xb9\xdb\x18\x31\xba\xd0\xe2\xf3\xdd\xbf\x3e\xcf\x4f\x5c\xa8\xdb\x31\xa9\x70\x14\x37\xcb\xbd\xd4\xe4\x03\xea\x6a\x0f\x73\xf6\x8f\xfd\x58\x64\x18\x68\xb2\x7b\xbd\x7e\x8f\xaa\x2a\xf1\x7d\x1c\xf2\xa2\x24\x1d\xb7\x20\x3f\xd9\x8a\xcc\x6c\xb9\xf8\xf2\xc7\xbb\xbd\x61\x80\xca\xd9\x8a\x5c\x90\x5d\x76\x36\x7f\x3d\x12\xe8\x8d\x02\x64\xe4\x85\x93\x15\x6b\x38\x85\xff\x27\x7b\xef\x00\x78\x81\x66\x16\x64\xcc\x06\xe4\x21\x94\xd4\x65\x25\x65\xad\x4e\x60\x73\x08\xa5\xf4\xe0\xa8\x72\xe4\xc9\x34\xfc\xc0\xc3\x68\xc0\xae\x7e\x22\x11\xd2\x03\xe8\x3b\x72\x0c\x03\xbe\xb4\xb5\xca\x40\x58\xb3\x26\x17\xc0\x91\xb0\x85\x91\xff\xdb\x62\x7b\x08\x36\x2e\xaa\x30\x90\x0f\x10\xf3\xde\xa0\x82\x35\xaa\x9a\x2e\x00\x4d\x76\x80\xac\x71\x03\x8e\x78\x4d\xa8\x4d\x0f\x2f\x4e\xf0\x87\x7a\xdc\x58\x47\x20\x4d\x6e\xa7\x50\x86\x50\xf9\xe9\xe5\x65\x21\x43\x47\x8d\xc2\x6a\x5d\x1b\x19\x36\x97\xc2\x9a\xe0\xe4\xaa\x0e\xd6\xf9\xcb\x8c\xd6\xa4\x2e\xbd\x2c\x12\x74\xa2\x94\x81\x44\xa8\x1d\x5d\x62\x25\x93\x68\x88\x61\xf3\x7d\xaa\xb3\xdf\xb9\x96\x4c\xbb\x54\x1a\xc9\x9d\xe6\x5f\x64\xb5\x17\x84\x87\xb9\x0d\xa4\x07\x6c\xa1\x1a\x9f\xec\xa2\xc0\x43\xec\xba\xdb\x4f\x77\xf7\xd0\x69\xd2\x44\xaa\x09\xca\x4e\xd4\x8f\xc5\x87\xbd\x29\x4d\x4e\xae\x99\x97\x3b\xab\x63\x38\xc8\x64\x95\x95\x26\xc4\x07\xa1\x24\x99\x00\xbe\x5e\x69\x19\x38\x0d\xfe\x5b\x93\x0f\x1c\xba\x43\xd8\x79\x2c\x1f\xb0\x22\xa8\x2b\x4e\xf6\xec\x50\x60\x61\x60\x8e\x9a\xd4\x1c\x3d\xfd\xc6\xb1\xe2\xa8\xf8\x84\x83\x70\x52\xb4\xfa\x45\x71\xf7\x6b\x84\x1b\xf7\xf6\x5e\x74\x45\x0e\xe0\xf8\x3e\xe5\xbf\xb6\x30\x34\xe5\xe9\xc9\x5b\x00\x19\x48\x0f\x0c\x1f\x83\xec\xb2\x29\xc7\x5a\x85\x5b\x5b\x07\x1a\x96\x78\x2e\xe3\x76\xbf\xab\x1e\x16\x04\x52\xca\xc3\x63\x49\xa1\x8c\x89\xc2\x3b\x2a\x90\xcb\x51\x10\x14\xc4\x89\x50\x12\x38\x5e\xd6\x31\x29\x70\xca\x2c\x96\x4b\x6b\xd5\x28\x3c\x7a\xe0\x4c\x6a\x35\x6e\xe6\xa6\xf0\xe5\xc6\xc3\xa3\x0c\x25\x78\x5a\x93\x43\xb5\x5b\x66\x4b\x24\x25\xae\x09\x64\x00\x4f\x01\xac\x19\xc5\xb7\x46\x6d\xc0\x1a\x6a\xd5\xd1\x29\x2c\x02\xe4\xc8\x66\xac\x50\x3c\x74\xa4\xe3\x29\xc4\x5d\xb4\xa7\x74\x3a\x19\x84\x6c\x43\xbf\xb2\x56\x11\x0e\xaf\x2c\xab\x59\x96\x39\xf2\x23\xf1\x01\xc8\xad\xd3\x18\xa6\x20\xab\xf5\x77\x23\x22\x23\xd9\xb8\xfb\xd3\x28\x9e\x59\x45\xe3\xd7\x6b\x32\x05\x17\xaa\xf7\x7f\x3a\x7b\x19\x9b\xbd\x3a\x89\x6e\x6c\x36\x94\x3c\x8b\x25\xb7\x3a\xec\x27\x66\x37\xcf\x4c\x94\x81\x5d\x93\x83\xab\xef\xe7\x4b\xb0\x2e\x86\x6f\x14\x95\x19\x2d\x4e\xc9\xad\x03\x84\x82\xb9\x88\x0b\x4c\x2e\x8b\xda\x71\x61\xe1\xf2\x24\x50\xa9\x4d\x8c\x7a\x9b\x63\xcc\x56\x90\x95\xa2\x1a\x0b\x2f\x99\x5a\x8f\x19\x9c\xc4\x99\xa3\x2f\x5b\x8d\x7e\x18\xd7\xfa\x59\x77\xb7\xa4\xc0\x0d\xdd\x09\x61\xfd\x70\x66\xf6\x30\x73\x4b\x47\x07\x55\xa8\x33\x63\x97\x59\x83\xaf\x7b\x2a\x0e\xbc\x1f\x21\xc6\xad\xea\x8b\xc8\x6a\xf0\x54\xf1\x66\x22\x3a\x87\x87\xce\xab\xb0\xf6\x43\xba\x1e\xdb\x88\x4d\x4f\x3c\x9d\xbc\xcc\x79\x47\xdd\xf6\x35\x79\xa8\x57\xe4\x0c\x05\xf2\xc9\x1a\x95\xcc\xfa\xc7\xa3\xfe\x2f\x01\x4d\xde\x63\xd1\x34\xe2\xa8\x89\xf3\x5b\x6a\x5d\x07\xee\x70\x9f\x88\x03\xb8\x5a\xf1\x2e\x24\x95\xc3\xc7\x8f\x60\x55\x76\x47\x2a\x9f\x3c\x1f\xb1\xa4\xb5\x73\x72\x42\x04\x9a\x56\x77\x3a\x39\xad\x92\xec\x5a\xe7\x37\x2c\x4c\x0a\x7d\xb8\x77\x68\x7c\x44\xe6\x56\xf9\x24\x66\xb9\x46\x1f\x20\x48\x4d\x91\x35\xb6\x9a\x41\xd8\x42\x31\x09\x70\xc7\xc2\x4c\xbf\xd7\xd2\x3f\xfd\x0b\x16\xd0\x58\xe6\xa0\xf4\xbc\xbd\xd3\x98\xf1\x63\x6c\x6b\x4e\x36\xe1\x3e\x76\xb6\x3b\x33\xa4\xdf\x79\x18\x1e\xd1\x8f\xb5\x49\x27\xeb\xd4\x25\xdc\x29\xca\x7c\x5f\x6b\x34\x89\x23\xcc\x38\x1d\xbb\x5c\x05\x69\x32\x29\x30\xd6\xc1\x8c\x02\x4a\xe5\x01\x57\xb6\x7e\xba\x8b\xbb\x1f\xfb\xa1\x17\x84\x73\x55\x77\x84\xfe\xf0\xbc\x32\xa2\x39\xbb\xb1\x11\xe7\x12\xba\x9f\x0e\xef\xfc\xa1\x42\x67\x3b\x73\x68\xab\x8c\x68\x74\x17\x45\xbb\xc6\x61\xab\xcc\x45\xd7\x74\xdc\x3b\x3e\xbd\xfc\x1d\x95\xa7\x0b\xf8\xd1\x3c\x18\xfb\x78\xbe\x5e\x51\xf1\x53\xb4\xba\xdf\x54\xb1\xe5\x11\xaa\xe6\x1b\x98\x9d\x5e\xe9\xb7\xa8\x17\xa3\x3b\x2e\x89\x26\xbd\xb4\x48\x8c\x17\x02\x8e\xef\x2d\xf9\x8d\x39\xe8\xb1\x4f\xeb\x45\xae\xb7\xb3\x99\x8e\x39\x5c\xb6\x0e\xc2\xea\xae\x39\x6c\xd2\xc7\x51\xb2\x26\x27\xf3\xb8\x15\xac\x01\xf4\x0f\x6d\x8b\xc1\x1d\xe9\x00\x2c\x03\xb9\xa8\x54\xef\xce\x2c\x9d\xbc\x8c\x1b\x85\xd5\x95\xa2\xe3\xac\xd8\x35\x8d\x4c\x3c\x09\xd3\xe1\xe4\x8c\x48\x1e\xe5\x89\x3d\x1f\xde\xb4\xb4\xd0\xf5\x6d\x18\xfa\xa6\x0a\xee\xc2\xcd\x3b\xf6\x57\x85\xd2\x5d\x80\xe4\x4b\x80\x4d\x28\xa5\x29\xd2\x73\x14\x6b\x70\xfc\x09\x8a\xdd\x36\x92\x20\x6c\x6d\xda\x33\x47\xe6\x64\xbe\xa7\x5e\x6e\x6b\x93\xf1\xa5\x41\xab\xdf\x18\xb3\x3e\x57\xb1\xb8\x97\x47\xfd\x89\xcf\x99\xe3\x22\xa7\x24\x5f\xf7\x5b\x2c\x67\x37\x2d\x1c\xa0\xa3\x83\x3e\xb8\xbd\x78\x91\x26\xd1\xa4\xad\xdb\x44\x71\x28\x49\x65\x80\x1e\xb0\xbb\x8c\x3b\x82\x6f\x1d\xe4\x8e\x08\xb0\x40\x69\x7c\xe8\x1d\x67\xda\xc2\x38\xec\x87\x5d\x80\xf8\xa8\x55\x90\x1b\x91\xd2\x28\xde\xd0\x19\x37\xb3\xf9\xa1\x2f\x6e\x66\xf3\x51\x67\xf0\x3b\x81\xa2\x24\xd0\x58\x55\x94\x41\xb0\x47\xc0\x63\x8d\x3f\xf4\x2d\x9a\xa7\x1e\xb9\xe0\x93\x46\xf4\x31\xef\x70\x5b\x07\x40\x50\x34\x70\x2f\xf1\x42\x57\x49\xef\xa5\x29\xae\x19\xe9\x6d\xbc\xd5\x07\x1c\x4e\x9e\x6d\x86\xf0\x21\x87\x4f\xd1\xab\x3a\x74\x8a\xc4\x0e\xe9\x08\xfc\x80\x5f\x1e\x4b\x29\x4a\x78\x24\xc7\xfb\x4a\x58\x97\x51\xd6\x24\xd6\xeb\x3c\xe3\x03\x2a\x7a\x3b\xbf\xdc\xed\xe0\xb6\x5e\x89\xf1\xf3\x1d\xb1\xef\x99\x05\x86\x5d\x03\xf6\xd1\x78\x66\x2c\x6d\x1d\x5d\x1c\x41\xdf\xf3\x41\x84\xcd\x5e\x63\xfd\xb1\x4a\xca\x07\x87\x1e\xdd\x8c\x48\xec\xb6\xe0\x98\x40\x3f\x4f\x46\x64\x7a\x21\x18\x94\x38\x5a\xa0\xa1\xbb\xf9\x5b\x5c\x4d\x27\xcf\xc6\xee\xb6\x93\xed\xaa\x6e\x73\x7b\x69\xf3\x3e\x5f\xef\x2a\x67\x6f\x74\x10\x1b\xc0\xa1\xe1\x7a\x7c\x46\x95\x19\x77\x7e\x72\x50\x81\x07\x04\xb6\x36\x4f\x5e\xe0\xac\x6f\x76\xc7\xb7\xdd\xe9\x8b\xe5\x33\xb7\x40\xcf\xd4\xdd\x3d\xa8\xf5\x87\x67\xc0\x4e\xdd\x95\xb3\x01\xcc\x2e\xfe\x8b\xe5\xfa\x43\xc7\x59\x3d\xc6\x42\x65\xdb\x7b\xec\xc5\x72\xfd\x1d\xf7\xcf\xa3\xe8\x72\x6f\x5b\x97\x5c\x1a\xcd\x1e\xec\x68\x13\x72\x82\x3b\x64\xc5\xa8\xb7\x94\xbf\xd6\x07\x8d\x7a\xb7\x94\xef\x0c\xe7\x81\x8b\x58\xca\xe3\x97\x9f\xf8\xfd\xef\x92\xff\x07\xdc\xd2\x5c\xb4\x52\x5b\xe7\x3c\xe2\xf0\xfe\xdd\x8b\x5a\xe4\xf5\xf4\xdb\xdd\x22\xbe\xe9\xd1\xb3\x6b\x2a\x5b\x8f\x94\xfb\x27\xd1\xe6\xd8\xc9\xac\x7d\x1b\x0f\x79\x67\x5b\xd5\xbb\xa2\x9a\xfe\x06\xc7\xd2\x23\x49\xd0\x18\xb2\xbd\xfc\xdc\x44\xb3\x5b\xf5\xda\xcb\x4a\x4e\x0f\x45\x79\x80\x8a\x4c\x26\x4d\x71\x01\x94\x16\xe9\x78\x4d\x9a\xe9\x95\x2c\x6a\x5b\xfb\xf6\xfb\x36\x93\x21\x60\x47\x35\xa0\x31\x08\xee\xc2\xa1\x7d\x3d\x0b\x01\x45\xa9\xc9\x84\xdd\x97\x7e\xae\x8c\xa3\xf8\x99\xcc\x73\x72\xfc\xa1\xa7\x49\xd8\x27\xdf\x8c\x4e\x76\x21\xf7\x57\x34\x3d\x6f\xf6\x59\x47\xc4\xc1\x49\x4f\x06\xe3\x25\x6d\x36\x85\xe0\xea\xe6\x2b\xac\x0f\xd6\xf1\xa1\xa8\x37\x52\xaf\xb6\x9f\xf4\x3a\x03\x7c\xc0\x50\xfb\x29\xfc\xfc\xcb\xe4\xd7\x01\x00\xe9\xdb\x33\x40\x70\x21\x00\x00")
 
 func chartCrdsNetworkHarvesterhciIo_virtualmachinenetworkconfigsYamlBytes() ([]byte, error) {
 	return bindataRead(
@@ -114,7 +114,7 @@ func chartCrdsNetworkHarvesterhciIo_virtualmachinenetworkconfigsYaml() (*asset,
 		return nil, err
 	}
 
-	info := bindataFileInfo{name: "chart/crds/network.harvesterhci.io_virtualmachinenetworkconfigs.yaml", size: 4603, mode: os.FileMode(420), modTime: time.Unix(1750154346, 0)}
+	info := bindataFileInfo{name: "chart/crds/network.harvesterhci.io_virtualmachinenetworkconfigs.yaml", size: 8560, mode: os.FileMode(420), modTime: time.Unix(1792180195, 0)}
 	a := &asset{bytes: bytes, info: info}
 	return a, nil
 }
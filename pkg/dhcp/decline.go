@@ -0,0 +1,70 @@
+package dhcp
+
+import (
+	"sort"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/sirupsen/logrus"
+)
+
+// Decline is a DHCPDECLINE received from a client, telling the IP address of
+// its lease is already in use on the network.
+type Decline struct {
+	IP         string    `json:"ip"`
+	MACAddress string    `json:"mac"`
+	Time       time.Time `json:"time"`
+}
+
+// decline records the DHCPDECLINE m and stops offering the declined lease.
+// Declines of IP addresses not leased to the client are ignored. The caller
+// must hold the allocator write lock.
+func (a *DHCPAllocator) decline(m *dhcpv4.DHCPv4) {
+	hwAddr := m.ClientHWAddr.String()
+	declinedIP := m.RequestedIPAddress()
+
+	lease, ok := a.leases[hwAddr]
+	if !ok || declinedIP == nil || !declinedIP.Equal(lease.ClientIP) {
+		logrus.Infof("(dhcp.dhcpHandler) DECLINED IP NOT LEASED: hwaddr=%s, declined=%s, leased=%s", hwAddr, declinedIP.String(), lease.ClientIP.String())
+		return
+	}
+
+	logrus.Warnf("(dhcp.dhcpHandler) DHCPDECLINE: hwaddr=%s, clientip=%s is in use on the network", hwAddr, lease.ClientIP.String())
+
+	lease.Declined = true
+	a.leases[hwAddr] = lease
+
+	a.declines[lease.ClientIP.String()] = Decline{
+		IP:         lease.ClientIP.String(),
+		MACAddress: hwAddr,
+		Time:       a.clock.Now().UTC().Truncate(time.Second),
+	}
+
+	select {
+	case a.declined <- struct{}{}:
+	default:
+	}
+}
+
+// Declined returns a channel receiving a value whenever a DHCPDECLINE is
+// recorded. Declines received while the value is pending are coalesced.
+func (a *DHCPAllocator) Declined() <-chan struct{} {
+	return a.declined
+}
+
+// ListDeclines returns the latest DHCPDECLINE of each declined IP address,
+// sorted by IP address.
+func (a *DHCPAllocator) ListDeclines() []Decline {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	declines := make([]Decline, 0, len(a.declines))
+	for _, decline := range a.declines {
+		declines = append(declines, decline)
+	}
+	sort.Slice(declines, func(i, j int) bool {
+		return declines[i].IP < declines[j].IP
+	})
+
+	return declines
+}
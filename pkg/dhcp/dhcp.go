@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,7 +13,12 @@ import (
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
-	"github.com/insomniacslk/dhcp/rfc1035label"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
 )
 
 type DHCPLease struct {
@@ -25,8 +31,34 @@ type DHCPLease struct {
 	DomainSearch []string
 	NTP          []net.IP
 	LeaseTime    int
+	StaticRoutes dhcpv4.Routes
+	// AlwaysSendOptions are sent regardless of the parameter request list
+	AlwaysSendOptions []uint8
+	// MTU is the interface MTU, not sent if zero
+	MTU uint16
+	// ExtraOptions are sent as they are, unless they clash with the options
+	// above
+	ExtraOptions map[uint8][]byte
+	// Permanent leases have been served to a BOOTP client. They're offered
+	// with an infinite lease time from then on.
+	Permanent bool
+	// NoDefaultRoute leases belong to interfaces which mustn't get a default
+	// route. They carry no router, so neither option 3 nor the default route
+	// of option 121 is sent.
+	NoDefaultRoute bool
+	// Declined leases were declined by the client as already in use on the
+	// network. They aren't offered anymore until they're replaced.
+	Declined bool
+
+	// options is the template of the options the lease is answered with,
+	// see newOptionsTemplate
+	options dhcpv4.Options
 }
 
+// infiniteLeaseTime is the lease time meaning the lease never expires (RFC
+// 2131 section 3.3).
+const infiniteLeaseTime = 0xffffffff * time.Second
+
 func (l *DHCPLease) String() string {
 	b, err := json.Marshal(l)
 	if err != nil {
@@ -35,24 +67,123 @@ func (l *DHCPLease) String() string {
 	return string(b)
 }
 
+// PoolConfig holds the settings shared by every lease of the pool.
+type PoolConfig struct {
+	ServerIP net.IP
+	// Subnet is the subnet of the pool, if known
+	Subnet *net.IPNet
+	// Authoritative pools NAK requests for addresses they haven't leased to
+	// the clients they know of, or which are out of their subnet, while
+	// non-authoritative ones stay silent.
+	Authoritative bool
+	// AllowBOOTP makes the pool answer BOOTP requests in addition to DHCP
+	// ones.
+	AllowBOOTP bool
+	// RelayGateways are the relay agents whose requests the pool answers.
+	// Pools without any answer every relayed request.
+	RelayGateways []net.IP
+}
+
+// servesRelay tells whether the pool answers requests relayed by the relay
+// agent giaddr. Requests which aren't relayed are always answered.
+func (c PoolConfig) servesRelay(giaddr net.IP) bool {
+	if len(c.RelayGateways) == 0 || giaddr == nil || giaddr.IsUnspecified() {
+		return true
+	}
+
+	for _, relayGateway := range c.RelayGateways {
+		if relayGateway.Equal(giaddr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inSubnet tells whether ip is in the subnet of the pool. Any IP address is
+// deemed in the subnet of pools whose subnet is unknown.
+func (c PoolConfig) inSubnet(ip net.IP) bool {
+	return c.Subnet == nil || c.Subnet.Contains(ip)
+}
+
 type DHCPAllocator struct {
-	leases  map[string]DHCPLease
-	servers map[string]*server4.Server
-	mutex   sync.RWMutex
+	leases     map[string]DHCPLease
+	poolConfig PoolConfig
+	servers    map[string]*server4.Server
+	// leases6 are the IPv6 leases, served over DHCPv6
+	leases6  map[string]DHCPv6Lease
+	servers6 map[string]*server6.Server
+	// serverDUID identifies the DHCPv6 server, once it's running
+	serverDUID dhcpv6.DUID
+	// declines are the latest DHCPDECLINEs received, by IP address
+	declines map[string]Decline
+	// declined is signaled whenever a DHCPDECLINE is received
+	declined chan struct{}
+	clock    clock.Clock
+	mutex    sync.RWMutex
 }
 
 func New() *DHCPAllocator {
-	return NewDHCPAllocator()
+	return NewDHCPAllocator(clock.RealClock{})
 }
 
-func NewDHCPAllocator() *DHCPAllocator {
+func NewDHCPAllocator(clock clock.Clock) *DHCPAllocator {
 	leases := make(map[string]DHCPLease)
 	servers := make(map[string]*server4.Server)
 
 	return &DHCPAllocator{
-		leases:  leases,
-		servers: servers,
+		leases:   leases,
+		servers:  servers,
+		leases6:  make(map[string]DHCPv6Lease),
+		servers6: make(map[string]*server6.Server),
+		declines: make(map[string]Decline),
+		declined: make(chan struct{}, 1),
+		clock:    clock,
+	}
+}
+
+func (a *DHCPAllocator) SetPoolConfig(serverIP, cidr string, authoritative, allowBOOTP bool, relayGateways []string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	ip := net.ParseIP(serverIP)
+	if serverIP != "" && ip == nil {
+		return fmt.Errorf("invalid server ip %s", serverIP)
+	}
+
+	var subnet *net.IPNet
+	if cidr != "" {
+		var err error
+		if _, subnet, err = net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid cidr %s: %w", cidr, err)
+		}
+	}
+
+	var relayGatewayIPs []net.IP
+	for _, relayGateway := range relayGateways {
+		relayGatewayIP := net.ParseIP(relayGateway)
+		if relayGatewayIP == nil {
+			return fmt.Errorf("invalid relay gateway %s", relayGateway)
+		}
+		relayGatewayIPs = append(relayGatewayIPs, relayGatewayIP)
+	}
+
+	a.poolConfig = PoolConfig{
+		ServerIP:      ip,
+		Subnet:        subnet,
+		Authoritative: authoritative,
+		AllowBOOTP:    allowBOOTP,
+		RelayGateways: relayGatewayIPs,
 	}
+
+	return nil
+}
+
+func (a *DHCPAllocator) GetPoolConfig() PoolConfig {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	return a.poolConfig
 }
 
 func (a *DHCPAllocator) AddLease(
@@ -60,12 +191,17 @@ func (a *DHCPAllocator) AddLease(
 	serverIP string,
 	clientIP string,
 	cidr string,
+	subnetMask string,
 	routerIP string,
 	dnsServers []string,
 	domainName *string,
 	domainSearch []string,
 	ntpServers []string,
 	leaseTime *int,
+	staticRoutes []networkv1.Route,
+	alwaysSendOptions []int,
+	dhcpOptions *networkv1.DHCPOptions,
+	defaultRoute bool,
 ) (err error) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
@@ -74,9 +210,13 @@ func (a *DHCPAllocator) AddLease(
 		return fmt.Errorf("hwaddr is empty")
 	}
 
-	if _, err := net.ParseMAC(hwAddr); err != nil {
+	// Leases are keyed by the normalized MAC address, the form requests
+	// are looked up with
+	normalized, err := util.ParseMAC(hwAddr)
+	if err != nil {
 		return fmt.Errorf("hwaddr %s is not valid", hwAddr)
 	}
+	hwAddr = normalized
 
 	if a.checkLease(hwAddr) {
 		return fmt.Errorf("lease for hwaddr %s already exists", hwAddr)
@@ -91,18 +231,36 @@ func (a *DHCPAllocator) AddLease(
 		return err
 	}
 	lease.SubnetMask = ipNet.Mask
+	if subnetMask != "" {
+		if lease.SubnetMask, err = parseSubnetMask(subnetMask); err != nil {
+			return err
+		}
+	}
 
-	lease.Router = net.ParseIP(routerIP)
+	if defaultRoute {
+		lease.Router = net.ParseIP(routerIP)
+	} else {
+		lease.NoDefaultRoute = true
+	}
 	for _, dnsServer := range dnsServers {
 		dnsServerIP := net.ParseIP(dnsServer)
-		lease.DNS = append(lease.DNS, dnsServerIP)
+		if dnsServerIP.To4() == nil {
+			return fmt.Errorf("dns server %s is not a valid ipv4 address", dnsServer)
+		}
+		lease.DNS = append(lease.DNS, dnsServerIP.To4())
 	}
+	// Names are sent without the trailing dot, and the options of unset
+	// names are left out rather than sent empty
 	if domainName == nil {
 		lease.DomainName = ""
 	} else {
-		lease.DomainName = *domainName
+		lease.DomainName = strings.TrimSuffix(*domainName, ".")
+	}
+	for _, domain := range domainSearch {
+		if domain = strings.TrimSuffix(domain, "."); domain != "" {
+			lease.DomainSearch = append(lease.DomainSearch, domain)
+		}
 	}
-	lease.DomainSearch = domainSearch
 
 	for _, ntpServer := range ntpServers {
 		ntpServerIP := net.ParseIP(ntpServer)
@@ -127,6 +285,52 @@ func (a *DHCPAllocator) AddLease(
 		lease.LeaseTime = *leaseTime
 	}
 
+	for _, staticRoute := range staticRoutes {
+		_, dest, err := net.ParseCIDR(staticRoute.Destination)
+		if err != nil {
+			return fmt.Errorf("static route destination %s is not valid", staticRoute.Destination)
+		}
+		router := net.ParseIP(staticRoute.Gateway)
+		if router == nil || router.To4() == nil {
+			return fmt.Errorf("static route gateway %s is not valid", staticRoute.Gateway)
+		}
+		lease.StaticRoutes = append(lease.StaticRoutes, &dhcpv4.Route{
+			Dest:   dest,
+			Router: router.To4(),
+		})
+	}
+
+	for _, code := range alwaysSendOptions {
+		if code < 1 || code > 254 {
+			return fmt.Errorf("option code %d is not valid", code)
+		}
+		lease.AlwaysSendOptions = append(lease.AlwaysSendOptions, uint8(code))
+	}
+
+	if dhcpOptions != nil {
+		if dhcpOptions.MTU != nil {
+			if *dhcpOptions.MTU < 68 || *dhcpOptions.MTU > 9000 {
+				return fmt.Errorf("mtu %d is not valid", *dhcpOptions.MTU)
+			}
+			lease.MTU = uint16(*dhcpOptions.MTU)
+		}
+		for _, extraOption := range dhcpOptions.ExtraOptions {
+			if extraOption.Code < 1 || extraOption.Code > 254 {
+				return fmt.Errorf("option code %d is not valid", extraOption.Code)
+			}
+			payload, err := OptionPayload(extraOption)
+			if err != nil {
+				return err
+			}
+			if lease.ExtraOptions == nil {
+				lease.ExtraOptions = make(map[uint8][]byte)
+			}
+			lease.ExtraOptions[uint8(extraOption.Code)] = payload
+		}
+	}
+
+	lease.options = newOptionsTemplate(lease)
+
 	a.leases[hwAddr] = lease
 
 	logrus.Infof("(dhcp.AddLease) lease added for hardware address: %s", hwAddr)
@@ -135,7 +339,7 @@ func (a *DHCPAllocator) AddLease(
 }
 
 func (a *DHCPAllocator) checkLease(hwAddr string) bool {
-	_, exists := a.leases[hwAddr]
+	_, exists := a.leases[util.NormalizeMAC(hwAddr)]
 
 	return exists
 }
@@ -144,7 +348,7 @@ func (a *DHCPAllocator) GetLease(hwAddr string) (lease DHCPLease) {
 	a.mutex.RLock()
 	defer a.mutex.RUnlock()
 
-	return a.leases[hwAddr]
+	return a.leases[util.NormalizeMAC(hwAddr)]
 }
 
 func (a *DHCPAllocator) DeleteLease(hwAddr string) (err error) {
@@ -155,7 +359,7 @@ func (a *DHCPAllocator) DeleteLease(hwAddr string) (err error) {
 		return fmt.Errorf("lease for hwaddr %s does not exists", hwAddr)
 	}
 
-	delete(a.leases, hwAddr)
+	delete(a.leases, util.NormalizeMAC(hwAddr))
 
 	logrus.Infof("(dhcp.DeleteLease) lease deleted for hardware address: %s", hwAddr)
 
@@ -167,7 +371,7 @@ func (a *DHCPAllocator) Usage() {
 	defer a.mutex.RUnlock()
 
 	for hwaddr, lease := range a.leases {
-		logrus.Infof("(dhcp.Usage) lease: hwaddr=%s, clientip=%s, netmask=%s, router=%s, dns=%+v, domain=%s, domainsearch=%+v, ntp=%+v, leasetime=%d",
+		logrus.Infof("(dhcp.Usage) lease: hwaddr=%s, clientip=%s, netmask=%s, router=%s, dns=%+v, domain=%s, domainsearch=%+v, ntp=%+v, leasetime=%d, permanent=%t",
 			hwaddr,
 			lease.ClientIP.String(),
 			lease.SubnetMask.String(),
@@ -177,13 +381,14 @@ func (a *DHCPAllocator) Usage() {
 			lease.DomainSearch,
 			lease.NTP,
 			lease.LeaseTime,
+			lease.Permanent,
 		)
 	}
 }
 
 func (a *DHCPAllocator) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
-	a.mutex.RLock()
-	defer a.mutex.RUnlock()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 
 	if m == nil {
 		logrus.Errorf("(dhcp.dhcpHandler) packet is nil!")
@@ -197,33 +402,185 @@ func (a *DHCPAllocator) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv
 		return
 	}
 
-	reply, err := dhcpv4.NewReplyFromRequest(m)
-	if err != nil {
-		logrus.Errorf("(dhcp.dhcpHandler) NewReplyFromRequest failed: %v", err)
+	reply := a.respond(m)
+	if reply == nil {
 		return
 	}
 
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		logrus.Errorf("(dhcp.dhcpHandler) Cannot reply to client: %v", err)
+	}
+}
+
+// respond returns the reply to the request m, or nil if the request should
+// be left unanswered. The caller must hold the allocator write lock as leases
+// served to BOOTP clients are made permanent.
+func (a *DHCPAllocator) respond(m *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	// A request relayed for another pool
+	if !a.poolConfig.servesRelay(m.GatewayIPAddr) {
+		logrus.Debugf("(dhcp.dhcpHandler) RELAYED FOR OTHER POOL: hwaddr=%s, giaddr=%s", m.ClientHWAddr.String(), m.GatewayIPAddr.String())
+		return nil
+	}
+
+	messageType := m.MessageType()
+
+	// Requests without a DHCP message type come from BOOTP clients
+	if messageType == dhcpv4.MessageTypeNone {
+		return a.respondBOOTP(m)
+	}
+
+	// A client selecting another server's offer, or declining it
+	if serverID := m.ServerIdentifier(); (messageType == dhcpv4.MessageTypeRequest || messageType == dhcpv4.MessageTypeDecline) &&
+		serverID != nil && a.poolConfig.ServerIP != nil && !serverID.Equal(a.poolConfig.ServerIP) {
+		logrus.Debugf("(dhcp.dhcpHandler) REQUEST FOR OTHER SERVER: hwaddr=%s, serverid=%s", m.ClientHWAddr.String(), serverID.String())
+		return nil
+	}
+
+	if messageType == dhcpv4.MessageTypeDecline {
+		a.decline(m)
+		return nil
+	}
+
 	lease := a.leases[m.ClientHWAddr.String()]
 
+	if messageType == dhcpv4.MessageTypeRequest {
+		requestedIP := m.RequestedIPAddress()
+		if requestedIP == nil && !m.ClientIPAddr.IsUnspecified() {
+			requestedIP = m.ClientIPAddr
+		}
+		// Clients unknown to the pool may hold an address of another server,
+		// so they're only NAKed for addresses out of the subnet
+		if requestedIP != nil && !requestedIP.Equal(lease.ClientIP) &&
+			(lease.ClientIP != nil || !a.poolConfig.inSubnet(requestedIP)) {
+			logrus.Infof("(dhcp.dhcpHandler) REQUESTED IP NOT LEASED: hwaddr=%s, requested=%s, leased=%s", m.ClientHWAddr.String(), requestedIP.String(), lease.ClientIP.String())
+			return a.nak(m)
+		}
+	}
+
 	if lease.ClientIP == nil {
 		logrus.Warnf("(dhcp.dhcpHandler) NO LEASE FOUND: hwaddr=%s", m.ClientHWAddr.String())
 
-		return
+		return nil
+	}
+
+	if lease.Declined {
+		logrus.Debugf("(dhcp.dhcpHandler) LEASE DECLINED: hwaddr=%s, clientip=%s", m.ClientHWAddr.String(), lease.ClientIP.String())
+		return nil
+	}
+
+	// Formatting the lease would allocate for every packet otherwise
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		logrus.Debugf("(dhcp.dhcpHandler) LEASE FOUND: hwaddr=%s, serverip=%s, clientip=%s, mask=%s, router=%s, dns=%+v, domainname=%s, domainsearch=%+v, ntp=%+v, leasetime=%d",
+			m.ClientHWAddr.String(),
+			lease.ServerIP.String(),
+			lease.ClientIP.String(),
+			lease.SubnetMask.String(),
+			lease.Router.String(),
+			lease.DNS,
+			lease.DomainName,
+			lease.DomainSearch,
+			lease.NTP,
+			lease.LeaseTime,
+		)
 	}
 
-	logrus.Debugf("(dhcp.dhcpHandler) LEASE FOUND: hwaddr=%s, serverip=%s, clientip=%s, mask=%s, router=%s, dns=%+v, domainname=%s, domainsearch=%+v, ntp=%+v, leasetime=%d",
-		m.ClientHWAddr.String(),
-		lease.ServerIP.String(),
-		lease.ClientIP.String(),
-		lease.SubnetMask.String(),
-		lease.Router.String(),
-		lease.DNS,
-		lease.DomainName,
-		lease.DomainSearch,
-		lease.NTP,
-		lease.LeaseTime,
+	reply, err := dhcpv4.NewReplyFromRequest(m)
+	if err != nil {
+		logrus.Errorf("(dhcp.dhcpHandler) NewReplyFromRequest failed: %v", err)
+		return nil
+	}
+
+	if err := buildReply(reply, m, lease); err != nil {
+		logrus.Warnf("(dhcp.dhcpHandler) %s", err.Error())
+		return nil
+	}
+
+	return reply
+}
+
+// respondBOOTP returns the reply to the BOOTP request m, or nil if the pool
+// doesn't serve BOOTP clients or has no lease for the client. BOOTP clients
+// keep their address for good, so the lease is marked permanent.
+func (a *DHCPAllocator) respondBOOTP(m *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	if !a.poolConfig.AllowBOOTP {
+		logrus.Debugf("(dhcp.dhcpHandler) BOOTP NOT ALLOWED: hwaddr=%s", m.ClientHWAddr.String())
+		return nil
+	}
+
+	hwAddr := m.ClientHWAddr.String()
+	lease, ok := a.leases[hwAddr]
+	if !ok {
+		logrus.Warnf("(dhcp.dhcpHandler) NO LEASE FOUND: hwaddr=%s", hwAddr)
+		return nil
+	}
+
+	reply, err := dhcpv4.NewReplyFromRequest(m)
+	if err != nil {
+		logrus.Errorf("(dhcp.dhcpHandler) NewReplyFromRequest failed: %v", err)
+		return nil
+	}
+
+	buildBOOTPReply(reply, m, lease)
+
+	if !lease.Permanent {
+		lease.Permanent = true
+		a.leases[hwAddr] = lease
+		logrus.Infof("(dhcp.dhcpHandler) lease made permanent for BOOTP client: hwaddr=%s, clientip=%s", hwAddr, lease.ClientIP.String())
+	}
+
+	logrus.Debugf("(dhcp.dhcpHandler) BOOTREPLY: %+v", reply)
+
+	return reply
+}
+
+// nak returns a DHCPNAK for the request m if the pool is authoritative. The
+// client falls back to discovery on receiving it instead of waiting for its
+// request to time out.
+func (a *DHCPAllocator) nak(m *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	if !a.poolConfig.Authoritative || a.poolConfig.ServerIP == nil {
+		return nil
+	}
+
+	reply, err := dhcpv4.NewReplyFromRequest(m,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+		dhcpv4.WithServerIP(net.IPv4zero),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(a.poolConfig.ServerIP)),
 	)
+	if err != nil {
+		logrus.Errorf("(dhcp.dhcpHandler) NewReplyFromRequest failed: %v", err)
+		return nil
+	}
+
+	reply.ClientIPAddr = net.IPv4zero
+	reply.YourIPAddr = net.IPv4zero
+	// Relay agents must broadcast the NAK as the client may have no address
+	// (RFC 2131 section 4.3.2)
+	if !m.GatewayIPAddr.IsUnspecified() {
+		reply.SetBroadcast()
+	}
+
+	logrus.Debugf("(dhcp.dhcpHandler) DHCPNAK: %+v", reply)
 
+	return reply
+}
+
+// parseSubnetMask parses a subnet mask in dotted-quad notation, e.g.,
+// 255.255.0.0.
+func parseSubnetMask(subnetMask string) (net.IPMask, error) {
+	ip := net.ParseIP(subnetMask).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("subnet mask %s is not valid", subnetMask)
+	}
+	mask := net.IPMask(ip)
+	if _, bits := mask.Size(); bits == 0 {
+		return nil, fmt.Errorf("subnet mask %s is not contiguous", subnetMask)
+	}
+	return mask, nil
+}
+
+// buildReply fills in the reply to the request m from the lease. The options
+// are copied from the template of the lease, which is left untouched.
+func buildReply(reply, m *dhcpv4.DHCPv4, lease DHCPLease) error {
 	reply.ClientIPAddr = lease.ClientIP
 	reply.ServerIPAddr = lease.ServerIP
 	reply.YourIPAddr = lease.ClientIP
@@ -232,9 +589,50 @@ func (a *DHCPAllocator) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv
 	reply.Flags = m.Flags
 	reply.GatewayIPAddr = m.GatewayIPAddr
 
-	reply.UpdateOption(dhcpv4.OptServerIdentifier(lease.ServerIP))
+	// The encoded values are shared with the template, and the reply only
+	// ever replaces or drops them
+	for code, value := range lease.optionsTemplate() {
+		reply.Options[code] = value
+	}
+
+	if lease.Permanent {
+		reply.UpdateOption(dhcpv4.OptIPAddressLeaseTime(infiniteLeaseTime))
+	}
+
+	switch messageType := m.MessageType(); messageType {
+	case dhcpv4.MessageTypeDiscover:
+		logrus.Debugf("(dhcp.dhcpHandler) DHCPDISCOVER: %+v", m)
+		reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+		logrus.Debugf("(dhcp.dhcpHandler) DHCPOFFER: %+v", reply)
+	case dhcpv4.MessageTypeRequest:
+		logrus.Debugf("(dhcp.dhcpHandler) DHCPREQUEST: %+v", m)
+		reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+		logrus.Debugf("(dhcp.dhcpHandler) DHCPACK: %+v", reply)
+	default:
+		return fmt.Errorf("unhandled message type for hwaddr [%s]: %v", m.ClientHWAddr.String(), messageType)
+	}
+
+	filterRequestedOptions(reply, m, lease)
+
+	return nil
+}
+
+// buildBOOTPReply fills in the reply to the BOOTP request m from the lease.
+// Only the vendor extensions of RFC 1497 are sent, as BOOTP clients know
+// nothing about the DHCP ones.
+func buildBOOTPReply(reply, m *dhcpv4.DHCPv4, lease DHCPLease) {
+	reply.ServerIPAddr = lease.ServerIP
+	reply.YourIPAddr = lease.ClientIP
+	reply.TransactionID = m.TransactionID
+	reply.ClientHWAddr = m.ClientHWAddr
+	reply.Flags = m.Flags
+	reply.GatewayIPAddr = m.GatewayIPAddr
+
 	reply.UpdateOption(dhcpv4.OptSubnetMask(lease.SubnetMask))
-	reply.UpdateOption(dhcpv4.OptRouter(lease.Router))
+
+	if lease.Router != nil {
+		reply.UpdateOption(dhcpv4.OptRouter(lease.Router))
+	}
 
 	if len(lease.DNS) > 0 {
 		reply.UpdateOption(dhcpv4.OptDNS(lease.DNS...))
@@ -243,42 +641,71 @@ func (a *DHCPAllocator) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv
 	if lease.DomainName != "" {
 		reply.UpdateOption(dhcpv4.OptDomainName(lease.DomainName))
 	}
+}
 
-	if len(lease.DomainSearch) > 0 {
-		dsl := rfc1035label.NewLabels()
-		dsl.Labels = append(dsl.Labels, lease.DomainSearch...)
-
-		reply.UpdateOption(dhcpv4.OptDomainSearch(dsl))
+// filterRequestedOptions drops the options the client didn't ask for with the
+// parameter request list (option 55), as some clients misbehave when given
+// options they don't expect. The options needed to complete the exchange are
+// always kept, and so are the relay agent information (option 82) and the
+// client identifier (option 61) echoed from the request, which relay agents
+// and clients need to recognize the reply (RFC 3046, RFC 6842). Clients
+// without a parameter request list get every option but the classless static
+// routes of Microsoft.
+func filterRequestedOptions(reply, m *dhcpv4.DHCPv4, lease DHCPLease) {
+	prl := m.ParameterRequestList()
+	if len(prl) == 0 {
+		delete(reply.Options, optionMSClasslessStaticRoute.Code())
+		return
 	}
 
-	if len(lease.NTP) > 0 {
-		reply.UpdateOption(dhcpv4.OptNTPServers(lease.NTP...))
+	keep := map[uint8]struct{}{
+		dhcpv4.OptionSubnetMask.Code():         {},
+		dhcpv4.OptionIPAddressLeaseTime.Code(): {},
+		dhcpv4.OptionDHCPMessageType.Code():    {},
+		dhcpv4.OptionServerIdentifier.Code():   {},
+		// Echoed from the request
+		dhcpv4.OptionRelayAgentInformation.Code(): {},
+		dhcpv4.OptionClientIdentifier.Code():      {},
+	}
+	if lease.Router != nil {
+		keep[dhcpv4.OptionRouter.Code()] = struct{}{}
+	}
+	for _, code := range prl {
+		keep[code.Code()] = struct{}{}
+	}
+	for _, code := range lease.AlwaysSendOptions {
+		keep[code] = struct{}{}
 	}
 
-	if lease.LeaseTime > 0 {
-		reply.UpdateOption(dhcpv4.OptIPAddressLeaseTime(time.Duration(lease.LeaseTime) * time.Second))
-	} else {
-		// default lease time: 1 year
-		reply.UpdateOption(dhcpv4.OptIPAddressLeaseTime(31536000 * time.Second))
+	for code := range reply.Options {
+		if _, ok := keep[code]; !ok {
+			delete(reply.Options, code)
+		}
 	}
+}
 
-	switch messageType := m.MessageType(); messageType {
-	case dhcpv4.MessageTypeDiscover:
-		logrus.Debugf("(dhcp.dhcpHandler) DHCPDISCOVER: %+v", m)
-		reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
-		logrus.Debugf("(dhcp.dhcpHandler) DHCPOFFER: %+v", reply)
-	case dhcpv4.MessageTypeRequest:
-		logrus.Debugf("(dhcp.dhcpHandler) DHCPREQUEST: %+v", m)
-		reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
-		logrus.Debugf("(dhcp.dhcpHandler) DHCPACK: %+v", reply)
-	default:
-		logrus.Warnf("(dhcp.dhcpHandler) Unhandled message type for hwaddr [%s]: %v", m.ClientHWAddr.String(), messageType)
-		return
+// classlessStaticRoutes returns the routes to be sent with option 121. Clients
+// honoring option 121 ignore the router option (RFC 3442), so the default route
+// toward the router is appended unless a default route is already given.
+func classlessStaticRoutes(lease DHCPLease) dhcpv4.Routes {
+	routes := lease.StaticRoutes
+	if lease.Router == nil || lease.Router.To4() == nil {
+		return routes
 	}
 
-	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
-		logrus.Errorf("(dhcp.dhcpHandler) Cannot reply to client: %v", err)
+	for _, route := range routes {
+		if ones, _ := route.Dest.Mask.Size(); ones == 0 {
+			return routes
+		}
 	}
+
+	return append(routes[:len(routes):len(routes)], &dhcpv4.Route{
+		Dest: &net.IPNet{
+			IP:   net.IPv4zero.To4(),
+			Mask: net.CIDRMask(0, 32),
+		},
+		Router: lease.Router.To4(),
+	})
 }
 
 func (a *DHCPAllocator) Run(ctx context.Context, nic string) (err error) {
@@ -321,6 +748,15 @@ func (a *DHCPAllocator) DryRun(ctx context.Context, nic string) (err error) {
 func (a *DHCPAllocator) stop(nic string) (err error) {
 	logrus.Infof("(dhcp.Stop) stopping DHCP service on nic %s", nic)
 
+	a.mutex.RLock()
+	v6Server := a.servers6[nic]
+	a.mutex.RUnlock()
+	if v6Server != nil {
+		if err := v6Server.Close(); err != nil {
+			logrus.Errorf("(dhcp.Stop) cannot stop DHCPv6 service on nic %s: %v", nic, err)
+		}
+	}
+
 	if a.servers[nic] == nil {
 		return nil
 	}
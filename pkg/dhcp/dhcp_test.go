@@ -3,7 +3,14 @@ package dhcp
 import (
 	"fmt"
 	"net"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
 )
 
 func TestDHCP(t *testing.T) {
@@ -20,6 +27,7 @@ func TestDHCP(t *testing.T) {
 		domainSearch []string
 		ntpServers   []string
 		leaseTime    *int
+		staticRoutes []networkv1.Route
 		want         error
 	}{
 		{
@@ -120,6 +128,34 @@ func TestDHCP(t *testing.T) {
 			ntpServers: []string{"xxxx"},
 			want:       nil,
 		},
+		{
+			hwAddr:   "22:33:44:55:66:77",
+			serverIP: "0.0.0.0",
+			clientIP: "192.168.0.12",
+			cidr:     "192.168.0.0/24",
+			routerIP: "192.168.0.254",
+			staticRoutes: []networkv1.Route{
+				{
+					Destination: "10.53.0.0/16",
+					Gateway:     "192.168.0.253",
+				},
+			},
+			want: nil,
+		},
+		{
+			hwAddr:   "33:44:55:66:77:88",
+			serverIP: "0.0.0.0",
+			clientIP: "192.168.0.13",
+			cidr:     "192.168.0.0/24",
+			routerIP: "192.168.0.254",
+			staticRoutes: []networkv1.Route{
+				{
+					Destination: "10.53.0.0/33",
+					Gateway:     "192.168.0.253",
+				},
+			},
+			want: fmt.Errorf("static route destination 10.53.0.0/33 is not valid"),
+		},
 	}
 
 	// AddLease function tests
@@ -129,12 +165,17 @@ func TestDHCP(t *testing.T) {
 			testLeases[i].serverIP,
 			testLeases[i].clientIP,
 			testLeases[i].cidr,
+			"",
 			testLeases[i].routerIP,
 			testLeases[i].dnsServers,
 			testLeases[i].domainName,
 			testLeases[i].domainSearch,
 			testLeases[i].ntpServers,
 			testLeases[i].leaseTime,
+			testLeases[i].staticRoutes,
+			nil,
+			nil,
+			true,
 		); got != testLeases[i].want {
 			if got == nil || testLeases[i].want == nil {
 				t.Errorf("got %q, wanted %q", got, testLeases[i].want)
@@ -154,6 +195,13 @@ func TestDHCP(t *testing.T) {
 		t.Errorf("got %q, wanted nil", lease2.ClientIP.String())
 	}
 
+	lease3 := td.GetLease("22:33:44:55:66:77")
+	if routes := classlessStaticRoutes(lease3); len(routes) != 2 {
+		t.Errorf("got %d static routes, wanted 2", len(routes))
+	} else if routes[1].String() != "route to 0.0.0.0/0 via 192.168.0.254" {
+		t.Errorf("got %q, wanted default route via router", routes[1].String())
+	}
+
 	// checkLease function tests
 	if !td.checkLease("aa:bb:cc:dd:ee:ff") {
 		t.Errorf("got false, wanted true for hwAddr aa:bb:cc:dd:ee:ff")
@@ -179,3 +227,777 @@ func TestDHCP(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildReply(t *testing.T) {
+	hwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+
+	lease := DHCPLease{
+		ServerIP:   net.ParseIP("192.168.0.2").To4(),
+		ClientIP:   net.ParseIP("192.168.0.10").To4(),
+		SubnetMask: net.CIDRMask(24, 32),
+		Router:     net.ParseIP("192.168.0.254").To4(),
+		DNS:        []net.IP{net.ParseIP("8.8.8.8").To4()},
+		DomainName: "example.com",
+		NTP:        []net.IP{net.ParseIP("192.168.0.253").To4()},
+		LeaseTime:  300,
+	}
+
+	// The reply sent before the parameter request list was honored
+	fullOptions := dhcpv4.OptionsFromList(
+		dhcpv4.OptServerIdentifier(lease.ServerIP),
+		dhcpv4.OptSubnetMask(lease.SubnetMask),
+		dhcpv4.OptRouter(lease.Router),
+		dhcpv4.OptDNS(lease.DNS...),
+		dhcpv4.OptDomainName(lease.DomainName),
+		dhcpv4.OptNTPServers(lease.NTP...),
+		dhcpv4.OptIPAddressLeaseTime(300*time.Second),
+		dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer),
+	)
+
+	pick := func(codes ...dhcpv4.OptionCode) dhcpv4.Options {
+		options := make(dhcpv4.Options)
+		for _, code := range codes {
+			options[code.Code()] = fullOptions.Get(code)
+		}
+		return options
+	}
+
+	relayAgentInfo := dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0")))
+	clientIdentifier := dhcpv4.OptClientIdentifier([]byte{0x01, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	echoed := func(options dhcpv4.Options) dhcpv4.Options {
+		options.Update(relayAgentInfo)
+		options.Update(clientIdentifier)
+		return options
+	}
+
+	testCases := []struct {
+		name              string
+		requestedOptions  []dhcpv4.OptionCode
+		alwaysSendOptions []uint8
+		relayed           bool
+		expected          dhcpv4.Options
+	}{
+		{
+			name:     "client without parameter request list gets every option",
+			expected: fullOptions,
+		},
+		{
+			name:             "client with parameter request list gets requested and mandatory options",
+			requestedOptions: []dhcpv4.OptionCode{dhcpv4.OptionDomainNameServer},
+			expected: pick(
+				dhcpv4.OptionServerIdentifier,
+				dhcpv4.OptionSubnetMask,
+				dhcpv4.OptionRouter,
+				dhcpv4.OptionDomainNameServer,
+				dhcpv4.OptionIPAddressLeaseTime,
+				dhcpv4.OptionDHCPMessageType,
+			),
+		},
+		{
+			name:              "always sent options are added to the requested ones",
+			requestedOptions:  []dhcpv4.OptionCode{dhcpv4.OptionDomainNameServer},
+			alwaysSendOptions: []uint8{dhcpv4.OptionNTPServers.Code()},
+			expected: pick(
+				dhcpv4.OptionServerIdentifier,
+				dhcpv4.OptionSubnetMask,
+				dhcpv4.OptionRouter,
+				dhcpv4.OptionDomainNameServer,
+				dhcpv4.OptionNTPServers,
+				dhcpv4.OptionIPAddressLeaseTime,
+				dhcpv4.OptionDHCPMessageType,
+			),
+		},
+		{
+			name:             "requested options the pool doesn't define are not sent",
+			requestedOptions: []dhcpv4.OptionCode{dhcpv4.OptionDNSDomainSearchList, dhcpv4.OptionInterfaceMTU},
+			expected: pick(
+				dhcpv4.OptionServerIdentifier,
+				dhcpv4.OptionSubnetMask,
+				dhcpv4.OptionRouter,
+				dhcpv4.OptionIPAddressLeaseTime,
+				dhcpv4.OptionDHCPMessageType,
+			),
+		},
+		{
+			name:             "relayed request gets relay agent information and client identifier echoed",
+			requestedOptions: []dhcpv4.OptionCode{dhcpv4.OptionDomainNameServer},
+			relayed:          true,
+			expected: echoed(pick(
+				dhcpv4.OptionServerIdentifier,
+				dhcpv4.OptionSubnetMask,
+				dhcpv4.OptionRouter,
+				dhcpv4.OptionDomainNameServer,
+				dhcpv4.OptionIPAddressLeaseTime,
+				dhcpv4.OptionDHCPMessageType,
+			)),
+		},
+	}
+
+	for _, tc := range testCases {
+		modifiers := []dhcpv4.Modifier{
+			dhcpv4.WithHwAddr(hwAddr),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+		}
+		if len(tc.requestedOptions) > 0 {
+			modifiers = append(modifiers, dhcpv4.WithRequestedOptions(tc.requestedOptions...))
+		}
+		if tc.relayed {
+			modifiers = append(modifiers,
+				dhcpv4.WithRelay(net.ParseIP("192.168.0.1").To4()),
+				dhcpv4.WithOption(relayAgentInfo),
+				dhcpv4.WithOption(clientIdentifier),
+			)
+		}
+		m, err := dhcpv4.New(modifiers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply, err := dhcpv4.NewReplyFromRequest(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tcLease := lease
+		tcLease.AlwaysSendOptions = tc.alwaysSendOptions
+		if err := buildReply(reply, m, tcLease); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		if !reflect.DeepEqual(tc.expected, reply.Options) {
+			t.Errorf("%s: got options %s, wanted %s", tc.name, reply.Options, tc.expected)
+		}
+	}
+}
+
+func TestRespond(t *testing.T) {
+	knownHwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	unknownHwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:00")
+
+	serverIP := net.ParseIP("192.168.0.2").To4()
+	leasedIP := net.ParseIP("192.168.0.10").To4()
+	staleIP := net.ParseIP("192.168.0.20").To4()
+	relayIP := net.ParseIP("10.0.0.1").To4()
+	otherServerIP := net.ParseIP("192.168.0.3").To4()
+	otherSubnetIP := net.ParseIP("192.168.1.10").To4()
+
+	type expected struct {
+		messageType dhcpv4.MessageType
+		broadcast   bool
+	}
+
+	testCases := []struct {
+		name          string
+		hwAddr        net.HardwareAddr
+		messageType   dhcpv4.MessageType
+		requestedIP   net.IP
+		relayIP       net.IP
+		serverID      net.IP
+		authoritative *expected
+		silent        *expected
+	}{
+		{
+			name:          "known client discovering",
+			hwAddr:        knownHwAddr,
+			messageType:   dhcpv4.MessageTypeDiscover,
+			authoritative: &expected{messageType: dhcpv4.MessageTypeOffer},
+			silent:        &expected{messageType: dhcpv4.MessageTypeOffer},
+		},
+		{
+			name:          "known client requesting its leased address",
+			hwAddr:        knownHwAddr,
+			messageType:   dhcpv4.MessageTypeRequest,
+			requestedIP:   leasedIP,
+			authoritative: &expected{messageType: dhcpv4.MessageTypeAck},
+			silent:        &expected{messageType: dhcpv4.MessageTypeAck},
+		},
+		{
+			name:          "known client requesting a stale address",
+			hwAddr:        knownHwAddr,
+			messageType:   dhcpv4.MessageTypeRequest,
+			requestedIP:   staleIP,
+			authoritative: &expected{messageType: dhcpv4.MessageTypeNak},
+		},
+		{
+			name:        "unknown client discovering",
+			hwAddr:      unknownHwAddr,
+			messageType: dhcpv4.MessageTypeDiscover,
+		},
+		{
+			name:        "unknown client requesting an address of the subnet",
+			hwAddr:      unknownHwAddr,
+			messageType: dhcpv4.MessageTypeRequest,
+			requestedIP: leasedIP,
+		},
+		{
+			name:          "unknown client requesting an address out of the subnet",
+			hwAddr:        unknownHwAddr,
+			messageType:   dhcpv4.MessageTypeRequest,
+			requestedIP:   otherSubnetIP,
+			authoritative: &expected{messageType: dhcpv4.MessageTypeNak},
+		},
+		{
+			name:          "relayed request for a stale address",
+			hwAddr:        knownHwAddr,
+			messageType:   dhcpv4.MessageTypeRequest,
+			requestedIP:   staleIP,
+			relayIP:       relayIP,
+			authoritative: &expected{messageType: dhcpv4.MessageTypeNak, broadcast: true},
+		},
+		{
+			name:        "request selecting another server",
+			hwAddr:      knownHwAddr,
+			messageType: dhcpv4.MessageTypeRequest,
+			requestedIP: staleIP,
+			serverID:    otherServerIP,
+		},
+	}
+
+	for _, authoritative := range []bool{true, false} {
+		a := New()
+		a.leases[knownHwAddr.String()] = DHCPLease{
+			ServerIP:   serverIP,
+			ClientIP:   leasedIP,
+			SubnetMask: net.CIDRMask(24, 32),
+		}
+		if err := a.SetPoolConfig(serverIP.String(), "192.168.0.0/24", authoritative, false, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range testCases {
+			want := tc.silent
+			if authoritative {
+				want = tc.authoritative
+			}
+
+			modifiers := []dhcpv4.Modifier{
+				dhcpv4.WithHwAddr(tc.hwAddr),
+				dhcpv4.WithMessageType(tc.messageType),
+			}
+			if tc.requestedIP != nil {
+				modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(tc.requestedIP)))
+			}
+			if tc.relayIP != nil {
+				modifiers = append(modifiers, dhcpv4.WithRelay(tc.relayIP))
+			}
+			if tc.serverID != nil {
+				modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(tc.serverID)))
+			}
+			m, err := dhcpv4.New(modifiers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reply := a.respond(m)
+			if want == nil {
+				if reply != nil {
+					t.Errorf("%s (authoritative=%t): got %s, wanted no reply", tc.name, authoritative, reply.MessageType())
+				}
+				continue
+			}
+			if reply == nil {
+				t.Errorf("%s (authoritative=%t): got no reply, wanted %s", tc.name, authoritative, want.messageType)
+				continue
+			}
+			if reply.MessageType() != want.messageType {
+				t.Errorf("%s (authoritative=%t): got %s, wanted %s", tc.name, authoritative, reply.MessageType(), want.messageType)
+			}
+			if reply.IsBroadcast() != want.broadcast {
+				t.Errorf("%s (authoritative=%t): got broadcast flag %t, wanted %t", tc.name, authoritative, reply.IsBroadcast(), want.broadcast)
+			}
+			if !reply.ServerIdentifier().Equal(serverIP) {
+				t.Errorf("%s (authoritative=%t): got server identifier %s, wanted %s", tc.name, authoritative, reply.ServerIdentifier(), serverIP)
+			}
+			if want.messageType == dhcpv4.MessageTypeNak && !reply.YourIPAddr.IsUnspecified() {
+				t.Errorf("%s (authoritative=%t): got yiaddr %s on nak", tc.name, authoritative, reply.YourIPAddr)
+			}
+		}
+	}
+}
+
+func TestRespondRelayGateways(t *testing.T) {
+	hwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+
+	newAllocator := func(serverIP, leasedIP string, relayGateways ...string) *DHCPAllocator {
+		a := New()
+		a.leases[hwAddr.String()] = DHCPLease{
+			ServerIP:   net.ParseIP(serverIP).To4(),
+			ClientIP:   net.ParseIP(leasedIP).To4(),
+			SubnetMask: net.CIDRMask(24, 32),
+		}
+		if err := a.SetPoolConfig(serverIP, "", true, false, relayGateways); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	// The same client is known to pools behind different relay agents, as
+	// with a centralized DHCP server
+	pools := map[string]*DHCPAllocator{
+		"net-1": newAllocator("10.0.1.2", "10.0.1.10", "10.0.1.1"),
+		"net-2": newAllocator("10.0.2.2", "10.0.2.10", "10.0.2.1", "10.0.2.254"),
+	}
+
+	testCases := []struct {
+		name    string
+		relayIP net.IP
+		want    map[string]string
+	}{
+		{
+			name:    "relayed by the gateway of net-1",
+			relayIP: net.ParseIP("10.0.1.1").To4(),
+			want:    map[string]string{"net-1": "10.0.1.10"},
+		},
+		{
+			name:    "relayed by a gateway of net-2",
+			relayIP: net.ParseIP("10.0.2.254").To4(),
+			want:    map[string]string{"net-2": "10.0.2.10"},
+		},
+		{
+			name:    "relayed by an unknown gateway",
+			relayIP: net.ParseIP("10.0.3.1").To4(),
+			want:    map[string]string{},
+		},
+		{
+			name: "not relayed",
+			want: map[string]string{"net-1": "10.0.1.10", "net-2": "10.0.2.10"},
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, messageType := range []dhcpv4.MessageType{dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest} {
+			modifiers := []dhcpv4.Modifier{
+				dhcpv4.WithHwAddr(hwAddr),
+				dhcpv4.WithMessageType(messageType),
+			}
+			if tc.relayIP != nil {
+				modifiers = append(modifiers, dhcpv4.WithRelay(tc.relayIP))
+			}
+			m, err := dhcpv4.New(modifiers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]string)
+			for name, a := range pools {
+				if reply := a.respond(m); reply != nil {
+					got[name] = reply.YourIPAddr.String()
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("%s (%s): got replies %v, wanted %v", tc.name, messageType, got, tc.want)
+			}
+		}
+	}
+
+	a := New()
+	if err := a.SetPoolConfig("10.0.1.2", "", true, false, []string{"10.0.1"}); err == nil {
+		t.Error("got no error, wanted invalid relay gateway to be rejected")
+	}
+}
+
+func TestRespondBOOTP(t *testing.T) {
+	knownHwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	unknownHwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:00")
+
+	serverIP := net.ParseIP("192.168.0.2").To4()
+	leasedIP := net.ParseIP("192.168.0.10").To4()
+	routerIP := net.ParseIP("192.168.0.1").To4()
+
+	newAllocator := func(allowBOOTP bool) *DHCPAllocator {
+		a := New()
+		a.leases[knownHwAddr.String()] = DHCPLease{
+			ServerIP:   serverIP,
+			ClientIP:   leasedIP,
+			SubnetMask: net.CIDRMask(24, 32),
+			Router:     routerIP,
+			LeaseTime:  3600,
+		}
+		if err := a.SetPoolConfig(serverIP.String(), "", true, allowBOOTP, nil); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	newBOOTPRequest := func(hwAddr net.HardwareAddr) *dhcpv4.DHCPv4 {
+		m, err := dhcpv4.New(dhcpv4.WithHwAddr(hwAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	t.Run("bootp request gets a permanent lease", func(t *testing.T) {
+		a := newAllocator(true)
+
+		reply := a.respond(newBOOTPRequest(knownHwAddr))
+		if reply == nil {
+			t.Fatal("got no reply, wanted a bootreply")
+		}
+
+		// Check the reply as sent on the wire
+		reply, err := dhcpv4.FromBytes(reply.ToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.OpCode != dhcpv4.OpcodeBootReply {
+			t.Errorf("got opcode %s, wanted %s", reply.OpCode, dhcpv4.OpcodeBootReply)
+		}
+		if !reply.YourIPAddr.Equal(leasedIP) {
+			t.Errorf("got yiaddr %s, wanted %s", reply.YourIPAddr, leasedIP)
+		}
+		if !reply.ServerIPAddr.Equal(serverIP) {
+			t.Errorf("got siaddr %s, wanted %s", reply.ServerIPAddr, serverIP)
+		}
+		if reply.MessageType() != dhcpv4.MessageTypeNone {
+			t.Errorf("got message type %s, wanted none", reply.MessageType())
+		}
+		if reply.Options.Has(dhcpv4.OptionIPAddressLeaseTime) {
+			t.Errorf("got lease time option %s, wanted none", reply.IPAddressLeaseTime(0))
+		}
+		if mask := reply.SubnetMask(); mask.String() != net.CIDRMask(24, 32).String() {
+			t.Errorf("got subnet mask %s, wanted %s", mask, net.CIDRMask(24, 32))
+		}
+		if routers := reply.Router(); len(routers) != 1 || !routers[0].Equal(routerIP) {
+			t.Errorf("got routers %v, wanted %s", routers, routerIP)
+		}
+
+		lease := a.GetLease(knownHwAddr.String())
+		if !lease.Permanent {
+			t.Errorf("got lease %s, wanted a permanent one", lease.String())
+		}
+
+		// DHCP requests from the client no longer get the pool's lease time
+		m, err := dhcpv4.New(
+			dhcpv4.WithHwAddr(knownHwAddr),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply = a.respond(m)
+		if reply == nil {
+			t.Fatal("got no reply, wanted an offer")
+		}
+		if leaseTime := reply.IPAddressLeaseTime(0); leaseTime != infiniteLeaseTime {
+			t.Errorf("got lease time %s, wanted %s", leaseTime, infiniteLeaseTime)
+		}
+	})
+
+	t.Run("bootp request to a pool not allowing bootp", func(t *testing.T) {
+		a := newAllocator(false)
+
+		if reply := a.respond(newBOOTPRequest(knownHwAddr)); reply != nil {
+			t.Errorf("got %s, wanted no reply", reply.Summary())
+		}
+		if lease := a.GetLease(knownHwAddr.String()); lease.Permanent {
+			t.Errorf("got lease %s, wanted a non-permanent one", lease.String())
+		}
+	})
+
+	t.Run("bootp request from an unknown client", func(t *testing.T) {
+		a := newAllocator(true)
+
+		if reply := a.respond(newBOOTPRequest(unknownHwAddr)); reply != nil {
+			t.Errorf("got %s, wanted no reply", reply.Summary())
+		}
+		if _, ok := a.leases[unknownHwAddr.String()]; ok {
+			t.Error("got a lease for the unknown client, wanted none")
+		}
+	})
+}
+
+func TestRespond_DefaultRoute(t *testing.T) {
+	primaryHwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	secondaryHwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:02")
+
+	routerIP := net.ParseIP("192.168.0.1").To4()
+	staticRoutes := []networkv1.Route{
+		{Destination: "10.0.0.0/8", Gateway: "192.168.0.254"},
+	}
+
+	// A VM with two interfaces on the pool, only the first one taking the
+	// default route
+	a := New()
+	for _, lease := range []struct {
+		hwAddr       net.HardwareAddr
+		clientIP     string
+		defaultRoute bool
+	}{
+		{hwAddr: primaryHwAddr, clientIP: "192.168.0.10", defaultRoute: true},
+		{hwAddr: secondaryHwAddr, clientIP: "192.168.0.11", defaultRoute: false},
+	} {
+		if err := a.AddLease(
+			lease.hwAddr.String(),
+			"192.168.0.2",
+			lease.clientIP,
+			"192.168.0.0/24",
+			"",
+			routerIP.String(),
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			staticRoutes,
+			nil,
+			nil,
+			lease.defaultRoute,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	discover := func(hwAddr net.HardwareAddr) *dhcpv4.DHCPv4 {
+		m, err := dhcpv4.New(
+			dhcpv4.WithHwAddr(hwAddr),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+			dhcpv4.WithRequestedOptions(dhcpv4.OptionRouter, dhcpv4.OptionClasslessStaticRoute),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := a.respond(m)
+		if reply == nil {
+			t.Fatalf("got no reply for hwaddr %s, wanted an offer", hwAddr)
+		}
+		// Check the reply as sent on the wire
+		reply, err = dhcpv4.FromBytes(reply.ToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	reply := discover(primaryHwAddr)
+	if routers := reply.Router(); len(routers) != 1 || !routers[0].Equal(routerIP) {
+		t.Errorf("got routers %v on the primary interface, wanted %s", routers, routerIP)
+	}
+	if routes := reply.ClasslessStaticRoute(); len(routes) != 2 {
+		t.Errorf("got classless static routes %v on the primary interface, wanted the static and the default one", routes)
+	}
+
+	reply = discover(secondaryHwAddr)
+	if reply.Options.Has(dhcpv4.OptionRouter) {
+		t.Errorf("got routers %v on the secondary interface, wanted none", reply.Router())
+	}
+	routes := reply.ClasslessStaticRoute()
+	if len(routes) != 1 || routes[0].Dest.String() != "10.0.0.0/8" {
+		t.Errorf("got classless static routes %v on the secondary interface, wanted the static one only", routes)
+	}
+}
+
+func TestRespond_SubnetMask(t *testing.T) {
+	hwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+
+	testCases := []struct {
+		name       string
+		subnetMask string
+		expected   net.IPMask
+		wantErr    error
+	}{
+		{
+			name:     "subnet mask derived from the cidr",
+			expected: net.CIDRMask(24, 32),
+		},
+		{
+			name:       "subnet mask overridden with a wider one",
+			subnetMask: "255.255.0.0",
+			expected:   net.CIDRMask(16, 32),
+		},
+		{
+			name:       "subnet mask not valid",
+			subnetMask: "255.255.0",
+			wantErr:    fmt.Errorf("subnet mask 255.255.0 is not valid"),
+		},
+		{
+			name:       "subnet mask not contiguous",
+			subnetMask: "255.0.255.0",
+			wantErr:    fmt.Errorf("subnet mask 255.0.255.0 is not contiguous"),
+		},
+	}
+
+	for _, tc := range testCases {
+		a := New()
+		err := a.AddLease(
+			hwAddr.String(),
+			"192.168.0.2",
+			"192.168.0.10",
+			"192.168.0.0/24",
+			tc.subnetMask,
+			"192.168.0.1",
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			true,
+		)
+		if tc.wantErr != nil {
+			if err == nil || err.Error() != tc.wantErr.Error() {
+				t.Errorf("%s: got error %v, wanted %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		// Option 1 is sent even to clients leaving it out of the parameter
+		// request list
+		m, err := dhcpv4.New(
+			dhcpv4.WithHwAddr(hwAddr),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+			dhcpv4.WithRequestedOptions(dhcpv4.OptionRouter),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := a.respond(m)
+		if reply == nil {
+			t.Fatalf("%s: got no reply, wanted an offer", tc.name)
+		}
+		reply, err = dhcpv4.FromBytes(reply.ToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reply.Options.Has(dhcpv4.OptionSubnetMask) {
+			t.Errorf("%s: got no subnet mask, wanted %s", tc.name, net.IP(tc.expected))
+		} else if mask := reply.SubnetMask(); !reflect.DeepEqual(mask, tc.expected) {
+			t.Errorf("%s: got subnet mask %s, wanted %s", tc.name, net.IP(mask), net.IP(tc.expected))
+		}
+	}
+}
+
+func TestRespond_Decline(t *testing.T) {
+	hwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	otherHwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:00")
+	serverIP := net.ParseIP("192.168.0.2").To4()
+	leasedIP := net.ParseIP("192.168.0.10").To4()
+	otherIP := net.ParseIP("192.168.0.20").To4()
+
+	newMessage := func(hwAddr net.HardwareAddr, messageType dhcpv4.MessageType, ip net.IP) *dhcpv4.DHCPv4 {
+		modifiers := []dhcpv4.Modifier{
+			dhcpv4.WithHwAddr(hwAddr),
+			dhcpv4.WithMessageType(messageType),
+		}
+		if ip != nil {
+			modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))
+		}
+		m, err := dhcpv4.New(modifiers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := NewDHCPAllocator(clock.NewFakeClock(now))
+	a.leases[hwAddr.String()] = DHCPLease{
+		ServerIP:   serverIP,
+		ClientIP:   leasedIP,
+		SubnetMask: net.CIDRMask(24, 32),
+	}
+	if err := a.SetPoolConfig(serverIP.String(), "", true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Declines of addresses not leased to the client are ignored
+	for _, m := range []*dhcpv4.DHCPv4{
+		newMessage(hwAddr, dhcpv4.MessageTypeDecline, otherIP),
+		newMessage(otherHwAddr, dhcpv4.MessageTypeDecline, leasedIP),
+	} {
+		if reply := a.respond(m); reply != nil {
+			t.Errorf("got %s, wanted no reply to decline", reply.MessageType())
+		}
+	}
+	if declines := a.ListDeclines(); len(declines) != 0 {
+		t.Fatalf("got declines %+v, wanted none", declines)
+	}
+	select {
+	case <-a.Declined():
+		t.Fatal("got decline signaled, wanted none")
+	default:
+	}
+
+	if reply := a.respond(newMessage(hwAddr, dhcpv4.MessageTypeDecline, leasedIP)); reply != nil {
+		t.Errorf("got %s, wanted no reply to decline", reply.MessageType())
+	}
+
+	select {
+	case <-a.Declined():
+	default:
+		t.Fatal("got no decline signaled")
+	}
+	declines := a.ListDeclines()
+	if len(declines) != 1 || declines[0].IP != leasedIP.String() || declines[0].MACAddress != hwAddr.String() || !declines[0].Time.Equal(now) {
+		t.Fatalf("got declines %+v, wanted one of %s by %s at %s", declines, leasedIP, hwAddr, now)
+	}
+
+	// The declined lease isn't offered anymore until it's replaced
+	if reply := a.respond(newMessage(hwAddr, dhcpv4.MessageTypeDiscover, nil)); reply != nil {
+		t.Errorf("got %s, wanted no offer of declined lease", reply.MessageType())
+	}
+	if reply := a.respond(newMessage(hwAddr, dhcpv4.MessageTypeRequest, leasedIP)); reply != nil {
+		t.Errorf("got %s, wanted no ack of declined lease", reply.MessageType())
+	}
+
+	if err := a.DeleteLease(hwAddr.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddLease(hwAddr.String(), serverIP.String(), otherIP.String(), "192.168.0.0/24", "", "", nil, nil, nil, nil, nil, nil, nil, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	reply := a.respond(newMessage(hwAddr, dhcpv4.MessageTypeDiscover, nil))
+	if reply == nil || reply.MessageType() != dhcpv4.MessageTypeOffer || !reply.YourIPAddr.Equal(otherIP) {
+		t.Errorf("got %v, wanted offer of %s", reply, otherIP)
+	}
+}
+
+func TestLeases_MACAddressForms(t *testing.T) {
+	serverIP := net.ParseIP("192.168.0.2").To4()
+	hwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+
+	a := New()
+	if err := a.SetPoolConfig(serverIP.String(), "", true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddLease("AA-BB-CC-DD-EE-FF", serverIP.String(), "192.168.0.10", "192.168.0.0/24", "", "",
+		nil, nil, nil, nil, nil, nil, nil, nil, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests carry the address the way net.HardwareAddr prints it
+	m, err := dhcpv4.NewDiscovery(hwAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := a.respond(m); reply == nil || !reply.YourIPAddr.Equal(net.ParseIP("192.168.0.10")) {
+		t.Errorf("got reply %v, wanted an offer of 192.168.0.10", reply)
+	}
+
+	for _, form := range []string{"aa:bb:cc:dd:ee:ff", "AA:BB:CC:DD:EE:FF", "aabb.ccdd.eeff"} {
+		if lease := a.GetLease(form); lease.ClientIP == nil {
+			t.Errorf("got no lease for %s", form)
+		}
+	}
+	if err := a.AddLease("aabb.ccdd.eeff", serverIP.String(), "192.168.0.11", "192.168.0.0/24", "", "",
+		nil, nil, nil, nil, nil, nil, nil, nil, true); err == nil {
+		t.Error("got no error adding a second lease for the same hwaddr in another form")
+	}
+	if err := a.AddLease("aa:bb:cc:ff:fe:dd:ee:ff", serverIP.String(), "192.168.0.12", "192.168.0.0/24", "", "",
+		nil, nil, nil, nil, nil, nil, nil, nil, true); err == nil {
+		t.Error("got no error adding a lease for an eui-64 hwaddr")
+	}
+
+	if err := a.DeleteLease("AA:BB:CC:DD:EE:FF"); err != nil {
+		t.Fatal(err)
+	}
+	if lease := a.GetLease("aa:bb:cc:dd:ee:ff"); lease.ClientIP != nil {
+		t.Errorf("got lease %s after deleting it", lease.ClientIP)
+	}
+}
@@ -0,0 +1,301 @@
+package dhcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/insomniacslk/dhcp/iana"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// DHCPv6Lease is the IPv6 address leased to a MAC address, served over
+// DHCPv6. Routes aren't part of it, as IPv6 hosts learn them from router
+// advertisements.
+type DHCPv6Lease struct {
+	ClientIP  net.IP
+	DNS       []net.IP
+	LeaseTime int
+}
+
+// lifetime returns the preferred and valid lifetime of the address of the
+// lease.
+func (l DHCPv6Lease) lifetime() time.Duration {
+	if l.LeaseTime > 0 {
+		return time.Duration(l.LeaseTime) * time.Second
+	}
+	return defaultLeaseTime
+}
+
+func (a *DHCPAllocator) AddLease6(hwAddr string, clientIP string, dnsServers []string, leaseTime *int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	normalized, err := util.ParseMAC(hwAddr)
+	if err != nil {
+		return fmt.Errorf("hwaddr %s is not valid", hwAddr)
+	}
+	hwAddr = normalized
+
+	if _, exists := a.leases6[hwAddr]; exists {
+		return fmt.Errorf("ipv6 lease for hwaddr %s already exists", hwAddr)
+	}
+
+	lease := DHCPv6Lease{
+		ClientIP: net.ParseIP(clientIP),
+	}
+	if lease.ClientIP == nil || lease.ClientIP.To4() != nil {
+		return fmt.Errorf("client ip %s is not a valid ipv6 address", clientIP)
+	}
+	for _, dnsServer := range dnsServers {
+		if dnsServerIP := net.ParseIP(dnsServer); dnsServerIP != nil {
+			lease.DNS = append(lease.DNS, dnsServerIP)
+		}
+	}
+	if leaseTime != nil {
+		lease.LeaseTime = *leaseTime
+	}
+
+	a.leases6[hwAddr] = lease
+
+	logrus.Infof("(dhcp.AddLease6) ipv6 lease added for hardware address: %s", hwAddr)
+
+	return nil
+}
+
+func (a *DHCPAllocator) GetLease6(hwAddr string) DHCPv6Lease {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	return a.leases6[util.NormalizeMAC(hwAddr)]
+}
+
+func (a *DHCPAllocator) DeleteLease6(hwAddr string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, exists := a.leases6[util.NormalizeMAC(hwAddr)]; !exists {
+		return fmt.Errorf("ipv6 lease for hwaddr %s does not exists", hwAddr)
+	}
+
+	delete(a.leases6, util.NormalizeMAC(hwAddr))
+
+	logrus.Infof("(dhcp.DeleteLease6) ipv6 lease deleted for hardware address: %s", hwAddr)
+
+	return nil
+}
+
+func (a *DHCPAllocator) dhcpv6Handler(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if m == nil {
+		logrus.Errorf("(dhcp.dhcpv6Handler) packet is nil!")
+		return
+	}
+
+	logrus.Tracef("(dhcp.dhcpv6Handler) INCOMING PACKET=%s", m.Summary())
+
+	reply, err := a.respond6(m, peer)
+	if err != nil {
+		logrus.Warnf("(dhcp.dhcpv6Handler) %s", err.Error())
+		return
+	}
+	if reply == nil {
+		return
+	}
+
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		logrus.Errorf("(dhcp.dhcpv6Handler) Cannot reply to client: %v", err)
+	}
+}
+
+// respond6 returns the reply to the packet m received from peer, relayed or
+// not, or nil if it should be left unanswered. Clients are told apart by
+// their MAC address, taken from their DUID or the relay agent, or else from
+// the EUI-64 link-local address they sent the packet from. The caller must
+// hold the allocator read lock.
+func (a *DHCPAllocator) respond6(m dhcpv6.DHCPv6, peer net.Addr) (dhcpv6.DHCPv6, error) {
+	if a.serverDUID == nil {
+		return nil, fmt.Errorf("dhcpv6 server has no duid yet")
+	}
+
+	msg, err := m.GetInnerMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := dhcpv6.ExtractMAC(m)
+	if err != nil {
+		udpAddr, ok := peer.(*net.UDPAddr)
+		if !ok || m.IsRelay() {
+			return nil, fmt.Errorf("cannot tell the mac address of the client: %w", err)
+		}
+		if mac, err = dhcpv6.GetMacAddressFromEUI64(udpAddr.IP); err != nil {
+			return nil, fmt.Errorf("cannot tell the mac address of the client: %w", err)
+		}
+	}
+
+	reply := a.reply6(msg, mac)
+	if reply == nil {
+		return nil, nil
+	}
+
+	if relay, ok := m.(*dhcpv6.RelayMessage); ok {
+		return dhcpv6.NewRelayReplFromRelayForw(relay, reply)
+	}
+
+	return reply, nil
+}
+
+// reply6 returns the reply to the message msg of the client with the MAC
+// address, or nil if it should be left unanswered.
+func (a *DHCPAllocator) reply6(msg *dhcpv6.Message, mac net.HardwareAddr) *dhcpv6.Message {
+	messageType := msg.Type()
+
+	// A client talking to another server
+	switch messageType {
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		if serverID := msg.Options.ServerID(); serverID == nil || !serverID.Equal(a.serverDUID) {
+			logrus.Debugf("(dhcp.dhcpv6Handler) %s FOR OTHER SERVER: hwaddr=%s", messageType, mac.String())
+			return nil
+		}
+	}
+
+	lease, ok := a.leases6[mac.String()]
+	if !ok {
+		logrus.Warnf("(dhcp.dhcpv6Handler) NO IPV6 LEASE FOUND: hwaddr=%s", mac.String())
+		return nil
+	}
+
+	logrus.Debugf("(dhcp.dhcpv6Handler) IPV6 LEASE FOUND: hwaddr=%s, type=%s, clientip=%s, dns=%+v, leasetime=%d",
+		mac.String(), messageType, lease.ClientIP.String(), lease.DNS, lease.LeaseTime)
+
+	modifiers := []dhcpv6.Modifier{dhcpv6.WithServerID(a.serverDUID)}
+	if len(lease.DNS) > 0 {
+		modifiers = append(modifiers, dhcpv6.WithDNS(lease.DNS...))
+	}
+
+	var (
+		reply *dhcpv6.Message
+		err   error
+	)
+	switch messageType {
+	case dhcpv6.MessageTypeSolicit:
+		iaNA := msg.Options.OneIANA()
+		if iaNA == nil {
+			logrus.Debugf("(dhcp.dhcpv6Handler) SOLICIT WITHOUT IA_NA: hwaddr=%s", mac.String())
+			return nil
+		}
+		modifiers = append(modifiers, dhcpv6.WithOption(leaseIANA(iaNA, lease)))
+		if msg.GetOneOption(dhcpv6.OptionRapidCommit) != nil {
+			reply, err = dhcpv6.NewReplyFromMessage(msg, modifiers...)
+		} else {
+			reply, err = dhcpv6.NewAdvertiseFromSolicit(msg, modifiers...)
+		}
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		iaNA := msg.Options.OneIANA()
+		if iaNA == nil {
+			logrus.Debugf("(dhcp.dhcpv6Handler) %s WITHOUT IA_NA: hwaddr=%s", messageType, mac.String())
+			return nil
+		}
+		modifiers = append(modifiers, dhcpv6.WithOption(leaseIANA(iaNA, lease)))
+		reply, err = dhcpv6.NewReplyFromMessage(msg, modifiers...)
+	case dhcpv6.MessageTypeConfirm:
+		status := &dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess}
+		for _, iaNA := range msg.Options.IANA() {
+			for _, iaAddr := range iaNA.Options.Addresses() {
+				if !iaAddr.IPv6Addr.Equal(lease.ClientIP) {
+					status = &dhcpv6.OptStatusCode{StatusCode: iana.StatusNotOnLink, StatusMessage: "address not leased"}
+				}
+			}
+		}
+		reply, err = dhcpv6.NewReplyFromMessage(msg, dhcpv6.WithServerID(a.serverDUID), dhcpv6.WithOption(status))
+	case dhcpv6.MessageTypeRelease:
+		// The lease lives as long as the VM network config does, so there's
+		// nothing to let go of
+		reply, err = dhcpv6.NewReplyFromMessage(msg, dhcpv6.WithServerID(a.serverDUID),
+			dhcpv6.WithOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess}))
+	case dhcpv6.MessageTypeInformationRequest:
+		reply, err = dhcpv6.NewReplyFromMessage(msg, modifiers...)
+	default:
+		logrus.Debugf("(dhcp.dhcpv6Handler) UNHANDLED MESSAGE TYPE %s: hwaddr=%s", messageType, mac.String())
+		return nil
+	}
+	if err != nil {
+		logrus.Errorf("(dhcp.dhcpv6Handler) cannot build reply to %s: %v", messageType, err)
+		return nil
+	}
+
+	logrus.Debugf("(dhcp.dhcpv6Handler) %s: %s", reply.Type(), reply.Summary())
+
+	return reply
+}
+
+// leaseIANA returns the IA_NA answering iaNA with the address of the lease.
+// Other addresses the client asks for get zero lifetimes, so it stops using
+// them (RFC 8415 section 18.3.4).
+func leaseIANA(iaNA *dhcpv6.OptIANA, lease DHCPv6Lease) *dhcpv6.OptIANA {
+	lifetime := lease.lifetime()
+
+	reply := &dhcpv6.OptIANA{
+		IaId: iaNA.IaId,
+		T1:   lifetime / 2,
+		T2:   lifetime * 4 / 5,
+	}
+	reply.Options.Add(&dhcpv6.OptIAAddress{
+		IPv6Addr:          lease.ClientIP,
+		PreferredLifetime: lifetime,
+		ValidLifetime:     lifetime,
+	})
+	for _, iaAddr := range iaNA.Options.Addresses() {
+		if !iaAddr.IPv6Addr.Equal(lease.ClientIP) {
+			reply.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: iaAddr.IPv6Addr})
+		}
+	}
+
+	return reply
+}
+
+// Run6 starts serving the IPv6 leases over DHCPv6 on nic. The server is
+// identified by a DUID made of the MAC address of nic.
+func (a *DHCPAllocator) Run6(ctx context.Context, nic string) error {
+	logrus.Infof("(dhcp.Run6) starting DHCPv6 service on nic %s", nic)
+
+	iface, err := net.InterfaceByName(nic)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	a.serverDUID = &dhcpv6.DUIDLL{
+		HWType:        iana.HWTypeEthernet,
+		LinkLayerAddr: iface.HardwareAddr,
+	}
+	a.mutex.Unlock()
+
+	// A nil address listens on [::]:547 and joins the multicast group of
+	// the DHCPv6 servers and relay agents
+	server, err := server6.NewServer(nic, nil, a.dhcpv6Handler)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := server.Serve(); err != nil {
+			logrus.Errorf("(dhcp.Run6) DHCPv6 server on nic %s exited with error: %v", nic, err)
+		}
+	}()
+
+	a.mutex.Lock()
+	a.servers6[nic] = server
+	a.mutex.Unlock()
+
+	return nil
+}
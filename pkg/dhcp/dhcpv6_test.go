@@ -0,0 +1,208 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestDHCPv6Leases(t *testing.T) {
+	a := New()
+
+	if err := a.AddLease6("aa:bb:cc:dd:ee:ff", "2001:db8::10", []string{"2001:db8::53"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddLease6("aa:bb:cc:dd:ee:ff", "2001:db8::11", nil, nil); err == nil {
+		t.Error("got no error adding a second ipv6 lease for the same hwaddr")
+	}
+	if err := a.AddLease6("aa:bb:cc:dd:ee:00", "192.168.0.10", nil, nil); err == nil {
+		t.Error("got no error adding an ipv4 address as ipv6 lease")
+	}
+
+	lease := a.GetLease6("aa:bb:cc:dd:ee:ff")
+	if !lease.ClientIP.Equal(net.ParseIP("2001:db8::10")) {
+		t.Errorf("got client ip %s, wanted 2001:db8::10", lease.ClientIP)
+	}
+	if lease.lifetime() != defaultLeaseTime {
+		t.Errorf("got lifetime %s, wanted %s", lease.lifetime(), defaultLeaseTime)
+	}
+
+	if err := a.DeleteLease6("aa:bb:cc:dd:ee:ff"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DeleteLease6("aa:bb:cc:dd:ee:ff"); err == nil {
+		t.Error("got no error deleting a deleted ipv6 lease")
+	}
+}
+
+func TestRespond6(t *testing.T) {
+	knownHwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	unknownHwAddr, _ := net.ParseMAC("aa:bb:cc:dd:ee:00")
+	serverHwAddr, _ := net.ParseMAC("02:00:00:00:00:01")
+	otherServerHwAddr, _ := net.ParseMAC("02:00:00:00:00:02")
+
+	leasedIP := net.ParseIP("2001:db8::10")
+	staleIP := net.ParseIP("2001:db8::20")
+	dnsIP := net.ParseIP("2001:db8::53")
+	peer := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: dhcpv6.DefaultClientPort}
+	// The EUI-64 link-local address of knownHwAddr
+	eui64Peer := &net.UDPAddr{IP: net.ParseIP("fe80::a8bb:ccff:fedd:eeff"), Port: dhcpv6.DefaultClientPort}
+
+	serverDUID := &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: serverHwAddr}
+	otherServerDUID := &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: otherServerHwAddr}
+
+	message := func(hwAddr net.HardwareAddr, messageType dhcpv6.MessageType, modifiers ...dhcpv6.Modifier) *dhcpv6.Message {
+		m, err := dhcpv6.NewSolicit(hwAddr, modifiers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.MessageType = messageType
+		return m
+	}
+
+	testCases := []struct {
+		name string
+		m    dhcpv6.DHCPv6
+		peer net.Addr
+		// expected is the type of the reply, none if zero
+		expected dhcpv6.MessageType
+		// addresses are the lifetimes of the addresses of the IA_NA of the
+		// reply, zero for the ones the client must stop using
+		addresses map[string]time.Duration
+	}{
+		{
+			name:      "known client soliciting",
+			m:         message(knownHwAddr, dhcpv6.MessageTypeSolicit),
+			peer:      peer,
+			expected:  dhcpv6.MessageTypeAdvertise,
+			addresses: map[string]time.Duration{leasedIP.String(): defaultLeaseTime},
+		},
+		{
+			name:      "known client soliciting with rapid commit",
+			m:         message(knownHwAddr, dhcpv6.MessageTypeSolicit, dhcpv6.WithRapidCommit),
+			peer:      peer,
+			expected:  dhcpv6.MessageTypeReply,
+			addresses: map[string]time.Duration{leasedIP.String(): defaultLeaseTime},
+		},
+		{
+			name:      "known client requesting",
+			m:         message(knownHwAddr, dhcpv6.MessageTypeRequest, dhcpv6.WithServerID(serverDUID)),
+			peer:      peer,
+			expected:  dhcpv6.MessageTypeReply,
+			addresses: map[string]time.Duration{leasedIP.String(): defaultLeaseTime},
+		},
+		{
+			name:     "known client requesting from another server",
+			m:        message(knownHwAddr, dhcpv6.MessageTypeRequest, dhcpv6.WithServerID(otherServerDUID)),
+			peer:     peer,
+			expected: 0,
+		},
+		{
+			name: "known client renewing a stale address",
+			m: message(knownHwAddr, dhcpv6.MessageTypeRenew, dhcpv6.WithServerID(serverDUID),
+				dhcpv6.WithIANA(dhcpv6.OptIAAddress{IPv6Addr: staleIP, PreferredLifetime: time.Hour, ValidLifetime: time.Hour})),
+			peer:     peer,
+			expected: dhcpv6.MessageTypeReply,
+			addresses: map[string]time.Duration{
+				leasedIP.String(): defaultLeaseTime,
+				staleIP.String():  0,
+			},
+		},
+		{
+			name:     "unknown client soliciting",
+			m:        message(unknownHwAddr, dhcpv6.MessageTypeSolicit),
+			peer:     peer,
+			expected: 0,
+		},
+		{
+			name: "known client without link-layer duid soliciting from its eui-64 address",
+			m: func() *dhcpv6.Message {
+				m := message(knownHwAddr, dhcpv6.MessageTypeSolicit)
+				m.UpdateOption(dhcpv6.OptClientID(&dhcpv6.DUIDEN{EnterpriseNumber: 1, EnterpriseIdentifier: []byte("vm")}))
+				return m
+			}(),
+			peer:      eui64Peer,
+			expected:  dhcpv6.MessageTypeAdvertise,
+			addresses: map[string]time.Duration{leasedIP.String(): defaultLeaseTime},
+		},
+		{
+			name: "known client soliciting through a relay agent",
+			m: func() dhcpv6.DHCPv6 {
+				relay, err := dhcpv6.EncapsulateRelay(message(knownHwAddr, dhcpv6.MessageTypeSolicit),
+					dhcpv6.MessageTypeRelayForward, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::2"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return relay
+			}(),
+			peer:      peer,
+			expected:  dhcpv6.MessageTypeAdvertise,
+			addresses: map[string]time.Duration{leasedIP.String(): defaultLeaseTime},
+		},
+	}
+
+	a := New()
+	a.serverDUID = serverDUID
+	a.leases6[knownHwAddr.String()] = DHCPv6Lease{
+		ClientIP: leasedIP,
+		DNS:      []net.IP{dnsIP},
+	}
+
+	for _, tc := range testCases {
+		reply, err := a.respond6(tc.m, tc.peer)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if tc.expected == 0 {
+			if reply != nil {
+				t.Errorf("%s: got %s, wanted no reply", tc.name, reply.Type())
+			}
+			continue
+		}
+		if reply == nil {
+			t.Errorf("%s: got no reply, wanted %s", tc.name, tc.expected)
+			continue
+		}
+
+		if tc.m.IsRelay() != reply.IsRelay() {
+			t.Errorf("%s: got relayed reply %t, wanted %t", tc.name, reply.IsRelay(), tc.m.IsRelay())
+		}
+		msg, err := reply.GetInnerMessage()
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if msg.Type() != tc.expected {
+			t.Errorf("%s: got %s, wanted %s", tc.name, msg.Type(), tc.expected)
+		}
+		if serverID := msg.Options.ServerID(); serverID == nil || !serverID.Equal(serverDUID) {
+			t.Errorf("%s: got server id %v, wanted %s", tc.name, serverID, serverDUID)
+		}
+		if dns := msg.Options.DNS(); len(dns) != 1 || !dns[0].Equal(dnsIP) {
+			t.Errorf("%s: got dns %v, wanted %s", tc.name, dns, dnsIP)
+		}
+
+		iaNA := msg.Options.OneIANA()
+		if iaNA == nil {
+			t.Errorf("%s: got no IA_NA", tc.name)
+			continue
+		}
+		addresses := make(map[string]time.Duration)
+		for _, iaAddr := range iaNA.Options.Addresses() {
+			addresses[iaAddr.IPv6Addr.String()] = iaAddr.ValidLifetime
+		}
+		if len(addresses) != len(tc.addresses) {
+			t.Errorf("%s: got addresses %v, wanted %v", tc.name, addresses, tc.addresses)
+			continue
+		}
+		for ip, lifetime := range tc.addresses {
+			if got, ok := addresses[ip]; !ok || got != lifetime {
+				t.Errorf("%s: got addresses %v, wanted %v", tc.name, addresses, tc.addresses)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package dhcp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+)
+
+// defaultLeaseTime is the lease time of the leases without one: 1 year.
+const defaultLeaseTime = 31536000 * time.Second
+
+// optionMSClasslessStaticRoute is the option Microsoft clients take the
+// classless static routes from, instead of option 121. It's only sent to the
+// clients asking for it, as other clients may make something else of it.
+const optionMSClasslessStaticRoute = dhcpv4.GenericOptionCode(249)
+
+// newOptionsTemplate encodes the options the lease is answered with, which
+// are the same for every reply. The leases carry it from the time they're
+// added, so the replies only copy it instead of encoding the options over
+// again for every packet. The options depending on the request, i.e., the
+// message type, and on the state of the lease, i.e., the infinite lease time
+// of permanent leases, are set on top of it per reply.
+//
+// The template is shared by every reply of the lease and must never be
+// modified. A lease whose settings change is added again with a new one.
+func newOptionsTemplate(lease DHCPLease) dhcpv4.Options {
+	options := make(dhcpv4.Options)
+
+	// The extra options go first, so the ones below win over them
+	for code, value := range lease.ExtraOptions {
+		options.Update(dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(code), value))
+	}
+
+	options.Update(dhcpv4.OptServerIdentifier(lease.ServerIP))
+	options.Update(dhcpv4.OptSubnetMask(lease.SubnetMask))
+
+	if lease.Router != nil {
+		options.Update(dhcpv4.OptRouter(lease.Router))
+	}
+
+	if len(lease.DNS) > 0 {
+		options.Update(dhcpv4.OptDNS(lease.DNS...))
+	}
+
+	if lease.DomainName != "" {
+		options.Update(dhcpv4.OptDomainName(lease.DomainName))
+	}
+
+	if len(lease.DomainSearch) > 0 {
+		options.Update(dhcpv4.OptGeneric(dhcpv4.OptionDNSDomainSearchList, encodeDomainSearch(lease.DomainSearch)))
+	}
+
+	if len(lease.NTP) > 0 {
+		options.Update(dhcpv4.OptNTPServers(lease.NTP...))
+	}
+
+	if lease.MTU > 0 {
+		options.Update(dhcpv4.Option{Code: dhcpv4.OptionInterfaceMTU, Value: dhcpv4.Uint16(lease.MTU)})
+	}
+
+	if len(lease.StaticRoutes) > 0 {
+		routes := encodeClasslessStaticRoutes(classlessStaticRoutes(lease))
+		options.Update(dhcpv4.OptGeneric(dhcpv4.OptionClasslessStaticRoute, routes))
+		// Windows only asks for the routes with the option of Microsoft,
+		// which is encoded the same way
+		options.Update(dhcpv4.OptGeneric(optionMSClasslessStaticRoute, routes))
+	}
+
+	if lease.LeaseTime > 0 {
+		options.Update(dhcpv4.OptIPAddressLeaseTime(time.Duration(lease.LeaseTime) * time.Second))
+	} else {
+		options.Update(dhcpv4.OptIPAddressLeaseTime(defaultLeaseTime))
+	}
+
+	return options
+}
+
+// OptionPayload returns the bytes the extra option is sent with, decoding its
+// value as its type says. A DHCP option holds at most 255 bytes.
+func OptionPayload(extraOption networkv1.ExtraOption) ([]byte, error) {
+	var payload []byte
+	switch extraOption.Type {
+	case "", networkv1.ExtraOptionTypeText:
+		payload = []byte(extraOption.Value)
+	case networkv1.ExtraOptionTypeHex:
+		var err error
+		if payload, err = hex.DecodeString(extraOption.Value); err != nil {
+			return nil, fmt.Errorf("value of option %d is not valid hex: %w", extraOption.Code, err)
+		}
+	default:
+		return nil, fmt.Errorf("type %q of option %d is not valid", extraOption.Type, extraOption.Code)
+	}
+
+	if len(payload) > 255 {
+		return nil, fmt.Errorf("value of option %d is %d bytes long, more than 255", extraOption.Code, len(payload))
+	}
+
+	return payload, nil
+}
+
+// encodeClasslessStaticRoutes encodes the routes of option 121 (RFC 3442).
+// Each route is the prefix length of its destination, followed by the
+// significant octets of the destination only, i.e., as many as it takes to
+// hold the prefix length, and by the router. A default route thus takes 5
+// octets, a /24 route 8, and a /32 host route 9.
+func encodeClasslessStaticRoutes(routes dhcpv4.Routes) []byte {
+	var data []byte
+	for _, route := range routes {
+		ones, _ := route.Dest.Mask.Size()
+		destination := route.Dest.IP.Mask(route.Dest.Mask).To4()
+		data = append(data, byte(ones))
+		data = append(data, destination[:(ones+7)/8]...)
+		data = append(data, route.Router.To4()...)
+	}
+	return data
+}
+
+// maxCompressionOffset is the largest offset a compression pointer can hold,
+// which has 14 bits for it.
+const maxCompressionOffset = 0x3fff
+
+// encodeDomainSearch encodes the domain search list of option 119 (RFC 3397).
+// The names are compressed the way RFC 1035 compresses them in DNS messages:
+// a name whose suffix is already in the list ends with a pointer to it, the
+// offset being counted from the start of the option data. Pointers only ever
+// target names encoded in full, so that decoders not following a pointer to a
+// pointer, like the one of the dhcp library, read the list as well. Suffixes
+// are matched regardless of the case.
+func encodeDomainSearch(domains []string) []byte {
+	var data []byte
+	// Offsets of the suffixes encoded in full, by lowercase suffix
+	offsets := make(map[string]int)
+
+	for _, domain := range domains {
+		domain = strings.TrimSuffix(domain, ".")
+		if domain == "" {
+			continue
+		}
+		labels := strings.Split(domain, ".")
+
+		// The labels before the longest suffix already encoded are
+		// written out, and the suffix is pointed to
+		literal, pointer := len(labels), -1
+		for i := range labels {
+			if offset, ok := offsets[strings.ToLower(strings.Join(labels[i:], "."))]; ok {
+				literal, pointer = i, offset
+				break
+			}
+		}
+
+		for i, label := range labels[:literal] {
+			if pointer < 0 && len(data) <= maxCompressionOffset {
+				offsets[strings.ToLower(strings.Join(labels[i:], "."))] = len(data)
+			}
+			data = append(data, byte(len(label)))
+			data = append(data, label...)
+		}
+		if pointer < 0 {
+			data = append(data, 0)
+		} else {
+			data = append(data, 0xc0|byte(pointer>>8), byte(pointer))
+		}
+	}
+
+	return data
+}
+
+// optionsTemplate returns the options template of the lease, encoding it
+// first for the leases which weren't added through AddLease.
+func (l *DHCPLease) optionsTemplate() dhcpv4.Options {
+	if l.options != nil {
+		return l.options
+	}
+	return newOptionsTemplate(*l)
+}
@@ -0,0 +1,503 @@
+package dhcp
+
+import (
+	"encoding/hex"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/rfc1035label"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+const (
+	goldenHwAddr        = "aa:bb:cc:dd:ee:ff"
+	goldenNoRouteHwAddr = "aa:bb:cc:dd:ee:01"
+	goldenClientIP      = "192.168.0.10"
+	goldenNoRouteIP     = "192.168.0.11"
+)
+
+// newGoldenAllocator returns an allocator serving the leases the golden
+// replies are made from, one with a default route and one without.
+func newGoldenAllocator(t testing.TB) *DHCPAllocator {
+	a := New()
+	if err := a.SetPoolConfig("192.168.0.2", "", true, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	domainName := "example.com"
+	leaseTime := 300
+	for _, lease := range []struct {
+		hwAddr       string
+		clientIP     string
+		defaultRoute bool
+	}{
+		{goldenHwAddr, goldenClientIP, true},
+		{goldenNoRouteHwAddr, goldenNoRouteIP, false},
+	} {
+		if err := a.AddLease(
+			lease.hwAddr,
+			"192.168.0.2",
+			lease.clientIP,
+			"192.168.0.0/24",
+			"",
+			"192.168.0.1",
+			[]string{"8.8.8.8", "1.1.1.1"},
+			&domainName,
+			[]string{"example.com", "example.org"},
+			[]string{"192.168.0.253"},
+			&leaseTime,
+			[]networkv1.Route{{Destination: "10.53.0.0/16", Gateway: "192.168.0.254"}},
+			[]int{42},
+			nil,
+			lease.defaultRoute,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return a
+}
+
+func newGoldenRequest(t testing.TB, hwAddr string, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	mac, _ := net.ParseMAC(hwAddr)
+	m, err := dhcpv4.New(append([]dhcpv4.Modifier{
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithTransactionID(dhcpv4.TransactionID{0xde, 0xad, 0xbe, 0xef}),
+	}, modifiers...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// TestRespond_Golden makes sure the replies stay the same on the wire. Run
+// the test with -update to rewrite the golden files on purpose.
+func TestRespond_Golden(t *testing.T) {
+	testCases := []struct {
+		name      string
+		hwAddr    string
+		permanent bool
+		modifiers []dhcpv4.Modifier
+	}{
+		{
+			name:      "discover",
+			hwAddr:    goldenHwAddr,
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover)},
+		},
+		{
+			name:   "request",
+			hwAddr: goldenHwAddr,
+			modifiers: []dhcpv4.Modifier{
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+				dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.ParseIP(goldenClientIP))),
+			},
+		},
+		{
+			name:   "discover-with-prl",
+			hwAddr: goldenHwAddr,
+			modifiers: []dhcpv4.Modifier{
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+				dhcpv4.WithRequestedOptions(dhcpv4.OptionDomainNameServer, dhcpv4.OptionClasslessStaticRoute),
+			},
+		},
+		{
+			name:      "discover-without-default-route",
+			hwAddr:    goldenNoRouteHwAddr,
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover)},
+		},
+		{
+			name:      "discover-permanent",
+			hwAddr:    goldenHwAddr,
+			permanent: true,
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover)},
+		},
+		{
+			name:   "relayed-request",
+			hwAddr: goldenHwAddr,
+			modifiers: []dhcpv4.Modifier{
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+				dhcpv4.WithGatewayIP(net.ParseIP("10.0.0.1")),
+				dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0")))),
+			},
+		},
+		{
+			name:      "bootp",
+			hwAddr:    goldenHwAddr,
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithBroadcast(true)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newGoldenAllocator(t)
+			if tc.permanent {
+				lease := a.leases[tc.hwAddr]
+				lease.Permanent = true
+				a.leases[tc.hwAddr] = lease
+			}
+
+			reply := a.respond(newGoldenRequest(t, tc.hwAddr, tc.modifiers...))
+			if reply == nil {
+				t.Fatal("got no reply")
+			}
+			got := hex.EncodeToString(reply.ToBytes())
+
+			golden := filepath.Join("testdata", tc.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wanted, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != strings.TrimSpace(string(wanted)) {
+				t.Errorf("got reply %s, wanted %s", got, strings.TrimSpace(string(wanted)))
+			}
+		})
+	}
+}
+
+func TestBuildReply_TemplateUntouched(t *testing.T) {
+	a := newGoldenAllocator(t)
+	lease := a.leases[goldenHwAddr]
+	wanted := hex.EncodeToString(lease.options.ToBytes())
+
+	m := newGoldenRequest(t, goldenHwAddr,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+		dhcpv4.WithRequestedOptions(dhcpv4.OptionDomainNameServer),
+	)
+	for _, permanent := range []bool{false, true} {
+		lease.Permanent = permanent
+		reply, err := dhcpv4.NewReplyFromRequest(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := buildReply(reply, m, lease); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := hex.EncodeToString(lease.options.ToBytes()); got != wanted {
+		t.Errorf("got template %s, wanted it untouched as %s", got, wanted)
+	}
+}
+
+func TestNewOptionsTemplate_DHCPOptions(t *testing.T) {
+	a := New()
+	mtu := 1450
+	if err := a.AddLease(goldenHwAddr, "192.168.0.2", goldenClientIP, "192.168.0.0/24", "", "192.168.0.1",
+		nil, nil, nil, nil, nil, nil, nil,
+		&networkv1.DHCPOptions{
+			MTU: &mtu,
+			ExtraOptions: []networkv1.ExtraOption{
+				{Code: 67, Value: "pxelinux.0"},
+				{Code: 161, Value: "c0a80001", Type: networkv1.ExtraOptionTypeHex},
+				// Left out for the subnet mask of the CIDR
+				{Code: 1, Value: "bogus"},
+			},
+		},
+		true,
+	); err != nil {
+		t.Fatal(err)
+	}
+	options := a.leases[goldenHwAddr].options
+
+	if got := options.Get(dhcpv4.OptionInterfaceMTU); hex.EncodeToString(got) != "05aa" {
+		t.Errorf("got mtu %x, wanted 05aa", got)
+	}
+	if got := options.Get(dhcpv4.OptionBootfileName); string(got) != "pxelinux.0" {
+		t.Errorf("got boot file name %q, wanted pxelinux.0", got)
+	}
+	if got := options.Get(dhcpv4.OptionSubnetMask); hex.EncodeToString(got) != "ffffff00" {
+		t.Errorf("got subnet mask %x, wanted ffffff00", got)
+	}
+
+	reply := a.respond(newGoldenRequest(t, goldenHwAddr,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+		dhcpv4.WithRequestedOptions(dhcpv4.GenericOptionCode(161)),
+	))
+	if reply == nil {
+		t.Fatal("got no reply")
+	}
+	if got := reply.Options.Get(dhcpv4.GenericOptionCode(161)); hex.EncodeToString(got) != "c0a80001" {
+		t.Errorf("got option 161 %x, wanted c0a80001", got)
+	}
+	if got := reply.Options.Get(dhcpv4.OptionBootfileName); got != nil {
+		t.Errorf("got boot file name %q, wanted none as it wasn't requested", got)
+	}
+
+	for _, mtu := range []int{67, 9001} {
+		if err := a.AddLease(goldenNoRouteHwAddr, "192.168.0.2", goldenNoRouteIP, "192.168.0.0/24", "", "",
+			nil, nil, nil, nil, nil, nil, nil, &networkv1.DHCPOptions{MTU: &mtu}, true); err == nil {
+			t.Errorf("got no error adding a lease with mtu %d", mtu)
+		}
+	}
+}
+
+func TestNewOptionsTemplate_JumboMTU(t *testing.T) {
+	a := New()
+	mtu := 9000
+	if err := a.AddLease(goldenHwAddr, "192.168.0.2", goldenClientIP, "192.168.0.0/24", "", "192.168.0.1",
+		nil, nil, nil, nil, nil, nil, nil, &networkv1.DHCPOptions{MTU: &mtu}, true); err != nil {
+		t.Fatal(err)
+	}
+	// Two bytes, big-endian
+	if got := a.leases[goldenHwAddr].options.Get(dhcpv4.OptionInterfaceMTU); hex.EncodeToString(got) != "2328" {
+		t.Errorf("got mtu %x, wanted 2328", got)
+	}
+
+	// Guests keep their own MTU without one in the IPPool
+	if err := a.AddLease(goldenNoRouteHwAddr, "192.168.0.2", goldenNoRouteIP, "192.168.0.0/24", "", "192.168.0.1",
+		nil, nil, nil, nil, nil, nil, nil, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.leases[goldenNoRouteHwAddr].options.Get(dhcpv4.OptionInterfaceMTU); got != nil {
+		t.Errorf("got mtu %x, wanted none", got)
+	}
+}
+
+func TestEncodeClasslessStaticRoutes(t *testing.T) {
+	route := func(destination, router string) *dhcpv4.Route {
+		_, dest, _ := net.ParseCIDR(destination)
+		return &dhcpv4.Route{Dest: dest, Router: net.ParseIP(router).To4()}
+	}
+
+	tests := []struct {
+		name   string
+		routes dhcpv4.Routes
+		// expected is the hex of the option data
+		expected string
+	}{
+		{
+			name:     "default route",
+			routes:   dhcpv4.Routes{route("0.0.0.0/0", "192.168.0.1")},
+			expected: "00" + "c0a80001",
+		},
+		{
+			name: "rfc 3442 examples",
+			routes: dhcpv4.Routes{
+				route("10.0.0.0/8", "192.168.0.1"),
+				route("10.17.0.0/16", "192.168.0.1"),
+				route("10.27.129.0/24", "192.168.0.1"),
+				route("10.229.0.128/25", "192.168.0.1"),
+				route("10.198.122.47/32", "192.168.0.1"),
+			},
+			expected: "080a" + "c0a80001" +
+				"100a11" + "c0a80001" +
+				"180a1b81" + "c0a80001" +
+				"190ae50080" + "c0a80001" +
+				"200ac67a2f" + "c0a80001",
+		},
+		{
+			name: "prefix lengths not on octet boundaries",
+			routes: dhcpv4.Routes{
+				route("172.16.0.0/12", "192.168.0.254"),
+				route("192.168.128.0/17", "0.0.0.0"),
+			},
+			expected: "0cac10" + "c0a800fe" + "11c0a880" + "00000000",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := encodeClasslessStaticRoutes(tc.routes)
+			if got := hex.EncodeToString(data); got != tc.expected {
+				t.Errorf("got %s, wanted %s", got, tc.expected)
+			}
+
+			var decoded dhcpv4.Routes
+			if err := decoded.FromBytes(data); err != nil {
+				t.Fatalf("cannot decode %x: %s", data, err)
+			}
+			if decoded.String() != tc.routes.String() {
+				t.Errorf("decoded %s, wanted %s", decoded, tc.routes)
+			}
+		})
+	}
+}
+
+func TestRespond_MSClasslessStaticRoute(t *testing.T) {
+	a := newGoldenAllocator(t)
+	option121 := a.leases[goldenHwAddr].options.Get(dhcpv4.OptionClasslessStaticRoute)
+	if len(option121) == 0 {
+		t.Fatal("got no classless static routes in the template")
+	}
+
+	testCases := []struct {
+		name     string
+		prl      []dhcpv4.OptionCode
+		expected bool
+	}{
+		{
+			name:     "asked for by windows",
+			prl:      []dhcpv4.OptionCode{dhcpv4.OptionRouter, optionMSClasslessStaticRoute},
+			expected: true,
+		},
+		{
+			name: "asked for option 121 only",
+			prl:  []dhcpv4.OptionCode{dhcpv4.OptionRouter, dhcpv4.OptionClasslessStaticRoute},
+		},
+		{
+			name: "no parameter request list",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			modifiers := []dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover)}
+			if len(tc.prl) > 0 {
+				modifiers = append(modifiers, dhcpv4.WithRequestedOptions(tc.prl...))
+			}
+			reply := a.respond(newGoldenRequest(t, goldenHwAddr, modifiers...))
+			if reply == nil {
+				t.Fatal("got no reply")
+			}
+
+			option249 := reply.Options.Get(optionMSClasslessStaticRoute)
+			switch {
+			case tc.expected && hex.EncodeToString(option249) != hex.EncodeToString(option121):
+				t.Errorf("got option 249 %x, wanted %x as option 121", option249, option121)
+			case !tc.expected && option249 != nil:
+				t.Errorf("got option 249 %x, wanted none", option249)
+			}
+		})
+	}
+}
+
+func TestEncodeDomainSearch(t *testing.T) {
+	tests := []struct {
+		name    string
+		domains []string
+		// expected is the hex of the option data
+		expected string
+		// decoded is the list as the dhcp library reads it
+		decoded []string
+	}{
+		{
+			name:    "rfc 3397 example",
+			domains: []string{"eng.apple.com.", "marketing.apple.com."},
+			// eng.apple.com, then marketing and a pointer to apple.com
+			expected: "03656e67056170706c6503636f6d00" + "096d61726b6574696e67" + "c004",
+			decoded:  []string{"eng.apple.com", "marketing.apple.com"},
+		},
+		{
+			name:     "no common suffix",
+			domains:  []string{"example.com", "example.org"},
+			expected: "076578616d706c6503636f6d00" + "076578616d706c65036f726700",
+			decoded:  []string{"example.com", "example.org"},
+		},
+		{
+			name:    "whole name and suffix of another case",
+			domains: []string{"example.com", "Example.COM", "eng.EXAMPLE.com"},
+			// example.com, then a pointer to it, then eng and a pointer to it
+			expected: "076578616d706c6503636f6d00" + "c000" + "03656e67c000",
+			decoded:  []string{"example.com", "example.com", "eng.example.com"},
+		},
+		{
+			name:    "no pointer to a pointer",
+			domains: []string{"example.com", "lab.example.com", "rack.lab.example.com"},
+			// rack.lab.example.com points to example.com, as lab.example.com
+			// isn't encoded in full
+			expected: "076578616d706c6503636f6d00" + "036c6162c000" + "047261636b036c6162c000",
+			decoded:  []string{"example.com", "lab.example.com", "rack.lab.example.com"},
+		},
+		{
+			name:     "empty names left out",
+			domains:  []string{"", ".", "example.com"},
+			expected: "076578616d706c6503636f6d00",
+			decoded:  []string{"example.com"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := encodeDomainSearch(tc.domains)
+			if got := hex.EncodeToString(data); got != tc.expected {
+				t.Errorf("got %s, wanted %s", got, tc.expected)
+			}
+
+			labels, err := rfc1035label.FromBytes(data)
+			if err != nil {
+				t.Fatalf("cannot decode %x: %s", data, err)
+			}
+			if strings.Join(labels.Labels, ",") != strings.Join(tc.decoded, ",") {
+				t.Errorf("decoded %v, wanted %v", labels.Labels, tc.decoded)
+			}
+		})
+	}
+}
+
+func TestNewOptionsTemplate_Domains(t *testing.T) {
+	a := New()
+	domainName := "example.com."
+	if err := a.AddLease(goldenHwAddr, "192.168.0.2", goldenClientIP, "192.168.0.0/24", "", "192.168.0.1",
+		nil, &domainName, []string{"eng.example.com.", "example.com", ""}, nil, nil, nil, nil, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	options := a.leases[goldenHwAddr].options
+
+	if got := options.Get(dhcpv4.OptionDomainName); string(got) != "example.com" {
+		t.Errorf("got domain name %q, wanted example.com", got)
+	}
+	// eng and example.com, then a pointer to example.com
+	if got := options.Get(dhcpv4.OptionDNSDomainSearchList); hex.EncodeToString(got) != "03656e67076578616d706c6503636f6d00c004" {
+		t.Errorf("got domain search list %x, wanted 03656e67076578616d706c6503636f6d00c004", got)
+	}
+
+	// Unset names are left out
+	emptyDomainName := ""
+	if err := a.AddLease(goldenNoRouteHwAddr, "192.168.0.2", goldenNoRouteIP, "192.168.0.0/24", "", "192.168.0.1",
+		nil, &emptyDomainName, []string{""}, nil, nil, nil, nil, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	options = a.leases[goldenNoRouteHwAddr].options
+	for _, code := range []dhcpv4.OptionCode{dhcpv4.OptionDomainName, dhcpv4.OptionDNSDomainSearchList} {
+		if options.Has(code) {
+			t.Errorf("got option %s, wanted none as it's unset", code)
+		}
+	}
+}
+
+// BenchmarkRespond_Discover compares answering a DISCOVER from the options
+// template of the lease with encoding the options for every reply, the way
+// leases without a template are answered.
+func BenchmarkRespond_Discover(b *testing.B) {
+	for _, tc := range []struct {
+		name     string
+		template bool
+	}{
+		{name: "template", template: true},
+		{name: "encode", template: false},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			a := newGoldenAllocator(b)
+			if !tc.template {
+				lease := a.leases[goldenHwAddr]
+				lease.options = nil
+				a.leases[goldenHwAddr] = lease
+			}
+			m := newGoldenRequest(b, goldenHwAddr,
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+				dhcpv4.WithRequestedOptions(dhcpv4.OptionDomainNameServer, dhcpv4.OptionClasslessStaticRoute),
+			)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if reply := a.respond(m); reply == nil {
+					b.Fatal("got no reply")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package externalipam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+const (
+	// DefaultTimeout is how long a request waits for the answer of the
+	// webhook when the IPPool doesn't tell.
+	DefaultTimeout = 5 * time.Second
+	// DefaultFailureThreshold is how many requests in a row have to fail for
+	// the webhook of an IPPool to be given up on for a while.
+	DefaultFailureThreshold = 5
+	// DefaultCooldown is how long the webhook of an IPPool is given up on
+	// before being tried again.
+	DefaultCooldown = 30 * time.Second
+
+	// MaxTimeout caps how long a request waits for the answer, whatever the
+	// IPPool tells, so a slow webhook can't hold up the reconciliation of
+	// the VMs for long.
+	MaxTimeout = 10 * time.Second
+
+	// maxResponseSize caps the body read from the webhook.
+	maxResponseSize = 64 * 1024
+)
+
+// ErrUnavailable is returned without asking the webhook while it's given up
+// on after failing too many times in a row.
+var ErrUnavailable = errors.New("external ipam unavailable")
+
+type Operation string
+
+const (
+	OperationAllocate Operation = "Allocate"
+	OperationRelease  Operation = "Release"
+)
+
+// Request is the body posted to the webhook. The IP address is the one
+// released, or the one the allocation asks for, if any, which the external
+// IPAM is free to turn down for another one.
+type Request struct {
+	Operation   Operation `json:"operation"`
+	IPPool      string    `json:"ipPool"`
+	NetworkName string    `json:"networkName"`
+	CIDR        string    `json:"cidr"`
+	MACAddress  string    `json:"macAddress"`
+	VmNetCfg    string    `json:"vmNetCfg"`
+	VMName      string    `json:"vmName,omitempty"`
+	IPAddress   string    `json:"ipAddress,omitempty"`
+}
+
+// Response is the body the webhook answers an allocation with. The answer to
+// a release is ignored, only its status code counts.
+type Response struct {
+	IPAddress string `json:"ipAddress"`
+}
+
+// Endpoint is where, and how, the webhook of an IPPool is reached.
+type Endpoint struct {
+	URL     string
+	Token   string
+	Timeout time.Duration
+}
+
+type breaker struct {
+	failures int
+	openedAt time.Time
+	lastErr  error
+}
+
+// Client asks the webhooks of the IPPools for the IP addresses to allocate and
+// tells them about the releases. The webhook of an IPPool failing too many
+// times in a row is given up on for a cooldown, then tried again with the next
+// request, so a broken external IPAM doesn't hold up every allocation for the
+// whole timeout. It lives in memory only, every webhook being tried again
+// after a restart.
+type Client struct {
+	clock      clock.Clock
+	httpClient *http.Client
+	threshold  int
+	cooldown   time.Duration
+
+	breakers map[string]*breaker
+	// onStateChange is called with the key of the IPPool whose webhook is
+	// given up on, or works again
+	onStateChange func(ipPoolKey string)
+	mutex         sync.Mutex
+}
+
+func NewClient(clock clock.Clock, threshold int, cooldown time.Duration) *Client {
+	return &Client{
+		clock: clock,
+		httpClient: &http.Client{
+			Timeout: MaxTimeout,
+			// A redirect could lead the token anywhere, past the
+			// allowed URLs
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		threshold: threshold,
+		cooldown:  cooldown,
+		breakers:  make(map[string]*breaker),
+	}
+}
+
+// SetTransport sets the transport the webhooks are asked with, e.g., to trust
+// a private CA.
+func (c *Client) SetTransport(transport http.RoundTripper) {
+	c.httpClient.Transport = transport
+}
+
+// OnStateChange sets the function called with the key of the IPPool whose
+// webhook is given up on, or works again.
+func (c *Client) OnStateChange(f func(ipPoolKey string)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onStateChange = f
+}
+
+// Unavailable tells whether the webhook of the IPPool is given up on, along
+// with the last error it failed with. It stays so during the trials following
+// the cooldown until one of them succeeds.
+func (c *Client) Unavailable(ipPoolKey string) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	b, ok := c.breakers[ipPoolKey]
+	if !ok || b.failures < c.threshold {
+		return false, nil
+	}
+	return true, b.lastErr
+}
+
+// Forget drops the state of the webhook of the IPPool, once it's deleted or
+// no longer has one.
+func (c *Client) Forget(ipPoolKey string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.breakers, ipPoolKey)
+}
+
+// Allocate asks the webhook of the IPPool for the IP address to allocate. The
+// answer is only taken once accepted by validate, which allocates it, and
+// counts as a failure otherwise.
+func (c *Client) Allocate(ctx context.Context, ipPoolKey string, endpoint Endpoint, request Request, validate func(ip string) error) (string, error) {
+	if !c.allow(ipPoolKey) {
+		return "", ErrUnavailable
+	}
+
+	request.Operation = OperationAllocate
+	var response Response
+	err := c.post(ctx, endpoint, request, &response)
+	if err == nil && response.IPAddress == "" {
+		err = errors.New("external ipam answered no ip address")
+	}
+	if err == nil {
+		if validateErr := validate(response.IPAddress); validateErr != nil {
+			err = fmt.Errorf("external ipam answered ip %s: %w", response.IPAddress, validateErr)
+		}
+	}
+	c.record(ipPoolKey, err)
+	if err != nil {
+		return "", err
+	}
+
+	return response.IPAddress, nil
+}
+
+// Release tells the webhook of the IPPool about the IP address released.
+func (c *Client) Release(ctx context.Context, ipPoolKey string, endpoint Endpoint, request Request) error {
+	if !c.allow(ipPoolKey) {
+		return ErrUnavailable
+	}
+
+	request.Operation = OperationRelease
+	err := c.post(ctx, endpoint, request, nil)
+	c.record(ipPoolKey, err)
+	return err
+}
+
+// allow tells whether the webhook of the IPPool may be asked, which it may
+// unless given up on within the cooldown.
+func (c *Client) allow(ipPoolKey string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	b, ok := c.breakers[ipPoolKey]
+	if !ok || b.failures < c.threshold {
+		return true
+	}
+	return c.clock.Since(b.openedAt) >= c.cooldown
+}
+
+// record counts the outcome of a request to the webhook of the IPPool. A
+// failure past the threshold starts the cooldown over.
+func (c *Client) record(ipPoolKey string, err error) {
+	c.mutex.Lock()
+	b, ok := c.breakers[ipPoolKey]
+	if !ok {
+		b = &breaker{}
+		c.breakers[ipPoolKey] = b
+	}
+
+	wasOpen := b.failures >= c.threshold
+	if err != nil {
+		b.failures++
+		b.lastErr = err
+		if b.failures >= c.threshold {
+			b.openedAt = c.clock.Now()
+		}
+	} else {
+		b.failures = 0
+		b.lastErr = nil
+	}
+	changed := wasOpen != (b.failures >= c.threshold)
+	onStateChange := c.onStateChange
+	c.mutex.Unlock()
+
+	if changed && onStateChange != nil {
+		onStateChange(ipPoolKey)
+	}
+}
+
+func (c *Client) post(ctx context.Context, endpoint Endpoint, request Request, response *Response) error {
+	timeout := endpoint.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	if timeout > MaxTimeout {
+		timeout = MaxTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if endpoint.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+endpoint.Token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("external ipam answered %s to %s", resp.Status, request.Operation)
+	}
+	if response == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("external ipam answered an invalid body to %s: %w", request.Operation, err)
+	}
+
+	return nil
+}
+
+// CheckURL makes sure the URL of a webhook is an https one starting with one
+// of the allowed URLs, which are set by the admin. The host has to match as a
+// whole, and the path of the allowed URL is a prefix of the path of the
+// webhook. No allowed URL means no webhook may be asked.
+func CheckURL(rawURL string, allowed []string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %w", rawURL, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("url %q is not an absolute https one", rawURL)
+	}
+
+	for _, allowedURL := range allowed {
+		a, err := url.Parse(allowedURL)
+		if err != nil || a.Scheme != "https" {
+			continue
+		}
+		if !strings.EqualFold(a.Host, u.Host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(a.Path, "/")
+		if u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("url %q is not allowed for external ipams", rawURL)
+}
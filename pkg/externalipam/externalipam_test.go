@@ -0,0 +1,309 @@
+package externalipam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+const testKey = "default/net-1"
+
+var testNow = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var testRequest = Request{
+	IPPool:      testKey,
+	NetworkName: "default/net-1",
+	CIDR:        "192.168.0.0/24",
+	MACAddress:  "11:22:33:44:55:66",
+	VmNetCfg:    "default/vm-1",
+	VMName:      "vm-1",
+}
+
+func acceptAll(string) error { return nil }
+
+// fakeIPAM is an external IPAM recording the requests it's sent and answering
+// them with handle.
+type fakeIPAM struct {
+	handle func(w http.ResponseWriter, request Request)
+
+	requests []Request
+	headers  []http.Header
+	mutex    sync.Mutex
+}
+
+func (f *fakeIPAM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request Request
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	f.requests = append(f.requests, request)
+	f.headers = append(f.headers, r.Header.Clone())
+	f.mutex.Unlock()
+
+	f.handle(w, request)
+}
+
+func answer(ip string) func(http.ResponseWriter, Request) {
+	return func(w http.ResponseWriter, _ Request) {
+		_ = json.NewEncoder(w).Encode(Response{IPAddress: ip})
+	}
+}
+
+func newTestServer(t *testing.T, handle func(http.ResponseWriter, Request)) (*fakeIPAM, Endpoint) {
+	fake := &fakeIPAM{handle: handle}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, Endpoint{URL: server.URL, Token: "token-1", Timeout: time.Second}
+}
+
+func TestClient_Allocate(t *testing.T) {
+	t.Run("request carries the context and the token", func(t *testing.T) {
+		fake, endpoint := newTestServer(t, answer("192.168.0.10"))
+		client := NewClient(clock.NewFakeClock(testNow), DefaultFailureThreshold, DefaultCooldown)
+
+		request := testRequest
+		request.IPAddress = "192.168.0.20"
+		ip, err := client.Allocate(context.Background(), testKey, endpoint, request, acceptAll)
+		require.NoError(t, err)
+		assert.Equal(t, "192.168.0.10", ip)
+
+		require.Len(t, fake.requests, 1)
+		expected := request
+		expected.Operation = OperationAllocate
+		assert.Equal(t, expected, fake.requests[0])
+		assert.Equal(t, "Bearer token-1", fake.headers[0].Get("Authorization"))
+	})
+
+	t.Run("request schema", func(t *testing.T) {
+		var body map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			_, _ = w.Write([]byte(`{"ipAddress":"192.168.0.10"}`))
+		}))
+		defer server.Close()
+		endpoint := Endpoint{URL: server.URL}
+		client := NewClient(clock.NewFakeClock(testNow), DefaultFailureThreshold, DefaultCooldown)
+
+		_, err := client.Allocate(context.Background(), testKey, endpoint, testRequest, acceptAll)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{
+			"operation":   "Allocate",
+			"ipPool":      "default/net-1",
+			"networkName": "default/net-1",
+			"cidr":        "192.168.0.0/24",
+			"macAddress":  "11:22:33:44:55:66",
+			"vmNetCfg":    "default/vm-1",
+			"vmName":      "vm-1",
+		}, body)
+	})
+
+	t.Run("no token without auth secret", func(t *testing.T) {
+		fake, endpoint := newTestServer(t, answer("192.168.0.10"))
+		endpoint.Token = ""
+		client := NewClient(clock.NewFakeClock(testNow), DefaultFailureThreshold, DefaultCooldown)
+
+		_, err := client.Allocate(context.Background(), testKey, endpoint, testRequest, acceptAll)
+		require.NoError(t, err)
+		assert.Empty(t, fake.headers[0].Get("Authorization"))
+	})
+
+	tests := []struct {
+		name     string
+		handle   func(http.ResponseWriter, Request)
+		validate func(string) error
+		timeout  time.Duration
+		errMsg   string
+	}{
+		{
+			name: "error status",
+			handle: func(w http.ResponseWriter, _ Request) {
+				http.Error(w, "boom", http.StatusInternalServerError)
+			},
+			errMsg: "external ipam answered 500 Internal Server Error to Allocate",
+		},
+		{
+			name: "invalid body",
+			handle: func(w http.ResponseWriter, _ Request) {
+				_, _ = w.Write([]byte("not json"))
+			},
+			errMsg: "external ipam answered an invalid body to Allocate",
+		},
+		{
+			name:   "no ip address",
+			handle: answer(""),
+			errMsg: "external ipam answered no ip address",
+		},
+		{
+			name:   "rejected ip address",
+			handle: answer("10.0.0.1"),
+			validate: func(ip string) error {
+				return fmt.Errorf("ip %s is not in the pool", ip)
+			},
+			errMsg: "external ipam answered ip 10.0.0.1: ip 10.0.0.1 is not in the pool",
+		},
+		{
+			name: "timeout",
+			handle: func(w http.ResponseWriter, _ Request) {
+				time.Sleep(200 * time.Millisecond)
+			},
+			timeout: 50 * time.Millisecond,
+			errMsg:  "context deadline exceeded",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, endpoint := newTestServer(t, tc.handle)
+			if tc.timeout > 0 {
+				endpoint.Timeout = tc.timeout
+			}
+			validate := tc.validate
+			if validate == nil {
+				validate = acceptAll
+			}
+			client := NewClient(clock.NewFakeClock(testNow), DefaultFailureThreshold, DefaultCooldown)
+
+			_, err := client.Allocate(context.Background(), testKey, endpoint, testRequest, validate)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.errMsg)
+		})
+	}
+}
+
+func TestClient_Release(t *testing.T) {
+	fake, endpoint := newTestServer(t, func(w http.ResponseWriter, _ Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	client := NewClient(clock.NewFakeClock(testNow), DefaultFailureThreshold, DefaultCooldown)
+
+	request := testRequest
+	request.IPAddress = "192.168.0.10"
+	require.NoError(t, client.Release(context.Background(), testKey, endpoint, request))
+
+	require.Len(t, fake.requests, 1)
+	expected := request
+	expected.Operation = OperationRelease
+	assert.Equal(t, expected, fake.requests[0])
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	failing := true
+	fake, endpoint := newTestServer(t, func(w http.ResponseWriter, request Request) {
+		if failing {
+			http.Error(w, "boom", http.StatusServiceUnavailable)
+			return
+		}
+		answer("192.168.0.10")(w, request)
+	})
+	fakeClock := clock.NewFakeClock(testNow)
+	client := NewClient(fakeClock, 3, time.Minute)
+
+	var changes []string
+	client.OnStateChange(func(ipPoolKey string) {
+		changes = append(changes, ipPoolKey)
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Allocate(context.Background(), testKey, endpoint, testRequest, acceptAll)
+		require.Error(t, err)
+	}
+	unavailable, lastErr := client.Unavailable(testKey)
+	assert.True(t, unavailable)
+	assert.EqualError(t, lastErr, "external ipam answered 503 Service Unavailable to Allocate")
+	assert.Equal(t, []string{testKey}, changes)
+
+	// Given up on within the cooldown, without asking
+	_, err := client.Allocate(context.Background(), testKey, endpoint, testRequest, acceptAll)
+	assert.True(t, errors.Is(err, ErrUnavailable))
+	assert.True(t, errors.Is(client.Release(context.Background(), testKey, endpoint, testRequest), ErrUnavailable))
+	assert.Len(t, fake.requests, 3)
+
+	// Other IPPools aren't affected
+	unavailable, _ = client.Unavailable("default/net-2")
+	assert.False(t, unavailable)
+
+	// A failed trial after the cooldown starts it over
+	fakeClock.Step(time.Minute)
+	_, err = client.Allocate(context.Background(), testKey, endpoint, testRequest, acceptAll)
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ErrUnavailable))
+	_, err = client.Allocate(context.Background(), testKey, endpoint, testRequest, acceptAll)
+	assert.True(t, errors.Is(err, ErrUnavailable))
+	assert.Equal(t, []string{testKey}, changes)
+
+	// A successful one closes it
+	failing = false
+	fakeClock.Step(time.Minute)
+	ip, err := client.Allocate(context.Background(), testKey, endpoint, testRequest, acceptAll)
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.0.10", ip)
+	unavailable, _ = client.Unavailable(testKey)
+	assert.False(t, unavailable)
+	assert.Equal(t, []string{testKey, testKey}, changes)
+}
+
+func TestClient_NoRedirect(t *testing.T) {
+	var redirected bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+	client := NewClient(clock.NewFakeClock(testNow), DefaultFailureThreshold, DefaultCooldown)
+
+	_, err := client.Allocate(context.Background(), testKey, Endpoint{URL: server.URL, Token: "token-1"}, testRequest, acceptAll)
+	assert.EqualError(t, err, "external ipam answered 307 Temporary Redirect to Allocate")
+	assert.False(t, redirected, "the token should not follow the redirect")
+}
+
+func TestCheckURL(t *testing.T) {
+	allowed := []string{"https://ipam.example.com/vm-dhcp", "https://netbox.example.com"}
+
+	tests := []struct {
+		url string
+		err string
+	}{
+		{url: "https://ipam.example.com/vm-dhcp"},
+		{url: "https://IPAM.example.com/vm-dhcp/allocate"},
+		{url: "https://netbox.example.com/api/ipam"},
+		{url: "http://ipam.example.com/vm-dhcp", err: `url "http://ipam.example.com/vm-dhcp" is not an absolute https one`},
+		{url: "/vm-dhcp", err: `url "/vm-dhcp" is not an absolute https one`},
+		{url: "https://ipam.example.com/vm-dhcp-other", err: `url "https://ipam.example.com/vm-dhcp-other" is not allowed for external ipams`},
+		{url: "https://ipam.example.com.evil.io/vm-dhcp", err: `url "https://ipam.example.com.evil.io/vm-dhcp" is not allowed for external ipams`},
+		{url: "https://10.0.0.1/vm-dhcp", err: `url "https://10.0.0.1/vm-dhcp" is not allowed for external ipams`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.url, func(t *testing.T) {
+			err := CheckURL(tc.url, allowed)
+			if tc.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+
+	assert.Error(t, CheckURL("https://ipam.example.com/vm-dhcp", nil), "no allowed url should allow nothing")
+}
@@ -0,0 +1,251 @@
+// Package featuregate resolves which of the optional behaviors of the
+// controller and the webhook are turned on. Each gate is set by the
+// --feature-gates flag of the component, or else by the feature gates
+// ConfigMap shared by all the components, or else falls back to its default.
+// Setting the gates in the ConfigMap keeps the controller and the webhook
+// from disagreeing about them.
+package featuregate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// ConfigMapName is the ConfigMap, in the namespace of the components,
+	// setting the gates, e.g., CNIIPAM: "true"
+	ConfigMapName = "vm-dhcp-feature-gates"
+	// DefaultSyncInterval is how often the ConfigMap is read again
+	DefaultSyncInterval = 10 * time.Second
+
+	EnabledMetricName = "vm_dhcp_feature_enabled"
+	LabelFeature      = "feature"
+)
+
+// Feature is the name of a feature gate.
+type Feature string
+
+const (
+	// CNIIPAM serves the allocations of containers as CNI IPAM results from
+	// the controller, and has the webhook admit the
+	// VirtualMachineNetworkConfigs recording them.
+	CNIIPAM Feature = "CNIIPAM"
+	// LeaseReclaim gives back the leases held by VMs of deleted namespaces.
+	LeaseReclaim Feature = "LeaseReclaim"
+)
+
+type Stage string
+
+const (
+	Alpha Stage = "Alpha"
+	Beta  Stage = "Beta"
+	GA    Stage = "GA"
+)
+
+// Spec is the default state and the maturity of a feature.
+type Spec struct {
+	Default     bool
+	Stage       Stage
+	Description string
+}
+
+var features = map[Feature]Spec{
+	CNIIPAM: {
+		Default:     false,
+		Stage:       Alpha,
+		Description: "Serve the allocations of containers as CNI IPAM results",
+	},
+	LeaseReclaim: {
+		Default:     true,
+		Stage:       Beta,
+		Description: "Reclaim the leases held by VMs of deleted namespaces",
+	},
+}
+
+// Source tells where the state of a gate comes from.
+type Source string
+
+const (
+	SourceDefault   Source = "default"
+	SourceConfigMap Source = "configmap"
+	SourceFlag      Source = "flag"
+)
+
+// Status is the resolved state of a gate.
+type Status struct {
+	Name        Feature `json:"name"`
+	Enabled     bool    `json:"enabled"`
+	Default     bool    `json:"default"`
+	Source      Source  `json:"source"`
+	Stage       Stage   `json:"stage"`
+	Description string  `json:"description"`
+}
+
+// Gates holds the gates set by the flag and by the ConfigMap. A nil Gates
+// has every gate in its default state.
+type Gates struct {
+	flags     map[Feature]bool
+	configMap map[Feature]bool
+	mutex     sync.RWMutex
+
+	desc *prometheus.Desc
+}
+
+// New returns the gates set by the --feature-gates flag, given as gate names
+// and boolean values. Unknown gates and invalid values are rejected, as they
+// are typos the operator wants to hear about right away.
+func New(flags map[string]string) (*Gates, error) {
+	parsed, errs := parse(flags)
+	if len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+
+	return &Gates{
+		flags:     parsed,
+		configMap: make(map[Feature]bool),
+		desc: prometheus.NewDesc(
+			EnabledMetricName,
+			"Whether the feature gate is enabled (1) or not (0)",
+			[]string{LabelFeature},
+			nil,
+		),
+	}, nil
+}
+
+func parse(values map[string]string) (map[Feature]bool, []error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parsed := make(map[Feature]bool, len(values))
+	var errs []error
+	for _, name := range names {
+		value := values[name]
+		feature := Feature(name)
+		if _, ok := features[feature]; !ok {
+			errs = append(errs, fmt.Errorf("unknown feature gate %q", name))
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q of feature gate %s", value, name))
+			continue
+		}
+		parsed[feature] = enabled
+	}
+	return parsed, errs
+}
+
+// SetFromConfigMap replaces the gates set by the ConfigMap with data. Unknown
+// gates and invalid values are left out rather than failing the component,
+// so a typo in the ConfigMap doesn't take down the controller and the webhook
+// alike.
+func (g *Gates) SetFromConfigMap(data map[string]string) {
+	parsed, errs := parse(data)
+	for _, err := range errs {
+		logrus.Warnf("(featuregate.SetFromConfigMap) ignore %s in configmap %s", err.Error(), ConfigMapName)
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.configMap = parsed
+}
+
+// Enabled reports whether the feature is turned on.
+func (g *Gates) Enabled(feature Feature) bool {
+	enabled, _ := g.resolve(feature)
+	return enabled
+}
+
+func (g *Gates) resolve(feature Feature) (bool, Source) {
+	if g == nil {
+		return features[feature].Default, SourceDefault
+	}
+
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	if enabled, ok := g.flags[feature]; ok {
+		return enabled, SourceFlag
+	}
+	if enabled, ok := g.configMap[feature]; ok {
+		return enabled, SourceConfigMap
+	}
+	return features[feature].Default, SourceDefault
+}
+
+// List returns the resolved state of every gate, sorted by name.
+func (g *Gates) List() []Status {
+	result := make([]Status, 0, len(features))
+	for feature, spec := range features {
+		enabled, source := g.resolve(feature)
+		result = append(result, Status{
+			Name:        feature,
+			Enabled:     enabled,
+			Default:     spec.Default,
+			Source:      source,
+			Stage:       spec.Stage,
+			Description: spec.Description,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Sync reads the gates from the ConfigMap. A missing ConfigMap sets none.
+func (g *Gates) Sync(ctx context.Context, configMaps typedcorev1.ConfigMapInterface) error {
+	configMap, err := configMaps.Get(ctx, ConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		g.SetFromConfigMap(nil)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot get configmap %s: %w", ConfigMapName, err)
+	}
+
+	g.SetFromConfigMap(configMap.Data)
+	return nil
+}
+
+// Run reads the gates from the ConfigMap every interval until ctx is done.
+// The gates set by the ConfigMap are kept as they are while it can't be
+// read.
+func (g *Gates) Run(ctx context.Context, configMaps typedcorev1.ConfigMapInterface, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := g.Sync(ctx, configMaps); err != nil {
+			logrus.Warnf("(featuregate.Run) %s", err.Error())
+		}
+	}, interval)
+}
+
+func (g *Gates) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+// Collect reports the resolved state of every gate.
+func (g *Gates) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range g.List() {
+		var value float64
+		if status.Enabled {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, value, string(status.Name))
+	}
+}
@@ -0,0 +1,70 @@
+package featuregate
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "harvester-system"
+
+func TestGates_Precedence(t *testing.T) {
+	clientset := k8sfake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: ConfigMapName},
+		Data: map[string]string{
+			string(CNIIPAM):      "true",
+			string(LeaseReclaim): "false",
+			// Ignored rather than failing the components
+			"Unknown": "true",
+		},
+	})
+	configMaps := clientset.CoreV1().ConfigMaps(testNamespace)
+
+	// The flag overrides the ConfigMap, which overrides the defaults
+	gates, err := New(map[string]string{string(LeaseReclaim): "true"})
+	assert.Nil(t, err)
+	assert.False(t, gates.Enabled(CNIIPAM))
+	assert.True(t, gates.Enabled(LeaseReclaim))
+
+	assert.Nil(t, gates.Sync(context.TODO(), configMaps))
+	assert.True(t, gates.Enabled(CNIIPAM), "the configmap should override the default")
+	assert.True(t, gates.Enabled(LeaseReclaim), "the flag should override the configmap")
+	assert.Equal(t, []Status{
+		{Name: CNIIPAM, Enabled: true, Default: false, Source: SourceConfigMap, Stage: Alpha, Description: features[CNIIPAM].Description},
+		{Name: LeaseReclaim, Enabled: true, Default: true, Source: SourceFlag, Stage: Beta, Description: features[LeaseReclaim].Description},
+	}, gates.List())
+
+	// Back to the defaults once the ConfigMap is gone
+	assert.Nil(t, configMaps.Delete(context.TODO(), ConfigMapName, metav1.DeleteOptions{}))
+	assert.Nil(t, gates.Sync(context.TODO(), configMaps))
+	assert.False(t, gates.Enabled(CNIIPAM))
+
+	// No gates at all has every gate in its default state
+	var nilGates *Gates
+	assert.False(t, nilGates.Enabled(CNIIPAM))
+	assert.True(t, nilGates.Enabled(LeaseReclaim))
+}
+
+func TestNew_InvalidFlag(t *testing.T) {
+	_, err := New(map[string]string{"Unknown": "true", string(CNIIPAM): "yes"})
+	assert.EqualError(t, err, `[invalid value "yes" of feature gate CNIIPAM, unknown feature gate "Unknown"]`)
+}
+
+func TestGates_Collect(t *testing.T) {
+	gates, err := New(map[string]string{string(CNIIPAM): "true", string(LeaseReclaim): "false"})
+	assert.Nil(t, err)
+
+	expected := `
+# HELP vm_dhcp_feature_enabled Whether the feature gate is enabled (1) or not (0)
+# TYPE vm_dhcp_feature_enabled gauge
+vm_dhcp_feature_enabled{feature="CNIIPAM"} 1
+vm_dhcp_feature_enabled{feature="LeaseReclaim"} 0
+`
+	assert.Nil(t, testutil.CollectAndCompare(gates, strings.NewReader(expected), EnabledMetricName))
+}
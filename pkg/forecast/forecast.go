@@ -0,0 +1,153 @@
+package forecast
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+const (
+	// DefaultWindow is how far back the allocations and releases of an
+	// IPPool are averaged over at each evaluation.
+	DefaultWindow = time.Hour
+	// DefaultSmoothingPeriod is the time constant of the exponential
+	// smoothing of the rate. A change of the allocation pace is about two
+	// thirds reflected in the rate after that long.
+	DefaultSmoothingPeriod = 24 * time.Hour
+)
+
+// event is an amount of addresses allocated, negative if released, at once.
+type event struct {
+	at    time.Time
+	delta int
+}
+
+type pool struct {
+	events []event
+	// since is when the tracking of the IPPool started
+	since     time.Time
+	evaluated time.Time
+	rate      float64
+	seeded    bool
+}
+
+// Tracker keeps the allocations and releases of each IPPool over a rolling
+// window, and estimates the net rate addresses are allocated at from them. It
+// lives in memory only, the rate being seeded again from the IPPool status
+// after a restart.
+type Tracker struct {
+	clock  clock.Clock
+	window time.Duration
+	period time.Duration
+	pools  map[string]*pool
+	mutex  sync.Mutex
+}
+
+func NewTracker(clock clock.Clock, window, period time.Duration) *Tracker {
+	return &Tracker{
+		clock:  clock,
+		window: window,
+		period: period,
+		pools:  make(map[string]*pool),
+	}
+}
+
+func (t *Tracker) pool(ipPoolKey string) *pool {
+	p, ok := t.pools[ipPoolKey]
+	if !ok {
+		p = &pool{since: t.clock.Now()}
+		t.pools[ipPoolKey] = p
+	}
+	return p
+}
+
+// Record adds the net amount of addresses allocated to the IPPool, negative if
+// released, at the current time.
+func (t *Tracker) Record(ipPoolKey string, delta int) {
+	if delta == 0 {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	p := t.pool(ipPoolKey)
+	p.events = append(p.events, event{at: t.clock.Now(), delta: delta})
+}
+
+// Evaluate returns the net amount of addresses allocated to the IPPool per
+// hour. The average of the window is smoothed exponentially with the rate of
+// the previous evaluation, weighted by the time elapsed since, so bursts are
+// spread out rather than taken for the pace. The first evaluation of an IPPool
+// returns seed, e.g., the rate persisted in its status, as what happened
+// before the tracking started is unknown.
+func (t *Tracker) Evaluate(ipPoolKey string, seed float64) float64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.clock.Now()
+	p := t.pool(ipPoolKey)
+	if !p.seeded {
+		p.seeded = true
+		p.rate = seed
+		p.evaluated = now
+		return p.rate
+	}
+
+	elapsed := now.Sub(p.evaluated)
+	if elapsed <= 0 {
+		return p.rate
+	}
+
+	// Events fallen out of the window are dropped for good
+	start := now.Add(-t.window)
+	i := 0
+	for i < len(p.events) && !p.events[i].at.After(start) {
+		i++
+	}
+	p.events = p.events[i:]
+
+	net := 0
+	for _, e := range p.events {
+		net += e.delta
+	}
+
+	span := min(t.window, now.Sub(p.since))
+	if span > 0 {
+		average := float64(net) / span.Hours()
+		alpha := 1 - math.Exp(-elapsed.Seconds()/t.period.Seconds())
+		p.rate += alpha * (average - p.rate)
+	}
+	p.evaluated = now
+
+	return p.rate
+}
+
+// Forget drops what's tracked of the IPPool.
+func (t *Tracker) Forget(ipPoolKey string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.pools, ipPoolKey)
+}
+
+// Exhaustion returns when the available addresses run out at the net rate per
+// hour, or false if they never do, i.e., the rate is zero or negative.
+func Exhaustion(now time.Time, available int, rate float64) (time.Time, bool) {
+	if rate <= 0 {
+		return time.Time{}, false
+	}
+	if available <= 0 {
+		return now, true
+	}
+
+	hours := float64(available) / rate
+	// Far-off projections are capped rather than overflowing the duration
+	if hours > math.MaxInt64/float64(time.Hour) {
+		return time.Time{}, false
+	}
+
+	return now.Add(time.Duration(hours * float64(time.Hour))), true
+}
@@ -0,0 +1,157 @@
+package forecast
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+const testKey = "default/net-1"
+
+var testNow = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// replay feeds the tracker one allocation history entry per interval, halfway
+// between the evaluations the periodic pass runs every interval, and returns
+// the last rate.
+func replay(tracker *Tracker, fakeClock *clock.FakeClock, interval time.Duration, deltas []int) float64 {
+	var rate float64
+	for _, delta := range deltas {
+		fakeClock.Step(interval / 2)
+		tracker.Record(testKey, delta)
+		fakeClock.Step(interval / 2)
+		rate = tracker.Evaluate(testKey, 0)
+	}
+	return rate
+}
+
+func TestTracker_Evaluate(t *testing.T) {
+	t.Run("first evaluation returns the seed", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(testNow)
+		tracker := NewTracker(fakeClock, DefaultWindow, DefaultSmoothingPeriod)
+
+		tracker.Record(testKey, 100)
+		assert.Equal(t, 1.5, tracker.Evaluate(testKey, 1.5))
+		assert.Equal(t, 1.5, tracker.Evaluate(testKey, 0), "rate should hold without time elapsing")
+	})
+
+	t.Run("steady allocations converge to their rate", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(testNow)
+		tracker := NewTracker(fakeClock, DefaultWindow, DefaultSmoothingPeriod)
+		tracker.Evaluate(testKey, 0)
+
+		// 2 addresses every 5 minutes for a week
+		deltas := make([]int, 7*24*12)
+		for i := range deltas {
+			deltas[i] = 2
+		}
+		rate := replay(tracker, fakeClock, 5*time.Minute, deltas)
+		assert.InDelta(t, 24, rate, 0.5)
+	})
+
+	t.Run("burst is spread out and decays", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(testNow)
+		tracker := NewTracker(fakeClock, DefaultWindow, DefaultSmoothingPeriod)
+		tracker.Evaluate(testKey, 0)
+
+		// 200 addresses at once, then nothing for three days
+		deltas := make([]int, 3*24*12)
+		deltas[0] = 200
+		rate := replay(tracker, fakeClock, 5*time.Minute, deltas[:12])
+		assert.Greater(t, rate, 0.0)
+		assert.Less(t, rate, 200.0/4, "burst shouldn't be taken for the pace")
+
+		peak := rate
+		rate = replay(tracker, fakeClock, 5*time.Minute, deltas[12:])
+		assert.Greater(t, rate, 0.0)
+		assert.Less(t, rate, peak/10, "burst should fade as time goes by")
+	})
+
+	t.Run("recurring bursts average out", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(testNow)
+		tracker := NewTracker(fakeClock, DefaultWindow, DefaultSmoothingPeriod)
+		tracker.Evaluate(testKey, 0)
+
+		// 48 addresses every 4 hours for two weeks, i.e., 12 per hour
+		deltas := make([]int, 14*24*12)
+		for i := 0; i < len(deltas); i += 4 * 12 {
+			deltas[i] = 48
+		}
+		rate := replay(tracker, fakeClock, 5*time.Minute, deltas)
+		assert.InDelta(t, 12, rate, 3)
+	})
+
+	t.Run("releases outpacing allocations turn the rate negative", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(testNow)
+		tracker := NewTracker(fakeClock, DefaultWindow, DefaultSmoothingPeriod)
+		tracker.Evaluate(testKey, 5)
+
+		deltas := make([]int, 7*24*12)
+		for i := range deltas {
+			deltas[i] = 1
+			if i%2 == 0 {
+				deltas[i] = -3
+			}
+		}
+		rate := replay(tracker, fakeClock, 5*time.Minute, deltas)
+		assert.Less(t, rate, 0.0)
+	})
+
+	t.Run("forgotten ippool is seeded again", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(testNow)
+		tracker := NewTracker(fakeClock, DefaultWindow, DefaultSmoothingPeriod)
+		tracker.Evaluate(testKey, 3)
+		replay(tracker, fakeClock, 5*time.Minute, []int{10, 10})
+
+		tracker.Forget(testKey)
+		assert.Equal(t, 0.0, tracker.Evaluate(testKey, 0))
+	})
+}
+
+func TestExhaustion(t *testing.T) {
+	testCases := []struct {
+		name               string
+		available          int
+		rate               float64
+		expectedKnown      bool
+		expectedExhaustion time.Time
+	}{
+		{
+			name:               "positive rate",
+			available:          100,
+			rate:               4,
+			expectedKnown:      true,
+			expectedExhaustion: testNow.Add(25 * time.Hour),
+		},
+		{
+			name:      "zero rate",
+			available: 100,
+		},
+		{
+			name:      "negative rate",
+			available: 100,
+			rate:      -2,
+		},
+		{
+			name:               "nothing left",
+			rate:               1,
+			expectedKnown:      true,
+			expectedExhaustion: testNow,
+		},
+		{
+			name:      "too far off",
+			available: 1 << 30,
+			rate:      1e-9,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			exhaustion, known := Exhaustion(testNow, tc.available, tc.rate)
+			assert.Equal(t, tc.expectedKnown, known)
+			assert.Equal(t, tc.expectedExhaustion, exhaustion)
+		})
+	}
+}
@@ -31,6 +31,8 @@ func init() {
 }
 
 type Interface interface {
+	ConfigMap() ConfigMapController
+	Namespace() NamespaceController
 	Node() NodeController
 	Pod() PodController
 }
@@ -45,6 +47,14 @@ type version struct {
 	controllerFactory controller.SharedControllerFactory
 }
 
+func (v *version) ConfigMap() ConfigMapController {
+	return generic.NewController[*v1.ConfigMap, *v1.ConfigMapList](schema.GroupVersionKind{Group: "", Version: "v1", Kind: "ConfigMap"}, "configmaps", true, v.controllerFactory)
+}
+
+func (v *version) Namespace() NamespaceController {
+	return generic.NewNonNamespacedController[*v1.Namespace, *v1.NamespaceList](schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Namespace"}, "namespaces", v.controllerFactory)
+}
+
 func (v *version) Node() NodeController {
 	return generic.NewNonNamespacedController[*v1.Node, *v1.NodeList](schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Node"}, "nodes", v.controllerFactory)
 }
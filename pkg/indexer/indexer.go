@@ -6,6 +6,16 @@ import (
 
 const (
 	VmNetCfgByNetworkIndex = "network.harvesterhci.io/vmnetcfg-by-network"
+	// VmNetCfgByMACIndex is served by util.VmNetCfgByMAC, which normalizes the
+	// MAC addresses with util.NormalizeMAC
+	VmNetCfgByMACIndex = "network.harvesterhci.io/vmnetcfg-by-mac"
+	// VmNetCfgByQualifiedNetworkIndex is served by
+	// util.VmNetCfgByQualifiedNetwork, which qualifies the network names
+	// given without a namespace
+	VmNetCfgByQualifiedNetworkIndex = "network.harvesterhci.io/vmnetcfg-by-qualified-network"
+	// VmNetCfgByNetworkMACIndex is served by util.VmNetCfgByNetworkMAC, whose
+	// keys are built by util.NetworkMACKey
+	VmNetCfgByNetworkMACIndex = "network.harvesterhci.io/vmnetcfg-by-network-mac"
 )
 
 func VmNetCfgByNetwork(obj *networkv1.VirtualMachineNetworkConfig) ([]string, error) {
@@ -11,7 +11,7 @@ func NewIPAllocatorBuilder() *IPAllocatorBuilder {
 }
 
 func (b *IPAllocatorBuilder) IPSubnet(name, cidr, start, end string) *IPAllocatorBuilder {
-	_ = b.ipAllocator.NewIPSubnet(name, cidr, start, end)
+	_ = b.ipAllocator.NewIPSubnet(name, cidr, start, end, false)
 	return b
 }
 
@@ -22,6 +22,18 @@ func (b *IPAllocatorBuilder) Revoke(name string, ipAddressList ...string) *IPAll
 	return b
 }
 
+func (b *IPAllocatorBuilder) Reserve(name string, ipAddressList ...string) *IPAllocatorBuilder {
+	for _, ip := range ipAddressList {
+		_ = b.ipAllocator.ReserveIP(name, ip)
+	}
+	return b
+}
+
+func (b *IPAllocatorBuilder) HoldBack(name, start, end string) *IPAllocatorBuilder {
+	_ = b.ipAllocator.HoldBack(name, start, end)
+	return b
+}
+
 func (b *IPAllocatorBuilder) Allocate(name string, ipAddressList ...string) *IPAllocatorBuilder {
 	for _, ip := range ipAddressList {
 		_, _ = b.ipAllocator.AllocateIP(name, ip)
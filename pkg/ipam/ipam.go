@@ -1,21 +1,47 @@
 package ipam
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"math/bits"
 	"net"
 	"net/netip"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	// ErrExhausted is returned when no IP address is left in the network.
+	ErrExhausted = errors.New("no more ip addresses left")
+	// ErrAlreadyAllocated is returned when the designated IP address is
+	// already taken.
+	ErrAlreadyAllocated = errors.New("already allocated")
+)
+
+// maxIPv6RangeSize bounds the amount of addresses of IPv6 ranges. The IPAM
+// keeps track of each address of the range, and a /64 alone has 2^64 of them.
+const maxIPv6RangeSize = 1 << 20
+
 type IPSubnet struct {
 	ipNet     *net.IPNet
 	start     net.IP
 	end       net.IP
 	broadcast net.IP
 	ips       map[string]bool
+	// reserved are the IP addresses only allocated when designated
+	reserved map[string]bool
+	// heldBack are the IP addresses only allocated when designated or once
+	// the other ones are exhausted
+	heldBack map[string]bool
+
+	// allowNetworkBroadcast lets the network and broadcast addresses be
+	// allocated like any other
+	allowNetworkBroadcast bool
 }
 
 type IPAllocator struct {
@@ -33,17 +59,24 @@ func NewIPAllocator() *IPAllocator {
 	}
 }
 
-func (a *IPAllocator) NewIPSubnet(name, cidr, start, end string) error {
-	// Calculate the broadcast IP address
+// NewIPSubnet initializes the network name with the range from start to end of
+// cidr. The broadcast address can't end the range unless allowNetworkBroadcast
+// is set. IPv6 has no broadcast address, so any address of an IPv6 cidr may
+// end the range, which is limited to maxIPv6RangeSize addresses though.
+func (a *IPAllocator) NewIPSubnet(name, cidr, start, end string, allowNetworkBroadcast bool) error {
 	ip, ipNet, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return err
 	}
-	ipv4 := ip.To4()
-	mask := ipNet.Mask
-	broadcast := make(net.IP, 4)
-	for i, octet := range ipv4 {
-		broadcast[i] = octet | ^mask[i]
+
+	// Calculate the broadcast IP address of IPv4 subnets
+	var broadcast net.IP
+	if ipv4 := ip.To4(); ipv4 != nil {
+		mask := ipNet.Mask
+		broadcast = make(net.IP, 4)
+		for i, octet := range ipv4 {
+			broadcast[i] = octet | ^mask[i]
+		}
 	}
 
 	startIP := net.ParseIP(start)
@@ -68,22 +101,38 @@ func (a *IPAllocator) NewIPSubnet(name, cidr, start, end string) error {
 		return fmt.Errorf("end ip address %s is less than start ip address %s", end, start)
 	}
 
-	if endIP.Equal(broadcast) {
+	if !allowNetworkBroadcast && broadcast != nil && endIP.Equal(broadcast) {
 		return fmt.Errorf("end ip address %s equals broadcast ip address %s", end, broadcast.String())
 	}
 
+	if broadcast == nil && exceedsRangeSize(startAddr, endAddr, maxIPv6RangeSize) {
+		return fmt.Errorf("range from %s to %s has more than %d ip addresses", start, end, maxIPv6RangeSize)
+	}
+
 	// Expand the map of allocated IP addresses ranging from the start to end IP address
 	ips := make(map[string]bool)
 	for ip := startAddr; endAddr.Compare(ip.Prev()) > 0; ip = ip.Next() {
 		ips[ip.Unmap().String()] = false
 	}
 
+	// IPv4 addresses are kept in their 4-byte form
+	if startIPv4 := startIP.To4(); startIPv4 != nil {
+		startIP = startIPv4
+	}
+	if endIPv4 := endIP.To4(); endIPv4 != nil {
+		endIP = endIPv4
+	}
+
 	ipSubnet := IPSubnet{
 		ipNet:     ipNet,
-		start:     startIP.To4(),
-		end:       endIP.To4(),
+		start:     startIP,
+		end:       endIP,
 		broadcast: broadcast,
 		ips:       ips,
+		reserved:  make(map[string]bool),
+		heldBack:  make(map[string]bool),
+
+		allowNetworkBroadcast: allowNetworkBroadcast,
 	}
 
 	a.ipam[name] = ipSubnet
@@ -91,6 +140,15 @@ func (a *IPAllocator) NewIPSubnet(name, cidr, start, end string) error {
 	return nil
 }
 
+// exceedsRangeSize tells whether the range from start to end, start not being
+// after end, has more than size addresses, without walking it.
+func exceedsRangeSize(start, end netip.Addr, size uint64) bool {
+	s, e := start.As16(), end.As16()
+	lo, borrow := bits.Sub64(binary.BigEndian.Uint64(e[8:]), binary.BigEndian.Uint64(s[8:]), 0)
+	hi, _ := bits.Sub64(binary.BigEndian.Uint64(e[:8]), binary.BigEndian.Uint64(s[:8]), borrow)
+	return hi != 0 || lo >= size
+}
+
 func (a *IPAllocator) DeleteIPSubnet(name string) {
 	delete(a.ipam, name)
 }
@@ -126,30 +184,102 @@ func (a *IPAllocator) AllocateIP(name string, ipAddress string) (string, error)
 			)
 		}
 
-		if a.ipam[name].broadcast.Equal(designatedIP) {
+		if !a.ipam[name].allowNetworkBroadcast && a.ipam[name].broadcast != nil && a.ipam[name].broadcast.Equal(designatedIP) {
 			return net.IPv4zero.String(), fmt.Errorf("designated ip %s equals broadcast ip address %s", designatedIP.String(), a.ipam[name].broadcast.String())
 		}
 	}
 
+	var heldBackIP string
 	for ip, isAllocated := range a.ipam[name].ips {
 		if !designatedIP.IsUnspecified() {
 			if ip == designatedIP.String() {
 				if isAllocated {
-					return net.IPv4zero.String(), fmt.Errorf("designated ip %s is already allocated", designatedIP.String())
+					return net.IPv4zero.String(), fmt.Errorf("designated ip %s is %w", designatedIP.String(), ErrAlreadyAllocated)
 				} else {
 					a.ipam[name].ips[ip] = true
 					return ip, nil
 				}
 			}
 		} else {
-			if !isAllocated {
+			if !isAllocated && !a.ipam[name].reserved[ip] {
+				if a.ipam[name].heldBack[ip] {
+					heldBackIP = ip
+					continue
+				}
 				a.ipam[name].ips[ip] = true
 				return ip, nil
 			}
 		}
 	}
 
-	return net.IPv4zero.String(), fmt.Errorf("no more ip addresses left in network %s ipam", name)
+	if heldBackIP != "" {
+		return a.allocateHeldBack(name, heldBackIP), nil
+	}
+
+	return net.IPv4zero.String(), fmt.Errorf("%w in network %s ipam", ErrExhausted, name)
+}
+
+// allocateHeldBack allocates the held-back IP address, which only happens once
+// the other IP addresses of the network are exhausted.
+func (a *IPAllocator) allocateHeldBack(name, ip string) string {
+	logrus.Warnf("ipam[%s] ip addresses left are held back, allocating held-back ip %s", name, ip)
+	a.ipam[name].ips[ip] = true
+	return ip
+}
+
+// AllocateIPByMAC allocates the IP address indexed by a hash of the MAC address
+// within the range of the network. If it's taken or revoked, the next free one
+// is allocated instead, wrapping around at the end of the range. The same MAC
+// address thus gets the same IP address as long as it's free.
+func (a *IPAllocator) AllocateIPByMAC(name, macAddress string) (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// Sanity check
+	if _, exists := a.ipam[name]; !exists {
+		return "", fmt.Errorf("network %s does not exist", name)
+	}
+
+	hwAddr := []byte(strings.ToLower(macAddress))
+	if mac, err := net.ParseMAC(macAddress); err == nil {
+		hwAddr = mac
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write(hwAddr)
+
+	if len(a.ipam[name].start) != net.IPv4len {
+		return "", fmt.Errorf("network %s is not an ipv4 one", name)
+	}
+
+	start := binary.BigEndian.Uint32(a.ipam[name].start)
+	size := binary.BigEndian.Uint32(a.ipam[name].end) - start + 1
+	index := hash.Sum32() % size
+
+	var heldBackIP string
+	for i := uint32(0); i < size; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, start+(index+i)%size)
+		isAllocated, exists := a.ipam[name].ips[ip.String()]
+		if !exists || isAllocated || a.ipam[name].reserved[ip.String()] {
+			continue
+		}
+		if a.ipam[name].heldBack[ip.String()] {
+			// The first one past the hash, so it's still the same one for
+			// the same MAC address
+			if heldBackIP == "" {
+				heldBackIP = ip.String()
+			}
+			continue
+		}
+		a.ipam[name].ips[ip.String()] = true
+		return ip.String(), nil
+	}
+
+	if heldBackIP != "" {
+		return a.allocateHeldBack(name, heldBackIP), nil
+	}
+
+	return net.IPv4zero.String(), fmt.Errorf("%w in network %s ipam", ErrExhausted, name)
 }
 
 func (a *IPAllocator) DeallocateIP(name, ipAddress string) error {
@@ -191,6 +321,120 @@ func (a *IPAllocator) RevokeIP(name, ipAddress string) error {
 	return nil
 }
 
+// RestoreIP puts a revoked IP address back into the network as allocatable.
+// IP addresses outside of the range of the network are ignored.
+func (a *IPAllocator) RestoreIP(name, ipAddress string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// Sanity check
+	if _, exists := a.ipam[name]; !exists {
+		return fmt.Errorf("network %s does not exist", name)
+	}
+
+	ipAddr, err := netip.ParseAddr(ipAddress)
+	if err != nil {
+		return err
+	}
+	startAddr, _ := netip.AddrFromSlice(a.ipam[name].start)
+	endAddr, _ := netip.AddrFromSlice(a.ipam[name].end)
+	if ipAddr.Compare(startAddr) < 0 || ipAddr.Compare(endAddr) > 0 {
+		return nil
+	}
+
+	if _, exists := a.ipam[name].ips[ipAddr.String()]; !exists {
+		a.ipam[name].ips[ipAddr.String()] = false
+	}
+
+	return nil
+}
+
+// ReserveIP keeps the IP address for the allocations designating it, so it's
+// never picked when any IP address will do. IP addresses of the subnet outside
+// of the range are added to the network for the purpose.
+func (a *IPAllocator) ReserveIP(name, ipAddress string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// Sanity check
+	if _, exists := a.ipam[name]; !exists {
+		return fmt.Errorf("network %s does not exist", name)
+	}
+
+	ipAddr, err := netip.ParseAddr(ipAddress)
+	if err != nil {
+		return err
+	}
+	ipAddr = ipAddr.Unmap()
+	ip := net.IP(ipAddr.AsSlice())
+
+	ipSubnet := a.ipam[name]
+	if !ipSubnet.ipNet.Contains(ip) {
+		return fmt.Errorf("reserved ip %s is not in subnet %s", ipAddress, ipSubnet.ipNet.String())
+	}
+	if !ipSubnet.allowNetworkBroadcast && (ipSubnet.ipNet.IP.Equal(ip) || ipSubnet.broadcast.Equal(ip)) {
+		return fmt.Errorf("reserved ip %s is the network or broadcast ip address of subnet %s", ipAddress, ipSubnet.ipNet.String())
+	}
+
+	if _, exists := ipSubnet.ips[ipAddr.String()]; !exists {
+		ipSubnet.ips[ipAddr.String()] = false
+	}
+	ipSubnet.reserved[ipAddr.String()] = true
+
+	return nil
+}
+
+// HoldBack keeps the IP addresses of the range from start to end, both
+// included, for the allocations designating them, unless the other IP
+// addresses of the network are exhausted. IP addresses outside of the range
+// of the network are ignored.
+func (a *IPAllocator) HoldBack(name, start, end string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// Sanity check
+	if _, exists := a.ipam[name]; !exists {
+		return fmt.Errorf("network %s does not exist", name)
+	}
+
+	startAddr, err := netip.ParseAddr(start)
+	if err != nil {
+		return err
+	}
+	endAddr, err := netip.ParseAddr(end)
+	if err != nil {
+		return err
+	}
+	startAddr, endAddr = startAddr.Unmap(), endAddr.Unmap()
+	if startAddr.Compare(endAddr) > 0 {
+		return fmt.Errorf("held-back end ip %s is less than start ip %s", end, start)
+	}
+
+	ipSubnet := a.ipam[name]
+	rangeStart, _ := netip.AddrFromSlice(ipSubnet.start)
+	rangeEnd, _ := netip.AddrFromSlice(ipSubnet.end)
+	if startAddr.Compare(rangeStart) < 0 {
+		startAddr = rangeStart
+	}
+	if endAddr.Compare(rangeEnd) > 0 {
+		endAddr = rangeEnd
+	}
+	for ip := startAddr; ip.IsValid() && ip.Compare(endAddr) <= 0; ip = ip.Next() {
+		ipSubnet.heldBack[ip.String()] = true
+	}
+
+	return nil
+}
+
+// IsHeldBack tells whether the IP address is held back in the network.
+func (a *IPAllocator) IsHeldBack(name, ipAddress string) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	ipSubnet, exists := a.ipam[name]
+	return exists && ipSubnet.heldBack[ipAddress]
+}
+
 func (a *IPAllocator) IsAllocated(name, ipAddress string) (bool, error) {
 	a.mutex.RLock()
 	defer a.mutex.RUnlock()
@@ -241,8 +485,9 @@ func (a *IPAllocator) GetAvailable(name string) (int, error) {
 		return available, fmt.Errorf("network %s does not exist", name)
 	}
 
-	for _, isAllocated := range a.ipam[name].ips {
-		if !isAllocated {
+	// Reserved IP addresses aren't available to anyone but their owners
+	for ip, isAllocated := range a.ipam[name].ips {
+		if !isAllocated && !a.ipam[name].reserved[ip] {
 			available++
 		}
 	}
@@ -1,7 +1,9 @@
 package ipam
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -136,6 +138,7 @@ func TestIPAM(t *testing.T) {
 			testIPSubnets[i].cidr,
 			testIPSubnets[i].start,
 			testIPSubnets[i].end,
+			false,
 		); got != testIPSubnets[i].want {
 			if got == nil || testIPSubnets[i].want == nil {
 				t.Errorf("got %q, wanted %q", got, testIPSubnets[i].want)
@@ -293,3 +296,239 @@ func TestIPAM(t *testing.T) {
 		t.Errorf("got %q", got)
 	}
 }
+
+func TestIPAM_RestoreIP(t *testing.T) {
+	ti := New()
+	name := "default/network-restore"
+	if err := ti.NewIPSubnet(name, "192.168.0.0/24", "192.168.0.10", "192.168.0.12", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ti.RevokeIP(name, "192.168.0.11"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ti.IsAllocated(name, "192.168.0.11"); err == nil {
+		t.Errorf("revoked ip 192.168.0.11 is still in the network")
+	}
+
+	if err := ti.RestoreIP(name, "192.168.0.11"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ti.IsAllocated(name, "192.168.0.11"); err != nil || got {
+		t.Errorf("got %t, %v, wanted restored ip 192.168.0.11 to be allocatable", got, err)
+	}
+
+	// Restoring an allocated ip keeps it allocated
+	if _, err := ti.AllocateIP(name, "192.168.0.11"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ti.RestoreIP(name, "192.168.0.11"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ti.IsAllocated(name, "192.168.0.11"); !got {
+		t.Errorf("restored ip 192.168.0.11 lost its allocation")
+	}
+
+	// Out of range ips are ignored
+	if err := ti.RestoreIP(name, "192.168.0.100"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ti.IsAllocated(name, "192.168.0.100"); err == nil {
+		t.Errorf("out of range ip 192.168.0.100 was restored")
+	}
+}
+
+func TestIPAM_AllocateIPByMAC(t *testing.T) {
+	name := "default/network-hashed"
+	newAllocator := func() *IPAllocator {
+		return NewIPAllocatorBuilder().
+			IPSubnet(name, "192.168.0.0/24", "192.168.0.10", "192.168.0.19").Build()
+	}
+
+	ti := newAllocator()
+	want, err := ti.AllocateIPByMAC(name, "11:22:33:44:55:66")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same MAC address gets the same ip address, whatever its notation
+	if got, err := newAllocator().AllocateIPByMAC(name, "11-22-33-44-55-66"); err != nil || got != want {
+		t.Errorf("got %s, %v, wanted %s", got, err, want)
+	}
+	if err := ti.DeallocateIP(name, want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ti.AllocateIPByMAC(name, "11:22:33:44:55:66"); err != nil || got != want {
+		t.Errorf("got %s, %v, wanted %s once released", got, err, want)
+	}
+
+	// A taken ip address makes way for the next free one
+	ti = NewIPAllocatorBuilder().
+		IPSubnet(name, "192.168.0.0/24", "192.168.0.10", "192.168.0.19").
+		Allocate(name, want).Build()
+	got, err := ti.AllocateIPByMAC(name, "11:22:33:44:55:66")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == want {
+		t.Errorf("got allocated ip %s", got)
+	}
+	if allocated, err := ti.IsAllocated(name, got); err != nil || !allocated {
+		t.Errorf("got %t, %v, wanted %s to be allocated", allocated, err, got)
+	}
+
+	// Revoked ip addresses are skipped until the network is exhausted
+	ti = NewIPAllocatorBuilder().
+		IPSubnet(name, "192.168.0.0/24", "192.168.0.10", "192.168.0.11").
+		Revoke(name, "192.168.0.10").Build()
+	if got, err := ti.AllocateIPByMAC(name, "11:22:33:44:55:66"); err != nil || got != "192.168.0.11" {
+		t.Errorf("got %s, %v, wanted 192.168.0.11", got, err)
+	}
+	if _, err := ti.AllocateIPByMAC(name, "22:33:44:55:66:77"); !errors.Is(err, ErrExhausted) {
+		t.Errorf("got %v, wanted %v", err, ErrExhausted)
+	}
+}
+
+func TestIPAM_ReserveIP(t *testing.T) {
+	name := "default/network-reserved"
+	ti := NewIPAllocatorBuilder().
+		IPSubnet(name, "192.168.0.0/24", "192.168.0.10", "192.168.0.11").
+		Reserve(name, "192.168.0.10").Build()
+
+	// Reserved ip addresses are never picked when any will do
+	if got, err := ti.AllocateIP(name, ""); err != nil || got != "192.168.0.11" {
+		t.Errorf("got %s, %v, wanted 192.168.0.11", got, err)
+	}
+	if _, err := ti.AllocateIP(name, ""); !errors.Is(err, ErrExhausted) {
+		t.Errorf("got %v, wanted %v", err, ErrExhausted)
+	}
+	if _, err := ti.AllocateIPByMAC(name, "11:22:33:44:55:66"); !errors.Is(err, ErrExhausted) {
+		t.Errorf("got %v, wanted %v", err, ErrExhausted)
+	}
+	if available, err := ti.GetAvailable(name); err != nil || available != 0 {
+		t.Errorf("got %d, %v, wanted 0 available", available, err)
+	}
+
+	// but are when designated
+	if got, err := ti.AllocateIP(name, "192.168.0.10"); err != nil || got != "192.168.0.10" {
+		t.Errorf("got %s, %v, wanted 192.168.0.10", got, err)
+	}
+
+	// Reserved ip addresses of the subnet outside of the range are added
+	if err := ti.ReserveIP(name, "192.168.0.100"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ti.AllocateIP(name, "192.168.0.100"); err != nil || got != "192.168.0.100" {
+		t.Errorf("got %s, %v, wanted 192.168.0.100", got, err)
+	}
+
+	for _, ip := range []string{"192.168.1.10", "192.168.0.0", "192.168.0.255"} {
+		if err := ti.ReserveIP(name, ip); err == nil {
+			t.Errorf("got no error reserving %s", ip)
+		}
+	}
+}
+
+func TestIPAM_HoldBack(t *testing.T) {
+	name := "default/network-held-back"
+	heldBack := map[string]bool{"192.168.0.13": true, "192.168.0.14": true}
+	ti := NewIPAllocatorBuilder().
+		IPSubnet(name, "192.168.0.0/24", "192.168.0.10", "192.168.0.14").
+		HoldBack(name, "192.168.0.13", "192.168.0.20").Build()
+
+	// Held-back ip addresses are avoided until the rest of the range is full
+	for i := 0; i < 3; i++ {
+		got, err := ti.AllocateIP(name, "")
+		if err != nil || heldBack[got] {
+			t.Errorf("got %s, %v, wanted an ip address which isn't held back", got, err)
+		}
+	}
+	if available, err := ti.GetAvailable(name); err != nil || available != 2 {
+		t.Errorf("got %d, %v, wanted 2 available", available, err)
+	}
+
+	// and then spilled into
+	got, err := ti.AllocateIP(name, "")
+	if err != nil || !heldBack[got] || !ti.IsHeldBack(name, got) {
+		t.Errorf("got %s, %v, wanted a held-back ip address", got, err)
+	}
+
+	// The other one is still allocatable when designated
+	other := "192.168.0.13"
+	if got == other {
+		other = "192.168.0.14"
+	}
+	if got, err := ti.AllocateIP(name, other); err != nil || got != other {
+		t.Errorf("got %s, %v, wanted %s", got, err, other)
+	}
+	if _, err := ti.AllocateIP(name, ""); !errors.Is(err, ErrExhausted) {
+		t.Errorf("got %v, wanted %v", err, ErrExhausted)
+	}
+
+	// The hashed allocation avoids them as well
+	hashed := NewIPAllocatorBuilder().
+		IPSubnet(name, "192.168.0.0/24", "192.168.0.10", "192.168.0.14").
+		HoldBack(name, "192.168.0.13", "192.168.0.14").Build()
+	for i, macAddress := range []string{"11:22:33:44:55:66", "22:33:44:55:66:77", "33:44:55:66:77:88", "44:55:66:77:88:99"} {
+		got, err := hashed.AllocateIPByMAC(name, macAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 3 && hashed.IsHeldBack(name, got) {
+			t.Errorf("got held-back %s for %s, wanted one which isn't held back", got, macAddress)
+		}
+		if i == 3 && !hashed.IsHeldBack(name, got) {
+			t.Errorf("got %s for %s, wanted a held-back one", got, macAddress)
+		}
+	}
+
+	if err := ti.HoldBack(name, "192.168.0.14", "192.168.0.13"); err == nil {
+		t.Errorf("got no error holding back a reversed range")
+	}
+}
+
+func TestIPAM_AllowNetworkBroadcast(t *testing.T) {
+	ti := New()
+	name := "default/network-overlay"
+	if err := ti.NewIPSubnet(name, "192.168.0.0/24", "192.168.0.0", "192.168.0.255", true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []string{"192.168.0.0", "192.168.0.255"} {
+		if got, err := ti.AllocateIP(name, ip); err != nil || got != ip {
+			t.Errorf("got %q, %v, wanted %s to be allocatable", got, err, ip)
+		}
+	}
+	if used, err := ti.GetUsed(name); err != nil || used != 2 {
+		t.Errorf("got %d, %v, wanted 2 used", used, err)
+	}
+
+	// Without the toggle the broadcast address stays out of the range
+	if err := ti.NewIPSubnet("default/network-class-c", "192.168.0.0/24", "192.168.0.0", "192.168.0.255", false); err == nil {
+		t.Errorf("broadcast ip 192.168.0.255 was accepted as the end of the range")
+	}
+}
+
+func TestIPAM_IPv6(t *testing.T) {
+	ti := New()
+	name := "default/network-v6"
+
+	// The all-ones address isn't a broadcast one
+	if err := ti.NewIPSubnet(name, "2001:db8::/120", "2001:db8::f0", "2001:db8::ff", false); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ti.AllocateIP(name, "2001:db8::ff"); err != nil || got != "2001:db8::ff" {
+		t.Errorf("got %q, %v, wanted 2001:db8::ff to be allocatable", got, err)
+	}
+	if got, err := ti.AllocateIP(name, ""); err != nil || !strings.HasPrefix(got, "2001:db8::f") {
+		t.Errorf("got %q, %v, wanted an address of the range", got, err)
+	}
+	if _, err := ti.AllocateIPByMAC(name, "11:22:33:44:55:66"); err == nil {
+		t.Errorf("allocating by mac was accepted in an ipv6 network")
+	}
+
+	// A /64 is never expanded in full
+	if err := ti.NewIPSubnet("default/network-v6-huge", "2001:db8::/64", "2001:db8::", "2001:db8::ffff:ffff:ffff:ffff", false); err == nil {
+		t.Errorf("range of a /64 was accepted")
+	}
+}
@@ -2,11 +2,16 @@ package metrics
 
 import (
 	"net/http"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
 )
 
 var (
@@ -17,16 +22,182 @@ var (
 	LabelMACAddress   = "mac"
 	LabelIPAddress    = "ip"
 	LabelState        = "state"
+	LabelReason       = "reason"
+	LabelOverflowPool = "overflow"
+	LabelController   = "controller"
+	LabelHandler      = "handler"
+	LabelIdentity     = "identity"
+	LabelVMName       = "vm"
+	LabelKind         = "kind"
+)
+
+const (
+	IPPoolPendingAllocationsMetricName         = "vmdhcpcontroller_ippool_pending_allocations"
+	IPPoolPendingAllocationOldestAgeMetricName = "vmdhcpcontroller_ippool_pending_allocation_oldest_age_seconds"
+	IPPoolAllocationDenialsMetricName          = "vmdhcpcontroller_ippool_allocation_denials_total"
+	IPPoolOverflowAllocationsMetricName        = "vmdhcpcontroller_ippool_overflow_allocations_total"
+	ReconcileTimeoutsMetricName                = "vmdhcpcontroller_reconcile_timeouts_total"
+	IPPoolAllocatorRebuildsMetricName          = "vmdhcpcontroller_ippool_allocator_rebuilds_total"
+	IPPoolAllocatorRebuildDurationMetricName   = "vmdhcpcontroller_ippool_allocator_rebuild_duration_seconds"
+	LeaderMetricName                           = "vmdhcpcontroller_leader"
+	IPPoolNetAllocationRateMetricName          = "vmdhcpcontroller_ippool_net_allocation_rate"
+	IPPoolExhaustionTimestampMetricName        = "vmdhcpcontroller_ippool_exhaustion_timestamp_seconds"
+	IPPoolAllocationsMetricName                = "vmdhcpcontroller_ippool_allocations_total"
+	IPPoolAddressesMetricName                  = "vmdhcpcontroller_ippool_addresses"
+	IPPoolAllocationAttemptsMetricName         = "vmdhcpcontroller_ippool_allocation_attempts_total"
+	IPPoolAllocationFailuresMetricName         = "vmdhcpcontroller_ippool_allocation_failures_total"
+	IPPoolAllocationDurationMetricName         = "vmdhcpcontroller_ippool_allocation_duration_seconds"
 )
 
+// The kinds of addresses of an IPPool counted by IPPoolAddressesMetricName
+const (
+	AddressKindTotal     = "total"
+	AddressKindAllocated = "allocated"
+	AddressKindExcluded  = "excluded"
+	AddressKindReserved  = "reserved"
+)
+
+// allocationExemplarWindow is how long the latest allocation of an IPPool is
+// attached as an exemplar after it happened.
+const allocationExemplarWindow = 15 * time.Minute
+
 type MetricsAllocator struct {
-	ipPoolUsed      *prometheus.GaugeVec
-	ipPoolAvailable *prometheus.GaugeVec
-	vmNetCfgStatus  *prometheus.GaugeVec
-	registry        *prometheus.Registry
+	ipPoolUsed       *prometheus.GaugeVec
+	ipPoolAvailable  *prometheus.GaugeVec
+	vmNetCfgStatus   *prometheus.GaugeVec
+	ipPoolMalformed  *prometheus.GaugeVec
+	ipPoolPending    *prometheus.GaugeVec
+	ipPoolPendingAge *pendingAgeCollector
+	ipPoolDenials    *prometheus.CounterVec
+	ipPoolOverflows  *prometheus.CounterVec
+	reconcileTimeout *prometheus.CounterVec
+	ipPoolRebuilds   *prometheus.CounterVec
+	ipPoolRebuildDur *prometheus.HistogramVec
+	leader           *prometheus.GaugeVec
+	ipPoolRate       *prometheus.GaugeVec
+	ipPoolExhaustion *prometheus.GaugeVec
+	ipPoolAddresses  *prometheus.GaugeVec
+	ipPoolAttempts   *prometheus.CounterVec
+	ipPoolFailures   *prometheus.CounterVec
+	ipPoolAllocDur   *prometheus.HistogramVec
+	// ipPoolAllocs is only set once the allocation exemplars are enabled
+	ipPoolAllocs *allocationCollector
+	clock        clock.Clock
+	registry     *prometheus.Registry
+}
+
+// pendingAgeCollector computes the age of the oldest pending allocation of
+// each IPPool at collection time, so the value doesn't go stale between
+// reconciliations.
+type pendingAgeCollector struct {
+	desc   *prometheus.Desc
+	clock  clock.Clock
+	oldest map[string]time.Time
+	mutex  sync.RWMutex
+}
+
+func (c *pendingAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *pendingAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for name, since := range c.oldest {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, c.clock.Since(since).Seconds(), name)
+	}
+}
+
+func (c *pendingAgeCollector) set(name string, since time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if since.IsZero() {
+		delete(c.oldest, name)
+		return
+	}
+	c.oldest[name] = since
+}
+
+// allocationExemplar is the latest allocation of an IPPool.
+type allocationExemplar struct {
+	vmName    string
+	timestamp time.Time
 }
 
-func NewMetricsAllocator() *MetricsAllocator {
+// allocationCollector counts the allocations of each IPPool, and attaches the
+// VM of the latest one as an exemplar while it's recent. Only the IPPools
+// with the most recent allocations, up to limit, get one at each collection,
+// so the exemplars stay bounded however many IPPools there are.
+type allocationCollector struct {
+	desc   *prometheus.Desc
+	clock  clock.Clock
+	limit  int
+	counts map[string]float64
+	latest map[string]allocationExemplar
+	mutex  sync.RWMutex
+}
+
+func (c *allocationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *allocationCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var recent []string
+	for name, latest := range c.latest {
+		if c.clock.Since(latest.timestamp) <= allocationExemplarWindow {
+			recent = append(recent, name)
+		}
+	}
+	sort.Slice(recent, func(i, j int) bool {
+		return c.latest[recent[i]].timestamp.After(c.latest[recent[j]].timestamp)
+	})
+	exemplified := make(map[string]struct{}, c.limit)
+	for _, name := range recent[:min(len(recent), c.limit)] {
+		exemplified[name] = struct{}{}
+	}
+
+	for name, count := range c.counts {
+		metric := prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, count, name)
+		if _, ok := exemplified[name]; ok {
+			latest := c.latest[name]
+			// VM names too long for an exemplar are left out
+			if withExemplar, err := prometheus.NewMetricWithExemplars(metric, prometheus.Exemplar{
+				Value:     1,
+				Labels:    prometheus.Labels{LabelVMName: latest.vmName},
+				Timestamp: latest.timestamp,
+			}); err == nil {
+				metric = withExemplar
+			}
+		}
+		ch <- metric
+	}
+}
+
+func (c *allocationCollector) inc(name, vmName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.counts[name]++
+	c.latest[name] = allocationExemplar{
+		vmName:    vmName,
+		timestamp: c.clock.Now(),
+	}
+}
+
+func (c *allocationCollector) delete(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.counts, name)
+	delete(c.latest, name)
+}
+
+func NewMetricsAllocator(clock clock.Clock) *MetricsAllocator {
 	metricsAllocator := &MetricsAllocator{
 		ipPoolUsed: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
@@ -63,16 +234,218 @@ func NewMetricsAllocator() *MetricsAllocator {
 				LabelState,
 			},
 		),
+		ipPoolMalformed: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "vmdhcpcontroller_ippool_malformed_allocations",
+				Help: "Amount of allocation records which cannot be parsed",
+			},
+			[]string{
+				LabelIPPoolName,
+			},
+		),
+		ipPoolPending: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: IPPoolPendingAllocationsMetricName,
+				Help: "Amount of vmnetcfg objects waiting for an IP address",
+			},
+			[]string{
+				LabelIPPoolName,
+				LabelReason,
+			},
+		),
+		ipPoolPendingAge: &pendingAgeCollector{
+			clock: clock,
+			desc: prometheus.NewDesc(
+				IPPoolPendingAllocationOldestAgeMetricName,
+				"Seconds the oldest vmnetcfg object has been waiting for an IP address",
+				[]string{LabelIPPoolName},
+				nil,
+			),
+			oldest: make(map[string]time.Time),
+		},
+		ipPoolDenials: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: IPPoolAllocationDenialsMetricName,
+				Help: "Amount of allocation attempts which were denied",
+			},
+			[]string{
+				LabelIPPoolName,
+				LabelReason,
+			},
+		),
+		ipPoolOverflows: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: IPPoolOverflowAllocationsMetricName,
+				Help: "Amount of IP addresses allocated from an overflow IPPool as the IPPool was exhausted",
+			},
+			[]string{
+				LabelIPPoolName,
+				LabelOverflowPool,
+			},
+		),
+		reconcileTimeout: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: ReconcileTimeoutsMetricName,
+				Help: "Amount of reconciles which ran longer than the reconcile timeout",
+			},
+			[]string{
+				LabelController,
+				LabelHandler,
+			},
+		),
+		ipPoolRebuilds: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: IPPoolAllocatorRebuildsMetricName,
+				Help: "Amount of times the IPAM of the IPPool was built from its spec and status",
+			},
+			[]string{
+				LabelIPPoolName,
+			},
+		),
+		ipPoolRebuildDur: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    IPPoolAllocatorRebuildDurationMetricName,
+				Help:    "Seconds it took to build the IPAM of the IPPool",
+				Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+			},
+			[]string{
+				LabelIPPoolName,
+			},
+		),
+		leader: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: LeaderMetricName,
+				Help: "Whether the controller instance holds the leader lease",
+			},
+			[]string{
+				LabelIdentity,
+			},
+		),
+		ipPoolRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: IPPoolNetAllocationRateMetricName,
+				Help: "Smoothed amount of addresses allocated from the IPPool per hour, net of the ones released",
+			},
+			[]string{
+				LabelIPPoolName,
+			},
+		),
+		ipPoolExhaustion: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: IPPoolExhaustionTimestampMetricName,
+				Help: "When the IPPool runs out of addresses at its net allocation rate, as a Unix timestamp; absent while the rate is zero or negative",
+			},
+			[]string{
+				LabelIPPoolName,
+			},
+		),
+		ipPoolAddresses: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: IPPoolAddressesMetricName,
+				Help: "Amount of IP addresses of the pool range, in total and per kind of allocation entry",
+			},
+			[]string{
+				LabelIPPoolName,
+				LabelKind,
+			},
+		),
+		ipPoolAttempts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: IPPoolAllocationAttemptsMetricName,
+				Help: "Amount of attempts to allocate a new IP address from the IPPool",
+			},
+			[]string{
+				LabelIPPoolName,
+			},
+		),
+		ipPoolFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: IPPoolAllocationFailuresMetricName,
+				Help: "Amount of attempts to allocate a new IP address from the IPPool which failed",
+			},
+			[]string{
+				LabelIPPoolName,
+			},
+		),
+		ipPoolAllocDur: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    IPPoolAllocationDurationMetricName,
+				Help:    "Seconds it took to allocate a new IP address from the IPPool, including the overflow IPPools tried",
+				Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+			},
+			[]string{
+				LabelIPPoolName,
+			},
+		),
 	}
 
+	metricsAllocator.clock = clock
 	metricsAllocator.registry = prometheus.NewRegistry()
 	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolUsed)
 	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolAvailable)
 	metricsAllocator.registry.MustRegister(metricsAllocator.vmNetCfgStatus)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolMalformed)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolPending)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolPendingAge)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolDenials)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolOverflows)
+	metricsAllocator.registry.MustRegister(metricsAllocator.reconcileTimeout)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolRebuilds)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolRebuildDur)
+	metricsAllocator.registry.MustRegister(metricsAllocator.leader)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolRate)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolExhaustion)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolAddresses)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolAttempts)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolFailures)
+	metricsAllocator.registry.MustRegister(metricsAllocator.ipPoolAllocDur)
 
 	return metricsAllocator
 }
 
+// RegisterCollector serves the metrics of a component without a
+// MetricsAllocator of its own along with the ones of the controller.
+func (a *MetricsAllocator) RegisterCollector(collector prometheus.Collector) {
+	a.registry.MustRegister(collector)
+}
+
+// EnableAllocationExemplars has the allocations of each IPPool counted, with
+// the VM of the latest one attached as an exemplar for up to limit IPPools at
+// a time, so the allocation can be correlated with traces. The exemplars are
+// only served to scrapers asking for the OpenMetrics format.
+func (a *MetricsAllocator) EnableAllocationExemplars(limit int) {
+	a.ipPoolAllocs = &allocationCollector{
+		clock: a.clock,
+		limit: limit,
+		desc: prometheus.NewDesc(
+			IPPoolAllocationsMetricName,
+			"Amount of IP addresses allocated from the IPPool, with the VM of the latest allocation as an exemplar while recent",
+			[]string{LabelIPPoolName},
+			nil,
+		),
+		counts: make(map[string]float64),
+		latest: make(map[string]allocationExemplar),
+	}
+	a.registry.MustRegister(a.ipPoolAllocs)
+}
+
+// IncIPPoolAllocations counts an IP address allocated from the IPPool to the
+// VM, given as <namespace>/<name>, if the allocation exemplars are enabled.
+func (a *MetricsAllocator) IncIPPoolAllocations(name, vmName string) {
+	if a.ipPoolAllocs == nil {
+		return
+	}
+	a.ipPoolAllocs.inc(name, vmName)
+}
+
+// DeleteIPPoolAllocations drops the allocations counted for the IPPool.
+func (a *MetricsAllocator) DeleteIPPoolAllocations(name string) {
+	if a.ipPoolAllocs == nil {
+		return
+	}
+	a.ipPoolAllocs.delete(name)
+}
+
 func (a *MetricsAllocator) UpdateIPPoolUsed(name string, cidr string, networkName string, used int) {
 	a.ipPoolUsed.With(prometheus.Labels{
 		LabelIPPoolName:  name,
@@ -89,18 +462,170 @@ func (a *MetricsAllocator) UpdateIPPoolAvailable(name string, cidr string, netwo
 	}).Set(float64(available))
 }
 
-func (a *MetricsAllocator) DeleteIPPool(name string, cidr string, networkName string) {
-	a.ipPoolUsed.Delete(prometheus.Labels{
-		LabelIPPoolName:  name,
-		LabelCIDR:        cidr,
-		LabelNetworkName: networkName,
+// DeleteIPPool drops the metrics of the IPPool, whatever CIDR and network
+// they were last labeled with.
+func (a *MetricsAllocator) DeleteIPPool(name string) {
+	a.ipPoolUsed.DeletePartialMatch(prometheus.Labels{
+		LabelIPPoolName: name,
 	})
 
-	a.ipPoolAvailable.Delete(prometheus.Labels{
-		LabelIPPoolName:  name,
-		LabelCIDR:        cidr,
-		LabelNetworkName: networkName,
+	a.ipPoolAvailable.DeletePartialMatch(prometheus.Labels{
+		LabelIPPoolName: name,
 	})
+
+	a.ipPoolMalformed.Delete(prometheus.Labels{
+		LabelIPPoolName: name,
+	})
+
+	a.ipPoolPending.DeletePartialMatch(prometheus.Labels{
+		LabelIPPoolName: name,
+	})
+	a.ipPoolPendingAge.set(name, time.Time{})
+
+	a.ipPoolDenials.DeletePartialMatch(prometheus.Labels{
+		LabelIPPoolName: name,
+	})
+
+	a.ipPoolOverflows.DeletePartialMatch(prometheus.Labels{
+		LabelIPPoolName: name,
+	})
+	a.ipPoolOverflows.DeletePartialMatch(prometheus.Labels{
+		LabelOverflowPool: name,
+	})
+
+	a.ipPoolRebuilds.Delete(prometheus.Labels{
+		LabelIPPoolName: name,
+	})
+	a.ipPoolRebuildDur.Delete(prometheus.Labels{
+		LabelIPPoolName: name,
+	})
+
+	a.ipPoolAddresses.DeletePartialMatch(prometheus.Labels{
+		LabelIPPoolName: name,
+	})
+	a.ipPoolAttempts.Delete(prometheus.Labels{
+		LabelIPPoolName: name,
+	})
+	a.ipPoolFailures.Delete(prometheus.Labels{
+		LabelIPPoolName: name,
+	})
+	a.ipPoolAllocDur.Delete(prometheus.Labels{
+		LabelIPPoolName: name,
+	})
+}
+
+// UpdateIPPoolAddresses records the amount of IP addresses of the IPPool of
+// each kind, keyed by the AddressKind constants.
+func (a *MetricsAllocator) UpdateIPPoolAddresses(name string, addresses map[string]int) {
+	for kind, count := range addresses {
+		a.ipPoolAddresses.With(prometheus.Labels{
+			LabelIPPoolName: name,
+			LabelKind:       kind,
+		}).Set(float64(count))
+	}
+}
+
+// ObserveIPPoolAllocation counts an attempt to allocate a new IP address from
+// the IPPool along with how long it took, and whether it failed.
+func (a *MetricsAllocator) ObserveIPPoolAllocation(name string, duration time.Duration, failed bool) {
+	labels := prometheus.Labels{
+		LabelIPPoolName: name,
+	}
+	a.ipPoolAttempts.With(labels).Inc()
+	if failed {
+		a.ipPoolFailures.With(labels).Inc()
+	}
+	a.ipPoolAllocDur.With(labels).Observe(duration.Seconds())
+}
+
+func (a *MetricsAllocator) UpdateIPPoolMalformed(name string, malformed int) {
+	a.ipPoolMalformed.With(prometheus.Labels{
+		LabelIPPoolName: name,
+	}).Set(float64(malformed))
+}
+
+// UpdateIPPoolPending records the amount of pending allocations of the IPPool
+// per reason and when the oldest one started waiting. A zero oldestSince
+// means nothing is waiting.
+func (a *MetricsAllocator) UpdateIPPoolPending(name string, reasons map[string]int, oldestSince time.Time) {
+	for reason, count := range reasons {
+		a.ipPoolPending.With(prometheus.Labels{
+			LabelIPPoolName: name,
+			LabelReason:     reason,
+		}).Set(float64(count))
+	}
+	a.ipPoolPendingAge.set(name, oldestSince)
+}
+
+// UpdateIPPoolForecast publishes the net allocation rate of the IPPool, per
+// hour, and when it runs out of addresses at that rate. The exhaustion time is
+// dropped when unknown, i.e., the rate is zero or negative.
+func (a *MetricsAllocator) UpdateIPPoolForecast(name string, rate float64, exhaustion time.Time, known bool) {
+	labels := prometheus.Labels{
+		LabelIPPoolName: name,
+	}
+	a.ipPoolRate.With(labels).Set(rate)
+	if !known {
+		a.ipPoolExhaustion.Delete(labels)
+		return
+	}
+	a.ipPoolExhaustion.With(labels).Set(float64(exhaustion.Unix()))
+}
+
+// DeleteIPPoolForecast drops the forecast metrics of the IPPool.
+func (a *MetricsAllocator) DeleteIPPoolForecast(name string) {
+	labels := prometheus.Labels{
+		LabelIPPoolName: name,
+	}
+	a.ipPoolRate.Delete(labels)
+	a.ipPoolExhaustion.Delete(labels)
+}
+
+func (a *MetricsAllocator) IncIPPoolDenials(name, reason string) {
+	a.ipPoolDenials.With(prometheus.Labels{
+		LabelIPPoolName: name,
+		LabelReason:     reason,
+	}).Inc()
+}
+
+// IncIPPoolOverflowAllocations counts an IP address allocated from the
+// overflow IPPool as the IPPool was exhausted.
+func (a *MetricsAllocator) IncIPPoolOverflowAllocations(name, overflowPool string) {
+	a.ipPoolOverflows.With(prometheus.Labels{
+		LabelIPPoolName:   name,
+		LabelOverflowPool: overflowPool,
+	}).Inc()
+}
+
+// ObserveIPPoolAllocatorRebuild counts a build of the IPAM of the IPPool
+// along with how long it took.
+func (a *MetricsAllocator) ObserveIPPoolAllocatorRebuild(name string, duration time.Duration) {
+	labels := prometheus.Labels{
+		LabelIPPoolName: name,
+	}
+	a.ipPoolRebuilds.With(labels).Inc()
+	a.ipPoolRebuildDur.With(labels).Observe(duration.Seconds())
+}
+
+// IncReconcileTimeouts counts a reconcile of the handler of the controller
+// which ran longer than the reconcile timeout.
+func (a *MetricsAllocator) IncReconcileTimeouts(controller, handler string) {
+	a.reconcileTimeout.With(prometheus.Labels{
+		LabelController: controller,
+		LabelHandler:    handler,
+	}).Inc()
+}
+
+// UpdateLeader records whether the controller instance of the identity holds
+// the leader lease.
+func (a *MetricsAllocator) UpdateLeader(identity string, leader bool) {
+	var value float64
+	if leader {
+		value = 1
+	}
+	a.leader.With(prometheus.Labels{
+		LabelIdentity: identity,
+	}).Set(value)
 }
 
 func (a *MetricsAllocator) UpdateVmNetCfgStatus(name, networkName, macAddress, ipAddress, state string) {
@@ -152,11 +677,12 @@ func (a *MetricsAllocator) GetHTTPHandler() http.Handler {
 	return promhttp.HandlerFor(
 		a.registry,
 		promhttp.HandlerOpts{
-			Registry: a.registry,
+			Registry:          a.registry,
+			EnableOpenMetrics: true,
 		},
 	)
 }
 
 func New() *MetricsAllocator {
-	return NewMetricsAllocator()
+	return NewMetricsAllocator(clock.RealClock{})
 }
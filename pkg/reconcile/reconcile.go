@@ -0,0 +1,163 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/metrics"
+)
+
+var (
+	// ErrTimeout tells a reconcile ran past its time limit. The reconcile
+	// isn't aborted but left to finish in the background, while the object is
+	// requeued with backoff.
+	ErrTimeout = errors.New("reconcile timed out")
+
+	// ErrInFlight tells a former reconcile of the object which timed out is
+	// still running, so a new one isn't started next to it.
+	ErrInFlight = errors.New("former reconcile still running")
+)
+
+// Object is what the handlers reconcile.
+type Object interface {
+	runtime.Object
+	GetNamespace() string
+	GetName() string
+}
+
+// Limiter bounds how long the handlers of a controller run on a single
+// object, so a pathological object, e.g., an IPPool with a huge range behind
+// a slow API server, doesn't hold up a worker of the workqueue.
+//
+// The handlers of this repository can't be interrupted midway, as neither the
+// generated clients nor the allocators take a context. Instead, a reconcile
+// running past the limit is left to finish in the background on a copy of
+// the object, and no other reconcile of the object is started until it does.
+// Any mutation it makes is then either committed through the API, which
+// guards against stale writes with resource versions, or not at all, and the
+// handlers pick up from there on the next reconcile as after a crash.
+type Limiter struct {
+	controller       string
+	timeout          time.Duration
+	metricsAllocator *metrics.MetricsAllocator
+
+	inFlight map[string]struct{}
+	mutex    sync.Mutex
+}
+
+// NewLimiter returns a limiter letting the handlers of the controller run for
+// up to timeout per object. It returns nil, which limits nothing, if timeout
+// is zero or less.
+func NewLimiter(controller string, timeout time.Duration, metricsAllocator *metrics.MetricsAllocator) *Limiter {
+	if timeout <= 0 {
+		return nil
+	}
+
+	return &Limiter{
+		controller:       controller,
+		timeout:          timeout,
+		metricsAllocator: metricsAllocator,
+		inFlight:         make(map[string]struct{}),
+	}
+}
+
+// run runs fn for the object under the time limit.
+func (l *Limiter) run(handler, key string, fn func() error) error {
+	l.mutex.Lock()
+	if _, ok := l.inFlight[key]; ok {
+		l.mutex.Unlock()
+		return fmt.Errorf("%s of %s: %w", handler, key, ErrInFlight)
+	}
+	l.inFlight[key] = struct{}{}
+	l.mutex.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			l.mutex.Lock()
+			delete(l.inFlight, key)
+			l.mutex.Unlock()
+		}()
+		done <- fn()
+	}()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		logrus.Warnf("(reconcile.run) %s of %s of controller %s ran longer than %s, requeue", handler, key, l.controller, l.timeout)
+		if l.metricsAllocator != nil {
+			l.metricsAllocator.IncReconcileTimeouts(l.controller, handler)
+		}
+		return fmt.Errorf("%s of %s ran longer than %s: %w", handler, key, l.timeout, ErrTimeout)
+	}
+}
+
+// Handler limits an OnChange or OnRemove handler.
+func Handler[T Object](l *Limiter, name string, handler func(string, T) (T, error)) func(string, T) (T, error) {
+	if l == nil {
+		return handler
+	}
+
+	return func(key string, obj T) (T, error) {
+		var result T
+		objCpy := deepCopy(obj)
+		err := l.run(name, key, func() error {
+			var err error
+			result, err = handler(key, objCpy)
+			return err
+		})
+		if errors.Is(err, ErrTimeout) || errors.Is(err, ErrInFlight) {
+			return obj, err
+		}
+		return result, err
+	}
+}
+
+// StatusHandler limits a status handler. The status of a reconcile running
+// past the limit is dropped, which keeps the one the object has.
+func StatusHandler[T Object, S any](l *Limiter, name string, handler func(T, S) (S, error)) func(T, S) (S, error) {
+	if l == nil {
+		return handler
+	}
+
+	return func(obj T, status S) (S, error) {
+		var result S
+		objCpy := deepCopy(obj)
+		err := l.run(name, key(obj), func() error {
+			var err error
+			result, err = handler(objCpy, status)
+			return err
+		})
+		if errors.Is(err, ErrTimeout) || errors.Is(err, ErrInFlight) {
+			return status, err
+		}
+		return result, err
+	}
+}
+
+// deepCopy gives the handler an object of its own, as the caller goes on
+// using the one it passed once the handler runs past the limit.
+func deepCopy[T Object](obj T) T {
+	var objCpy T
+	// Deleted objects come as nil, which is copied as nil
+	if c, ok := obj.DeepCopyObject().(T); ok {
+		objCpy = c
+	}
+	return objCpy
+}
+
+func key(obj Object) string {
+	if obj.GetNamespace() == "" {
+		return obj.GetName()
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
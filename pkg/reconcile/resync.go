@@ -0,0 +1,52 @@
+package reconcile
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+// ResyncLimiter spreads the resyncs asked for with the resync annotation over
+// time, so a flood of annotations can't keep the workers of a controller busy
+// rebuilding caches.
+type ResyncLimiter struct {
+	limiter *rate.Limiter
+	clock   clock.Clock
+}
+
+// NewResyncLimiter returns a limiter letting a resync run every interval, with
+// bursts of up to burst of them. It returns nil, which limits nothing, if
+// interval is zero or less.
+func NewResyncLimiter(interval time.Duration, burst int, clock clock.Clock) *ResyncLimiter {
+	if interval <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &ResyncLimiter{
+		limiter: rate.NewLimiter(rate.Every(interval), burst),
+		clock:   clock,
+	}
+}
+
+// Wait returns how long a resync has to wait before it may run, taking its
+// turn if it may run right away. A resync held back doesn't take a turn, as
+// the object is enqueued again after the delay.
+func (l *ResyncLimiter) Wait() time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	now := l.clock.Now()
+	reservation := l.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay
+	}
+
+	return 0
+}
@@ -0,0 +1,104 @@
+// Package sdk offers the lookups other components keep doing against the
+// resources of the controller, like finding the IPPool of a network or
+// waiting for the IP addresses of a VM, so they don't have to reimplement
+// them on top of the generated clients.
+//
+// The package follows the semantic versioning of the module: its exported
+// API only changes in backward compatible ways within a major version, while
+// the packages it's built on may change at any time.
+package sdk
+
+import (
+	"context"
+	"net/netip"
+	"sort"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	ctlcniv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/k8s.cni.cncf.io/v1"
+	ctlkubevirtv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/kubevirt.io/v1"
+	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// Client answers the lookups from the caches of the generated controllers.
+type Client struct {
+	nadCache      ctlcniv1.NetworkAttachmentDefinitionCache
+	ippoolCache   ctlnetworkv1.IPPoolCache
+	vmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache
+	vmCache       ctlkubevirtv1.VirtualMachineCache
+}
+
+// New returns a client reading from the given caches. The VirtualMachine
+// cache is optional; without it, the allocations are keyed by MAC address
+// rather than interface name.
+func New(
+	nadCache ctlcniv1.NetworkAttachmentDefinitionCache,
+	ippoolCache ctlnetworkv1.IPPoolCache,
+	vmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache,
+	vmCache ctlkubevirtv1.VirtualMachineCache,
+) *Client {
+	return &Client{
+		nadCache:      nadCache,
+		ippoolCache:   ippoolCache,
+		vmnetcfgCache: vmnetcfgCache,
+		vmCache:       vmCache,
+	}
+}
+
+// Lease is an IP address of an IPPool leased to a MAC address.
+type Lease struct {
+	IPAddress  string
+	MACAddress string
+	// Namespace is the namespace of the VM holding the lease. It's empty for
+	// leases recorded before it was.
+	Namespace string
+}
+
+// ResolvePoolForNetwork returns the IPPool serving the VMs of the namespace
+// attached to the network, given as <namespace>/<name> or, for a network of
+// the namespace itself, <name>. The IPPool is the one the network is labeled
+// with, or the IPPool it delegates to for the namespace.
+func (c *Client) ResolvePoolForNetwork(_ context.Context, networkName, namespace string) (*networkv1.IPPool, error) {
+	return util.GetIPPoolFromNetworkName(c.nadCache, c.ippoolCache, networkName, namespace)
+}
+
+// ListLeases returns the leases of the IPPool sorted by IP address, leaving
+// out the excluded and reserved IP addresses.
+func (c *Client) ListLeases(_ context.Context, namespace, name string) ([]Lease, error) {
+	ipPool, err := c.ippoolCache.Get(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []Lease
+	for ip, entry := range util.AllocationEntries(ipPool.Status.IPv4) {
+		if entry.Type != networkv1.AllocationTypeLease {
+			continue
+		}
+		leases = append(leases, Lease{
+			IPAddress:  ip,
+			MACAddress: entry.Owner,
+			Namespace:  entry.Namespace,
+		})
+	}
+
+	sort.Slice(leases, func(i, j int) bool {
+		return lessIP(leases[i].IPAddress, leases[j].IPAddress)
+	})
+
+	return leases, nil
+}
+
+// lessIP orders IP addresses numerically, with the unparsable ones last.
+func lessIP(a, b string) bool {
+	addrA, errA := netip.ParseAddr(a)
+	addrB, errB := netip.ParseAddr(b)
+	switch {
+	case errA == nil && errB == nil:
+		return addrA.Less(addrB)
+	case errA == nil || errB == nil:
+		return errA == nil
+	default:
+		return a < b
+	}
+}
@@ -0,0 +1,202 @@
+package sdk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/ippool"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/vmnetcfg"
+	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
+)
+
+const (
+	testNamespace   = "default"
+	testNADName     = "net-1"
+	testNetworkName = testNamespace + "/" + testNADName
+	testIPPoolName  = "pool-1"
+	testIPPoolRef   = testNamespace + "/" + testIPPoolName
+	testVMName      = "test-vm"
+	testCIDR        = "192.168.0.0/24"
+	testIPAddress1  = "192.168.0.101"
+	testIPAddress2  = "192.168.0.12"
+	testMACAddress1 = "11:22:33:44:55:66"
+	testMACAddress2 = "22:33:44:55:66:77"
+)
+
+func newTestClient(objects ...runtime.Object) *Client {
+	nad := ippool.NewNetworkAttachmentDefinitionBuilder(testNamespace, testNADName).
+		Label(util.IPPoolNamespaceLabelKey, testNamespace).
+		Label(util.IPPoolNameLabelKey, testIPPoolName).Build()
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	clientset := fake.NewSimpleClientset(objects...)
+	_ = clientset.Tracker().Create(nadGVR, nad, nad.Namespace)
+
+	return New(
+		fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+		fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+		fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		fakeclient.VirtualMachineCache(clientset.KubevirtV1().VirtualMachines),
+	)
+}
+
+func newTestIPPool() *networkv1.IPPool {
+	return ippool.NewIPPoolBuilder(testNamespace, testIPPoolName).
+		CIDR(testCIDR).
+		NetworkName(testNetworkName).
+		AllocationEntry(testIPAddress1, networkv1.AllocationTypeLease, testMACAddress1).
+		AllocationEntry(testIPAddress2, networkv1.AllocationTypeLease, testMACAddress2).
+		AllocationEntry("192.168.0.50", networkv1.AllocationTypeExcluded, "").Build()
+}
+
+func newTestVM() *kubevirtv1.VirtualMachine {
+	return &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: testNamespace,
+			Name:      testVMName,
+		},
+		Spec: kubevirtv1.VirtualMachineSpec{
+			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+				Spec: kubevirtv1.VirtualMachineInstanceSpec{
+					Domain: kubevirtv1.DomainSpec{
+						Devices: kubevirtv1.Devices{
+							Interfaces: []kubevirtv1.Interface{
+								{Name: "nic-1", MacAddress: testMACAddress1},
+								{Name: "nic-2", MacAddress: "22-33-44-55-66-77"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newTestVmNetCfgBuilder() *vmnetcfg.VmNetCfgBuilder {
+	return vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVMName).
+		WithVMName(testVMName).
+		WithNetworkConfig("", testMACAddress1, testNetworkName).
+		WithNetworkConfig("", testMACAddress2, testNetworkName)
+}
+
+func TestClient_ResolvePoolForNetwork(t *testing.T) {
+	c := newTestClient(newTestIPPool())
+
+	ipPool, err := c.ResolvePoolForNetwork(context.TODO(), testNADName, testNamespace)
+	assert.Nil(t, err)
+	assert.Equal(t, testIPPoolName, ipPool.Name)
+
+	_, err = c.ResolvePoolForNetwork(context.TODO(), testNamespace+"/net-2", testNamespace)
+	assert.NotNil(t, err, "network without an ippool should not resolve")
+}
+
+func TestClient_ListLeases(t *testing.T) {
+	c := newTestClient(newTestIPPool())
+
+	leases, err := c.ListLeases(context.TODO(), testNamespace, testIPPoolName)
+	assert.Nil(t, err)
+	assert.Equal(t, []Lease{
+		{IPAddress: testIPAddress2, MACAddress: testMACAddress2},
+		{IPAddress: testIPAddress1, MACAddress: testMACAddress1},
+	}, leases)
+}
+
+func TestClient_WaitForAllocation(t *testing.T) {
+	t.Run("allocated", func(t *testing.T) {
+		vmNetCfg := newTestVmNetCfgBuilder().
+			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+			IPPoolRef(testIPPoolRef).
+			WithNetworkConfigStatus(testIPAddress2, testMACAddress2, testNetworkName, networkv1.AllocatedState).
+			IPPoolRef(testIPPoolRef).
+			AllocatedCondition(corev1.ConditionTrue, "", "").Build()
+		c := newTestClient(vmNetCfg, newTestVM())
+
+		allocations, err := c.WaitForAllocation(context.TODO(), testNamespace, testVMName, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]Allocation{
+			"nic-1": {
+				InterfaceName: "nic-1",
+				NetworkName:   testNetworkName,
+				MACAddress:    testMACAddress1,
+				IPAddress:     testIPAddress1,
+				IPPool:        testIPPoolRef,
+			},
+			"nic-2": {
+				InterfaceName: "nic-2",
+				NetworkName:   testNetworkName,
+				MACAddress:    testMACAddress2,
+				IPAddress:     testIPAddress2,
+				IPPool:        testIPPoolRef,
+			},
+		}, allocations)
+	})
+
+	t.Run("allocated without vm", func(t *testing.T) {
+		vmNetCfg := newTestVmNetCfgBuilder().
+			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+			WithNetworkConfigStatus(testIPAddress2, testMACAddress2, testNetworkName, networkv1.AllocatedState).
+			AllocatedCondition(corev1.ConditionTrue, "", "").Build()
+		c := newTestClient(vmNetCfg)
+
+		allocations, err := c.WaitForAllocation(context.TODO(), testNamespace, testVMName, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, testIPAddress1, allocations[testMACAddress1].IPAddress)
+		assert.Equal(t, testIPAddress2, allocations[testMACAddress2].IPAddress)
+	})
+
+	t.Run("network config added since the last allocation", func(t *testing.T) {
+		vmNetCfg := newTestVmNetCfgBuilder().
+			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+			AllocatedCondition(corev1.ConditionTrue, "", "").Build()
+		c := newTestClient(vmNetCfg, newTestVM())
+
+		_, err := c.WaitForAllocation(context.TODO(), testNamespace, testVMName, 10*time.Millisecond)
+		assert.ErrorIs(t, err, ErrNotAllocated)
+		assert.ErrorContains(t, err, "mac address "+testMACAddress2+" not allocated yet")
+	})
+
+	t.Run("out-of-sync", func(t *testing.T) {
+		vmNetCfg := newTestVmNetCfgBuilder().
+			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+			WithNetworkConfigStatus(testIPAddress2, testMACAddress2, testNetworkName, networkv1.AllocatedState).
+			AllocatedCondition(corev1.ConditionTrue, "", "").
+			InSyncedCondition(corev1.ConditionFalse, "", "").Build()
+		c := newTestClient(vmNetCfg, newTestVM())
+
+		_, err := c.WaitForAllocation(context.TODO(), testNamespace, testVMName, 10*time.Millisecond)
+		assert.ErrorIs(t, err, ErrNotAllocated)
+	})
+
+	t.Run("vmnetcfg not created yet", func(t *testing.T) {
+		c := newTestClient(newTestVM())
+
+		_, err := c.WaitForAllocation(context.TODO(), testNamespace, testVMName, 10*time.Millisecond)
+		assert.ErrorIs(t, err, ErrNotAllocated)
+	})
+
+	t.Run("paused", func(t *testing.T) {
+		vmNetCfg := newTestVmNetCfgBuilder().
+			Paused().
+			DisabledCondition(corev1.ConditionTrue, "", "").Build()
+		c := newTestClient(vmNetCfg, newTestVM())
+
+		_, err := c.WaitForAllocation(context.TODO(), testNamespace, testVMName, time.Minute)
+		assert.ErrorIs(t, err, ErrAllocationDisabled)
+	})
+}
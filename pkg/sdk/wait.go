@@ -0,0 +1,166 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// allocationPollInterval is how often WaitForAllocation looks at the
+// VirtualMachineNetworkConfig of the VM.
+const allocationPollInterval = time.Second
+
+var (
+	// ErrNotAllocated tells the IP addresses of the VM weren't all allocated
+	// in time.
+	ErrNotAllocated = errors.New("ip addresses not allocated")
+
+	// ErrAllocationDisabled tells the VirtualMachineNetworkConfig of the VM is
+	// paused, so its IP addresses aren't allocated until it's resumed.
+	ErrAllocationDisabled = errors.New("allocation disabled")
+)
+
+// Allocation is an IP address allocated for an interface of a VM.
+type Allocation struct {
+	InterfaceName string
+	NetworkName   string
+	MACAddress    string
+	IPAddress     string
+	// IPPool is the IPPool the IP address was allocated from, as
+	// <namespace>/<name>.
+	IPPool string
+}
+
+// WaitForAllocation waits until every network config of the
+// VirtualMachineNetworkConfig of the VM has an IP address allocated, and
+// returns them keyed by interface name. Network configs without an interface
+// of the VM, e.g., in VirtualMachineNetworkConfigs created by hand, are keyed
+// by MAC address instead.
+//
+// The allocations are only taken as complete once the controller has caught
+// up with the spec: the VirtualMachineNetworkConfig is in sync, its Allocated
+// condition is true, and the status has an allocated IP address for the MAC
+// address of each network config. It gives up with ErrNotAllocated once the
+// timeout runs out, telling what it was still waiting for, or right away with
+// ErrAllocationDisabled if the VirtualMachineNetworkConfig is paused.
+func (c *Client) WaitForAllocation(ctx context.Context, vmNamespace, vmName string, timeout time.Duration) (map[string]Allocation, error) {
+	var (
+		allocations map[string]Allocation
+		pending     string
+	)
+
+	err := wait.PollUntilContextTimeout(ctx, allocationPollInterval, timeout, true, func(context.Context) (bool, error) {
+		var err error
+		allocations, pending, err = c.getAllocations(vmNamespace, vmName)
+		if err != nil {
+			return false, err
+		}
+		return pending == "", nil
+	})
+	// Still pending means the timeout ran out or ctx was done
+	if err != nil && pending != "" {
+		return nil, fmt.Errorf("vm %s/%s: %w: %s", vmNamespace, vmName, ErrNotAllocated, pending)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return allocations, nil
+}
+
+// getAllocations returns the allocations of the VM once complete. Otherwise,
+// it tells what is still pending.
+func (c *Client) getAllocations(vmNamespace, vmName string) (map[string]Allocation, string, error) {
+	// The VirtualMachineNetworkConfig of a VM shares its name
+	vmNetCfg, err := c.vmnetcfgCache.Get(vmNamespace, vmName)
+	if apierrors.IsNotFound(err) {
+		return nil, "vmnetcfg not created yet", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if networkv1.Disabled.IsTrue(vmNetCfg) {
+		return nil, "", fmt.Errorf("vmnetcfg %s/%s: %w", vmNamespace, vmName, ErrAllocationDisabled)
+	}
+	if networkv1.InSynced.IsFalse(vmNetCfg) {
+		return nil, "vmnetcfg out-of-sync", nil
+	}
+	if networkv1.DeferredAllocation.IsTrue(vmNetCfg) {
+		return nil, "allocation deferred until the vm is started", nil
+	}
+	if !networkv1.Allocated.IsTrue(vmNetCfg) {
+		return nil, "vmnetcfg not allocated yet", nil
+	}
+
+	interfaceNames, err := c.getInterfaceNames(vmNamespace, vmName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	allocations := make(map[string]Allocation, len(vmNetCfg.Spec.NetworkConfigs))
+	for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+		macAddress := util.NormalizeMAC(nc.MACAddress)
+
+		var ncStatus *networkv1.NetworkConfigStatus
+		for i := range vmNetCfg.Status.NetworkConfigs {
+			if util.NormalizeMAC(vmNetCfg.Status.NetworkConfigs[i].MACAddress) == macAddress {
+				ncStatus = &vmNetCfg.Status.NetworkConfigs[i]
+				break
+			}
+		}
+		if ncStatus == nil || ncStatus.State != networkv1.AllocatedState || ncStatus.AllocatedIPAddress == "" {
+			return nil, fmt.Sprintf("mac address %s not allocated yet", nc.MACAddress), nil
+		}
+
+		key, ok := interfaceNames[macAddress]
+		if !ok {
+			key = nc.MACAddress
+		}
+		allocations[key] = Allocation{
+			InterfaceName: interfaceNames[macAddress],
+			NetworkName:   nc.NetworkName,
+			MACAddress:    nc.MACAddress,
+			IPAddress:     ncStatus.AllocatedIPAddress,
+			IPPool:        ncStatus.IPPoolRef,
+		}
+	}
+
+	return allocations, "", nil
+}
+
+// getInterfaceNames returns the names of the interfaces of the VM keyed by
+// their normalized MAC addresses. It returns none without a VM cache or VM.
+func (c *Client) getInterfaceNames(vmNamespace, vmName string) (map[string]string, error) {
+	names := make(map[string]string)
+	if c.vmCache == nil {
+		return names, nil
+	}
+
+	vm, err := c.vmCache.Get(vmNamespace, vmName)
+	if apierrors.IsNotFound(err) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if vm.Spec.Template == nil {
+		return names, nil
+	}
+
+	for _, nic := range vm.Spec.Template.Spec.Domain.Devices.Interfaces {
+		if nic.MacAddress == "" {
+			continue
+		}
+		names[util.NormalizeMAC(nic.MacAddress)] = nic.Name
+	}
+
+	return names, nil
+}
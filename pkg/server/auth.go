@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io"
+)
+
+// ipPoolAuthorizer lets a request through only if its bearer token is
+// authenticated by the API server, and if the user it belongs to may act on
+// the subresource of the IPPool named in the path, as Kubernetes RBAC grants
+// it, e.g., create on ippools/cni.
+type ipPoolAuthorizer struct {
+	client kubernetes.Interface
+}
+
+func newIPPoolAuthorizer(client kubernetes.Interface) *ipPoolAuthorizer {
+	return &ipPoolAuthorizer{
+		client: client,
+	}
+}
+
+// handler serves handler to the requests allowed to verb the subresource of
+// the IPPool {namespace}/{name}, or of all IPPools on paths without them.
+// Requests without a valid token are answered with 401, and the ones whose
+// user isn't allowed with 403.
+func (a *ipPoolAuthorizer) handler(verb, subresource string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vm-dhcp-controller"`)
+			http.Error(w, "bearer token required", http.StatusUnauthorized)
+			return
+		}
+
+		tokenReview, err := a.client.AuthenticationV1().TokenReviews().Create(r.Context(), &authenticationv1.TokenReview{
+			Spec: authenticationv1.TokenReviewSpec{Token: token},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			logrus.Errorf("(server.authorize) failed to review token: %s", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !tokenReview.Status.Authenticated {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vm-dhcp-controller"`)
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		params := mux.Vars(r)
+		user := tokenReview.Status.User
+		extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+		for key, value := range user.Extra {
+			extra[key] = authorizationv1.ExtraValue(value)
+		}
+		accessReview, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(r.Context(), &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:   user.Username,
+				UID:    user.UID,
+				Groups: user.Groups,
+				Extra:  extra,
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   params["namespace"],
+					Name:        params["name"],
+					Verb:        verb,
+					Group:       network.GroupName,
+					Resource:    "ippools",
+					Subresource: subresource,
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			logrus.Errorf("(server.authorize) failed to review access of %s: %s", user.Username, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !accessReview.Status.Allowed {
+			target := "ippools/" + subresource
+			if params["name"] != "" {
+				target += " " + params["namespace"] + "/" + params["name"]
+			}
+			http.Error(w, "user "+user.Username+" cannot "+verb+" "+target, http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testToken    = "valid-token"
+	testUsername = "system:serviceaccount:default:cni-plugin"
+)
+
+func TestIPPoolAuthorizer(t *testing.T) {
+	var reviewed *authorizationv1.ResourceAttributes
+	client := k8sfake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == testToken {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: testUsername}
+		}
+		return true, review, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviewed = review.Spec.ResourceAttributes
+		// Only allowed on the IPPool default/net-1
+		review.Status.Allowed = review.Spec.User == testUsername &&
+			reviewed.Namespace == testIPPoolNamespace && reviewed.Name == testIPPoolName
+		return true, review, nil
+	})
+
+	authorizer := newIPPoolAuthorizer(client)
+	router := mux.NewRouter()
+	router.Handle("/pools/{namespace}/{name}/cni", authorizer.handler("create", "cni", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))).Methods(http.MethodPost)
+
+	testCases := []struct {
+		name           string
+		path           string
+		authorization  string
+		expectedStatus int
+	}{
+		{
+			name:           "no token",
+			path:           "/pools/default/net-1/cni",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "invalid token",
+			path:           "/pools/default/net-1/cni",
+			authorization:  "Bearer invalid-token",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "not a bearer token",
+			path:           "/pools/default/net-1/cni",
+			authorization:  "Basic " + testToken,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "user not allowed on the ippool",
+			path:           "/pools/default/net-2/cni",
+			authorization:  "Bearer " + testToken,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "user allowed on the ippool",
+			path:           "/pools/default/net-1/cni",
+			authorization:  "Bearer " + testToken,
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+		})
+	}
+
+	// The access is reviewed against the subresource of the IPPool
+	assert.Equal(t, &authorizationv1.ResourceAttributes{
+		Namespace:   testIPPoolNamespace,
+		Name:        testIPPoolName,
+		Verb:        "create",
+		Group:       "network.harvesterhci.io",
+		Resource:    "ippools",
+		Subresource: "cni",
+	}, reviewed)
+}
+
+func TestIPPoolAuthorizer_AllIPPools(t *testing.T) {
+	var reviewed *authorizationv1.ResourceAttributes
+	client := k8sfake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		review.Status.Authenticated = review.Spec.Token == testToken
+		review.Status.User = authenticationv1.UserInfo{Username: testUsername}
+		return true, review, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviewed = review.Spec.ResourceAttributes
+		return true, review, nil
+	})
+
+	authorizer := newIPPoolAuthorizer(client)
+	router := mux.NewRouter()
+	router.Handle("/lookup", authorizer.handler("get", "lookup", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))).Methods(http.MethodGet)
+
+	req := httptest.NewRequest(http.MethodGet, "/lookup?mac="+testMACAddress1, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, "user "+testUsername+" cannot get ippools/lookup\n", rec.Body.String())
+	// The access is reviewed against the subresource of all IPPools
+	assert.Equal(t, &authorizationv1.ResourceAttributes{
+		Verb:        "get",
+		Group:       "network.harvesterhci.io",
+		Resource:    "ippools",
+		Subresource: "lookup",
+	}, reviewed)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+const (
+	// cniVersion is the version of the CNI specification the results
+	// conform to
+	cniVersion = "1.0.0"
+	// cniVmNetCfgPrefix prefixes the names of the
+	// VirtualMachineNetworkConfigs holding the allocations of containers
+	cniVmNetCfgPrefix = "cni-"
+)
+
+// cniRequest is the body of a CNI ADD, as sent by an IPAM plugin on behalf
+// of the runtime.
+type cniRequest struct {
+	CNIVersion  string `json:"cniVersion,omitempty"`
+	ContainerID string `json:"containerID"`
+	MACAddress  string `json:"macAddress"`
+}
+
+// cniResult is the IPAM result of the CNI specification, which IPAM plugins
+// can hand over to the runtime as is.
+type cniResult struct {
+	CNIVersion string        `json:"cniVersion"`
+	IPs        []cniIPConfig `json:"ips"`
+	Routes     []cniRoute    `json:"routes,omitempty"`
+	DNS        *cniDNS       `json:"dns,omitempty"`
+}
+
+type cniIPConfig struct {
+	Address string `json:"address"`
+	Gateway string `json:"gateway,omitempty"`
+}
+
+type cniRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+type cniDNS struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Domain      string   `json:"domain,omitempty"`
+	Search      []string `json:"search,omitempty"`
+}
+
+// cniVmNetCfgName returns the name of the VirtualMachineNetworkConfig
+// holding the allocation of the container.
+func cniVmNetCfgName(containerID string) (string, error) {
+	if containerID == "" {
+		return "", fmt.Errorf("container id is required")
+	}
+	name := cniVmNetCfgPrefix + containerID
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", fmt.Errorf("invalid container id %q: %s", containerID, strings.Join(errs, ", "))
+	}
+	return name, nil
+}
+
+// newCNIVmNetCfg returns the VirtualMachineNetworkConfig allocating an IP
+// address of the IPPool to the MAC address of the container. It goes through
+// the same allocation and lease bookkeeping as the ones of VMs.
+func newCNIVmNetCfg(ipPool *networkv1.IPPool, name, containerID, macAddress string) *networkv1.VirtualMachineNetworkConfig {
+	return &networkv1.VirtualMachineNetworkConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: ipPool.Namespace,
+			Name:      name,
+			Annotations: map[string]string{
+				util.CNIContainerIDAnnotationKey: containerID,
+			},
+		},
+		Spec: networkv1.VirtualMachineNetworkConfigSpec{
+			VMName: name,
+			NetworkConfigs: []networkv1.NetworkConfig{
+				{
+					NetworkName: ipPool.Spec.NetworkName,
+					MACAddress:  macAddress,
+				},
+			},
+		},
+	}
+}
+
+// buildCNIResult returns the CNI result of the IP address allocated from the
+// IPPool, along with the router, the static routes and the DNS settings of
+// the IPPool.
+func buildCNIResult(ipPool *networkv1.IPPool, ipAddress string) (*cniResult, error) {
+	ip, err := netip.ParseAddr(ipAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip address %q: %w", ipAddress, err)
+	}
+	prefix, err := netip.ParsePrefix(ipPool.Spec.IPv4Config.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr of ippool %s/%s: %w", ipPool.Namespace, ipPool.Name, err)
+	}
+
+	router := ipPool.Spec.IPv4Config.Router
+	result := &cniResult{
+		CNIVersion: cniVersion,
+		IPs: []cniIPConfig{
+			{
+				Address: netip.PrefixFrom(ip, prefix.Bits()).String(),
+				Gateway: router,
+			},
+		},
+	}
+
+	if router != "" && util.DefaultRouteEnabled(ipPool, nil) {
+		result.Routes = append(result.Routes, cniRoute{Dst: "0.0.0.0/0", GW: router})
+	}
+	for _, route := range ipPool.Spec.IPv4Config.StaticRoutes {
+		result.Routes = append(result.Routes, cniRoute{Dst: route.Destination, GW: route.Gateway})
+	}
+
+	dns := &cniDNS{
+		Nameservers: ipPool.Spec.IPv4Config.DNS,
+		Search:      ipPool.Spec.IPv4Config.DomainSearch,
+	}
+	if ipPool.Spec.IPv4Config.DomainName != nil {
+		dns.Domain = *ipPool.Spec.IPv4Config.DomainName
+	}
+	if len(dns.Nameservers) > 0 || dns.Domain != "" || len(dns.Search) > 0 {
+		result.DNS = dns
+	}
+
+	return result, nil
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/ippool"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/vmnetcfg"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
+	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
+)
+
+const testContainerID = "0f3c2a1b9e8d"
+
+func newTestCNIIPPool() *networkv1.IPPool {
+	return ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+		NetworkName(testNetworkName).
+		CIDR("192.168.0.0/24").
+		Router("192.168.0.1").
+		StaticRoute("10.0.0.0/8", "192.168.0.254").
+		DNS("192.168.0.53").
+		DomainName(testDomainName).
+		DomainSearch(testDomainName).Build()
+}
+
+func TestBuildCNIResult(t *testing.T) {
+	result, err := buildCNIResult(newTestCNIIPPool(), testIPAddress1)
+	assert.Nil(t, err)
+
+	payload, err := json.Marshal(result)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"cniVersion": "1.0.0",
+		"ips": [{"address": "192.168.0.111/24", "gateway": "192.168.0.1"}],
+		"routes": [
+			{"dst": "0.0.0.0/0", "gw": "192.168.0.1"},
+			{"dst": "10.0.0.0/8", "gw": "192.168.0.254"}
+		],
+		"dns": {"nameservers": ["192.168.0.53"], "domain": "example.com", "search": ["example.com"]}
+	}`, string(payload))
+
+	// Neither router nor DNS settings
+	bare := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).CIDR("192.168.0.0/24").Build()
+	result, err = buildCNIResult(bare, testIPAddress1)
+	assert.Nil(t, err)
+	payload, err = json.Marshal(result)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"cniVersion": "1.0.0", "ips": [{"address": "192.168.0.111/24"}]}`, string(payload))
+}
+
+func TestCNIHandlers(t *testing.T) {
+	cniVmNetCfgName := cniVmNetCfgPrefix + testContainerID
+	clientset := fake.NewSimpleClientset(
+		newTestCNIIPPool(),
+		// Allocated by the controller for an earlier ADD
+		vmnetcfg.NewVmNetCfgBuilder(testIPPoolNamespace, cniVmNetCfgName).
+			Annotation(util.CNIContainerIDAnnotationKey, testContainerID).
+			WithVMName(cniVmNetCfgName).
+			WithNetworkConfig("", testMACAddress1, testNetworkName).
+			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+			IPPoolRef(testIPPoolNamespace+"/"+testIPPoolName).
+			AllocatedCondition(corev1.ConditionTrue, "", "").Build(),
+		// A VM happening to be named like the vmnetcfg of a container
+		vmnetcfg.NewVmNetCfgBuilder(testIPPoolNamespace, "cni-vm").
+			WithVMName("cni-vm").
+			WithNetworkConfig("", testMACAddress2, testNetworkName).Build(),
+	)
+	vmnetcfgClient := fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)
+
+	router := mux.NewRouter()
+	router.Handle("/pools/{namespace}/{name}/cni", cniAddHandler(
+		fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		vmnetcfgClient,
+		fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		nil,
+		10*time.Millisecond,
+	)).Methods(http.MethodPost)
+	router.Handle("/pools/{namespace}/{name}/cni/{containerID}", cniDelHandler(vmnetcfgClient)).Methods(http.MethodDelete)
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "allocated container",
+			method:         http.MethodPost,
+			path:           "/pools/default/net-1/cni",
+			body:           `{"cniVersion": "1.0.0", "containerID": "` + testContainerID + `", "macAddress": "11-22-33-44-55-66"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"ips":[{"address":"192.168.0.111/24","gateway":"192.168.0.1"}]`,
+		},
+		{
+			name:           "container not allocated in time",
+			method:         http.MethodPost,
+			path:           "/pools/default/net-1/cni",
+			body:           `{"containerID": "a1b2c3", "macAddress": "` + testMACAddress3 + `"}`,
+			expectedStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:           "same container with another mac address",
+			method:         http.MethodPost,
+			path:           "/pools/default/net-1/cni",
+			body:           `{"containerID": "` + testContainerID + `", "macAddress": "` + testMACAddress3 + `"}`,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "unsupported version",
+			method:         http.MethodPost,
+			path:           "/pools/default/net-1/cni",
+			body:           `{"cniVersion": "0.4.0", "containerID": "` + testContainerID + `", "macAddress": "` + testMACAddress1 + `"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid mac address",
+			method:         http.MethodPost,
+			path:           "/pools/default/net-1/cni",
+			body:           `{"containerID": "` + testContainerID + `", "macAddress": "invalid"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid container id",
+			method:         http.MethodPost,
+			path:           "/pools/default/net-1/cni",
+			body:           `{"containerID": "Not_Valid", "macAddress": "` + testMACAddress1 + `"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "missing ippool",
+			method:         http.MethodPost,
+			path:           "/pools/default/net-2/cni",
+			body:           `{"containerID": "` + testContainerID + `", "macAddress": "` + testMACAddress1 + `"}`,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "vmnetcfg of a vm",
+			method:         http.MethodDelete,
+			path:           "/pools/default/net-1/cni/vm",
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "release container",
+			method:         http.MethodDelete,
+			path:           "/pools/default/net-1/cni/" + testContainerID,
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "release released container",
+			method:         http.MethodDelete,
+			path:           "/pools/default/net-1/cni/" + testContainerID,
+			expectedStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, tc.expectedStatus, rec.Code, "case %q: %s", tc.name, rec.Body.String())
+		if tc.expectedBody != "" {
+			assert.Contains(t, rec.Body.String(), tc.expectedBody, "case %q", tc.name)
+		}
+	}
+
+	// The container not allocated in time keeps its vmnetcfg for the retry
+	created, err := vmnetcfgClient.Get(testIPPoolNamespace, cniVmNetCfgPrefix+"a1b2c3", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "a1b2c3", created.Annotations[util.CNIContainerIDAnnotationKey])
+	assert.Equal(t, []networkv1.NetworkConfig{{NetworkName: testNetworkName, MACAddress: testMACAddress3}}, created.Spec.NetworkConfigs)
+
+	_, err = vmnetcfgClient.Get(testIPPoolNamespace, cniVmNetCfgName, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = vmnetcfgClient.Get(testIPPoolNamespace, "cni-vm", metav1.GetOptions{})
+	assert.Nil(t, err)
+}
+
+func TestCNIAddHandler_FeatureGate(t *testing.T) {
+	featureGates, err := featuregate.New(nil)
+	assert.Nil(t, err)
+	called := false
+	handler := gatedHandler(featureGates, featuregate.CNIIPAM, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/pools/default/net-1/cni", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.False(t, called, "the endpoint should be off by default")
+
+	// Turned on in the ConfigMap shared with the webhook
+	featureGates.SetFromConfigMap(map[string]string{string(featuregate.CNIIPAM): "true"})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/pools/default/net-1/cni", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, called)
+}
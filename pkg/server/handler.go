@@ -2,16 +2,38 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
+	"github.com/harvester/vm-dhcp-controller/pkg/audit"
 	"github.com/harvester/vm-dhcp-controller/pkg/cache"
 	"github.com/harvester/vm-dhcp-controller/pkg/dhcp"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
+	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
 	"github.com/harvester/vm-dhcp-controller/pkg/ipam"
 	"github.com/harvester/vm-dhcp-controller/pkg/metrics"
+	"github.com/harvester/vm-dhcp-controller/pkg/sdk"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+const (
+	// cniAllocationTimeout is how long a CNI ADD waits for the IP address to
+	// be allocated, well within the write timeout of the server
+	cniAllocationTimeout = 10 * time.Second
+	// maxCNIRequestSize bounds the body of a CNI ADD
+	maxCNIRequestSize = 1 << 16
 )
 
 func listIPByNetworkHandler(ipAllocator *ipam.IPAllocator) http.Handler {
@@ -64,9 +86,399 @@ func listLeaseHandler(dhcpAllocator *dhcp.DHCPAllocator) http.Handler {
 			_, _ = fmt.Fprintf(w, "cannot list leases: %s", err.Error())
 			return
 		}
-		payload, err := json.Marshal(set)
+		w.Header().Set("Content-Type", "application/json")
+		body, finish := negotiateEncoding(w, r)
+		if err := json.NewEncoder(body).Encode(set); err != nil {
+			logrus.Error(err)
+			return
+		}
+		if err := finish(); err != nil {
+			logrus.Error(err)
+		}
+	})
+}
+
+func getPoolConfigHandler(dhcpAllocator *dhcp.DHCPAllocator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := json.Marshal(dhcpAllocator.GetPoolConfig())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(payload); err != nil {
+			logrus.Error(err)
+		}
+	})
+}
+
+// zoneFileHandler exports the records of the IPPool as a zone file. The
+// VirtualMachineNetworkConfig objects are read from the vmnetcfg cache, which
+// is only running on the leader, so the other replicas can't answer rather
+// than serving a zone file without hosts.
+func zoneFileHandler(ippoolClient ctlnetworkv1.IPPoolClient, vmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache, isLeader func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		namespace, name := params["namespace"], params["name"]
+
+		if isLeader != nil && !isLeader() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprintf(w, "not the leader")
+			return
+		}
+
+		var withPTR bool
+		if ptr := r.URL.Query().Get("ptr"); ptr != "" {
+			var err error
+			withPTR, err = strconv.ParseBool(ptr)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = fmt.Fprintf(w, "invalid ptr parameter %q", ptr)
+				return
+			}
+		}
+
+		ipPool, err := ippoolClient.Get(namespace, name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			_, _ = fmt.Fprintf(w, "failed to get ippool %s/%s: %s", namespace, name, err.Error())
+			return
+		}
+
+		vmNetCfgs, err := vmnetcfgCache.List(metav1.NamespaceAll, labels.Everything())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprintf(w, "failed to list vmnetcfgs: %s", err.Error())
+			return
+		}
+
+		zoneFile, err := buildZoneFile(ipPool, vmNetCfgs, withPTR)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "cannot build zone file: %s", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set(revisionHeader, strconv.FormatInt(ipPool.Status.AllocationRevision, 10))
+		if _, err := w.Write([]byte(zoneFile)); err != nil {
+			logrus.Error(err)
+		}
+	})
+}
+
+// leasesHandler exports the leases of the IPPool. Consumers pass the revision
+// they're at as the sinceRevision parameter to get the changes made since
+// then, and are told to resync with the full set of leases if the change log
+// no longer covers it. A request already at the latest revision is held until
+// the next one or the long-poll timeout. The change log is kept by the
+// leader, so the other replicas always answer with the full set.
+func leasesHandler(ippoolClient ctlnetworkv1.IPPoolClient, changeLog *audit.ChangeLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		namespace, name := params["namespace"], params["name"]
+
+		var sinceRevision *int64
+		if since := r.URL.Query().Get("sinceRevision"); since != "" {
+			revision, err := strconv.ParseInt(since, 10, 64)
+			if err != nil || revision < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = fmt.Fprintf(w, "invalid sinceRevision parameter %q", since)
+				return
+			}
+			sinceRevision = &revision
+		}
+
+		// Wait before reading the IPPool so no revision slips in between
+		waiter := changeLog.Wait(namespace + "/" + name)
+
+		ipPool, err := ippoolClient.Get(namespace, name, metav1.GetOptions{})
+		if err == nil && sinceRevision != nil && *sinceRevision == ipPool.Status.AllocationRevision {
+			select {
+			case <-waiter:
+				ipPool, err = ippoolClient.Get(namespace, name, metav1.GetOptions{})
+			case <-time.After(longPollTimeout):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			_, _ = fmt.Fprintf(w, "failed to get ippool %s/%s: %s", namespace, name, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(revisionHeader, strconv.FormatInt(ipPool.Status.AllocationRevision, 10))
+		body, finish := negotiateEncoding(w, r)
+		if err := buildLeasesExport(ipPool, changeLog, sinceRevision).encode(body); err != nil {
+			logrus.Error(err)
+			return
+		}
+		if err := finish(); err != nil {
+			logrus.Error(err)
+		}
+	})
+}
+
+// lookupMACHandler tells which VMs a MAC address belongs to and the IP
+// addresses allocated for it. The vmnetcfg cache is only running on the
+// leader, so the other replicas can't answer.
+func lookupMACHandler(vmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache) http.Handler {
+	getter := &util.VmnetcfgGetter{VmnetcfgCache: vmnetcfgCache}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		macAddress := r.URL.Query().Get("mac")
+		if _, err := net.ParseMAC(macAddress); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "invalid mac parameter %q", macAddress)
+			return
+		}
+
+		result, err := lookupMAC(getter, macAddress)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprintf(w, "cannot look up mac address %s: %s", macAddress, err.Error())
+			return
+		}
+		if len(result.Owners) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprintf(w, "mac address %s is not in any vmnetcfg", macAddress)
+			return
+		}
+
+		payload, err := json.Marshal(result)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(payload); err != nil {
+			logrus.Error(err)
+		}
+	})
+}
+
+// cniAddHandler allocates an IP address of the IPPool to the MAC address of
+// a container and answers with a CNI IPAM result. The allocation is recorded
+// in a VirtualMachineNetworkConfig named after the container, so it's
+// persisted and leased like the ones of VMs, and repeated ADDs of a container
+// get the same IP address. The allocation is waited for through the vmnetcfg
+// cache, which is only running on the leader, so the other replicas can't
+// answer.
+func cniAddHandler(
+	ippoolClient ctlnetworkv1.IPPoolClient,
+	vmnetcfgClient ctlnetworkv1.VirtualMachineNetworkConfigClient,
+	vmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache,
+	isLeader func() bool,
+	timeout time.Duration,
+) http.Handler {
+	sdkClient := sdk.New(nil, nil, vmnetcfgCache, nil)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		namespace, name := params["namespace"], params["name"]
+
+		if isLeader != nil && !isLeader() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprintf(w, "not the leader")
+			return
+		}
+
+		var request cniRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxCNIRequestSize)).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "invalid request: %s", err.Error())
+			return
+		}
+		if request.CNIVersion != "" && request.CNIVersion != cniVersion {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "unsupported cniVersion %q, only %s is", request.CNIVersion, cniVersion)
+			return
+		}
+		macAddress, err := util.ParseMAC(request.MACAddress)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "invalid macAddress %q", request.MACAddress)
+			return
+		}
+		vmNetCfgName, err := cniVmNetCfgName(request.ContainerID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+
+		ipPool, err := ippoolClient.Get(namespace, name, metav1.GetOptions{})
+		if err != nil {
+			w.WriteHeader(apiErrorStatus(err))
+			_, _ = fmt.Fprintf(w, "failed to get ippool %s/%s: %s", namespace, name, err.Error())
+			return
+		}
+
+		vmNetCfg, err := vmnetcfgClient.Get(namespace, vmNetCfgName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			vmNetCfg, err = vmnetcfgClient.Create(newCNIVmNetCfg(ipPool, vmNetCfgName, request.ContainerID, macAddress))
+		}
+		if err != nil {
+			w.WriteHeader(apiErrorStatus(err))
+			_, _ = fmt.Fprintf(w, "failed to get or create vmnetcfg %s/%s: %s", namespace, vmNetCfgName, err.Error())
+			return
+		}
+		if vmNetCfg.Annotations[util.CNIContainerIDAnnotationKey] != request.ContainerID ||
+			len(vmNetCfg.Spec.NetworkConfigs) != 1 ||
+			util.NormalizeMAC(vmNetCfg.Spec.NetworkConfigs[0].MACAddress) != macAddress ||
+			vmNetCfg.Spec.NetworkConfigs[0].NetworkName != ipPool.Spec.NetworkName {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = fmt.Fprintf(w, "vmnetcfg %s/%s already exists for another container, mac address or network", namespace, vmNetCfgName)
+			return
+		}
+
+		allocations, err := sdkClient.WaitForAllocation(r.Context(), namespace, vmNetCfgName, timeout)
+		if err != nil {
+			switch {
+			case errors.Is(err, sdk.ErrNotAllocated):
+				w.WriteHeader(http.StatusGatewayTimeout)
+			case errors.Is(err, sdk.ErrAllocationDisabled):
+				w.WriteHeader(http.StatusConflict)
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			_, _ = fmt.Fprintf(w, "cannot allocate ip address to container %s: %s", request.ContainerID, err.Error())
+			return
+		}
+
+		// Without a VM, the allocation is keyed by the MAC address
+		allocation := allocations[vmNetCfg.Spec.NetworkConfigs[0].MACAddress]
+
+		// The IP address may come from an overflow IPPool of another subnet
+		allocationPool := ipPool
+		if allocation.IPPool != "" && allocation.IPPool != namespace+"/"+name {
+			poolNamespace, poolName, _ := strings.Cut(allocation.IPPool, "/")
+			allocationPool, err = ippoolClient.Get(poolNamespace, poolName, metav1.GetOptions{})
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = fmt.Fprintf(w, "failed to get ippool %s: %s", allocation.IPPool, err.Error())
+				return
+			}
+		}
+
+		result, err := buildCNIResult(allocationPool, allocation.IPAddress)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprintf(w, "cannot build cni result: %s", err.Error())
+			return
+		}
+
+		payload, err := json.Marshal(result)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(payload); err != nil {
+			logrus.Error(err)
+		}
+	})
+}
+
+// cniDelHandler releases the IP address allocated to a container by deleting
+// its VirtualMachineNetworkConfig. Releasing a container without any
+// allocation succeeds, as CNI DELs may be repeated.
+func cniDelHandler(vmnetcfgClient ctlnetworkv1.VirtualMachineNetworkConfigClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		namespace, containerID := params["namespace"], params["containerID"]
+
+		vmNetCfgName, err := cniVmNetCfgName(containerID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+
+		vmNetCfg, err := vmnetcfgClient.Get(namespace, vmNetCfgName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprintf(w, "failed to get vmnetcfg %s/%s: %s", namespace, vmNetCfgName, err.Error())
+			return
+		}
+		// Never release the IP addresses of a VM
+		if vmNetCfg.Annotations[util.CNIContainerIDAnnotationKey] != containerID {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = fmt.Fprintf(w, "vmnetcfg %s/%s is not the one of container %s", namespace, vmNetCfgName, containerID)
+			return
+		}
+
+		if err := vmnetcfgClient.Delete(namespace, vmNetCfgName, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprintf(w, "failed to delete vmnetcfg %s/%s: %s", namespace, vmNetCfgName, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// featuresHandler serves the resolved state of the feature gates of the
+// component.
+func featuresHandler(featureGates *featuregate.Gates) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := json.Marshal(featureGates.List())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(payload); err != nil {
+			logrus.Error(err)
+		}
+	})
+}
+
+// gatedHandler serves handler only while the feature is enabled, and answers
+// as if it didn't exist otherwise.
+func gatedHandler(featureGates *featuregate.Gates, feature featuregate.Feature, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !featureGates.Enabled(feature) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprintf(w, "feature gate %s is disabled", feature)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// apiErrorStatus returns the HTTP status of an error of the API server, e.g.,
+// 404 for a missing object or 400 for one denied by a webhook.
+func apiErrorStatus(err error) int {
+	var status apierrors.APIStatus
+	if errors.As(err, &status) && status.Status().Code != 0 {
+		return int(status.Status().Code)
+	}
+	return http.StatusInternalServerError
+}
+
+// listDenialHandler serves the denials recorded by this controller instance.
+// Allocations only happen on the leader, so the other replicas have nothing
+// to report.
+func listDenialHandler(denialLog *audit.DenialLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		ipPoolKey := params["namespace"] + "/" + params["name"]
+		payload, err := json.Marshal(denialLog.List(ipPoolKey))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		if _, err := w.Write(payload); err != nil {
@@ -2,23 +2,36 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
 	"github.com/harvester/vm-dhcp-controller/pkg/config"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
 )
 
-const defaultPort = 8080
+const (
+	defaultPort    = 8080
+	defaultAPIPort = 8443
+)
 
 type HTTPServer struct {
 	*config.HTTPServerOptions
 	srv    *http.Server
 	router *mux.Router
+	// apiSrv serves the endpoints of apiRouter, which require
+	// authentication, if any is registered
+	apiSrv    *http.Server
+	apiRouter *mux.Router
 }
 
 func NewHTTPServer(httpServerOptions *config.HTTPServerOptions) *HTTPServer {
@@ -35,50 +48,180 @@ func (s *HTTPServer) registerProbeHandlers() {
 		}
 	})
 	s.router.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		var readyErr error
+		if s.ReadyCheck != nil {
+			readyErr = s.ReadyCheck()
+		}
+
+		if r.URL.Query().Has("verbose") {
+			s.writeVerboseReadiness(w, readyErr)
+			return
+		}
+
+		if readyErr != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprintf(w, "not ready: %s", readyErr.Error())
+			return
+		}
 		if err := json.NewEncoder(w).Encode(map[string]bool{"ok": true}); err != nil {
 			logrus.Fatal(err)
 		}
 	})
 }
 
+// readiness is the verbose answer of the ready check, telling which instance
+// answered and whether it holds the leader lease.
+type readiness struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	Leader   *bool  `json:"leader,omitempty"`
+}
+
+func (s *HTTPServer) writeVerboseReadiness(w http.ResponseWriter, readyErr error) {
+	result := readiness{
+		OK:       readyErr == nil,
+		Identity: s.Identity,
+	}
+	if readyErr != nil {
+		result.Error = readyErr.Error()
+	}
+	if s.IsLeader != nil {
+		leader := s.IsLeader()
+		result.Leader = &leader
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if readyErr != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logrus.Errorf("(server.readyz) failed to encode readiness: %s", err.Error())
+	}
+}
+
 func (s *HTTPServer) RegisterControllerHandlers() {
 	s.registerProbeHandlers()
 
 	if s.DebugMode {
 		s.router.Handle("/ipams/{networkName:.*}", listIPByNetworkHandler(s.IPAllocator))
 		s.router.Handle("/caches/{networkName:.*}", listCacheByNetworkHandler(s.CacheAllocator))
+		s.router.Handle("/supportbundle", supportBundleHandler(&supportBundle{
+			ippoolClient:     s.IPPoolClient,
+			vmnetcfgClient:   s.VmNetCfgClient,
+			ipAllocator:      s.IPAllocator,
+			cacheAllocator:   s.CacheAllocator,
+			denialLog:        s.DenialLog,
+			changeLog:        s.ChangeLog,
+			version:          versionInfo{Version: s.AppVersion, GitCommit: s.GitCommit},
+			clock:            clock.RealClock{},
+			fetchAgentLeases: agentLeasesFetcher(s.PodClient),
+		})).Methods(http.MethodGet)
 	}
 
 	s.router.Handle("/metrics", metricsHandler(s.MetricsAllocator))
+	s.router.Handle("/features", featuresHandler(s.FeatureGates)).Methods(http.MethodGet)
+	// Containers are allocated and released, and denials and the hosts of
+	// IPPools are read, on behalf of the users allowed to by RBAC only. MAC
+	// addresses are looked up across all IPPools, so on behalf of the users
+	// allowed to on all of them.
+	authorizer := newIPPoolAuthorizer(s.KubeClient)
+	s.apiRouter = mux.NewRouter()
+	s.apiRouter.Handle("/pools/{namespace}/{name}/zonefile", authorizer.handler("get", "zonefile",
+		zoneFileHandler(s.IPPoolClient, s.VmNetCfgCache, s.IsLeader))).Methods(http.MethodGet)
+	s.apiRouter.Handle("/pools/{namespace}/{name}/leases", authorizer.handler("get", "leases",
+		leasesHandler(s.IPPoolClient, s.ChangeLog))).Methods(http.MethodGet)
+	s.apiRouter.Handle("/lookup", authorizer.handler("get", "lookup",
+		lookupMACHandler(s.VmNetCfgCache))).Methods(http.MethodGet)
+	s.apiRouter.Handle("/pools/{namespace}/{name}/denials", authorizer.handler("get", "denials",
+		listDenialHandler(s.DenialLog))).Methods(http.MethodGet)
+	s.apiRouter.Handle("/pools/{namespace}/{name}/cni", authorizer.handler("create", "cni", gatedHandler(s.FeatureGates, featuregate.CNIIPAM,
+		cniAddHandler(s.IPPoolClient, s.VmNetCfgClient, s.VmNetCfgCache, s.IsLeader, cniAllocationTimeout)))).Methods(http.MethodPost)
+	s.apiRouter.Handle("/pools/{namespace}/{name}/cni/{containerID}", authorizer.handler("delete", "cni", gatedHandler(s.FeatureGates, featuregate.CNIIPAM,
+		cniDelHandler(s.VmNetCfgClient)))).Methods(http.MethodDelete)
 }
 
 func (s *HTTPServer) RegisterAgentHandlers() {
 	s.registerProbeHandlers()
 
 	if s.DebugMode {
+		s.router.Handle("/pool", getPoolConfigHandler(s.DHCPAllocator))
+		// The lease table goes into the support bundle
 		s.router.Handle("/leases", listLeaseHandler(s.DHCPAllocator))
 	}
 }
 
+func (s *HTTPServer) RegisterWebhookHandlers() {
+	s.registerProbeHandlers()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(s.Collectors...)
+	s.router.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	s.router.Handle("/features", featuresHandler(s.FeatureGates)).Methods(http.MethodGet)
+}
+
 func (s *HTTPServer) Run() error {
 	logrus.Info("Starting HTTP server")
 
+	port := s.Port
+	if port == 0 {
+		port = defaultPort
+	}
+
 	s.srv = &http.Server{
 		Handler:      s.router,
-		Addr:         fmt.Sprintf(":%d", defaultPort),
+		Addr:         fmt.Sprintf(":%d", port),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+
+	logrus.Infof("Listening on port: %d", port)
+
+	if s.apiRouter == nil {
+		return s.srv.ListenAndServe()
+	}
+	if s.GetAPICertificate == nil {
+		logrus.Warn("No certificate for the endpoints requiring authentication, not serving them")
+		return s.srv.ListenAndServe()
+	}
+
+	apiPort := s.APIPort
+	if apiPort == 0 {
+		apiPort = defaultAPIPort
+	}
+	// The endpoints requiring authentication take bearer tokens, which must
+	// only go to a server the clients can verify
+	s.apiSrv = &http.Server{
+		Handler: s.apiRouter,
+		Addr:    fmt.Sprintf(":%d", apiPort),
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: s.GetAPICertificate,
+		},
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
 
-	logrus.Infof("Listening on port: %d", defaultPort)
+	logrus.Infof("Listening on port: %d (TLS)", apiPort)
 
-	return s.srv.ListenAndServe()
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- s.srv.ListenAndServe()
+	}()
+	go func() {
+		errCh <- s.apiSrv.ListenAndServeTLS("", "")
+	}()
+	return <-errCh
 }
 
 func (s *HTTPServer) stop(ctx context.Context) error {
 	logrus.Info("Stopping HTTP server")
 
-	return s.srv.Shutdown(ctx)
+	var apiErr error
+	if s.apiSrv != nil {
+		apiErr = s.apiSrv.Shutdown(ctx)
+	}
+	return errors.Join(s.srv.Shutdown(ctx), apiErr)
 }
 
 func Cleanup(ctx context.Context, srv *HTTPServer) <-chan error {
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/audit"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// revisionHeader carries the allocation revision of the IPPool the leases
+// were exported from.
+const revisionHeader = "X-Allocation-Revision"
+
+// longPollTimeout is how long a request for the changes since the latest
+// revision waits for the next one. It's kept below the write timeout of the
+// server.
+const longPollTimeout = 10 * time.Second
+
+// leasesExport is either the full set of leases of an IPPool, along with the
+// config of the pool, or the changes made to them since the requested
+// revision. Both come as the leases to upsert and the ones to remove, so
+// consumers apply them the same way.
+type leasesExport struct {
+	Revision   int64         `json:"revision"`
+	LastChange *metav1.Time  `json:"lastChange,omitempty"`
+	Full       bool          `json:"full"`
+	Pool       *poolConfig   `json:"pool,omitempty"`
+	Upserts    []leaseRecord `json:"upserts,omitempty"`
+	Removals   []leaseRecord `json:"removals,omitempty"`
+
+	// leases are the upserts of a full export, which are streamed from the
+	// leases of the IPPool rather than built up front
+	leases map[string]string
+}
+
+// poolConfig is the part of the spec of an IPPool its leases are served
+// with.
+type poolConfig struct {
+	NetworkName string `json:"networkName"`
+	CIDR        string `json:"cidr"`
+	ServerIP    string `json:"serverIP"`
+	Router      string `json:"router,omitempty"`
+	Start       string `json:"start"`
+	End         string `json:"end,omitempty"`
+}
+
+// leaseRecord is a lease to upsert or remove. The leases of a change carry its
+// revision and writer.
+type leaseRecord struct {
+	IPAddress  string `json:"ipAddress"`
+	MACAddress string `json:"macAddress"`
+	Revision   int64  `json:"revision,omitempty"`
+	Writer     string `json:"writer,omitempty"`
+}
+
+// buildLeasesExport returns the changes made to the leases of the IPPool since
+// the given revision. The full set of leases is returned instead if no
+// revision is given or the change log no longer covers it.
+func buildLeasesExport(ipPool *networkv1.IPPool, changeLog *audit.ChangeLog, sinceRevision *int64) leasesExport {
+	export := leasesExport{
+		Revision: ipPool.Status.AllocationRevision,
+	}
+	if !ipPool.Status.LastChange.IsZero() {
+		lastChange := ipPool.Status.LastChange
+		export.LastChange = &lastChange
+	}
+
+	if sinceRevision != nil {
+		changes, ok := changeLog.Since(ipPool.Namespace+"/"+ipPool.Name, *sinceRevision, export.Revision)
+		if ok {
+			export.Upserts, export.Removals = foldChanges(changes)
+			return export
+		}
+	}
+
+	export.Full = true
+	export.Pool = &poolConfig{
+		NetworkName: ipPool.Spec.NetworkName,
+		CIDR:        ipPool.Spec.IPv4Config.CIDR,
+		ServerIP:    ipPool.Spec.IPv4Config.ServerIP,
+		Router:      ipPool.Spec.IPv4Config.Router,
+		Start:       ipPool.Spec.IPv4Config.Pool.Start,
+		End:         ipPool.Spec.IPv4Config.Pool.End,
+	}
+	export.leases = util.Leases(ipPool.Status.IPv4)
+
+	return export
+}
+
+// foldChanges folds changes into the leases to upsert and the ones to remove,
+// going by the last change of each IP address.
+func foldChanges(changes []audit.Change) (upserts, removals []leaseRecord) {
+	last := make(map[string]audit.Change, len(changes))
+	for _, change := range changes {
+		last[change.IPAddress] = change
+	}
+
+	for _, change := range changes {
+		if last[change.IPAddress] != change {
+			continue
+		}
+		record := leaseRecord{
+			IPAddress:  change.IPAddress,
+			MACAddress: change.MACAddress,
+			Revision:   change.Revision,
+			Writer:     change.Writer,
+		}
+		if change.Type == audit.ChangeTypeReleased {
+			removals = append(removals, record)
+		} else {
+			upserts = append(upserts, record)
+		}
+	}
+
+	return upserts, removals
+}
+
+// encode writes the export as JSON to w. The upserts of a full export are
+// encoded one at a time, sorted by IP address, so the leases of a large
+// IPPool are never held as a whole in memory once more.
+func (e leasesExport) encode(w io.Writer) error {
+	header := e
+	header.Upserts, header.Removals = nil, nil
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	// The header always has the revision, so the sections follow with a
+	// comma
+	_, _ = bw.Write(data[:len(data)-1])
+
+	if len(e.Upserts) > 0 || len(e.leases) > 0 {
+		_, _ = bw.WriteString(`,"upserts":[`)
+		if e.leases != nil {
+			ips := make([]string, 0, len(e.leases))
+			for ip := range e.leases {
+				ips = append(ips, ip)
+			}
+			sort.Strings(ips)
+			for i, ip := range ips {
+				if err := writeRecord(bw, i, leaseRecord{IPAddress: ip, MACAddress: e.leases[ip]}); err != nil {
+					return err
+				}
+			}
+		}
+		for i, record := range e.Upserts {
+			if err := writeRecord(bw, i, record); err != nil {
+				return err
+			}
+		}
+		_, _ = bw.WriteString("]")
+	}
+
+	if len(e.Removals) > 0 {
+		_, _ = bw.WriteString(`,"removals":[`)
+		for i, record := range e.Removals {
+			if err := writeRecord(bw, i, record); err != nil {
+				return err
+			}
+		}
+		_, _ = bw.WriteString("]")
+	}
+
+	_, _ = bw.WriteString("}")
+	return bw.Flush()
+}
+
+// writeRecord writes the i-th record of a section.
+func writeRecord(bw *bufio.Writer, i int, record leaseRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if i > 0 {
+		_ = bw.WriteByte(',')
+	}
+	_, err = bw.Write(data)
+	return err
+}
+
+// negotiateEncoding returns the writer the body of the response goes to,
+// which gzips it if the client accepts gzip, and the function finishing the
+// body. Clients not asking for gzip, e.g., older ones, get it uncompressed.
+func negotiateEncoding(w http.ResponseWriter, r *http.Request) (io.Writer, func() error) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		return w, func() error { return nil }
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gw := gzip.NewWriter(w)
+	return gw, gw.Close
+}
+
+// acceptsGzip tells whether the Accept-Encoding header lists gzip without a
+// zero quality value.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		param, value, ok := strings.Cut(strings.TrimSpace(params), "=")
+		if !ok || strings.TrimSpace(param) != "q" {
+			return true
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return err == nil && q > 0
+	}
+	return false
+}
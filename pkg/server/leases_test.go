@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/audit"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/ippool"
+	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
+)
+
+// leasesExportCap is the size the compressed full export of a large IPPool
+// has to fit in, e.g., the body limit of the ingress in front of the
+// controller.
+var leasesExportCap = flag.Int("leases-export-cap", 1<<20, "size in bytes the compressed full leases export of a 50k-lease ippool must fit in")
+
+const largeIPPoolLeases = 50000
+
+// newLargeIPPool returns an IPPool with n leases of random MAC addresses,
+// which compress about as badly as the ones of real VMs.
+func newLargeIPPool(n int) *networkv1.IPPool {
+	ipPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+		ServerIP("10.0.0.1").
+		CIDR("10.0.0.0/8").
+		PoolRange("10.0.0.2", "10.255.255.254").
+		NetworkName(testNetworkName).
+		AllocationRevision(int64(n)).Build()
+
+	random := rand.New(rand.NewSource(1))
+	ipPool.Status.IPv4 = &networkv1.IPv4Status{
+		Entries: make(map[string]networkv1.AllocationEntry, n),
+	}
+	for i := 0; i < n; i++ {
+		ip := fmt.Sprintf("10.%d.%d.%d", (i+2)>>16&0xff, (i+2)>>8&0xff, (i+2)&0xff)
+		mac := fmt.Sprintf("02:%02x:%02x:%02x:%02x:%02x",
+			random.Intn(256), random.Intn(256), random.Intn(256), random.Intn(256), random.Intn(256))
+		ipPool.Status.IPv4.Entries[ip] = networkv1.AllocationEntry{
+			Type:  networkv1.AllocationTypeLease,
+			Owner: mac,
+		}
+	}
+	return ipPool
+}
+
+func TestBuildLeasesExport(t *testing.T) {
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+	ipPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+		ServerIP("192.168.0.2").
+		CIDR("192.168.0.0/24").
+		PoolRange("192.168.0.100", "192.168.0.200").
+		NetworkName(testNetworkName).
+		Allocated(testIPAddress1, testMACAddress1).
+		Allocated(testIPAddress2, testMACAddress2).
+		AllocationRevision(3).Build()
+
+	changeLog := audit.NewChangeLog(2)
+	changeLog.Record(ipPoolKey, 2, []audit.Change{{Type: audit.ChangeTypeAllocated, IPAddress: testIPAddress1, MACAddress: testMACAddress1}})
+	changeLog.Record(ipPoolKey, 3, []audit.Change{{Type: audit.ChangeTypeAllocated, IPAddress: testIPAddress2, MACAddress: testMACAddress2}})
+
+	revision := func(revision int64) *int64 {
+		return &revision
+	}
+
+	fullExport := leasesExport{
+		Revision: 3,
+		Full:     true,
+		Pool: &poolConfig{
+			NetworkName: testNetworkName,
+			CIDR:        "192.168.0.0/24",
+			ServerIP:    "192.168.0.2",
+			Start:       "192.168.0.100",
+			End:         "192.168.0.200",
+		},
+		leases: map[string]string{
+			testIPAddress1: testMACAddress1,
+			testIPAddress2: testMACAddress2,
+		},
+	}
+
+	testCases := []struct {
+		name          string
+		sinceRevision *int64
+		expected      leasesExport
+	}{
+		{
+			name:     "full export without revision",
+			expected: fullExport,
+		},
+		{
+			name:          "changes since kept revision",
+			sinceRevision: revision(2),
+			expected: leasesExport{
+				Revision: 3,
+				Upserts: []leaseRecord{
+					{Revision: 3, IPAddress: testIPAddress2, MACAddress: testMACAddress2},
+				},
+			},
+		},
+		{
+			name:          "no changes since latest revision",
+			sinceRevision: revision(3),
+			expected: leasesExport{
+				Revision: 3,
+			},
+		},
+		{
+			name:          "full export since evicted revision",
+			sinceRevision: revision(0),
+			expected:      fullExport,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, buildLeasesExport(ipPool, changeLog, tc.sinceRevision))
+		})
+	}
+}
+
+func TestFoldChanges(t *testing.T) {
+	upserts, removals := foldChanges([]audit.Change{
+		{Revision: 4, Type: audit.ChangeTypeAllocated, IPAddress: testIPAddress1, MACAddress: testMACAddress1},
+		{Revision: 4, Type: audit.ChangeTypeReleased, IPAddress: testIPAddress2, MACAddress: testMACAddress2},
+		{Revision: 5, Type: audit.ChangeTypeReleased, IPAddress: testIPAddress1, MACAddress: testMACAddress1},
+		{Revision: 6, Type: audit.ChangeTypeAllocated, IPAddress: testIPAddress2, MACAddress: testMACAddress1, Writer: "replica-a"},
+	})
+
+	assert.Equal(t, []leaseRecord{
+		{Revision: 6, IPAddress: testIPAddress2, MACAddress: testMACAddress1, Writer: "replica-a"},
+	}, upserts, "only the last change of an ip address should count")
+	assert.Equal(t, []leaseRecord{
+		{Revision: 5, IPAddress: testIPAddress1, MACAddress: testMACAddress1},
+	}, removals, "a lease allocated and released since should only be removed")
+}
+
+func TestLeasesExport_Encode(t *testing.T) {
+	testCases := []struct {
+		name     string
+		export   leasesExport
+		expected string
+	}{
+		{
+			name: "full export",
+			export: leasesExport{
+				Revision: 3,
+				Full:     true,
+				Pool:     &poolConfig{NetworkName: testNetworkName, CIDR: "192.168.0.0/24", ServerIP: "192.168.0.2", Start: "192.168.0.100"},
+				leases: map[string]string{
+					testIPAddress2: testMACAddress2,
+					testIPAddress1: testMACAddress1,
+				},
+			},
+			expected: fmt.Sprintf(`{"revision":3,"full":true,
+				"pool":{"networkName":%q,"cidr":"192.168.0.0/24","serverIP":"192.168.0.2","start":"192.168.0.100"},
+				"upserts":[{"ipAddress":%q,"macAddress":%q},{"ipAddress":%q,"macAddress":%q}]}`,
+				testNetworkName, testIPAddress1, testMACAddress1, testIPAddress2, testMACAddress2),
+		},
+		{
+			name: "changes",
+			export: leasesExport{
+				Revision: 5,
+				Upserts:  []leaseRecord{{Revision: 4, IPAddress: testIPAddress1, MACAddress: testMACAddress1}},
+				Removals: []leaseRecord{{Revision: 5, IPAddress: testIPAddress2, MACAddress: testMACAddress2, Writer: "replica-a"}},
+			},
+			expected: fmt.Sprintf(`{"revision":5,"full":false,
+				"upserts":[{"revision":4,"ipAddress":%q,"macAddress":%q}],
+				"removals":[{"revision":5,"ipAddress":%q,"macAddress":%q,"writer":"replica-a"}]}`,
+				testIPAddress1, testMACAddress1, testIPAddress2, testMACAddress2),
+		},
+		{
+			name:     "no changes",
+			export:   leasesExport{Revision: 5},
+			expected: `{"revision":5,"full":false}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			assert.Nil(t, tc.export.encode(&buf))
+			assert.JSONEq(t, tc.expected, buf.String())
+		})
+	}
+}
+
+func TestLeasesHandler_Encoding(t *testing.T) {
+	ipPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+		Allocated(testIPAddress1, testMACAddress1).
+		AllocationRevision(1).Build()
+	clientset := fake.NewSimpleClientset(ipPool)
+
+	router := mux.NewRouter()
+	router.Handle("/pools/{namespace}/{name}/leases", leasesHandler(
+		fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		audit.NewChangeLog(audit.DefaultChangeLogSize),
+	))
+
+	testCases := []struct {
+		name           string
+		acceptEncoding string
+		expectGzip     bool
+	}{
+		{name: "uncompressed"},
+		{name: "gzip", acceptEncoding: "gzip", expectGzip: true},
+		{name: "gzip among others", acceptEncoding: "br;q=1.0, gzip;q=0.8", expectGzip: true},
+		{name: "gzip refused", acceptEncoding: "gzip;q=0, identity"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/pools/%s/%s/leases", testIPPoolNamespace, testIPPoolName), nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+
+			var body io.Reader = rec.Body
+			if tc.expectGzip {
+				assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+				gr, err := gzip.NewReader(rec.Body)
+				if !assert.Nil(t, err) {
+					return
+				}
+				body = gr
+			} else {
+				assert.Empty(t, rec.Header().Get("Content-Encoding"))
+			}
+
+			var export leasesExport
+			assert.Nil(t, json.NewDecoder(body).Decode(&export))
+			assert.True(t, export.Full)
+			assert.Equal(t, []leaseRecord{{IPAddress: testIPAddress1, MACAddress: testMACAddress1}}, export.Upserts)
+		})
+	}
+}
+
+// TestLeasesExport_CompressedSize checks the compressed full export of an
+// IPPool with 50k leases fits in the cap given with -leases-export-cap.
+func TestLeasesExport_CompressedSize(t *testing.T) {
+	export := buildLeasesExport(newLargeIPPool(largeIPPoolLeases), audit.NewChangeLog(1), nil)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	assert.Nil(t, export.encode(gw))
+	assert.Nil(t, gw.Close())
+
+	assert.LessOrEqual(t, buf.Len(), *leasesExportCap, "compressed export of %d leases should fit in %d bytes", largeIPPoolLeases, *leasesExportCap)
+
+	gr, err := gzip.NewReader(&buf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	var decoded leasesExport
+	assert.Nil(t, json.NewDecoder(gr).Decode(&decoded))
+	assert.Len(t, decoded.Upserts, largeIPPoolLeases)
+}
+
+func BenchmarkLeasesExport_Encode(b *testing.B) {
+	export := buildLeasesExport(newLargeIPPool(largeIPPoolLeases), audit.NewChangeLog(1), nil)
+
+	b.Run("uncompressed", func(b *testing.B) {
+		var buf bytes.Buffer
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			if err := export.encode(&buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(buf.Len()), "bytes/export")
+	})
+
+	b.Run("gzip", func(b *testing.B) {
+		var buf bytes.Buffer
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			gw := gzip.NewWriter(&buf)
+			if err := export.encode(gw); err != nil {
+				b.Fatal(err)
+			}
+			if err := gw.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(buf.Len()), "bytes/export")
+	})
+}
+
+func BenchmarkBuildLeasesExport(b *testing.B) {
+	ipPool := newLargeIPPool(largeIPPoolLeases)
+	changeLog := audit.NewChangeLog(1)
+
+	for i := 0; i < b.N; i++ {
+		_ = buildLeasesExport(ipPool, changeLog, nil)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// macOwner is a network config listing the MAC address looked up, along with
+// the IP address allocated for it if any.
+type macOwner struct {
+	VmNetCfg    string                       `json:"vmNetCfg"`
+	VMName      string                       `json:"vmName"`
+	NetworkName string                       `json:"networkName"`
+	IPAddress   string                       `json:"ipAddress,omitempty"`
+	IPPoolRef   string                       `json:"ipPoolRef,omitempty"`
+	State       networkv1.NetworkConfigState `json:"state,omitempty"`
+}
+
+type macLookup struct {
+	MACAddress string     `json:"macAddress"`
+	Owners     []macOwner `json:"owners"`
+}
+
+// lookupMAC finds the network configs listing the MAC address through the
+// MAC index of the vmnetcfg cache. A MAC address should have a single owner,
+// but all of them are reported so conflicts show up.
+func lookupMAC(getter *util.VmnetcfgGetter, macAddress string) (macLookup, error) {
+	macAddress = util.NormalizeMAC(macAddress)
+	result := macLookup{
+		MACAddress: macAddress,
+		Owners:     []macOwner{},
+	}
+
+	vmNetCfgs, err := getter.WhoHasMAC(macAddress)
+	if err != nil {
+		return result, err
+	}
+
+	for _, vmNetCfg := range vmNetCfgs {
+		for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+			if util.NormalizeMAC(nc.MACAddress) != macAddress {
+				continue
+			}
+			owner := macOwner{
+				VmNetCfg:    vmNetCfg.Namespace + "/" + vmNetCfg.Name,
+				VMName:      vmNetCfg.Spec.VMName,
+				NetworkName: nc.NetworkName,
+			}
+			for _, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+				if util.NormalizeMAC(ncStatus.MACAddress) == macAddress && ncStatus.NetworkName == nc.NetworkName {
+					owner.IPAddress = ncStatus.AllocatedIPAddress
+					owner.IPPoolRef = ncStatus.IPPoolRef
+					owner.State = ncStatus.State
+					break
+				}
+			}
+			result.Owners = append(result.Owners, owner)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/vmnetcfg"
+	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
+)
+
+// macIndexedVmNetCfgCache serves the MAC index the vmnetcfg controller adds
+// to the cache.
+type macIndexedVmNetCfgCache struct {
+	fakeclient.VirtualMachineNetworkConfigCache
+}
+
+func (c macIndexedVmNetCfgCache) GetByIndex(indexName, key string) ([]*networkv1.VirtualMachineNetworkConfig, error) {
+	if indexName != indexer.VmNetCfgByMACIndex {
+		return c.VirtualMachineNetworkConfigCache.GetByIndex(indexName, key)
+	}
+
+	vmNetCfgs, err := c.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var result []*networkv1.VirtualMachineNetworkConfig
+	for _, vmNetCfg := range vmNetCfgs {
+		macAddresses, _ := util.VmNetCfgByMAC(vmNetCfg)
+		for _, macAddress := range macAddresses {
+			if macAddress == key {
+				result = append(result, vmNetCfg)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func TestLookupMACHandler(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		vmnetcfg.NewVmNetCfgBuilder("default", "vm-1").
+			WithVMName("vm-1").
+			WithNetworkConfig("", testMACAddress1, testNetworkName).
+			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).
+			IPPoolRef(testIPPoolNamespace+"/"+testIPPoolName).Build(),
+		// Written in uppercase by some tooling
+		vmnetcfg.NewVmNetCfgBuilder("default", "vm-2").
+			WithVMName("vm-2").
+			WithNetworkConfig("", strings.ToUpper(testMACAddress2), testNetworkName).Build(),
+	)
+	cache := macIndexedVmNetCfgCache{
+		VirtualMachineNetworkConfigCache: fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+	}
+	handler := lookupMACHandler(cache)
+
+	testCases := []struct {
+		name           string
+		mac            string
+		expectedStatus int
+		expectedOwners []macOwner
+	}{
+		{
+			name:           "allocated mac address",
+			mac:            testMACAddress1,
+			expectedStatus: http.StatusOK,
+			expectedOwners: []macOwner{{
+				VmNetCfg:    "default/vm-1",
+				VMName:      "vm-1",
+				NetworkName: testNetworkName,
+				IPAddress:   testIPAddress1,
+				IPPoolRef:   testIPPoolNamespace + "/" + testIPPoolName,
+				State:       networkv1.AllocatedState,
+			}},
+		},
+		{
+			name:           "mac address given in another case and format",
+			mac:            strings.ReplaceAll(testMACAddress1, ":", "-"),
+			expectedStatus: http.StatusOK,
+			expectedOwners: []macOwner{{
+				VmNetCfg:    "default/vm-1",
+				VMName:      "vm-1",
+				NetworkName: testNetworkName,
+				IPAddress:   testIPAddress1,
+				IPPoolRef:   testIPPoolNamespace + "/" + testIPPoolName,
+				State:       networkv1.AllocatedState,
+			}},
+		},
+		{
+			name:           "mac address not allocated yet",
+			mac:            testMACAddress2,
+			expectedStatus: http.StatusOK,
+			expectedOwners: []macOwner{{
+				VmNetCfg:    "default/vm-2",
+				VMName:      "vm-2",
+				NetworkName: testNetworkName,
+			}},
+		},
+		{
+			name:           "unknown mac address",
+			mac:            testMACAddress3,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "invalid mac address",
+			mac:            "foo",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/lookup?mac="+tc.mac, nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, tc.expectedStatus, rec.Code, tc.name)
+		if tc.expectedStatus != http.StatusOK {
+			continue
+		}
+
+		var result macLookup
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &result), tc.name)
+		assert.Equal(t, util.NormalizeMAC(tc.mac), result.MACAddress, tc.name)
+		assert.Equal(t, tc.expectedOwners, result.Owners, tc.name)
+	}
+}
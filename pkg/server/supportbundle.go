@@ -0,0 +1,278 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/audit"
+	"github.com/harvester/vm-dhcp-controller/pkg/cache"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+	ctlcorev1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/core/v1"
+	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/ipam"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+const (
+	// supportBundleDir is the top directory of the support bundle tarball
+	supportBundleDir = "vm-dhcp-supportbundle"
+	// supportBundleSectionLimit bounds the size of each file in the support
+	// bundle. Larger ones are cut and flagged in the manifest.
+	supportBundleSectionLimit = 4 << 20
+	// agentFetchTimeout bounds the time spent fetching the leases of each
+	// agent. The agents are fetched in parallel so the whole bundle stays
+	// below the write timeout of the server.
+	agentFetchTimeout = 5 * time.Second
+)
+
+// supportBundleSection is the manifest entry of a file in the support bundle.
+type supportBundleSection struct {
+	Name      string `json:"name"`
+	Size      int    `json:"size"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type supportBundleManifest struct {
+	CreatedAt metav1.Time            `json:"createdAt"`
+	Sections  []supportBundleSection `json:"sections"`
+}
+
+// agentLeases is the lease table of an agent, or why it couldn't be fetched.
+type agentLeases struct {
+	Pod         string            `json:"pod,omitempty"`
+	Unreachable bool              `json:"unreachable,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Leases      map[string]string `json:"leases,omitempty"`
+}
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+}
+
+// supportBundle gathers the state of the DHCP subsystem for troubleshooting.
+// The IPPool and VirtualMachineNetworkConfig objects are read from the API
+// server, while the allocator state and the action logs are only kept by the
+// leader.
+type supportBundle struct {
+	ippoolClient   ctlnetworkv1.IPPoolClient
+	vmnetcfgClient ctlnetworkv1.VirtualMachineNetworkConfigClient
+	ipAllocator    *ipam.IPAllocator
+	cacheAllocator *cache.CacheAllocator
+	denialLog      *audit.DenialLog
+	changeLog      *audit.ChangeLog
+	version        versionInfo
+	clock          clock.Clock
+
+	// fetchAgentLeases returns the lease table of the agent of the IPPool
+	fetchAgentLeases func(ctx context.Context, ipPool *networkv1.IPPool) agentLeases
+}
+
+// write assembles the support bundle as a gzipped tarball.
+func (b *supportBundle) write(ctx context.Context, w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	now := b.clock.Now()
+	manifest := supportBundleManifest{
+		CreatedAt: metav1.NewTime(now),
+	}
+
+	add := func(name string, v interface{}, sectionErr error) error {
+		section := supportBundleSection{Name: name}
+		payload, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		if len(payload) > supportBundleSectionLimit {
+			payload = payload[:supportBundleSectionLimit]
+			section.Truncated = true
+		}
+		section.Size = len(payload)
+		if sectionErr != nil {
+			section.Error = sectionErr.Error()
+		}
+		manifest.Sections = append(manifest.Sections, section)
+
+		return writeTarFile(tw, supportBundleDir+"/"+name, payload, now)
+	}
+
+	if err := add("version.json", b.version, nil); err != nil {
+		return err
+	}
+
+	ipPools, err := b.ippoolClient.List(metav1.NamespaceAll, metav1.ListOptions{})
+	if err != nil {
+		ipPools = &networkv1.IPPoolList{}
+	}
+	if err := add("ippools.json", ipPools.Items, err); err != nil {
+		return err
+	}
+
+	vmNetCfgs, err := b.vmnetcfgClient.List(metav1.NamespaceAll, metav1.ListOptions{})
+	if err != nil {
+		vmNetCfgs = &networkv1.VirtualMachineNetworkConfigList{}
+	}
+	if err := add("vmnetcfgs.json", vmNetCfgs.Items, err); err != nil {
+		return err
+	}
+
+	leases := b.fetchAllAgentLeases(ctx, ipPools.Items)
+
+	for i := range ipPools.Items {
+		ipPool := &ipPools.Items[i]
+		ipPoolKey := ipPool.Namespace + "/" + ipPool.Name
+		dir := "pools/" + ipPoolKey + "/"
+		ipamName := util.IPAMName(ipPool)
+
+		ips, err := b.ipAllocator.ListAll(ipamName)
+		if err := add(dir+"ipam.json", ips, err); err != nil {
+			return err
+		}
+
+		macs, err := b.cacheAllocator.ListAll(ipamName)
+		if err := add(dir+"cache.json", macs, err); err != nil {
+			return err
+		}
+
+		if err := add(dir+"agent-leases.json", leases[i], nil); err != nil {
+			return err
+		}
+
+		if err := add(dir+"denials.json", b.denialLog.List(ipPoolKey), nil); err != nil {
+			return err
+		}
+
+		if err := add(dir+"changes.json", b.changeLog.List(ipPoolKey), nil); err != nil {
+			return err
+		}
+	}
+
+	payload, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, supportBundleDir+"/manifest.json", payload, now); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// fetchAllAgentLeases fetches the lease tables of the agents of the IPPools
+// in parallel.
+func (b *supportBundle) fetchAllAgentLeases(ctx context.Context, ipPools []networkv1.IPPool) []agentLeases {
+	leases := make([]agentLeases, len(ipPools))
+
+	var wg sync.WaitGroup
+	for i := range ipPools {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, agentFetchTimeout)
+			defer cancel()
+			leases[i] = b.fetchAgentLeases(ctx, &ipPools[i])
+		}(i)
+	}
+	wg.Wait()
+
+	return leases
+}
+
+func writeTarFile(tw *tar.Writer, name string, payload []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(payload)),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(payload)
+	return err
+}
+
+// agentLeasesFetcher returns a function fetching the lease table of the agent
+// of an IPPool from its pod.
+func agentLeasesFetcher(podClient ctlcorev1.PodClient) func(ctx context.Context, ipPool *networkv1.IPPool) agentLeases {
+	return func(ctx context.Context, ipPool *networkv1.IPPool) agentLeases {
+		podRef := ipPool.Status.AgentPodRef
+		if podRef == nil {
+			return agentLeases{Unreachable: true, Error: "no agent deployed"}
+		}
+		leases := agentLeases{Pod: podRef.Namespace + "/" + podRef.Name}
+
+		pod, err := podClient.Get(podRef.Namespace, podRef.Name, metav1.GetOptions{})
+		if err != nil {
+			leases.Unreachable, leases.Error = true, err.Error()
+			return leases
+		}
+		if pod.Status.PodIP == "" {
+			leases.Unreachable, leases.Error = true, "agent pod has no ip address"
+			return leases
+		}
+
+		url := fmt.Sprintf("http://%s/leases", net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(defaultPort)))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			leases.Unreachable, leases.Error = true, err.Error()
+			return leases
+		}
+		// The transport asks for gzip and decompresses the response, while
+		// agents predating it answer uncompressed
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			leases.Unreachable, leases.Error = true, err.Error()
+			return leases
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			leases.Unreachable, leases.Error = true, fmt.Sprintf("agent answered with %s", resp.Status)
+			return leases
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&leases.Leases); err != nil {
+			leases.Unreachable, leases.Error = true, err.Error()
+		}
+
+		return leases
+	}
+}
+
+// supportBundleHandler serves the support bundle as a gzipped tarball. It's
+// assembled in memory first, so a failure is still reported as such.
+func supportBundleHandler(b *supportBundle) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := b.write(r.Context(), &buf); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprintf(w, "cannot assemble support bundle: %s", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+			fmt.Sprintf("%s-%s.tar.gz", supportBundleDir, b.clock.Now().UTC().Format("20060102T150405Z"))))
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			logrus.Error(err)
+		}
+	})
+}
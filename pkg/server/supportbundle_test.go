@@ -0,0 +1,183 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/audit"
+	"github.com/harvester/vm-dhcp-controller/pkg/cache"
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/ippool"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/vmnetcfg"
+	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/ipam"
+	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
+)
+
+func readSupportBundle(t *testing.T, r io.Reader) map[string][]byte {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = payload
+	}
+	return files
+}
+
+func TestSupportBundle(t *testing.T) {
+	const otherIPPoolName = "net-2"
+	ipPoolKey := testIPPoolNamespace + "/" + testIPPoolName
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	givenIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+		NetworkName(testNetworkName).
+		CIDR("192.168.0.0/24").
+		PoolRange("192.168.0.100", "192.168.0.101").
+		Allocated(testIPAddress1, testMACAddress1).
+		AgentPodRef("harvester-system", "default-net-1-agent", "rancher/harvester-vm-dhcp-agent:main-head", "").Build()
+	// The agent of this one is down
+	givenOtherIPPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, otherIPPoolName).
+		NetworkName(testIPPoolNamespace + "/" + otherIPPoolName).
+		CIDR("192.168.1.0/24").Build()
+	givenVmNetCfg := vmnetcfg.NewVmNetCfgBuilder("default", "vm-1").
+		WithVMName("vm-1").
+		WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).Build()
+
+	clientset := fake.NewSimpleClientset(givenIPPool, givenOtherIPPool, givenVmNetCfg)
+
+	ipAllocator := ipam.New()
+	if err := ipAllocator.NewIPSubnet(testNetworkName, "192.168.0.0/24", "192.168.0.100", "192.168.0.101", false); err != nil {
+		t.Fatal(err)
+	}
+	cacheAllocator := cache.New()
+	if err := cacheAllocator.NewMACSet(testNetworkName); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacheAllocator.AddMAC(testNetworkName, testMACAddress1, testIPAddress1); err != nil {
+		t.Fatal(err)
+	}
+
+	denialLog := audit.NewDenialLog(clock.NewFakeClock(now), audit.DefaultDenialLogSize)
+	denialLog.Record(ipPoolKey, audit.Denial{MACAddress: testMACAddress2, Reason: audit.DenialReasonPoolExhausted, VmNetCfg: "default/vm-2", VMName: "vm-2"})
+	changeLog := audit.NewChangeLog(audit.DefaultChangeLogSize)
+	changeLog.Record(ipPoolKey, 1, []audit.Change{{Type: audit.ChangeTypeAllocated, IPAddress: testIPAddress1, MACAddress: testMACAddress1}})
+
+	b := &supportBundle{
+		ippoolClient:   fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+		vmnetcfgClient: fakeclient.VirtualMachineNetworkConfigClient(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+		ipAllocator:    ipAllocator,
+		cacheAllocator: cacheAllocator,
+		denialLog:      denialLog,
+		changeLog:      changeLog,
+		version:        versionInfo{Version: "v1.0.0", GitCommit: "abcdef"},
+		clock:          clock.NewFakeClock(now),
+		fetchAgentLeases: func(ctx context.Context, ipPool *networkv1.IPPool) agentLeases {
+			if ipPool.Name == otherIPPoolName {
+				return agentLeases{Unreachable: true, Error: "context deadline exceeded"}
+			}
+			return agentLeases{
+				Pod:    "harvester-system/default-net-1-agent",
+				Leases: map[string]string{testMACAddress1: `{"ClientIP":"` + testIPAddress1 + `"}`},
+			}
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, b.write(context.Background(), &buf))
+	files := readSupportBundle(t, &buf)
+
+	poolDir := supportBundleDir + "/pools/" + ipPoolKey + "/"
+	otherPoolDir := supportBundleDir + "/pools/" + testIPPoolNamespace + "/" + otherIPPoolName + "/"
+	expectedFiles := []string{
+		supportBundleDir + "/manifest.json",
+		supportBundleDir + "/version.json",
+		supportBundleDir + "/ippools.json",
+		supportBundleDir + "/vmnetcfgs.json",
+	}
+	for _, dir := range []string{poolDir, otherPoolDir} {
+		for _, name := range []string{"ipam.json", "cache.json", "agent-leases.json", "denials.json", "changes.json"} {
+			expectedFiles = append(expectedFiles, dir+name)
+		}
+	}
+	var actualFiles []string
+	for name := range files {
+		actualFiles = append(actualFiles, name)
+	}
+	assert.ElementsMatch(t, expectedFiles, actualFiles)
+
+	var manifest supportBundleManifest
+	assert.Nil(t, json.Unmarshal(files[supportBundleDir+"/manifest.json"], &manifest))
+	assert.Equal(t, now, manifest.CreatedAt.UTC())
+	assert.Len(t, manifest.Sections, len(expectedFiles)-1, "every file but the manifest should be listed")
+	for _, section := range manifest.Sections {
+		assert.Equal(t, len(files[supportBundleDir+"/"+section.Name]), section.Size, section.Name)
+		assert.False(t, section.Truncated, section.Name)
+		switch section.Name {
+		case "pools/default/net-2/ipam.json", "pools/default/net-2/cache.json":
+			assert.NotEmpty(t, section.Error, "missing allocator state of %s should be reported", section.Name)
+		default:
+			assert.Empty(t, section.Error, section.Name)
+		}
+	}
+
+	var version versionInfo
+	assert.Nil(t, json.Unmarshal(files[supportBundleDir+"/version.json"], &version))
+	assert.Equal(t, versionInfo{Version: "v1.0.0", GitCommit: "abcdef"}, version)
+
+	var ipPools []networkv1.IPPool
+	assert.Nil(t, json.Unmarshal(files[supportBundleDir+"/ippools.json"], &ipPools))
+	assert.Len(t, ipPools, 2)
+
+	var vmNetCfgs []networkv1.VirtualMachineNetworkConfig
+	assert.Nil(t, json.Unmarshal(files[supportBundleDir+"/vmnetcfgs.json"], &vmNetCfgs))
+	if assert.Len(t, vmNetCfgs, 1) {
+		assert.Equal(t, givenVmNetCfg.Status, vmNetCfgs[0].Status, "vmnetcfgs should come with their status")
+	}
+
+	var ips map[string]string
+	assert.Nil(t, json.Unmarshal(files[poolDir+"ipam.json"], &ips))
+	assert.Equal(t, map[string]string{"192.168.0.100": "false", "192.168.0.101": "false"}, ips)
+
+	var macs map[string]string
+	assert.Nil(t, json.Unmarshal(files[poolDir+"cache.json"], &macs))
+	assert.Equal(t, map[string]string{testMACAddress1: testIPAddress1}, macs)
+
+	var leases, otherLeases agentLeases
+	assert.Nil(t, json.Unmarshal(files[poolDir+"agent-leases.json"], &leases))
+	assert.False(t, leases.Unreachable)
+	assert.Len(t, leases.Leases, 1)
+	assert.Nil(t, json.Unmarshal(files[otherPoolDir+"agent-leases.json"], &otherLeases))
+	assert.True(t, otherLeases.Unreachable, "agent not answering should be marked unreachable")
+
+	var denials []audit.Denial
+	assert.Nil(t, json.Unmarshal(files[poolDir+"denials.json"], &denials))
+	assert.Len(t, denials, 1)
+
+	var changes []audit.Change
+	assert.Nil(t, json.Unmarshal(files[poolDir+"changes.json"], &changes))
+	assert.Equal(t, []audit.Change{{Revision: 1, Type: audit.ChangeTypeAllocated, IPAddress: testIPAddress1, MACAddress: testMACAddress1}}, changes)
+}
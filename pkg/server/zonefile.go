@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"unicode"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+type zoneRecord struct {
+	ip       netip.Addr
+	hostname string
+	comment  string
+}
+
+// buildZoneFile renders the leases of the IPPool as zone file records named
+// after the VMs holding them. Names are qualified with the IPPool's domain
+// name if it has one. PTR records need the names to be fully qualified, so
+// they're only available for IPPools with a domain name. Known external hosts
+// are exported as well, named after their IP address and marked external.
+func buildZoneFile(ipPool *networkv1.IPPool, vmNetCfgs []*networkv1.VirtualMachineNetworkConfig, withPTR bool) (string, error) {
+	var domain string
+	if ipPool.Spec.IPv4Config.DomainName != nil {
+		domain = strings.TrimSuffix(*ipPool.Spec.IPv4Config.DomainName, ".")
+	}
+	if withPTR && domain == "" {
+		return "", fmt.Errorf("ippool %s/%s has no domain name for ptr records", ipPool.Namespace, ipPool.Name)
+	}
+
+	// Only trust the VirtualMachineNetworkConfig records agreeing with the
+	// IPPool on both the IP and the MAC address
+	leases := util.Leases(ipPool.Status.IPv4)
+	var records []zoneRecord
+	for _, vmNetCfg := range vmNetCfgs {
+		for _, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+			if ncStatus.State != networkv1.AllocatedState {
+				continue
+			}
+			if mac, ok := leases[ncStatus.AllocatedIPAddress]; !ok || mac != ncStatus.MACAddress {
+				continue
+			}
+			ip, err := netip.ParseAddr(ncStatus.AllocatedIPAddress)
+			if err != nil {
+				return "", err
+			}
+			records = append(records, zoneRecord{
+				ip:       ip,
+				hostname: vmNetCfg.Spec.VMName,
+			})
+		}
+	}
+
+	for _, host := range ipPool.Spec.KnownExternalHosts {
+		ip, err := netip.ParseAddr(host.IP)
+		if err != nil {
+			return "", err
+		}
+		comment := "external"
+		if host.Description != "" {
+			comment += ": " + host.Description
+		}
+		records = append(records, zoneRecord{
+			ip:       ip,
+			hostname: externalHostname(ip),
+			comment:  comment,
+		})
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ip.Less(records[j].ip)
+	})
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "; generated by vm-dhcp-controller from ippool %s/%s\n", ipPool.Namespace, ipPool.Name)
+	for _, record := range records {
+		fmt.Fprintf(&sb, "%s\tIN\tA\t%s%s\n", qualifyName(record.hostname, domain), record.ip, formatComment(record.comment))
+	}
+	if withPTR {
+		for _, record := range records {
+			fmt.Fprintf(&sb, "%s\tIN\tPTR\t%s%s\n", reverseName(record.ip), qualifyName(record.hostname, domain), formatComment(record.comment))
+		}
+	}
+
+	return sb.String(), nil
+}
+
+func qualifyName(hostname, domain string) string {
+	if domain == "" {
+		return hostname
+	}
+	return hostname + "." + domain + "."
+}
+
+func externalHostname(ip netip.Addr) string {
+	return "external-" + strings.ReplaceAll(ip.String(), ".", "-")
+}
+
+// formatComment renders the comment at the end of a record. Control
+// characters are replaced by spaces, so a comment never spills over into a
+// record of its own.
+func formatComment(comment string) string {
+	if comment == "" {
+		return ""
+	}
+	return "\t; " + strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, comment)
+}
+
+func reverseName(ip netip.Addr) string {
+	octets := ip.As4()
+	return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", octets[3], octets[2], octets[1], octets[0])
+}
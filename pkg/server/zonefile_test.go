@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/ippool"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/vmnetcfg"
+	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
+)
+
+const (
+	testIPPoolNamespace = "default"
+	testIPPoolName      = "net-1"
+	testNetworkName     = "default/net-1"
+	testDomainName      = "example.com"
+
+	testIPAddress1  = "192.168.0.111"
+	testIPAddress2  = "192.168.0.12"
+	testIPAddress3  = "192.168.0.177"
+	testMACAddress1 = "11:22:33:44:55:66"
+	testMACAddress2 = "22:33:44:55:66:77"
+	testMACAddress3 = "33:44:55:66:77:88"
+)
+
+func newTestVmNetCfgs() []*networkv1.VirtualMachineNetworkConfig {
+	return []*networkv1.VirtualMachineNetworkConfig{
+		vmnetcfg.NewVmNetCfgBuilder("default", "vm-1").
+			WithVMName("vm-1").
+			WithNetworkConfigStatus(testIPAddress1, testMACAddress1, testNetworkName, networkv1.AllocatedState).Build(),
+		vmnetcfg.NewVmNetCfgBuilder("default", "vm-2").
+			WithVMName("vm-2").
+			WithNetworkConfigStatus(testIPAddress2, testMACAddress2, testNetworkName, networkv1.AllocatedState).Build(),
+		// The IPPool doesn't agree with the record
+		vmnetcfg.NewVmNetCfgBuilder("default", "vm-3").
+			WithVMName("vm-3").
+			WithNetworkConfigStatus(testIPAddress3, testMACAddress1, testNetworkName, networkv1.AllocatedState).Build(),
+	}
+}
+
+func TestBuildZoneFile(t *testing.T) {
+	header := fmt.Sprintf("; generated by vm-dhcp-controller from ippool %s/%s\n", testIPPoolNamespace, testIPPoolName)
+
+	testCases := []struct {
+		name     string
+		ipPool   *networkv1.IPPool
+		withPTR  bool
+		expected string
+		err      error
+	}{
+		{
+			name: "a records without domain name",
+			ipPool: ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+				Allocated(testIPAddress1, testMACAddress1).
+				Allocated(testIPAddress2, testMACAddress2).
+				Allocated(testIPAddress3, testMACAddress3).Build(),
+			expected: header +
+				"vm-2\tIN\tA\t192.168.0.12\n" +
+				"vm-1\tIN\tA\t192.168.0.111\n",
+		},
+		{
+			name: "a and ptr records with domain name",
+			ipPool: ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+				DomainName(testDomainName+".").
+				AllocationEntry(testIPAddress1, networkv1.AllocationTypeLease, testMACAddress1).
+				AllocationEntry(testIPAddress2, networkv1.AllocationTypeLease, testMACAddress2).
+				AllocationEntry("192.168.0.254", networkv1.AllocationTypeReserved, "").Build(),
+			withPTR: true,
+			expected: header +
+				"vm-2.example.com.\tIN\tA\t192.168.0.12\n" +
+				"vm-1.example.com.\tIN\tA\t192.168.0.111\n" +
+				"12.0.168.192.in-addr.arpa.\tIN\tPTR\tvm-2.example.com.\n" +
+				"111.0.168.192.in-addr.arpa.\tIN\tPTR\tvm-1.example.com.\n",
+		},
+		{
+			name: "known external hosts",
+			ipPool: ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+				DomainName(testDomainName).
+				KnownExternalHost("192.168.0.50", testMACAddress3, "printer").
+				KnownExternalHost("192.168.0.200", "", "").
+				AllocationEntry(testIPAddress1, networkv1.AllocationTypeLease, testMACAddress1).
+				AllocationEntry("192.168.0.50", networkv1.AllocationTypeExcluded, "").
+				AllocationEntry("192.168.0.200", networkv1.AllocationTypeExcluded, "").Build(),
+			withPTR: true,
+			expected: header +
+				"external-192-168-0-50.example.com.\tIN\tA\t192.168.0.50\t; external: printer\n" +
+				"vm-1.example.com.\tIN\tA\t192.168.0.111\n" +
+				"external-192-168-0-200.example.com.\tIN\tA\t192.168.0.200\t; external\n" +
+				"50.0.168.192.in-addr.arpa.\tIN\tPTR\texternal-192-168-0-50.example.com.\t; external: printer\n" +
+				"111.0.168.192.in-addr.arpa.\tIN\tPTR\tvm-1.example.com.\n" +
+				"200.0.168.192.in-addr.arpa.\tIN\tPTR\texternal-192-168-0-200.example.com.\t; external\n",
+		},
+		{
+			name: "description with a newline",
+			ipPool: ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+				KnownExternalHost("192.168.0.50", "", "printer\nevil\tIN\tA\t10.0.0.1").Build(),
+			expected: header +
+				"external-192-168-0-50\tIN\tA\t192.168.0.50\t; external: printer evil IN A 10.0.0.1\n",
+		},
+		{
+			name: "ptr records without domain name",
+			ipPool: ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+				Allocated(testIPAddress1, testMACAddress1).Build(),
+			withPTR: true,
+			err:     fmt.Errorf("ippool %s/%s has no domain name for ptr records", testIPPoolNamespace, testIPPoolName),
+		},
+	}
+
+	for _, tc := range testCases {
+		zoneFile, err := buildZoneFile(tc.ipPool, newTestVmNetCfgs(), tc.withPTR)
+		if tc.err != nil {
+			assert.Equal(t, tc.err, err, tc.name)
+			continue
+		}
+		assert.Nil(t, err, tc.name)
+		assert.Equal(t, tc.expected, zoneFile, tc.name)
+	}
+}
+
+func TestZoneFileHandler(t *testing.T) {
+	ipPool := ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+		Allocated(testIPAddress1, testMACAddress1).
+		Allocated(testIPAddress2, testMACAddress2).Build()
+	vmNetCfgs := newTestVmNetCfgs()
+	clientset := fake.NewSimpleClientset(ipPool, vmNetCfgs[0], vmNetCfgs[1])
+
+	testCases := []struct {
+		name           string
+		leader         bool
+		expectedStatus int
+		expected       string
+	}{
+		{
+			name:           "leader",
+			leader:         true,
+			expectedStatus: http.StatusOK,
+			expected: fmt.Sprintf("; generated by vm-dhcp-controller from ippool %s/%s\n", testIPPoolNamespace, testIPPoolName) +
+				"vm-2\tIN\tA\t192.168.0.12\n" +
+				"vm-1\tIN\tA\t192.168.0.111\n",
+		},
+		{
+			name:           "not the leader",
+			leader:         false,
+			expectedStatus: http.StatusServiceUnavailable,
+			expected:       "not the leader",
+		},
+	}
+
+	for _, tc := range testCases {
+		leader := tc.leader
+		router := mux.NewRouter()
+		router.Handle("/pools/{namespace}/{name}/zonefile", zoneFileHandler(
+			fakeclient.IPPoolClient(clientset.NetworkV1alpha1().IPPools),
+			fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs),
+			func() bool { return leader },
+		))
+
+		req := httptest.NewRequest(http.MethodGet, "/pools/"+testIPPoolNamespace+"/"+testIPPoolName+"/zonefile", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, tc.expectedStatus, rec.Code, tc.name)
+		assert.Equal(t, tc.expected, rec.Body.String(), tc.name)
+	}
+}
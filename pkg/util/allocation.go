@@ -0,0 +1,273 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+)
+
+// AllocationEntries returns the allocation records of the given status as
+// typed entries. Records still in the legacy format are converted on the fly
+// so that unmigrated IPPools can be read as well. Typed entries win if an IP
+// address shows up in both formats.
+func AllocationEntries(ipv4Status *networkv1.IPv4Status) map[string]networkv1.AllocationEntry {
+	if ipv4Status == nil {
+		return nil
+	}
+
+	entries := make(map[string]networkv1.AllocationEntry, len(ipv4Status.Entries)+len(ipv4Status.Allocated))
+	for ip, val := range ipv4Status.Allocated {
+		entries[ip] = ConvertAllocated(val)
+	}
+	for ip, entry := range ipv4Status.Entries {
+		entries[ip] = entry
+	}
+
+	return entries
+}
+
+// ConvertAllocated converts a value of the legacy allocated map to its typed
+// counterpart.
+func ConvertAllocated(val string) networkv1.AllocationEntry {
+	switch val {
+	case ExcludedMark:
+		return networkv1.AllocationEntry{Type: networkv1.AllocationTypeExcluded}
+	case ReservedMark:
+		return networkv1.AllocationEntry{Type: networkv1.AllocationTypeReserved}
+	default:
+		return networkv1.AllocationEntry{Type: networkv1.AllocationTypeLease, Owner: val}
+	}
+}
+
+func legacyAllocated(entry networkv1.AllocationEntry) string {
+	switch entry.Type {
+	case networkv1.AllocationTypeExcluded:
+		return ExcludedMark
+	case networkv1.AllocationTypeReserved:
+		return ReservedMark
+	default:
+		return entry.Owner
+	}
+}
+
+// Leases returns the IP addresses leased to MAC addresses, leaving out the
+// excluded and reserved ones.
+func Leases(ipv4Status *networkv1.IPv4Status) map[string]string {
+	return leases(AllocationEntries(ipv4Status), false)
+}
+
+// ServedLeases returns the IP addresses leased to MAC addresses the agent
+// serves over DHCP, leaving out the reserveOnly leases as well.
+func ServedLeases(ipv4Status *networkv1.IPv4Status) map[string]string {
+	return leases(AllocationEntries(ipv4Status), true)
+}
+
+// IPv6Leases returns the IPv6 addresses leased to MAC addresses.
+func IPv6Leases(ipv6Status *networkv1.IPv6Status) map[string]string {
+	if ipv6Status == nil {
+		return make(map[string]string)
+	}
+	return leases(ipv6Status.Entries, false)
+}
+
+// ServedIPv6Leases returns the IPv6 addresses leased to MAC addresses the
+// agent serves over DHCPv6.
+func ServedIPv6Leases(ipv6Status *networkv1.IPv6Status) map[string]string {
+	if ipv6Status == nil {
+		return make(map[string]string)
+	}
+	return leases(ipv6Status.Entries, true)
+}
+
+func leases(entries map[string]networkv1.AllocationEntry, servedOnly bool) map[string]string {
+	leases := make(map[string]string)
+	for ip, entry := range entries {
+		if entry.Type != networkv1.AllocationTypeLease {
+			continue
+		}
+		if servedOnly && entry.Mode == networkv1.NetworkConfigModeReserveOnly {
+			continue
+		}
+		leases[ip] = entry.Owner
+	}
+	return leases
+}
+
+// DefaultRoutes returns whether each IP address leased from the IPPool gets
+// the router as its default route. Records in the legacy format carry no
+// settings, so they go with the setting of the IPPool.
+func DefaultRoutes(ipPool *networkv1.IPPool) map[string]bool {
+	defaultRoutes := make(map[string]bool)
+	for ip, entry := range AllocationEntries(ipPool.Status.IPv4) {
+		if entry.Type != networkv1.AllocationTypeLease {
+			continue
+		}
+		defaultRoutes[ip] = DefaultRouteEnabled(ipPool, entry.DefaultRoute)
+	}
+	return defaultRoutes
+}
+
+// DefaultRouteEnabled reports whether an interface with the given setting
+// gets the router of the IPPool as its default route. Interfaces without a
+// setting go with the IPPool's, which defaults to true.
+func DefaultRouteEnabled(ipPool *networkv1.IPPool, defaultRoute *bool) bool {
+	if defaultRoute != nil {
+		return *defaultRoute
+	}
+	return ipPool.Spec.IPv4Config.DefaultRoute == nil || *ipPool.Spec.IPv4Config.DefaultRoute
+}
+
+// SetAllocationEntry records the entry for the IP address in whichever format
+// the status is currently in. An IPPool whose status has any typed entries is
+// deemed migrated. The timestamp of an unchanged entry is preserved, new ones
+// are stamped with now. The settings of the lease, which the legacy format
+// cannot hold, are updated in place. A reserveOnly lease, which the legacy
+// format couldn't tell from one to serve, migrates the status to typed
+// entries.
+func SetAllocationEntry(ipv4Status *networkv1.IPv4Status, ip string, entry networkv1.AllocationEntry, now time.Time) {
+	if ipv4Status.Entries == nil && entry.Mode == networkv1.NetworkConfigModeReserveOnly {
+		MigrateAllocated(ipv4Status, now)
+		if ipv4Status.Entries == nil {
+			ipv4Status.Entries = make(map[string]networkv1.AllocationEntry)
+		}
+	}
+
+	if ipv4Status.Entries == nil {
+		if ipv4Status.Allocated == nil {
+			ipv4Status.Allocated = make(map[string]string)
+		}
+		ipv4Status.Allocated[ip] = legacyAllocated(entry)
+		return
+	}
+
+	setTypedEntry(ipv4Status.Entries, ip, entry, now)
+}
+
+// SetIPv6AllocationEntry records the entry for the IPv6 address, the same way
+// SetAllocationEntry does for typed entries.
+func SetIPv6AllocationEntry(ipv6Status *networkv1.IPv6Status, ip string, entry networkv1.AllocationEntry, now time.Time) {
+	if ipv6Status.Entries == nil {
+		ipv6Status.Entries = make(map[string]networkv1.AllocationEntry)
+	}
+	setTypedEntry(ipv6Status.Entries, ip, entry, now)
+}
+
+func setTypedEntry(entries map[string]networkv1.AllocationEntry, ip string, entry networkv1.AllocationEntry, now time.Time) {
+	if existing, ok := entries[ip]; ok && existing.Type == entry.Type && existing.Owner == entry.Owner {
+		existing.DefaultRoute = entry.DefaultRoute
+		existing.Mode = entry.Mode
+		// Backfills the leases recorded without their namespace
+		if entry.Namespace != "" {
+			existing.Namespace = entry.Namespace
+		}
+		entries[ip] = existing
+		return
+	}
+
+	if entry.Since == nil {
+		since := metav1.NewTime(now)
+		entry.Since = &since
+	}
+	entries[ip] = entry
+}
+
+// DeleteAllocationEntry removes the record of the IP address in both formats.
+func DeleteAllocationEntry(ipv4Status *networkv1.IPv4Status, ip string) {
+	if ipv4Status == nil {
+		return
+	}
+	delete(ipv4Status.Allocated, ip)
+	delete(ipv4Status.Entries, ip)
+}
+
+// MigrateAllocated converts the legacy allocated map of the status into typed
+// entries in place, stamping them with now. It reports whether anything was
+// migrated.
+func MigrateAllocated(ipv4Status *networkv1.IPv4Status, now time.Time) bool {
+	if ipv4Status == nil || len(ipv4Status.Allocated) == 0 {
+		return false
+	}
+
+	since := metav1.NewTime(now)
+	if ipv4Status.Entries == nil {
+		ipv4Status.Entries = make(map[string]networkv1.AllocationEntry, len(ipv4Status.Allocated))
+	}
+	for ip, val := range ipv4Status.Allocated {
+		if _, ok := ipv4Status.Entries[ip]; ok {
+			continue
+		}
+		entry := ConvertAllocated(val)
+		entry.Since = &since
+		ipv4Status.Entries[ip] = entry
+	}
+	ipv4Status.Allocated = nil
+
+	return true
+}
+
+// IsMixedAllocationFormat reports whether the status carries records in both
+// the legacy and the typed format, which never happens after a migration.
+func IsMixedAllocationFormat(ipv4Status *networkv1.IPv4Status) bool {
+	return ipv4Status != nil && len(ipv4Status.Allocated) > 0 && len(ipv4Status.Entries) > 0
+}
+
+// ReservedIPAddress returns the IP address reserved for the MAC address in the
+// IPPool, if any.
+func ReservedIPAddress(ipPool *networkv1.IPPool, macAddress string) (string, bool) {
+	for _, reservation := range ipPool.Spec.IPv4Config.Reservations {
+		if NormalizeMAC(reservation.MACAddress) == NormalizeMAC(macAddress) {
+			return reservation.IPAddress, true
+		}
+	}
+	return "", false
+}
+
+// ReservationOwner returns the MAC address the IP address is reserved for in
+// the IPPool, if any.
+func ReservationOwner(ipPool *networkv1.IPPool, ipAddress string) (string, bool) {
+	for _, reservation := range ipPool.Spec.IPv4Config.Reservations {
+		if reservation.IPAddress == ipAddress {
+			return reservation.MACAddress, true
+		}
+	}
+	return "", false
+}
+
+// ExternalIPAMFailurePolicy returns the failure policy of the external IPAM of
+// the IPPool, which defaults to Fail.
+func ExternalIPAMFailurePolicy(ipPool *networkv1.IPPool) networkv1.ExternalIPAMFailurePolicy {
+	if ipPool.Spec.ExternalIPAM == nil || ipPool.Spec.ExternalIPAM.FailurePolicy == "" {
+		return networkv1.ExternalIPAMFailurePolicyFail
+	}
+	return ipPool.Spec.ExternalIPAM.FailurePolicy
+}
+
+// PinnedAllocation is an IP address allocated to a VM, as pinned in an
+// annotation of the VM so it outlives the IPPool it was allocated from.
+type PinnedAllocation struct {
+	MACAddress string `json:"macAddress"`
+	IPAddress  string `json:"ipAddress"`
+	// IPPool is the IPPool the IP address was allocated from, as
+	// <namespace>/<name>
+	IPPool string `json:"ipPool"`
+}
+
+// PinnedAllocations returns the allocations pinned in the annotation of the
+// given annotations, if any.
+func PinnedAllocations(annotations map[string]string, annotation string) ([]PinnedAllocation, error) {
+	value, ok := annotations[annotation]
+	if !ok || value == "" {
+		return nil, nil
+	}
+
+	var pinned []PinnedAllocation
+	if err := json.Unmarshal([]byte(value), &pinned); err != nil {
+		return nil, fmt.Errorf("failed to parse annotation %s: %w", annotation, err)
+	}
+
+	return pinned, nil
+}
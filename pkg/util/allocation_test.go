@@ -0,0 +1,151 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+)
+
+func TestConvertAllocated_RoundTrip(t *testing.T) {
+	testCases := []struct {
+		name     string
+		legacy   string
+		expected networkv1.AllocationEntry
+	}{
+		{
+			name:     "lease",
+			legacy:   "11:22:33:44:55:66",
+			expected: networkv1.AllocationEntry{Type: networkv1.AllocationTypeLease, Owner: "11:22:33:44:55:66"},
+		},
+		{
+			name:     "excluded",
+			legacy:   ExcludedMark,
+			expected: networkv1.AllocationEntry{Type: networkv1.AllocationTypeExcluded},
+		},
+		{
+			name:     "reserved",
+			legacy:   ReservedMark,
+			expected: networkv1.AllocationEntry{Type: networkv1.AllocationTypeReserved},
+		},
+	}
+
+	for _, tc := range testCases {
+		entry := ConvertAllocated(tc.legacy)
+		assert.Equal(t, tc.expected, entry, tc.name)
+		assert.Equal(t, tc.legacy, legacyAllocated(entry), tc.name)
+	}
+}
+
+func TestMigrateAllocated(t *testing.T) {
+	ipv4Status := &networkv1.IPv4Status{
+		Allocated: map[string]string{
+			"192.168.0.1":   ReservedMark,
+			"192.168.0.10":  "11:22:33:44:55:66",
+			"192.168.0.100": ExcludedMark,
+		},
+	}
+
+	before := AllocationEntries(ipv4Status)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.True(t, MigrateAllocated(ipv4Status, now))
+	assert.Nil(t, ipv4Status.Allocated)
+	assert.Len(t, ipv4Status.Entries, 3)
+	for ip, entry := range ipv4Status.Entries {
+		assert.Equal(t, metav1.NewTime(now), *entry.Since, ip)
+		entry.Since = nil
+		assert.Equal(t, before[ip], entry, ip)
+	}
+
+	assert.False(t, MigrateAllocated(ipv4Status, now.Add(time.Hour)), "migrating twice should be a no-op")
+}
+
+func TestAllocationEntries_TypedEntriesWin(t *testing.T) {
+	ipv4Status := &networkv1.IPv4Status{
+		Allocated: map[string]string{
+			"192.168.0.10": "11:22:33:44:55:66",
+			"192.168.0.20": ExcludedMark,
+		},
+		Entries: map[string]networkv1.AllocationEntry{
+			"192.168.0.10": {Type: networkv1.AllocationTypeLease, Owner: "66:55:44:33:22:11"},
+		},
+	}
+
+	assert.True(t, IsMixedAllocationFormat(ipv4Status))
+	assert.Equal(t, map[string]networkv1.AllocationEntry{
+		"192.168.0.10": {Type: networkv1.AllocationTypeLease, Owner: "66:55:44:33:22:11"},
+		"192.168.0.20": {Type: networkv1.AllocationTypeExcluded},
+	}, AllocationEntries(ipv4Status))
+	assert.Equal(t, map[string]string{
+		"192.168.0.10": "66:55:44:33:22:11",
+	}, Leases(ipv4Status))
+}
+
+func TestSetAllocationEntry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	legacy := &networkv1.IPv4Status{}
+	SetAllocationEntry(legacy, "192.168.0.10", networkv1.AllocationEntry{Type: networkv1.AllocationTypeLease, Owner: "11:22:33:44:55:66"}, now)
+	assert.Equal(t, map[string]string{"192.168.0.10": "11:22:33:44:55:66"}, legacy.Allocated)
+	assert.Nil(t, legacy.Entries)
+
+	since := metav1.NewTime(now.Add(-time.Second))
+	typed := &networkv1.IPv4Status{
+		Entries: map[string]networkv1.AllocationEntry{
+			"192.168.0.10": {Type: networkv1.AllocationTypeLease, Owner: "11:22:33:44:55:66", Since: &since},
+		},
+	}
+
+	SetAllocationEntry(typed, "192.168.0.10", networkv1.AllocationEntry{Type: networkv1.AllocationTypeLease, Owner: "11:22:33:44:55:66"}, now)
+	assert.Equal(t, &since, typed.Entries["192.168.0.10"].Since, "unchanged entry should keep its timestamp")
+
+	noDefaultRoute := false
+	SetAllocationEntry(typed, "192.168.0.10", networkv1.AllocationEntry{Type: networkv1.AllocationTypeLease, Owner: "11:22:33:44:55:66", DefaultRoute: &noDefaultRoute}, now)
+	assert.Equal(t, &noDefaultRoute, typed.Entries["192.168.0.10"].DefaultRoute, "settings of the lease should be updated")
+	assert.Equal(t, &since, typed.Entries["192.168.0.10"].Since, "entry with new settings should keep its timestamp")
+
+	SetAllocationEntry(typed, "192.168.0.10", networkv1.AllocationEntry{Type: networkv1.AllocationTypeLease, Owner: "66:55:44:33:22:11"}, now)
+	assert.Equal(t, "66:55:44:33:22:11", typed.Entries["192.168.0.10"].Owner)
+	assert.Equal(t, metav1.NewTime(now), *typed.Entries["192.168.0.10"].Since)
+	assert.Nil(t, typed.Allocated)
+
+	DeleteAllocationEntry(typed, "192.168.0.10")
+	assert.Empty(t, typed.Entries)
+
+	// The legacy format can't tell a reserveOnly lease from one to serve
+	SetAllocationEntry(legacy, "192.168.0.11", networkv1.AllocationEntry{Type: networkv1.AllocationTypeLease, Owner: "22:33:44:55:66:77", Mode: networkv1.NetworkConfigModeReserveOnly}, now)
+	assert.Nil(t, legacy.Allocated)
+	assert.Equal(t, networkv1.NetworkConfigModeReserveOnly, legacy.Entries["192.168.0.11"].Mode)
+	assert.Equal(t, "11:22:33:44:55:66", legacy.Entries["192.168.0.10"].Owner, "legacy records should be migrated along")
+	assert.Equal(t, map[string]string{"192.168.0.10": "11:22:33:44:55:66"}, ServedLeases(legacy))
+	assert.Len(t, Leases(legacy), 2)
+
+	SetAllocationEntry(legacy, "192.168.0.11", networkv1.AllocationEntry{Type: networkv1.AllocationTypeLease, Owner: "22:33:44:55:66:77", Mode: networkv1.NetworkConfigModeDHCP}, now)
+	assert.Len(t, ServedLeases(legacy), 2, "switching the mode should update the lease in place")
+}
+
+func TestSetIPv6AllocationEntry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Empty(t, IPv6Leases(nil))
+	assert.Empty(t, ServedIPv6Leases(nil))
+
+	ipv6Status := &networkv1.IPv6Status{}
+	SetIPv6AllocationEntry(ipv6Status, "2001:db8::10", networkv1.AllocationEntry{Type: networkv1.AllocationTypeLease, Owner: "11:22:33:44:55:66"}, now)
+	SetIPv6AllocationEntry(ipv6Status, "2001:db8::11", networkv1.AllocationEntry{Type: networkv1.AllocationTypeLease, Owner: "22:33:44:55:66:77", Mode: networkv1.NetworkConfigModeReserveOnly}, now)
+	SetIPv6AllocationEntry(ipv6Status, "2001:db8::1", networkv1.AllocationEntry{Type: networkv1.AllocationTypeReserved}, now)
+	assert.Equal(t, metav1.NewTime(now), *ipv6Status.Entries["2001:db8::10"].Since)
+
+	SetIPv6AllocationEntry(ipv6Status, "2001:db8::10", networkv1.AllocationEntry{Type: networkv1.AllocationTypeLease, Owner: "11:22:33:44:55:66"}, now.Add(time.Hour))
+	assert.Equal(t, metav1.NewTime(now), *ipv6Status.Entries["2001:db8::10"].Since, "unchanged entry should keep its timestamp")
+
+	assert.Equal(t, map[string]string{
+		"2001:db8::10": "11:22:33:44:55:66",
+		"2001:db8::11": "22:33:44:55:66:77",
+	}, IPv6Leases(ipv6Status))
+	assert.Equal(t, map[string]string{"2001:db8::10": "11:22:33:44:55:66"}, ServedIPv6Leases(ipv6Status))
+}
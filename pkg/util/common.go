@@ -3,9 +3,11 @@ package util
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"net"
 	"strings"
 
 	"github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io"
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
 )
 
 const (
@@ -15,9 +17,70 @@ const (
 	AgentSuffixName         = "agent"
 	NodeArgsAnnotationKey   = "rke2.io/node-args"
 	ServiceCIDRFlag         = "--service-cidr"
+	ClusterCIDRFlag         = "--cluster-cidr"
 	ManagementNodeLabelKey  = "node-role.kubernetes.io/control-plane"
 	IPPoolNamespaceLabelKey = network.GroupName + "/ippool-namespace"
 	IPPoolNameLabelKey      = network.GroupName + "/ippool-name"
+	IPPoolUIDLabelKey       = network.GroupName + "/ippool-uid"
+
+	NetworkVerificationAnnotationKey = network.GroupName + "/network-verification"
+	// DeclinedIPsAnnotationKey lists, as JSON, the DHCPDECLINEs an agent
+	// received. It's set on the agent Pod by the agent itself.
+	DeclinedIPsAnnotationKey = network.GroupName + "/declined-ips"
+
+	// DelegatedPoolsAnnotationKey lists the IPPools, as comma-separated
+	// namespace/name pairs, sharing the subnet of the annotated IPPool.
+	DelegatedPoolsAnnotationKey = network.GroupName + "/delegated-pools"
+	// DelegatedFromAnnotationKey names the IPPool, as a namespace/name pair,
+	// delegating part of its subnet to the annotated IPPool.
+	DelegatedFromAnnotationKey = network.GroupName + "/delegated-from"
+	// AutoRebindAnnotationKey, set to "true" on a NetworkAttachmentDefinition,
+	// lets the IP addresses allocated from the IPPool it used to point to move
+	// over to the one it points to now.
+	AutoRebindAnnotationKey = network.GroupName + "/auto-rebind"
+	// PinLeaseAnnotationKey, set to "true" on a VirtualMachineNetworkConfig,
+	// keeps its IP addresses from being released or moved by the controller.
+	PinLeaseAnnotationKey = network.GroupName + "/pin-lease"
+	// AllocationTimingAnnotationKey, set to "immediate" or "onFirstStart" on a
+	// VM, overrides when the IP addresses of the VM are allocated.
+	AllocationTimingAnnotationKey = network.GroupName + "/allocation-timing"
+	// RunDHCPCheckAnnotationKey, set to "true" on an IPPool, has the
+	// controller check the DHCP service of the IPPool end to end once.
+	RunDHCPCheckAnnotationKey = network.GroupName + "/run-dhcp-check"
+	// ResyncAnnotationKey, set to a request ID on an IPPool or a
+	// VirtualMachineNetworkConfig, has the controller check its allocations
+	// against the caches and repair any drift, once per request ID.
+	ResyncAnnotationKey = network.GroupName + "/resync"
+	// PinnedAllocationsAnnotationKey is the suggested annotation for
+	// pinning the IP addresses allocated to a VM on the VM itself, as the
+	// annotation is configurable.
+	PinnedAllocationsAnnotationKey = network.GroupName + "/pinned-allocations"
+	// CNIContainerIDAnnotationKey holds the ID of the container a
+	// VirtualMachineNetworkConfig was created for by the CNI endpoint of the
+	// controller, rather than for a VM.
+	CNIContainerIDAnnotationKey = network.GroupName + "/cni-container-id"
+	// ForceDeleteAnnotationKey, set to "true" on an IPPool, lets it be deleted
+	// while it still leases IP addresses. It's meant for break-glass
+	// situations only.
+	ForceDeleteAnnotationKey = network.GroupName + "/force-delete"
+	// MACAddressAnnotationKey holds the MAC address of each interface of a VM
+	// as the Harvester UI sets it, e.g., {"nic-1": "fa:cf:8e:50:82:fc"}. The
+	// vm controller applies it to the interfaces without one.
+	MACAddressAnnotationKey = "harvesterhci.io/mac-address"
+	// ExternalIPAMAuthLabelKey, set to "true" on a Secret, lets its token be
+	// sent to the external IPAM of an IPPool of its namespace naming it.
+	ExternalIPAMAuthLabelKey = network.GroupName + "/external-ipam-auth"
+
+	// AllocationsConfigMapName is the ConfigMap the allocations of the VMs of
+	// a namespace are mirrored into, when enabled. The shards after the first
+	// one are suffixed with their index, e.g., vm-dhcp-allocations-1.
+	AllocationsConfigMapName = "vm-dhcp-allocations"
+	// AllocationsShardLabelKey holds the index of the shard of the
+	// allocations ConfigMap.
+	AllocationsShardLabelKey = network.GroupName + "/allocations-shard"
+	// AllocationsShardsAnnotationKey holds the amount of shards of the
+	// allocations ConfigMap, set on the first one.
+	AllocationsShardsAnnotationKey = network.GroupName + "/allocations-shards"
 )
 
 func agentConcatName(name ...string) string {
@@ -41,3 +104,22 @@ func SafeAgentConcatName(name ...string) string {
 
 	return agentConcatName(fullPath[0:50], hex.EncodeToString(digest[0:])[0:6])
 }
+
+// DHCPCheckMACAddress returns the test MAC address the DHCP checks of the
+// IPPool run with. It's derived from the UID of the IPPool, with the locally
+// administered bit set, so it hardly ever matches the one of a VM.
+func DHCPCheckMACAddress(ipPool *networkv1.IPPool) string {
+	digest := sha256.Sum256([]byte(ipPool.UID))
+	mac := net.HardwareAddr{0x02, digest[0], digest[1], digest[2], digest[3], digest[4]}
+	return mac.String()
+}
+
+// DHCPCheckLease returns the test lease of the DHCP check running on the
+// IPPool, if any. It's served by the agent until the check is done.
+func DHCPCheckLease(ipPool *networkv1.IPPool) (ipAddress, macAddress string, ok bool) {
+	check := ipPool.Status.LastCheck
+	if check == nil || check.State != networkv1.DHCPCheckRunning || check.IPAddress == "" || check.MACAddress == "" {
+		return "", "", false
+	}
+	return check.IPAddress, check.MACAddress, true
+}
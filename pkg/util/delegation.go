@@ -0,0 +1,210 @@
+package util
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/rancher/wrangler/v3/pkg/kv"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
+)
+
+// An IPPool can delegate part of its subnet to IPPools in other namespaces,
+// so that the subnet is split across teams while being served by a single
+// agent. The delegation takes both sides: the delegating IPPool lists the
+// delegated ones with the DelegatedPoolsAnnotationKey annotation, and each of
+// them points back with the DelegatedFromAnnotationKey annotation. The VMs of
+// a namespace get their IP addresses from the IPPool delegated to it, if any.
+//
+// An IPPool can also overflow into another IPPool on the same network once
+// exhausted, which can overflow into another one in turn. The IPPool names
+// its overflow IPPool in spec.overflowPool, and the overflow IPPool points
+// back with the DelegatedFromAnnotationKey annotation, as it's served by the
+// same agent and keeps an IPAM of its own just like delegated IPPools.
+
+// MaxOverflowDepth bounds the amount of IPPools followed along an overflow
+// chain.
+const MaxOverflowDepth = 4
+
+// MaxOverflowWeight bounds the weight of an IPPool of an overflow chain, and
+// defaultOverflowWeight is the one of the IPPools without any.
+const (
+	MaxOverflowWeight     = 100
+	defaultOverflowWeight = 1
+)
+
+// DelegatedPools returns the keys of the IPPools the IPPool delegates to.
+func DelegatedPools(ipPool *networkv1.IPPool) []string {
+	value, ok := ipPool.Annotations[DelegatedPoolsAnnotationKey]
+	if !ok {
+		return nil
+	}
+
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// DelegatingPool returns the key of the IPPool delegating to the IPPool, and
+// whether there's one.
+func DelegatingPool(ipPool *networkv1.IPPool) (string, bool) {
+	key, ok := ipPool.Annotations[DelegatedFromAnnotationKey]
+	if !ok || strings.TrimSpace(key) == "" {
+		return "", false
+	}
+
+	return strings.TrimSpace(key), true
+}
+
+// IsDelegated reports whether the delegation from parent to child is declared
+// on both sides. Overflow IPPools are delegated by the IPPool overflowing into
+// them.
+func IsDelegated(parent, child *networkv1.IPPool) bool {
+	if key, ok := DelegatingPool(child); !ok || key != parent.Namespace+"/"+parent.Name {
+		return false
+	}
+
+	if OverflowsInto(parent, child) {
+		return true
+	}
+
+	for _, key := range DelegatedPools(parent) {
+		if key == child.Namespace+"/"+child.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OverflowsInto reports whether parent names child as its overflow IPPool.
+func OverflowsInto(parent, child *networkv1.IPPool) bool {
+	return parent.Spec.OverflowPool == child.Namespace+"/"+child.Name
+}
+
+// OverflowChain returns the IPPools the IPPool overflows into, in order. The
+// chain ends at the first IPPool which is missing or doesn't point back, and
+// is cut where it loops back or after MaxOverflowDepth IPPools.
+func OverflowChain(ippoolCache ctlnetworkv1.IPPoolCache, ipPool *networkv1.IPPool) ([]*networkv1.IPPool, error) {
+	var chain []*networkv1.IPPool
+	visited := map[string]struct{}{
+		ipPool.Namespace + "/" + ipPool.Name: {},
+	}
+
+	for parent := ipPool; parent.Spec.OverflowPool != "" && len(chain) < MaxOverflowDepth; {
+		if _, ok := visited[parent.Spec.OverflowPool]; ok {
+			break
+		}
+		visited[parent.Spec.OverflowPool] = struct{}{}
+
+		childNamespace, childName := kv.RSplit(parent.Spec.OverflowPool, "/")
+		child, err := ippoolCache.Get(childNamespace, childName)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				break
+			}
+			return nil, err
+		}
+		if !IsDelegated(parent, child) {
+			break
+		}
+
+		chain = append(chain, child)
+		parent = child
+	}
+
+	return chain, nil
+}
+
+// WeightedOverflowPool returns the IPPool of the overflow chain of ipPool,
+// ipPool included, a new IP address of the MAC address is to be allocated
+// from, if any IPPool of the chain has a weight. The IPPools are picked in
+// proportion to their weights by a hash of the MAC address, so the pick stays
+// the same across reconciliations. It returns nil if no IPPool has a weight,
+// or if they all weigh 0, in which case the chain is filled in order.
+func WeightedOverflowPool(ipPool *networkv1.IPPool, chain []*networkv1.IPPool, macAddress string) *networkv1.IPPool {
+	ipPools := append([]*networkv1.IPPool{ipPool}, chain...)
+
+	var weighted bool
+	var total uint32
+	weights := make([]uint32, len(ipPools))
+	for i, pool := range ipPools {
+		weights[i] = defaultOverflowWeight
+		if pool.Spec.OverflowWeight != nil {
+			weighted = true
+			weights[i] = uint32(max(*pool.Spec.OverflowWeight, 0))
+		}
+		total += weights[i]
+	}
+	if !weighted || total == 0 {
+		return nil
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(NormalizeMAC(macAddress)))
+	point := hash.Sum32() % total
+	for i, weight := range weights {
+		if point < weight {
+			return ipPools[i]
+		}
+		point -= weight
+	}
+
+	return nil
+}
+
+// IPAMName returns the name of the IPAM subnet and MAC set backing the IPPool.
+// IPPools are named after their network, except delegated ones, which share
+// the network with the delegating IPPool.
+func IPAMName(ipPool *networkv1.IPPool) string {
+	if _, ok := DelegatingPool(ipPool); ok {
+		return fmt.Sprintf("%s@%s/%s", ipPool.Spec.NetworkName, ipPool.Namespace, ipPool.Name)
+	}
+
+	return ipPool.Spec.NetworkName
+}
+
+// IPv6IPAMName returns the name of the IPAM subnet and MAC cache holding the
+// IPv6 allocations of the IPPool, which are kept apart from the IPv4 ones.
+func IPv6IPAMName(ipPool *networkv1.IPPool) string {
+	return IPv6IPAMNameOf(IPAMName(ipPool))
+}
+
+// IPv6IPAMNameOf returns the name of the IPv6 counterpart of the IPAM subnet
+// and MAC cache named ipamName.
+func IPv6IPAMNameOf(ipamName string) string {
+	return ipamName + "/ipv6"
+}
+
+// GetDelegatedPool returns the IPPool the parent delegates to in the
+// namespace, or nil if there's none.
+func GetDelegatedPool(ippoolCache ctlnetworkv1.IPPoolCache, parent *networkv1.IPPool, namespace string) (*networkv1.IPPool, error) {
+	for _, key := range DelegatedPools(parent) {
+		childNamespace, childName := kv.RSplit(key, "/")
+		if childNamespace != namespace {
+			continue
+		}
+
+		child, err := ippoolCache.Get(childNamespace, childName)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		if IsDelegated(parent, child) {
+			return child, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,126 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
+)
+
+func newTestDelegationPool(namespace, name string, annotations map[string]string) *networkv1.IPPool {
+	return &networkv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Annotations: annotations,
+		},
+		Spec: networkv1.IPPoolSpec{
+			NetworkName: "default/net-1",
+		},
+	}
+}
+
+func TestIsDelegated(t *testing.T) {
+	parent := newTestDelegationPool("default", "net-1", map[string]string{
+		DelegatedPoolsAnnotationKey: "team-a/net-1, team-b/net-1",
+	})
+	childA := newTestDelegationPool("team-a", "net-1", map[string]string{
+		DelegatedFromAnnotationKey: "default/net-1",
+	})
+	childB := newTestDelegationPool("team-b", "net-1", nil)
+	childC := newTestDelegationPool("team-c", "net-1", map[string]string{
+		DelegatedFromAnnotationKey: "default/net-1",
+	})
+
+	assert.Equal(t, []string{"team-a/net-1", "team-b/net-1"}, DelegatedPools(parent))
+	assert.True(t, IsDelegated(parent, childA))
+	assert.False(t, IsDelegated(parent, childB), "delegation should be declared by the delegated ippool as well")
+	assert.False(t, IsDelegated(parent, childC), "delegation should be declared by the delegating ippool as well")
+
+	assert.Equal(t, "default/net-1", IPAMName(parent))
+	assert.Equal(t, "default/net-1@team-a/net-1", IPAMName(childA))
+}
+
+func TestGetIPPoolFromNetworkName_Delegation(t *testing.T) {
+	nad := &cniv1.NetworkAttachmentDefinition{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "net-1",
+			Labels: map[string]string{
+				IPPoolNamespaceLabelKey: "default",
+				IPPoolNameLabelKey:      "net-1",
+			},
+		},
+	}
+	parent := newTestDelegationPool("default", "net-1", map[string]string{
+		DelegatedPoolsAnnotationKey: "team-a/net-1,team-b/net-1",
+	})
+	childA := newTestDelegationPool("team-a", "net-1", map[string]string{
+		DelegatedFromAnnotationKey: "default/net-1",
+	})
+
+	clientset := fake.NewSimpleClientset(parent, childA)
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+	err := clientset.Tracker().Create(nadGVR, nad, nad.Namespace)
+	assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+	nadCache := fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions)
+	ippoolCache := fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools)
+
+	testCases := []struct {
+		namespace string
+		expected  string
+	}{
+		{namespace: "team-a", expected: "team-a/net-1"},
+		{namespace: "team-b", expected: "default/net-1"},
+		{namespace: "default", expected: "default/net-1"},
+	}
+
+	for _, tc := range testCases {
+		ipPool, err := GetIPPoolFromNetworkName(nadCache, ippoolCache, "default/net-1", tc.namespace)
+		assert.Nil(t, err, tc.namespace)
+		assert.Equal(t, tc.expected, ipPool.Namespace+"/"+ipPool.Name, "consumer in namespace %s", tc.namespace)
+	}
+}
+
+func TestWeightedOverflowPool(t *testing.T) {
+	primary := newTestDelegationPool("default", "net-1", nil)
+	overflow := newTestDelegationPool("default", "net-1-overflow", nil)
+	chain := []*networkv1.IPPool{overflow}
+	zero, one, two := 0, 1, 2
+
+	assert.Nil(t, WeightedOverflowPool(primary, chain, "11:22:33:44:55:66"), "chains without weights should be filled in order")
+
+	primary.Spec.OverflowWeight = &two
+	overflow.Spec.OverflowWeight = &one
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		macAddress := fmt.Sprintf("52:54:00:%02x:%02x:%02x", byte(i>>16), byte(i>>8), byte(i))
+		pick := WeightedOverflowPool(primary, chain, macAddress)
+		assert.NotNil(t, pick)
+		counts[pick.Name]++
+		assert.Equal(t, pick, WeightedOverflowPool(primary, chain, strings.ToUpper(macAddress)), "picks should stick to the MAC address")
+	}
+	assert.InDelta(t, 2000, counts["net-1"], 100, "the primary ippool should get about two thirds of the allocations")
+	assert.InDelta(t, 1000, counts["net-1-overflow"], 100, "the overflow ippool should get about a third of the allocations")
+
+	primary.Spec.OverflowWeight = &zero
+	overflow.Spec.OverflowWeight = nil
+	assert.Equal(t, overflow, WeightedOverflowPool(primary, chain, "11:22:33:44:55:66"), "ippools without a weight should weigh 1")
+
+	overflow.Spec.OverflowWeight = &zero
+	assert.Nil(t, WeightedOverflowPool(primary, chain, "11:22:33:44:55:66"), "chains weighing 0 should be filled in order")
+}
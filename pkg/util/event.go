@@ -0,0 +1,127 @@
+package util
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+type eventKey struct {
+	namespace   string
+	name        string
+	uid         types.UID
+	eventType   string
+	reason      string
+	messageHash uint64
+}
+
+type eventEntry struct {
+	lastEmitted time.Time
+	suppressed  int
+}
+
+// DedupRecorder wraps an EventRecorder so that recurring events don't flood
+// the cluster. The first event about an object with a given type, reason, and
+// message is emitted right away, while the identical ones following it within
+// the window are only counted. The first one after the window is emitted with
+// the count of the ones suppressed in the meantime.
+type DedupRecorder struct {
+	recorder record.EventRecorder
+	clock    clock.Clock
+	window   time.Duration
+
+	entries map[eventKey]*eventEntry
+	mutex   sync.Mutex
+}
+
+func NewDedupRecorder(recorder record.EventRecorder, clock clock.Clock, window time.Duration) *DedupRecorder {
+	return &DedupRecorder{
+		recorder: recorder,
+		clock:    clock,
+		window:   window,
+		entries:  make(map[eventKey]*eventEntry),
+	}
+}
+
+func (r *DedupRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if message, ok := r.admit(object, eventtype, reason, message); ok {
+		r.recorder.Event(object, eventtype, reason, message)
+	}
+}
+
+func (r *DedupRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *DedupRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	if message, ok := r.admit(object, eventtype, reason, message); ok {
+		r.recorder.AnnotatedEventf(object, annotations, eventtype, reason, "%s", message)
+	}
+}
+
+// admit reports whether the event should be emitted, along with the message
+// to emit it with.
+func (r *DedupRecorder) admit(object runtime.Object, eventtype, reason, message string) (string, bool) {
+	accessor, err := meta.Accessor(object)
+	if err != nil {
+		logrus.Warnf("(util.DedupRecorder) cannot deduplicate event %s: %s", reason, err.Error())
+		return message, true
+	}
+
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(message))
+	key := eventKey{
+		namespace:   accessor.GetNamespace(),
+		name:        accessor.GetName(),
+		uid:         accessor.GetUID(),
+		eventType:   eventtype,
+		reason:      reason,
+		messageHash: hash.Sum64(),
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.clock.Now()
+	r.prune(now)
+
+	entry, ok := r.entries[key]
+	if !ok {
+		r.entries[key] = &eventEntry{lastEmitted: now}
+		return message, true
+	}
+
+	if now.Sub(entry.lastEmitted) < r.window {
+		entry.suppressed++
+		return "", false
+	}
+
+	if entry.suppressed > 0 {
+		message = fmt.Sprintf("%s (repeated %d times in the last %s)", message, entry.suppressed+1, now.Sub(entry.lastEmitted).Round(time.Second))
+	}
+	entry.lastEmitted = now
+	entry.suppressed = 0
+
+	return message, true
+}
+
+// prune drops the entries that haven't been emitted for two windows so the
+// ones of deleted objects don't pile up. Counts that old aren't worth
+// reporting anymore.
+func (r *DedupRecorder) prune(now time.Time) {
+	for key, entry := range r.entries {
+		if now.Sub(entry.lastEmitted) >= 2*r.window {
+			delete(r.entries, key)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/harvester/vm-dhcp-controller/pkg/clock"
+)
+
+func newTestPod(name, uid string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			UID:       types.UID(uid),
+		},
+	}
+}
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestDedupRecorder_Window(t *testing.T) {
+	fakeRecorder := record.NewFakeRecorder(100)
+	fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	recorder := NewDedupRecorder(fakeRecorder, fakeClock, 10*time.Minute)
+	pod := newTestPod("pod-1", "uid-1")
+
+	recorder.Eventf(pod, corev1.EventTypeWarning, "BadMAC", "cannot parse mac address %s", "foo")
+	assert.Equal(t, []string{"Warning BadMAC cannot parse mac address foo"}, drainEvents(fakeRecorder), "first event should be emitted")
+
+	for i := 0; i < 3; i++ {
+		fakeClock.Step(time.Minute)
+		recorder.Eventf(pod, corev1.EventTypeWarning, "BadMAC", "cannot parse mac address %s", "foo")
+	}
+	assert.Empty(t, drainEvents(fakeRecorder), "events within the window should be suppressed")
+
+	fakeClock.Step(7 * time.Minute)
+	recorder.Eventf(pod, corev1.EventTypeWarning, "BadMAC", "cannot parse mac address %s", "foo")
+	assert.Equal(t, []string{"Warning BadMAC cannot parse mac address foo (repeated 4 times in the last 10m0s)"}, drainEvents(fakeRecorder), "event after the window should carry the count")
+
+	fakeClock.Step(10 * time.Minute)
+	recorder.Eventf(pod, corev1.EventTypeWarning, "BadMAC", "cannot parse mac address %s", "foo")
+	assert.Equal(t, []string{"Warning BadMAC cannot parse mac address foo"}, drainEvents(fakeRecorder), "event without suppressed ones should be emitted as is")
+
+	fakeClock.Step(time.Minute)
+	recorder.Eventf(pod, corev1.EventTypeWarning, "BadMAC", "cannot parse mac address %s", "foo")
+	fakeClock.Step(20 * time.Minute)
+	recorder.Eventf(pod, corev1.EventTypeWarning, "BadMAC", "cannot parse mac address %s", "foo")
+	assert.Equal(t, []string{"Warning BadMAC cannot parse mac address foo"}, drainEvents(fakeRecorder), "counts older than two windows should be dropped")
+}
+
+func TestDedupRecorder_Distinct(t *testing.T) {
+	fakeRecorder := record.NewFakeRecorder(100)
+	fakeClock := clock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	recorder := NewDedupRecorder(fakeRecorder, fakeClock, 10*time.Minute)
+	pod1 := newTestPod("pod-1", "uid-1")
+	pod2 := newTestPod("pod-2", "uid-2")
+
+	recorder.Event(pod1, corev1.EventTypeWarning, "BadMAC", "cannot parse mac address")
+	recorder.Event(pod1, corev1.EventTypeWarning, "MissingLabel", "cannot parse mac address")
+	recorder.Event(pod1, corev1.EventTypeNormal, "BadMAC", "cannot parse mac address")
+	recorder.Event(pod1, corev1.EventTypeWarning, "BadMAC", "nad has no ippool label")
+	recorder.Event(pod2, corev1.EventTypeWarning, "BadMAC", "cannot parse mac address")
+	recorder.AnnotatedEventf(pod1, map[string]string{"key": "value"}, corev1.EventTypeWarning, "BadMAC", "cannot parse mac address")
+
+	assert.Equal(t, []string{
+		"Warning BadMAC cannot parse mac address",
+		"Warning MissingLabel cannot parse mac address",
+		"Normal BadMAC cannot parse mac address",
+		"Warning BadMAC nad has no ippool label",
+		"Warning BadMAC cannot parse mac address",
+	}, drainEvents(fakeRecorder), "events differing in object, type, reason, or message should never be merged")
+}
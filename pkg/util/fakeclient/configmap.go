@@ -0,0 +1,69 @@
+package fakeclient
+
+import (
+	"context"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	typecorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+type ConfigMapClient func(string) typecorev1.ConfigMapInterface
+
+func (c ConfigMapClient) Update(configMap *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	return c(configMap.Namespace).Update(context.TODO(), configMap, metav1.UpdateOptions{})
+}
+func (c ConfigMapClient) Get(namespace, name string, options metav1.GetOptions) (*corev1.ConfigMap, error) {
+	return c(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+}
+func (c ConfigMapClient) Create(configMap *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	return c(configMap.Namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
+}
+func (c ConfigMapClient) Delete(namespace, name string, options *metav1.DeleteOptions) error {
+	return c(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+}
+func (c ConfigMapClient) List(namespace string, opts metav1.ListOptions) (*corev1.ConfigMapList, error) {
+	panic("implement me")
+}
+func (c ConfigMapClient) UpdateStatus(configMap *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	panic("implement me")
+}
+func (c ConfigMapClient) Watch(namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	panic("implement me")
+}
+func (c ConfigMapClient) Patch(namespace, name string, pt types.PatchType, data []byte, subresources ...string) (result *corev1.ConfigMap, err error) {
+	panic("implement me")
+}
+
+func (c ConfigMapClient) WithImpersonation(config rest.ImpersonationConfig) (generic.ClientInterface[*corev1.ConfigMap, *corev1.ConfigMapList], error) {
+	panic("implement me")
+}
+
+type ConfigMapCache func(string) typecorev1.ConfigMapInterface
+
+func (c ConfigMapCache) Get(namespace, name string) (*corev1.ConfigMap, error) {
+	return c(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+}
+func (c ConfigMapCache) List(namespace string, selector labels.Selector) ([]*corev1.ConfigMap, error) {
+	list, err := c(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*corev1.ConfigMap, 0, len(list.Items))
+	for _, configMap := range list.Items {
+		cm := configMap
+		result = append(result, &cm)
+	}
+	return result, err
+}
+func (c ConfigMapCache) AddIndexer(indexName string, indexer generic.Indexer[*corev1.ConfigMap]) {
+	panic("implement me")
+}
+func (c ConfigMapCache) GetByIndex(indexName, key string) ([]*corev1.ConfigMap, error) {
+	panic("implement me")
+}
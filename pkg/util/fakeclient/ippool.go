@@ -29,7 +29,7 @@ func (c IPPoolClient) Delete(namespace, name string, options *metav1.DeleteOptio
 	panic("implement me")
 }
 func (c IPPoolClient) List(namespace string, opts metav1.ListOptions) (*networkv1.IPPoolList, error) {
-	panic("implement me")
+	return c(namespace).List(context.TODO(), opts)
 }
 func (c IPPoolClient) UpdateStatus(ipPool *networkv1.IPPool) (*networkv1.IPPool, error) {
 	return c(ipPool.Namespace).UpdateStatus(context.TODO(), ipPool, metav1.UpdateOptions{})
@@ -0,0 +1,35 @@
+package fakeclient
+
+import (
+	"context"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	typecorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+type NamespaceCache func() typecorev1.NamespaceInterface
+
+func (c NamespaceCache) Get(name string) (*corev1.Namespace, error) {
+	return c().Get(context.TODO(), name, metav1.GetOptions{})
+}
+func (c NamespaceCache) List(selector labels.Selector) ([]*corev1.Namespace, error) {
+	list, err := c().List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*corev1.Namespace, 0, len(list.Items))
+	for _, namespace := range list.Items {
+		n := namespace
+		result = append(result, &n)
+	}
+	return result, err
+}
+func (c NamespaceCache) AddIndexer(indexName string, indexer generic.Indexer[*corev1.Namespace]) {
+	panic("implement me")
+}
+func (c NamespaceCache) GetByIndex(indexName, key string) ([]*corev1.Namespace, error) {
+	panic("implement me")
+}
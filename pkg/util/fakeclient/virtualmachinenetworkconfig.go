@@ -26,10 +26,10 @@ func (c VirtualMachineNetworkConfigClient) Create(vmNetCfg *networkv1.VirtualMac
 	return c(vmNetCfg.Namespace).Create(context.TODO(), vmNetCfg, metav1.CreateOptions{})
 }
 func (c VirtualMachineNetworkConfigClient) Delete(namespace, name string, options *metav1.DeleteOptions) error {
-	panic("implement me")
+	return c(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
 }
 func (c VirtualMachineNetworkConfigClient) List(namespace string, opts metav1.ListOptions) (*networkv1.VirtualMachineNetworkConfigList, error) {
-	panic("implement me")
+	return c(namespace).List(context.TODO(), opts)
 }
 func (c VirtualMachineNetworkConfigClient) UpdateStatus(vmNetCfg *networkv1.VirtualMachineNetworkConfig) (*networkv1.VirtualMachineNetworkConfig, error) {
 	return c(vmNetCfg.Namespace).UpdateStatus(context.TODO(), vmNetCfg, metav1.UpdateOptions{})
@@ -0,0 +1,25 @@
+package util
+
+import (
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// GetRESTConfig loads the REST config from the given kubeconfig file and
+// context. It falls back to the in-cluster config if the file doesn't exist.
+func GetRESTConfig(kubeConfig, kubeContext string) (*rest.Config, error) {
+	if !FileExists(kubeConfig) {
+		return rest.InClusterConfig()
+	}
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{
+			ExplicitPath: kubeConfig,
+		},
+		&clientcmd.ConfigOverrides{
+			ClusterInfo:    clientcmdapi.Cluster{},
+			CurrentContext: kubeContext,
+		},
+	).ClientConfig()
+}
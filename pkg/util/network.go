@@ -1,13 +1,22 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"math/bits"
 	"net"
 	"net/netip"
+	"sort"
+	"strings"
 
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
 	"github.com/rancher/wrangler/v3/pkg/kv"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
 	ctlcniv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/k8s.cni.cncf.io/v1"
@@ -22,11 +31,84 @@ type PoolInfo struct {
 	EndIPAddr       netip.Addr
 	ServerIPAddr    netip.Addr
 	RouterIPAddr    netip.Addr
+	// DNSServers are the nameservers handed out to the clients, of the
+	// address family of the pool
+	DNSServers []netip.Addr
+	// DomainName is the domain name handed out with option 15, and
+	// DomainSearch the domain search list handed out with option 119, both
+	// without the trailing dot. They're only set for IPv4 pools.
+	DomainName   string
+	DomainSearch []string
+	// StaticRoutes are the classless static routes handed out with option
+	// 121. They're only set for IPv4 pools.
+	StaticRoutes []StaticRoute
+
+	// AllowNetworkBroadcast tells whether the network and broadcast
+	// addresses are allocatable as well
+	AllowNetworkBroadcast bool
+}
+
+// StaticRoute is a classless static route of a pool. The gateway is the
+// unspecified address for destinations on the link.
+type StaticRoute struct {
+	Destination netip.Prefix
+	Gateway     netip.Addr
+}
+
+// IsIPv6 tells whether the pool is an IPv6 one. IPv6 pools have no broadcast
+// address.
+func (pi PoolInfo) IsIPv6() bool {
+	return pi.NetworkIPAddr.Is6()
+}
+
+// GenerateMACAddress derives a MAC address from the UID of the VM and the name
+// of its interface, so the same interface always gets the same address. The
+// address is a locally administered unicast one, which can't collide with the
+// vendor-assigned ones.
+func GenerateMACAddress(vmUID types.UID, nicName string) string {
+	sum := sha256.Sum256([]byte(string(vmUID) + "/" + nicName))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = mac[0]&0xfe | 0x02
+	return mac.String()
+}
+
+// ParseMAC returns the 48-bit MAC address in lowercase with colons, the way
+// the agents and KubeVirt write them, whether it's given in another case,
+// with dashes, or in the dotted form of Cisco. Unparsable addresses, and the
+// ones of another length, e.g., EUI-64 or InfiniBand ones, are rejected.
+func ParseMAC(macAddress string) (string, error) {
+	hwAddr, err := net.ParseMAC(strings.TrimSpace(macAddress))
+	if err != nil {
+		return "", fmt.Errorf("mac address %q is not valid", macAddress)
+	}
+	if len(hwAddr) != 6 {
+		return "", fmt.Errorf("mac address %q is not a 48-bit mac address", macAddress)
+	}
+	return hwAddr.String(), nil
+}
+
+// NormalizeMAC returns the MAC address the way ParseMAC does, so addresses
+// written in different forms still match. Addresses ParseMAC rejects are only
+// lowercased, for them to be compared with each other still; they're kept
+// from being stored by the intake of the controllers and the webhook.
+func NormalizeMAC(macAddress string) string {
+	if normalized, err := ParseMAC(macAddress); err == nil {
+		return normalized
+	}
+	return strings.ToLower(strings.TrimSpace(macAddress))
 }
 
 func GetServiceCIDRFromNode(node *corev1.Node) (string, error) {
+	return getNodeArg(node, ServiceCIDRFlag)
+}
+
+func GetClusterCIDRFromNode(node *corev1.Node) (string, error) {
+	return getNodeArg(node, ClusterCIDRFlag)
+}
+
+func getNodeArg(node *corev1.Node, flag string) (string, error) {
 	if node.Annotations == nil {
-		return "", fmt.Errorf("service CIDR not found for node %s", node.Name)
+		return "", fmt.Errorf("annotation %s not found for node %s", NodeArgsAnnotationKey, node.Name)
 	}
 
 	nodeArgs, ok := node.Annotations[NodeArgsAnnotationKey]
@@ -39,25 +121,51 @@ func GetServiceCIDRFromNode(node *corev1.Node) (string, error) {
 		return "", err
 	}
 
-	var serviceCIDRIndex int
+	var flagIndex int
 	for i, val := range argList {
-		if val == ServiceCIDRFlag {
+		if val == flag {
 			// The "rke2.io/node-args" annotation in node objects contains various node arguments.
 			// For example, '[...,"--cluster-cidr","10.52.0.0/16","--service-cidr","10.53.0.0/16", ...]'
-			// What we need here is the value of the "--service-cidr" flag.
+			// What we need here is the value of the given flag, e.g., "--service-cidr".
 			// It could be accessed by accumulating the flag index by one.
-			serviceCIDRIndex = i + 1
+			flagIndex = i + 1
 			break
 		}
 	}
 
-	if serviceCIDRIndex == 0 || serviceCIDRIndex >= len(argList) {
-		return "", fmt.Errorf("serviceCIDR not found for node %s", node.Name)
+	if flagIndex == 0 || flagIndex >= len(argList) {
+		return "", fmt.Errorf("%s not found for node %s", strings.TrimPrefix(flag, "--"), node.Name)
+	}
+
+	return argList[flagIndex], nil
+}
+
+// GetMTUFromNAD returns the MTU set in the CNI config of the given
+// NetworkAttachmentDefinition. Zero means the MTU is left to the CNI plugin.
+func GetMTUFromNAD(nad *cniv1.NetworkAttachmentDefinition) (int, error) {
+	if nad.Spec.Config == "" {
+		return 0, nil
+	}
+
+	var netConf struct {
+		MTU int `json:"mtu,omitempty"`
+	}
+	if err := json.Unmarshal([]byte(nad.Spec.Config), &netConf); err != nil {
+		return 0, fmt.Errorf("failed to parse config of network attachment definition %s/%s: %w", nad.Namespace, nad.Name, err)
 	}
 
-	return argList[serviceCIDRIndex], nil
+	return netConf.MTU, nil
+}
+
+// IsAutoRebindEnabled reports whether the NetworkAttachmentDefinition opted in
+// to moving the IP addresses over when its IPPool labels are re-pointed.
+func IsAutoRebindEnabled(nad *cniv1.NetworkAttachmentDefinition) bool {
+	return nad.Annotations[AutoRebindAnnotationKey] == "true"
 }
 
+// LoadCIDR parses the subnet of cidr along with its network and broadcast
+// addresses. IPv6 has no broadcast, so the broadcast address of an IPv6 prefix
+// is left invalid rather than reserving its last address.
 func LoadCIDR(cidr string) (ipNet *net.IPNet, networkIPAddr netip.Addr, broadcastIPAddr netip.Addr, err error) {
 	_, ipNet, err = net.ParseCIDR(cidr)
 	if err != nil {
@@ -69,88 +177,712 @@ func LoadCIDR(cidr string) (ipNet *net.IPNet, networkIPAddr netip.Addr, broadcas
 		err = fmt.Errorf("cannot convert ip address %s", ipNet.IP)
 		return
 	}
+	networkIPAddr = networkIPAddr.Unmap()
 
-	broadcastIP := make(net.IP, len(ipNet.IP))
-	copy(broadcastIP, ipNet.IP)
-	for i := range broadcastIP {
-		broadcastIP[i] |= ^ipNet.Mask[i]
-	}
-	broadcastIPAddr, ok = netip.AddrFromSlice(broadcastIP)
-	if !ok {
-		err = fmt.Errorf("cannot convert ip address %s", broadcastIP)
+	if networkIPAddr.Is6() {
 		return
 	}
 
+	broadcastIPAddr, err = lastAddress(ipNet)
 	return
 }
 
-func LoadPool(ipPool *networkv1.IPPool) (pi PoolInfo, err error) {
-	pi.IPNet, pi.NetworkIPAddr, pi.BroadcastIPAddr, err = LoadCIDR(ipPool.Spec.IPv4Config.CIDR)
+// lastAddress returns the last address of the subnet, i.e., the one with all
+// the host bits set.
+func lastAddress(ipNet *net.IPNet) (netip.Addr, error) {
+	if ipNet == nil {
+		return netip.Addr{}, fmt.Errorf("subnet is empty")
+	}
+
+	lastIP := make(net.IP, len(ipNet.IP))
+	copy(lastIP, ipNet.IP)
+	for i := range lastIP {
+		lastIP[i] |= ^ipNet.Mask[i]
+	}
+	lastIPAddr, ok := netip.AddrFromSlice(lastIP)
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("cannot convert ip address %s", lastIP)
+	}
+
+	return lastIPAddr.Unmap(), nil
+}
+
+// LastUsable returns the last host address of the IPv4 subnet, which is the
+// one before the broadcast address. A /31 has no broadcast address (RFC 3021)
+// and a /32 has a single address, so their last address is usable as is.
+func LastUsable(ipNet *net.IPNet) (netip.Addr, error) {
+	if ipNet == nil {
+		return netip.Addr{}, fmt.Errorf("subnet is empty")
+	}
+
+	ip := ipNet.IP.To4()
+	ones, bits := ipNet.Mask.Size()
+	if ip == nil || bits != 8*net.IPv4len {
+		return netip.Addr{}, fmt.Errorf("subnet %s is not an ipv4 one", ipNet)
+	}
+
+	mask := ipNet.Mask[len(ipNet.Mask)-net.IPv4len:]
+	var broadcast [net.IPv4len]byte
+	for i := range broadcast {
+		broadcast[i] = ip[i] | ^mask[i]
+	}
+	broadcastIPAddr := netip.AddrFrom4(broadcast)
+
+	if ones >= 8*net.IPv4len-1 {
+		return broadcastIPAddr, nil
+	}
+
+	return broadcastIPAddr.Prev(), nil
+}
+
+// LoadPool parses the IPv4 addresses of the IPPool. An unset pool End is
+// derived from the pool Count if set, and defaults to the last usable address
+// of the CIDR otherwise, or to the broadcast address if the pool allows it.
+// Setting both is rejected as ambiguous. DNS servers which aren't IPv4
+// addresses, domain names which aren't valid DNS names, and static routes
+// which can't be parsed are rejected as well.
+func LoadPool(ipPool *networkv1.IPPool) (PoolInfo, error) {
+	ipv4Config := ipPool.Spec.IPv4Config
+	pi, err := loadPool(false, ipv4Config.CIDR, ipv4Config.ServerIP, ipv4Config.Router, ipv4Config.DNS, ipv4Config.Pool)
+	if err != nil {
+		return pi, err
+	}
+
+	if ipv4Config.DomainName != nil && *ipv4Config.DomainName != "" {
+		if err := CheckDomainName(*ipv4Config.DomainName); err != nil {
+			return pi, fmt.Errorf("domain name %s is not valid: %w", *ipv4Config.DomainName, err)
+		}
+		pi.DomainName = strings.TrimSuffix(*ipv4Config.DomainName, ".")
+	}
+	for _, domain := range ipv4Config.DomainSearch {
+		if err := CheckDomainName(domain); err != nil {
+			return pi, fmt.Errorf("search domain %s is not valid: %w", domain, err)
+		}
+		pi.DomainSearch = append(pi.DomainSearch, strings.TrimSuffix(domain, "."))
+	}
+	for _, route := range ipv4Config.StaticRoutes {
+		staticRoute, err := ParseStaticRoute(route)
+		if err != nil {
+			return pi, err
+		}
+		pi.StaticRoutes = append(pi.StaticRoutes, staticRoute)
+	}
+
+	return pi, nil
+}
+
+// ParseStaticRoute parses a static route, whose destination must be an IPv4
+// CIDR and whose gateway must be an IPv4 address. The host bits of the
+// destination are cleared, the way the agent always did.
+func ParseStaticRoute(route networkv1.Route) (StaticRoute, error) {
+	destination, err := netip.ParsePrefix(route.Destination)
+	if err != nil || !destination.Addr().Is4() {
+		return StaticRoute{}, fmt.Errorf("static route destination %s is not an IPv4 cidr", route.Destination)
+	}
+	destination = destination.Masked()
+
+	gateway, err := netip.ParseAddr(route.Gateway)
+	if err != nil || !gateway.Is4() {
+		return StaticRoute{}, fmt.Errorf("static route gateway %s is not an IPv4 address", route.Gateway)
+	}
+
+	return StaticRoute{Destination: destination, Gateway: gateway}, nil
+}
+
+// CheckDomainName checks whether name is a syntactically valid DNS name
+// (RFC 1035), with or without the trailing dot: labels of 1 to 63 letters,
+// digits, and hyphens, which neither start nor end with a hyphen, of 253
+// characters at most overall.
+func CheckDomainName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return errors.New("name is empty")
+	}
+	if len(name) > 253 {
+		return errors.New("name is longer than 253 characters")
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return errors.New("name has an empty label")
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("label %s is longer than 63 characters", label)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label %s starts or ends with a hyphen", label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("label %s has characters other than letters, digits, and hyphens", label)
+			}
+		}
+	}
+
+	return nil
+}
+
+// linkLocalPrefix holds the IPv6 link-local addresses, which the hosts
+// configure by themselves and are never handed out.
+var linkLocalPrefix = netip.MustParsePrefix("fe80::/10")
+
+// LoadIPv6Pool parses the IPv6 addresses of the IPPool the way LoadPool does
+// the IPv4 ones, except that an unset pool End defaults to the last address of
+// the CIDR, as IPv6 has no broadcast. Link-local addresses are rejected.
+func LoadIPv6Pool(ipPool *networkv1.IPPool) (PoolInfo, error) {
+	ipv6Config := ipPool.Spec.IPv6Config
+	if ipv6Config == nil {
+		return PoolInfo{}, fmt.Errorf("ippool %s/%s has no ipv6 config", ipPool.Namespace, ipPool.Name)
+	}
+
+	pool := networkv1.Pool{
+		Start:   ipv6Config.Pool.Start,
+		End:     ipv6Config.Pool.End,
+		Count:   ipv6Config.Pool.Count,
+		Exclude: ipv6Config.Pool.Exclude,
+	}
+	pi, err := loadPool(true, ipv6Config.CIDR, ipv6Config.ServerIP, ipv6Config.Router, ipv6Config.DNS, pool)
+	if err != nil {
+		return pi, err
+	}
+
+	prefix, err := netip.ParsePrefix(ipv6Config.CIDR)
+	if err != nil {
+		return pi, err
+	}
+	if prefix.Overlaps(linkLocalPrefix) {
+		return pi, fmt.Errorf("cidr %s overlaps link-local prefix %s", ipv6Config.CIDR, linkLocalPrefix)
+	}
+	for _, ipAddr := range []netip.Addr{pi.StartIPAddr, pi.EndIPAddr, pi.ServerIPAddr, pi.RouterIPAddr} {
+		if ipAddr.IsLinkLocalUnicast() {
+			return pi, fmt.Errorf("ip address %s is link-local", ipAddr)
+		}
+	}
+
+	return pi, nil
+}
+
+// loadPool parses the addresses of a pool, whose CIDR and DNS servers must be
+// IPv6 ones if ipv6 is set and IPv4 ones otherwise.
+func loadPool(ipv6 bool, cidr, serverIP, router string, dnsServers []string, pool networkv1.Pool) (pi PoolInfo, err error) {
+	pi.IPNet, pi.NetworkIPAddr, pi.BroadcastIPAddr, err = LoadCIDR(cidr)
 	if err != nil {
 		return
 	}
+	if pi.IsIPv6() != ipv6 {
+		err = fmt.Errorf("cidr %s is not of the address family of the config", cidr)
+		return
+	}
+	pi.AllowNetworkBroadcast = pool.AllowNetworkBroadcast
 
-	if ipPool.Spec.IPv4Config.Pool.Start != "" {
-		pi.StartIPAddr, err = netip.ParseAddr(ipPool.Spec.IPv4Config.Pool.Start)
+	if pool.Start != "" {
+		pi.StartIPAddr, err = netip.ParseAddr(pool.Start)
 		if err != nil {
 			return
 		}
 	}
 
-	if ipPool.Spec.IPv4Config.Pool.End != "" {
-		pi.EndIPAddr, err = netip.ParseAddr(ipPool.Spec.IPv4Config.Pool.End)
+	switch {
+	case pool.End != "" && pool.Count != 0:
+		err = fmt.Errorf("pool end %s and count %d are ambiguous; set only one of them", pool.End, pool.Count)
+		return
+	case pool.End != "":
+		pi.EndIPAddr, err = netip.ParseAddr(pool.End)
+		if err != nil {
+			return
+		}
+	case pool.Count != 0:
+		pi.EndIPAddr, err = countedEnd(pi, pool.Count)
+		if err != nil {
+			return
+		}
+	default:
+		pi.EndIPAddr, err = pi.lastAllocatable()
 		if err != nil {
 			return
 		}
 	}
 
-	if ipPool.Spec.IPv4Config.ServerIP != "" {
-		pi.ServerIPAddr, err = netip.ParseAddr(ipPool.Spec.IPv4Config.ServerIP)
+	if serverIP != "" {
+		pi.ServerIPAddr, err = netip.ParseAddr(serverIP)
 		if err != nil {
 			return
 		}
 	}
 
-	if ipPool.Spec.IPv4Config.Router != "" {
-		pi.RouterIPAddr, err = netip.ParseAddr(ipPool.Spec.IPv4Config.Router)
+	if router != "" {
+		pi.RouterIPAddr, err = netip.ParseAddr(router)
 		if err != nil {
 			return
 		}
 	}
 
+	for _, dnsServer := range dnsServers {
+		var dnsServerIPAddr netip.Addr
+		dnsServerIPAddr, err = netip.ParseAddr(dnsServer)
+		if err != nil {
+			return
+		}
+		if dnsServerIPAddr.Is6() != ipv6 {
+			err = fmt.Errorf("dns server %s is not of the address family of the config", dnsServer)
+			return
+		}
+		pi.DNSServers = append(pi.DNSServers, dnsServerIPAddr)
+	}
+
 	return
 }
 
+// lastAllocatable returns the last address of the CIDR the pool may hand out.
+// The all-ones address of an IPv6 prefix isn't reserved, so it's the last one.
+func (pi PoolInfo) lastAllocatable() (netip.Addr, error) {
+	if pi.IsIPv6() {
+		return lastAddress(pi.IPNet)
+	}
+	if pi.AllowNetworkBroadcast && pi.BroadcastIPAddr.Is4() {
+		return pi.BroadcastIPAddr, nil
+	}
+	return LastUsable(pi.IPNet)
+}
+
+// countedEnd returns the last address of the range of count addresses from the
+// start of the pool, which must stay within the usable addresses of the CIDR.
+func countedEnd(pi PoolInfo, count int) (netip.Addr, error) {
+	if count < 0 {
+		return netip.Addr{}, fmt.Errorf("pool count %d is not positive", count)
+	}
+	if !pi.StartIPAddr.IsValid() || pi.StartIPAddr.BitLen() != pi.NetworkIPAddr.BitLen() {
+		family := "ipv4"
+		if pi.IsIPv6() {
+			family = "ipv6"
+		}
+		return netip.Addr{}, fmt.Errorf("pool count %d needs an %s start", count, family)
+	}
+
+	lastUsable, err := pi.lastAllocatable()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	if !pi.IPNet.Contains(pi.StartIPAddr.AsSlice()) {
+		return netip.Addr{}, fmt.Errorf("pool start %s is not within cidr %s", pi.StartIPAddr, pi.IPNet)
+	}
+
+	end, ok := addAddr(pi.StartIPAddr, uint64(count)-1)
+	if !ok || lastUsable.Less(end) {
+		return netip.Addr{}, fmt.Errorf("pool of %d addresses from %s exceeds the usable addresses of cidr %s", count, pi.StartIPAddr, pi.IPNet)
+	}
+
+	return end, nil
+}
+
+// addAddr returns the address n addresses after ipAddr, of the same family,
+// or false if it's past the last address of the family.
+func addAddr(ipAddr netip.Addr, n uint64) (netip.Addr, bool) {
+	b := ipAddr.As16()
+	lo, carry := bits.Add64(binary.BigEndian.Uint64(b[8:]), n, 0)
+	hi, carry := bits.Add64(binary.BigEndian.Uint64(b[:8]), 0, carry)
+	if carry != 0 {
+		return netip.Addr{}, false
+	}
+	binary.BigEndian.PutUint64(b[:8], hi)
+	binary.BigEndian.PutUint64(b[8:], lo)
+
+	sum := netip.AddrFrom16(b)
+	if ipAddr.Is4() {
+		// Past 255.255.255.255 the IPv4-mapped prefix is left
+		if !sum.Is4In6() {
+			return netip.Addr{}, false
+		}
+		return sum.Unmap(), true
+	}
+	return sum, true
+}
+
+// addrSpan returns the amount of addresses from first to last, both included,
+// for first not after last. It saturates at math.MaxUint64, as the ranges of
+// IPv6 prefixes as short as a /64 don't fit otherwise.
+func addrSpan(first, last netip.Addr) uint64 {
+	f, l := first.As16(), last.As16()
+	lo, borrow := bits.Sub64(binary.BigEndian.Uint64(l[8:]), binary.BigEndian.Uint64(f[8:]), 0)
+	hi, _ := bits.Sub64(binary.BigEndian.Uint64(l[:8]), binary.BigEndian.Uint64(f[:8]), borrow)
+	if hi != 0 || lo == math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return lo + 1
+}
+
+// PoolEnd returns the last address of the pool range of the IPPool as
+// LoadPool sees it, or an empty string if it can't be loaded.
+func PoolEnd(ipPool *networkv1.IPPool) string {
+	if ipPool.Spec.IPv4Config.Pool.End != "" {
+		return ipPool.Spec.IPv4Config.Pool.End
+	}
+	pi, err := LoadPool(ipPool)
+	if err != nil {
+		return ""
+	}
+	return pi.EndIPAddr.String()
+}
+
+// IPv6PoolEnd returns the last address of the IPv6 pool range of the IPPool,
+// or an empty string if it has no valid IPv6 config.
+func IPv6PoolEnd(ipPool *networkv1.IPPool) string {
+	pi, err := LoadIPv6Pool(ipPool)
+	if err != nil {
+		return ""
+	}
+	return pi.EndIPAddr.String()
+}
+
+// CanonicalIP returns the IP address in its canonical form, the one the IPAM
+// keys its addresses by, e.g., 2001:db8::1 for 2001:0db8:0:0:0:0:0:1.
+// Unparsable addresses are returned as is.
+func CanonicalIP(ip string) string {
+	ipAddr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	return ipAddr.String()
+}
+
+// AllocatorInputsHash returns a digest of the parts of the IPPool spec the
+// IPAM is built from: the subnet, the pool range, and the addresses kept out
+// of it. Options handed out to the clients only, e.g., DNS servers or the
+// lease time, don't change it, as they don't call for rebuilding the IPAM.
+// The known external hosts are left out as well since they're synced into
+// the IPAM in place.
+func AllocatorInputsHash(ipPool *networkv1.IPPool) string {
+	exclude := append([]string(nil), ipPool.Spec.IPv4Config.Pool.Exclude...)
+	sort.Strings(exclude)
+
+	inputs := []string{
+		ipPool.Spec.IPv4Config.CIDR,
+		ipPool.Spec.IPv4Config.Pool.Start,
+		ipPool.Spec.IPv4Config.Pool.End,
+		fmt.Sprint(ipPool.Spec.IPv4Config.Pool.Count),
+		ipPool.Spec.IPv4Config.ServerIP,
+		ipPool.Spec.IPv4Config.Router,
+		strings.Join(exclude, ","),
+	}
+	// Appended only when set, so the digest of the existing pools stays put
+	if ipPool.Spec.IPv4Config.Pool.AllowNetworkBroadcast {
+		inputs = append(inputs, "allowNetworkBroadcast")
+	}
+	if reservations := ipPool.Spec.IPv4Config.Reservations; len(reservations) > 0 {
+		reserved := make([]string, 0, len(reservations))
+		for _, reservation := range reservations {
+			reserved = append(reserved, reservation.IPAddress+"="+NormalizeMAC(reservation.MACAddress))
+		}
+		sort.Strings(reserved)
+		inputs = append(inputs, "reservations", strings.Join(reserved, ","))
+	}
+	if holdBack := ipPool.Spec.IPv4Config.Pool.HoldBack; holdBack != nil {
+		inputs = append(inputs, "holdBack", holdBack.Start, holdBack.End)
+	}
+	if ipv6Config := ipPool.Spec.IPv6Config; ipv6Config != nil {
+		exclude := append([]string(nil), ipv6Config.Pool.Exclude...)
+		sort.Strings(exclude)
+		inputs = append(inputs,
+			"ipv6",
+			ipv6Config.CIDR,
+			ipv6Config.Pool.Start,
+			ipv6Config.Pool.End,
+			fmt.Sprint(ipv6Config.Pool.Count),
+			ipv6Config.ServerIP,
+			ipv6Config.Router,
+			strings.Join(exclude, ","),
+		)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(inputs, "|")))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
 // LoadAllocated returns the un-allocatable IP addresses in three types of IP
-// address lists, allocatedList, excludedList, and reservedList.
-func LoadAllocated(allocated map[string]string) (allocatedList, excludedList, reservedList []netip.Addr) {
-	for ip, val := range allocated {
+// address lists, allocatedList, excludedList, and reservedList. IPv4-mapped
+// IPv6 addresses are normalized to plain IPv4. The keys that cannot be parsed
+// are returned sorted in malformedList, as they indicate corrupted data.
+func LoadAllocated(entries map[string]networkv1.AllocationEntry) (allocatedList, excludedList, reservedList []netip.Addr, malformedList []string) {
+	for ip, entry := range entries {
 		ipAddr, err := netip.ParseAddr(ip)
 		if err != nil {
+			malformedList = append(malformedList, ip)
 			continue
 		}
+		ipAddr = ipAddr.Unmap()
 
-		switch val {
-		case ExcludedMark:
+		switch entry.Type {
+		case networkv1.AllocationTypeExcluded:
 			excludedList = append(excludedList, ipAddr)
-		case ReservedMark:
+		case networkv1.AllocationTypeReserved:
 			reservedList = append(reservedList, ipAddr)
 		default:
 			allocatedList = append(allocatedList, ipAddr)
 		}
 	}
+	sort.Strings(malformedList)
 	return
 }
 
+// allocatableRange returns the first and last address the pool could hand
+// out. An unset Start falls back to the network address, and an unset End,
+// which only hand-built PoolInfos have, to the broadcast address, or to the
+// last address of IPv6 prefixes.
+func (pi PoolInfo) allocatableRange() (first, last netip.Addr) {
+	first, last = pi.NetworkIPAddr, pi.BroadcastIPAddr
+	if pi.IsIPv6() && pi.IPNet != nil {
+		last, _ = lastAddress(pi.IPNet)
+	}
+	if pi.StartIPAddr.IsValid() {
+		first = pi.StartIPAddr
+	}
+	if pi.EndIPAddr.IsValid() {
+		last = pi.EndIPAddr
+	}
+	return
+}
+
+// InSubnet reports whether the address, masked with the CIDR mask, equals the
+// network address. Unlike a numeric range check, this catches addresses
+// copy-pasted from a neighboring subnet.
+func (pi PoolInfo) InSubnet(ipAddr netip.Addr) bool {
+	if pi.IPNet == nil || !ipAddr.IsValid() || !pi.NetworkIPAddr.IsValid() {
+		return false
+	}
+
+	ones, _ := pi.IPNet.Mask.Size()
+	prefix, err := ipAddr.Unmap().Prefix(ones)
+	if err != nil {
+		return false
+	}
+
+	return prefix.Addr() == pi.NetworkIPAddr.Unmap()
+}
+
+// CheckPoolRange makes sure Start and End, when set, genuinely belong to the
+// subnet of the CIDR.
+func CheckPoolRange(pi PoolInfo) error {
+	if pi.StartIPAddr.IsValid() && !pi.InSubnet(pi.StartIPAddr) {
+		return fmt.Errorf("start ip %s is not within subnet", pi.StartIPAddr)
+	}
+
+	if pi.EndIPAddr.IsValid() && !pi.InSubnet(pi.EndIPAddr) {
+		return fmt.Errorf("end ip %s is not within subnet", pi.EndIPAddr)
+	}
+
+	return nil
+}
+
+// DefaultMaxPoolSize is the default maximum amount of allocatable addresses of
+// an IPPool. The IPAM keeps track of every address in the range, so huge
+// ranges would exhaust the memory of the controller.
+const DefaultMaxPoolSize = 65536
+
+// Size returns the amount of addresses in the allocatable range of the pool,
+// leaving out the excluded ones. The CIDR doesn't count, so a small range of a
+// huge CIDR makes a small pool. It's computed rather than counted, and
+// saturates at math.MaxUint64 for the huge ranges of IPv6 prefixes.
+func (pi PoolInfo) Size(excluded []string) uint64 {
+	first, last := pi.allocatableRange()
+	if !first.IsValid() || !last.IsValid() || first.BitLen() != last.BitLen() || last.Less(first) {
+		return 0
+	}
+
+	size := addrSpan(first, last)
+	if size == math.MaxUint64 {
+		return size
+	}
+
+	seen := make(map[netip.Addr]struct{}, len(excluded))
+	for _, ip := range excluded {
+		ipAddr, err := netip.ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+		ipAddr = ipAddr.Unmap()
+		if _, ok := seen[ipAddr]; ok || ipAddr.Less(first) || last.Less(ipAddr) {
+			continue
+		}
+		seen[ipAddr] = struct{}{}
+		size--
+	}
+
+	return size
+}
+
+// CheckPoolSize makes sure the pool has no more than maxPoolSize allocatable
+// addresses after exclusions. A maxPoolSize of zero or less means no limit.
+func CheckPoolSize(pi PoolInfo, excluded []string, maxPoolSize int) error {
+	if maxPoolSize <= 0 {
+		return nil
+	}
+
+	if size := pi.Size(excluded); size > uint64(maxPoolSize) {
+		return fmt.Errorf("pool range has %d allocatable addresses, more than the maximum of %d; narrow the range or raise the limit with --max-pool-size", size, maxPoolSize)
+	}
+
+	return nil
+}
+
+// PoolRangeError tells which bound of a pool range is wrong, and why.
+type PoolRangeError struct {
+	// Bound is either "start" or "end"
+	Bound  string
+	Addr   netip.Addr
+	Reason string
+}
+
+func (e *PoolRangeError) Error() string {
+	return fmt.Sprintf("pool %s %s %s", e.Bound, e.Addr, e.Reason)
+}
+
+// ValidatePoolRange makes sure the bounds of the pool range are within the
+// subnet and the start isn't after the end. A bound left empty, i.e., the
+// edge of the subnet, is always fine. Every wrong bound is reported, each as a
+// *PoolRangeError, joined into the error returned.
+func ValidatePoolRange(pi PoolInfo) error {
+	var errs []error
+
+	inSubnet := func(bound string, addr netip.Addr) bool {
+		if !addr.IsValid() {
+			return false
+		}
+		if !pi.InSubnet(addr) {
+			errs = append(errs, &PoolRangeError{Bound: bound, Addr: addr, Reason: fmt.Sprintf("must be within subnet %s", pi.IPNet)})
+			return false
+		}
+		return true
+	}
+	startOK := inSubnet("start", pi.StartIPAddr)
+	endOK := inSubnet("end", pi.EndIPAddr)
+
+	if startOK && endOK && pi.StartIPAddr.Unmap().Compare(pi.EndIPAddr.Unmap()) > 0 {
+		errs = append(errs, &PoolRangeError{Bound: "end", Addr: pi.EndIPAddr, Reason: fmt.Sprintf("must not be before start %s", pi.StartIPAddr)})
+	}
+
+	return errors.Join(errs...)
+}
+
+// GatewayAddrError tells which of the server and router IP addresses of a pool
+// is wrong, and why.
+type GatewayAddrError struct {
+	// Field is either "serverIP" or "router"
+	Field  string
+	Addr   netip.Addr
+	Reason string
+}
+
+func (e *GatewayAddrError) Error() string {
+	name := "server ip"
+	if e.Field == "router" {
+		name = "router"
+	}
+	return fmt.Sprintf("%s %s %s", name, e.Addr, e.Reason)
+}
+
+// ValidateGatewayAddrs makes sure the server and router IP addresses of the
+// pool, when set, are host addresses of the subnet, i.e., within it and
+// neither its network nor its broadcast address, even if the pool allows
+// them. Otherwise, the clients can't reach them. The server must not be the
+// router either. Every wrong address is reported, each as a
+// *GatewayAddrError, joined into the error returned.
+func ValidateGatewayAddrs(pi PoolInfo) error {
+	var errs []error
+
+	for _, gateway := range []struct {
+		field string
+		addr  netip.Addr
+	}{
+		{field: "serverIP", addr: pi.ServerIPAddr},
+		{field: "router", addr: pi.RouterIPAddr},
+	} {
+		if !gateway.addr.IsValid() {
+			continue
+		}
+		addr := gateway.addr.Unmap()
+
+		var reason string
+		switch {
+		case pi.IPNet == nil || !pi.IPNet.Contains(addr.AsSlice()):
+			reason = fmt.Sprintf("must be within subnet %s", pi.IPNet)
+		case addr == pi.NetworkIPAddr:
+			reason = "must not be the network ip"
+		case addr == pi.BroadcastIPAddr:
+			reason = "must not be the broadcast ip"
+		default:
+			continue
+		}
+		errs = append(errs, &GatewayAddrError{Field: gateway.field, Addr: gateway.addr, Reason: reason})
+	}
+
+	if len(errs) == 0 && pi.ServerIPAddr.IsValid() && pi.ServerIPAddr == pi.RouterIPAddr {
+		errs = append(errs, &GatewayAddrError{Field: "serverIP", Addr: pi.ServerIPAddr, Reason: "must not be the router ip"})
+	}
+
+	return errors.Join(errs...)
+}
+
+// GatewayAddrCollisions returns, for each of the server and router IP
+// addresses of the pool found in reserved, a message naming it along with what
+// it's reserved for, e.g., the static IP address of a VM. Such a VM can't get
+// its address, and the others on the network would use it as their gateway.
+func GatewayAddrCollisions(pi PoolInfo, reserved map[netip.Addr]string) []string {
+	var collisions []string
+
+	if holder, ok := reserved[pi.ServerIPAddr]; ok && pi.ServerIPAddr.IsValid() {
+		collisions = append(collisions, fmt.Sprintf("server ip %s is reserved for %s", pi.ServerIPAddr, holder))
+	}
+	if pi.RouterIPAddr == pi.ServerIPAddr {
+		return collisions
+	}
+	if holder, ok := reserved[pi.RouterIPAddr]; ok && pi.RouterIPAddr.IsValid() {
+		collisions = append(collisions, fmt.Sprintf("router %s is reserved for %s", pi.RouterIPAddr, holder))
+	}
+
+	return collisions
+}
+
+// IPNetsOverlap reports whether the two subnets share any address, i.e.,
+// whether either one contains the network address of the other.
+func IPNetsOverlap(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// PoolInfosOverlap reports whether the allocatable ranges of the two pools
+// intersect. Pools of different address families never overlap.
+func PoolInfosOverlap(a, b PoolInfo) bool {
+	aFirst, aLast := a.allocatableRange()
+	bFirst, bLast := b.allocatableRange()
+
+	if !aFirst.IsValid() || !aLast.IsValid() || !bFirst.IsValid() || !bLast.IsValid() {
+		return false
+	}
+
+	if aFirst.BitLen() != bFirst.BitLen() {
+		return false
+	}
+
+	return aFirst.Compare(bLast) <= 0 && bFirst.Compare(aLast) <= 0
+}
+
+// IsIPAddrInList reports whether ipAddr is in ipAddrList. IPv4-mapped IPv6
+// addresses match their IPv4 address.
 func IsIPAddrInList(ipAddr netip.Addr, ipAddrList []netip.Addr) bool {
+	ipAddr = ipAddr.Unmap()
 	for i := range ipAddrList {
-		if ipAddr == ipAddrList[i] {
+		if ipAddr == ipAddrList[i].Unmap() {
 			return true
 		}
 	}
 	return false
 }
 
+// IsIPInBetweenOf reports whether ip is within the range from ip1 to ip2, both
+// included. IPv4-mapped IPv6 addresses are taken for their IPv4 address, and
+// addresses of different families are never in between of one another.
 func IsIPInBetweenOf(ip, ip1, ip2 string) bool {
 	ipAddr, err := netip.ParseAddr(ip)
 	if err != nil {
@@ -165,17 +897,61 @@ func IsIPInBetweenOf(ip, ip1, ip2 string) bool {
 		return false
 	}
 
+	ipAddr, ip1Addr, ip2Addr = ipAddr.Unmap(), ip1Addr.Unmap(), ip2Addr.Unmap()
+	if ipAddr.BitLen() != ip1Addr.BitLen() || ipAddr.BitLen() != ip2Addr.BitLen() {
+		return false
+	}
+
 	return ipAddr.Compare(ip1Addr) >= 0 && ipAddr.Compare(ip2Addr) <= 0
 }
 
+// GlobalNetworkNamespace is where the NetworkAttachmentDefinitions shared by
+// all namespaces live, like the global namespace of Multus.
+const GlobalNetworkNamespace = "default"
+
+// ErrAmbiguousNetwork tells a network name without a namespace matches
+// NetworkAttachmentDefinitions pointing to different IPPools.
+var ErrAmbiguousNetwork = errors.New("ambiguous network name")
+
+// AmbiguousNetworkError names the NetworkAttachmentDefinitions an ambiguous
+// network name matches and the IPPools they point to, both as
+// <namespace>/<name> and in the same order.
+type AmbiguousNetworkError struct {
+	NetworkName string
+	Candidates  []string
+	IPPools     []string
+}
+
+func (e *AmbiguousNetworkError) Error() string {
+	pairs := make([]string, 0, len(e.Candidates))
+	for i := range e.Candidates {
+		pairs = append(pairs, fmt.Sprintf("%s (ippool %s)", e.Candidates[i], e.IPPools[i]))
+	}
+	return fmt.Sprintf("network %s matches network attachment definitions %s; qualify it with a namespace",
+		e.NetworkName, strings.Join(pairs, " and "))
+}
+
+func (e *AmbiguousNetworkError) Unwrap() error {
+	return ErrAmbiguousNetwork
+}
+
 // GetIPPoolFromNetworkName resolves an IPPool from a network name by:
 // 1. Looking up the NetworkAttachmentDefinition
 // 2. Reading IPPool namespace/name from NAD labels
 // 3. Retrieving the IPPool resource
+// 4. Switching to the IPPool it delegates to in fallbackNamespace, if any
 //
 // If networkName doesn't include a namespace prefix (e.g., "my-network" vs "default/my-network"),
 // it defaults to the provided fallbackNamespace. Pass an empty string to fallbackNamespace
 // to use no default (namespace will be empty if not specified in networkName).
+// Callers pass the namespace of the consumer, i.e., the VM or the
+// VirtualMachineNetworkConfig, so that it's also used to pick the delegated IPPool.
+//
+// A network name without a namespace is ambiguous when the
+// NetworkAttachmentDefinition of the same name in GlobalNetworkNamespace
+// points to another IPPool than the one in fallbackNamespace. Rather than
+// guessing, an *AmbiguousNetworkError is returned then. A network name with a
+// namespace is never ambiguous.
 //
 // This function provides a single source of truth for IPPool lookup logic, preventing
 // duplication across controllers and webhooks.
@@ -193,10 +969,40 @@ func GetIPPoolFromNetworkName(
 	fallbackNamespace string,
 ) (*networkv1.IPPool, error) {
 	nadNamespace, nadName := kv.RSplit(networkName, "/")
-	if nadNamespace == "" {
+	qualified := nadNamespace != ""
+	if !qualified {
 		nadNamespace = fallbackNamespace
 	}
 
+	ipPool, err := getIPPoolFromNAD(nadCache, ippoolCache, nadNamespace, nadName, fallbackNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if !qualified && nadNamespace != GlobalNetworkNamespace {
+		// A NetworkAttachmentDefinition of the global namespace not
+		// resolving to an IPPool isn't one the name could be taken for
+		global, err := getIPPoolFromNAD(nadCache, ippoolCache, GlobalNetworkNamespace, nadName, fallbackNamespace)
+		if err == nil && (global.Namespace != ipPool.Namespace || global.Name != ipPool.Name) {
+			return nil, &AmbiguousNetworkError{
+				NetworkName: networkName,
+				Candidates:  []string{nadNamespace + "/" + nadName, GlobalNetworkNamespace + "/" + nadName},
+				IPPools:     []string{ipPool.Namespace + "/" + ipPool.Name, global.Namespace + "/" + global.Name},
+			}
+		}
+	}
+
+	return ipPool, nil
+}
+
+// getIPPoolFromNAD resolves the IPPool of the NetworkAttachmentDefinition for
+// consumers in the namespace.
+func getIPPoolFromNAD(
+	nadCache ctlcniv1.NetworkAttachmentDefinitionCache,
+	ippoolCache ctlnetworkv1.IPPoolCache,
+	nadNamespace, nadName string,
+	consumerNamespace string,
+) (*networkv1.IPPool, error) {
 	nad, err := nadCache.Get(nadNamespace, nadName)
 	if err != nil {
 		return nil, fmt.Errorf("network attachment definition %s/%s not found: %w", nadNamespace, nadName, err)
@@ -221,5 +1027,49 @@ func GetIPPoolFromNetworkName(
 		return nil, fmt.Errorf("ippool %s/%s not found: %w", ipPoolNamespace, ipPoolName, err)
 	}
 
+	// The consumers in a namespace the IPPool delegates to are served by the
+	// delegated IPPool instead
+	delegated, err := GetDelegatedPool(ippoolCache, ipPool, consumerNamespace)
+	if err != nil {
+		return nil, err
+	}
+	if delegated != nil {
+		return delegated, nil
+	}
+
 	return ipPool, nil
 }
+
+// MergeStaticRoutes merges the user-specified static routes with the
+// generated ones. A generated route is dropped if a user-specified route
+// already targets the same destination, i.e., user entries always win.
+func MergeStaticRoutes(userRoutes, generatedRoutes []networkv1.Route) []networkv1.Route {
+	if len(userRoutes) == 0 && len(generatedRoutes) == 0 {
+		return nil
+	}
+
+	routes := make([]networkv1.Route, 0, len(userRoutes)+len(generatedRoutes))
+	destinations := make(map[string]struct{}, len(userRoutes))
+
+	for _, route := range userRoutes {
+		destinations[normalizeRouteDestination(route.Destination)] = struct{}{}
+		routes = append(routes, route)
+	}
+
+	for _, route := range generatedRoutes {
+		if _, exists := destinations[normalizeRouteDestination(route.Destination)]; exists {
+			continue
+		}
+		routes = append(routes, route)
+	}
+
+	return routes
+}
+
+func normalizeRouteDestination(destination string) string {
+	prefix, err := netip.ParsePrefix(destination)
+	if err != nil {
+		return destination
+	}
+	return prefix.Masked().String()
+}
@@ -0,0 +1,1201 @@
+package util
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
+)
+
+func newTestPoolInfo(t *testing.T, cidr, start, end string) PoolInfo {
+	ipPool := &networkv1.IPPool{
+		Spec: networkv1.IPPoolSpec{
+			IPv4Config: networkv1.IPv4Config{
+				CIDR: cidr,
+				Pool: networkv1.Pool{
+					Start: start,
+					End:   end,
+				},
+			},
+		},
+	}
+
+	pi, err := LoadPool(ipPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pi
+}
+
+func TestGenerateMACAddress(t *testing.T) {
+	const (
+		uid1 = "3a955369-9eaa-43db-94f3-9153289d7dc2"
+		uid2 = "f3c1a9a2-5b8e-4d2f-9c1e-7a6b5d4c3b2a"
+	)
+
+	mac := GenerateMACAddress(uid1, "nic1")
+	assert.Equal(t, mac, GenerateMACAddress(uid1, "nic1"), "same vm and interface should get the same mac")
+	assert.NotEqual(t, mac, GenerateMACAddress(uid1, "nic2"), "interfaces should get different macs")
+	assert.NotEqual(t, mac, GenerateMACAddress(uid2, "nic1"), "vms should get different macs")
+
+	for _, nicName := range []string{"nic1", "nic2", "default", "eth0", "lan"} {
+		hwAddr, err := net.ParseMAC(GenerateMACAddress(uid1, nicName))
+		assert.Nil(t, err, nicName)
+		assert.Len(t, hwAddr, 6, nicName)
+		assert.Equal(t, byte(0x02), hwAddr[0]&0x02, "%s should be locally administered", nicName)
+		assert.Equal(t, byte(0x00), hwAddr[0]&0x01, "%s should be unicast", nicName)
+	}
+}
+
+func TestParseMAC(t *testing.T) {
+	tests := []struct {
+		name       string
+		macAddress string
+		expected   string
+		err        string
+	}{
+		{name: "canonical", macAddress: "fa:cf:8e:50:82:fc", expected: "fa:cf:8e:50:82:fc"},
+		{name: "uppercase", macAddress: "FA:CF:8E:50:82:FC", expected: "fa:cf:8e:50:82:fc"},
+		{name: "dash separated", macAddress: "FA-CF-8E-50-82-FC", expected: "fa:cf:8e:50:82:fc"},
+		{name: "cisco dotted", macAddress: "facf.8e50.82fc", expected: "fa:cf:8e:50:82:fc"},
+		{name: "surrounding spaces", macAddress: " fa:cf:8e:50:82:fc\n", expected: "fa:cf:8e:50:82:fc"},
+		{name: "empty", macAddress: "", err: `mac address "" is not valid`},
+		{name: "truncated", macAddress: "fa:cf:8e:50:82", err: `mac address "fa:cf:8e:50:82" is not valid`},
+		{name: "not hexadecimal", macAddress: "fa:cf:8e:50:82:zz", err: `mac address "fa:cf:8e:50:82:zz" is not valid`},
+		{name: "eui-64", macAddress: "fa:cf:8e:ff:fe:50:82:fc", err: `mac address "fa:cf:8e:ff:fe:50:82:fc" is not a 48-bit mac address`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			macAddress, err := ParseMAC(tc.macAddress)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, macAddress)
+			assert.Equal(t, tc.expected, NormalizeMAC(tc.macAddress))
+		})
+	}
+
+	assert.Equal(t, "not-a-mac", NormalizeMAC(" NOT-A-MAC "), "unparsable addresses should only be lowercased")
+}
+
+func TestLastUsable(t *testing.T) {
+	testCases := []struct {
+		cidr     string
+		expected string
+		err      bool
+	}{
+		{cidr: "192.168.0.0/24", expected: "192.168.0.254"},
+		{cidr: "192.168.0.8/30", expected: "192.168.0.10"},
+		{cidr: "192.168.0.8/31", expected: "192.168.0.9"},
+		{cidr: "192.168.0.8/32", expected: "192.168.0.8"},
+		{cidr: "2001:db8::/64", err: true},
+	}
+
+	for _, tc := range testCases {
+		_, ipNet, err := net.ParseCIDR(tc.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lastUsable, err := LastUsable(ipNet)
+		if tc.err {
+			assert.NotNil(t, err, tc.cidr)
+			continue
+		}
+		assert.Nil(t, err, tc.cidr)
+		assert.Equal(t, netip.MustParseAddr(tc.expected), lastUsable, tc.cidr)
+	}
+
+	_, err := LastUsable(nil)
+	assert.NotNil(t, err)
+}
+
+func TestLoadPool_DefaultEnd(t *testing.T) {
+	pi := newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.10", "")
+	assert.Equal(t, netip.MustParseAddr("192.168.0.254"), pi.EndIPAddr, "unset end should default to the last usable address")
+
+	pi = newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.10", "192.168.0.100")
+	assert.Equal(t, netip.MustParseAddr("192.168.0.100"), pi.EndIPAddr, "set end should be kept")
+}
+
+func TestLoadPool_AllowNetworkBroadcast(t *testing.T) {
+	ipPool := &networkv1.IPPool{
+		Spec: networkv1.IPPoolSpec{
+			IPv4Config: networkv1.IPv4Config{
+				CIDR: "192.168.0.0/24",
+				Pool: networkv1.Pool{
+					Start:                 "192.168.0.0",
+					AllowNetworkBroadcast: true,
+				},
+			},
+		},
+	}
+
+	pi, err := LoadPool(ipPool)
+	assert.Nil(t, err)
+	assert.True(t, pi.AllowNetworkBroadcast)
+	assert.Equal(t, netip.MustParseAddr("192.168.0.255"), pi.EndIPAddr, "unset end should default to the broadcast address")
+	assert.Equal(t, uint64(256), pi.Size(nil), "network and broadcast addresses should be allocatable")
+
+	hash := AllocatorInputsHash(ipPool)
+	ipPool.Spec.IPv4Config.Pool.AllowNetworkBroadcast = false
+	assert.NotEqual(t, hash, AllocatorInputsHash(ipPool), "toggling the network and broadcast addresses should rebuild the ipam")
+}
+
+func TestLoadPool_DNSServers(t *testing.T) {
+	ipPool := &networkv1.IPPool{
+		Spec: networkv1.IPPoolSpec{
+			IPv4Config: networkv1.IPv4Config{
+				CIDR: "192.168.0.0/24",
+				Pool: networkv1.Pool{Start: "192.168.0.10"},
+				DNS:  []string{"1.1.1.1", "8.8.8.8"},
+			},
+		},
+	}
+
+	pi, err := LoadPool(ipPool)
+	assert.Nil(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("8.8.8.8")}, pi.DNSServers)
+
+	ipPool.Spec.IPv4Config.DNS = append(ipPool.Spec.IPv4Config.DNS, "2001:4860:4860::8888")
+	_, err = LoadPool(ipPool)
+	assert.EqualError(t, err, "dns server 2001:4860:4860::8888 is not of the address family of the config")
+}
+
+func TestLoadPool_Domains(t *testing.T) {
+	domainName := "example.com."
+	ipPool := &networkv1.IPPool{
+		Spec: networkv1.IPPoolSpec{
+			IPv4Config: networkv1.IPv4Config{
+				CIDR:         "192.168.0.0/24",
+				Pool:         networkv1.Pool{Start: "192.168.0.10"},
+				DomainName:   &domainName,
+				DomainSearch: []string{"eng.example.com", "example.org."},
+			},
+		},
+	}
+
+	pi, err := LoadPool(ipPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com", pi.DomainName)
+	assert.Equal(t, []string{"eng.example.com", "example.org"}, pi.DomainSearch)
+
+	ipPool.Spec.IPv4Config.DomainSearch = append(ipPool.Spec.IPv4Config.DomainSearch, "-eng.example.net")
+	_, err = LoadPool(ipPool)
+	assert.EqualError(t, err, "search domain -eng.example.net is not valid: label -eng starts or ends with a hyphen")
+}
+
+func TestLoadPool_StaticRoutes(t *testing.T) {
+	ipPool := &networkv1.IPPool{
+		Spec: networkv1.IPPoolSpec{
+			IPv4Config: networkv1.IPv4Config{
+				CIDR: "192.168.0.0/24",
+				Pool: networkv1.Pool{Start: "192.168.0.10"},
+				StaticRoutes: []networkv1.Route{
+					{Destination: "10.0.0.0/8", Gateway: "192.168.0.254"},
+					{Destination: "172.16.1.1/24", Gateway: "0.0.0.0"},
+				},
+			},
+		},
+	}
+
+	pi, err := LoadPool(ipPool)
+	assert.Nil(t, err)
+	assert.Equal(t, []StaticRoute{
+		{Destination: netip.MustParsePrefix("10.0.0.0/8"), Gateway: netip.MustParseAddr("192.168.0.254")},
+		{Destination: netip.MustParsePrefix("172.16.1.0/24"), Gateway: netip.MustParseAddr("0.0.0.0")},
+	}, pi.StaticRoutes, "destinations should have their host bits cleared")
+
+	ipPool.Spec.IPv4Config.StaticRoutes = append(ipPool.Spec.IPv4Config.StaticRoutes, networkv1.Route{Destination: "2001:db8::/64", Gateway: "192.168.0.254"})
+	_, err = LoadPool(ipPool)
+	assert.EqualError(t, err, "static route destination 2001:db8::/64 is not an IPv4 cidr")
+}
+
+func TestCheckDomainName(t *testing.T) {
+	tests := []struct {
+		name       string
+		domainName string
+		err        string
+	}{
+		{name: "single label", domainName: "localdomain"},
+		{name: "fully qualified", domainName: "eng.Example.com."},
+		{name: "hyphens and digits", domainName: "rack-42.dc1.example.com"},
+		{name: "empty", domainName: ".", err: "name is empty"},
+		{name: "empty label", domainName: "eng..example.com", err: "name has an empty label"},
+		{name: "long label", domainName: strings.Repeat("a", 64) + ".com", err: "label " + strings.Repeat("a", 64) + " is longer than 63 characters"},
+		{name: "long name", domainName: strings.Repeat(strings.Repeat("a", 63)+".", 4) + "com", err: "name is longer than 253 characters"},
+		{name: "trailing hyphen", domainName: "eng-.example.com", err: "label eng- starts or ends with a hyphen"},
+		{name: "underscore", domainName: "eng_lab.example.com", err: "label eng_lab has characters other than letters, digits, and hyphens"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckDomainName(tc.domainName)
+			if tc.err == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestLoadPool_Count(t *testing.T) {
+	newIPPool := func(start, end string, count int) *networkv1.IPPool {
+		return &networkv1.IPPool{
+			Spec: networkv1.IPPoolSpec{
+				IPv4Config: networkv1.IPv4Config{
+					CIDR: "10.0.0.0/24",
+					Pool: networkv1.Pool{
+						Start: start,
+						End:   end,
+						Count: count,
+					},
+				},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		ipPool   *networkv1.IPPool
+		expected string
+		err      string
+	}{
+		{
+			name:     "end derived from count",
+			ipPool:   newIPPool("10.0.0.20", "", 50),
+			expected: "10.0.0.69",
+		},
+		{
+			name:     "single address",
+			ipPool:   newIPPool("10.0.0.20", "", 1),
+			expected: "10.0.0.20",
+		},
+		{
+			name:     "up to the last usable address",
+			ipPool:   newIPPool("10.0.0.200", "", 55),
+			expected: "10.0.0.254",
+		},
+		{
+			name:   "past the last usable address",
+			ipPool: newIPPool("10.0.0.200", "", 56),
+			err:    "pool of 56 addresses from 10.0.0.200 exceeds the usable addresses of cidr 10.0.0.0/24",
+		},
+		{
+			name:   "start out of the cidr",
+			ipPool: newIPPool("10.0.1.20", "", 10),
+			err:    "pool start 10.0.1.20 is not within cidr 10.0.0.0/24",
+		},
+		{
+			name:   "negative count",
+			ipPool: newIPPool("10.0.0.20", "", -1),
+			err:    "pool count -1 is not positive",
+		},
+		{
+			name:   "both end and count",
+			ipPool: newIPPool("10.0.0.20", "10.0.0.69", 50),
+			err:    "pool end 10.0.0.69 and count 50 are ambiguous; set only one of them",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pi, err := LoadPool(tc.ipPool)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, netip.MustParseAddr(tc.expected), pi.EndIPAddr)
+			assert.Equal(t, tc.expected, PoolEnd(tc.ipPool))
+		})
+	}
+}
+
+func TestAllocatorInputsHash(t *testing.T) {
+	newIPPool := func() *networkv1.IPPool {
+		return &networkv1.IPPool{
+			Spec: networkv1.IPPoolSpec{
+				IPv4Config: networkv1.IPv4Config{
+					CIDR:     "10.0.0.0/24",
+					ServerIP: "10.0.0.2",
+					Router:   "10.0.0.1",
+					Pool: networkv1.Pool{
+						Start:   "10.0.0.10",
+						End:     "10.0.0.100",
+						Exclude: []string{"10.0.0.20", "10.0.0.21"},
+					},
+				},
+			},
+		}
+	}
+	leaseTime := 600
+
+	testCases := []struct {
+		name    string
+		mutate  func(ipPool *networkv1.IPPool)
+		changed bool
+	}{
+		{
+			name: "dns servers",
+			mutate: func(ipPool *networkv1.IPPool) {
+				ipPool.Spec.IPv4Config.DNS = []string{"1.1.1.1"}
+			},
+		},
+		{
+			name: "lease time",
+			mutate: func(ipPool *networkv1.IPPool) {
+				ipPool.Spec.IPv4Config.LeaseTime = &leaseTime
+			},
+		},
+		{
+			name: "excluded addresses reordered",
+			mutate: func(ipPool *networkv1.IPPool) {
+				ipPool.Spec.IPv4Config.Pool.Exclude = []string{"10.0.0.21", "10.0.0.20"}
+			},
+		},
+		{
+			name: "excluded address added",
+			mutate: func(ipPool *networkv1.IPPool) {
+				ipPool.Spec.IPv4Config.Pool.Exclude = append(ipPool.Spec.IPv4Config.Pool.Exclude, "10.0.0.22")
+			},
+			changed: true,
+		},
+		{
+			name: "pool range",
+			mutate: func(ipPool *networkv1.IPPool) {
+				ipPool.Spec.IPv4Config.Pool.End = "10.0.0.200"
+			},
+			changed: true,
+		},
+		{
+			name: "router",
+			mutate: func(ipPool *networkv1.IPPool) {
+				ipPool.Spec.IPv4Config.Router = "10.0.0.254"
+			},
+			changed: true,
+		},
+		{
+			name: "reservation added",
+			mutate: func(ipPool *networkv1.IPPool) {
+				ipPool.Spec.IPv4Config.Reservations = []networkv1.Reservation{
+					{MACAddress: "aa:bb:cc:dd:ee:ff", IPAddress: "10.0.0.50"},
+				}
+			},
+			changed: true,
+		},
+		{
+			name: "held-back range added",
+			mutate: func(ipPool *networkv1.IPPool) {
+				ipPool.Spec.IPv4Config.Pool.HoldBack = &networkv1.HoldBack{Start: "10.0.0.90", End: "10.0.0.100"}
+			},
+			changed: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ipPool := newIPPool()
+			tc.mutate(ipPool)
+			if tc.changed {
+				assert.NotEqual(t, AllocatorInputsHash(newIPPool()), AllocatorInputsHash(ipPool))
+			} else {
+				assert.Equal(t, AllocatorInputsHash(newIPPool()), AllocatorInputsHash(ipPool))
+			}
+		})
+	}
+}
+
+func TestPoolInfo_Size(t *testing.T) {
+	pi := newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.10", "192.168.0.19")
+	assert.Equal(t, uint64(10), pi.Size(nil))
+	assert.Equal(t, uint64(8), pi.Size([]string{"192.168.0.10", "192.168.0.15", "192.168.0.15", "192.168.0.100", "foo"}), "only distinct exclusions within the range should count")
+
+	pi = newTestPoolInfo(t, "10.0.0.0/8", "10.0.0.1", "10.0.0.254")
+	assert.Equal(t, uint64(254), pi.Size(nil), "a huge cidr should not count")
+
+	pi = newTestPoolInfo(t, "10.0.0.0/8", "", "")
+	assert.Equal(t, uint64(1<<24-1), pi.Size(nil), "unset range should span the cidr")
+
+	assert.Nil(t, CheckPoolSize(pi, nil, 0), "zero should mean no limit")
+	assert.NotNil(t, CheckPoolSize(pi, nil, DefaultMaxPoolSize))
+}
+
+func TestCheckPoolRange(t *testing.T) {
+	pi := newTestPoolInfo(t, "192.168.0.0/25", "192.168.0.10", "192.168.0.100")
+	assert.True(t, pi.InSubnet(pi.StartIPAddr))
+	assert.Nil(t, CheckPoolRange(pi))
+
+	pi = newTestPoolInfo(t, "192.168.0.0/25", "192.168.0.130", "192.168.0.100")
+	assert.False(t, pi.InSubnet(pi.StartIPAddr), "start of the neighboring subnet should not be within the cidr")
+	assert.EqualError(t, CheckPoolRange(pi), "start ip 192.168.0.130 is not within subnet")
+
+	pi = newTestPoolInfo(t, "192.168.0.0/25", "192.168.0.10", "192.168.0.200")
+	assert.EqualError(t, CheckPoolRange(pi), "end ip 192.168.0.200 is not within subnet")
+
+	pi = newTestPoolInfo(t, "192.168.0.128/25", "192.168.0.10", "192.168.0.100")
+	assert.NotNil(t, CheckPoolRange(pi), "range copy-pasted from the other half of the /24 should be rejected")
+
+	pi = newTestPoolInfo(t, "192.168.0.0/25", "", "")
+	assert.Nil(t, CheckPoolRange(pi), "unset start and end should be within the cidr")
+}
+
+func TestLoadCIDR_IPv6(t *testing.T) {
+	ipNet, networkIPAddr, broadcastIPAddr, err := LoadCIDR("2001:db8::/64")
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::/64", ipNet.String())
+	assert.Equal(t, netip.MustParseAddr("2001:db8::"), networkIPAddr)
+	assert.False(t, broadcastIPAddr.IsValid(), "ipv6 has no broadcast address")
+
+	_, _, broadcastIPAddr, err = LoadCIDR("192.168.0.0/24")
+	assert.Nil(t, err)
+	assert.Equal(t, netip.MustParseAddr("192.168.0.255"), broadcastIPAddr)
+}
+
+func TestLoadIPv6Pool(t *testing.T) {
+	newIPPool := func(cidr, start, end string, count int) *networkv1.IPPool {
+		return &networkv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "net-1"},
+			Spec: networkv1.IPPoolSpec{
+				IPv6Config: &networkv1.IPv6Config{
+					CIDR:     cidr,
+					ServerIP: "2001:db8::1",
+					Router:   "2001:db8::2",
+					Pool: networkv1.IPv6Pool{
+						Start: start,
+						End:   end,
+						Count: count,
+					},
+				},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name         string
+		ipPool       *networkv1.IPPool
+		expectedEnd  string
+		expectedSize uint64
+		err          string
+	}{
+		{
+			name:         "unset end takes the all-ones address",
+			ipPool:       newIPPool("2001:db8::/120", "2001:db8::10", "", 0),
+			expectedEnd:  "2001:db8::ff",
+			expectedSize: 240,
+		},
+		{
+			name:         "end derived from count",
+			ipPool:       newIPPool("2001:db8::/64", "2001:db8::10", "", 0x100),
+			expectedEnd:  "2001:db8::10f",
+			expectedSize: 256,
+		},
+		{
+			name:         "count up to the all-ones address",
+			ipPool:       newIPPool("2001:db8::/120", "2001:db8::f0", "", 16),
+			expectedEnd:  "2001:db8::ff",
+			expectedSize: 16,
+		},
+		{
+			name:   "count past the all-ones address",
+			ipPool: newIPPool("2001:db8::/120", "2001:db8::f0", "", 17),
+			err:    "pool of 17 addresses from 2001:db8::f0 exceeds the usable addresses of cidr 2001:db8::/120",
+		},
+		{
+			name:         "/64 saturates the size",
+			ipPool:       newIPPool("2001:db8::/64", "2001:db8::", "", 0),
+			expectedEnd:  "2001:db8::ffff:ffff:ffff:ffff",
+			expectedSize: math.MaxUint64,
+		},
+		{
+			name:   "link-local cidr",
+			ipPool: newIPPool("fe80::/64", "fe80::10", "", 0),
+			err:    "cidr fe80::/64 overlaps link-local prefix fe80::/10",
+		},
+		{
+			name:   "cidr holding the link-local prefix",
+			ipPool: newIPPool("fe00::/8", "fe00::10", "", 0),
+			err:    "cidr fe00::/8 overlaps link-local prefix fe80::/10",
+		},
+		{
+			name:   "ipv4 cidr",
+			ipPool: newIPPool("192.168.0.0/24", "192.168.0.10", "", 0),
+			err:    "cidr 192.168.0.0/24 is not of the address family of the config",
+		},
+		{
+			name:   "ipv4 start",
+			ipPool: newIPPool("2001:db8::/64", "192.168.0.10", "", 10),
+			err:    "pool count 10 needs an ipv6 start",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pi, err := LoadIPv6Pool(tc.ipPool)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.True(t, pi.IsIPv6())
+			assert.Equal(t, netip.MustParseAddr(tc.expectedEnd), pi.EndIPAddr)
+			assert.Equal(t, netip.MustParseAddr("2001:db8::1"), pi.ServerIPAddr)
+			assert.Equal(t, netip.MustParseAddr("2001:db8::2"), pi.RouterIPAddr)
+			assert.Equal(t, tc.expectedSize, pi.Size(nil))
+		})
+	}
+
+	_, err := LoadIPv6Pool(&networkv1.IPPool{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "net-1"}})
+	assert.EqualError(t, err, "ippool default/net-1 has no ipv6 config")
+}
+
+func TestIsIPInBetweenOf(t *testing.T) {
+	testCases := []struct {
+		ip, ip1, ip2 string
+		expected     bool
+	}{
+		{ip: "192.168.0.50", ip1: "192.168.0.10", ip2: "192.168.0.99", expected: true},
+		{ip: "192.168.0.100", ip1: "192.168.0.10", ip2: "192.168.0.99"},
+		{ip: "::ffff:192.168.0.50", ip1: "192.168.0.10", ip2: "192.168.0.99", expected: true},
+		{ip: "2001:db8::50", ip1: "2001:db8::10", ip2: "2001:db8::99", expected: true},
+		{ip: "2001:db8::100", ip1: "2001:db8::10", ip2: "2001:db8::99"},
+		{ip: "192.168.0.50", ip1: "192.168.0.10", ip2: "2001:db8::99"},
+		{ip: "2001:db8::50", ip1: "192.168.0.10", ip2: "2001:db8::99"},
+		{ip: "foo", ip1: "192.168.0.10", ip2: "192.168.0.99"},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, IsIPInBetweenOf(tc.ip, tc.ip1, tc.ip2), "%s in %s-%s", tc.ip, tc.ip1, tc.ip2)
+	}
+}
+
+func TestValidatePoolRange(t *testing.T) {
+	testCases := []struct {
+		name        string
+		start, end  string
+		expectedErr []string
+	}{
+		{
+			name:  "range within the subnet",
+			start: "192.168.0.10",
+			end:   "192.168.0.100",
+		},
+		{
+			name: "empty range is the whole subnet",
+		},
+		{
+			name:  "single address",
+			start: "192.168.0.10",
+			end:   "192.168.0.10",
+		},
+		{
+			name:  "start after end",
+			start: "192.168.0.100",
+			end:   "192.168.0.10",
+			expectedErr: []string{
+				"pool end 192.168.0.10 must not be before start 192.168.0.100",
+			},
+		},
+		{
+			name:  "start after the default end",
+			start: "192.168.1.10",
+			expectedErr: []string{
+				"pool start 192.168.1.10 must be within subnet 192.168.0.0/24",
+			},
+		},
+		{
+			name:  "both bounds out of the subnet",
+			start: "10.0.0.1",
+			end:   "10.0.0.10",
+			expectedErr: []string{
+				"pool start 10.0.0.1 must be within subnet 192.168.0.0/24",
+				"pool end 10.0.0.10 must be within subnet 192.168.0.0/24",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidatePoolRange(newTestPoolInfo(t, "192.168.0.0/24", tc.start, tc.end))
+			if len(tc.expectedErr) == 0 {
+				assert.Nil(t, err)
+				return
+			}
+			if assert.NotNil(t, err) {
+				assert.Equal(t, strings.Join(tc.expectedErr, "\n"), err.Error())
+				var rangeErr *PoolRangeError
+				assert.True(t, errors.As(err, &rangeErr), "bounds should be told apart")
+			}
+		})
+	}
+}
+
+func TestValidatePoolRange_OtherSubnet(t *testing.T) {
+	// The bounds are numerically close to the subnet, but the mask of the
+	// CIDR tells them apart
+	testCases := []struct {
+		name        string
+		cidr        string
+		start, end  string
+		expectedErr []string
+	}{
+		{
+			name:  "upper half of the /24 of a /25",
+			cidr:  "192.168.0.0/25",
+			start: "192.168.0.130",
+			end:   "192.168.0.140",
+			expectedErr: []string{
+				"pool start 192.168.0.130 must be within subnet 192.168.0.0/25",
+				"pool end 192.168.0.140 must be within subnet 192.168.0.0/25",
+			},
+		},
+		{
+			name:  "end in the next subnet",
+			cidr:  "192.168.0.128/25",
+			start: "192.168.0.130",
+			end:   "192.168.1.10",
+			expectedErr: []string{
+				"pool end 192.168.1.10 must be within subnet 192.168.0.128/25",
+			},
+		},
+		{
+			name:  "start in the previous subnet",
+			cidr:  "10.0.1.0/24",
+			start: "10.0.0.250",
+			end:   "10.0.1.10",
+			expectedErr: []string{
+				"pool start 10.0.0.250 must be within subnet 10.0.1.0/24",
+			},
+		},
+		{
+			name:  "cidr given with host bits",
+			cidr:  "192.168.0.200/25",
+			start: "192.168.0.130",
+			end:   "192.168.0.140",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidatePoolRange(newTestPoolInfo(t, tc.cidr, tc.start, tc.end))
+			if len(tc.expectedErr) == 0 {
+				assert.Nil(t, err)
+				return
+			}
+			if assert.NotNil(t, err) {
+				assert.Equal(t, strings.Join(tc.expectedErr, "\n"), err.Error())
+			}
+		})
+	}
+}
+
+func TestValidateGatewayAddrs(t *testing.T) {
+	testCases := []struct {
+		name             string
+		cidr             string
+		serverIP, router string
+		expectedErr      []string
+	}{
+		{
+			name:     "gateways within the subnet",
+			cidr:     "192.168.0.0/24",
+			serverIP: "192.168.0.2",
+			router:   "192.168.0.1",
+		},
+		{
+			name: "no gateways",
+			cidr: "192.168.0.0/24",
+		},
+		{
+			name:     "server ip is the router",
+			cidr:     "192.168.0.0/24",
+			serverIP: "192.168.0.1",
+			router:   "192.168.0.1",
+			expectedErr: []string{
+				"server ip 192.168.0.1 must not be the router ip",
+			},
+		},
+		{
+			name:   "router out of the subnet",
+			cidr:   "192.168.0.0/24",
+			router: "192.168.1.1",
+			expectedErr: []string{
+				"router 192.168.1.1 must be within subnet 192.168.0.0/24",
+			},
+		},
+		{
+			name:     "both host addresses of a /30",
+			cidr:     "192.168.0.0/30",
+			serverIP: "192.168.0.1",
+			router:   "192.168.0.2",
+		},
+		{
+			name:     "network and broadcast ip of a /30",
+			cidr:     "192.168.0.0/30",
+			serverIP: "192.168.0.0",
+			router:   "192.168.0.3",
+			expectedErr: []string{
+				"server ip 192.168.0.0 must not be the network ip",
+				"router 192.168.0.3 must not be the broadcast ip",
+			},
+		},
+		{
+			name:     "first address past a /30",
+			cidr:     "192.168.0.0/30",
+			serverIP: "192.168.0.1",
+			router:   "192.168.0.4",
+			expectedErr: []string{
+				"router 192.168.0.4 must be within subnet 192.168.0.0/30",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pi := newTestPoolInfo(t, tc.cidr, "", "")
+			if tc.serverIP != "" {
+				pi.ServerIPAddr = netip.MustParseAddr(tc.serverIP)
+			}
+			if tc.router != "" {
+				pi.RouterIPAddr = netip.MustParseAddr(tc.router)
+			}
+
+			err := ValidateGatewayAddrs(pi)
+			if len(tc.expectedErr) == 0 {
+				assert.Nil(t, err)
+				return
+			}
+			if assert.NotNil(t, err) {
+				assert.Equal(t, strings.Join(tc.expectedErr, "\n"), err.Error())
+				var gatewayErr *GatewayAddrError
+				assert.True(t, errors.As(err, &gatewayErr), "gateways should be told apart")
+			}
+		})
+	}
+}
+
+func TestGatewayAddrCollisions(t *testing.T) {
+	pi := newTestPoolInfo(t, "192.168.0.0/30", "", "")
+	pi.ServerIPAddr = netip.MustParseAddr("192.168.0.1")
+	pi.RouterIPAddr = netip.MustParseAddr("192.168.0.2")
+
+	reserved := map[netip.Addr]string{
+		netip.MustParseAddr("192.168.0.2"): "mac 11:22:33:44:55:66 of vmnetcfg default/vm-1",
+	}
+	assert.Equal(t, []string{"router 192.168.0.2 is reserved for mac 11:22:33:44:55:66 of vmnetcfg default/vm-1"},
+		GatewayAddrCollisions(pi, reserved))
+
+	// The server being the router is reported once
+	pi.RouterIPAddr = pi.ServerIPAddr
+	reserved[pi.ServerIPAddr] = "mac 11:22:33:44:55:77 of vmnetcfg default/vm-2"
+	assert.Equal(t, []string{"server ip 192.168.0.1 is reserved for mac 11:22:33:44:55:77 of vmnetcfg default/vm-2"},
+		GatewayAddrCollisions(pi, reserved))
+
+	assert.Empty(t, GatewayAddrCollisions(PoolInfo{}, reserved))
+}
+
+func TestIsIPAddrInList(t *testing.T) {
+	list := []netip.Addr{netip.MustParseAddr("192.168.0.10"), netip.MustParseAddr("2001:db8::10")}
+
+	assert.True(t, IsIPAddrInList(netip.MustParseAddr("192.168.0.10"), list))
+	assert.True(t, IsIPAddrInList(netip.MustParseAddr("::ffff:192.168.0.10"), list), "ipv4-mapped address should match")
+	assert.True(t, IsIPAddrInList(netip.MustParseAddr("2001:db8::10"), list))
+	assert.False(t, IsIPAddrInList(netip.MustParseAddr("2001:db8::11"), list))
+}
+
+func TestPoolInfosOverlap(t *testing.T) {
+	testCases := []struct {
+		name     string
+		a        PoolInfo
+		b        PoolInfo
+		expected bool
+	}{
+		{
+			name:     "overlapping ranges",
+			a:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.10", "192.168.0.100"),
+			b:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.50", "192.168.0.150"),
+			expected: true,
+		},
+		{
+			name:     "identical ranges",
+			a:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.10", "192.168.0.100"),
+			b:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.10", "192.168.0.100"),
+			expected: true,
+		},
+		{
+			name:     "one range contains the other",
+			a:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.10", "192.168.0.200"),
+			b:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.50", "192.168.0.60"),
+			expected: true,
+		},
+		{
+			name:     "ranges touching at a single address",
+			a:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.10", "192.168.0.100"),
+			b:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.100", "192.168.0.200"),
+			expected: true,
+		},
+		{
+			name:     "adjacent but disjoint ranges",
+			a:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.10", "192.168.0.99"),
+			b:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.100", "192.168.0.200"),
+			expected: false,
+		},
+		{
+			name:     "adjacent but disjoint cidrs",
+			a:        newTestPoolInfo(t, "192.168.0.0/25", "", ""),
+			b:        newTestPoolInfo(t, "192.168.0.128/25", "", ""),
+			expected: false,
+		},
+		{
+			name:     "unset range falls back to the full cidr",
+			a:        newTestPoolInfo(t, "192.168.0.0/24", "", ""),
+			b:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.200", "192.168.0.210"),
+			expected: true,
+		},
+		{
+			name:     "range outside of a smaller cidr",
+			a:        newTestPoolInfo(t, "192.168.0.0/25", "", ""),
+			b:        newTestPoolInfo(t, "192.168.0.0/24", "192.168.0.200", "192.168.0.210"),
+			expected: false,
+		},
+		{
+			name:     "different subnets",
+			a:        newTestPoolInfo(t, "192.168.0.0/24", "", ""),
+			b:        newTestPoolInfo(t, "10.0.0.0/8", "", ""),
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, PoolInfosOverlap(tc.a, tc.b))
+			assert.Equal(t, tc.expected, PoolInfosOverlap(tc.b, tc.a))
+		})
+	}
+}
+
+func TestIPNetsOverlap(t *testing.T) {
+	testCases := []struct {
+		name     string
+		a        string
+		b        string
+		expected bool
+	}{
+		{
+			name:     "identical cidrs",
+			a:        "192.168.0.0/24",
+			b:        "192.168.0.0/24",
+			expected: true,
+		},
+		{
+			name:     "one cidr contains the other",
+			a:        "192.168.0.0/16",
+			b:        "192.168.100.0/24",
+			expected: true,
+		},
+		{
+			name:     "adjacent cidrs",
+			a:        "192.168.0.0/25",
+			b:        "192.168.0.128/25",
+			expected: false,
+		},
+		{
+			name:     "different subnets",
+			a:        "192.168.0.0/24",
+			b:        "10.0.0.0/8",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, _, _, err := LoadCIDR(tc.a)
+			assert.Nil(t, err)
+			b, _, _, err := LoadCIDR(tc.b)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expected, IPNetsOverlap(a, b))
+			assert.Equal(t, tc.expected, IPNetsOverlap(b, a))
+		})
+	}
+}
+
+func TestMergeStaticRoutes(t *testing.T) {
+	testCases := []struct {
+		name            string
+		userRoutes      []networkv1.Route
+		generatedRoutes []networkv1.Route
+		expected        []networkv1.Route
+	}{
+		{
+			name:     "no routes",
+			expected: nil,
+		},
+		{
+			name: "generated routes only",
+			generatedRoutes: []networkv1.Route{
+				{Destination: "10.53.0.0/16", Gateway: "192.168.0.253"},
+				{Destination: "10.52.0.0/16", Gateway: "192.168.0.253"},
+			},
+			expected: []networkv1.Route{
+				{Destination: "10.53.0.0/16", Gateway: "192.168.0.253"},
+				{Destination: "10.52.0.0/16", Gateway: "192.168.0.253"},
+			},
+		},
+		{
+			name: "disjoint user and generated routes",
+			userRoutes: []networkv1.Route{
+				{Destination: "172.16.0.0/12", Gateway: "192.168.0.1"},
+			},
+			generatedRoutes: []networkv1.Route{
+				{Destination: "10.53.0.0/16", Gateway: "192.168.0.253"},
+			},
+			expected: []networkv1.Route{
+				{Destination: "172.16.0.0/12", Gateway: "192.168.0.1"},
+				{Destination: "10.53.0.0/16", Gateway: "192.168.0.253"},
+			},
+		},
+		{
+			name: "user route wins on conflict",
+			userRoutes: []networkv1.Route{
+				{Destination: "10.53.0.1/16", Gateway: "192.168.0.1"},
+			},
+			generatedRoutes: []networkv1.Route{
+				{Destination: "10.53.0.0/16", Gateway: "192.168.0.253"},
+				{Destination: "10.52.0.0/16", Gateway: "192.168.0.253"},
+			},
+			expected: []networkv1.Route{
+				{Destination: "10.53.0.1/16", Gateway: "192.168.0.1"},
+				{Destination: "10.52.0.0/16", Gateway: "192.168.0.253"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, MergeStaticRoutes(tc.userRoutes, tc.generatedRoutes))
+		})
+	}
+}
+
+func TestGetMTUFromNAD(t *testing.T) {
+	testCases := []struct {
+		name        string
+		config      string
+		expected    int
+		expectedErr bool
+	}{
+		{
+			name:     "empty config",
+			expected: 0,
+		},
+		{
+			name:     "mtu not specified",
+			config:   `{"cniVersion":"0.3.1","type":"bridge","bridge":"mgmt-br"}`,
+			expected: 0,
+		},
+		{
+			name:     "mtu specified",
+			config:   `{"cniVersion":"0.3.1","type":"bridge","bridge":"mgmt-br","mtu":9000}`,
+			expected: 9000,
+		},
+		{
+			name:        "malformed config",
+			config:      `{"mtu":`,
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nad := &cniv1.NetworkAttachmentDefinition{
+				Spec: cniv1.NetworkAttachmentDefinitionSpec{
+					Config: tc.config,
+				},
+			}
+
+			mtu, err := GetMTUFromNAD(nad)
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, mtu)
+		})
+	}
+}
+
+func TestLoadAllocated(t *testing.T) {
+	entries := map[string]networkv1.AllocationEntry{
+		"192.168.0.10":        {Type: networkv1.AllocationTypeLease, Owner: "11:22:33:44:55:66"},
+		"::ffff:192.168.0.11": {Type: networkv1.AllocationTypeLease, Owner: "22:33:44:55:66:77"},
+		"192.168.0.20":        {Type: networkv1.AllocationTypeExcluded},
+		"192.168.0.254":       {Type: networkv1.AllocationTypeReserved},
+		"192.168.0.300":       {Type: networkv1.AllocationTypeLease, Owner: "33:44:55:66:77:88"},
+		"not-an-ip":           {Type: networkv1.AllocationTypeExcluded},
+	}
+
+	allocatedList, excludedList, reservedList, malformedList := LoadAllocated(entries)
+
+	assert.ElementsMatch(t, []netip.Addr{
+		netip.MustParseAddr("192.168.0.10"),
+		netip.MustParseAddr("192.168.0.11"),
+	}, allocatedList)
+	for _, ipAddr := range allocatedList {
+		assert.True(t, ipAddr.Is4(), "mapped address should be normalized to plain ipv4")
+	}
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.168.0.20")}, excludedList)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.168.0.254")}, reservedList)
+	assert.Equal(t, []string{"192.168.0.300", "not-an-ip"}, malformedList)
+}
+
+func TestGetIPPoolFromNetworkName_Ambiguity(t *testing.T) {
+	newNAD := func(namespace, name, ipPoolNamespace, ipPoolName string) *cniv1.NetworkAttachmentDefinition {
+		nad := &cniv1.NetworkAttachmentDefinition{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+		}
+		if ipPoolName != "" {
+			nad.Labels = map[string]string{
+				IPPoolNamespaceLabelKey: ipPoolNamespace,
+				IPPoolNameLabelKey:      ipPoolName,
+			}
+		}
+		return nad
+	}
+	newIPPool := func(namespace, name string) *networkv1.IPPool {
+		return &networkv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+		}
+	}
+
+	nads := []*cniv1.NetworkAttachmentDefinition{
+		// Same name, different ippools
+		newNAD("default", "vlan100", "default", "pool-100"),
+		newNAD("tenant", "vlan100", "tenant", "tenant-100"),
+		// Same name, same ippool
+		newNAD("default", "vlan200", "default", "pool-200"),
+		newNAD("tenant", "vlan200", "default", "pool-200"),
+		// Global one without an ippool
+		newNAD("default", "vlan300", "", ""),
+		newNAD("tenant", "vlan300", "tenant", "tenant-300"),
+		// Global one only
+		newNAD("default", "vlan400", "default", "pool-400"),
+	}
+	clientset := fake.NewSimpleClientset(
+		newIPPool("default", "pool-100"),
+		newIPPool("tenant", "tenant-100"),
+		newIPPool("default", "pool-200"),
+		newIPPool("tenant", "tenant-300"),
+		newIPPool("default", "pool-400"),
+	)
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+	for _, nad := range nads {
+		err := clientset.Tracker().Create(nadGVR, nad, nad.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+	}
+
+	nadCache := fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions)
+	ippoolCache := fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools)
+
+	testCases := []struct {
+		name        string
+		networkName string
+		namespace   string
+		expected    string
+		ambiguous   *AmbiguousNetworkError
+		notFound    bool
+	}{
+		{
+			name:        "unqualified name matching nads of different ippools",
+			networkName: "vlan100",
+			namespace:   "tenant",
+			ambiguous: &AmbiguousNetworkError{
+				NetworkName: "vlan100",
+				Candidates:  []string{"tenant/vlan100", "default/vlan100"},
+				IPPools:     []string{"tenant/tenant-100", "default/pool-100"},
+			},
+		},
+		{
+			name:        "qualified name of the namespace",
+			networkName: "tenant/vlan100",
+			namespace:   "tenant",
+			expected:    "tenant/tenant-100",
+		},
+		{
+			name:        "qualified name of the global namespace",
+			networkName: "default/vlan100",
+			namespace:   "tenant",
+			expected:    "default/pool-100",
+		},
+		{
+			name:        "unqualified name in the global namespace",
+			networkName: "vlan100",
+			namespace:   "default",
+			expected:    "default/pool-100",
+		},
+		{
+			name:        "unqualified name matching nads of the same ippool",
+			networkName: "vlan200",
+			namespace:   "tenant",
+			expected:    "default/pool-200",
+		},
+		{
+			name:        "unqualified name matching a global nad without ippool",
+			networkName: "vlan300",
+			namespace:   "tenant",
+			expected:    "tenant/tenant-300",
+		},
+		{
+			name:        "unqualified name only matching a global nad",
+			networkName: "vlan400",
+			namespace:   "tenant",
+			notFound:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ipPool, err := GetIPPoolFromNetworkName(nadCache, ippoolCache, tc.networkName, tc.namespace)
+			switch {
+			case tc.ambiguous != nil:
+				var ambiguous *AmbiguousNetworkError
+				if assert.True(t, errors.As(err, &ambiguous), "expected an ambiguous network error, got %v", err) {
+					assert.Equal(t, tc.ambiguous, ambiguous)
+				}
+				assert.ErrorIs(t, err, ErrAmbiguousNetwork)
+			case tc.notFound:
+				assert.NotNil(t, err)
+				assert.False(t, errors.Is(err, ErrAmbiguousNetwork))
+			default:
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expected, ipPool.Namespace+"/"+ipPool.Name)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package util
+
+import (
+	"reflect"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+)
+
+// While the CRDs are being upgraded, the informers may deliver IPPools whose
+// status lacks the fields added since, e.g., the typed allocation entries.
+// Such a status reads as if nothing was allocated, so the handlers only
+// derive destructive actions from what is absent in a status, like releasing
+// leases or purging agents, once the controller has written the status at
+// the current schema version.
+
+// IsStatusCurrent reports whether the status of the IPPool was written at the
+// current schema version. The status of a new IPPool, which was never
+// written, has nothing to lose and counts as current.
+func IsStatusCurrent(ipPool *networkv1.IPPool) bool {
+	if ipPool.Status.SchemaVersion >= networkv1.IPPoolStatusSchemaVersion {
+		return true
+	}
+	return reflect.DeepEqual(ipPool.Status, networkv1.IPPoolStatus{})
+}
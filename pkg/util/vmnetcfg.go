@@ -3,6 +3,8 @@ package util
 import (
 	"fmt"
 
+	"github.com/rancher/wrangler/v3/pkg/kv"
+
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
 	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
 	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
@@ -12,6 +14,105 @@ type VmnetcfgGetter struct {
 	VmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache
 }
 
+// IsLeasePinned reports whether the IP addresses of the
+// VirtualMachineNetworkConfig must stay where they are.
+func IsLeasePinned(vmNetCfg *networkv1.VirtualMachineNetworkConfig) bool {
+	return vmNetCfg.Annotations[PinLeaseAnnotationKey] == "true"
+}
+
+// DedupNetworkConfigs splits the network configs into the ones to keep and
+// the ones repeating the MAC address of an earlier one. The agents key their
+// leases by MAC address, so a MAC address can only be served once. MAC
+// addresses are compared once normalized.
+func DedupNetworkConfigs(ncs []networkv1.NetworkConfig) (kept, duplicates []networkv1.NetworkConfig) {
+	seen := make(map[string]struct{}, len(ncs))
+	for _, nc := range ncs {
+		macAddress := NormalizeMAC(nc.MACAddress)
+		if _, ok := seen[macAddress]; ok {
+			duplicates = append(duplicates, nc)
+			continue
+		}
+		seen[macAddress] = struct{}{}
+		kept = append(kept, nc)
+	}
+	return kept, duplicates
+}
+
+// VmNetCfgByMAC indexes the VirtualMachineNetworkConfigs by the normalized MAC
+// addresses of their network configs.
+func VmNetCfgByMAC(obj *networkv1.VirtualMachineNetworkConfig) ([]string, error) {
+	ncs := obj.Spec.NetworkConfigs
+	macAddresses := make([]string, 0, len(ncs))
+	for _, nc := range ncs {
+		macAddresses = append(macAddresses, NormalizeMAC(nc.MACAddress))
+	}
+	return macAddresses, nil
+}
+
+// VmNetCfgByQualifiedNetwork indexes the VirtualMachineNetworkConfigs by the
+// networks of their network configs, in the namespace/name form. A network
+// given without a namespace is indexed under both the namespace of the
+// VirtualMachineNetworkConfig and the global one, as it may resolve to either.
+func VmNetCfgByQualifiedNetwork(obj *networkv1.VirtualMachineNetworkConfig) ([]string, error) {
+	seen := make(map[string]struct{}, len(obj.Spec.NetworkConfigs))
+	var networkNames []string
+	add := func(networkName string) {
+		if _, ok := seen[networkName]; ok {
+			return
+		}
+		seen[networkName] = struct{}{}
+		networkNames = append(networkNames, networkName)
+	}
+
+	for _, nc := range obj.Spec.NetworkConfigs {
+		nadNamespace, nadName := kv.RSplit(nc.NetworkName, "/")
+		if nadNamespace != "" {
+			add(nc.NetworkName)
+			continue
+		}
+		add(obj.Namespace + "/" + nadName)
+		add(GlobalNetworkNamespace + "/" + nadName)
+	}
+	return networkNames, nil
+}
+
+// NetworkMACKey returns the key of the MAC address on the network in the
+// VmNetCfgByNetworkMAC index. A network given without a namespace is the
+// NetworkAttachmentDefinition of the same name in the given namespace.
+func NetworkMACKey(namespace, networkName, macAddress string) string {
+	nadNamespace, nadName := kv.RSplit(networkName, "/")
+	if nadNamespace == "" {
+		nadNamespace = namespace
+	}
+	return nadNamespace + "/" + nadName + "/" + NormalizeMAC(macAddress)
+}
+
+// VmNetCfgByNetworkMAC indexes the VirtualMachineNetworkConfigs by the MAC
+// addresses of their network configs along with their network, so the same
+// MAC address on different networks is told apart.
+func VmNetCfgByNetworkMAC(obj *networkv1.VirtualMachineNetworkConfig) ([]string, error) {
+	ncs := obj.Spec.NetworkConfigs
+	keys := make([]string, 0, len(ncs))
+	for _, nc := range ncs {
+		keys = append(keys, NetworkMACKey(obj.Namespace, nc.NetworkName, nc.MACAddress))
+	}
+	return keys, nil
+}
+
+// WhoHasMAC returns the VirtualMachineNetworkConfigs listing the MAC address.
+// It requires adding the MAC indexer to the vmnetcfg cache before invoking it.
+func (g *VmnetcfgGetter) WhoHasMAC(macAddress string) ([]*networkv1.VirtualMachineNetworkConfig, error) {
+	return g.VmnetcfgCache.GetByIndex(indexer.VmNetCfgByMACIndex, NormalizeMAC(macAddress))
+}
+
+// WhoHasMACOnNetwork returns the VirtualMachineNetworkConfigs listing the MAC
+// address on the network, the network given without a namespace being looked
+// up in the given one. It requires adding the network MAC indexer to the
+// vmnetcfg cache before invoking it.
+func (g *VmnetcfgGetter) WhoHasMACOnNetwork(namespace, networkName, macAddress string) ([]*networkv1.VirtualMachineNetworkConfig, error) {
+	return g.VmnetcfgCache.GetByIndex(indexer.VmNetCfgByNetworkMACIndex, NetworkMACKey(namespace, networkName, macAddress))
+}
+
 // WhoUseIPPool requires adding network indexer to the vmnetcfg cache before invoking it
 func (g *VmnetcfgGetter) WhoUseIPPool(ipPool *networkv1.IPPool) ([]*networkv1.VirtualMachineNetworkConfig, error) {
 	networkName := fmt.Sprintf("%s/%s", ipPool.Namespace, ipPool.Name)
@@ -0,0 +1,722 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/dhcp"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// infiniteLeaseTime is the lease time in seconds meaning the lease never
+// expires.
+const infiniteLeaseTime = 0xffffffff
+
+// maxKnownExternalHostDescriptionLength is the longest description a known
+// external host may have.
+const maxKnownExternalHostDescriptionLength = 256
+
+// minMTU is the smallest MTU an IPv4 link may have (RFC 791), and maxMTU the
+// largest jumbo frames commonly go up to.
+const (
+	minMTU = 68
+	maxMTU = 9000
+)
+
+// derivedOptionCodes are the DHCP options the agent derives from the spec or
+// sets per reply, which can't be given as extra options: the subnet mask, the
+// router, the DNS servers, the domain name, the MTU, the NTP servers, the
+// lease time, the message type, the server identifier, the domain search list
+// and the classless static routes, of RFC 3442 and of Microsoft.
+var derivedOptionCodes = map[int]struct{}{
+	1: {}, 3: {}, 6: {}, 15: {}, 26: {}, 42: {}, 51: {}, 53: {}, 54: {}, 119: {}, 121: {}, 249: {},
+}
+
+// ValidateIPPoolSpec checks whether the spec of ipPool is consistent on its
+// own, i.e., without looking at the cluster: the CIDR, the pool range, the
+// exclusions, the addresses reserved for the server, the router, the known
+// external hosts, and the MAC addresses, the domain names, and the static
+// routes. It's shared by
+// the admission webhook and the lint command, so the two agree on what's
+// valid. The checks needing the cluster, e.g., overlaps with other IPPools,
+// are left to the webhook.
+func ValidateIPPoolSpec(ipPool *networkv1.IPPool) field.ErrorList {
+	specPath := field.NewPath("spec")
+	ipv4Path := specPath.Child("ipv4Config")
+	poolPath := ipv4Path.Child("pool")
+	ipv4Config := ipPool.Spec.IPv4Config
+
+	var allErrs field.ErrorList
+
+	_, networkIPAddr, _, err := util.LoadCIDR(ipv4Config.CIDR)
+	if err != nil {
+		// Nothing else can be checked without the subnet
+		return append(allErrs, field.Invalid(ipv4Path.Child("cidr"), ipv4Config.CIDR, err.Error()))
+	}
+	if !networkIPAddr.Is4() {
+		// IPv6 subnets go in the IPv6 config
+		return append(allErrs, field.Invalid(ipv4Path.Child("cidr"), ipv4Config.CIDR, "must be an IPv4 cidr"))
+	}
+
+	allErrs = append(allErrs, validateIPv4(poolPath.Child("start"), ipv4Config.Pool.Start)...)
+	allErrs = append(allErrs, validateIPv4(poolPath.Child("end"), ipv4Config.Pool.End)...)
+	allErrs = append(allErrs, validateIPv4(ipv4Path.Child("serverIP"), ipv4Config.ServerIP)...)
+	allErrs = append(allErrs, validateIPv4(ipv4Path.Child("router"), ipv4Config.Router)...)
+	allErrs = append(allErrs, validateDNSServers(ipv4Path.Child("dns"), ipv4Config.DNS, false)...)
+	allErrs = append(allErrs, validateDomainNames(ipv4Path, ipv4Config)...)
+	allErrs = append(allErrs, validateStaticRoutes(ipv4Path.Child("staticRoutes"), ipv4Config.StaticRoutes)...)
+	if ipv4Config.Pool.End != "" && ipv4Config.Pool.Count != 0 {
+		allErrs = append(allErrs, field.Invalid(poolPath.Child("count"), ipv4Config.Pool.Count,
+			fmt.Sprintf("is ambiguous with end %s; set only one of them", ipv4Config.Pool.End)))
+	}
+	if len(allErrs) > 0 {
+		return allErrs
+	}
+
+	pi, err := util.LoadPool(ipPool)
+	if err != nil {
+		// Only the count is left to fail
+		return append(allErrs, field.Invalid(poolPath.Child("count"), ipv4Config.Pool.Count, err.Error()))
+	}
+
+	allErrs = append(allErrs, validatePoolRange(poolPath, pi)...)
+	allErrs = append(allErrs, validateExclusions(poolPath.Child("exclude"), ipv4Config.Pool.Exclude, pi)...)
+	allErrs = append(allErrs, validateHoldBack(poolPath.Child("holdBack"), ipv4Config.Pool.HoldBack, pi)...)
+	allErrs = append(allErrs, validateGatewayAddrs(ipv4Path, pi)...)
+	allErrs = append(allErrs, validateStaticRouteGateways(ipv4Path.Child("staticRoutes"), pi)...)
+	allErrs = append(allErrs, validateSubnetMask(ipv4Path.Child("subnetMaskOverride"), ipv4Config.SubnetMaskOverride, pi)...)
+	allErrs = append(allErrs, validateServiceGateway(specPath, ipPool, pi)...)
+	allErrs = append(allErrs, validateLeaseTime(ipv4Path.Child("leaseTime"), ipPool)...)
+	allErrs = append(allErrs, validateDHCPOptions(ipv4Path.Child("options"), ipv4Config.Options)...)
+	allErrs = append(allErrs, validateRelayGateways(specPath.Child("relayGateways"), ipPool.Spec.RelayGateways)...)
+	allErrs = append(allErrs, validateExternalIPAM(specPath.Child("externalIPAM"), ipPool.Spec.ExternalIPAM)...)
+	allErrs = append(allErrs, validateOverflowWeight(specPath.Child("overflowWeight"), ipPool.Spec.OverflowWeight)...)
+	allErrs = append(allErrs, validateKnownExternalHosts(specPath.Child("knownExternalHosts"), ipPool.Spec.KnownExternalHosts, pi)...)
+	allErrs = append(allErrs, validateReservations(ipv4Path.Child("reservations"), ipPool, pi)...)
+	allErrs = append(allErrs, validateIPv6Config(specPath.Child("ipv6Config"), ipPool)...)
+
+	return allErrs
+}
+
+// validateIPv6Config checks the IPv6 addressing of ipPool, if any, the way the
+// IPv4 one is: the pool range, the server, and the router must be within the
+// subnet, and the server and the router must differ.
+func validateIPv6Config(ipv6Path *field.Path, ipPool *networkv1.IPPool) field.ErrorList {
+	if ipPool.Spec.IPv6Config == nil {
+		return nil
+	}
+
+	if errs := validateDNSServers(ipv6Path.Child("dns"), ipPool.Spec.IPv6Config.DNS, true); len(errs) > 0 {
+		return errs
+	}
+
+	pi, err := util.LoadIPv6Pool(ipPool)
+	if err != nil {
+		return field.ErrorList{field.Invalid(ipv6Path, ipPool.Spec.IPv6Config.CIDR, err.Error())}
+	}
+
+	var allErrs field.ErrorList
+	allErrs = append(allErrs, validatePoolRange(ipv6Path.Child("pool"), pi)...)
+	allErrs = append(allErrs, validateGatewayAddrs(ipv6Path, pi)...)
+
+	return allErrs
+}
+
+// validateIPv4 checks whether value, if given, is an IPv4 address.
+func validateIPv4(fldPath *field.Path, value string) field.ErrorList {
+	if value == "" {
+		return nil
+	}
+
+	if ipAddr, err := netip.ParseAddr(value); err != nil || !ipAddr.Is4() {
+		return field.ErrorList{field.Invalid(fldPath, value, "must be a valid IPv4 address")}
+	}
+
+	return nil
+}
+
+// validateDNSServers checks whether each DNS server is a valid address of the
+// address family of the config, IPv6 if ipv6 is set and IPv4 otherwise,
+// listed only once. Nameservers of the other family are a common mistake, as
+// clients only take the ones of the family of the protocol serving them.
+func validateDNSServers(fldPath *field.Path, dnsServers []string, ipv6 bool) field.ErrorList {
+	family, otherFamily := "IPv4", "ipv6Config"
+	if ipv6 {
+		family, otherFamily = "IPv6", "ipv4Config"
+	}
+
+	var allErrs field.ErrorList
+
+	seen := make(map[netip.Addr]struct{}, len(dnsServers))
+	for i, dnsServer := range dnsServers {
+		dnsServerAddr, err := netip.ParseAddr(dnsServer)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), dnsServer, fmt.Sprintf("must be a valid %s address", family)))
+			continue
+		}
+		if dnsServerAddr.Is6() != ipv6 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), dnsServer,
+				fmt.Sprintf("must be an %s address; set the other ones in spec.%s.dns", family, otherFamily)))
+			continue
+		}
+
+		if _, ok := seen[dnsServerAddr]; ok {
+			allErrs = append(allErrs, field.Duplicate(fldPath.Index(i), dnsServer))
+			continue
+		}
+		seen[dnsServerAddr] = struct{}{}
+	}
+
+	return allErrs
+}
+
+// validateDomainNames checks whether the domain name and each entry of the
+// domain search list are valid DNS names, the entries being listed only once
+// regardless of the case and of the trailing dot.
+func validateDomainNames(ipv4Path *field.Path, ipv4Config networkv1.IPv4Config) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if ipv4Config.DomainName != nil && *ipv4Config.DomainName != "" {
+		if err := util.CheckDomainName(*ipv4Config.DomainName); err != nil {
+			allErrs = append(allErrs, field.Invalid(ipv4Path.Child("domainName"), *ipv4Config.DomainName,
+				fmt.Sprintf("must be a valid DNS name: %s", err)))
+		}
+	}
+
+	fldPath := ipv4Path.Child("domainSearch")
+	seen := make(map[string]struct{}, len(ipv4Config.DomainSearch))
+	for i, domain := range ipv4Config.DomainSearch {
+		if err := util.CheckDomainName(domain); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), domain, fmt.Sprintf("must be a valid DNS name: %s", err)))
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimSuffix(domain, "."))
+		if _, ok := seen[key]; ok {
+			allErrs = append(allErrs, field.Duplicate(fldPath.Index(i), domain))
+			continue
+		}
+		seen[key] = struct{}{}
+	}
+
+	return allErrs
+}
+
+// validateStaticRoutes checks whether each static route has an IPv4 CIDR with
+// no host bits set as its destination, listed only once, and an IPv4 address
+// as its gateway. The gateways are checked against the subnet by
+// validateStaticRouteGateways.
+func validateStaticRoutes(fldPath *field.Path, routes []networkv1.Route) field.ErrorList {
+	var allErrs field.ErrorList
+
+	seen := make(map[netip.Prefix]struct{}, len(routes))
+	for i, route := range routes {
+		destination, err := netip.ParsePrefix(route.Destination)
+		if err != nil || !destination.Addr().Is4() {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i).Child("destination"), route.Destination, "must be a valid IPv4 cidr"))
+		} else if destination != destination.Masked() {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i).Child("destination"), route.Destination,
+				fmt.Sprintf("must not have host bits set, e.g., %s", destination.Masked())))
+		} else if _, ok := seen[destination]; ok {
+			allErrs = append(allErrs, field.Duplicate(fldPath.Index(i).Child("destination"), route.Destination))
+		} else {
+			seen[destination] = struct{}{}
+		}
+
+		allErrs = append(allErrs, validateIPv4(fldPath.Index(i).Child("gateway"), route.Gateway)...)
+		if route.Gateway == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Index(i).Child("gateway"), "must be given, 0.0.0.0 for destinations on the link"))
+		}
+	}
+
+	return allErrs
+}
+
+// validateStaticRouteGateways checks whether the gateway of each static route
+// is reachable by the clients, i.e., is a host address within the subnet. The
+// unspecified address stands for destinations on the link (RFC 3442) and is
+// let through.
+func validateStaticRouteGateways(fldPath *field.Path, pi util.PoolInfo) field.ErrorList {
+	var allErrs field.ErrorList
+
+	for i, route := range pi.StaticRoutes {
+		if route.Gateway.IsUnspecified() {
+			continue
+		}
+		if err := validateReserved(fldPath.Index(i).Child("gateway"), route.Gateway, pi, false); err != nil {
+			allErrs = append(allErrs, err)
+		}
+	}
+
+	return allErrs
+}
+
+// validateReserved checks whether ipAddr is within the subnet and is neither
+// the network nor the broadcast IP address, unless the pool allows them.
+func validateReserved(fldPath *field.Path, ipAddr netip.Addr, pi util.PoolInfo, allowNetworkBroadcast bool) *field.Error {
+	if !pi.InSubnet(ipAddr) {
+		return field.Invalid(fldPath, ipAddr.String(), fmt.Sprintf("must be within subnet %s", pi.IPNet))
+	}
+
+	if !allowNetworkBroadcast && ipAddr == pi.NetworkIPAddr {
+		return field.Invalid(fldPath, ipAddr.String(), "must not be the network ip")
+	}
+
+	if !allowNetworkBroadcast && ipAddr == pi.BroadcastIPAddr {
+		return field.Invalid(fldPath, ipAddr.String(), "must not be the broadcast ip")
+	}
+
+	return nil
+}
+
+// validatePoolRange ensures the pool range is within the subnet, and leaves
+// out the network and broadcast addresses unless the pool allows them. Once
+// both bounds are fine, its start must not be after its end.
+func validatePoolRange(poolPath *field.Path, pi util.PoolInfo) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if pi.StartIPAddr.IsValid() {
+		if err := validateReserved(poolPath.Child("start"), pi.StartIPAddr, pi, pi.AllowNetworkBroadcast); err != nil {
+			allErrs = append(allErrs, err)
+		}
+	}
+
+	if pi.EndIPAddr.IsValid() {
+		if err := validateReserved(poolPath.Child("end"), pi.EndIPAddr, pi, pi.AllowNetworkBroadcast); err != nil {
+			allErrs = append(allErrs, err)
+		}
+	}
+
+	if len(allErrs) > 0 {
+		return allErrs
+	}
+
+	if err := util.ValidatePoolRange(pi); err != nil {
+		for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+			var rangeErr *util.PoolRangeError
+			if errors.As(err, &rangeErr) {
+				allErrs = append(allErrs, field.Invalid(poolPath.Child(rangeErr.Bound), rangeErr.Addr.String(), rangeErr.Reason))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+// validateExclusions checks whether each excluded IP address is a valid IPv4
+// address within the subnet, listed only once.
+func validateExclusions(fldPath *field.Path, excluded []string, pi util.PoolInfo) field.ErrorList {
+	var allErrs field.ErrorList
+
+	seen := make(map[netip.Addr]struct{}, len(excluded))
+	for i, ip := range excluded {
+		idxPath := fldPath.Index(i)
+
+		ipAddr, err := netip.ParseAddr(ip)
+		if err != nil || !ipAddr.Is4() {
+			allErrs = append(allErrs, field.Invalid(idxPath, ip, "must be a valid IPv4 address"))
+			continue
+		}
+
+		if !pi.IPNet.Contains(ipAddr.AsSlice()) {
+			allErrs = append(allErrs, field.Invalid(idxPath, ip, fmt.Sprintf("must be within subnet %s", pi.IPNet)))
+			continue
+		}
+
+		if _, ok := seen[ipAddr]; ok {
+			allErrs = append(allErrs, field.Duplicate(idxPath, ip))
+			continue
+		}
+		seen[ipAddr] = struct{}{}
+	}
+
+	return allErrs
+}
+
+// validateHoldBack checks whether the held-back range, if any, is made of
+// IPv4 addresses within the pool range, its start not being after its end.
+func validateHoldBack(fldPath *field.Path, holdBack *networkv1.HoldBack, pi util.PoolInfo) field.ErrorList {
+	if holdBack == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+
+	addrs := make([]netip.Addr, 0, 2)
+	for _, bound := range []struct {
+		name  string
+		value string
+	}{
+		{name: "start", value: holdBack.Start},
+		{name: "end", value: holdBack.End},
+	} {
+		ipAddr, err := netip.ParseAddr(bound.value)
+		if err != nil || !ipAddr.Is4() {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child(bound.name), bound.value, "must be a valid IPv4 address"))
+			continue
+		}
+		if ipAddr.Compare(pi.StartIPAddr) < 0 || ipAddr.Compare(pi.EndIPAddr) > 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child(bound.name), bound.value,
+				fmt.Sprintf("must be within the pool range from %s to %s", pi.StartIPAddr, pi.EndIPAddr)))
+			continue
+		}
+		addrs = append(addrs, ipAddr)
+	}
+
+	if len(addrs) == 2 && addrs[0].Compare(addrs[1]) > 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("end"), holdBack.End,
+			fmt.Sprintf("must not be less than start %s", holdBack.Start)))
+	}
+
+	return allErrs
+}
+
+// validateGatewayAddrs checks whether the server and router IP addresses are
+// within the CIDR and are neither the network nor the broadcast IP address,
+// with util.ValidateGatewayAddrs, which the IPPool controller shares. Unlike
+// the pool range, they never take the network or broadcast IP address, even
+// if the pool allows them. The server must not be the router.
+func validateGatewayAddrs(fldPath *field.Path, pi util.PoolInfo) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if err := util.ValidateGatewayAddrs(pi); err != nil {
+		for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+			var gatewayErr *util.GatewayAddrError
+			if errors.As(err, &gatewayErr) {
+				allErrs = append(allErrs, field.Invalid(fldPath.Child(gatewayErr.Field), gatewayErr.Addr.String(), gatewayErr.Reason))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+// validateSubnetMask ensures the subnet mask overriding the one derived from
+// the CIDR is a contiguous IPv4 mask leaving room for at least two hosts. The
+// mask may be wider than the CIDR, but the network it gives to the server IP
+// must still hold the pool range and the router, or the clients couldn't
+// reach them.
+func validateSubnetMask(fldPath *field.Path, subnetMask string, pi util.PoolInfo) field.ErrorList {
+	if subnetMask == "" {
+		return nil
+	}
+
+	maskAddr, err := netip.ParseAddr(subnetMask)
+	if err != nil || !maskAddr.Is4() {
+		return field.ErrorList{field.Invalid(fldPath, subnetMask, "must be a valid IPv4 subnet mask")}
+	}
+
+	ones, bits := net.IPMask(maskAddr.AsSlice()).Size()
+	if bits == 0 {
+		return field.ErrorList{field.Invalid(fldPath, subnetMask, "must be contiguous")}
+	}
+	if ones < 1 || ones > 30 {
+		return field.ErrorList{field.Invalid(fldPath, subnetMask, "must be within /1 and /30")}
+	}
+
+	anchor := pi.NetworkIPAddr
+	if pi.ServerIPAddr.IsValid() {
+		anchor = pi.ServerIPAddr
+	} else if pi.StartIPAddr.IsValid() {
+		anchor = pi.StartIPAddr
+	}
+	prefix, err := anchor.Prefix(ones)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, subnetMask, err.Error())}
+	}
+
+	for _, ipAddr := range []netip.Addr{pi.StartIPAddr, pi.EndIPAddr, pi.RouterIPAddr} {
+		if ipAddr.IsValid() && !prefix.Contains(ipAddr) {
+			return field.ErrorList{field.Invalid(fldPath, subnetMask, fmt.Sprintf("leaves %s out of subnet %s", ipAddr, prefix))}
+		}
+	}
+
+	return nil
+}
+
+// validateServiceGateway ensures a service gateway within the subnet is given
+// if the IPPool asks to advertise the routes toward the Kubernetes service and
+// cluster CIDRs.
+func validateServiceGateway(specPath *field.Path, ipPool *networkv1.IPPool, pi util.PoolInfo) field.ErrorList {
+	if ipPool.Spec.AdvertiseServiceRoutes == nil || !*ipPool.Spec.AdvertiseServiceRoutes {
+		return nil
+	}
+
+	fldPath := specPath.Child("serviceGateway")
+	if ipPool.Spec.ServiceGateway == "" {
+		return field.ErrorList{field.Required(fldPath, "must be given when advertising service routes")}
+	}
+
+	serviceGatewayAddr, err := netip.ParseAddr(ipPool.Spec.ServiceGateway)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, ipPool.Spec.ServiceGateway, "must be a valid IPv4 address")}
+	}
+
+	if !pi.IPNet.Contains(serviceGatewayAddr.AsSlice()) {
+		return field.ErrorList{field.Invalid(fldPath, ipPool.Spec.ServiceGateway, fmt.Sprintf("must be within subnet %s", pi.IPNet))}
+	}
+
+	return nil
+}
+
+// validateLeaseTime ensures the lease time of an IPPool serving BOOTP clients
+// stays below the infinite lease time, which is left for the permanent leases
+// of the BOOTP clients so they can be told apart from the DHCP ones.
+func validateLeaseTime(fldPath *field.Path, ipPool *networkv1.IPPool) field.ErrorList {
+	if ipPool.Spec.AllowBOOTP == nil || !*ipPool.Spec.AllowBOOTP || ipPool.Spec.IPv4Config.LeaseTime == nil {
+		return nil
+	}
+
+	leaseTime := int64(*ipPool.Spec.IPv4Config.LeaseTime)
+	if leaseTime < 0 || leaseTime >= infiniteLeaseTime {
+		return field.ErrorList{field.Invalid(fldPath, leaseTime, fmt.Sprintf("must be within 0 and %d when allowing BOOTP", infiniteLeaseTime-1))}
+	}
+
+	return nil
+}
+
+// validateDHCPOptions checks whether the MTU is at least the minimum one and
+// the extra options have valid codes, listed only once and not derived from
+// the spec, and payloads the agent can decode.
+func validateDHCPOptions(fldPath *field.Path, options *networkv1.DHCPOptions) field.ErrorList {
+	if options == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+
+	if options.MTU != nil && (*options.MTU < minMTU || *options.MTU > maxMTU) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("mtu"), *options.MTU, fmt.Sprintf("must be within %d and %d", minMTU, maxMTU)))
+	}
+
+	seen := make(map[int]struct{}, len(options.ExtraOptions))
+	for i, extraOption := range options.ExtraOptions {
+		if _, err := dhcp.OptionPayload(extraOption); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("extraOptions").Index(i).Child("value"), extraOption.Value, err.Error()))
+		}
+
+		codePath := fldPath.Child("extraOptions").Index(i).Child("code")
+		if extraOption.Code < 1 || extraOption.Code > 254 {
+			allErrs = append(allErrs, field.Invalid(codePath, extraOption.Code, "must be within 1 and 254"))
+			continue
+		}
+		if _, ok := derivedOptionCodes[extraOption.Code]; ok {
+			allErrs = append(allErrs, field.Invalid(codePath, extraOption.Code, "is derived from the spec"))
+			continue
+		}
+		if _, ok := seen[extraOption.Code]; ok {
+			allErrs = append(allErrs, field.Duplicate(codePath, extraOption.Code))
+			continue
+		}
+		seen[extraOption.Code] = struct{}{}
+	}
+
+	return allErrs
+}
+
+// validateRelayGateways checks whether each relay gateway is a valid IPv4
+// address listed only once.
+func validateRelayGateways(fldPath *field.Path, relayGateways []string) field.ErrorList {
+	var allErrs field.ErrorList
+
+	seen := make(map[netip.Addr]struct{}, len(relayGateways))
+	for i, relayGateway := range relayGateways {
+		relayGatewayAddr, err := netip.ParseAddr(relayGateway)
+		if err != nil || !relayGatewayAddr.Is4() {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), relayGateway, "must be a valid IPv4 address"))
+			continue
+		}
+
+		if _, ok := seen[relayGatewayAddr]; ok {
+			allErrs = append(allErrs, field.Duplicate(fldPath.Index(i), relayGateway))
+			continue
+		}
+		seen[relayGatewayAddr] = struct{}{}
+	}
+
+	return allErrs
+}
+
+// validateExternalIPAM checks whether the external IPAM, if any, has an
+// absolute https URL, an auth Secret reference naming both the Secret
+// and the key, and a timeout of 1 to 60 seconds.
+func validateExternalIPAM(fldPath *field.Path, externalIPAM *networkv1.ExternalIPAM) field.ErrorList {
+	var allErrs field.ErrorList
+	if externalIPAM == nil {
+		return allErrs
+	}
+
+	u, err := url.Parse(externalIPAM.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("url"), externalIPAM.URL, "must be an absolute https URL"))
+	}
+
+	if ref := externalIPAM.AuthSecretRef; ref != nil {
+		refPath := fldPath.Child("authSecretRef")
+		if ref.Name == "" {
+			allErrs = append(allErrs, field.Required(refPath.Child("name"), "must name the Secret holding the token"))
+		}
+		if ref.Key == "" {
+			allErrs = append(allErrs, field.Required(refPath.Child("key"), "must name the key of the token"))
+		}
+	}
+
+	if timeout := externalIPAM.TimeoutSeconds; timeout != nil && (*timeout < 1 || *timeout > 60) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("timeoutSeconds"), *timeout, "must be between 1 and 60"))
+	}
+
+	switch externalIPAM.FailurePolicy {
+	case "", networkv1.ExternalIPAMFailurePolicyFail, networkv1.ExternalIPAMFailurePolicyAllocateLocally:
+	default:
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("failurePolicy"), externalIPAM.FailurePolicy,
+			[]string{string(networkv1.ExternalIPAMFailurePolicyFail), string(networkv1.ExternalIPAMFailurePolicyAllocateLocally)}))
+	}
+
+	return allErrs
+}
+
+// validateKnownExternalHosts checks whether the IP address of each known
+// external host:
+//   - is WITHIN the CIDR
+//   - is NOT the network or broadcast IP address
+//   - is NOT the server or router IP address
+//   - is NOT listed twice
+//
+// and whether the MAC address, if given, is valid. The description ends up in
+// zone files, so it has to be a single line of limited length.
+func validateOverflowWeight(fldPath *field.Path, weight *int) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if weight != nil && (*weight < 0 || *weight > util.MaxOverflowWeight) {
+		allErrs = append(allErrs, field.Invalid(fldPath, *weight, fmt.Sprintf("must be within 0 and %d", util.MaxOverflowWeight)))
+	}
+
+	return allErrs
+}
+
+func validateKnownExternalHosts(fldPath *field.Path, hosts []networkv1.KnownExternalHost, pi util.PoolInfo) field.ErrorList {
+	var allErrs field.ErrorList
+
+	seen := make(map[netip.Addr]struct{}, len(hosts))
+	for i, host := range hosts {
+		ipPath := fldPath.Index(i).Child("ip")
+
+		if host.MAC != "" {
+			if _, err := net.ParseMAC(host.MAC); err != nil {
+				allErrs = append(allErrs, field.Invalid(fldPath.Index(i).Child("mac"), host.MAC, "must be a valid MAC address"))
+			}
+		}
+
+		descriptionPath := fldPath.Index(i).Child("description")
+		if len(host.Description) > maxKnownExternalHostDescriptionLength {
+			allErrs = append(allErrs, field.TooLong(descriptionPath, host.Description, maxKnownExternalHostDescriptionLength))
+		} else if strings.IndexFunc(host.Description, unicode.IsControl) >= 0 {
+			allErrs = append(allErrs, field.Invalid(descriptionPath, host.Description, "must not contain control characters"))
+		}
+
+		ipAddr, err := netip.ParseAddr(host.IP)
+		if err != nil || !ipAddr.Is4() {
+			allErrs = append(allErrs, field.Invalid(ipPath, host.IP, "must be a valid IPv4 address"))
+			continue
+		}
+
+		if err := validateReserved(ipPath, ipAddr, pi, pi.AllowNetworkBroadcast); err != nil {
+			allErrs = append(allErrs, err)
+			continue
+		}
+
+		if pi.ServerIPAddr.IsValid() && ipAddr == pi.ServerIPAddr {
+			allErrs = append(allErrs, field.Invalid(ipPath, host.IP, "must not be the server ip"))
+			continue
+		}
+
+		if pi.RouterIPAddr.IsValid() && ipAddr == pi.RouterIPAddr {
+			allErrs = append(allErrs, field.Invalid(ipPath, host.IP, "must not be the router ip"))
+			continue
+		}
+
+		if _, ok := seen[ipAddr]; ok {
+			allErrs = append(allErrs, field.Duplicate(ipPath, host.IP))
+			continue
+		}
+		seen[ipAddr] = struct{}{}
+	}
+
+	return allErrs
+}
+
+// validateReservations checks whether the IP address of each reservation:
+//   - is WITHIN the CIDR
+//   - is NOT the network or broadcast IP address
+//   - is NOT the server or router IP address
+//   - is NOT excluded
+//   - is NOT reserved for another MAC address
+//
+// and whether the MAC address is valid and has only one reservation.
+func validateReservations(fldPath *field.Path, ipPool *networkv1.IPPool, pi util.PoolInfo) field.ErrorList {
+	var allErrs field.ErrorList
+
+	excluded := make(map[netip.Addr]struct{}, len(ipPool.Spec.IPv4Config.Pool.Exclude))
+	for _, ip := range ipPool.Spec.IPv4Config.Pool.Exclude {
+		if ipAddr, err := netip.ParseAddr(ip); err == nil {
+			excluded[ipAddr] = struct{}{}
+		}
+	}
+
+	seenIPs := make(map[netip.Addr]struct{}, len(ipPool.Spec.IPv4Config.Reservations))
+	seenMACs := make(map[string]struct{}, len(ipPool.Spec.IPv4Config.Reservations))
+	for i, reservation := range ipPool.Spec.IPv4Config.Reservations {
+		ipPath := fldPath.Index(i).Child("ipAddress")
+		macPath := fldPath.Index(i).Child("macAddress")
+
+		if _, err := net.ParseMAC(reservation.MACAddress); err != nil {
+			allErrs = append(allErrs, field.Invalid(macPath, reservation.MACAddress, "must be a valid MAC address"))
+		} else if _, ok := seenMACs[util.NormalizeMAC(reservation.MACAddress)]; ok {
+			allErrs = append(allErrs, field.Duplicate(macPath, reservation.MACAddress))
+		} else {
+			seenMACs[util.NormalizeMAC(reservation.MACAddress)] = struct{}{}
+		}
+
+		ipAddr, err := netip.ParseAddr(reservation.IPAddress)
+		if err != nil || !ipAddr.Is4() {
+			allErrs = append(allErrs, field.Invalid(ipPath, reservation.IPAddress, "must be a valid IPv4 address"))
+			continue
+		}
+
+		if err := validateReserved(ipPath, ipAddr, pi, pi.AllowNetworkBroadcast); err != nil {
+			allErrs = append(allErrs, err)
+			continue
+		}
+
+		if pi.ServerIPAddr.IsValid() && ipAddr == pi.ServerIPAddr {
+			allErrs = append(allErrs, field.Invalid(ipPath, reservation.IPAddress, "must not be the server ip"))
+			continue
+		}
+
+		if pi.RouterIPAddr.IsValid() && ipAddr == pi.RouterIPAddr {
+			allErrs = append(allErrs, field.Invalid(ipPath, reservation.IPAddress, "must not be the router ip"))
+			continue
+		}
+
+		if _, ok := excluded[ipAddr]; ok {
+			allErrs = append(allErrs, field.Invalid(ipPath, reservation.IPAddress, "must not be excluded"))
+			continue
+		}
+
+		if _, ok := seenIPs[ipAddr]; ok {
+			allErrs = append(allErrs, field.Duplicate(ipPath, reservation.IPAddress))
+			continue
+		}
+		seenIPs[ipAddr] = struct{}{}
+	}
+
+	return allErrs
+}
@@ -0,0 +1,476 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/ippool"
+)
+
+const (
+	testIPPoolNamespace = "default"
+	testIPPoolName      = "net-1"
+	testCIDR            = "192.168.0.0/24"
+	testServerIP        = "192.168.0.2"
+	testRouter          = "192.168.0.1"
+	testStartIP         = "192.168.0.10"
+	testEndIP           = "192.168.0.99"
+	testNetworkName     = testIPPoolNamespace + "/" + testIPPoolName
+)
+
+// newTestIPPoolBuilder returns the builder of a valid IPPool the test cases
+// break one field at a time.
+func newTestIPPoolBuilder() *ippool.IPPoolBuilder {
+	return ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName).
+		CIDR(testCIDR).
+		ServerIP(testServerIP).
+		Router(testRouter).
+		NetworkName(testNetworkName)
+}
+
+func TestValidateIPPoolSpec(t *testing.T) {
+	testCases := []struct {
+		name     string
+		given    *networkv1.IPPool
+		expected []string
+	}{
+		{
+			name:  "valid ippool",
+			given: newTestIPPoolBuilder().PoolRange(testStartIP, testEndIP).Exclude("192.168.0.50").Build(),
+		},
+		{
+			name:  "valid ippool without pool range",
+			given: newTestIPPoolBuilder().Build(),
+		},
+		{
+			name:  "valid ippool with pool count",
+			given: newTestIPPoolBuilder().PoolCount(testStartIP, 90).Build(),
+		},
+		{
+			name: "valid ippool with everything",
+			given: newTestIPPoolBuilder().
+				PoolRange(testStartIP, testEndIP).
+				Exclude("192.168.0.50", "192.168.0.51").
+				SubnetMaskOverride("255.255.0.0").
+				AdvertiseServiceRoutes("192.168.0.254").
+				AllowBOOTP().
+				LeaseTime(3600).
+				DNS("1.1.1.1", "8.8.8.8").
+				DomainName("example.com").
+				DomainSearch("eng.example.com", "example.com.").
+				MTU(1450).
+				ExtraOption(66, "tftp.example.com").
+				ExtraOption(67, "pxelinux.0").
+				TypedExtraOption(161, "c0a80001", networkv1.ExtraOptionTypeHex).
+				RelayGateway("10.0.1.1", "10.0.2.1").
+				ExternalIPAM("https://ipam.example.com/allocate", networkv1.ExternalIPAMFailurePolicyAllocateLocally).
+				ExternalIPAMAuthSecret("ipam-token", "token").
+				KnownExternalHost("192.168.0.200", "fa:cf:8e:50:82:fc", "printer").
+				Reservation("fa:cf:8e:50:82:fd", "192.168.0.20").
+				Reservation("fa:cf:8e:50:82:fe", "192.168.0.150").Build(),
+		},
+		{
+			name: "valid ippool handing out the network and broadcast ip",
+			given: newTestIPPoolBuilder().
+				PoolRange("192.168.0.0", "192.168.0.255").
+				AllowNetworkBroadcast().
+				KnownExternalHost("192.168.0.255", "", "gateway").Build(),
+		},
+		{
+			name:     "invalid cidr",
+			given:    newTestIPPoolBuilder().CIDR("192.168.0.0/33").ServerIP("192.168.100.2").Build(),
+			expected: []string{`spec.ipv4Config.cidr: Invalid value: "192.168.0.0/33": invalid CIDR address: 192.168.0.0/33`},
+		},
+		{
+			name: "malformed ip addresses",
+			given: newTestIPPoolBuilder().
+				ServerIP("192.168.0.1000").
+				Router("192.168.0").
+				PoolRange("::1", "192.168.0.999").Build(),
+			expected: []string{
+				`spec.ipv4Config.pool.start: Invalid value: "::1": must be a valid IPv4 address`,
+				`spec.ipv4Config.pool.end: Invalid value: "192.168.0.999": must be a valid IPv4 address`,
+				`spec.ipv4Config.serverIP: Invalid value: "192.168.0.1000": must be a valid IPv4 address`,
+				`spec.ipv4Config.router: Invalid value: "192.168.0": must be a valid IPv4 address`,
+			},
+		},
+		{
+			name: "pool end and count are ambiguous",
+			given: func() *networkv1.IPPool {
+				ipPool := newTestIPPoolBuilder().PoolRange(testStartIP, testEndIP).Build()
+				ipPool.Spec.IPv4Config.Pool.Count = 90
+				return ipPool
+			}(),
+			expected: []string{`spec.ipv4Config.pool.count: Invalid value: 90: is ambiguous with end 192.168.0.99; set only one of them`},
+		},
+		{
+			name:     "pool count beyond the subnet",
+			given:    newTestIPPoolBuilder().PoolCount("192.168.0.200", 100).Build(),
+			expected: []string{`spec.ipv4Config.pool.count: Invalid value: 100: pool of 100 addresses from 192.168.0.200 exceeds the usable addresses of cidr 192.168.0.0/24`},
+		},
+		{
+			name:  "pool range out of subnet",
+			given: newTestIPPoolBuilder().PoolRange("192.168.1.10", "192.168.1.99").Build(),
+			expected: []string{
+				`spec.ipv4Config.pool.start: Invalid value: "192.168.1.10": must be within subnet 192.168.0.0/24`,
+				`spec.ipv4Config.pool.end: Invalid value: "192.168.1.99": must be within subnet 192.168.0.0/24`,
+			},
+		},
+		{
+			name:  "pool range of the other half of the /24",
+			given: newTestIPPoolBuilder().CIDR("192.168.0.0/25").PoolRange("192.168.0.130", "192.168.0.140").Build(),
+			expected: []string{
+				`spec.ipv4Config.pool.start: Invalid value: "192.168.0.130": must be within subnet 192.168.0.0/25`,
+				`spec.ipv4Config.pool.end: Invalid value: "192.168.0.140": must be within subnet 192.168.0.0/25`,
+			},
+		},
+		{
+			name:  "pool start after end",
+			given: newTestIPPoolBuilder().PoolRange("192.168.0.99", "192.168.0.10").Build(),
+			expected: []string{
+				`spec.ipv4Config.pool.end: Invalid value: "192.168.0.10": must not be before start 192.168.0.99`,
+			},
+		},
+		{
+			name:  "pool range with the network and broadcast ip",
+			given: newTestIPPoolBuilder().PoolRange("192.168.0.0", "192.168.0.255").Build(),
+			expected: []string{
+				`spec.ipv4Config.pool.start: Invalid value: "192.168.0.0": must not be the network ip`,
+				`spec.ipv4Config.pool.end: Invalid value: "192.168.0.255": must not be the broadcast ip`,
+			},
+		},
+		{
+			name:  "invalid exclusions",
+			given: newTestIPPoolBuilder().Exclude("192.168.0", "192.168.1.50", "192.168.0.50", "192.168.0.50").Build(),
+			expected: []string{
+				`spec.ipv4Config.pool.exclude[0]: Invalid value: "192.168.0": must be a valid IPv4 address`,
+				`spec.ipv4Config.pool.exclude[1]: Invalid value: "192.168.1.50": must be within subnet 192.168.0.0/24`,
+				`spec.ipv4Config.pool.exclude[3]: Duplicate value: "192.168.0.50"`,
+			},
+		},
+		{
+			name:     "server ip out of subnet",
+			given:    newTestIPPoolBuilder().ServerIP("192.168.100.2").Build(),
+			expected: []string{`spec.ipv4Config.serverIP: Invalid value: "192.168.100.2": must be within subnet 192.168.0.0/24`},
+		},
+		{
+			name:     "server ip is the network ip even if the pool allows it",
+			given:    newTestIPPoolBuilder().ServerIP("192.168.0.0").AllowNetworkBroadcast().Build(),
+			expected: []string{`spec.ipv4Config.serverIP: Invalid value: "192.168.0.0": must not be the network ip`},
+		},
+		{
+			name:     "server ip is the broadcast ip",
+			given:    newTestIPPoolBuilder().ServerIP("192.168.0.255").Build(),
+			expected: []string{`spec.ipv4Config.serverIP: Invalid value: "192.168.0.255": must not be the broadcast ip`},
+		},
+		{
+			name:     "server ip is the router ip",
+			given:    newTestIPPoolBuilder().ServerIP(testRouter).Build(),
+			expected: []string{`spec.ipv4Config.serverIP: Invalid value: "192.168.0.1": must not be the router ip`},
+		},
+		{
+			name:  "server ip and router on a /30",
+			given: newTestIPPoolBuilder().CIDR("192.168.0.0/30").ServerIP("192.168.0.1").Router("192.168.0.2").Build(),
+		},
+		{
+			name:     "router is the broadcast ip of a /30",
+			given:    newTestIPPoolBuilder().CIDR("192.168.0.0/30").ServerIP("192.168.0.1").Router("192.168.0.3").Build(),
+			expected: []string{`spec.ipv4Config.router: Invalid value: "192.168.0.3": must not be the broadcast ip`},
+		},
+		{
+			name:     "router out of subnet",
+			given:    newTestIPPoolBuilder().Router("192.168.1.1").Build(),
+			expected: []string{`spec.ipv4Config.router: Invalid value: "192.168.1.1": must be within subnet 192.168.0.0/24`},
+		},
+		{
+			name:     "router is the broadcast ip",
+			given:    newTestIPPoolBuilder().Router("192.168.0.255").Build(),
+			expected: []string{`spec.ipv4Config.router: Invalid value: "192.168.0.255": must not be the broadcast ip`},
+		},
+		{
+			name:     "subnet mask leaving the router out",
+			given:    newTestIPPoolBuilder().ServerIP("192.168.0.130").SubnetMaskOverride("255.255.255.128").Build(),
+			expected: []string{`spec.ipv4Config.subnetMaskOverride: Invalid value: "255.255.255.128": leaves 192.168.0.1 out of subnet 192.168.0.128/25`},
+		},
+		{
+			name:     "subnet mask not contiguous",
+			given:    newTestIPPoolBuilder().SubnetMaskOverride("255.0.255.0").Build(),
+			expected: []string{`spec.ipv4Config.subnetMaskOverride: Invalid value: "255.0.255.0": must be contiguous`},
+		},
+		{
+			name:     "service gateway missing",
+			given:    newTestIPPoolBuilder().AdvertiseServiceRoutes("").Build(),
+			expected: []string{`spec.serviceGateway: Required value: must be given when advertising service routes`},
+		},
+		{
+			name:     "service gateway out of subnet",
+			given:    newTestIPPoolBuilder().AdvertiseServiceRoutes("192.168.100.1").Build(),
+			expected: []string{`spec.serviceGateway: Invalid value: "192.168.100.1": must be within subnet 192.168.0.0/24`},
+		},
+		{
+			name:     "infinite lease time when allowing BOOTP",
+			given:    newTestIPPoolBuilder().AllowBOOTP().LeaseTime(infiniteLeaseTime).Build(),
+			expected: []string{`spec.ipv4Config.leaseTime: Invalid value: 4294967295: must be within 0 and 4294967294 when allowing BOOTP`},
+		},
+		{
+			name:  "infinite lease time without BOOTP",
+			given: newTestIPPoolBuilder().LeaseTime(infiniteLeaseTime).Build(),
+		},
+		{
+			name:  "invalid dns servers",
+			given: newTestIPPoolBuilder().DNS("1.1.1", "2001:4860:4860::8888", "8.8.8.8", "8.8.8.8").Build(),
+			expected: []string{
+				`spec.ipv4Config.dns[0]: Invalid value: "1.1.1": must be a valid IPv4 address`,
+				`spec.ipv4Config.dns[1]: Invalid value: "2001:4860:4860::8888": must be an IPv4 address; set the other ones in spec.ipv6Config.dns`,
+				`spec.ipv4Config.dns[3]: Duplicate value: "8.8.8.8"`,
+			},
+		},
+		{
+			name: "invalid domain names",
+			given: newTestIPPoolBuilder().
+				DomainName("example..com").
+				DomainSearch("eng.example.com", "eng_lab.example.com", "ENG.example.com.").Build(),
+			expected: []string{
+				`spec.ipv4Config.domainName: Invalid value: "example..com": must be a valid DNS name: name has an empty label`,
+				`spec.ipv4Config.domainSearch[1]: Invalid value: "eng_lab.example.com": must be a valid DNS name: label eng_lab has characters other than letters, digits, and hyphens`,
+				`spec.ipv4Config.domainSearch[2]: Duplicate value: "ENG.example.com."`,
+			},
+		},
+		{
+			name:     "mtu below the minimum",
+			given:    newTestIPPoolBuilder().MTU(67).Build(),
+			expected: []string{`spec.ipv4Config.options.mtu: Invalid value: 67: must be within 68 and 9000`},
+		},
+		{
+			name:     "mtu above the maximum",
+			given:    newTestIPPoolBuilder().MTU(9001).Build(),
+			expected: []string{`spec.ipv4Config.options.mtu: Invalid value: 9001: must be within 68 and 9000`},
+		},
+		{
+			name:     "overflow weight above the maximum",
+			given:    newTestIPPoolBuilder().OverflowWeight(101).Build(),
+			expected: []string{`spec.overflowWeight: Invalid value: 101: must be within 0 and 100`},
+		},
+		{
+			name: "invalid extra options",
+			given: newTestIPPoolBuilder().
+				ExtraOption(0, "").
+				ExtraOption(255, "").
+				ExtraOption(26, "1450").
+				ExtraOption(67, "pxelinux.0").
+				ExtraOption(67, "ipxe.efi").Build(),
+			expected: []string{
+				`spec.ipv4Config.options.extraOptions[0].code: Invalid value: 0: must be within 1 and 254`,
+				`spec.ipv4Config.options.extraOptions[1].code: Invalid value: 255: must be within 1 and 254`,
+				`spec.ipv4Config.options.extraOptions[2].code: Invalid value: 26: is derived from the spec`,
+				`spec.ipv4Config.options.extraOptions[4].code: Duplicate value: 67`,
+			},
+		},
+		{
+			name: "undecodable extra options",
+			given: newTestIPPoolBuilder().
+				TypedExtraOption(161, "c0a8000", networkv1.ExtraOptionTypeHex).
+				ExtraOption(162, strings.Repeat("x", 256)).Build(),
+			expected: []string{
+				`spec.ipv4Config.options.extraOptions[0].value: Invalid value: "c0a8000": value of option 161 is not valid hex: encoding/hex: odd length hex string`,
+				`spec.ipv4Config.options.extraOptions[1].value: Invalid value: "` + strings.Repeat("x", 256) + `": value of option 162 is 256 bytes long, more than 255`,
+			},
+		},
+		{
+			name:  "invalid relay gateways",
+			given: newTestIPPoolBuilder().RelayGateway("10.0.1", "10.0.1.1", "10.0.1.1").Build(),
+			expected: []string{
+				`spec.relayGateways[0]: Invalid value: "10.0.1": must be a valid IPv4 address`,
+				`spec.relayGateways[2]: Duplicate value: "10.0.1.1"`,
+			},
+		},
+		{
+			name: "invalid external ipam",
+			given: newTestIPPoolBuilder().
+				ExternalIPAM("ipam.example.com/allocate", "Retry").
+				ExternalIPAMAuthSecret("", "").Build(),
+			expected: []string{
+				`spec.externalIPAM.url: Invalid value: "ipam.example.com/allocate": must be an absolute https URL`,
+				`spec.externalIPAM.authSecretRef.name: Required value: must name the Secret holding the token`,
+				`spec.externalIPAM.authSecretRef.key: Required value: must name the key of the token`,
+				`spec.externalIPAM.failurePolicy: Unsupported value: "Retry": supported values: "Fail", "AllocateLocally"`,
+			},
+		},
+		{
+			name:  "plain http external ipam",
+			given: newTestIPPoolBuilder().ExternalIPAM("http://ipam.example.com/allocate", "").Build(),
+			expected: []string{
+				`spec.externalIPAM.url: Invalid value: "http://ipam.example.com/allocate": must be an absolute https URL`,
+			},
+		},
+		{
+			name: "invalid known external hosts",
+			given: newTestIPPoolBuilder().
+				KnownExternalHost("192.168.0.300", "", "typo").
+				KnownExternalHost("192.168.100.50", "", "elsewhere").
+				KnownExternalHost(testServerIP, "", "server").
+				KnownExternalHost(testRouter, "", "router").
+				KnownExternalHost("192.168.0.255", "", "broadcast").
+				KnownExternalHost("192.168.0.200", "not-a-mac", "printer").
+				KnownExternalHost("192.168.0.200", "", "printer").
+				KnownExternalHost("192.168.0.201", "", "printer\n@ IN NS evil.example.com.").
+				KnownExternalHost("192.168.0.202", "", strings.Repeat("x", 257)).Build(),
+			expected: []string{
+				`spec.knownExternalHosts[0].ip: Invalid value: "192.168.0.300": must be a valid IPv4 address`,
+				`spec.knownExternalHosts[1].ip: Invalid value: "192.168.100.50": must be within subnet 192.168.0.0/24`,
+				`spec.knownExternalHosts[2].ip: Invalid value: "192.168.0.2": must not be the server ip`,
+				`spec.knownExternalHosts[3].ip: Invalid value: "192.168.0.1": must not be the router ip`,
+				`spec.knownExternalHosts[4].ip: Invalid value: "192.168.0.255": must not be the broadcast ip`,
+				`spec.knownExternalHosts[5].mac: Invalid value: "not-a-mac": must be a valid MAC address`,
+				`spec.knownExternalHosts[6].ip: Duplicate value: "192.168.0.200"`,
+				`spec.knownExternalHosts[7].description: Invalid value: "printer\n@ IN NS evil.example.com.": must not contain control characters`,
+				`spec.knownExternalHosts[8].description: Too long: may not be more than 256 bytes`,
+			},
+		},
+		{
+			name: "invalid reservations",
+			given: newTestIPPoolBuilder().
+				PoolRange(testStartIP, testEndIP).
+				Exclude("192.168.0.50").
+				Reservation("fa:cf:8e:50:82:01", "192.168.100.10").
+				Reservation("fa:cf:8e:50:82:02", testServerIP).
+				Reservation("fa:cf:8e:50:82:03", "192.168.0.50").
+				Reservation("fa:cf:8e:50:82:04", "192.168.0.20").
+				Reservation("fa:cf:8e:50:82:05", "192.168.0.20").
+				Reservation("FA-CF-8E-50-82-04", "192.168.0.21").
+				Reservation("not-a-mac", "192.168.0.22").Build(),
+			expected: []string{
+				`spec.ipv4Config.reservations[0].ipAddress: Invalid value: "192.168.100.10": must be within subnet 192.168.0.0/24`,
+				`spec.ipv4Config.reservations[1].ipAddress: Invalid value: "192.168.0.2": must not be the server ip`,
+				`spec.ipv4Config.reservations[2].ipAddress: Invalid value: "192.168.0.50": must not be excluded`,
+				`spec.ipv4Config.reservations[4].ipAddress: Duplicate value: "192.168.0.20"`,
+				`spec.ipv4Config.reservations[5].macAddress: Duplicate value: "FA-CF-8E-50-82-04"`,
+				`spec.ipv4Config.reservations[6].macAddress: Invalid value: "not-a-mac": must be a valid MAC address`,
+			},
+		},
+		{
+			name: "valid held-back range",
+			given: newTestIPPoolBuilder().
+				PoolRange(testStartIP, testEndIP).
+				HoldBack("192.168.0.90", testEndIP).Build(),
+		},
+		{
+			name: "held-back range out of the pool range",
+			given: newTestIPPoolBuilder().
+				PoolRange(testStartIP, testEndIP).
+				HoldBack("192.168.0.5", "192.168.0.100").Build(),
+			expected: []string{
+				`spec.ipv4Config.pool.holdBack.start: Invalid value: "192.168.0.5": must be within the pool range from 192.168.0.10 to 192.168.0.99`,
+				`spec.ipv4Config.pool.holdBack.end: Invalid value: "192.168.0.100": must be within the pool range from 192.168.0.10 to 192.168.0.99`,
+			},
+		},
+		{
+			name: "invalid held-back range",
+			given: newTestIPPoolBuilder().
+				PoolRange(testStartIP, testEndIP).
+				HoldBack("192.168.0.90", "192.168.0.80").Build(),
+			expected: []string{
+				`spec.ipv4Config.pool.holdBack.end: Invalid value: "192.168.0.80": must not be less than start 192.168.0.90`,
+			},
+		},
+		{
+			name: "held-back range of invalid addresses",
+			given: newTestIPPoolBuilder().
+				PoolRange(testStartIP, testEndIP).
+				HoldBack("192.168.0.300", "fd00::1").Build(),
+			expected: []string{
+				`spec.ipv4Config.pool.holdBack.start: Invalid value: "192.168.0.300": must be a valid IPv4 address`,
+				`spec.ipv4Config.pool.holdBack.end: Invalid value: "fd00::1": must be a valid IPv4 address`,
+			},
+		},
+		{
+			name: "errors of several fields",
+			given: newTestIPPoolBuilder().
+				ServerIP("192.168.0.255").
+				PoolRange("192.168.1.10", testEndIP).
+				RelayGateway("10.0.1").Build(),
+			expected: []string{
+				`spec.ipv4Config.pool.start: Invalid value: "192.168.1.10": must be within subnet 192.168.0.0/24`,
+				`spec.ipv4Config.serverIP: Invalid value: "192.168.0.255": must not be the broadcast ip`,
+				`spec.relayGateways[0]: Invalid value: "10.0.1": must be a valid IPv4 address`,
+			},
+		},
+		{
+			name:  "valid ippool with ipv6",
+			given: newTestIPPoolBuilder().IPv6PoolRange("2001:db8::/64", "2001:db8::1", "2001:db8::100", "").Build(),
+		},
+		{
+			name:     "ipv4 dns server in ipv6 config",
+			given:    newTestIPPoolBuilder().IPv6PoolRange("2001:db8::/64", "2001:db8::1", "2001:db8::100", "").IPv6DNS("2001:db8::53", "8.8.8.8").Build(),
+			expected: []string{`spec.ipv6Config.dns[1]: Invalid value: "8.8.8.8": must be an IPv6 address; set the other ones in spec.ipv4Config.dns`},
+		},
+		{
+			name:     "ipv6 pool range out of subnet",
+			given:    newTestIPPoolBuilder().IPv6PoolRange("2001:db8::/64", "2001:db8::1", "2001:db8:1::100", "2001:db8::200").Build(),
+			expected: []string{`spec.ipv6Config.pool.start: Invalid value: "2001:db8:1::100": must be within subnet 2001:db8::/64`},
+		},
+		{
+			name:     "ipv6 cidr in ipv4 config",
+			given:    newTestIPPoolBuilder().CIDR("2001:db8::/64").Build(),
+			expected: []string{`spec.ipv4Config.cidr: Invalid value: "2001:db8::/64": must be an IPv4 cidr`},
+		},
+		{
+			name:     "link-local ipv6 cidr",
+			given:    newTestIPPoolBuilder().IPv6PoolRange("fe80::/64", "", "fe80::100", "").Build(),
+			expected: []string{`spec.ipv6Config: Invalid value: "fe80::/64": cidr fe80::/64 overlaps link-local prefix fe80::/10`},
+		},
+		{
+			name: "valid ippool with static routes",
+			given: newTestIPPoolBuilder().
+				StaticRoute("10.0.0.0/8", "192.168.0.254").
+				StaticRoute("172.16.1.0/24", "0.0.0.0").
+				StaticRoute("0.0.0.0/0", testRouter).Build(),
+		},
+		{
+			name: "malformed static routes",
+			given: newTestIPPoolBuilder().
+				StaticRoute("10.0.0.1/8", "192.168.0.254").
+				StaticRoute("2001:db8::/64", "192.168.0.254").
+				StaticRoute("10.0.0.0/8", "192.168.0").
+				StaticRoute("172.16.0.0/16", "").Build(),
+			expected: []string{
+				`spec.ipv4Config.staticRoutes[0].destination: Invalid value: "10.0.0.1/8": must not have host bits set, e.g., 10.0.0.0/8`,
+				`spec.ipv4Config.staticRoutes[1].destination: Invalid value: "2001:db8::/64": must be a valid IPv4 cidr`,
+				`spec.ipv4Config.staticRoutes[2].gateway: Invalid value: "192.168.0": must be a valid IPv4 address`,
+				`spec.ipv4Config.staticRoutes[3].gateway: Required value: must be given, 0.0.0.0 for destinations on the link`,
+			},
+		},
+		{
+			name: "duplicate static route destination",
+			given: newTestIPPoolBuilder().
+				StaticRoute("10.0.0.0/8", "192.168.0.254").
+				StaticRoute("10.0.0.0/8", "192.168.0.253").Build(),
+			expected: []string{`spec.ipv4Config.staticRoutes[1].destination: Duplicate value: "10.0.0.0/8"`},
+		},
+		{
+			name: "static route gateways out of reach",
+			given: newTestIPPoolBuilder().
+				StaticRoute("10.0.0.0/8", "192.168.1.254").
+				StaticRoute("172.16.0.0/16", "192.168.0.255").Build(),
+			expected: []string{
+				`spec.ipv4Config.staticRoutes[0].gateway: Invalid value: "192.168.1.254": must be within subnet 192.168.0.0/24`,
+				`spec.ipv4Config.staticRoutes[1].gateway: Invalid value: "192.168.0.255": must not be the broadcast ip`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := ValidateIPPoolSpec(tc.given)
+
+			var actual []string
+			for _, err := range errs {
+				actual = append(actual, err.Error())
+			}
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
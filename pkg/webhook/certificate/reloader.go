@@ -0,0 +1,115 @@
+package certificate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const ExpiryMetricName = "vmdhcpwebhook_certificate_expiry_timestamp_seconds"
+
+var errNoCertificate = errors.New("no serving certificate loaded yet")
+
+// Reloader serves the certificate kept in a TLS Secret, e.g., the one of the
+// webhook, whose framework issues and renews the certificate in the Secret.
+// The Reloader watches the Secret and swaps the new key pair in through the
+// GetCertificate callback of the listener. New connections get the new
+// certificate without rebinding the listener, and the ones in flight keep
+// the certificate they were handshaked with.
+type Reloader struct {
+	namespace string
+	name      string
+
+	cert atomic.Pointer[tls.Certificate]
+	desc *prometheus.Desc
+}
+
+// NewReloader returns a Reloader for the TLS Secret namespace/name.
+func NewReloader(namespace, name string) *Reloader {
+	return &Reloader{
+		namespace: namespace,
+		name:      name,
+		desc: prometheus.NewDesc(
+			ExpiryMetricName,
+			"Expiry time of the certificate served by the webhook in seconds since the epoch",
+			nil, nil,
+		),
+	}
+}
+
+// OnChange loads the key pair of the TLS Secret whenever it changes. A key
+// pair which cannot be loaded is skipped, the certificate loaded before
+// being served until the Secret is fixed.
+func (r *Reloader) OnChange(_ string, secret *corev1.Secret) (*corev1.Secret, error) {
+	if secret == nil || secret.DeletionTimestamp != nil {
+		return secret, nil
+	}
+	if secret.Namespace != r.namespace || secret.Name != r.name {
+		return secret, nil
+	}
+
+	cert, err := loadKeyPair(secret)
+	if err != nil {
+		logrus.Warnf("(certificate.OnChange) skip reloading the certificate of secret %s/%s: %s", secret.Namespace, secret.Name, err.Error())
+		return secret, nil
+	}
+
+	if old := r.cert.Swap(cert); old == nil || !old.Leaf.Equal(cert.Leaf) {
+		logrus.Infof("(certificate.OnChange) serving certificate of secret %s/%s expiring at %s",
+			secret.Namespace, secret.Name, cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	return secret, nil
+}
+
+func loadKeyPair(secret *corev1.Secret) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse certificate: %w", err)
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// GetCertificate hands out the certificate currently loaded, and is meant
+// for the tls.Config of the listener.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := r.cert.Load()
+	if cert == nil {
+		return nil, errNoCertificate
+	}
+	return cert, nil
+}
+
+// Ready tells whether a certificate has been loaded, without which no
+// admission can be served.
+func (r *Reloader) Ready() error {
+	if r.cert.Load() == nil {
+		return errNoCertificate
+	}
+	return nil
+}
+
+func (r *Reloader) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.desc
+}
+
+// Collect reports the expiry time of the certificate currently served.
+func (r *Reloader) Collect(ch chan<- prometheus.Metric) {
+	cert := r.cert.Load()
+	if cert == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(r.desc, prometheus.GaugeValue, float64(cert.Leaf.NotAfter.Unix()))
+}
@@ -0,0 +1,167 @@
+package certificate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	testNamespace  = "harvester-system"
+	testSecretName = "vm-dhcp-webhook-tls"
+	testServerName = "vm-dhcp-webhook.harvester-system.svc"
+)
+
+func newTestSecret(t *testing.T, notAfter time.Time) *corev1.Secret {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(notAfter.Unix()),
+		Subject:      pkix.Name{CommonName: testServerName},
+		DNSNames:     []string{testServerName},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: testNamespace,
+			Name:      testSecretName,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		},
+	}
+}
+
+func TestReloader_Rotation(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	oldSecret := newTestSecret(t, now.Add(time.Hour))
+	newSecret := newTestSecret(t, now.Add(90*24*time.Hour))
+
+	reloader := NewReloader(testNamespace, testSecretName)
+	assert.Error(t, reloader.Ready(), "reloader without a certificate should not be ready")
+	assert.Equal(t, 0, testutil.CollectAndCount(reloader), "nothing should be reported without a certificate")
+
+	_, err := reloader.OnChange(testNamespace+"/"+testSecretName, oldSecret)
+	assert.Nil(t, err)
+	assert.Nil(t, reloader.Ready())
+	assert.Equal(t, float64(now.Add(time.Hour).Unix()), testutil.ToFloat64(prometheus.Collector(reloader)))
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{GetCertificate: reloader.GetCertificate}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// Keep admissions flowing over fresh and kept-alive connections while the
+	// certificate is rotated
+	var (
+		wg       sync.WaitGroup
+		failures atomic.Int32
+		stop     = make(chan struct{})
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(keepAlive bool) {
+			defer wg.Done()
+			client := &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig:   &tls.Config{ServerName: testServerName, InsecureSkipVerify: true},
+					DisableKeepAlives: !keepAlive,
+				},
+				Timeout: 5 * time.Second,
+			}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := client.Post(srv.URL+"/v1/webhook/validation", "application/json", strings.NewReader("{}"))
+				if err != nil {
+					failures.Add(1)
+					continue
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					failures.Add(1)
+				}
+			}
+		}(i%2 == 0)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = reloader.OnChange(testNamespace+"/"+testSecretName, newSecret)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	assert.Zero(t, failures.Load(), "no admission should fail during the rotation")
+	assert.Equal(t, float64(now.Add(90*24*time.Hour).Unix()), testutil.ToFloat64(prometheus.Collector(reloader)))
+
+	// New connections get the new certificate
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{ServerName: testServerName, InsecureSkipVerify: true})
+	if assert.Nil(t, err) {
+		assert.Equal(t, now.Add(90*24*time.Hour).UTC(), conn.ConnectionState().PeerCertificates[0].NotAfter.UTC())
+		conn.Close()
+	}
+}
+
+func TestReloader_OnChange(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	secret := newTestSecret(t, now.Add(time.Hour))
+
+	reloader := NewReloader(testNamespace, testSecretName)
+	_, err := reloader.OnChange(testNamespace+"/"+testSecretName, secret)
+	assert.Nil(t, err)
+
+	other := newTestSecret(t, now.Add(2*time.Hour))
+	other.Name = "other"
+	_, err = reloader.OnChange(testNamespace+"/other", other)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(now.Add(time.Hour).Unix()), testutil.ToFloat64(prometheus.Collector(reloader)), "other secrets should be ignored")
+
+	broken := newTestSecret(t, now.Add(3*time.Hour))
+	broken.Data[corev1.TLSPrivateKeyKey] = []byte("garbage")
+	_, err = reloader.OnChange(testNamespace+"/"+testSecretName, broken)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(now.Add(time.Hour).Unix()), testutil.ToFloat64(prometheus.Collector(reloader)), "broken key pair should keep the certificate served")
+
+	_, err = reloader.OnChange(testNamespace+"/"+testSecretName, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, reloader.Ready(), "deleted secret should keep the certificate served")
+}
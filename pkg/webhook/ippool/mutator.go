@@ -120,7 +120,7 @@ func ensureServerIP(server string, cidr, router string, excludes []string) (*str
 				continue
 			}
 
-			if serverIPAddr.As4() == broadcastIPAddr.As4() {
+			if serverIPAddr == broadcastIPAddr {
 				break
 			}
 
@@ -156,6 +156,9 @@ func ensurePoolRange(pool networkv1.Pool, cidr string) (*networkv1.Pool, error)
 
 	if !startIPAddr.IsValid() {
 		startIPAddr = networkIPAddr.Next()
+		if pool.AllowNetworkBroadcast {
+			startIPAddr = networkIPAddr
+		}
 
 		if !ipNet.Contains(startIPAddr.AsSlice()) {
 			logrus.Warningf("start ip is out of subnet")
@@ -164,8 +167,23 @@ func ensurePoolRange(pool networkv1.Pool, cidr string) (*networkv1.Pool, error)
 		newPool.Start = startIPAddr.String()
 	}
 
+	// The end of a pool sized by count is derived from it, see util.LoadPool
+	if pool.Count != 0 && pool.End == "" {
+		if !reflect.DeepEqual(newPool, pool) {
+			logrus.Infof("auto assign startIP=%s", startIPAddr.String())
+			return &newPool, nil
+		}
+		return nil, nil
+	}
+
 	if !endIPAddr.IsValid() {
-		endIPAddr = broadcastIPAddr.Prev()
+		endIPAddr, err = util.LastUsable(ipNet)
+		if err != nil {
+			return nil, err
+		}
+		if pool.AllowNetworkBroadcast {
+			endIPAddr = broadcastIPAddr
+		}
 
 		if !ipNet.Contains(endIPAddr.AsSlice()) {
 			logrus.Warningf("end ip is out of subnet")
@@ -82,6 +82,17 @@ func TestMutator_Create(t *testing.T) {
 			},
 			expected: output{},
 		},
+		{
+			given: input{
+				name: "ippool with pool range sized by count",
+				ipPool: newTestIPPoolBuilder().
+					CIDR("172.19.64.0/24").
+					ServerIP("172.19.64.2").
+					Router("172.19.64.1").
+					PoolCount("172.19.64.20", 50).Build(),
+			},
+			expected: output{},
+		},
 		{
 			given: input{
 				name: "/30 ippool with router (zero allocatable ip left effectively)",
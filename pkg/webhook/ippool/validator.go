@@ -3,38 +3,54 @@ package ippool
 import (
 	"fmt"
 	"net/netip"
+	"sort"
 	"strings"
 
 	"github.com/harvester/webhook/pkg/server/admission"
 	"github.com/rancher/wrangler/v3/pkg/kv"
 	"github.com/sirupsen/logrus"
 	admissionregv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
 	ctlcniv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/k8s.cni.cncf.io/v1"
 	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
 	"github.com/harvester/vm-dhcp-controller/pkg/util"
+	"github.com/harvester/vm-dhcp-controller/pkg/validation"
 	"github.com/harvester/vm-dhcp-controller/pkg/webhook"
 )
 
+// maxListedHolders caps the holders of outstanding leases named when denying
+// the deletion of an IPPool.
+const maxListedHolders = 5
+
 type Validator struct {
 	admission.DefaultValidator
 
 	serviceCIDR string
+	maxPoolSize int
 
 	nadCache      ctlcniv1.NetworkAttachmentDefinitionCache
+	ippoolCache   ctlnetworkv1.IPPoolCache
 	vmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache
 }
 
 func NewValidator(
 	serviceCIDR string,
+	maxPoolSize int,
 	nadCache ctlcniv1.NetworkAttachmentDefinitionCache,
+	ippoolCache ctlnetworkv1.IPPoolCache,
 	vmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache,
 ) *Validator {
 	return &Validator{
 		serviceCIDR:   serviceCIDR,
+		maxPoolSize:   maxPoolSize,
 		nadCache:      nadCache,
+		ippoolCache:   ippoolCache,
 		vmnetcfgCache: vmnetcfgCache,
 	}
 }
@@ -43,7 +59,10 @@ func (v *Validator) Create(_ *admission.Request, newObj runtime.Object) error {
 	ipPool := newObj.(*networkv1.IPPool)
 	logrus.Infof("create ippool %s/%s", ipPool.Namespace, ipPool.Name)
 
-	// sanity check
+	if errs := validation.ValidateIPPoolSpec(ipPool); len(errs) > 0 {
+		return fmt.Errorf(webhook.CreateErr, "IPPool", ipPool.Namespace, ipPool.Name, errs.ToAggregate())
+	}
+
 	poolInfo, err := util.LoadPool(ipPool)
 	if err != nil {
 		return fmt.Errorf(webhook.CreateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
@@ -57,31 +76,63 @@ func (v *Validator) Create(_ *admission.Request, newObj runtime.Object) error {
 		return fmt.Errorf(webhook.CreateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
 	}
 
-	if err := v.checkPoolRange(poolInfo); err != nil {
+	if err := util.CheckPoolSize(poolInfo, ipPool.Spec.IPv4Config.Pool.Exclude, v.maxPoolSize); err != nil {
+		return fmt.Errorf(webhook.CreateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
+	}
+
+	if err := v.checkCIDROverlap(ipPool); err != nil {
+		return fmt.Errorf(webhook.CreateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
+	}
+
+	if err := v.checkPoolOverlap(ipPool, poolInfo); err != nil {
+		return fmt.Errorf(webhook.CreateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
+	}
+
+	if err := v.checkDelegation(ipPool); err != nil {
 		return fmt.Errorf(webhook.CreateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
 	}
 
-	if err := v.checkServerIP(poolInfo); err != nil {
+	if err := v.checkOverflow(ipPool); err != nil {
 		return fmt.Errorf(webhook.CreateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
 	}
 
-	if err := v.checkRouter(poolInfo); err != nil {
+	if err := v.checkKnownExternalHosts(ipPool); err != nil {
 		return fmt.Errorf(webhook.CreateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
 	}
 
+	v.warnGatewayCollisions(ipPool, poolInfo)
+
 	return nil
 }
 
-func (v *Validator) Update(_ *admission.Request, _, newObj runtime.Object) error {
+func (v *Validator) Update(request *admission.Request, oldObj, newObj runtime.Object) error {
+	oldIPPool, _ := oldObj.(*networkv1.IPPool)
 	ipPool := newObj.(*networkv1.IPPool)
 
 	if ipPool.DeletionTimestamp != nil {
 		return nil
 	}
 
+	// The status is written by the controllers alone, which only need its
+	// format kept; the spec isn't changed along with it
+	if isStatusUpdate(request) {
+		if util.IsMixedAllocationFormat(ipPool.Status.IPv4) {
+			return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name,
+				fmt.Errorf("status mixes legacy allocated records with typed entries"))
+		}
+		return nil
+	}
+
+	if err := checkDHCPCheckRequest(oldIPPool, ipPool); err != nil {
+		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
+	}
+
 	logrus.Infof("update ippool %s/%s", ipPool.Namespace, ipPool.Name)
 
-	// sanity check
+	if errs := validation.ValidateIPPoolSpec(ipPool); len(errs) > 0 {
+		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, errs.ToAggregate())
+	}
+
 	poolInfo, err := util.LoadPool(ipPool)
 	if err != nil {
 		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
@@ -90,9 +141,18 @@ func (v *Validator) Update(_ *admission.Request, _, newObj runtime.Object) error
 	var (
 		allocatedIPAddrList []netip.Addr
 		excludedIPAddrList  []netip.Addr
+		malformedList       []string
 	)
 	if ipPool.Status.IPv4 != nil {
-		allocatedIPAddrList, excludedIPAddrList, _ = util.LoadAllocated(ipPool.Status.IPv4.Allocated)
+		allocatedIPAddrList, excludedIPAddrList, _, malformedList = util.LoadAllocated(util.AllocationEntries(ipPool.Status.IPv4))
+	}
+	if len(malformedList) > 0 {
+		logrus.Warnf("ippool %s/%s has malformed allocation records: %s", ipPool.Namespace, ipPool.Name, strings.Join(malformedList, ", "))
+	}
+
+	if util.IsMixedAllocationFormat(ipPool.Status.IPv4) {
+		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name,
+			fmt.Errorf("status mixes legacy allocated records with typed entries"))
 	}
 
 	if err := v.checkNAD(ipPool.Spec.NetworkName); err != nil {
@@ -103,7 +163,15 @@ func (v *Validator) Update(_ *admission.Request, _, newObj runtime.Object) error
 		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
 	}
 
-	if err := v.checkPoolRange(poolInfo); err != nil {
+	if err := util.CheckPoolSize(poolInfo, ipPool.Spec.IPv4Config.Pool.Exclude, v.maxPoolSize); err != nil {
+		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
+	}
+
+	if err := v.checkCIDROverlap(ipPool); err != nil {
+		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
+	}
+
+	if err := v.checkPoolOverlap(ipPool, poolInfo); err != nil {
 		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
 	}
 
@@ -111,10 +179,24 @@ func (v *Validator) Update(_ *admission.Request, _, newObj runtime.Object) error
 		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
 	}
 
-	if err := v.checkRouter(poolInfo); err != nil {
+	if err := v.checkDelegation(ipPool); err != nil {
+		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
+	}
+
+	if err := v.checkOverflow(ipPool); err != nil {
+		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
+	}
+
+	if err := v.checkKnownExternalHosts(ipPool, allocatedIPAddrList...); err != nil {
 		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
 	}
 
+	if err := checkReservations(ipPool); err != nil {
+		return fmt.Errorf(webhook.UpdateErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
+	}
+
+	v.warnGatewayCollisions(ipPool, poolInfo)
+
 	return nil
 }
 
@@ -122,8 +204,17 @@ func (v *Validator) Delete(_ *admission.Request, oldObj runtime.Object) error {
 	ipPool := oldObj.(*networkv1.IPPool)
 	logrus.Infof("delete ippool %s/%s", ipPool.Namespace, ipPool.Name)
 
+	if ipPool.Annotations[util.ForceDeleteAnnotationKey] == "true" {
+		logrus.Warnf("force deleting ippool %s/%s regardless of its leases", ipPool.Namespace, ipPool.Name)
+		return nil
+	}
+
+	if err := v.checkLeases(ipPool); err != nil {
+		return fmt.Errorf(webhook.DeleteErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
+	}
+
 	if err := v.checkVmNetCfgs(ipPool); err != nil {
-		return fmt.Errorf(webhook.DeleteErr, ipPool.Kind, ipPool.Namespace, ipPool.Name, err)
+		return fmt.Errorf(webhook.DeleteErr, "IPPool", ipPool.Namespace, ipPool.Name, err)
 	}
 
 	return nil
@@ -131,7 +222,7 @@ func (v *Validator) Delete(_ *admission.Request, oldObj runtime.Object) error {
 
 func (v *Validator) Resource() admission.Resource {
 	return admission.Resource{
-		Names:      []string{"ippools"},
+		Names:      []string{"ippools", "ippools/status"},
 		Scope:      admissionregv1.NamespacedScope,
 		APIGroup:   networkv1.SchemeGroupVersion.Group,
 		APIVersion: networkv1.SchemeGroupVersion.Version,
@@ -144,6 +235,11 @@ func (v *Validator) Resource() admission.Resource {
 	}
 }
 
+// isStatusUpdate tells whether the request updates the status subresource.
+func isStatusUpdate(request *admission.Request) bool {
+	return request != nil && request.Request != nil && request.SubResource == "status"
+}
+
 func (v *Validator) checkNAD(namespacedName string) error {
 	nadNamespace, nadName := kv.RSplit(namespacedName, "/")
 	if nadNamespace == "" {
@@ -165,50 +261,87 @@ func (v *Validator) checkCIDR(cidr string) error {
 		return err
 	}
 
-	if ipNet.Contains(svcIPNet.IP) || svcIPNet.Contains(ipNet.IP) {
+	if util.IPNetsOverlap(ipNet, svcIPNet) {
 		return fmt.Errorf("cidr %s overlaps cluster service cidr %s", cidr, svcIPNet)
 	}
 
 	return nil
 }
 
-func (v *Validator) checkPoolRange(pi util.PoolInfo) error {
-	if pi.StartIPAddr.IsValid() {
-		if !pi.IPNet.Contains(pi.StartIPAddr.AsSlice()) {
-			return fmt.Errorf("start ip %s is not within subnet", pi.StartIPAddr)
+// checkCIDROverlap ensures the CIDR of the IPPool does not overlap the one of
+// any IPPool of another network, as both would hand out the same addresses.
+// The IPPools of the same network share the subnet by design, e.g., when
+// delegated to or overflowed into, and are kept apart by checkPoolOverlap
+// instead. The IPPool itself is skipped so that it can be updated in place.
+func (v *Validator) checkCIDROverlap(ipPool *networkv1.IPPool) error {
+	ipNet, _, _, err := util.LoadCIDR(ipPool.Spec.IPv4Config.CIDR)
+	if err != nil {
+		return err
+	}
+
+	ipPools, err := v.ippoolCache.List(metav1.NamespaceAll, labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, other := range ipPools {
+		if other.Namespace == ipPool.Namespace && other.Name == ipPool.Name {
+			continue
+		}
+		if other.Spec.NetworkName == ipPool.Spec.NetworkName {
+			continue
 		}
 
-		if pi.StartIPAddr.As4() == pi.NetworkIPAddr.As4() {
-			return fmt.Errorf("start ip %s is the same as network ip", pi.StartIPAddr)
+		otherIPNet, _, _, err := util.LoadCIDR(other.Spec.IPv4Config.CIDR)
+		if err != nil {
+			logrus.Warningf("skip cidr overlap check against ippool %s/%s: %v", other.Namespace, other.Name, err)
+			continue
 		}
 
-		if pi.StartIPAddr.As4() == pi.BroadcastIPAddr.As4() {
-			return fmt.Errorf("start ip %s is the same as broadcast ip", pi.StartIPAddr)
+		if util.IPNetsOverlap(ipNet, otherIPNet) {
+			return fmt.Errorf("cidr %s overlaps cidr %s of ippool %s/%s on network %s",
+				ipPool.Spec.IPv4Config.CIDR, other.Spec.IPv4Config.CIDR, other.Namespace, other.Name, other.Spec.NetworkName)
 		}
 	}
 
-	if pi.EndIPAddr.IsValid() {
-		if !pi.IPNet.Contains(pi.EndIPAddr.AsSlice()) {
-			return fmt.Errorf("end ip %s is not within subnet", pi.EndIPAddr)
+	return nil
+}
+
+// checkPoolOverlap ensures the allocatable range of the IPPool does not
+// intersect with the one of any other IPPool of the same network; the ones of
+// other networks are left to checkCIDROverlap. The IPPool itself is skipped so
+// that it can be updated in place.
+func (v *Validator) checkPoolOverlap(ipPool *networkv1.IPPool, pi util.PoolInfo) error {
+	ipPools, err := v.ippoolCache.List(metav1.NamespaceAll, labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, other := range ipPools {
+		if other.Namespace == ipPool.Namespace && other.Name == ipPool.Name {
+			continue
+		}
+		if other.Spec.NetworkName != ipPool.Spec.NetworkName {
+			continue
 		}
 
-		if pi.EndIPAddr.As4() == pi.NetworkIPAddr.As4() {
-			return fmt.Errorf("end ip %s is the same as network ip", pi.EndIPAddr)
+		otherPoolInfo, err := util.LoadPool(other)
+		if err != nil {
+			logrus.Warningf("skip overlap check against ippool %s/%s: %v", other.Namespace, other.Name, err)
+			continue
 		}
 
-		if pi.EndIPAddr.As4() == pi.BroadcastIPAddr.As4() {
-			return fmt.Errorf("end ip %s is the same as broadcast ip", pi.EndIPAddr)
+		if util.PoolInfosOverlap(pi, otherPoolInfo) {
+			return fmt.Errorf("pool range overlaps ippool %s/%s", other.Namespace, other.Name)
 		}
 	}
+
 	return nil
 }
 
-// checkServerIP checks whether the server IP address:
-//   - is WITHIN the CIDR
-//   - is NOT the network IP address
-//   - is NOT the broadcast IP address
-//   - is NOT the same as the router IP address (if there is one)
-//   - does NOT collide with any allocated or excluded IP addresses
+// checkServerIP checks whether the server IP address does NOT collide with
+// any allocated or excluded IP addresses. The rest is left to
+// validation.ValidateIPPoolSpec.
 //
 // It does not compare the server IP address with any reserved ones, as
 // currently, the reserved IP addresses could only be the server or router IP
@@ -219,68 +352,339 @@ func (v *Validator) checkServerIP(pi util.PoolInfo, unallocatables ...netip.Addr
 		return nil
 	}
 
-	if !pi.IPNet.Contains(pi.ServerIPAddr.AsSlice()) {
-		return fmt.Errorf("server ip %s is not within subnet", pi.ServerIPAddr)
+	for _, ip := range unallocatables {
+		if pi.ServerIPAddr == ip {
+			return fmt.Errorf("server ip %s is already occupied", pi.ServerIPAddr)
+		}
 	}
 
-	if pi.ServerIPAddr.As4() == pi.NetworkIPAddr.As4() {
-		return fmt.Errorf("server ip %s is the same as network ip", pi.ServerIPAddr)
+	return nil
+}
+
+// checkDelegation checks whether the IPPools the IPPool delegates to:
+//   - are given as namespace/name pairs
+//   - are NOT the IPPool itself
+//   - do NOT share a namespace
+//
+// and, if the IPPool is delegated to, whether the delegating IPPool:
+//   - exists and lists the IPPool, or names it as its overflow IPPool
+//   - is NOT delegated to itself, unless it overflows into the IPPool
+//   - has the same network, CIDR, and server IP
+//
+// The pool ranges are kept apart by checkPoolOverlap.
+func (v *Validator) checkDelegation(ipPool *networkv1.IPPool) error {
+	ipPoolKey := ipPool.Namespace + "/" + ipPool.Name
+
+	namespaces := make(map[string]string)
+	for _, key := range util.DelegatedPools(ipPool) {
+		if !isNamespacedName(key) {
+			return fmt.Errorf("delegated ippool %s is not a namespace/name pair", key)
+		}
+		if key == ipPoolKey {
+			return fmt.Errorf("delegated ippool %s is the ippool itself", key)
+		}
+		namespace, _ := kv.RSplit(key, "/")
+		if other, ok := namespaces[namespace]; ok {
+			return fmt.Errorf("delegated ippools %s and %s are in the same namespace", other, key)
+		}
+		namespaces[namespace] = key
 	}
 
-	if pi.ServerIPAddr.As4() == pi.BroadcastIPAddr.As4() {
-		return fmt.Errorf("server ip %s is the same as broadcast ip", pi.ServerIPAddr)
+	parentKey, ok := util.DelegatingPool(ipPool)
+	if !ok {
+		return nil
 	}
 
-	if pi.RouterIPAddr.IsValid() && pi.ServerIPAddr.As4() == pi.RouterIPAddr.As4() {
-		return fmt.Errorf("server ip %s is the same as router ip", pi.ServerIPAddr)
+	if len(namespaces) > 0 {
+		return fmt.Errorf("delegated ippool cannot delegate to other ippools")
 	}
 
-	for _, ip := range unallocatables {
-		if pi.ServerIPAddr == ip {
-			return fmt.Errorf("server ip %s is already occupied", pi.ServerIPAddr)
+	if !isNamespacedName(parentKey) {
+		return fmt.Errorf("delegating ippool %s is not a namespace/name pair", parentKey)
+	}
+
+	parentNamespace, parentName := kv.RSplit(parentKey, "/")
+	parent, err := v.ippoolCache.Get(parentNamespace, parentName)
+	if err != nil {
+		return fmt.Errorf("delegating ippool %s not found", parentKey)
+	}
+
+	// The IPPool overflowing into an overflow IPPool can be delegated to or
+	// overflowed into in turn
+	overflow := util.OverflowsInto(parent, ipPool)
+
+	if !util.IsDelegated(parent, ipPool) {
+		return fmt.Errorf("delegating ippool %s does not list it as delegated ippool", parentKey)
+	}
+
+	if _, ok := util.DelegatingPool(parent); ok && !overflow {
+		return fmt.Errorf("delegating ippool %s is delegated to itself", parentKey)
+	}
+
+	if parent.Spec.NetworkName != ipPool.Spec.NetworkName {
+		return fmt.Errorf("network %s differs from network %s of delegating ippool %s", ipPool.Spec.NetworkName, parent.Spec.NetworkName, parentKey)
+	}
+
+	if parent.Spec.IPv4Config.CIDR != ipPool.Spec.IPv4Config.CIDR {
+		return fmt.Errorf("cidr %s differs from cidr %s of delegating ippool %s", ipPool.Spec.IPv4Config.CIDR, parent.Spec.IPv4Config.CIDR, parentKey)
+	}
+
+	if parent.Spec.IPv4Config.ServerIP != ipPool.Spec.IPv4Config.ServerIP {
+		return fmt.Errorf("server ip %s differs from server ip %s of delegating ippool %s", ipPool.Spec.IPv4Config.ServerIP, parent.Spec.IPv4Config.ServerIP, parentKey)
+	}
+
+	return nil
+}
+
+// checkOverflow checks whether the overflow IPPool:
+//   - is given as a namespace/name pair
+//   - is NOT the IPPool itself
+//   - is NOT delegated to by the IPPool as well
+//   - is on the same network, if it exists already
+//
+// and whether the overflow chain starting from the IPPool does NOT loop back
+// and is no longer than util.MaxOverflowDepth IPPools. The overflow IPPool
+// pointing back is checked by checkDelegation on its side.
+func (v *Validator) checkOverflow(ipPool *networkv1.IPPool) error {
+	key := ipPool.Spec.OverflowPool
+	if key == "" {
+		return nil
+	}
+
+	ipPoolKey := ipPool.Namespace + "/" + ipPool.Name
+	if !isNamespacedName(key) {
+		return fmt.Errorf("overflow ippool %s is not a namespace/name pair", key)
+	}
+	if key == ipPoolKey {
+		return fmt.Errorf("overflow ippool %s is the ippool itself", key)
+	}
+	for _, delegated := range util.DelegatedPools(ipPool) {
+		if delegated == key {
+			return fmt.Errorf("overflow ippool %s is a delegated ippool as well", key)
 		}
 	}
 
+	visited := map[string]struct{}{ipPoolKey: {}}
+	for depth := 1; key != ""; depth++ {
+		if _, ok := visited[key]; ok {
+			return fmt.Errorf("overflow chain loops back to ippool %s", key)
+		}
+		if depth > util.MaxOverflowDepth {
+			return fmt.Errorf("overflow chain is longer than %d ippools", util.MaxOverflowDepth)
+		}
+		visited[key] = struct{}{}
+
+		namespace, name := kv.RSplit(key, "/")
+		overflowPool, err := v.ippoolCache.Get(namespace, name)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				break
+			}
+			return err
+		}
+
+		if depth == 1 && overflowPool.Spec.NetworkName != ipPool.Spec.NetworkName {
+			return fmt.Errorf("network %s of overflow ippool %s differs from network %s", overflowPool.Spec.NetworkName, key, ipPool.Spec.NetworkName)
+		}
+
+		key = overflowPool.Spec.OverflowPool
+	}
+
 	return nil
 }
 
-func (v *Validator) checkRouter(pi util.PoolInfo) error {
-	if !pi.RouterIPAddr.IsValid() {
+// checkDHCPCheckRequest refuses to ask for a DHCP check while one is running
+// on the IPPool.
+func checkDHCPCheckRequest(oldIPPool, ipPool *networkv1.IPPool) error {
+	if ipPool.Annotations[util.RunDHCPCheckAnnotationKey] != "true" {
 		return nil
 	}
+	// The controller removes the annotation itself when dropping a request
+	if oldIPPool != nil && oldIPPool.Annotations[util.RunDHCPCheckAnnotationKey] == "true" {
+		return nil
+	}
+
+	if check := ipPool.Status.LastCheck; check != nil && check.State == networkv1.DHCPCheckRunning {
+		return fmt.Errorf("dhcp check %s is still running", check.PodName)
+	}
+
+	return nil
+}
+
+func isNamespacedName(key string) bool {
+	namespace, name, ok := strings.Cut(key, "/")
+	return ok && namespace != "" && name != "" && !strings.Contains(name, "/")
+}
+
+// checkKnownExternalHosts checks whether the IP address of each known external
+// host is NOT allocated to a VM. The rest is left to
+// validation.ValidateIPPoolSpec.
+func (v *Validator) checkKnownExternalHosts(ipPool *networkv1.IPPool, allocated ...netip.Addr) error {
+	for _, host := range ipPool.Spec.KnownExternalHosts {
+		ipAddr, err := netip.ParseAddr(host.IP)
+		if err != nil {
+			continue
+		}
+
+		for _, ip := range allocated {
+			if ipAddr == ip {
+				return fmt.Errorf("known external host ip %s is already allocated", ipAddr)
+			}
+		}
+	}
+
+	return nil
+}
+
+// warnGatewayCollisions warns about the server or router IP address of the
+// IPPool being the static IP address a VirtualMachineNetworkConfig on its
+// network asks for. It's not rejected, as the IPPool may just be corrected
+// before the VirtualMachineNetworkConfig, but the VM won't get its address
+// until either one is. Failing to look them up only skips the warning.
+func (v *Validator) warnGatewayCollisions(ipPool *networkv1.IPPool, pi util.PoolInfo) {
+	if !pi.ServerIPAddr.IsValid() && !pi.RouterIPAddr.IsValid() {
+		return
+	}
 
-	if !pi.IPNet.Contains(pi.RouterIPAddr.AsSlice()) {
-		return fmt.Errorf("router ip %s is not within subnet", pi.RouterIPAddr)
+	vmNetCfgs, err := v.vmnetcfgCache.GetByIndex(indexer.VmNetCfgByQualifiedNetworkIndex, ipPool.Spec.NetworkName)
+	if err != nil {
+		logrus.Warningf("skip gateway collision check of ippool %s/%s: %v", ipPool.Namespace, ipPool.Name, err)
+		return
+	}
+
+	_, nadName := kv.RSplit(ipPool.Spec.NetworkName, "/")
+	reserved := make(map[netip.Addr]string)
+	for _, vmNetCfg := range vmNetCfgs {
+		for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+			if nc.IPAddress == nil || (nc.NetworkName != ipPool.Spec.NetworkName && nc.NetworkName != nadName) {
+				continue
+			}
+			if ipAddr, err := netip.ParseAddr(*nc.IPAddress); err == nil {
+				reserved[ipAddr] = fmt.Sprintf("mac %s of vmnetcfg %s/%s", nc.MACAddress, vmNetCfg.Namespace, vmNetCfg.Name)
+			}
+		}
 	}
 
-	if pi.RouterIPAddr.As4() == pi.NetworkIPAddr.As4() {
-		return fmt.Errorf("router ip %s is the same as network ip", pi.RouterIPAddr)
+	for _, collision := range util.GatewayAddrCollisions(pi, reserved) {
+		logrus.Warningf("ippool %s/%s: %s as its static ip", ipPool.Namespace, ipPool.Name, collision)
 	}
+}
 
-	if pi.RouterIPAddr.As4() == pi.BroadcastIPAddr.As4() {
-		return fmt.Errorf("router ip %s is the same as broadcast ip", pi.BroadcastIPAddr)
+// checkReservations checks whether the IP address of each reservation is NOT
+// leased to another MAC address. The rest is left to
+// validation.ValidateIPPoolSpec.
+func checkReservations(ipPool *networkv1.IPPool) error {
+	if len(ipPool.Spec.IPv4Config.Reservations) == 0 {
+		return nil
+	}
+
+	leases := util.Leases(ipPool.Status.IPv4)
+	for _, reservation := range ipPool.Spec.IPv4Config.Reservations {
+		mac, ok := leases[reservation.IPAddress]
+		if ok && util.NormalizeMAC(mac) != util.NormalizeMAC(reservation.MACAddress) {
+			return fmt.Errorf("reserved ip %s is already leased to mac %s", reservation.IPAddress, mac)
+		}
 	}
 
 	return nil
 }
 
-func (v *Validator) checkVmNetCfgs(ipPool *networkv1.IPPool) error {
+// checkLeases checks whether the IPPool does NOT lease any IP address anymore.
+// The excluded and reserved IP addresses do not count. The leases are
+// attributed to the VirtualMachineNetworkConfigs listing their MAC addresses,
+// or to the MAC addresses themselves if none does anymore.
+func (v *Validator) checkLeases(ipPool *networkv1.IPPool) error {
+	leases := util.Leases(ipPool.Status.IPv4)
+	for ip, macAddress := range util.IPv6Leases(ipPool.Status.IPv6) {
+		leases[ip] = macAddress
+	}
+	if len(leases) == 0 {
+		return nil
+	}
+
 	vmnetcfgGetter := util.VmnetcfgGetter{
 		VmnetcfgCache: v.vmnetcfgCache,
 	}
-	vmNetCfgs, err := vmnetcfgGetter.WhoUseIPPool(ipPool)
+	holders := make(map[string]struct{}, len(leases))
+	for _, macAddress := range leases {
+		vmNetCfgs, err := vmnetcfgGetter.WhoHasMAC(macAddress)
+		if err != nil {
+			return err
+		}
+		if len(vmNetCfgs) == 0 {
+			holders["mac "+util.NormalizeMAC(macAddress)] = struct{}{}
+			continue
+		}
+		for _, vmNetCfg := range vmNetCfgs {
+			holders[vmNetCfg.Namespace+"/"+vmNetCfg.Name] = struct{}{}
+		}
+	}
+
+	return fmt.Errorf("it still has %d outstanding lease(s) held by %s, which must be released at first", len(leases), listHolders(holders))
+}
+
+// listHolders lists the first maxListedHolders holders in order, summing up
+// the rest.
+func listHolders(holders map[string]struct{}) string {
+	names := make([]string, 0, len(holders))
+	for name := range holders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) <= maxListedHolders {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(names[:maxListedHolders], ", "), len(names)-maxListedHolders)
+}
+
+// checkVmNetCfgs checks whether no VirtualMachineNetworkConfig on the network
+// of the IPPool still waits for an IP address from it. The ones holding one
+// are already covered by checkLeases, while the pending ones would be stuck
+// without an IPPool. The ones being deleted don't count.
+func (v *Validator) checkVmNetCfgs(ipPool *networkv1.IPPool) error {
+	vmNetCfgs, err := v.vmnetcfgCache.GetByIndex(indexer.VmNetCfgByQualifiedNetworkIndex, ipPool.Spec.NetworkName)
 	if err != nil {
 		return err
 	}
 
-	logrus.Infof("%d vmnetcfg(s) associated", len(vmNetCfgs))
-
-	if len(vmNetCfgs) > 0 {
-		vmNetCfgNames := make([]string, 0, len(vmNetCfgs))
-		for _, vmNetCfg := range vmNetCfgs {
-			vmNetCfgNames = append(vmNetCfgNames, vmNetCfg.Namespace+"/"+vmNetCfg.Name)
+	vmNetCfgNames := make(map[string]struct{}, len(vmNetCfgs))
+	for _, vmNetCfg := range vmNetCfgs {
+		if vmNetCfg.DeletionTimestamp != nil || !isPendingOnNetwork(vmNetCfg, ipPool.Spec.NetworkName) {
+			continue
 		}
-		return fmt.Errorf("it's still used by VirtualMachineNetworkConfig(s) %s, which must be removed at first", strings.Join(vmNetCfgNames, ", "))
+		vmNetCfgNames[vmNetCfg.Namespace+"/"+vmNetCfg.Name] = struct{}{}
+	}
+
+	logrus.Infof("%d pending vmnetcfg(s) associated", len(vmNetCfgNames))
+
+	if len(vmNetCfgNames) > 0 {
+		return fmt.Errorf("it's still awaited by pending VirtualMachineNetworkConfig(s) %s, which must be removed at first", listHolders(vmNetCfgNames))
 	}
 	return nil
 }
+
+// isPendingOnNetwork reports whether a network config of the
+// VirtualMachineNetworkConfig on the network has no IP address allocated yet.
+// Networks given without a namespace are taken for any namespace, as they
+// may resolve to the global one.
+func isPendingOnNetwork(vmNetCfg *networkv1.VirtualMachineNetworkConfig, networkName string) bool {
+	_, nadName := kv.RSplit(networkName, "/")
+
+	allocated := make(map[string]struct{}, len(vmNetCfg.Status.NetworkConfigs))
+	for _, ncStatus := range vmNetCfg.Status.NetworkConfigs {
+		if ncStatus.AllocatedIPAddress != "" {
+			allocated[util.NormalizeMAC(ncStatus.MACAddress)] = struct{}{}
+		}
+	}
+
+	for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+		if nc.NetworkName != networkName && nc.NetworkName != nadName {
+			continue
+		}
+		if _, ok := allocated[util.NormalizeMAC(nc.MACAddress)]; !ok {
+			return true
+		}
+	}
+	return false
+}
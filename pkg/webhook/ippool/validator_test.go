@@ -6,15 +6,20 @@ import (
 
 	"github.com/harvester/webhook/pkg/server/admission"
 	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/rancher/wrangler/v3/pkg/webhook"
 	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
 	"github.com/harvester/vm-dhcp-controller/pkg/controller/ippool"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/vmnetcfg"
 	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
 	"github.com/harvester/vm-dhcp-controller/pkg/util"
 	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
 )
@@ -32,21 +37,56 @@ const (
 	testRouter              = "192.168.0.1"
 	testExcludedIP          = "192.168.0.100"
 	testNetworkName         = testNADNamespace + "/" + testNADName
+
+	testDelegatedIPPoolNamespace = "team-a"
+	testDelegatedIPPoolKey       = testDelegatedIPPoolNamespace + "/" + testIPPoolName
 )
 
 func newTestIPPoolBuilder() *ippool.IPPoolBuilder {
 	return ippool.NewIPPoolBuilder(testIPPoolNamespace, testIPPoolName)
 }
 
+// newTestDelegatingIPPoolBuilder returns the builder of an IPPool delegating
+// part of its subnet to the given IPPools.
+func newTestDelegatingIPPoolBuilder(delegatedPools string) *ippool.IPPoolBuilder {
+	return newTestIPPoolBuilder().
+		Annotation(util.DelegatedPoolsAnnotationKey, delegatedPools).
+		CIDR(testCIDR).
+		ServerIP(testServerIPWithinRange).
+		PoolRange("192.168.0.10", "192.168.0.99").
+		NetworkName(testNetworkName)
+}
+
+// newTestDelegatedIPPoolBuilder returns the builder of an IPPool delegated by
+// the one of newTestDelegatingIPPoolBuilder.
+func newTestDelegatedIPPoolBuilder() *ippool.IPPoolBuilder {
+	return ippool.NewIPPoolBuilder(testDelegatedIPPoolNamespace, testIPPoolName).
+		Annotation(util.DelegatedFromAnnotationKey, testIPPoolNamespace+"/"+testIPPoolName).
+		CIDR(testCIDR).
+		ServerIP(testServerIPWithinRange).
+		NetworkName(testNetworkName)
+}
+
+// newTestOverflowIPPoolBuilder returns the builder of an IPPool the given
+// IPPool overflows into, in the same namespace and on the same network.
+func newTestOverflowIPPoolBuilder(name, overflowFrom string) *ippool.IPPoolBuilder {
+	return ippool.NewIPPoolBuilder(testIPPoolNamespace, name).
+		Annotation(util.DelegatedFromAnnotationKey, overflowFrom).
+		CIDR(testCIDR).
+		ServerIP(testServerIPWithinRange).
+		NetworkName(testNetworkName)
+}
+
 func newTestNetworkAttachmentDefinitionBuilder() *ippool.NetworkAttachmentDefinitionBuilder {
 	return ippool.NewNetworkAttachmentDefinitionBuilder(testNADNamespace, testNADName)
 }
 
 func TestValidator_Create(t *testing.T) {
 	type input struct {
-		ipPool *networkv1.IPPool
-		nad    *cniv1.NetworkAttachmentDefinition
-		node   *corev1.Node
+		ipPool  *networkv1.IPPool
+		ipPools []*networkv1.IPPool
+		nad     *cniv1.NetworkAttachmentDefinition
+		node    *corev1.Node
 	}
 
 	type output struct {
@@ -78,7 +118,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because server ip %s is not within subnet", testIPPoolNamespace, testIPPoolName, testServerIPOutOfRange),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.serverIP: Invalid value: \"%s\": must be within subnet %s", testIPPoolNamespace, testIPPoolName, testServerIPOutOfRange, testCIDR),
 			},
 		},
 		{
@@ -91,7 +131,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because server ip %s is the same as network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.128"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.serverIP: Invalid value: \"%s\": must not be the network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.128"),
 			},
 		},
 		{
@@ -104,7 +144,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because server ip %s is the same as broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.127"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.serverIP: Invalid value: \"%s\": must not be the broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.127"),
 			},
 		},
 		{
@@ -118,7 +158,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because server ip %s is the same as router ip", testIPPoolNamespace, testIPPoolName, "192.168.0.254"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.serverIP: Invalid value: \"%s\": must not be the router ip", testIPPoolNamespace, testIPPoolName, "192.168.0.254"),
 			},
 		},
 		{
@@ -131,7 +171,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because ParseAddr(\"%s\"): IPv4 field has value >255", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.router: Invalid value: \"%s\": must be a valid IPv4 address", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
 			},
 		},
 		{
@@ -144,7 +184,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because router ip %s is not within subnet", testIPPoolNamespace, testIPPoolName, "192.168.1.1"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.router: Invalid value: \"%s\": must be within subnet %s", testIPPoolNamespace, testIPPoolName, "192.168.1.1", testCIDR),
 			},
 		},
 		{
@@ -157,7 +197,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because router ip %s is the same as network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.router: Invalid value: \"%s\": must not be the network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
 			},
 		},
 		{
@@ -170,7 +210,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because router ip %s is the same as broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.router: Invalid value: \"%s\": must not be the broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
 			},
 		},
 		{
@@ -183,7 +223,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because ParseAddr(\"%s\"): IPv4 field has value >255", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.pool.start: Invalid value: \"%s\": must be a valid IPv4 address", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
 			},
 		},
 		{
@@ -196,7 +236,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because start ip %s is not within subnet", testIPPoolNamespace, testIPPoolName, "192.168.1.100"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.pool.start: Invalid value: \"%s\": must be within subnet %s", testIPPoolNamespace, testIPPoolName, "192.168.1.100", testCIDR),
 			},
 		},
 		{
@@ -209,7 +249,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because start ip %s is the same as network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.pool.start: Invalid value: \"%s\": must not be the network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
 			},
 		},
 		{
@@ -222,7 +262,18 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because start ip %s is the same as broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.pool.start: Invalid value: \"%s\": must not be the broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+			},
+		},
+		{
+			name: "pool range with network and broadcast ip allowed",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					CIDR("192.168.0.0/24").
+					PoolRange("192.168.0.0", "192.168.0.255").
+					AllowNetworkBroadcast().
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 		},
 		{
@@ -235,7 +286,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because ParseAddr(\"%s\"): IPv4 field has value >255", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.pool.end: Invalid value: \"%s\": must be a valid IPv4 address", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
 			},
 		},
 		{
@@ -248,7 +299,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because end ip %s is not within subnet", testIPPoolNamespace, testIPPoolName, "192.168.1.100"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.pool.end: Invalid value: \"%s\": must be within subnet %s", testIPPoolNamespace, testIPPoolName, "192.168.1.100", testCIDR),
 			},
 		},
 		{
@@ -261,7 +312,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because end ip %s is the same as network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.pool.end: Invalid value: \"%s\": must not be the network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
 			},
 		},
 		{
@@ -274,7 +325,7 @@ func TestValidator_Create(t *testing.T) {
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot create IPPool %s/%s because end ip %s is the same as broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.pool.end: Invalid value: \"%s\": must not be the broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
 			},
 		},
 		{
@@ -332,379 +383,945 @@ func TestValidator_Create(t *testing.T) {
 				err: fmt.Errorf("cannot create IPPool %s/%s because cidr %s overlaps cluster service cidr %s", testIPPoolNamespace, testIPPoolName, testCIDROverlap, testServiceCIDR),
 			},
 		},
-	}
-
-	nadGVR := schema.GroupVersionResource{
-		Group:    "k8s.cni.cncf.io",
-		Version:  "v1",
-		Resource: "network-attachment-definitions",
-	}
-
-	for _, tc := range testCases {
-		clientset := fake.NewSimpleClientset()
-		err := clientset.Tracker().Create(nadGVR, tc.given.nad, tc.given.nad.Namespace)
-		assert.Nil(t, err, "mock resource should add into fake controller tracker")
-
-		k8sclientset := k8sfake.NewSimpleClientset()
-		if tc.given.node != nil {
-			err := k8sclientset.Tracker().Add(tc.given.node)
-			assert.Nil(t, err, "mock resource should add into fake controller tracker")
-		}
-
-		nadCache := fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions)
-		vmnetCache := fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)
-		validator := NewValidator(testServiceCIDR, nadCache, vmnetCache)
-
-		err = validator.Create(&admission.Request{}, tc.given.ipPool)
-
-		if tc.expected.err != nil {
-			assert.Equal(t, tc.expected.err.Error(), err.Error(), tc.name)
-		} else {
-			assert.Nil(t, err, tc.name)
-		}
-	}
-}
-
-func TestValidator_Update(t *testing.T) {
-	type input struct {
-		oldIPPool *networkv1.IPPool
-		newIPPool *networkv1.IPPool
-		nad       *cniv1.NetworkAttachmentDefinition
-		node      *corev1.Node
-	}
-
-	type output struct {
-		err error
-	}
-
-	testCases := []struct {
-		name     string
-		given    input
-		expected output
-	}{
 		{
-			name: "valid server ip",
+			name: "pool range overlaps another ippool",
 			given: input{
-				oldIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					ServerIP("192.168.0.2").
-					NetworkName(testNetworkName).Build(),
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					ServerIP("192.168.0.254").
+					PoolRange("192.168.0.100", "192.168.0.200").
 					NetworkName(testNetworkName).Build(),
+				ipPools: []*networkv1.IPPool{
+					ippool.NewIPPoolBuilder(testIPPoolNamespace, "net-2").
+						CIDR(testCIDR).
+						PoolRange("192.168.0.150", "192.168.0.250").
+						NetworkName(testNetworkName).Build(),
+				},
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
+			expected: output{
+				err: fmt.Errorf("cannot create IPPool %s/%s because pool range overlaps ippool %s/%s", testIPPoolNamespace, testIPPoolName, testIPPoolNamespace, "net-2"),
+			},
 		},
 		{
-			name: "invalid server ip which is out of range",
+			name: "pool range overlaps another ippool without explicit range",
 			given: input{
-				oldIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					ServerIP("192.168.0.2").
-					NetworkName(testNetworkName).Build(),
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					ServerIP("192.168.100.2").
+					PoolRange("192.168.0.100", "192.168.0.200").
 					NetworkName(testNetworkName).Build(),
+				ipPools: []*networkv1.IPPool{
+					ippool.NewIPPoolBuilder(testIPPoolNamespace, "net-2").
+						CIDR("192.168.0.128/25").
+						NetworkName(testNetworkName).Build(),
+				},
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because server ip %s is not within subnet", testIPPoolNamespace, testIPPoolName, testServerIPOutOfRange),
+				err: fmt.Errorf("cannot create IPPool %s/%s because pool range overlaps ippool %s/%s", testIPPoolNamespace, testIPPoolName, testIPPoolNamespace, "net-2"),
 			},
 		},
 		{
-			name: "invalid server ip which is the same as network ip",
+			name: "cidr overlaps an ippool of another network",
 			given: input{
-				oldIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					ServerIP("192.168.0.2").
-					NetworkName(testNetworkName).Build(),
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					ServerIP("192.168.0.0").
+					PoolRange("192.168.0.100", "192.168.0.149").
 					NetworkName(testNetworkName).Build(),
+				ipPools: []*networkv1.IPPool{
+					ippool.NewIPPoolBuilder(testIPPoolNamespace, "net-2").
+						CIDR("192.168.0.128/25").
+						PoolRange("192.168.0.150", "192.168.0.250").
+						NetworkName(testIPPoolNamespace + "/net-2").Build(),
+				},
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because server ip %s is the same as network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because cidr %s overlaps cidr 192.168.0.128/25 of ippool %s/net-2 on network %s/net-2", testIPPoolNamespace, testIPPoolName, testCIDR, testIPPoolNamespace, testIPPoolNamespace),
 			},
 		},
 		{
-			name: "invalid server ip which is the same as broadcast ip",
+			name: "advertise service routes without service gateway",
 			given: input{
-				oldIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					ServerIP("192.168.0.2").
-					NetworkName(testNetworkName).Build(),
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					ServerIP("192.168.0.255").
-					NetworkName(testNetworkName).Build(),
+					NetworkName(testNetworkName).
+					AdvertiseServiceRoutes("").Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because server ip %s is the same as broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.serviceGateway: Required value: must be given when advertising service routes", testIPPoolNamespace, testIPPoolName),
 			},
 		},
 		{
-			name: "invalid server ip which is the same as router ip",
+			name: "advertise service routes with service gateway out of subnet",
 			given: input{
-				oldIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					ServerIP("192.168.0.2").
-					Router("192.168.0.254").
-					NetworkName(testNetworkName).Build(),
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					ServerIP("192.168.0.254").
-					Router("192.168.0.254").
-					NetworkName(testNetworkName).Build(),
+					NetworkName(testNetworkName).
+					AdvertiseServiceRoutes("192.168.100.1").Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because server ip %s is the same as router ip", testIPPoolNamespace, testIPPoolName, "192.168.0.254"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.serviceGateway: Invalid value: \"192.168.100.1\": must be within subnet 192.168.0.0/24", testIPPoolNamespace, testIPPoolName),
 			},
 		},
 		{
-			name: "invalid server ip which collides with other allocated ips",
+			name: "advertise service routes with service gateway",
 			given: input{
-
-				oldIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					ServerIP("192.168.0.2").
-					NetworkName(testNetworkName).
-					Allocated("192.168.0.100", "11:22:33:44:55:66").Build(),
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					ServerIP("192.168.0.100").
 					NetworkName(testNetworkName).
-					Allocated("192.168.0.100", "11:22:33:44:55:66").Build(),
+					AdvertiseServiceRoutes("192.168.0.254").Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
-			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because server ip %s is already occupied", testIPPoolNamespace, testIPPoolName, "192.168.0.100"),
+		},
+		{
+			name: "delegated ippool with disjoint range",
+			given: input{
+				ipPool: newTestDelegatedIPPoolBuilder().
+					PoolRange("192.168.0.100", "192.168.0.199").Build(),
+				ipPools: []*networkv1.IPPool{
+					newTestDelegatingIPPoolBuilder(testDelegatedIPPoolKey).Build(),
+				},
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 		},
 		{
-			name: "invalid router ip which is malformed",
+			name: "delegated ippool overlapping the delegating ippool",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					Router("192.168.0.1000").
-					NetworkName(testNetworkName).Build(),
+				ipPool: newTestDelegatedIPPoolBuilder().
+					PoolRange("192.168.0.50", "192.168.0.199").Build(),
+				ipPools: []*networkv1.IPPool{
+					newTestDelegatingIPPoolBuilder(testDelegatedIPPoolKey).Build(),
+				},
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because ParseAddr(\"%s\"): IPv4 field has value >255", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
+				err: fmt.Errorf("cannot create IPPool %s because pool range overlaps ippool %s/%s", testDelegatedIPPoolKey, testIPPoolNamespace, testIPPoolName),
 			},
 		},
 		{
-			name: "invalid router ip which is out of subnet",
+			name: "delegated ippool in the namespace of the delegating ippool",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: ippool.NewIPPoolBuilder(testIPPoolNamespace, "net-1-team").
+					Annotation(util.DelegatedFromAnnotationKey, testIPPoolNamespace+"/"+testIPPoolName).
 					CIDR(testCIDR).
-					Router("192.168.1.1").
+					ServerIP(testServerIPWithinRange).
+					PoolRange("192.168.0.100", "192.168.0.199").
 					NetworkName(testNetworkName).Build(),
+				ipPools: []*networkv1.IPPool{
+					newTestDelegatingIPPoolBuilder(testIPPoolNamespace + "/net-1-team").Build(),
+				},
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
-			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because router ip %s is not within subnet", testIPPoolNamespace, testIPPoolName, "192.168.1.1"),
-			},
 		},
 		{
-			name: "invalid router ip which is the same as network ip",
+			name: "delegated ippool not listed by the delegating ippool",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					Router("192.168.0.0").
-					NetworkName(testNetworkName).Build(),
+				ipPool: newTestDelegatedIPPoolBuilder().
+					PoolRange("192.168.0.100", "192.168.0.199").Build(),
+				ipPools: []*networkv1.IPPool{
+					newTestDelegatingIPPoolBuilder("other/net-1").Build(),
+				},
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because router ip %s is the same as network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
+				err: fmt.Errorf("cannot create IPPool %s because delegating ippool %s does not list it as delegated ippool", testDelegatedIPPoolKey, testNetworkName),
 			},
 		},
 		{
-			name: "invalid router ip which is the same as broadcast ip",
+			name: "delegated ippool without the delegating ippool",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					Router("192.168.0.255").
-					NetworkName(testNetworkName).Build(),
+				ipPool: newTestDelegatedIPPoolBuilder().
+					PoolRange("192.168.0.100", "192.168.0.199").Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because router ip %s is the same as broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+				err: fmt.Errorf("cannot create IPPool %s because delegating ippool %s not found", testDelegatedIPPoolKey, testNetworkName),
 			},
 		},
 		{
-			name: "invalid start ip which is malformed",
+			name: "delegated ippool with another cidr",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					PoolRange("192.168.0.1000", "").
+				ipPool: ippool.NewIPPoolBuilder(testDelegatedIPPoolNamespace, testIPPoolName).
+					Annotation(util.DelegatedFromAnnotationKey, testIPPoolNamespace+"/"+testIPPoolName).
+					CIDR("192.168.1.0/24").
+					ServerIP("192.168.1.2").
+					PoolRange("192.168.1.100", "192.168.1.199").
 					NetworkName(testNetworkName).Build(),
+				ipPools: []*networkv1.IPPool{
+					newTestDelegatingIPPoolBuilder(testDelegatedIPPoolKey).Build(),
+				},
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because ParseAddr(\"%s\"): IPv4 field has value >255", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
+				err: fmt.Errorf("cannot create IPPool %s because cidr 192.168.1.0/24 differs from cidr %s of delegating ippool %s", testDelegatedIPPoolKey, testCIDR, testNetworkName),
 			},
 		},
 		{
-			name: "invalid start ip which is out of subnet",
+			name: "delegating ippool with two delegated ippools in the same namespace",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					PoolRange("192.168.1.100", "").
-					NetworkName(testNetworkName).Build(),
-				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+				ipPool: newTestDelegatingIPPoolBuilder(testDelegatedIPPoolKey + "," + testDelegatedIPPoolNamespace + "/net-2").Build(),
+				nad:    newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because start ip %s is not within subnet", testIPPoolNamespace, testIPPoolName, "192.168.1.100"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because delegated ippools %s and %s/net-2 are in the same namespace", testIPPoolNamespace, testIPPoolName, testDelegatedIPPoolKey, testDelegatedIPPoolNamespace),
 			},
 		},
 		{
-			name: "invalid start ip which is the same as network ip",
+			name: "overflow ippool at the end of a chain of three ippools",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					PoolRange("192.168.0.0", "").
-					NetworkName(testNetworkName).Build(),
+				ipPool: newTestOverflowIPPoolBuilder("net-1-overflow-2", testIPPoolNamespace+"/net-1-overflow-1").
+					PoolRange("192.168.0.150", "192.168.0.199").Build(),
+				ipPools: []*networkv1.IPPool{
+					newTestIPPoolBuilder().
+						CIDR(testCIDR).
+						ServerIP(testServerIPWithinRange).
+						PoolRange("192.168.0.10", "192.168.0.99").
+						NetworkName(testNetworkName).
+						OverflowPool(testIPPoolNamespace + "/net-1-overflow-1").Build(),
+					newTestOverflowIPPoolBuilder("net-1-overflow-1", testNetworkName).
+						PoolRange("192.168.0.100", "192.168.0.149").
+						OverflowPool(testIPPoolNamespace + "/net-1-overflow-2").Build(),
+				},
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
-			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because start ip %s is the same as network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
-			},
 		},
 		{
-			name: "invalid start ip which is the same as broadcast ip",
+			name: "overflow chain looping back",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDR).
-					PoolRange("192.168.0.255", "").
-					NetworkName(testNetworkName).Build(),
+				ipPool: newTestOverflowIPPoolBuilder("net-1-overflow-2", testIPPoolNamespace+"/net-1-overflow-1").
+					PoolRange("192.168.0.150", "192.168.0.199").
+					OverflowPool(testNetworkName).Build(),
+				ipPools: []*networkv1.IPPool{
+					newTestIPPoolBuilder().
+						CIDR(testCIDR).
+						ServerIP(testServerIPWithinRange).
+						PoolRange("192.168.0.10", "192.168.0.99").
+						NetworkName(testNetworkName).
+						OverflowPool(testIPPoolNamespace + "/net-1-overflow-1").Build(),
+					newTestOverflowIPPoolBuilder("net-1-overflow-1", testNetworkName).
+						PoolRange("192.168.0.100", "192.168.0.149").
+						OverflowPool(testIPPoolNamespace + "/net-1-overflow-2").Build(),
+				},
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because start ip %s is the same as broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+				err: fmt.Errorf("cannot create IPPool %s/net-1-overflow-2 because overflow chain loops back to ippool %s/net-1-overflow-2", testIPPoolNamespace, testIPPoolNamespace),
 			},
 		},
 		{
-			name: "invalid end ip which is malformed",
+			name: "ippool overflowing into itself",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					PoolRange("", "192.168.0.1000").
-					NetworkName(testNetworkName).Build(),
+					NetworkName(testNetworkName).
+					OverflowPool(testNetworkName).Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because ParseAddr(\"%s\"): IPv4 field has value >255", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because overflow ippool %s is the ippool itself", testIPPoolNamespace, testIPPoolName, testNetworkName),
 			},
 		},
 		{
-			name: "invalid end ip which is out of subnet",
+			name: "ippool overflowing into an ippool on another network",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					PoolRange("", "192.168.1.100").
-					NetworkName(testNetworkName).Build(),
+					ServerIP(testServerIPWithinRange).
+					PoolRange("192.168.0.10", "192.168.0.99").
+					NetworkName(testNetworkName).
+					OverflowPool(testIPPoolNamespace + "/net-2").Build(),
+				ipPools: []*networkv1.IPPool{
+					ippool.NewIPPoolBuilder(testIPPoolNamespace, "net-2").
+						CIDR("192.168.1.0/24").
+						NetworkName(testIPPoolNamespace + "/net-2").Build(),
+				},
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because end ip %s is not within subnet", testIPPoolNamespace, testIPPoolName, "192.168.1.100"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because network %s/net-2 of overflow ippool %s/net-2 differs from network %s", testIPPoolNamespace, testIPPoolName, testIPPoolNamespace, testIPPoolNamespace, testNetworkName),
 			},
 		},
 		{
-			name: "invalid emd ip which is the same as network ip",
+			name: "allow bootp with lease time",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					PoolRange("", "192.168.0.0").
-					NetworkName(testNetworkName).Build(),
+					NetworkName(testNetworkName).
+					LeaseTime(86400).
+					AllowBOOTP().Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
-			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because end ip %s is the same as network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
-			},
 		},
 		{
-			name: "invalid end ip which is the same as broadcast ip",
+			name: "allow bootp with infinite lease time",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					PoolRange("", "192.168.0.255").
-					NetworkName(testNetworkName).Build(),
+					NetworkName(testNetworkName).
+					LeaseTime(4294967295).
+					AllowBOOTP().Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because end ip %s is the same as broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.leaseTime: Invalid value: 4294967295: must be within 0 and 4294967294 when allowing BOOTP", testIPPoolNamespace, testIPPoolName),
 			},
 		},
 		{
-			name: "non-existed network name",
+			name: "allow bootp with negative lease time",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
+				ipPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					NetworkName("nonexist").Build(),
+					NetworkName(testNetworkName).
+					LeaseTime(-1).
+					AllowBOOTP().Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool default/net-1 because network-attachment-definitions.k8s.cni.cncf.io \"%s\" not found", "nonexist"),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.leaseTime: Invalid value: -1: must be within 0 and 4294967294 when allowing BOOTP", testIPPoolNamespace, testIPPoolName),
 			},
 		},
 		{
-			name: "cidr overlaps cluster's service cidr (retrieved from the node-args annotation)",
+			name: "subnet mask override wider than the cidr",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDROverlap).
+				ipPool: newTestIPPoolBuilder().
+					CIDR("192.168.0.0/24").
+					ServerIP("192.168.0.2").
+					Router("192.168.0.1").
+					SubnetMaskOverride("255.255.0.0").
 					NetworkName(testNetworkName).Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
-				node: &corev1.Node{
-					ObjectMeta: metav1.ObjectMeta{
-						Annotations: map[string]string{
-							util.NodeArgsAnnotationKey: fmt.Sprintf("[\"%s\", \"%s\"]", util.ServiceCIDRFlag, testServiceCIDR),
-						},
-						Labels: map[string]string{
-							util.ManagementNodeLabelKey: "true",
-						},
-						Name: "node-0",
-					},
-				},
 			},
-			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because cidr %s overlaps cluster service cidr %s", testIPPoolNamespace, testIPPoolName, testCIDROverlap, testServiceCIDR),
+		},
+		{
+			name: "subnet mask override narrower than the cidr holding the pool range",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					CIDR("192.168.0.0/24").
+					ServerIP("192.168.0.129").
+					PoolRange("192.168.0.130", "192.168.0.200").
+					SubnetMaskOverride("255.255.255.128").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 		},
 		{
-			name: "cidr overlaps cluster's service cidr (default service cidr)",
+			name: "subnet mask override narrower than the cidr leaving the router out",
 			given: input{
-				newIPPool: newTestIPPoolBuilder().
-					CIDR(testCIDROverlap).
+				ipPool: newTestIPPoolBuilder().
+					CIDR("192.168.0.0/24").
+					ServerIP("192.168.0.129").
+					Router("192.168.0.1").
+					PoolRange("192.168.0.130", "192.168.0.200").
+					SubnetMaskOverride("255.255.255.128").
 					NetworkName(testNetworkName).Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
-				node: &corev1.Node{
-					ObjectMeta: metav1.ObjectMeta{
-						Labels: map[string]string{
-							util.ManagementNodeLabelKey: "true",
-						},
-						Name: "node-0",
-					},
-				},
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because cidr %s overlaps cluster service cidr %s", testIPPoolNamespace, testIPPoolName, testCIDROverlap, testServiceCIDR),
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.subnetMaskOverride: Invalid value: \"255.255.255.128\": leaves 192.168.0.1 out of subnet 192.168.0.128/25", testIPPoolNamespace, testIPPoolName),
 			},
 		},
 		{
-			name: "server ip collides with excluded ip",
+			name: "subnet mask override which is not contiguous",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					CIDR("192.168.0.0/24").
+					SubnetMaskOverride("255.0.255.0").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.subnetMaskOverride: Invalid value: \"255.0.255.0\": must be contiguous", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "subnet mask override leaving no room for hosts",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					CIDR("192.168.0.0/24").
+					SubnetMaskOverride("255.255.255.255").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.subnetMaskOverride: Invalid value: \"255.255.255.255\": must be within /1 and /30", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "pool range adjacent to another ippool",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolRange("192.168.0.100", "192.168.0.149").
+					NetworkName(testNetworkName).Build(),
+				ipPools: []*networkv1.IPPool{
+					ippool.NewIPPoolBuilder(testIPPoolNamespace, "net-2").
+						CIDR(testCIDR).
+						PoolRange("192.168.0.150", "192.168.0.250").
+						NetworkName(testNetworkName).Build(),
+				},
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+		},
+		{
+			name: "pool range sized by count adjacent to another ippool",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolCount("192.168.0.100", 50).
+					NetworkName(testNetworkName).Build(),
+				ipPools: []*networkv1.IPPool{
+					ippool.NewIPPoolBuilder(testIPPoolNamespace, "net-2").
+						CIDR(testCIDR).
+						PoolRange("192.168.0.150", "192.168.0.250").
+						NetworkName(testNetworkName).Build(),
+				},
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+		},
+		{
+			name: "pool range sized by count overlapping another ippool",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolCount("192.168.0.100", 51).
+					NetworkName(testNetworkName).Build(),
+				ipPools: []*networkv1.IPPool{
+					ippool.NewIPPoolBuilder(testIPPoolNamespace, "net-2").
+						CIDR(testCIDR).
+						PoolRange("192.168.0.150", "192.168.0.250").
+						NetworkName(testNetworkName).Build(),
+				},
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot create IPPool %s/%s because pool range overlaps ippool %s/%s", testIPPoolNamespace, testIPPoolName, testIPPoolNamespace, "net-2"),
+			},
+		},
+		{
+			name: "pool range with both end and count",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolRange("192.168.0.100", "192.168.0.149").
+					PoolCount("192.168.0.100", 50).
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.ipv4Config.pool.count: Invalid value: 50: is ambiguous with end 192.168.0.149; set only one of them", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "pool range larger than the maximum pool size",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					ServerIP("172.16.0.2").
+					CIDR("172.16.0.0/12").
+					PoolRange("172.16.0.1", "172.31.255.254").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot create IPPool %s/%s because pool range has 1048574 allocatable addresses, more than the maximum of 65536; narrow the range or raise the limit with --max-pool-size", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "small pool range of a huge cidr",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					ServerIP("172.16.0.2").
+					CIDR("172.16.0.0/12").
+					PoolRange("172.16.0.10", "172.16.0.99").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+		},
+		{
+			name: "relay gateways",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					ServerIP("192.168.0.2").
+					CIDR("192.168.0.0/24").
+					RelayGateway("10.0.1.1", "10.0.2.1").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+		},
+		{
+			name: "invalid relay gateway",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					ServerIP("192.168.0.2").
+					CIDR("192.168.0.0/24").
+					RelayGateway("10.0.1").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.relayGateways[0]: Invalid value: \"10.0.1\": must be a valid IPv4 address", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "relay gateway listed twice",
+			given: input{
+				ipPool: newTestIPPoolBuilder().
+					ServerIP("192.168.0.2").
+					CIDR("192.168.0.0/24").
+					RelayGateway("10.0.1.1", "10.0.1.1").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot create IPPool %s/%s because spec.relayGateways[1]: Duplicate value: \"10.0.1.1\"", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+	}
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	for _, tc := range testCases {
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, tc.given.nad, tc.given.nad.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		k8sclientset := k8sfake.NewSimpleClientset()
+		if tc.given.node != nil {
+			err := k8sclientset.Tracker().Add(tc.given.node)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		}
+
+		for _, ipPool := range tc.given.ipPools {
+			err := clientset.Tracker().Add(ipPool)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		}
+
+		nadCache := fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions)
+		ippoolCache := fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools)
+		vmnetCache := indexedVmNetCfgCache{fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)}
+		validator := NewValidator(testServiceCIDR, util.DefaultMaxPoolSize, nadCache, ippoolCache, vmnetCache)
+
+		err = validator.Create(&admission.Request{}, tc.given.ipPool)
+
+		if tc.expected.err != nil {
+			assert.Equal(t, tc.expected.err.Error(), err.Error(), tc.name)
+		} else {
+			assert.Nil(t, err, tc.name)
+		}
+	}
+}
+
+func TestValidator_Update(t *testing.T) {
+	type input struct {
+		oldIPPool *networkv1.IPPool
+		newIPPool *networkv1.IPPool
+		ipPools   []*networkv1.IPPool
+		nad       *cniv1.NetworkAttachmentDefinition
+		node      *corev1.Node
+	}
+
+	type output struct {
+		err error
+	}
+
+	testCases := []struct {
+		name     string
+		given    input
+		expected output
+	}{
+		{
+			name: "valid server ip",
+			given: input{
+				oldIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.2").
+					NetworkName(testNetworkName).Build(),
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.254").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+		},
+		{
+			name: "invalid server ip which is out of range",
+			given: input{
+				oldIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.2").
+					NetworkName(testNetworkName).Build(),
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.100.2").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.serverIP: Invalid value: \"%s\": must be within subnet %s", testIPPoolNamespace, testIPPoolName, testServerIPOutOfRange, testCIDR),
+			},
+		},
+		{
+			name: "invalid server ip which is the same as network ip",
+			given: input{
+				oldIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.2").
+					NetworkName(testNetworkName).Build(),
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.0").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.serverIP: Invalid value: \"%s\": must not be the network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
+			},
+		},
+		{
+			name: "invalid server ip which is the same as broadcast ip",
+			given: input{
+				oldIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.2").
+					NetworkName(testNetworkName).Build(),
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.255").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.serverIP: Invalid value: \"%s\": must not be the broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+			},
+		},
+		{
+			name: "invalid server ip which is the same as router ip",
+			given: input{
+				oldIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.2").
+					Router("192.168.0.254").
+					NetworkName(testNetworkName).Build(),
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.254").
+					Router("192.168.0.254").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.serverIP: Invalid value: \"%s\": must not be the router ip", testIPPoolNamespace, testIPPoolName, "192.168.0.254"),
+			},
+		},
+		{
+			name: "invalid server ip which collides with other allocated ips",
+			given: input{
+
+				oldIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.2").
+					NetworkName(testNetworkName).
+					Allocated("192.168.0.100", "11:22:33:44:55:66").Build(),
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.100").
+					NetworkName(testNetworkName).
+					Allocated("192.168.0.100", "11:22:33:44:55:66").Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because server ip %s is already occupied", testIPPoolNamespace, testIPPoolName, "192.168.0.100"),
+			},
+		},
+		{
+			name: "invalid router ip which is malformed",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					Router("192.168.0.1000").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.router: Invalid value: \"%s\": must be a valid IPv4 address", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
+			},
+		},
+		{
+			name: "invalid router ip which is out of subnet",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					Router("192.168.1.1").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.router: Invalid value: \"%s\": must be within subnet %s", testIPPoolNamespace, testIPPoolName, "192.168.1.1", testCIDR),
+			},
+		},
+		{
+			name: "invalid router ip which is the same as network ip",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					Router("192.168.0.0").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.router: Invalid value: \"%s\": must not be the network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
+			},
+		},
+		{
+			name: "invalid router ip which is the same as broadcast ip",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					Router("192.168.0.255").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.router: Invalid value: \"%s\": must not be the broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+			},
+		},
+		{
+			name: "invalid start ip which is malformed",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolRange("192.168.0.1000", "").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.pool.start: Invalid value: \"%s\": must be a valid IPv4 address", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
+			},
+		},
+		{
+			name: "invalid start ip which is out of subnet",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolRange("192.168.1.100", "").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.pool.start: Invalid value: \"%s\": must be within subnet %s", testIPPoolNamespace, testIPPoolName, "192.168.1.100", testCIDR),
+			},
+		},
+		{
+			name: "invalid start ip which is the same as network ip",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolRange("192.168.0.0", "").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.pool.start: Invalid value: \"%s\": must not be the network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
+			},
+		},
+		{
+			name: "invalid start ip which is the same as broadcast ip",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolRange("192.168.0.255", "").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.pool.start: Invalid value: \"%s\": must not be the broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+			},
+		},
+		{
+			name: "invalid end ip which is malformed",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolRange("", "192.168.0.1000").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.pool.end: Invalid value: \"%s\": must be a valid IPv4 address", testIPPoolNamespace, testIPPoolName, "192.168.0.1000"),
+			},
+		},
+		{
+			name: "invalid end ip which is out of subnet",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolRange("", "192.168.1.100").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.pool.end: Invalid value: \"%s\": must be within subnet %s", testIPPoolNamespace, testIPPoolName, "192.168.1.100", testCIDR),
+			},
+		},
+		{
+			name: "invalid emd ip which is the same as network ip",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolRange("", "192.168.0.0").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.pool.end: Invalid value: \"%s\": must not be the network ip", testIPPoolNamespace, testIPPoolName, "192.168.0.0"),
+			},
+		},
+		{
+			name: "invalid end ip which is the same as broadcast ip",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					PoolRange("", "192.168.0.255").
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.ipv4Config.pool.end: Invalid value: \"%s\": must not be the broadcast ip", testIPPoolNamespace, testIPPoolName, "192.168.0.255"),
+			},
+		},
+		{
+			name: "non-existed network name",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					NetworkName("nonexist").Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool default/net-1 because network-attachment-definitions.k8s.cni.cncf.io \"%s\" not found", "nonexist"),
+			},
+		},
+		{
+			name: "cidr overlaps cluster's service cidr (retrieved from the node-args annotation)",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDROverlap).
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+				node: &corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							util.NodeArgsAnnotationKey: fmt.Sprintf("[\"%s\", \"%s\"]", util.ServiceCIDRFlag, testServiceCIDR),
+						},
+						Labels: map[string]string{
+							util.ManagementNodeLabelKey: "true",
+						},
+						Name: "node-0",
+					},
+				},
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because cidr %s overlaps cluster service cidr %s", testIPPoolNamespace, testIPPoolName, testCIDROverlap, testServiceCIDR),
+			},
+		},
+		{
+			name: "cidr overlaps cluster's service cidr (default service cidr)",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDROverlap).
+					NetworkName(testNetworkName).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+				node: &corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Labels: map[string]string{
+							util.ManagementNodeLabelKey: "true",
+						},
+						Name: "node-0",
+					},
+				},
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because cidr %s overlaps cluster service cidr %s", testIPPoolNamespace, testIPPoolName, testCIDROverlap, testServiceCIDR),
+			},
+		},
+		{
+			name: "server ip collides with excluded ip",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testExcludedIP).
+					NetworkName(testNetworkName).
+					Allocated(testExcludedIP, util.ExcludedMark).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because server ip %s is already occupied", testIPPoolNamespace, testIPPoolName, testExcludedIP),
+			},
+		},
+		{
+			name: "server ip within the pool range",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testServerIPWithinRange).
+					NetworkName(testNetworkName).
+					Allocated(testServerIPWithinRange, util.ReservedMark).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+		},
+		{
+			name: "server ip collides with excluded ip",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testExcludedIP).
+					NetworkName(testNetworkName).
+					Allocated(testExcludedIP, util.ExcludedMark).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because server ip %s is already occupied", testIPPoolNamespace, testIPPoolName, testExcludedIP),
+			},
+		},
+		{
+			name: "server ip within the pool range",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testServerIPWithinRange).
+					NetworkName(testNetworkName).
+					Allocated(testServerIPWithinRange, util.ReservedMark).Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+		},
+
+		{
+			name: "status mixing legacy allocated records with typed entries",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					NetworkName(testNetworkName).
+					Allocated("192.168.0.100", "11:22:33:44:55:66").
+					AllocationEntry("192.168.0.101", networkv1.AllocationTypeLease, "66:55:44:33:22:11").Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because status mixes legacy allocated records with typed entries", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "server ip collides with typed excluded entry",
 			given: input{
 				newIPPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
 					ServerIP(testExcludedIP).
 					NetworkName(testNetworkName).
-					Allocated(testExcludedIP, util.ExcludedMark).Build(),
+					AllocationEntry(testExcludedIP, networkv1.AllocationTypeExcluded, "").Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
@@ -712,40 +1329,198 @@ func TestValidator_Update(t *testing.T) {
 			},
 		},
 		{
-			name: "server ip within the pool range",
+			name: "known external hosts within subnet",
 			given: input{
 				newIPPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
 					ServerIP(testServerIPWithinRange).
+					Router(testRouter).
 					NetworkName(testNetworkName).
-					Allocated(testServerIPWithinRange, util.ReservedMark).Build(),
+					KnownExternalHost("192.168.0.50", "11:22:33:44:55:66", "printer").
+					KnownExternalHost("192.168.0.51", "", "").Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 		},
 		{
-			name: "server ip collides with excluded ip",
+			name: "known external host out of subnet",
 			given: input{
 				newIPPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
-					ServerIP(testExcludedIP).
+					ServerIP(testServerIPWithinRange).
 					NetworkName(testNetworkName).
-					Allocated(testExcludedIP, util.ExcludedMark).Build(),
+					KnownExternalHost("192.168.100.50", "", "").Build(),
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
 			expected: output{
-				err: fmt.Errorf("cannot update IPPool %s/%s because server ip %s is already occupied", testIPPoolNamespace, testIPPoolName, testExcludedIP),
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.knownExternalHosts[0].ip: Invalid value: \"192.168.100.50\": must be within subnet 192.168.0.0/24", testIPPoolNamespace, testIPPoolName),
 			},
 		},
 		{
-			name: "server ip within the pool range",
+			name: "known external host is the router",
 			given: input{
 				newIPPool: newTestIPPoolBuilder().
 					CIDR(testCIDR).
 					ServerIP(testServerIPWithinRange).
+					Router(testRouter).
 					NetworkName(testNetworkName).
-					Allocated(testServerIPWithinRange, util.ReservedMark).Build(),
+					KnownExternalHost(testRouter, "", "").Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.knownExternalHosts[0].ip: Invalid value: \"%s\": must not be the router ip", testIPPoolNamespace, testIPPoolName, testRouter),
+			},
+		},
+		{
+			name: "known external host listed twice",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testServerIPWithinRange).
+					NetworkName(testNetworkName).
+					KnownExternalHost("192.168.0.50", "", "printer").
+					KnownExternalHost("192.168.0.50", "", "scanner").Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.knownExternalHosts[1].ip: Duplicate value: \"192.168.0.50\"", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "known external host already allocated to a vm",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testServerIPWithinRange).
+					NetworkName(testNetworkName).
+					KnownExternalHost("192.168.0.50", "", "").
+					Allocated("192.168.0.50", "11:22:33:44:55:66").Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because known external host ip 192.168.0.50 is already allocated", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "reserved ip leased to another mac",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testServerIPWithinRange).
+					NetworkName(testNetworkName).
+					Reservation("aa:bb:cc:dd:ee:ff", "192.168.0.50").
+					Allocated("192.168.0.50", "11:22:33:44:55:66").Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because reserved ip 192.168.0.50 is already leased to mac 11:22:33:44:55:66", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "reserved ip leased to its mac",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testServerIPWithinRange).
+					NetworkName(testNetworkName).
+					Reservation("11-22-33-44-55-66", "192.168.0.50").
+					Allocated("192.168.0.50", "11:22:33:44:55:66").Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: nil,
+			},
+		},
+		{
+			name: "known external host with invalid mac",
+			given: input{
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testServerIPWithinRange).
+					NetworkName(testNetworkName).
+					KnownExternalHost("192.168.0.50", "not-a-mac", "").Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because spec.knownExternalHosts[0].mac: Invalid value: \"not-a-mac\": must be a valid MAC address", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "dhcp check asked for",
+			given: input{
+				oldIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testServerIPWithinRange).
+					NetworkName(testNetworkName).
+					DHCPCheck(networkv1.DHCPCheckSucceeded, "default-net-1-agent-dhcp-check", "", "").Build(),
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testServerIPWithinRange).
+					NetworkName(testNetworkName).
+					Annotation(util.RunDHCPCheckAnnotationKey, "true").
+					DHCPCheck(networkv1.DHCPCheckSucceeded, "default-net-1-agent-dhcp-check", "", "").Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+		},
+		{
+			name: "dhcp check asked for while one is running",
+			given: input{
+				oldIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testServerIPWithinRange).
+					NetworkName(testNetworkName).
+					DHCPCheck(networkv1.DHCPCheckRunning, "default-net-1-agent-dhcp-check", "", "").Build(),
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP(testServerIPWithinRange).
+					NetworkName(testNetworkName).
+					Annotation(util.RunDHCPCheckAnnotationKey, "true").
+					DHCPCheck(networkv1.DHCPCheckRunning, "default-net-1-agent-dhcp-check", "", "").Build(),
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because dhcp check default-net-1-agent-dhcp-check is still running", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "cidr updated in place next to an ippool of another network",
+			given: input{
+				oldIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.2").
+					NetworkName(testNetworkName).Build(),
+				newIPPool: newTestIPPoolBuilder().
+					CIDR("192.168.0.0/25").
+					ServerIP("192.168.0.2").
+					NetworkName(testNetworkName).Build(),
+				ipPools: []*networkv1.IPPool{
+					ippool.NewIPPoolBuilder(testIPPoolNamespace, "net-2").
+						CIDR("192.168.0.128/25").
+						NetworkName(testIPPoolNamespace + "/net-2").Build(),
+				},
+				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
+			},
+		},
+		{
+			name: "cidr updated to overlap an ippool of another network",
+			given: input{
+				oldIPPool: newTestIPPoolBuilder().
+					CIDR("192.168.0.0/25").
+					ServerIP("192.168.0.2").
+					NetworkName(testNetworkName).Build(),
+				newIPPool: newTestIPPoolBuilder().
+					CIDR(testCIDR).
+					ServerIP("192.168.0.2").
+					NetworkName(testNetworkName).Build(),
+				ipPools: []*networkv1.IPPool{
+					ippool.NewIPPoolBuilder(testIPPoolNamespace, "net-2").
+						CIDR("192.168.0.128/25").
+						NetworkName(testIPPoolNamespace + "/net-2").Build(),
+				},
 				nad: newTestNetworkAttachmentDefinitionBuilder().Build(),
 			},
+			expected: output{
+				err: fmt.Errorf("cannot update IPPool %s/%s because cidr %s overlaps cidr 192.168.0.128/25 of ippool %s/net-2 on network %s/net-2", testIPPoolNamespace, testIPPoolName, testCIDR, testIPPoolNamespace, testIPPoolNamespace),
+			},
 		},
 	}
 
@@ -766,9 +1541,20 @@ func TestValidator_Update(t *testing.T) {
 			assert.Nil(t, err, "mock resource should add into fake controller tracker")
 		}
 
+		if tc.given.oldIPPool != nil {
+			err := clientset.Tracker().Add(tc.given.oldIPPool)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		}
+
+		for _, ipPool := range tc.given.ipPools {
+			err := clientset.Tracker().Add(ipPool)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		}
+
 		nadCache := fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions)
-		vmnetCache := fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)
-		validator := NewValidator(testServiceCIDR, nadCache, vmnetCache)
+		ippoolCache := fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools)
+		vmnetCache := indexedVmNetCfgCache{fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)}
+		validator := NewValidator(testServiceCIDR, util.DefaultMaxPoolSize, nadCache, ippoolCache, vmnetCache)
 
 		err = validator.Update(&admission.Request{}, tc.given.oldIPPool, tc.given.newIPPool)
 
@@ -779,3 +1565,231 @@ func TestValidator_Update(t *testing.T) {
 		}
 	}
 }
+
+func TestValidator_UpdateStatus(t *testing.T) {
+	statusRequest := &admission.Request{
+		Request: &webhook.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{SubResource: "status"},
+		},
+	}
+
+	t.Run("status mixing legacy allocated records with typed entries", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			CIDR(testCIDR).
+			NetworkName(testNetworkName).
+			Allocated("192.168.0.100", "11:22:33:44:55:66").
+			AllocationEntry("192.168.0.101", networkv1.AllocationTypeLease, "66:55:44:33:22:11").Build()
+
+		clientset := fake.NewSimpleClientset()
+		validator := NewValidator(testServiceCIDR, util.DefaultMaxPoolSize,
+			fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			indexedVmNetCfgCache{fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)})
+
+		err := validator.Update(statusRequest, givenIPPool, givenIPPool)
+		assert.Equal(t, fmt.Sprintf("cannot update IPPool %s/%s because status mixes legacy allocated records with typed entries", testIPPoolNamespace, testIPPoolName), err.Error())
+	})
+
+	t.Run("status of ippool whose nad is gone", func(t *testing.T) {
+		givenIPPool := newTestIPPoolBuilder().
+			CIDR(testCIDR).
+			NetworkName(testNetworkName).
+			AllocationEntry("192.168.0.101", networkv1.AllocationTypeLease, "66:55:44:33:22:11").Build()
+
+		clientset := fake.NewSimpleClientset()
+		validator := NewValidator(testServiceCIDR, util.DefaultMaxPoolSize,
+			fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions),
+			fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools),
+			indexedVmNetCfgCache{fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)})
+
+		err := validator.Update(statusRequest, givenIPPool, givenIPPool)
+		assert.Nil(t, err, "status updates should only be checked for their format")
+	})
+}
+
+// indexedVmNetCfgCache serves the indexes the webhook adds to the vmnetcfg
+// cache.
+type indexedVmNetCfgCache struct {
+	fakeclient.VirtualMachineNetworkConfigCache
+}
+
+var testVmNetCfgIndexers = map[string]func(*networkv1.VirtualMachineNetworkConfig) ([]string, error){
+	indexer.VmNetCfgByNetworkIndex:          indexer.VmNetCfgByNetwork,
+	indexer.VmNetCfgByMACIndex:              util.VmNetCfgByMAC,
+	indexer.VmNetCfgByQualifiedNetworkIndex: util.VmNetCfgByQualifiedNetwork,
+}
+
+func (c indexedVmNetCfgCache) GetByIndex(indexName, key string) ([]*networkv1.VirtualMachineNetworkConfig, error) {
+	indexFunc, ok := testVmNetCfgIndexers[indexName]
+	if !ok {
+		return c.VirtualMachineNetworkConfigCache.GetByIndex(indexName, key)
+	}
+
+	vmNetCfgs, err := c.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var result []*networkv1.VirtualMachineNetworkConfig
+	for _, vmNetCfg := range vmNetCfgs {
+		values, _ := indexFunc(vmNetCfg)
+		for _, value := range values {
+			if value == key {
+				result = append(result, vmNetCfg)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func TestValidator_Delete(t *testing.T) {
+	type input struct {
+		ipPool    *networkv1.IPPool
+		vmNetCfgs []*networkv1.VirtualMachineNetworkConfig
+	}
+
+	type output struct {
+		err error
+	}
+
+	// newTestPopulatedIPPoolBuilder returns the builder of an IPPool leasing
+	// one IP address to each of the given MAC addresses, besides an excluded
+	// and a reserved one.
+	newTestPopulatedIPPoolBuilder := func(macAddresses ...string) *ippool.IPPoolBuilder {
+		b := newTestIPPoolBuilder().
+			CIDR(testCIDR).
+			ServerIP(testServerIPWithinRange).
+			NetworkName(testNetworkName).
+			AllocationEntry(testServerIPWithinRange, networkv1.AllocationTypeReserved, "").
+			AllocationEntry(testExcludedIP, networkv1.AllocationTypeExcluded, "")
+		for i, macAddress := range macAddresses {
+			b = b.AllocationEntry(fmt.Sprintf("192.168.0.%d", 10+i), networkv1.AllocationTypeLease, macAddress)
+		}
+		return b
+	}
+
+	var (
+		macAddresses []string
+		vmNetCfgs    []*networkv1.VirtualMachineNetworkConfig
+	)
+	for i := 0; i < 7; i++ {
+		macAddress := fmt.Sprintf("11:22:33:44:55:%02x", i)
+		macAddresses = append(macAddresses, macAddress)
+		vmNetCfgs = append(vmNetCfgs, vmnetcfg.NewVmNetCfgBuilder(testNADNamespace, fmt.Sprintf("vm-%d", i)).
+			WithNetworkConfig("", macAddress, testNetworkName).Build())
+	}
+
+	testCases := []struct {
+		name     string
+		given    input
+		expected output
+	}{
+		{
+			name: "empty pool",
+			given: input{
+				ipPool: newTestPopulatedIPPoolBuilder().Build(),
+			},
+		},
+		{
+			name: "populated pool",
+			given: input{
+				ipPool:    newTestPopulatedIPPoolBuilder(macAddresses[0], macAddresses[1]).Build(),
+				vmNetCfgs: vmNetCfgs[:2],
+			},
+			expected: output{
+				err: fmt.Errorf("cannot delete IPPool %s/%s because it still has 2 outstanding lease(s) held by default/vm-0, default/vm-1, which must be released at first", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "populated pool with more holders than listed",
+			given: input{
+				ipPool:    newTestPopulatedIPPoolBuilder(macAddresses...).Build(),
+				vmNetCfgs: vmNetCfgs,
+			},
+			expected: output{
+				err: fmt.Errorf("cannot delete IPPool %s/%s because it still has 7 outstanding lease(s) held by default/vm-0, default/vm-1, default/vm-2, default/vm-3, default/vm-4 and 2 more, which must be released at first", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "populated pool with a lease left behind by a removed vmnetcfg",
+			given: input{
+				ipPool: newTestPopulatedIPPoolBuilder("11:22:33:44:55:FF").Build(),
+			},
+			expected: output{
+				err: fmt.Errorf("cannot delete IPPool %s/%s because it still has 1 outstanding lease(s) held by mac 11:22:33:44:55:ff, which must be released at first", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "empty pool awaited by a pending vmnetcfg",
+			given: input{
+				ipPool:    newTestPopulatedIPPoolBuilder().Build(),
+				vmNetCfgs: vmNetCfgs[:1],
+			},
+			expected: output{
+				err: fmt.Errorf("cannot delete IPPool %s/%s because it's still awaited by pending VirtualMachineNetworkConfig(s) default/vm-0, which must be removed at first", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "empty pool awaited by a pending vmnetcfg given the network without a namespace",
+			given: input{
+				ipPool: newTestPopulatedIPPoolBuilder().Build(),
+				vmNetCfgs: []*networkv1.VirtualMachineNetworkConfig{
+					vmnetcfg.NewVmNetCfgBuilder(testNADNamespace, "vm-unqualified").
+						WithNetworkConfig("", macAddresses[0], testNADName).Build(),
+				},
+			},
+			expected: output{
+				err: fmt.Errorf("cannot delete IPPool %s/%s because it's still awaited by pending VirtualMachineNetworkConfig(s) default/vm-unqualified, which must be removed at first", testIPPoolNamespace, testIPPoolName),
+			},
+		},
+		{
+			name: "empty pool with vmnetcfgs allocated elsewhere, on other networks, or being deleted",
+			given: input{
+				ipPool: newTestPopulatedIPPoolBuilder().Build(),
+				vmNetCfgs: []*networkv1.VirtualMachineNetworkConfig{
+					vmnetcfg.NewVmNetCfgBuilder(testNADNamespace, "vm-overflowed").
+						WithNetworkConfig("", macAddresses[0], testNetworkName).
+						WithNetworkConfigStatus("192.168.0.50", macAddresses[0], testNetworkName, networkv1.AllocatedState).Build(),
+					vmnetcfg.NewVmNetCfgBuilder(testNADNamespace, "vm-other-network").
+						WithNetworkConfig("", macAddresses[1], testNADNamespace+"/net-2").Build(),
+					func() *networkv1.VirtualMachineNetworkConfig {
+						vmNetCfg := vmnetcfg.NewVmNetCfgBuilder(testNADNamespace, "vm-deleted").
+							WithNetworkConfig("", macAddresses[2], testNetworkName).Build()
+						vmNetCfg.Finalizers = []string{"wrangler.cattle.io/vm-dhcp-vmnetcfg-controller"}
+						vmNetCfg.DeletionTimestamp = &metav1.Time{}
+						return vmNetCfg
+					}(),
+				},
+			},
+		},
+		{
+			name: "populated pool forced to be deleted",
+			given: input{
+				ipPool: newTestPopulatedIPPoolBuilder(macAddresses...).
+					Annotation(util.ForceDeleteAnnotationKey, "true").Build(),
+				vmNetCfgs: vmNetCfgs,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		clientset := fake.NewSimpleClientset()
+		for _, vmNetCfg := range tc.given.vmNetCfgs {
+			err := clientset.Tracker().Add(vmNetCfg)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		}
+
+		nadCache := fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions)
+		ippoolCache := fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools)
+		vmnetCache := indexedVmNetCfgCache{fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)}
+		validator := NewValidator(testServiceCIDR, util.DefaultMaxPoolSize, nadCache, ippoolCache, vmnetCache)
+
+		err := validator.Delete(&admission.Request{}, tc.given.ipPool)
+
+		if tc.expected.err != nil {
+			assert.Equal(t, tc.expected.err.Error(), err.Error(), tc.name)
+		} else {
+			assert.Nil(t, err, tc.name)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/harvester/webhook/pkg/server/admission"
+	"github.com/rancher/wrangler/v3/pkg/kv"
+	"github.com/sirupsen/logrus"
+	admissionregv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+)
+
+// Mutator restores the MAC addresses of a VM being created from the
+// VirtualMachineNetworkConfig left by the VM of the same name, e.g., one
+// restored from a backup or re-applied by GitOps, so it keeps its leases.
+type Mutator struct {
+	admission.DefaultMutator
+
+	vmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache
+}
+
+func NewMutator(vmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache) *Mutator {
+	return &Mutator{
+		vmnetcfgCache: vmnetcfgCache,
+	}
+}
+
+// Create gives the interfaces without a MAC address the one the
+// VirtualMachineNetworkConfig of the VM lists on their network, and records
+// them in the MAC address annotation as well. MAC addresses set in the spec
+// or in the annotation are never overwritten, and are never handed to another
+// interface. The network configs left without an interface are left out, the
+// vm controller dropping them once the VM is created. A
+// VirtualMachineNetworkConfig being deleted is skipped, its leases being
+// already released. Failing to look up the
+// VirtualMachineNetworkConfig never fails the creation of the VM, as it's
+// only about keeping the leases.
+func (m *Mutator) Create(_ *admission.Request, newObj runtime.Object) (admission.Patch, error) {
+	vm := newObj.(*kubevirtv1.VirtualMachine)
+	if vm.Spec.Template == nil {
+		return nil, nil
+	}
+
+	vmNetCfg, err := m.vmnetcfgCache.Get(vm.Namespace, vm.Name)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		logrus.Warnf("skip restoring mac addresses of vm %s/%s: %s", vm.Namespace, vm.Name, err.Error())
+		return nil, nil
+	}
+	if vmNetCfg.DeletionTimestamp != nil {
+		logrus.Infof("skip restoring mac addresses of vm %s/%s: vmnetcfg is being deleted", vm.Namespace, vm.Name)
+		return nil, nil
+	}
+
+	macAddresses, annotationValid := parseMACAddressAnnotation(vm)
+
+	// The MAC addresses already taken by the incoming VM
+	taken := make(map[string]struct{})
+	for _, nic := range vm.Spec.Template.Spec.Domain.Devices.Interfaces {
+		if nic.MacAddress != "" {
+			taken[util.NormalizeMAC(nic.MacAddress)] = struct{}{}
+		}
+	}
+	for _, macAddress := range macAddresses {
+		taken[util.NormalizeMAC(macAddress)] = struct{}{}
+	}
+
+	// The MAC addresses of the VirtualMachineNetworkConfig by network, in
+	// the order they're listed
+	stored := make(map[string][]string)
+	for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+		macAddress, err := util.ParseMAC(nc.MACAddress)
+		if err != nil {
+			continue
+		}
+		if _, ok := taken[macAddress]; ok {
+			continue
+		}
+		networkName := qualifiedNetworkName(vm.Namespace, nc.NetworkName)
+		stored[networkName] = append(stored[networkName], macAddress)
+	}
+
+	multusNetworks := make(map[string]string, len(vm.Spec.Template.Spec.Networks))
+	for _, network := range vm.Spec.Template.Spec.Networks {
+		if network.Multus != nil {
+			multusNetworks[network.Name] = qualifiedNetworkName(vm.Namespace, network.Multus.NetworkName)
+		}
+	}
+
+	var patch admission.Patch
+	restored := make(map[string]string)
+	for i, nic := range vm.Spec.Template.Spec.Domain.Devices.Interfaces {
+		if nic.MacAddress != "" {
+			continue
+		}
+		if _, ok := macAddresses[nic.Name]; ok {
+			continue
+		}
+		networkName, ok := multusNetworks[nic.Name]
+		if !ok || len(stored[networkName]) == 0 {
+			continue
+		}
+
+		macAddress := stored[networkName][0]
+		stored[networkName] = stored[networkName][1:]
+		restored[nic.Name] = macAddress
+		logrus.Infof("restore mac address %s of interface %s on vm %s/%s from vmnetcfg %s/%s",
+			macAddress, nic.Name, vm.Namespace, vm.Name, vmNetCfg.Namespace, vmNetCfg.Name)
+		patch = append(patch, admission.PatchOp{
+			Op:    admission.PatchOpAdd,
+			Path:  fmt.Sprintf("/spec/template/spec/domain/devices/interfaces/%d/macAddress", i),
+			Value: macAddress,
+		})
+	}
+
+	for networkName, leftover := range stored {
+		if len(leftover) > 0 {
+			logrus.Infof("leave out mac address(es) %s of vmnetcfg %s/%s on network %s, which no interface of vm %s/%s is left for",
+				strings.Join(leftover, ", "), vmNetCfg.Namespace, vmNetCfg.Name, networkName, vm.Namespace, vm.Name)
+		}
+	}
+
+	if len(restored) == 0 || !annotationValid {
+		return patch, nil
+	}
+
+	for nicName, macAddress := range macAddresses {
+		restored[nicName] = macAddress
+	}
+	value, err := json.Marshal(restored)
+	if err != nil {
+		return patch, nil
+	}
+	if vm.Annotations == nil {
+		return append(patch, admission.PatchOp{
+			Op:    admission.PatchOpAdd,
+			Path:  "/metadata/annotations",
+			Value: map[string]string{util.MACAddressAnnotationKey: string(value)},
+		}), nil
+	}
+	return append(patch, admission.PatchOp{
+		Op:    admission.PatchOpAdd,
+		Path:  "/metadata/annotations/" + strings.ReplaceAll(util.MACAddressAnnotationKey, "/", "~1"),
+		Value: string(value),
+	}), nil
+}
+
+func (m *Mutator) Resource() admission.Resource {
+	return admission.Resource{
+		Names:      []string{"virtualmachines"},
+		Scope:      admissionregv1.NamespacedScope,
+		APIGroup:   kubevirtv1.SchemeGroupVersion.Group,
+		APIVersion: kubevirtv1.SchemeGroupVersion.Version,
+		ObjectType: &kubevirtv1.VirtualMachine{},
+		OperationTypes: []admissionregv1.OperationType{
+			admissionregv1.Create,
+		},
+	}
+}
+
+// parseMACAddressAnnotation returns the MAC addresses of the interfaces named
+// in the MAC address annotation of the VM, and whether the annotation, if
+// any, could be parsed. An annotation which can't be parsed is left alone.
+func parseMACAddressAnnotation(vm *kubevirtv1.VirtualMachine) (map[string]string, bool) {
+	annotation, ok := vm.Annotations[util.MACAddressAnnotationKey]
+	if !ok || annotation == "" {
+		return nil, true
+	}
+
+	var macAddresses map[string]string
+	if err := json.Unmarshal([]byte(annotation), &macAddresses); err != nil {
+		logrus.Warnf("failed to parse mac address annotation of vm %s/%s: %s", vm.Namespace, vm.Name, err.Error())
+		return nil, false
+	}
+	return macAddresses, true
+}
+
+// qualifiedNetworkName returns the network in the namespace/name form, a
+// network given without a namespace being the one of the VM.
+func qualifiedNetworkName(namespace, networkName string) string {
+	nadNamespace, nadName := kv.RSplit(networkName, "/")
+	if nadNamespace == "" {
+		nadNamespace = namespace
+	}
+	return nadNamespace + "/" + nadName
+}
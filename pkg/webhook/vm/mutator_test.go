@@ -0,0 +1,156 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/harvester/webhook/pkg/server/admission"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/vmnetcfg"
+	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
+)
+
+const (
+	testNamespace = "default"
+	testVMName    = "vm-1"
+	testMAC1      = "fa:cf:8e:50:82:01"
+	testMAC2      = "fa:cf:8e:50:82:02"
+	testMAC3      = "fa:cf:8e:50:82:03"
+)
+
+func deleting(vmNetCfg *networkv1.VirtualMachineNetworkConfig) *networkv1.VirtualMachineNetworkConfig {
+	now := metav1.Now()
+	vmNetCfg.DeletionTimestamp = &now
+	vmNetCfg.Finalizers = []string{"wrangler.cattle.io/vm-dhcp-vmnetcfg-controller"}
+	return vmNetCfg
+}
+
+type testNIC struct {
+	name        string
+	networkName string
+	macAddress  string
+}
+
+func newTestVM(annotations map[string]string, nics ...testNIC) *kubevirtv1.VirtualMachine {
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   testNamespace,
+			Name:        testVMName,
+			Annotations: annotations,
+		},
+		Spec: kubevirtv1.VirtualMachineSpec{
+			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{},
+		},
+	}
+	for _, nic := range nics {
+		vm.Spec.Template.Spec.Domain.Devices.Interfaces = append(vm.Spec.Template.Spec.Domain.Devices.Interfaces, kubevirtv1.Interface{
+			Name:       nic.name,
+			MacAddress: nic.macAddress,
+		})
+		vm.Spec.Template.Spec.Networks = append(vm.Spec.Template.Spec.Networks, kubevirtv1.Network{
+			Name: nic.name,
+			NetworkSource: kubevirtv1.NetworkSource{
+				Multus: &kubevirtv1.MultusNetwork{NetworkName: nic.networkName},
+			},
+		})
+	}
+	return vm
+}
+
+func TestMutator_Create(t *testing.T) {
+	annotationPath := "/metadata/annotations/harvesterhci.io~1mac-address"
+
+	testCases := []struct {
+		name     string
+		vmNetCfg *networkv1.VirtualMachineNetworkConfig
+		vm       *kubevirtv1.VirtualMachine
+		expected admission.Patch
+	}{
+		{
+			name: "no vmnetcfg left",
+			vm:   newTestVM(nil, testNIC{name: "nic-1", networkName: "default/net-1"}),
+		},
+		{
+			name: "mac addresses restored by network",
+			vmNetCfg: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVMName).
+				WithNetworkConfig("", testMAC1, "default/net-1").
+				WithNetworkConfig("", testMAC2, "net-2").Build(),
+			vm: newTestVM(nil,
+				testNIC{name: "nic-2", networkName: "default/net-2"},
+				testNIC{name: "nic-1", networkName: "net-1"}),
+			expected: admission.Patch{
+				{Op: admission.PatchOpAdd, Path: "/spec/template/spec/domain/devices/interfaces/0/macAddress", Value: testMAC2},
+				{Op: admission.PatchOpAdd, Path: "/spec/template/spec/domain/devices/interfaces/1/macAddress", Value: testMAC1},
+				{Op: admission.PatchOpAdd, Path: "/metadata/annotations", Value: map[string]string{
+					util.MACAddressAnnotationKey: `{"nic-1":"fa:cf:8e:50:82:01","nic-2":"fa:cf:8e:50:82:02"}`,
+				}},
+			},
+		},
+		{
+			name: "mac addresses set in the spec or the annotation kept",
+			vmNetCfg: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVMName).
+				WithNetworkConfig("", testMAC1, "default/net-1").
+				WithNetworkConfig("", testMAC2, "default/net-1").
+				WithNetworkConfig("", testMAC3, "default/net-1").Build(),
+			vm: newTestVM(map[string]string{util.MACAddressAnnotationKey: `{"nic-2":"FA:CF:8E:50:82:01"}`},
+				testNIC{name: "nic-1", networkName: "default/net-1", macAddress: testMAC3},
+				testNIC{name: "nic-2", networkName: "default/net-1"},
+				testNIC{name: "nic-3", networkName: "default/net-1"}),
+			expected: admission.Patch{
+				{Op: admission.PatchOpAdd, Path: "/spec/template/spec/domain/devices/interfaces/2/macAddress", Value: testMAC2},
+				{Op: admission.PatchOpAdd, Path: annotationPath, Value: `{"nic-2":"FA:CF:8E:50:82:01","nic-3":"fa:cf:8e:50:82:02"}`},
+			},
+		},
+		{
+			name: "interfaces gone from the vm",
+			vmNetCfg: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVMName).
+				WithNetworkConfig("", testMAC1, "default/net-1").
+				WithNetworkConfig("", testMAC2, "default/net-2").Build(),
+			vm: newTestVM(map[string]string{"foo": "bar"}, testNIC{name: "nic-1", networkName: "default/net-1"}),
+			expected: admission.Patch{
+				{Op: admission.PatchOpAdd, Path: "/spec/template/spec/domain/devices/interfaces/0/macAddress", Value: testMAC1},
+				{Op: admission.PatchOpAdd, Path: annotationPath, Value: `{"nic-1":"fa:cf:8e:50:82:01"}`},
+			},
+		},
+		{
+			name:     "vmnetcfg being deleted",
+			vmNetCfg: deleting(vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVMName).WithNetworkConfig("", testMAC1, "default/net-1").Build()),
+			vm:       newTestVM(nil, testNIC{name: "nic-1", networkName: "default/net-1"}),
+		},
+		{
+			name: "interfaces on other networks",
+			vmNetCfg: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVMName).
+				WithNetworkConfig("", testMAC1, "default/net-1").Build(),
+			vm: newTestVM(nil, testNIC{name: "nic-1", networkName: "other/net-1"}),
+		},
+		{
+			name: "unparsable annotation left alone",
+			vmNetCfg: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVMName).
+				WithNetworkConfig("", testMAC1, "default/net-1").Build(),
+			vm: newTestVM(map[string]string{util.MACAddressAnnotationKey: "nic-1"}, testNIC{name: "nic-1", networkName: "default/net-1"}),
+			expected: admission.Patch{
+				{Op: admission.PatchOpAdd, Path: "/spec/template/spec/domain/devices/interfaces/0/macAddress", Value: testMAC1},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			if tc.vmNetCfg != nil {
+				err := clientset.Tracker().Add(tc.vmNetCfg)
+				assert.Nil(t, err, "mock resource should add into fake controller tracker")
+			}
+
+			mutator := NewMutator(fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs))
+			patch, err := mutator.Create(&admission.Request{}, tc.vm)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, patch)
+		})
+	}
+}
@@ -2,11 +2,14 @@ package vmnetcfg
 
 import (
 	"fmt"
+	"net/netip"
+	"strings"
 
 	admissionregv1 "k8s.io/api/admissionregistration/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 
 	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
 	ctlcniv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/k8s.cni.cncf.io/v1"
 	ctlnetworkv1 "github.com/harvester/vm-dhcp-controller/pkg/generated/controllers/network.harvesterhci.io/v1alpha1"
 	"github.com/harvester/vm-dhcp-controller/pkg/util"
@@ -18,14 +21,23 @@ import (
 type Validator struct {
 	admission.DefaultValidator
 
-	nadCache    ctlcniv1.NetworkAttachmentDefinitionCache
-	ippoolCache ctlnetworkv1.IPPoolCache
+	nadCache      ctlcniv1.NetworkAttachmentDefinitionCache
+	ippoolCache   ctlnetworkv1.IPPoolCache
+	vmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache
+	featureGates  *featuregate.Gates
 }
 
-func NewValidator(nadCache ctlcniv1.NetworkAttachmentDefinitionCache, ippoolCache ctlnetworkv1.IPPoolCache) *Validator {
+func NewValidator(
+	nadCache ctlcniv1.NetworkAttachmentDefinitionCache,
+	ippoolCache ctlnetworkv1.IPPoolCache,
+	vmnetcfgCache ctlnetworkv1.VirtualMachineNetworkConfigCache,
+	featureGates *featuregate.Gates,
+) *Validator {
 	return &Validator{
-		nadCache:    nadCache,
-		ippoolCache: ippoolCache,
+		nadCache:      nadCache,
+		ippoolCache:   ippoolCache,
+		vmnetcfgCache: vmnetcfgCache,
+		featureGates:  featureGates,
 	}
 }
 
@@ -33,17 +45,242 @@ func (v *Validator) Create(request *admission.Request, newObj runtime.Object) er
 	vmNetCfg := newObj.(*networkv1.VirtualMachineNetworkConfig)
 	logrus.Infof("create vmnetcfg %s/%s", vmNetCfg.Namespace, vmNetCfg.Name)
 
+	if err := checkMACAddresses(vmNetCfg, nil); err != nil {
+		return fmt.Errorf(webhook.CreateErr, vmNetCfg.Kind, vmNetCfg.Namespace, vmNetCfg.Name, err)
+	}
+	if err := checkDuplicateMACAddresses(vmNetCfg); err != nil {
+		return fmt.Errorf(webhook.CreateErr, vmNetCfg.Kind, vmNetCfg.Namespace, vmNetCfg.Name, err)
+	}
+	if err := checkCNIContainer(vmNetCfg, v.featureGates); err != nil {
+		return fmt.Errorf(webhook.CreateErr, vmNetCfg.Kind, vmNetCfg.Namespace, vmNetCfg.Name, err)
+	}
+
+	if err := v.checkMACAddressesInUse(vmNetCfg, nil); err != nil {
+		return fmt.Errorf(webhook.CreateErr, vmNetCfg.Kind, vmNetCfg.Namespace, vmNetCfg.Name, err)
+	}
+
+	var defaultRouteNetworks []string
 	for _, nc := range vmNetCfg.Spec.NetworkConfigs {
 		// Use shared utility to look up IPPool via NAD labels
 		// Uses vmNetCfg.Namespace as fallback for unqualified network names
-		if _, err := util.GetIPPoolFromNetworkName(v.nadCache, v.ippoolCache, nc.NetworkName, vmNetCfg.Namespace); err != nil {
+		ipPool, err := util.GetIPPoolFromNetworkName(v.nadCache, v.ippoolCache, nc.NetworkName, vmNetCfg.Namespace)
+		if err != nil {
 			return fmt.Errorf(webhook.CreateErr, vmNetCfg.Kind, vmNetCfg.Namespace, vmNetCfg.Name, err)
 		}
+		if err := checkIPAddressFamily(nc, ipPool); err != nil {
+			return fmt.Errorf(webhook.CreateErr, vmNetCfg.Kind, vmNetCfg.Namespace, vmNetCfg.Name, err)
+		}
+		if ipPool.Spec.IPv4Config.Router != "" && util.DefaultRouteEnabled(ipPool, nc.DefaultRoute) {
+			defaultRouteNetworks = append(defaultRouteNetworks, nc.NetworkName)
+		}
+	}
+
+	// Competing default routes are a guest-side matter, so they're only
+	// warned about
+	if len(defaultRouteNetworks) > 1 {
+		logrus.Warnf("vmnetcfg %s/%s gets a default route on more than one network: %s",
+			vmNetCfg.Namespace, vmNetCfg.Name, strings.Join(defaultRouteNetworks, ", "))
+	}
+
+	return nil
+}
+
+func (v *Validator) Update(_ *admission.Request, oldObj, newObj runtime.Object) error {
+	oldVmNetCfg := oldObj.(*networkv1.VirtualMachineNetworkConfig)
+	vmNetCfg := newObj.(*networkv1.VirtualMachineNetworkConfig)
+
+	if vmNetCfg.DeletionTimestamp != nil {
+		return nil
+	}
+
+	if err := checkMACAddresses(vmNetCfg, oldVmNetCfg); err != nil {
+		return fmt.Errorf(webhook.UpdateErr, vmNetCfg.Kind, vmNetCfg.Namespace, vmNetCfg.Name, err)
+	}
+	if err := checkDuplicateMACAddresses(vmNetCfg); err != nil {
+		return fmt.Errorf(webhook.UpdateErr, vmNetCfg.Kind, vmNetCfg.Namespace, vmNetCfg.Name, err)
+	}
+	if err := checkAllocatedNetworkConfigs(oldVmNetCfg, vmNetCfg); err != nil {
+		return fmt.Errorf(webhook.UpdateErr, vmNetCfg.Kind, vmNetCfg.Namespace, vmNetCfg.Name, err)
+	}
+	if err := v.checkMACAddressesInUse(vmNetCfg, oldVmNetCfg); err != nil {
+		return fmt.Errorf(webhook.UpdateErr, vmNetCfg.Kind, vmNetCfg.Namespace, vmNetCfg.Name, err)
 	}
 
 	return nil
 }
 
+// checkAllocatedNetworkConfigs rejects changing the MAC address of a network
+// config holding an allocated IP address, or removing such a network config,
+// as the controller would never release the lease of the former MAC address.
+// Both are let through once the object is marked out-of-sync, which is how the
+// vm controller hands such changes over to the vmnetcfg controller to release
+// the leases. Network configs are told apart by their MAC address and network,
+// regardless of the notation of the MAC address.
+func checkAllocatedNetworkConfigs(old, vmNetCfg *networkv1.VirtualMachineNetworkConfig) error {
+	if networkv1.InSynced.IsFalse(old) {
+		return nil
+	}
+
+	type networkConfigKey struct {
+		macAddress  string
+		networkName string
+	}
+
+	allocated := make(map[networkConfigKey]string)
+	for _, ncStatus := range old.Status.NetworkConfigs {
+		if ncStatus.State == networkv1.AllocatedState && ncStatus.AllocatedIPAddress != "" {
+			allocated[networkConfigKey{util.NormalizeMAC(ncStatus.MACAddress), ncStatus.NetworkName}] = ncStatus.AllocatedIPAddress
+		}
+	}
+	if len(allocated) == 0 {
+		return nil
+	}
+
+	oldKeys := make(map[networkConfigKey]struct{}, len(old.Spec.NetworkConfigs))
+	for _, nc := range old.Spec.NetworkConfigs {
+		oldKeys[networkConfigKey{util.NormalizeMAC(nc.MACAddress), nc.NetworkName}] = struct{}{}
+	}
+	keys := make(map[networkConfigKey]struct{}, len(vmNetCfg.Spec.NetworkConfigs))
+	// addedMACs are the MAC addresses new to each network
+	addedMACs := make(map[string]string)
+	for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+		key := networkConfigKey{util.NormalizeMAC(nc.MACAddress), nc.NetworkName}
+		keys[key] = struct{}{}
+		if _, ok := oldKeys[key]; !ok {
+			addedMACs[nc.NetworkName] = nc.MACAddress
+		}
+	}
+
+	for _, nc := range old.Spec.NetworkConfigs {
+		key := networkConfigKey{util.NormalizeMAC(nc.MACAddress), nc.NetworkName}
+		ip, ok := allocated[key]
+		if !ok {
+			continue
+		}
+		if _, ok := keys[key]; ok {
+			continue
+		}
+		if macAddress, ok := addedMACs[nc.NetworkName]; ok {
+			return fmt.Errorf("mac address %s of network %s cannot be changed to %s while ip %s is allocated to it; mark the vmnetcfg out-of-sync first",
+				nc.MACAddress, nc.NetworkName, macAddress, ip)
+		}
+		return fmt.Errorf("network config of network %s cannot be removed while ip %s is allocated to %s; mark the vmnetcfg out-of-sync first",
+			nc.NetworkName, ip, nc.MACAddress)
+	}
+
+	return nil
+}
+
+// checkMACAddresses rejects network configs whose MAC address isn't a valid
+// 48-bit MAC address, as no agent could serve it. The ones already in old,
+// e.g., written before the check, are let through, so the object can still be
+// updated until the upgrade normalizes or an operator fixes them.
+func checkMACAddresses(vmNetCfg, old *networkv1.VirtualMachineNetworkConfig) error {
+	existing := make(map[string]struct{})
+	if old != nil {
+		for _, nc := range old.Spec.NetworkConfigs {
+			existing[nc.MACAddress] = struct{}{}
+		}
+	}
+
+	for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+		if _, ok := existing[nc.MACAddress]; ok {
+			continue
+		}
+		if _, err := util.ParseMAC(nc.MACAddress); err != nil {
+			return fmt.Errorf("network config of network %s: %w", nc.NetworkName, err)
+		}
+	}
+	return nil
+}
+
+// checkDuplicateMACAddresses rejects network configs sharing a MAC address,
+// as the agents would only serve one of the IP addresses allocated for them.
+func checkDuplicateMACAddresses(vmNetCfg *networkv1.VirtualMachineNetworkConfig) error {
+	_, duplicates := util.DedupNetworkConfigs(vmNetCfg.Spec.NetworkConfigs)
+	if len(duplicates) > 0 {
+		return fmt.Errorf("mac address %s is listed more than once", duplicates[0].MACAddress)
+	}
+	return nil
+}
+
+// checkMACAddressesInUse rejects network configs whose MAC address is already
+// listed on the same network by another VirtualMachineNetworkConfig, e.g., of
+// a VM cloned along with its MAC addresses, as the agents would serve both VMs
+// the same lease. The same MAC address on different networks is fine. The
+// network configs already in old are let through, so an existing duplicate
+// doesn't block the object from being updated, and so are the ones listed by
+// objects being deleted, whose leases are on their way out.
+func (v *Validator) checkMACAddressesInUse(vmNetCfg, old *networkv1.VirtualMachineNetworkConfig) error {
+	if v.vmnetcfgCache == nil {
+		return nil
+	}
+
+	existing := make(map[string]struct{})
+	if old != nil {
+		for _, nc := range old.Spec.NetworkConfigs {
+			existing[util.NetworkMACKey(old.Namespace, nc.NetworkName, nc.MACAddress)] = struct{}{}
+		}
+	}
+
+	getter := util.VmnetcfgGetter{VmnetcfgCache: v.vmnetcfgCache}
+	for _, nc := range vmNetCfg.Spec.NetworkConfigs {
+		if _, ok := existing[util.NetworkMACKey(vmNetCfg.Namespace, nc.NetworkName, nc.MACAddress)]; ok {
+			continue
+		}
+		others, err := getter.WhoHasMACOnNetwork(vmNetCfg.Namespace, nc.NetworkName, nc.MACAddress)
+		if err != nil {
+			return err
+		}
+		for _, other := range others {
+			if other.Namespace == vmNetCfg.Namespace && other.Name == vmNetCfg.Name {
+				continue
+			}
+			if other.DeletionTimestamp != nil {
+				continue
+			}
+			return fmt.Errorf("mac address %s of network %s is already used by vmnetcfg %s/%s",
+				nc.MACAddress, nc.NetworkName, other.Namespace, other.Name)
+		}
+	}
+
+	return nil
+}
+
+// checkIPAddressFamily rejects a requested static IP address whose family
+// differs from the one of the IPPool serving the network, as it could never be
+// allocated.
+func checkIPAddressFamily(nc networkv1.NetworkConfig, ipPool *networkv1.IPPool) error {
+	if nc.IPAddress == nil || *nc.IPAddress == "" {
+		return nil
+	}
+
+	ipAddr, err := netip.ParseAddr(*nc.IPAddress)
+	if err != nil {
+		return fmt.Errorf("ip address %s of network %s is not valid", *nc.IPAddress, nc.NetworkName)
+	}
+
+	prefix, err := netip.ParsePrefix(ipPool.Spec.IPv4Config.CIDR)
+	if err != nil {
+		// The IPPool itself is broken, which is up to its own validation
+		return nil
+	}
+
+	if ipAddr.Unmap().Is4() != prefix.Addr().Is4() {
+		return fmt.Errorf("ip address %s of network %s is %s while ippool %s/%s serves %s",
+			ipAddr, nc.NetworkName, addrFamily(ipAddr.Unmap()), ipPool.Namespace, ipPool.Name, addrFamily(prefix.Addr()))
+	}
+
+	return nil
+}
+
+func addrFamily(addr netip.Addr) string {
+	if addr.Is4() {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
 func (v *Validator) Resource() admission.Resource {
 	return admission.Resource{
 		Names:      []string{"virtualmachinenetworkconfigs"},
@@ -53,6 +290,16 @@ func (v *Validator) Resource() admission.Resource {
 		ObjectType: &networkv1.VirtualMachineNetworkConfig{},
 		OperationTypes: []admissionregv1.OperationType{
 			admissionregv1.Create,
+			admissionregv1.Update,
 		},
 	}
 }
+
+// checkCNIContainer admits the VirtualMachineNetworkConfigs recording the
+// allocations of containers only while the controller is meant to serve them.
+func checkCNIContainer(vmNetCfg *networkv1.VirtualMachineNetworkConfig, featureGates *featuregate.Gates) error {
+	if _, ok := vmNetCfg.Annotations[util.CNIContainerIDAnnotationKey]; !ok || featureGates.Enabled(featuregate.CNIIPAM) {
+		return nil
+	}
+	return fmt.Errorf("annotation %s requires feature gate %s", util.CNIContainerIDAnnotationKey, featuregate.CNIIPAM)
+}
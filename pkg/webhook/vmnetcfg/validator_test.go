@@ -0,0 +1,463 @@
+package vmnetcfg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/harvester/webhook/pkg/server/admission"
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	networkv1 "github.com/harvester/vm-dhcp-controller/pkg/apis/network.harvesterhci.io/v1alpha1"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/ippool"
+	"github.com/harvester/vm-dhcp-controller/pkg/controller/vmnetcfg"
+	"github.com/harvester/vm-dhcp-controller/pkg/featuregate"
+	"github.com/harvester/vm-dhcp-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/vm-dhcp-controller/pkg/indexer"
+	"github.com/harvester/vm-dhcp-controller/pkg/util"
+	"github.com/harvester/vm-dhcp-controller/pkg/util/fakeclient"
+)
+
+const (
+	testNamespace   = "default"
+	testNADName     = "net-1"
+	testVmNetCfg    = "test-vm"
+	testMACAddress  = "11:22:33:44:55:66"
+	testIPAddress   = "192.168.0.111"
+	testNetworkName = testNamespace + "/" + testNADName
+)
+
+func TestValidator_Create(t *testing.T) {
+	type input struct {
+		vmNetCfg     *networkv1.VirtualMachineNetworkConfig
+		ipPool       *networkv1.IPPool
+		nad          *cniv1.NetworkAttachmentDefinition
+		vmNetCfgs    []*networkv1.VirtualMachineNetworkConfig
+		featureGates *featuregate.Gates
+	}
+
+	type output struct {
+		err bool
+	}
+
+	vmNetCfg := vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+		WithNetworkConfig("", testMACAddress, testNetworkName).Build()
+	ipPool := ippool.NewIPPoolBuilder(testNamespace, testNADName).
+		NetworkName(testNetworkName).
+		CIDR("192.168.0.0/24").Build()
+	nad := ippool.NewNetworkAttachmentDefinitionBuilder(testNamespace, testNADName).
+		Label(util.IPPoolNamespaceLabelKey, testNamespace).
+		Label(util.IPPoolNameLabelKey, testNADName).Build()
+	cniVmNetCfg := vmnetcfg.NewVmNetCfgBuilder(testNamespace, "cni-0f3c2a1b9e8d").
+		Annotation(util.CNIContainerIDAnnotationKey, "0f3c2a1b9e8d").
+		WithNetworkConfig("", testMACAddress, testNetworkName).Build()
+	// Turned on in the ConfigMap shared with the controller
+	cniGates, err := featuregate.New(nil)
+	assert.Nil(t, err)
+	cniGates.SetFromConfigMap(map[string]string{string(featuregate.CNIIPAM): "true"})
+
+	testCases := []struct {
+		name     string
+		given    input
+		expected output
+	}{
+		{
+			name: "network with an ippool",
+			given: input{
+				ipPool: ipPool,
+				nad:    nad,
+			},
+		},
+		{
+			name: "network without an ippool",
+			given: input{
+				nad: nad,
+			},
+			expected: output{
+				err: true,
+			},
+		},
+		{
+			name: "static ip address of the family of the ippool",
+			given: input{
+				vmNetCfg: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+					WithNetworkConfig("192.168.0.10", testMACAddress, testNetworkName).Build(),
+				ipPool: ipPool,
+				nad:    nad,
+			},
+		},
+		{
+			name: "ipv6 static ip address on an ipv4 ippool",
+			given: input{
+				vmNetCfg: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+					WithNetworkConfig("fd00::10", testMACAddress, testNetworkName).Build(),
+				ipPool: ipPool,
+				nad:    nad,
+			},
+			expected: output{
+				err: true,
+			},
+		},
+		{
+			name: "mac address listed twice",
+			given: input{
+				vmNetCfg: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+					WithNetworkConfig("", testMACAddress, testNetworkName).
+					WithNetworkConfig("", strings.ToUpper(testMACAddress), testNamespace+"/net-2").Build(),
+				ipPool: ipPool,
+				nad:    nad,
+			},
+			expected: output{
+				err: true,
+			},
+		},
+		{
+			name: "mac addresses in other forms",
+			given: input{
+				vmNetCfg: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+					WithNetworkConfig("", "FA-CF-8E-50-82-FC", testNetworkName).
+					WithNetworkConfig("", "facf.8e50.82fd", testNetworkName).Build(),
+				ipPool: ipPool,
+				nad:    nad,
+			},
+		},
+		{
+			name: "invalid mac address",
+			given: input{
+				vmNetCfg: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+					WithNetworkConfig("", "fa:cf:8e:50:82", testNetworkName).Build(),
+				ipPool: ipPool,
+				nad:    nad,
+			},
+			expected: output{
+				err: true,
+			},
+		},
+		{
+			name: "vmnetcfg of a container without the feature",
+			given: input{
+				vmNetCfg: cniVmNetCfg,
+				ipPool:   ipPool,
+				nad:      nad,
+			},
+			expected: output{
+				err: true,
+			},
+		},
+		{
+			name: "vmnetcfg of a container with the feature",
+			given: input{
+				vmNetCfg:     cniVmNetCfg,
+				ipPool:       ipPool,
+				nad:          nad,
+				featureGates: cniGates,
+			},
+		},
+		{
+			name: "mac address in use on the same network",
+			given: input{
+				ipPool: ipPool,
+				nad:    nad,
+				vmNetCfgs: []*networkv1.VirtualMachineNetworkConfig{
+					vmnetcfg.NewVmNetCfgBuilder(testNamespace, "cloned-vm").
+						WithNetworkConfig("", strings.ToUpper(testMACAddress), testNetworkName).Build(),
+				},
+			},
+			expected: output{
+				err: true,
+			},
+		},
+		{
+			name: "mac address in use on the same network given without a namespace",
+			given: input{
+				ipPool: ipPool,
+				nad:    nad,
+				vmNetCfgs: []*networkv1.VirtualMachineNetworkConfig{
+					vmnetcfg.NewVmNetCfgBuilder(testNamespace, "cloned-vm").
+						WithNetworkConfig("", testMACAddress, testNADName).Build(),
+				},
+			},
+			expected: output{
+				err: true,
+			},
+		},
+		{
+			name: "mac address in use on another network",
+			given: input{
+				ipPool: ipPool,
+				nad:    nad,
+				vmNetCfgs: []*networkv1.VirtualMachineNetworkConfig{
+					vmnetcfg.NewVmNetCfgBuilder(testNamespace, "other-vm").
+						WithNetworkConfig("", testMACAddress, testNamespace+"/net-2").Build(),
+					vmnetcfg.NewVmNetCfgBuilder("other", "other-vm").
+						WithNetworkConfig("", testMACAddress, testNADName).Build(),
+				},
+			},
+		},
+		{
+			name: "mac address in use by a vmnetcfg being deleted",
+			given: input{
+				ipPool: ipPool,
+				nad:    nad,
+				vmNetCfgs: []*networkv1.VirtualMachineNetworkConfig{
+					func() *networkv1.VirtualMachineNetworkConfig {
+						vmNetCfg := vmnetcfg.NewVmNetCfgBuilder(testNamespace, "deleted-vm").
+							WithNetworkConfig("", testMACAddress, testNetworkName).Build()
+						vmNetCfg.Finalizers = []string{"wrangler.cattle.io/vm-dhcp-vmnetcfg-controller"}
+						vmNetCfg.DeletionTimestamp = &metav1.Time{}
+						return vmNetCfg
+					}(),
+				},
+			},
+		},
+	}
+
+	nadGVR := schema.GroupVersionResource{
+		Group:    "k8s.cni.cncf.io",
+		Version:  "v1",
+		Resource: "network-attachment-definitions",
+	}
+
+	for _, tc := range testCases {
+		clientset := fake.NewSimpleClientset()
+		err := clientset.Tracker().Create(nadGVR, tc.given.nad, tc.given.nad.Namespace)
+		assert.Nil(t, err, "mock resource should add into fake controller tracker")
+
+		if tc.given.ipPool != nil {
+			err := clientset.Tracker().Add(tc.given.ipPool)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		}
+		for _, vmNetCfg := range tc.given.vmNetCfgs {
+			err := clientset.Tracker().Add(vmNetCfg)
+			assert.Nil(t, err, "mock resource should add into fake controller tracker")
+		}
+
+		nadCache := fakeclient.NetworkAttachmentDefinitionCache(clientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions)
+		ippoolCache := fakeclient.IPPoolCache(clientset.NetworkV1alpha1().IPPools)
+		vmnetcfgCache := indexedVmNetCfgCache{fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)}
+		validator := NewValidator(nadCache, ippoolCache, vmnetcfgCache, tc.given.featureGates)
+
+		givenVmNetCfg := vmNetCfg
+		if tc.given.vmNetCfg != nil {
+			givenVmNetCfg = tc.given.vmNetCfg
+		}
+
+		err = validator.Create(&admission.Request{}, givenVmNetCfg)
+
+		if tc.expected.err {
+			assert.NotNil(t, err, tc.name)
+		} else {
+			assert.Nil(t, err, tc.name)
+		}
+	}
+}
+
+func TestValidator_Update(t *testing.T) {
+	testCases := []struct {
+		name  string
+		given *networkv1.VirtualMachineNetworkConfig
+		// old is the object being updated, given if it differs
+		old      *networkv1.VirtualMachineNetworkConfig
+		expected bool
+	}{
+		{
+			name: "distinct mac addresses",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNetworkName).Build(),
+		},
+		{
+			name: "mac address listed twice",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).
+				WithNetworkConfig("", testMACAddress, testNamespace+"/net-2").Build(),
+			expected: true,
+		},
+		{
+			name: "invalid mac address added",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).
+				WithNetworkConfig("", "not-a-mac", testNamespace+"/net-2").Build(),
+			old: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).Build(),
+			expected: true,
+		},
+		{
+			name: "invalid mac address kept",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", "not-a-mac", testNetworkName).Build(),
+		},
+		{
+			name: "mac address of allocated network config changed",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNetworkName).
+				WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).Build(),
+			old: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).
+				WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).Build(),
+			expected: true,
+		},
+		{
+			name: "mac address of allocated network config changed while out-of-sync",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNetworkName).
+				WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).
+				InSyncedCondition(corev1.ConditionFalse, "NetworkConfigChanged", "").Build(),
+			old: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).
+				WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).
+				InSyncedCondition(corev1.ConditionFalse, "NetworkConfigChanged", "").Build(),
+		},
+		{
+			name: "mac address of allocated network config renotated",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", "11-22-33-44-55-66", testNetworkName).
+				WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).Build(),
+			old: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).
+				WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).Build(),
+		},
+		{
+			name: "mac address of pending network config changed",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNetworkName).
+				WithNetworkConfigStatus("", testMACAddress, testNetworkName, networkv1.PendingState).Build(),
+			old: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).
+				WithNetworkConfigStatus("", testMACAddress, testNetworkName, networkv1.PendingState).Build(),
+		},
+		{
+			name: "allocated network config removed",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNamespace+"/net-2").
+				WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).Build(),
+			old: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNamespace+"/net-2").
+				WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).Build(),
+			expected: true,
+		},
+		{
+			name: "allocated network config removed while out-of-sync",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNamespace+"/net-2").
+				WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).
+				InSyncedCondition(corev1.ConditionFalse, "NetworkConfigChanged", "").Build(),
+			old: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNamespace+"/net-2").
+				WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).
+				InSyncedCondition(corev1.ConditionFalse, "NetworkConfigChanged", "").Build(),
+		},
+		{
+			name: "allocated vmnetcfg deleted",
+			given: func() *networkv1.VirtualMachineNetworkConfig {
+				vmNetCfg := vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+					WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).Build()
+				vmNetCfg.DeletionTimestamp = &metav1.Time{}
+				return vmNetCfg
+			}(),
+			old: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).
+				WithNetworkConfigStatus(testIPAddress, testMACAddress, testNetworkName, networkv1.AllocatedState).Build(),
+		},
+	}
+
+	validator := NewValidator(nil, nil, nil, nil)
+
+	for _, tc := range testCases {
+		old := tc.old
+		if old == nil {
+			old = tc.given
+		}
+		err := validator.Update(&admission.Request{}, old, tc.given)
+		if tc.expected {
+			assert.NotNil(t, err, tc.name)
+		} else {
+			assert.Nil(t, err, tc.name)
+		}
+	}
+}
+
+func TestValidator_UpdateMACAddressInUse(t *testing.T) {
+	other := vmnetcfg.NewVmNetCfgBuilder(testNamespace, "cloned-vm").
+		WithNetworkConfig("", testMACAddress, testNetworkName).Build()
+
+	testCases := []struct {
+		name     string
+		given    *networkv1.VirtualMachineNetworkConfig
+		old      *networkv1.VirtualMachineNetworkConfig
+		expected bool
+	}{
+		{
+			name: "mac address in use added",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNetworkName).
+				WithNetworkConfig("", testMACAddress, testNetworkName).Build(),
+			old: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNetworkName).Build(),
+			expected: true,
+		},
+		{
+			name: "mac address in use kept",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNetworkName).Build(),
+			old: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNetworkName).Build(),
+		},
+		{
+			name: "mac address in use moved to another network",
+			given: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", testMACAddress, testNamespace+"/net-2").Build(),
+			old: vmnetcfg.NewVmNetCfgBuilder(testNamespace, testVmNetCfg).
+				WithNetworkConfig("", "22:33:44:55:66:77", testNamespace+"/net-2").Build(),
+		},
+	}
+
+	clientset := fake.NewSimpleClientset(other)
+	vmnetcfgCache := indexedVmNetCfgCache{fakeclient.VirtualMachineNetworkConfigCache(clientset.NetworkV1alpha1().VirtualMachineNetworkConfigs)}
+	validator := NewValidator(nil, nil, vmnetcfgCache, nil)
+
+	for _, tc := range testCases {
+		err := validator.Update(&admission.Request{}, tc.old, tc.given)
+		if tc.expected {
+			assert.ErrorContains(t, err,
+				"mac address "+testMACAddress+" of network "+testNetworkName+" is already used by vmnetcfg "+testNamespace+"/cloned-vm", tc.name)
+		} else {
+			assert.Nil(t, err, tc.name)
+		}
+	}
+}
+
+// indexedVmNetCfgCache serves the indexes the webhook adds to the vmnetcfg
+// cache.
+type indexedVmNetCfgCache struct {
+	fakeclient.VirtualMachineNetworkConfigCache
+}
+
+func (c indexedVmNetCfgCache) GetByIndex(indexName, key string) ([]*networkv1.VirtualMachineNetworkConfig, error) {
+	if indexName != indexer.VmNetCfgByNetworkMACIndex {
+		return c.VirtualMachineNetworkConfigCache.GetByIndex(indexName, key)
+	}
+
+	vmNetCfgs, err := c.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var result []*networkv1.VirtualMachineNetworkConfig
+	for _, vmNetCfg := range vmNetCfgs {
+		keys, _ := util.VmNetCfgByNetworkMAC(vmNetCfg)
+		for _, k := range keys {
+			if k == key {
+				result = append(result, vmNetCfg)
+				break
+			}
+		}
+	}
+	return result, nil
+}